@@ -0,0 +1,223 @@
+package goreplay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Paths of admin API endpoints
+const (
+	adminLimits     = "/limits"
+	adminLimitsStep = "/limits/step"
+	adminMetrics    = "/metrics"
+	adminPlugins    = "/plugins"
+	adminOutputs    = "/outputs"
+)
+
+var errAdminNotFound = errors.New("not found")
+
+type adminLimit struct {
+	ID     int    `json:"id"`
+	Plugin string `json:"plugin"`
+	Limit  string `json:"limit"`
+}
+
+// adminPlugin is input or output, identified by its number among inputs or outputs in order of command line
+type adminPlugin struct {
+	ID     int    `json:"id"`
+	Plugin string `json:"plugin"`
+	Output bool   `json:"output"`
+	// Number of limiter of plugin, 0 if plugin is not limited
+	Limiter int    `json:"limiter,omitempty"`
+	Limit   string `json:"limit,omitempty"`
+	Paused  bool   `json:"paused"`
+}
+
+// adminServer serves API controlling running gor. Limits of plugins are listed and changed at runtime, so intensity
+// of replay can be tuned during test without restarting it.
+//
+//	GET  /limits                 list limiters in order of command line
+//	PUT  /limits/<id>?limit=20%  set limit of limiter, in the same format as after "|"
+//	POST /limits/step?steps=-1   step limits of all limiters up or down, like SIGUSR1 and SIGUSR2 do
+//	GET  /plugins                list inputs and outputs, with their limits and if they are paused
+//	PUT  /outputs/<id>?paused=1  pause output, payloads are dropped until it is resumed with paused=0
+//	GET  /metrics                latency percentiles of output-http targets and GraphQL operations, watchdog alarms, memory budget and dropped payloads in Prometheus text format
+//
+// The same operations are served over gRPC by serveAdminGRPC.
+type adminServer struct {
+	plugins *InOutPlugins
+}
+
+func newAdminServer(plugins *InOutPlugins) http.Handler {
+	return &adminServer{plugins: plugins}
+}
+
+func (s *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == adminLimits && r.Method == http.MethodGet:
+		s.writeLimits(w)
+	case r.URL.Path == adminMetrics && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeAdminMetrics(w)
+	case r.URL.Path == adminPlugins && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.listPlugins())
+	case strings.HasPrefix(r.URL.Path, adminOutputs+"/") && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, adminOutputs+"/"))
+		if err != nil || id < 1 || id > len(s.plugins.Outputs) {
+			http.NotFound(w, r)
+			return
+		}
+
+		paused, err := strconv.ParseBool(r.FormValue("paused"))
+		if err != nil {
+			http.Error(w, "paused should be boolean", http.StatusBadRequest)
+			return
+		}
+		s.pauseOutputs([]int{id}, paused)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.listPlugins())
+	case r.URL.Path == adminLimitsStep && r.Method == http.MethodPost:
+		steps, err := strconv.Atoi(r.FormValue("steps"))
+		if err != nil {
+			http.Error(w, "steps should be integer", http.StatusBadRequest)
+			return
+		}
+
+		stepLimits(s.plugins, steps)
+		s.writeLimits(w)
+	case strings.HasPrefix(r.URL.Path, adminLimits+"/") && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, adminLimits+"/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if err := s.setLimit(id, r.FormValue("limit")); err == errAdminNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.writeLimits(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// setLimit sets limit of limiter with given number
+func (s *adminServer) setLimit(id int, limit string) error {
+	if id < 1 || id > len(s.plugins.Limiters) {
+		return errAdminNotFound
+	}
+
+	return s.plugins.Limiters[id-1].SetLimit(limit)
+}
+
+// pauseOutputs pauses or resumes outputs with given numbers, all outputs if none are given
+func (s *adminServer) pauseOutputs(ids []int, paused bool) error {
+	for _, id := range ids {
+		if id < 1 || id > len(s.plugins.Outputs) {
+			return errAdminNotFound
+		}
+	}
+
+	if len(ids) == 0 {
+		for i := range s.plugins.Outputs {
+			ids = append(ids, i+1)
+		}
+	}
+	for _, id := range ids {
+		s.plugins.pauseOutput(id-1, paused)
+	}
+
+	return nil
+}
+
+// listPlugins lists inputs followed by outputs
+func (s *adminServer) listPlugins() []adminPlugin {
+	limiter := func(plugin interface{}) (int, string) {
+		for i, l := range s.plugins.Limiters {
+			if l.plugin == plugin {
+				return i + 1, l.Limit()
+			}
+		}
+		return 0, ""
+	}
+
+	list := make([]adminPlugin, 0, len(s.plugins.Inputs)+len(s.plugins.Outputs))
+	for i, in := range s.plugins.Inputs {
+		var plugin interface{} = in
+		if l, ok := in.(*Limiter); ok {
+			plugin = l.plugin
+		}
+
+		p := adminPlugin{ID: i + 1, Plugin: fmt.Sprint(plugin)}
+		p.Limiter, p.Limit = limiter(plugin)
+		list = append(list, p)
+	}
+	for i, out := range s.plugins.Outputs {
+		plugin := unwrapOutput(out)
+
+		p := adminPlugin{ID: i + 1, Plugin: fmt.Sprint(plugin), Output: true, Paused: s.plugins.outputPaused(i)}
+		p.Limiter, p.Limit = limiter(plugin)
+		list = append(list, p)
+	}
+
+	return list
+}
+
+// writeAdminMetrics writes metrics exposed by admin API in Prometheus text format
+func writeAdminMetrics(w io.Writer) {
+	outputHTTPLatency.writeMetrics(w)
+	outputHTTPGraphQLLatency.writeMetrics(w)
+	outputHTTPProtocolLatency.writeMetrics(w)
+	if captureWatchdog != nil {
+		captureWatchdog.writeMetrics(w)
+	}
+	if memoryGuard != nil {
+		memoryGuard.writeMetrics(w)
+	}
+	writePriorityMetrics(w)
+	if Settings.outputDelay > 0 {
+		writeDelayMetrics(w)
+	}
+	if Settings.httpDecompress {
+		writeDecompressMetrics(w)
+	}
+
+	fmt.Fprintln(w, "# HELP gor_output_paused_total Payloads not written to outputs paused by admin API.")
+	fmt.Fprintln(w, "# TYPE gor_output_paused_total counter")
+	fmt.Fprintf(w, "gor_output_paused_total %d\n", atomic.LoadUint64(&pausedPayloads))
+}
+
+func (s *adminServer) writeLimits(w http.ResponseWriter) {
+	limits := make([]adminLimit, 0, len(s.plugins.Limiters))
+	for i, l := range s.plugins.Limiters {
+		limits = append(limits, adminLimit{ID: i + 1, Plugin: fmt.Sprint(l.plugin), Limit: l.Limit()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
+
+// stepLimits changes limits of all limiters by given number of steps
+func stepLimits(plugins *InOutPlugins, steps int) {
+	if len(plugins.Limiters) == 0 {
+		log.Println("[LIMITER] No limits to change, set them with \"|\" after address of input or output")
+		return
+	}
+
+	for _, l := range plugins.Limiters {
+		l.Step(steps)
+	}
+}
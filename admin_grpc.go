@@ -0,0 +1,268 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/buger/goreplay/http2"
+)
+
+// Admin API is also served over gRPC, so orchestration systems can control many running gor instances with generated
+// clients. Service is defined in admin.proto, and its messages are encoded by hand, so no protobuf or gRPC library is
+// needed. Calls are unary, without compression, over HTTP/2 with prior knowledge (h2c):
+//
+//	grpcurl -plaintext -proto admin.proto -d '{"paused": true}' localhost:8183 goreplay.Admin/PauseOutputs
+const grpcAdminService = "/goreplay.Admin/"
+
+// gRPC status codes
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcNotFound        = 5
+	grpcUnimplemented   = 12
+)
+
+// Field numbers of messages in admin.proto
+const (
+	grpcPluginID = 1 + iota
+	grpcPluginName
+	grpcPluginOutput
+	grpcPluginLimiter
+	grpcPluginLimit
+	grpcPluginPaused
+)
+
+const (
+	grpcStatsMetrics = 1 + iota
+	grpcStatsFilteredRequests
+	grpcStatsPausedPayloads
+)
+
+// grpcError is error of call, sent with its gRPC status code
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+// serveAdminGRPC serves admin API over gRPC on given address
+func serveAdminGRPC(address string, plugins *InOutPlugins) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	s := &adminServer{plugins: plugins}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := http2.ServeConn(conn, s.serveGRPC); err != nil {
+				Debug("[ADMIN] gRPC connection error:", err)
+			}
+		}()
+	}
+}
+
+// serveGRPC handles gRPC call
+func (s *adminServer) serveGRPC(r *http2.Request) *http2.Response {
+	var path, contentType string
+	for _, f := range r.Fields {
+		switch f.Name {
+		case ":path":
+			path = f.Value
+		case "content-type":
+			contentType = f.Value
+		}
+	}
+
+	if !strings.HasPrefix(contentType, "application/grpc") {
+		return &http2.Response{Fields: []http2.HeaderField{{Name: ":status", Value: "415"}}}
+	}
+
+	reply, err := s.callGRPC(path, r.Body)
+	if err != nil {
+		e, ok := err.(*grpcError)
+		if !ok {
+			e = &grpcError{grpcInvalidArgument, err.Error()}
+		}
+
+		// Trailers-only response
+		return &http2.Response{Fields: []http2.HeaderField{
+			{Name: ":status", Value: "200"},
+			{Name: "content-type", Value: "application/grpc"},
+			{Name: "grpc-status", Value: fmt.Sprint(e.code)},
+			{Name: "grpc-message", Value: grpcEscape(e.message)},
+		}}
+	}
+
+	// Message is prefixed by compression flag and its length
+	body := make([]byte, 5, 5+len(reply))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(reply)))
+
+	return &http2.Response{
+		Fields: []http2.HeaderField{
+			{Name: ":status", Value: "200"},
+			{Name: "content-type", Value: "application/grpc"},
+		},
+		Body:     append(body, reply...),
+		Trailers: []http2.HeaderField{{Name: "grpc-status", Value: fmt.Sprint(grpcOK)}},
+	}
+}
+
+// callGRPC calls method of admin service with length prefixed request message, and returns reply message
+func (s *adminServer) callGRPC(path string, body []byte) ([]byte, error) {
+	if !strings.HasPrefix(path, grpcAdminService) {
+		return nil, &grpcError{grpcUnimplemented, "unknown service " + path}
+	}
+
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:])) != len(body)-5 {
+		return nil, &grpcError{grpcInvalidArgument, "malformed request message"}
+	}
+	if body[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compression is not supported"}
+	}
+	msg := body[5:]
+
+	switch method := strings.TrimPrefix(path, grpcAdminService); method {
+	case "ListPlugins":
+		return s.grpcPlugins(), nil
+	case "SetLimit":
+		var id int
+		var limit string
+		err := forEachProtoField(msg, func(field int, value uint64, data []byte) {
+			switch field {
+			case 1:
+				id = int(value)
+			case 2:
+				limit = string(data)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.setLimit(id, limit); err == errAdminNotFound {
+			return nil, &grpcError{grpcNotFound, fmt.Sprintf("limiter %d not found", id)}
+		} else if err != nil {
+			return nil, err
+		}
+		return s.grpcPlugins(), nil
+	case "StepLimits":
+		var steps int
+		err := forEachProtoField(msg, func(field int, value uint64, data []byte) {
+			if field == 1 {
+				steps = int(int32(value))
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		stepLimits(s.plugins, steps)
+		return s.grpcPlugins(), nil
+	case "PauseOutputs":
+		var ids []int
+		var paused bool
+		var packedErr error
+		err := forEachProtoField(msg, func(field int, value uint64, data []byte) {
+			switch field {
+			case 1:
+				// Repeated numbers are packed by proto3 encoders, but can be sent one by one as well
+				if data == nil {
+					ids = append(ids, int(value))
+					return
+				}
+				for len(data) > 0 {
+					id, n := binary.Uvarint(data)
+					if n <= 0 {
+						packedErr = errProtoMessage
+						return
+					}
+					ids = append(ids, int(id))
+					data = data[n:]
+				}
+			case 2:
+				paused = value != 0
+			}
+		})
+		if err == nil {
+			err = packedErr
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.pauseOutputs(ids, paused); err != nil {
+			return nil, &grpcError{grpcNotFound, fmt.Sprintf("output of %v not found", ids)}
+		}
+		return s.grpcPlugins(), nil
+	case "GetStats":
+		var metrics bytes.Buffer
+		writeAdminMetrics(&metrics)
+
+		var reply []byte
+		reply = appendBytesField(reply, grpcStatsMetrics, metrics.Bytes())
+		reply = appendGRPCVarint(reply, grpcStatsFilteredRequests, uint64(atomic.LoadInt64(&filteredRequestsCount)))
+		reply = appendGRPCVarint(reply, grpcStatsPausedPayloads, atomic.LoadUint64(&pausedPayloads))
+		return reply, nil
+	default:
+		return nil, &grpcError{grpcUnimplemented, "unknown method " + method}
+	}
+}
+
+// grpcPlugins returns PluginList message
+func (s *adminServer) grpcPlugins() []byte {
+	var list []byte
+	for _, p := range s.listPlugins() {
+		var msg []byte
+		msg = appendGRPCVarint(msg, grpcPluginID, uint64(p.ID))
+		msg = appendBytesField(msg, grpcPluginName, []byte(p.Plugin))
+		if p.Output {
+			msg = appendGRPCVarint(msg, grpcPluginOutput, 1)
+		}
+		msg = appendGRPCVarint(msg, grpcPluginLimiter, uint64(p.Limiter))
+		if p.Limit != "" {
+			msg = appendBytesField(msg, grpcPluginLimit, []byte(p.Limit))
+		}
+		if p.Paused {
+			msg = appendGRPCVarint(msg, grpcPluginPaused, 1)
+		}
+
+		list = appendBytesField(list, 1, msg)
+	}
+
+	return list
+}
+
+// appendGRPCVarint appends varint field, skipping default value like proto3 encoders do
+func appendGRPCVarint(buf []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return buf
+	}
+	return appendVarintField(buf, field, value)
+}
+
+// grpcEscape percent-encodes grpc-message value
+func grpcEscape(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
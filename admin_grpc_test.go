@@ -0,0 +1,139 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"testing"
+
+	"github.com/buger/goreplay/http2"
+)
+
+func grpcField(fields []http2.HeaderField, name string) string {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+func TestAdminGRPC(t *testing.T) {
+	plugins := NewPlugins()
+	plugins.AddPlugin(NewTestInput(), "")
+	plugins.AddPlugin(NewTestOutput(func(data []byte) {}), "50%")
+	plugins.AddPlugin(NewTestOutput(func(data []byte) {}), "")
+
+	s := &adminServer{plugins: plugins}
+	call := func(method string, msg []byte) (string, []byte) {
+		body := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+		body = append(body, msg...)
+
+		resp := s.serveGRPC(&http2.Request{
+			Fields: []http2.HeaderField{{Name: ":method", Value: "POST"}, {Name: ":path", Value: "/goreplay.Admin/" + method}, {Name: "content-type", Value: "application/grpc"}},
+			Body:   body,
+		})
+		if status := grpcField(resp.Fields, ":status"); status != "200" {
+			t.Fatalf("%s: unexpected status %s", method, status)
+		}
+
+		// Errors are sent as trailers-only response
+		if status := grpcField(resp.Fields, "grpc-status"); status != "" {
+			return status, nil
+		}
+		if len(resp.Body) < 5 {
+			t.Fatalf("%s: unexpected reply %q", method, resp.Body)
+		}
+		return grpcField(resp.Trailers, "grpc-status"), resp.Body[5:]
+	}
+
+	plugin := func(list []byte, index int) (p adminPlugin) {
+		var i int
+		forEachProtoField(list, func(field int, value uint64, data []byte) {
+			if i++; i-1 != index {
+				return
+			}
+			forEachProtoField(data, func(field int, value uint64, data []byte) {
+				switch field {
+				case grpcPluginID:
+					p.ID = int(value)
+				case grpcPluginName:
+					p.Plugin = string(data)
+				case grpcPluginOutput:
+					p.Output = value != 0
+				case grpcPluginLimiter:
+					p.Limiter = int(value)
+				case grpcPluginLimit:
+					p.Limit = string(data)
+				case grpcPluginPaused:
+					p.Paused = value != 0
+				}
+			})
+		})
+		return
+	}
+
+	status, list := call("ListPlugins", nil)
+	if p := plugin(list, 1); status != "0" || p.ID != 1 || !p.Output || p.Limiter != 1 || p.Limit != "50%" {
+		t.Errorf("unexpected plugins %s %+v", status, p)
+	}
+	if p := plugin(list, 0); p.ID != 1 || p.Output || p.Plugin == "" {
+		t.Errorf("unexpected input %+v", p)
+	}
+
+	var msg []byte
+	msg = appendVarintField(msg, 1, 1)
+	msg = appendBytesField(msg, 2, []byte("20%"))
+	if status, list := call("SetLimit", msg); status != "0" || plugin(list, 1).Limit != "20%" {
+		t.Errorf("limit is not set %s %+v", status, plugin(list, 1))
+	}
+
+	msg = appendVarintField(nil, 1, 2)
+	msg = appendBytesField(msg, 2, []byte("20%"))
+	if status, _ := call("SetLimit", msg); status != strconv.Itoa(grpcNotFound) {
+		t.Error("unknown limiter is found", status)
+	}
+
+	// Negative int32 is encoded as 64 bit number
+	minusOne := int64(-1)
+	if status, list := call("StepLimits", appendVarintField(nil, 1, uint64(minusOne))); status != "0" || plugin(list, 1).Limit != "15%" {
+		t.Errorf("limits are not stepped %s %+v", status, plugin(list, 1))
+	}
+
+	// Packed repeated output numbers
+	msg = appendBytesField(nil, 1, []byte{2})
+	msg = appendVarintField(msg, 2, 1)
+	status, list = call("PauseOutputs", msg)
+	if status != "0" || plugin(list, 1).Paused || !plugin(list, 2).Paused || !plugins.outputPaused(1) {
+		t.Errorf("output is not paused %s %+v", status, plugin(list, 2))
+	}
+
+	if status, _ := call("PauseOutputs", nil); status != "0" || plugins.outputPaused(1) {
+		t.Error("outputs are not resumed", status)
+	}
+
+	if status, _ := call("PauseOutputs", appendVarintField(nil, 1, 3)); status != strconv.Itoa(grpcNotFound) {
+		t.Error("unknown output is found", status)
+	}
+
+	status, stats := call("GetStats", nil)
+	var metrics string
+	forEachProtoField(stats, func(field int, value uint64, data []byte) {
+		if field == grpcStatsMetrics {
+			metrics = string(data)
+		}
+	})
+	if status != "0" || !bytes.Contains([]byte(metrics), []byte("gor_output_paused_total")) {
+		t.Errorf("unexpected stats %s %q", status, metrics)
+	}
+
+	if status, _ := call("Unknown", nil); status != strconv.Itoa(grpcUnimplemented) {
+		t.Error("unknown method is called", status)
+	}
+
+	resp := s.serveGRPC(&http2.Request{Fields: []http2.HeaderField{{Name: ":path", Value: "/goreplay.Admin/ListPlugins"}, {Name: "content-type", Value: "application/json"}}})
+	if status := grpcField(resp.Fields, ":status"); status != "415" {
+		t.Error("request without gRPC content type is served", status)
+	}
+}
@@ -0,0 +1,96 @@
+package goreplay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminLimits(t *testing.T) {
+	plugins := NewPlugins()
+	plugins.AddPlugin(NewTestOutput(func(data []byte) {}), "50%")
+	plugins.AddPlugin(NewTestOutput(func(data []byte) {}), "100")
+
+	server := httptest.NewServer(newAdminServer(plugins))
+	defer server.Close()
+
+	request := func(method, path string) (int, []adminLimit) {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var limits []adminLimit
+		json.NewDecoder(resp.Body).Decode(&limits)
+		return resp.StatusCode, limits
+	}
+
+	if _, limits := request("GET", "/limits"); len(limits) != 2 || limits[0].Limit != "50%" || limits[1].Limit != "100" {
+		t.Errorf("Expected initial limits, got %+v", limits)
+	}
+
+	if _, limits := request("PUT", "/limits/1?limit=5%25"); len(limits) != 2 || limits[0].Limit != "5%" {
+		t.Errorf("Expected limit to be changed, got %+v", limits)
+	}
+
+	if status, _ := request("PUT", "/limits/2?limit=5%25"); status != http.StatusBadRequest {
+		t.Error("Kind of limit should not be changed, got status", status)
+	}
+
+	if status, _ := request("PUT", "/limits/3?limit=5"); status != http.StatusNotFound {
+		t.Error("Unknown limiter should not be found, got status", status)
+	}
+
+	if _, limits := request("POST", "/limits/step?steps=2"); len(limits) != 2 || limits[0].Limit != "15%" || limits[1].Limit != "120" {
+		t.Errorf("Expected limits stepped by tenth of initial value, got %+v", limits)
+	}
+
+	if _, limits := request("POST", "/limits/step?steps=-20"); len(limits) != 2 || limits[0].Limit != "0%" || limits[1].Limit != "0" {
+		t.Errorf("Expected limits not to be negative, got %+v", limits)
+	}
+}
+
+func TestAdminPauseOutputs(t *testing.T) {
+	plugins := NewPlugins()
+	plugins.AddPlugin(NewTestOutput(func(data []byte) {}), "")
+	plugins.AddPlugin(NewTestOutput(func(data []byte) {}), "10%")
+
+	server := httptest.NewServer(newAdminServer(plugins))
+	defer server.Close()
+
+	request := func(method, path string) (int, []adminPlugin) {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var list []adminPlugin
+		json.NewDecoder(resp.Body).Decode(&list)
+		return resp.StatusCode, list
+	}
+
+	if _, list := request("GET", "/plugins"); len(list) != 2 || list[0].Limiter != 0 || list[1].Limiter != 1 || list[1].Limit != "10%" {
+		t.Errorf("Expected outputs with limits, got %+v", list)
+	}
+
+	if _, list := request("PUT", "/outputs/2?paused=true"); len(list) != 2 || list[0].Paused || !list[1].Paused || !plugins.outputPaused(1) {
+		t.Errorf("Expected output to be paused, got %+v", list)
+	}
+
+	if status, _ := request("PUT", "/outputs/2?paused=maybe"); status != http.StatusBadRequest || !plugins.outputPaused(1) {
+		t.Error("Invalid value should not change output, got status", status)
+	}
+
+	if status, _ := request("PUT", "/outputs/3?paused=true"); status != http.StatusNotFound {
+		t.Error("Unknown output should not be found, got status", status)
+	}
+
+	if _, list := request("PUT", "/outputs/2?paused=false"); len(list) != 2 || list[1].Paused {
+		t.Errorf("Expected output to be resumed, got %+v", list)
+	}
+}
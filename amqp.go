@@ -0,0 +1,644 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AMQPConfig holds configuration of AMQP input and output
+type AMQPConfig struct {
+	// Output publishes to exchange with routing key, input binds queue to exchange with routing key if exchange is set
+	exchange   string
+	routingKey string
+	// Output waits for publisher confirms of broker
+	confirm bool
+	// Input consumes durable queue, declaring it if it does not exist, with limited number of unacknowledged messages
+	queue    string
+	prefetch int
+	// Removes credentials from payloads before they are published
+	redactor *headerRedactor
+}
+
+// Methods of AMQP 0-9-1 used by plugins, class ID in high bits
+const (
+	amqpConnectionStart    = 10<<16 | 10
+	amqpConnectionStartOk  = 10<<16 | 11
+	amqpConnectionTune     = 10<<16 | 30
+	amqpConnectionTuneOk   = 10<<16 | 31
+	amqpConnectionOpen     = 10<<16 | 40
+	amqpConnectionOpenOk   = 10<<16 | 41
+	amqpConnectionClose    = 10<<16 | 50
+	amqpConnectionCloseOk  = 10<<16 | 51
+	amqpChannelOpen        = 20<<16 | 10
+	amqpChannelOpenOk      = 20<<16 | 11
+	amqpChannelClose       = 20<<16 | 40
+	amqpChannelCloseOk     = 20<<16 | 41
+	amqpQueueDeclare       = 50<<16 | 10
+	amqpQueueDeclareOk     = 50<<16 | 11
+	amqpQueueBind          = 50<<16 | 20
+	amqpQueueBindOk        = 50<<16 | 21
+	amqpBasicQos           = 60<<16 | 10
+	amqpBasicQosOk         = 60<<16 | 11
+	amqpBasicConsume       = 60<<16 | 20
+	amqpBasicConsumeOk     = 60<<16 | 21
+	amqpBasicPublish       = 60<<16 | 40
+	amqpBasicDeliver       = 60<<16 | 60
+	amqpBasicAck           = 60<<16 | 80
+	amqpBasicNack          = 60<<16 | 120
+	amqpConfirmSelect      = 85<<16 | 10
+	amqpConfirmSelectOk    = 85<<16 | 11
+	amqpFrameMethod        = 1
+	amqpFrameHeader        = 2
+	amqpFrameBody          = 3
+	amqpFrameHeartbeat     = 8
+	amqpFrameEnd           = 0xce
+	amqpDefaultFrameMax    = 128 << 10
+	amqpPersistentDelivery = 2
+)
+
+// amqpBuffer encodes arguments of methods
+type amqpBuffer struct {
+	bytes.Buffer
+}
+
+func (b *amqpBuffer) writeShort(v uint16) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	b.Write(buf[:])
+}
+
+func (b *amqpBuffer) writeLong(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	b.Write(buf[:])
+}
+
+func (b *amqpBuffer) writeLonglong(v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	b.Write(buf[:])
+}
+
+func (b *amqpBuffer) writeShortstr(s string) {
+	b.WriteByte(byte(len(s)))
+	b.WriteString(s)
+}
+
+func (b *amqpBuffer) writeLongstr(s string) {
+	b.writeLong(uint32(len(s)))
+	b.WriteString(s)
+}
+
+// writeBits writes consecutive bit arguments packed into octet
+func (b *amqpBuffer) writeBits(bits ...bool) {
+	var octet byte
+	for i, bit := range bits {
+		if bit {
+			octet |= 1 << uint(i)
+		}
+	}
+	b.WriteByte(octet)
+}
+
+// writeTable writes field table with string values
+func (b *amqpBuffer) writeTable(fields map[string]string) {
+	var table amqpBuffer
+	for name, value := range fields {
+		table.writeShortstr(name)
+		table.WriteByte('S')
+		table.writeLongstr(value)
+	}
+	b.writeLong(uint32(table.Len()))
+	b.Write(table.Bytes())
+}
+
+// amqpReader decodes arguments of methods, error is reported by err after reading
+type amqpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *amqpReader) next(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errors.New("malformed AMQP method")
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *amqpReader) readOctet() byte {
+	return r.next(1)[0]
+}
+
+func (r *amqpReader) readShort() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *amqpReader) readLong() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *amqpReader) readLonglong() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+func (r *amqpReader) readShortstr() string {
+	return string(r.next(int(r.readOctet())))
+}
+
+// readLongstr reads long string, and also field table which is encoded the same way
+func (r *amqpReader) readLongstr() string {
+	size := r.readLong()
+	if size > uint32(len(r.data)) {
+		r.err = errors.New("malformed AMQP method")
+		return ""
+	}
+	return string(r.next(int(size)))
+}
+
+type amqpMethod struct {
+	id   uint32
+	args *amqpReader
+}
+
+// amqpDelivery is message delivered to consumer
+type amqpDelivery struct {
+	tag  uint64
+	size uint64
+	body []byte
+}
+
+// amqpConn is connection to AMQP 0-9-1 broker, like RabbitMQ, using single channel. Synchronous methods are called one
+// at a time. Connection is not re-established, it is closed on first error and users dial new one.
+type amqpConn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	mu       sync.Mutex
+	writer   *bufio.Writer
+	frameMax int
+
+	// Replies of synchronous methods
+	callMu     sync.Mutex
+	replies    chan amqpMethod
+	deliveries chan amqpDelivery
+	delivery   *amqpDelivery
+	// Called with publisher confirms, from reading goroutine
+	onConfirm func(tag uint64, multiple, ack bool)
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error
+}
+
+// parseAMQPAddress parses `amqp://[user:password@]host[:port][/vhost]` address, `amqps://` scheme enables TLS. Default
+// credentials are guest:guest, and default virtual host is `/`.
+func parseAMQPAddress(address string) (*url.URL, error) {
+	if !strings.Contains(address, "://") {
+		address = "amqp://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "amqp" && u.Scheme != "amqps" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("host is not specified")
+	}
+	if u.Port() == "" {
+		if u.Scheme == "amqps" {
+			u.Host += ":5671"
+		} else {
+			u.Host += ":5672"
+		}
+	}
+	if u.User == nil {
+		u.User = url.UserPassword("guest", "guest")
+	}
+
+	return u, nil
+}
+
+func readAMQPFrame(r io.Reader) (typ byte, channel uint16, payload []byte, err error) {
+	var header [7]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	typ = header[0]
+	channel = binary.BigEndian.Uint16(header[1:3])
+	size := binary.BigEndian.Uint32(header[3:7])
+	if size > 16<<20 {
+		return 0, 0, nil, errors.New("AMQP frame is too large")
+	}
+
+	payload = make([]byte, size+1)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if payload[size] != amqpFrameEnd {
+		return 0, 0, nil, errors.New("malformed AMQP frame")
+	}
+
+	return typ, channel, payload[:size], nil
+}
+
+func (c *amqpConn) writeFrame(typ byte, channel uint16, payload []byte) {
+	var header [7]byte
+	header[0] = typ
+	binary.BigEndian.PutUint16(header[1:3], channel)
+	binary.BigEndian.PutUint32(header[3:7], uint32(len(payload)))
+	c.writer.Write(header[:])
+	c.writer.Write(payload)
+	c.writer.WriteByte(amqpFrameEnd)
+}
+
+func (c *amqpConn) writeMethod(channel uint16, method uint32, args []byte) {
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], method)
+	c.writeFrame(amqpFrameMethod, channel, append(id[:], args...))
+}
+
+// expectMethod reads frames until method frame during handshake, and returns arguments of expected method
+func expectMethod(r io.Reader, expected uint32) (*amqpReader, error) {
+	for {
+		typ, _, payload, err := readAMQPFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		if typ != amqpFrameMethod || len(payload) < 4 {
+			continue
+		}
+
+		method := binary.BigEndian.Uint32(payload)
+		args := &amqpReader{data: payload[4:]}
+		if method == amqpConnectionClose {
+			args.readShort()
+			return nil, errors.New("connection closed by broker: " + args.readShortstr())
+		}
+		if method != expected {
+			return nil, fmt.Errorf("unexpected AMQP method %d.%d", method>>16, method&0xffff)
+		}
+
+		return args, nil
+	}
+}
+
+// dialAMQP connects to broker and opens channel, onConfirm is called with publisher confirms if they are enabled
+func dialAMQP(u *url.URL, onConfirm func(tag uint64, multiple, ack bool)) (*amqpConn, error) {
+	var conn net.Conn
+	var err error
+	if u.Scheme == "amqps" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", u.Host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = net.DialTimeout("tcp", u.Host, 5*time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &amqpConn{
+		conn:       conn,
+		writer:     bufio.NewWriter(conn),
+		replies:    make(chan amqpMethod, 1),
+		deliveries: make(chan amqpDelivery, 1024),
+		onConfirm:  onConfirm,
+		closed:     make(chan struct{}),
+	}
+
+	if err := c.handshake(u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.read()
+
+	if _, err := c.call(amqpChannelOpen, []byte{0}, amqpChannelOpenOk); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// handshake negotiates connection and opens virtual host
+func (c *amqpConn) handshake(u *url.URL) error {
+	c.reader = bufio.NewReader(c.conn)
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+
+	c.writer.WriteString("AMQP\x00\x00\x09\x01")
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := expectMethod(c.reader, amqpConnectionStart); err != nil {
+		return err
+	}
+
+	password, _ := u.User.Password()
+	var args amqpBuffer
+	args.writeTable(map[string]string{"product": "gor", "version": VERSION})
+	args.writeShortstr("PLAIN")
+	args.writeLongstr("\x00" + u.User.Username() + "\x00" + password)
+	args.writeShortstr("en_US")
+	c.writeMethod(0, amqpConnectionStartOk, args.Bytes())
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+
+	tune, err := expectMethod(c.reader, amqpConnectionTune)
+	if err != nil {
+		return err
+	}
+	channelMax, frameMax, heartbeat := tune.readShort(), tune.readLong(), tune.readShort()
+	if tune.err != nil {
+		return tune.err
+	}
+	c.frameMax = int(frameMax)
+	if c.frameMax == 0 || c.frameMax > amqpDefaultFrameMax {
+		c.frameMax = amqpDefaultFrameMax
+	}
+
+	args.Reset()
+	args.writeShort(channelMax)
+	args.writeLong(uint32(c.frameMax))
+	args.writeShort(heartbeat)
+	c.writeMethod(0, amqpConnectionTuneOk, args.Bytes())
+
+	vhost := "/"
+	if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+		vhost = path
+	}
+	args.Reset()
+	args.writeShortstr(vhost)
+	args.writeShortstr("")
+	args.writeBits(false)
+	c.writeMethod(0, amqpConnectionOpen, args.Bytes())
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := expectMethod(c.reader, amqpConnectionOpenOk); err != nil {
+		return err
+	}
+
+	if heartbeat > 0 {
+		go c.heartbeat(time.Duration(heartbeat) * time.Second / 2)
+	}
+
+	return nil
+}
+
+// heartbeat sends heartbeat frames, so broker does not close idle connection
+func (c *amqpConn) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			c.writeFrame(amqpFrameHeartbeat, 0, nil)
+			c.flush()
+			c.mu.Unlock()
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *amqpConn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// Close closes connection gracefully, so broker requeues unacknowledged messages without logging error
+func (c *amqpConn) Close() error {
+	var args amqpBuffer
+	args.writeShort(200)
+	args.writeShortstr("")
+	args.writeShort(0)
+	args.writeShort(0)
+
+	c.mu.Lock()
+	c.writeMethod(0, amqpConnectionClose, args.Bytes())
+	c.flush()
+	c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+	case <-time.After(time.Second):
+	}
+	c.close(errors.New("connection closed"))
+
+	return nil
+}
+
+func (c *amqpConn) read() {
+	for {
+		typ, _, payload, err := readAMQPFrame(c.reader)
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		switch typ {
+		case amqpFrameMethod:
+			if len(payload) < 4 {
+				c.close(errors.New("malformed AMQP frame"))
+				return
+			}
+			if err := c.handleMethod(binary.BigEndian.Uint32(payload), &amqpReader{data: payload[4:]}); err != nil {
+				c.close(err)
+				return
+			}
+		case amqpFrameHeader:
+			if c.delivery == nil {
+				continue
+			}
+			header := &amqpReader{data: payload}
+			header.readShort()
+			header.readShort()
+			c.delivery.size = header.readLonglong()
+			if c.delivery.size == 0 {
+				c.deliver()
+			}
+		case amqpFrameBody:
+			if c.delivery == nil {
+				continue
+			}
+			c.delivery.body = append(c.delivery.body, payload...)
+			if uint64(len(c.delivery.body)) >= c.delivery.size {
+				c.deliver()
+			}
+		}
+	}
+}
+
+func (c *amqpConn) deliver() {
+	select {
+	case c.deliveries <- *c.delivery:
+	case <-c.closed:
+	}
+	c.delivery = nil
+}
+
+func (c *amqpConn) handleMethod(id uint32, args *amqpReader) error {
+	switch id {
+	case amqpBasicDeliver:
+		args.readShortstr()
+		c.delivery = &amqpDelivery{tag: args.readLonglong()}
+	case amqpBasicAck, amqpBasicNack:
+		tag := args.readLonglong()
+		multiple := args.readOctet()&1 != 0
+		if c.onConfirm != nil {
+			c.onConfirm(tag, multiple, id == amqpBasicAck)
+		}
+	case amqpConnectionClose, amqpChannelClose:
+		code, text := args.readShort(), args.readShortstr()
+
+		c.mu.Lock()
+		if id == amqpConnectionClose {
+			c.writeMethod(0, amqpConnectionCloseOk, nil)
+		} else {
+			c.writeMethod(1, amqpChannelCloseOk, nil)
+		}
+		c.flush()
+		c.mu.Unlock()
+
+		return fmt.Errorf("closed by broker: %d %s", code, text)
+	case amqpConnectionCloseOk:
+		return errors.New("connection closed")
+	default:
+		select {
+		case c.replies <- amqpMethod{id, args}:
+		default:
+		}
+	}
+
+	return args.err
+}
+
+func (c *amqpConn) flush() error {
+	if err := c.writer.Flush(); err != nil {
+		go c.close(err)
+		return err
+	}
+	return nil
+}
+
+// Flush sends buffered messages and acknowledgements
+func (c *amqpConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return c.err
+	default:
+	}
+
+	return c.flush()
+}
+
+// call calls synchronous method on channel and waits for its reply
+func (c *amqpConn) call(id uint32, args []byte, expected uint32) (*amqpReader, error) {
+	c.callMu.Lock()
+	defer c.callMu.Unlock()
+
+	c.mu.Lock()
+	c.writeMethod(1, id, args)
+	err := c.flush()
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-c.replies:
+		if reply.id != expected {
+			return nil, fmt.Errorf("unexpected AMQP method %d.%d", reply.id>>16, reply.id&0xffff)
+		}
+		return reply.args, nil
+	case <-c.closed:
+		return nil, c.err
+	case <-time.After(10 * time.Second):
+		return nil, errors.New("AMQP broker did not reply")
+	}
+}
+
+// publish publishes persistent message, messages are buffered until there are enough of them or they are flushed
+func (c *amqpConn) publish(exchange, routingKey string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return c.err
+	default:
+	}
+
+	var args amqpBuffer
+	args.writeShort(0)
+	args.writeShortstr(exchange)
+	args.writeShortstr(routingKey)
+	args.writeBits(false, false)
+	c.writeMethod(1, amqpBasicPublish, args.Bytes())
+
+	// Content header with delivery mode property only
+	var header amqpBuffer
+	header.writeShort(60)
+	header.writeShort(0)
+	header.writeLonglong(uint64(len(data)))
+	header.writeShort(1 << 12)
+	header.WriteByte(amqpPersistentDelivery)
+	c.writeFrame(amqpFrameHeader, 1, header.Bytes())
+
+	for chunk := c.frameMax - 8; len(data) > 0; {
+		if chunk > len(data) {
+			chunk = len(data)
+		}
+		c.writeFrame(amqpFrameBody, 1, data[:chunk])
+		data = data[chunk:]
+	}
+
+	if c.writer.Buffered() < 32<<10 {
+		return nil
+	}
+	return c.flush()
+}
+
+// ack acknowledges delivered message, acknowledgement is buffered like published messages
+func (c *amqpConn) ack(tag uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return c.err
+	default:
+	}
+
+	var args amqpBuffer
+	args.writeLonglong(tag)
+	args.writeBits(false)
+	c.writeMethod(1, amqpBasicAck, args.Bytes())
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// amqpServer emulates AMQP broker with small frame size, messages published to default exchange are stored in queue
+// named by routing key
+type amqpServer struct {
+	net.Listener
+	mu     sync.Mutex
+	queues map[string][][]byte
+	acks   int
+}
+
+func newAMQPServer(t *testing.T) *amqpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &amqpServer{Listener: listener, queues: make(map[string][][]byte)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+// readAMQPContent reads content header and body frames of published message
+func readAMQPContent(r io.Reader) []byte {
+	_, _, header, _ := readAMQPFrame(r)
+	size := binary.BigEndian.Uint64(header[4:12])
+
+	var body []byte
+	for uint64(len(body)) < size {
+		_, _, payload, err := readAMQPFrame(r)
+		if err != nil {
+			return nil
+		}
+		body = append(body, payload...)
+	}
+
+	return body
+}
+
+func (s *amqpServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	protocol := make([]byte, 8)
+	io.ReadFull(reader, protocol)
+
+	// Reuses encoding of client
+	c := &amqpConn{writer: bufio.NewWriter(conn), frameMax: 4096}
+	send := func(channel uint16, method uint32, args ...func(*amqpBuffer)) {
+		var b amqpBuffer
+		for _, arg := range args {
+			arg(&b)
+		}
+		c.writeMethod(channel, method, b.Bytes())
+		c.writer.Flush()
+	}
+
+	send(0, amqpConnectionStart, func(b *amqpBuffer) {
+		b.WriteByte(0)
+		b.WriteByte(9)
+		b.writeTable(nil)
+		b.writeLongstr("PLAIN")
+		b.writeLongstr("en_US")
+	})
+
+	var confirm bool
+	var published, delivered uint64
+	for {
+		typ, channel, payload, err := readAMQPFrame(reader)
+		if err != nil || typ != amqpFrameMethod {
+			return
+		}
+		args := &amqpReader{data: payload[4:]}
+
+		switch binary.BigEndian.Uint32(payload) {
+		case amqpConnectionStartOk:
+			args.readLongstr()
+			args.readShortstr()
+			if args.readLongstr() != "\x00guest\x00guest" {
+				send(0, amqpConnectionClose, func(b *amqpBuffer) {
+					b.writeShort(403)
+					b.writeShortstr("ACCESS_REFUSED")
+					b.writeShort(0)
+					b.writeShort(0)
+				})
+				return
+			}
+			send(0, amqpConnectionTune, func(b *amqpBuffer) {
+				b.writeShort(0)
+				b.writeLong(4096)
+				b.writeShort(0)
+			})
+		case amqpConnectionOpen:
+			send(0, amqpConnectionOpenOk, func(b *amqpBuffer) { b.writeShortstr("") })
+		case amqpChannelOpen:
+			send(channel, amqpChannelOpenOk, func(b *amqpBuffer) { b.writeLongstr("") })
+		case amqpConfirmSelect:
+			confirm = true
+			send(channel, amqpConfirmSelectOk)
+		case amqpBasicPublish:
+			args.readShort()
+			args.readShortstr()
+			key := args.readShortstr()
+			body := readAMQPContent(reader)
+
+			s.mu.Lock()
+			s.queues[key] = append(s.queues[key], body)
+			s.mu.Unlock()
+
+			if confirm {
+				published++
+				send(channel, amqpBasicAck, func(b *amqpBuffer) {
+					b.writeLonglong(published)
+					b.writeBits(false)
+				})
+			}
+		case amqpBasicQos:
+			send(channel, amqpBasicQosOk)
+		case amqpQueueDeclare:
+			args.readShort()
+			queue := args.readShortstr()
+			send(channel, amqpQueueDeclareOk, func(b *amqpBuffer) {
+				b.writeShortstr(queue)
+				b.writeLong(0)
+				b.writeLong(0)
+			})
+		case amqpBasicConsume:
+			args.readShort()
+			queue := args.readShortstr()
+			tag := args.readShortstr()
+			send(channel, amqpBasicConsumeOk, func(b *amqpBuffer) { b.writeShortstr(tag) })
+
+			s.mu.Lock()
+			for _, body := range s.queues[queue] {
+				delivered++
+				var b amqpBuffer
+				b.writeShortstr(tag)
+				b.writeLonglong(delivered)
+				b.writeBits(false)
+				b.writeShortstr("")
+				b.writeShortstr(queue)
+				c.writeMethod(channel, amqpBasicDeliver, b.Bytes())
+
+				var header amqpBuffer
+				header.writeShort(60)
+				header.writeShort(0)
+				header.writeLonglong(uint64(len(body)))
+				header.writeShort(0)
+				c.writeFrame(amqpFrameHeader, channel, header.Bytes())
+				for data := body; len(data) > 0; {
+					n := len(data)
+					if n > 4000 {
+						n = 4000
+					}
+					c.writeFrame(amqpFrameBody, channel, data[:n])
+					data = data[n:]
+				}
+			}
+			s.mu.Unlock()
+			c.writer.Flush()
+		case amqpBasicAck:
+			s.mu.Lock()
+			s.acks++
+			s.mu.Unlock()
+		case amqpConnectionClose:
+			send(0, amqpConnectionCloseOk)
+			return
+		}
+	}
+}
+
+func TestAMQPOutputInput(t *testing.T) {
+	server := newAMQPServer(t)
+	defer server.Close()
+	address := "amqp://" + server.Addr().String()
+
+	output := NewAMQPOutput(address, &AMQPConfig{routingKey: "gor", confirm: true}).(*AMQPOutput)
+	payloads := [][]byte{
+		[]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"),
+		// Larger than frame size
+		append([]byte("1 2 1\nPOST / HTTP/1.1\r\n\r\n"), bytes.Repeat([]byte("a"), 10000)...),
+		[]byte("2 2 1\nHTTP/1.1 200 OK\r\n\r\n"),
+	}
+	for _, p := range payloads {
+		output.Write(p)
+	}
+	output.Close()
+
+	// Close waits for confirms, so payloads are stored
+	server.mu.Lock()
+	stored := len(server.queues["gor"])
+	server.mu.Unlock()
+	if stored != len(payloads) {
+		t.Fatal("Expected confirmed payloads, got", stored)
+	}
+
+	input := NewAMQPInput(address, &AMQPConfig{queue: "gor", prefetch: 10})
+	defer input.Close()
+
+	buf := make([]byte, 20000)
+	for _, p := range payloads {
+		n, err := input.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], p) {
+			t.Errorf("Expected %q, got %q", p[:20], buf[:20])
+		}
+	}
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		server.mu.Lock()
+		acks := server.acks
+		server.mu.Unlock()
+
+		if acks == len(payloads) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected acknowledgements of all payloads, got", acks)
+		}
+	}
+}
+
+func TestAMQPAuthentication(t *testing.T) {
+	server := newAMQPServer(t)
+	defer server.Close()
+
+	u, _ := parseAMQPAddress("amqp://user:wrong@" + server.Addr().String())
+	if _, err := dialAMQP(u, nil); err == nil || !strings.Contains(err.Error(), "ACCESS_REFUSED") {
+		t.Error("Expected authentication error, got", err)
+	}
+}
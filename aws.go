@@ -0,0 +1,286 @@
+package goreplay
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Instance metadata service, used for credentials of EC2 instance role
+const awsMetadataEndpoint = "http://169.254.169.254/latest"
+
+type awsCredentials struct {
+	accessKey string
+	secretKey string
+	token     string
+	expires   time.Time
+}
+
+// awsClient calls AWS JSON APIs, like Kinesis. Requests are signed with Signature Version 4, using credentials from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or credentials of EC2 instance role.
+type awsClient struct {
+	service  string
+	region   string
+	endpoint string
+	// Target prefix of API methods, e.g. `Kinesis_20131202`
+	target string
+	http   *http.Client
+	// Used for streaming responses, without timeout
+	stream *http.Client
+
+	mu          sync.Mutex
+	credentials awsCredentials
+}
+
+// awsError is error returned by AWS API
+type awsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+	status  string
+}
+
+func (e *awsError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.status, e.Type, e.Message)
+}
+
+// awsRegion returns region from AWS_REGION or AWS_DEFAULT_REGION
+func awsRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+func newAWSClient(service, target, region, endpoint string) (*awsClient, error) {
+	if region == "" {
+		return nil, errors.New("region is not specified, set AWS_REGION")
+	}
+	if endpoint == "" {
+		endpoint = "https://" + service + "." + region + ".amazonaws.com"
+	}
+
+	return &awsClient{
+		service:  service,
+		region:   region,
+		endpoint: endpoint,
+		target:   target,
+		http:     &http.Client{Timeout: time.Minute},
+		stream:   &http.Client{},
+	}, nil
+}
+
+// getCredentials returns credentials from environment, or cached credentials of instance role, which are renewed
+// 5 minutes before expiration
+func (c *awsClient) getCredentials() (awsCredentials, error) {
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		return awsCredentials{accessKey: key, secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.credentials.accessKey != "" && time.Now().Add(5*time.Minute).Before(c.credentials.expires) {
+		return c.credentials, nil
+	}
+
+	credentials, err := c.instanceCredentials()
+	if err != nil {
+		return credentials, fmt.Errorf("can't get credentials of instance role, set AWS_ACCESS_KEY_ID outside of EC2: %v", err)
+	}
+	c.credentials = credentials
+
+	return credentials, nil
+}
+
+// instanceCredentials reads credentials of EC2 instance role using IMDSv2
+func (c *awsClient) instanceCredentials() (credentials awsCredentials, err error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	req, _ := http.NewRequest("PUT", awsMetadataEndpoint+"/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := awsMetadata(client, req)
+	if err != nil {
+		return
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, _ := http.NewRequest("GET", awsMetadataEndpoint+path, nil)
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return awsMetadata(client, req)
+	}
+
+	role, err := get("/meta-data/iam/security-credentials/")
+	if err != nil {
+		return
+	}
+	data, err := get("/meta-data/iam/security-credentials/" + strings.TrimSpace(string(role)))
+	if err != nil {
+		return
+	}
+
+	var response struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err = json.Unmarshal(data, &response); err != nil {
+		return
+	}
+
+	return awsCredentials{response.AccessKeyID, response.SecretAccessKey, response.Token, response.Expiration}, nil
+}
+
+func awsMetadata(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// sign adds Signature Version 4 authorization to request. Host, Content-Type and X-Amz-* headers are signed.
+func (c *awsClient) sign(req *http.Request, body []byte, credentials awsCredentials, now time.Time) {
+	date := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	if credentials.token != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.token)
+	}
+
+	headers := map[string]string{"host": req.Host}
+	if req.Host == "" {
+		headers["host"] = req.URL.Host
+	}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		// Spaces are encoded as %20, not as +
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date[:8] + "/" + c.region + "/" + c.service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + credentials.secretKey)
+	for _, part := range []string{date[:8], c.region, c.service, "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+credentials.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(key))
+}
+
+// request creates signed request of API method
+func (c *awsClient) request(method string, request interface{}) (*http.Request, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", c.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", c.target+"."+method)
+
+	credentials, err := c.getCredentials()
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, body, credentials, time.Now())
+
+	return req, nil
+}
+
+// call calls API method and decodes response to result
+func (c *awsClient) call(method string, request interface{}, result interface{}) error {
+	req, err := c.request(method, request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := awsResponseError(resp); err != nil {
+		return err
+	}
+
+	if result == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func awsResponseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &awsError{status: resp.Status}
+	if json.Unmarshal(body, e) != nil || e.Type == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	// Type can be prefixed by namespace, e.g. `com.amazonaws.kinesis#ResourceInUseException`
+	if i := strings.LastIndex(e.Type, "#"); i != -1 {
+		e.Type = e.Type[i+1:]
+	}
+
+	return e
+}
@@ -0,0 +1,38 @@
+package goreplay
+
+import (
+	"sync"
+)
+
+// Payloads larger than this are not returned to the pool, so rare large messages do not keep memory allocated
+const maxPooledBuffer = 64 << 10
+
+// payloadBuffers keeps buffers of payloads which outputs copy from emitter buffer and queue until they are sent.
+// At high rates allocating buffer for each payload makes GC pauses long enough to drop captured packets.
+var payloadBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// getPayloadBuffer returns copy of payload in buffer taken from the pool. Buffer should be returned with
+// putPayloadBuffer when owner is done with it, and not used afterwards.
+func getPayloadBuffer(payload []byte) []byte {
+	if len(payload) > maxPooledBuffer {
+		return append([]byte(nil), payload...)
+	}
+
+	buf := payloadBuffers.Get().(*[]byte)
+	return append((*buf)[:0], payload...)
+}
+
+// putPayloadBuffer returns buffer to the pool
+func putPayloadBuffer(buf []byte) {
+	if cap(buf) > maxPooledBuffer {
+		return
+	}
+
+	buf = buf[:0]
+	payloadBuffers.Put(&buf)
+}
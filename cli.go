@@ -0,0 +1,244 @@
+package goreplay
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// cliCommand is subcommand of gor. Subcommands running plugins accept flags of gor, except flags only used by other
+// subcommand, while subcommands working with recorded files have their own flags.
+type cliCommand struct {
+	usage string
+	// Prefixes of flags which are not accepted by subcommand
+	exclude []string
+	// run runs subcommand which doesn't use plugins, nil if plugins are configured by flags
+	run func(args []string, w io.Writer) error
+}
+
+// Flags of capturing traffic and of sending it to replayed servers
+var (
+	captureOnlyFlags = []string{"input-raw", "input-http", "input-envoy-tap"}
+	replayOnlyFlags  = []string{"output-http", "http-original-host", "output-udp", "output-dns", "output-mysql", "output-postgres", "output-redis", "output-mongo"}
+)
+
+// Usage of subcommands working with recorded files
+const (
+	diffUsage    = "Compare original responses with replayed responses saved by --output-http-track-response:\n\tgor diff [-body] [-key source] responses.gor"
+	inspectUsage = "Print, filter, split and merge payloads of saved files, or their stats:\n\tgor inspect [-from time] [-to time] [-method GET] [-url regexp] [-stats] [-output path [-split duration]] [-body] [-key source] requests.gor"
+)
+
+var cliCommands = map[string]*cliCommand{
+	"capture": {
+		usage:   "Capture traffic, and save or forward it:\n\tgor capture --input-raw :80 --output-file requests.gor",
+		exclude: replayOnlyFlags,
+	},
+	"replay": {
+		usage:   "Replay saved or forwarded traffic:\n\tgor replay --input-file requests.gor --output-http staging.com",
+		exclude: captureOnlyFlags,
+	},
+	"diff": {
+		usage: diffUsage,
+		run:   runDiff,
+	},
+	"inspect": {
+		usage: inspectUsage,
+		run:   runInspect,
+	},
+}
+
+// cliUsage prints subcommands before flags of legacy mode
+func cliUsage() {
+	w := flag.CommandLine.Output()
+
+	names := make([]string, 0, len(cliCommands))
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "Usage: gor <command> [flags], or gor [flags]\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n\t%s\n", name, cliCommands[name].usage)
+	}
+	fmt.Fprintf(w, "\nRun gor <command> -h for flags of command. Flags of all commands:\n")
+	flag.PrintDefaults()
+}
+
+// flagSet returns flags of gor accepted by subcommand, sharing their values with given flags
+func (c *cliCommand) flagSet(name string, flags *flag.FlagSet) *flag.FlagSet {
+	fs := flag.NewFlagSet("gor "+name, flag.ExitOnError)
+
+	flags.VisitAll(func(f *flag.Flag) {
+		for _, prefix := range c.exclude {
+			if strings.HasPrefix(f.Name, prefix) {
+				return
+			}
+		}
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s\n\nFlags:\n", c.usage)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// parseFilesFlags parses flags shared by subcommands reading files, and returns key and paths of files
+func parseFilesFlags(fs *flag.FlagSet, args []string) (key []byte, paths []string, err error) {
+	keySource := fs.String("key", "", "Key of files written with --output-file-key, from `file:<path>`, `env:<variable>` or `exec:<command>`")
+	fs.Parse(args)
+
+	if *keySource != "" {
+		if key, err = loadKey(*keySource); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, pattern := range fs.Args() {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(matches) == 0 {
+			return nil, nil, fmt.Errorf("no files match %q", pattern)
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return nil, nil, errors.New("expected file paths")
+	}
+
+	return key, paths, nil
+}
+
+// readPayloads calls fn for each payload of files, merged by their timestamps
+func readPayloads(paths []string, key []byte, fn func([]byte)) error {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+
+	m := newFileMerge(paths, func(string) int64 { return 0 }, key, false)
+	for r := m.next(); r != nil; r = m.next() {
+		fn(r.ReadPayload())
+	}
+
+	return nil
+}
+
+// diffResponse is response assembled from its chunks
+type diffResponse struct {
+	status []byte
+	body   []byte
+	done   bool
+}
+
+// runDiff compares status codes, and optionally bodies, of original and replayed responses of requests. Error is
+// returned if they differ, so it can be used in scripts.
+func runDiff(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("gor diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s\n\nFlags:\n", diffUsage)
+		fs.PrintDefaults()
+	}
+	compareBody := fs.Bool("body", false, "Compare bodies of responses, not only status codes")
+	key, paths, err := parseFilesFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	requests := make(map[string]string)
+	responses := map[byte]map[string]*diffResponse{ResponsePayload: {}, ReplayedResponsePayload: {}}
+	var compared, mismatched int
+
+	err = readPayloads(paths, key, func(payload []byte) {
+		meta := payloadMeta(payload)
+		if len(meta) < 3 {
+			return
+		}
+		id := string(meta[1])
+		data := payloadBody(payload)
+		index, more, _ := payloadChunk(payload)
+
+		if payload[0] == RequestPayload {
+			if index == 0 {
+				requests[id] = string(proto.Method(data)) + " " + string(proto.Path(data))
+			}
+			return
+		}
+
+		resps, ok := responses[payload[0]]
+		if !ok {
+			return
+		}
+		resp := resps[id]
+		if resp == nil {
+			resp = &diffResponse{status: append([]byte(nil), proto.Status(data)...), body: append([]byte(nil), proto.Body(data)...)}
+			resps[id] = resp
+		} else {
+			resp.body = append(resp.body, data...)
+		}
+		resp.done = !more
+
+		original, replayed := responses[ResponsePayload][id], responses[ReplayedResponsePayload][id]
+		if original == nil || replayed == nil || !original.done || !replayed.done {
+			return
+		}
+
+		compared++
+		if !bytes.Equal(original.status, replayed.status) {
+			mismatched++
+			fmt.Fprintf(w, "%s %s: status %s, replayed %s\n", id, requests[id], original.status, replayed.status)
+		} else if *compareBody && !bytes.Equal(original.body, replayed.body) {
+			mismatched++
+			fmt.Fprintf(w, "%s %s: body of %d bytes, replayed %d bytes differ\n", id, requests[id], len(original.body), len(replayed.body))
+		}
+
+		delete(requests, id)
+		delete(responses[ResponsePayload], id)
+		delete(responses[ReplayedResponsePayload], id)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n%d responses compared, %d differ, %d without replayed response\n", compared, mismatched, len(responses[ResponsePayload]))
+
+	if mismatched > 0 {
+		return fmt.Errorf("%d responses differ", mismatched)
+	}
+
+	return nil
+}
+
+// runCommand runs subcommand which doesn't use plugins and exits, or parses flags of subcommand running plugins
+func runCommand(name string, args []string) {
+	cmd := cliCommands[name]
+
+	if cmd.run != nil {
+		if err := cmd.run(args, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "gor "+name+":", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	fs := cmd.flagSet(name, flag.CommandLine)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "gor "+name+": unexpected arguments:", strings.Join(fs.Args(), " "))
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,353 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Upper bounds of body size buckets shown by `gor inspect -stats`
+var inspectSizeBuckets = []int{0, 1 << 10, 10 << 10, 100 << 10, 1 << 20}
+
+// inspectFilter selects requests by time, method and URL. Responses follow their requests.
+type inspectFilter struct {
+	from, to fileInputBound
+	methods  map[string]bool
+	url      *regexp.Regexp
+
+	// Timestamp of the first payload, start of offset bounds
+	start int64
+	// Decisions about requests, by their IDs
+	requests map[string]bool
+}
+
+// newInspectFilter parses bounds of time range, see parseFileInputBound, and regexp of URL. Empty values select all
+// requests.
+func newInspectFilter(from, to string, methods []string, url string) (f *inspectFilter, err error) {
+	f = &inspectFilter{methods: make(map[string]bool), requests: make(map[string]bool)}
+
+	if f.from, err = parseFileInputBound(from); err != nil {
+		return nil, fmt.Errorf("from: %v", err)
+	}
+	if f.to, err = parseFileInputBound(to); err != nil {
+		return nil, fmt.Errorf("to: %v", err)
+	}
+	for _, m := range methods {
+		f.methods[strings.ToUpper(m)] = true
+	}
+	if url != "" {
+		if f.url, err = regexp.Compile(url); err != nil {
+			return nil, fmt.Errorf("url: %v", err)
+		}
+	}
+
+	return f, nil
+}
+
+func (f *inspectFilter) match(payload []byte, id string, timestamp int64) bool {
+	if f.start == 0 {
+		f.start = timestamp
+	}
+
+	if payload[0] != RequestPayload {
+		return f.requests[id]
+	}
+	if index, _, _ := payloadChunk(payload); index > 0 {
+		return f.requests[id]
+	}
+
+	data := payloadBody(payload)
+	matched := (f.from.isZero() || timestamp >= f.from.timestamp(f.start)) &&
+		(f.to.isZero() || timestamp < f.to.timestamp(f.start)) &&
+		(len(f.methods) == 0 || f.methods[string(proto.Method(data))]) &&
+		(f.url == nil || f.url.Match(proto.Path(data)))
+
+	f.requests[id] = matched
+
+	return matched
+}
+
+// inspectStats counts requests by endpoint, and by size of body
+type inspectStats struct {
+	endpoints map[string]int
+	sizes     []int
+	// Body sizes of chunked requests, until their last chunk
+	pending map[string]int
+}
+
+func (s *inspectStats) add(payload []byte, id string) {
+	if payload[0] != RequestPayload {
+		return
+	}
+
+	data := payloadBody(payload)
+	index, more, _ := payloadChunk(payload)
+	if index == 0 {
+		path := proto.Path(data)
+		if i := bytes.IndexByte(path, '?'); i != -1 {
+			path = path[:i]
+		}
+		endpoint := string(proto.Method(data)) + " " + string(path)
+		// GraphQL operations are sent to the same endpoint, so they are counted separately
+		if operation := graphQLOperation(data); operation != "" {
+			endpoint += " " + operation
+		}
+		s.endpoints[endpoint]++
+		s.pending[id] = len(proto.Body(data))
+	} else {
+		s.pending[id] += len(data)
+	}
+
+	if more {
+		return
+	}
+
+	size := s.pending[id]
+	delete(s.pending, id)
+
+	bucket := len(inspectSizeBuckets)
+	for i, bound := range inspectSizeBuckets {
+		if size <= bound {
+			bucket = i
+			break
+		}
+	}
+	s.sizes[bucket]++
+}
+
+func (s *inspectStats) print(w io.Writer) {
+	endpoints := make([]string, 0, len(s.endpoints))
+	for e := range s.endpoints {
+		endpoints = append(endpoints, e)
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if s.endpoints[endpoints[i]] != s.endpoints[endpoints[j]] {
+			return s.endpoints[endpoints[i]] > s.endpoints[endpoints[j]]
+		}
+		return endpoints[i] < endpoints[j]
+	})
+
+	fmt.Fprintln(w, "Requests by endpoint:")
+	for _, e := range endpoints {
+		fmt.Fprintf(w, "%10d %s\n", s.endpoints[e], e)
+	}
+
+	fmt.Fprintln(w, "\nRequests by body size:")
+	for i, count := range s.sizes {
+		var bucket string
+		switch {
+		case i == 0:
+			bucket = "empty"
+		case i == len(inspectSizeBuckets):
+			bucket = "> " + formatSize(inspectSizeBuckets[i-1])
+		default:
+			bucket = "<= " + formatSize(inspectSizeBuckets[i])
+		}
+		fmt.Fprintf(w, "%10d %s\n", count, bucket)
+	}
+}
+
+func formatSize(size int) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%dMB", size>>20)
+	case size >= 1<<10:
+		return fmt.Sprintf("%dKB", size>>10)
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+// inspectWriter writes payloads to file, or to file per time window if split is set, adding index to file name like
+// --output-file does. Files with `.gz` extension are compressed.
+type inspectWriter struct {
+	path  string
+	split time.Duration
+
+	index  int
+	window int64
+	file   *os.File
+	gzip   *gzip.Writer
+	writer *bufio.Writer
+}
+
+func (o *inspectWriter) write(payload []byte, timestamp int64) error {
+	if o.file != nil && o.split > 0 && timestamp >= o.window+int64(o.split) {
+		if err := o.close(); err != nil {
+			return err
+		}
+		o.index++
+	}
+
+	if o.file == nil {
+		path := o.path
+		if o.split > 0 {
+			path = setFileIndex(path, o.index)
+			o.window = timestamp
+		}
+
+		var err error
+		if o.file, err = os.Create(path); err != nil {
+			return err
+		}
+		var dst io.Writer = o.file
+		if strings.HasSuffix(path, ".gz") {
+			o.gzip = gzip.NewWriter(o.file)
+			dst = o.gzip
+		}
+		o.writer = bufio.NewWriter(dst)
+	}
+
+	o.writer.Write(payload)
+	_, err := o.writer.WriteString(payloadSeparator)
+
+	return err
+}
+
+func (o *inspectWriter) close() error {
+	if o.file == nil {
+		return nil
+	}
+
+	err := o.writer.Flush()
+	if o.gzip != nil {
+		if e := o.gzip.Close(); err == nil {
+			err = e
+		}
+	}
+	if e := o.file.Close(); err == nil {
+		err = e
+	}
+	o.file, o.gzip = nil, nil
+
+	return err
+}
+
+// runInspect prints payloads of files merged by time, with type, ID, time and first line of each payload, and summary
+// of files. Payloads can be filtered, written to other file, which merges files, or split to files by time windows.
+// With -stats only counts of requests by endpoint and body size are printed.
+func runInspect(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("gor inspect", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s\n\nFlags:\n", inspectUsage)
+		fs.PrintDefaults()
+	}
+	body := fs.Bool("body", false, "Print whole payloads")
+	from := fs.String("from", "", "Skip requests before RFC3339 time, or offset from the first payload, e.g. `1h30m`")
+	to := fs.String("to", "", "Skip requests from RFC3339 time, or offset from the first payload")
+	var methods MultiOption
+	fs.Var(&methods, "method", "Select requests with method, the flag can be repeated")
+	urlPattern := fs.String("url", "", "Select requests with path matching regexp")
+	stats := fs.Bool("stats", false, "Print counts of requests by endpoint and by body size, instead of payloads")
+	output := fs.String("output", "", "Write selected payloads to file instead of printing them, .gz files are compressed")
+	split := fs.Duration("split", 0, "Write payloads of each time window to separate file, adding index to -output name, e.g. `1h`")
+	key, paths, err := parseFilesFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	filter, err := newInspectFilter(*from, *to, methods, *urlPattern)
+	if err != nil {
+		return err
+	}
+	if *split > 0 && *output == "" {
+		return fmt.Errorf("-split requires -output")
+	}
+
+	var writer *inspectWriter
+	if *output != "" {
+		writer = &inspectWriter{path: *output, split: *split}
+	}
+	summary := &inspectStats{endpoints: make(map[string]int), sizes: make([]int, len(inspectSizeBuckets)+1), pending: make(map[string]int)}
+
+	types := map[byte]string{RequestPayload: "request", ResponsePayload: "response", ReplayedResponsePayload: "replayed"}
+	counts := make(map[byte]int)
+	var first, last int64
+	var writeErr error
+
+	err = readPayloads(paths, key, func(payload []byte) {
+		meta := payloadMeta(payload)
+		if len(meta) < 3 {
+			if writer == nil && !*stats {
+				fmt.Fprintf(w, "malformed payload: %q\n", payload)
+			}
+			return
+		}
+
+		var timestamp int64
+		fmt.Sscan(string(meta[2]), &timestamp)
+		if !filter.match(payload, string(meta[1]), timestamp) {
+			return
+		}
+
+		if first == 0 || timestamp < first {
+			first = timestamp
+		}
+		if timestamp > last {
+			last = timestamp
+		}
+		counts[payload[0]]++
+
+		switch {
+		case *stats:
+			summary.add(payload, string(meta[1]))
+			return
+		case writer != nil:
+			if writeErr == nil {
+				writeErr = writer.write(payload, timestamp)
+			}
+			return
+		}
+
+		data := payloadBody(payload)
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i != -1 {
+			line = data[:i]
+		}
+
+		fmt.Fprintf(w, "%-8s %s %s %d bytes", types[payload[0]], meta[1], time.Unix(0, timestamp).Format(time.RFC3339Nano), len(data))
+		if index, more, ok := payloadChunk(payload); ok {
+			fmt.Fprintf(w, " chunk %d", index)
+			if more {
+				fmt.Fprint(w, "+")
+			}
+		}
+		if *body {
+			fmt.Fprintf(w, "\n%s\n\n", data)
+		} else {
+			fmt.Fprintf(w, " %q\n", bytes.TrimRight(line, "\r"))
+		}
+	})
+	if writer != nil {
+		if e := writer.close(); writeErr == nil {
+			writeErr = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	if *stats {
+		summary.print(w)
+	}
+
+	fmt.Fprintf(w, "\n%d requests, %d responses, %d replayed responses", counts[RequestPayload], counts[ResponsePayload], counts[ReplayedResponsePayload])
+	if first != 0 {
+		fmt.Fprintf(w, ", from %s to %s", time.Unix(0, first).Format(time.RFC3339), time.Unix(0, last).Format(time.RFC3339))
+	}
+	fmt.Fprintln(w)
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package goreplay
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePayloadsFile(t *testing.T, payloads ...[]byte) string {
+	file, err := ioutil.TempFile("", "gor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	for _, payload := range payloads {
+		file.Write(payload)
+		file.Write([]byte(payloadSeparator))
+	}
+
+	return file.Name()
+}
+
+func TestCLIFlagSet(t *testing.T) {
+	flags := flag.NewFlagSet("gor", flag.ContinueOnError)
+	RegisterFlags(flags)
+
+	capture := cliCommands["capture"].flagSet("capture", flags)
+	if capture.Lookup("input-raw") == nil || capture.Lookup("output-file") == nil {
+		t.Error("Capture should accept flags of capturing and saving traffic")
+	}
+	if capture.Lookup("output-http") != nil || capture.Lookup("output-http-workers") != nil {
+		t.Error("Capture should not accept flags of replaying traffic")
+	}
+
+	replay := cliCommands["replay"].flagSet("replay", flags)
+	if replay.Lookup("output-http") == nil || replay.Lookup("input-file") == nil {
+		t.Error("Replay should accept flags of reading and replaying traffic")
+	}
+	if replay.Lookup("input-raw-track-response") != nil {
+		t.Error("Replay should not accept flags of capturing traffic")
+	}
+}
+
+func TestCLIInspect(t *testing.T) {
+	now := time.Now().UnixNano()
+	path := writePayloadsFile(t,
+		append(payloadHeader(RequestPayload, []byte("a1"), now, -1), []byte("GET /users HTTP/1.1\r\nHost: example.com\r\n\r\n")...),
+		append(payloadHeader(ResponsePayload, []byte("a1"), now+1, 1), []byte("HTTP/1.1 200 OK\r\n\r\n")...),
+	)
+	defer os.Remove(path)
+
+	var out bytes.Buffer
+	if err := runInspect([]string{path}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{`request  a1`, `"GET /users HTTP/1.1"`, `response a1`, `"HTTP/1.1 200 OK"`, "1 requests, 1 responses, 0 replayed responses"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Output should contain %q:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestCLIDiff(t *testing.T) {
+	now := time.Now().UnixNano()
+	request := func(id, path string) []byte {
+		return append(payloadHeader(RequestPayload, []byte(id), now, -1), []byte("GET "+path+" HTTP/1.1\r\n\r\n")...)
+	}
+	response := func(kind byte, id, status, body string) []byte {
+		return append(payloadHeader(kind, []byte(id), now, 1), []byte("HTTP/1.1 "+status+"\r\nContent-Length: 1\r\n\r\n"+body)...)
+	}
+
+	path := writePayloadsFile(t,
+		request("a1", "/same"), response(ResponsePayload, "a1", "200 OK", "a"), response(ReplayedResponsePayload, "a1", "200 OK", "a"),
+		request("a2", "/body"), response(ResponsePayload, "a2", "200 OK", "a"), response(ReplayedResponsePayload, "a2", "200 OK", "b"),
+		request("a3", "/status"), response(ResponsePayload, "a3", "200 OK", "a"), response(ReplayedResponsePayload, "a3", "500 Internal Server Error", "a"),
+		request("a4", "/missing"), response(ResponsePayload, "a4", "200 OK", "a"),
+	)
+	defer os.Remove(path)
+
+	var out bytes.Buffer
+	if err := runDiff([]string{path}, &out); err == nil {
+		t.Error("Error should be returned if responses differ")
+	}
+	if !strings.Contains(out.String(), "a3 GET /status: status 200, replayed 500") || strings.Contains(out.String(), "/body") {
+		t.Error("Only status should be compared by default:\n", out.String())
+	}
+	if !strings.Contains(out.String(), "3 responses compared, 1 differ, 1 without replayed response") {
+		t.Error("Wrong summary:\n", out.String())
+	}
+
+	out.Reset()
+	runDiff([]string{"-body", path}, &out)
+	if !strings.Contains(out.String(), "a2 GET /body: body") || !strings.Contains(out.String(), "2 differ") {
+		t.Error("Bodies should be compared:\n", out.String())
+	}
+}
+
+func TestCLIInspectFilesTooling(t *testing.T) {
+	start := time.Date(2021, 3, 1, 22, 0, 0, 0, time.UTC).UnixNano()
+	request := func(id, method, path string, at time.Duration) []byte {
+		return append(payloadHeader(RequestPayload, []byte(id), start+int64(at), -1), []byte(method+" "+path+" HTTP/1.1\r\nContent-Length: 2\r\n\r\nab")...)
+	}
+	response := func(id string, at time.Duration) []byte {
+		return append(payloadHeader(ResponsePayload, []byte(id), start+int64(at), 1), []byte("HTTP/1.1 200 OK\r\n\r\n")...)
+	}
+
+	// Files overlap in time, so their payloads are merged
+	first := writePayloadsFile(t, request("a1", "GET", "/users?id=1", 0), response("a1", time.Millisecond), request("a3", "POST", "/users", 2*time.Hour))
+	second := writePayloadsFile(t, request("a2", "GET", "/users?id=2", time.Hour), response("a2", time.Hour+time.Millisecond), request("a4", "GET", "/orders", 3*time.Hour))
+	defer os.Remove(first)
+	defer os.Remove(second)
+
+	var out bytes.Buffer
+	if err := runInspect([]string{"-method", "get", "-url", "^/users", first, second}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "2 requests, 2 responses") || strings.Index(out.String(), "request  a1") > strings.Index(out.String(), "request  a2") {
+		t.Error("Requests should be filtered and merged by time:\n", out.String())
+	}
+
+	out.Reset()
+	runInspect([]string{"-from", "1h", "-to", "2021-03-02T01:00:00Z", "-stats", first, second}, &out)
+	for _, expected := range []string{"         1 GET /users\n", "         1 POST /users\n", "         2 <= 1KB\n", "2 requests, 1 responses"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Stats should contain %q:\n%s", expected, out.String())
+		}
+	}
+
+	dir, _ := ioutil.TempDir("", "gor")
+	defer os.RemoveAll(dir)
+
+	out.Reset()
+	if err := runInspect([]string{"-output", dir + "/merged.gz", "-split", "90m", first, second}, &out); err != nil {
+		t.Fatal(err)
+	}
+	for file, expected := range map[string]string{"merged_0.gz": "2 requests, 2 responses", "merged_1.gz": "2 requests, 0 responses"} {
+		out.Reset()
+		if err := runInspect([]string{dir + "/" + file}, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("%s should contain %q:\n%s", file, expected, out.String())
+		}
+	}
+}
@@ -0,0 +1,11 @@
+// Gor is simple http traffic replication tool written in Go. Its main goal to replay traffic from production servers to staging and dev environments.
+// Now you can test your code on real user sessions in an automated and repeatable fashion.
+package main
+
+import (
+	"github.com/buger/goreplay"
+)
+
+func main() {
+	goreplay.Main()
+}
@@ -0,0 +1,240 @@
+package goreplay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// dnsTypes contains names of query types which can be used in filters. Other types are written as TYPE<code> (RFC 3597).
+var dnsTypes = map[string]layers.DNSType{
+	"A":      layers.DNSTypeA,
+	"NS":     layers.DNSTypeNS,
+	"CNAME":  layers.DNSTypeCNAME,
+	"SOA":    layers.DNSTypeSOA,
+	"PTR":    layers.DNSTypePTR,
+	"HINFO":  layers.DNSTypeHINFO,
+	"MX":     layers.DNSTypeMX,
+	"TXT":    layers.DNSTypeTXT,
+	"AAAA":   layers.DNSTypeAAAA,
+	"SRV":    layers.DNSTypeSRV,
+	"NAPTR":  35,
+	"OPT":    41,
+	"DS":     43,
+	"RRSIG":  46,
+	"NSEC":   47,
+	"DNSKEY": 48,
+	"SVCB":   64,
+	"HTTPS":  65,
+	"IXFR":   251,
+	"AXFR":   252,
+	"ANY":    255,
+	"CAA":    257,
+}
+
+func dnsTypeName(t layers.DNSType) string {
+	for name, code := range dnsTypes {
+		if code == t {
+			return name
+		}
+	}
+
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// parseDNSType accepts type name, its code, or TYPE<code>
+func parseDNSType(name string) (layers.DNSType, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+
+	if t, ok := dnsTypes[name]; ok {
+		return t, nil
+	}
+
+	code, err := strconv.ParseUint(strings.TrimPrefix(name, "TYPE"), 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown DNS type %q", name)
+	}
+
+	return layers.DNSType(code), nil
+}
+
+// parseDNSTypes parses comma separated list of query types
+func parseDNSTypes(list string) (types []layers.DNSType, err error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	for _, name := range strings.Split(list, ",") {
+		t, err := parseDNSType(name)
+		if err != nil {
+			return nil, err
+		}
+
+		types = append(types, t)
+	}
+
+	return types, nil
+}
+
+var errDNSMalformed = errors.New("malformed DNS message")
+
+// decodeDNS decodes DNS message in wire format, as sent over UDP
+func decodeDNS(data []byte) (msg *layers.DNS, err error) {
+	// Decoder of record data trusts lengths found in the message
+	defer func() {
+		if recover() != nil {
+			msg, err = nil, errDNSMalformed
+		}
+	}()
+
+	msg = new(layers.DNS)
+	if err = msg.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// dnsName returns lowercase domain name without trailing dot
+func dnsName(name []byte) string {
+	return strings.TrimSuffix(strings.ToLower(string(name)), ".")
+}
+
+// dnsNameMatch checks name against patterns, `*` matches any part of name, e.g. `*.example.com`
+func dnsNameMatch(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(dnsName([]byte(p)), name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dnsQueryFilter returns function accepting queries with allowed names and types. Queries with multiple questions
+// are accepted if any question is.
+func dnsQueryFilter(allow, disallow []string, types []layers.DNSType) func(query *layers.DNS) bool {
+	return func(query *layers.DNS) bool {
+		for _, q := range query.Questions {
+			name := dnsName(q.Name)
+
+			if len(allow) > 0 && !dnsNameMatch(name, allow) {
+				continue
+			}
+
+			if dnsNameMatch(name, disallow) {
+				continue
+			}
+
+			if len(types) == 0 {
+				return true
+			}
+
+			for _, t := range types {
+				if q.Type == t {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+}
+
+// dnsRecord writes resource record in zone file format
+func dnsRecord(rr *layers.DNSResourceRecord) string {
+	var data string
+
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		data = rr.IP.String()
+	case layers.DNSTypeNS:
+		data = string(rr.NS) + "."
+	case layers.DNSTypeCNAME:
+		data = string(rr.CNAME) + "."
+	case layers.DNSTypePTR:
+		data = string(rr.PTR) + "."
+	case layers.DNSTypeMX:
+		data = fmt.Sprintf("%d %s.", rr.MX.Preference, rr.MX.Name)
+	case layers.DNSTypeSRV:
+		data = fmt.Sprintf("%d %d %d %s.", rr.SRV.Priority, rr.SRV.Weight, rr.SRV.Port, rr.SRV.Name)
+	case layers.DNSTypeSOA:
+		data = fmt.Sprintf("%s. %s. %d %d %d %d %d", rr.SOA.MName, rr.SOA.RName, rr.SOA.Serial, rr.SOA.Refresh, rr.SOA.Retry, rr.SOA.Expire, rr.SOA.Minimum)
+	case layers.DNSTypeTXT:
+		var txts []string
+		for _, txt := range rr.TXTs {
+			txts = append(txts, strconv.Quote(string(txt)))
+		}
+		data = strings.Join(txts, " ")
+	default:
+		data = fmt.Sprintf("\\# %d %x", len(rr.Data), rr.Data)
+	}
+
+	return fmt.Sprintf("%s.\t%d\t%s\t%s\t%s", rr.Name, rr.TTL, rr.Class, dnsTypeName(rr.Type), data)
+}
+
+// formatDNS writes DNS message as text, similar to `dig` output:
+//
+//	;; QUERY id:4660 rcode:No Error flags: rd
+//	;; QUESTION
+//	example.com.	IN	A
+//	;; ANSWER
+//	example.com.	300	IN	A	93.184.216.34
+func formatDNS(msg *layers.DNS) []byte {
+	var b bytes.Buffer
+
+	flags := []struct {
+		name string
+		set  bool
+	}{{"qr", msg.QR}, {"aa", msg.AA}, {"tc", msg.TC}, {"rd", msg.RD}, {"ra", msg.RA}}
+
+	fmt.Fprintf(&b, ";; %s id:%d rcode:%s flags:", strings.ToUpper(msg.OpCode.String()), msg.ID, msg.ResponseCode)
+	for _, f := range flags {
+		if f.set {
+			b.WriteString(" " + f.name)
+		}
+	}
+	b.WriteByte('\n')
+
+	b.WriteString(";; QUESTION\n")
+	for _, q := range msg.Questions {
+		fmt.Fprintf(&b, "%s.\t%s\t%s\n", q.Name, q.Class, dnsTypeName(q.Type))
+	}
+
+	sections := []struct {
+		name    string
+		records []layers.DNSResourceRecord
+	}{{"ANSWER", msg.Answers}, {"AUTHORITY", msg.Authorities}, {"ADDITIONAL", msg.Additionals}}
+
+	for _, s := range sections {
+		if len(s.records) == 0 {
+			continue
+		}
+
+		b.WriteString(";; " + s.name + "\n")
+		for i := range s.records {
+			b.WriteString(dnsRecord(&s.records[i]) + "\n")
+		}
+	}
+
+	return b.Bytes()
+}
+
+// prettifyDNS replaces DNS message in payload with its text form
+func prettifyDNS(p []byte) []byte {
+	headSize := bytes.IndexByte(p, '\n') + 1
+
+	msg, err := decodeDNS(p[headSize:])
+	if err != nil {
+		Debug("[Prettifier] DNS decoding error:", err)
+		return p
+	}
+
+	return append(p[:headSize:headSize], formatDNS(msg)...)
+}
@@ -0,0 +1,120 @@
+package goreplay
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func buildDNSQuery(id uint16, name string, qtype layers.DNSType) []byte {
+	return serializeDNS(&layers.DNS{
+		ID:        id,
+		RD:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: qtype, Class: layers.DNSClassIN}},
+	})
+}
+
+func serializeDNS(msg *layers.DNS) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestParseDNSTypes(t *testing.T) {
+	types, err := parseDNSTypes("a, AAAA,https,TYPE99,15")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []layers.DNSType{layers.DNSTypeA, layers.DNSTypeAAAA, 65, 99, layers.DNSTypeMX}
+	for i, typ := range expected {
+		if types[i] != typ {
+			t.Errorf("Type %d: expected %d, got %d", i, typ, types[i])
+		}
+	}
+
+	if _, err = parseDNSTypes("A,UNKNOWN"); err == nil {
+		t.Error("Should reject unknown type")
+	}
+
+	if dnsTypeName(65) != "HTTPS" || dnsTypeName(99) != "TYPE99" {
+		t.Error("Wrong type names", dnsTypeName(65), dnsTypeName(99))
+	}
+}
+
+func TestDecodeDNS(t *testing.T) {
+	msg, err := decodeDNS(buildDNSQuery(4660, "example.com", layers.DNSTypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.ID != 4660 || msg.QR || len(msg.Questions) != 1 || string(msg.Questions[0].Name) != "example.com" {
+		t.Error("Wrong query", msg)
+	}
+
+	for _, data := range []string{"", "GET / HTTP/1.1\r\n\r\n", "\x00\x01\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x03"} {
+		if _, err := decodeDNS([]byte(data)); err == nil {
+			t.Errorf("Should reject %q", data)
+		}
+	}
+}
+
+func TestDNSQueryFilter(t *testing.T) {
+	filter := dnsQueryFilter([]string{"*.example.com"}, []string{"Secret.Example.com."}, []layers.DNSType{layers.DNSTypeA, layers.DNSTypeAAAA})
+
+	cases := []struct {
+		name     string
+		qtype    layers.DNSType
+		expected bool
+	}{
+		{"www.example.com", layers.DNSTypeA, true},
+		{"WWW.Example.COM", layers.DNSTypeAAAA, true},
+		{"example.com", layers.DNSTypeA, false},
+		{"www.example.org", layers.DNSTypeA, false},
+		{"secret.example.com", layers.DNSTypeA, false},
+		{"www.example.com", layers.DNSTypeMX, false},
+	}
+
+	for _, c := range cases {
+		query, _ := decodeDNS(buildDNSQuery(1, c.name, c.qtype))
+		if filter(query) != c.expected {
+			t.Errorf("%s %s: expected %v", c.name, c.qtype, c.expected)
+		}
+	}
+}
+
+func TestPrettifyDNS(t *testing.T) {
+	resp := serializeDNS(&layers.DNS{
+		ID:        4660,
+		QR:        true,
+		RD:        true,
+		RA:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		Answers: []layers.DNSResourceRecord{
+			{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, IP: net.IPv4(93, 184, 216, 34)},
+		},
+	})
+
+	payload := append(payloadHeader(ResponsePayload, uuid(), 1, 1), resp...)
+	pretty := string(prettifyDNS(payload))
+
+	expected := ";; QUERY id:4660 rcode:No Error flags: qr rd ra\n" +
+		";; QUESTION\n" +
+		"example.com.\tIN\tA\n" +
+		";; ANSWER\n" +
+		"example.com.\t300\tIN\tA\t93.184.216.34\n"
+
+	if !strings.HasPrefix(pretty, "2 ") || string(payloadBody([]byte(pretty))) != expected {
+		t.Errorf("Wrong text form:\n%s", pretty)
+	}
+
+	if notDNS := append(payloadHeader(RequestPayload, uuid(), 1, -1), "GET / HTTP/1.1\r\n\r\n"...); string(prettifyDNS(notDNS)) != string(notDNS) {
+		t.Error("Should not change other payloads")
+	}
+}
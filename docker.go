@@ -0,0 +1,182 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Docker API socket, DOCKER_HOST environment variable is used if it is set to unix socket
+const dockerSocket = "/var/run/docker.sock"
+
+// procRoot is mount point of procfs, it is changed by tests
+var procRoot = "/proc"
+
+// dockerClient sends requests to Docker API over unix socket
+type dockerClient struct {
+	client *http.Client
+}
+
+func newDockerClient(socket string) *dockerClient {
+	if socket == "" {
+		socket = dockerSocket
+		if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+			socket = strings.TrimPrefix(host, "unix://")
+		}
+	}
+
+	return &dockerClient{client: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+func (c *dockerClient) get(path string, v interface{}) error {
+	resp, err := c.client.Get("http://docker" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// containerPids returns PIDs of running containers with given name or ID, or of all containers with given label if
+// `key=value` is given
+func (c *dockerClient) containerPids(container string) ([]int, error) {
+	var ids []string
+
+	if strings.Contains(container, "=") {
+		filters, _ := json.Marshal(map[string][]string{"label": {container}})
+
+		var list []struct {
+			ID string `json:"Id"`
+		}
+		if err := c.get("/containers/json?"+url.Values{"filters": {string(filters)}}.Encode(), &list); err != nil {
+			return nil, err
+		}
+		for _, item := range list {
+			ids = append(ids, item.ID)
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("no running containers with label %s", container)
+		}
+	} else {
+		ids = []string{container}
+	}
+
+	var pids []int
+	for _, id := range ids {
+		var inspect struct {
+			Name  string `json:"Name"`
+			State struct {
+				Pid int `json:"Pid"`
+			} `json:"State"`
+			HostConfig struct {
+				NetworkMode string `json:"NetworkMode"`
+			} `json:"HostConfig"`
+		}
+		if err := c.get("/containers/"+url.PathEscape(id)+"/json", &inspect); err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(inspect.Name, "/")
+		if inspect.State.Pid == 0 {
+			return nil, fmt.Errorf("container %s is not running", name)
+		}
+		if inspect.HostConfig.NetworkMode == "host" {
+			return nil, fmt.Errorf("container %s uses host network, capture host interfaces instead", name)
+		}
+
+		pids = append(pids, inspect.State.Pid)
+	}
+
+	return pids, nil
+}
+
+// netnsPeers returns names of host interfaces which are peers of interfaces in network namespace of process, i.e.
+// host side of veth pairs. Interface of peer is found by its index, read from sysfs of container.
+func netnsPeers(pid int) ([]string, error) {
+	dev, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+	defer dev.Close()
+
+	var peers []string
+
+	// Two header lines are followed by `name: counters` line of each interface
+	scanner := bufio.NewScanner(dev)
+	for line := 0; scanner.Scan(); line++ {
+		colon := strings.IndexByte(scanner.Text(), ':')
+		if line < 2 || colon == -1 {
+			continue
+		}
+
+		name := strings.TrimSpace(scanner.Text()[:colon])
+		if name == "lo" {
+			continue
+		}
+
+		iflink, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "root", "sys", "class", "net", name, "iflink"))
+		if err != nil {
+			return nil, err
+		}
+		index, err := strconv.Atoi(string(bytes.TrimSpace(iflink)))
+		if err != nil {
+			return nil, fmt.Errorf("wrong iflink of %s: %v", name, err)
+		}
+
+		peer, err := net.InterfaceByIndex(index)
+		if err != nil {
+			return nil, fmt.Errorf("peer of %s is not in host network namespace, e.g. overlay network is used", name)
+		}
+		peers = append(peers, peer.Name)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no network interfaces in namespace of process %d", pid)
+	}
+
+	return peers, nil
+}
+
+// containerInterfaces returns names of host interfaces connected to given containers, see containerPids
+func containerInterfaces(client *dockerClient, container string) ([]string, error) {
+	pids, err := client.containerPids(container)
+	if err != nil {
+		return nil, err
+	}
+
+	var interfaces []string
+	for _, pid := range pids {
+		peers, err := netnsPeers(pid)
+		if err != nil {
+			return nil, err
+		}
+		interfaces = append(interfaces, peers...)
+	}
+
+	return interfaces, nil
+}
@@ -0,0 +1,69 @@
+package goreplay
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestContainerInterfaces(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "docker")
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("filters") != `{"label":["app=api"]}` {
+			t.Error("Wrong filters:", r.URL.Query().Get("filters"))
+		}
+		w.Write([]byte(`[{"Id": "abc"}]`))
+	})
+	mux.HandleFunc("/containers/abc/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Name": "/api", "State": {"Pid": 42}, "HostConfig": {"NetworkMode": "bridge"}}`))
+	})
+	mux.HandleFunc("/containers/proxy/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Name": "/proxy", "State": {"Pid": 43}, "HostConfig": {"NetworkMode": "host"}}`))
+	})
+	go http.Serve(listener, mux)
+
+	// Peer of container interface is loopback of host, since it always exists
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("No loopback interface")
+	}
+
+	procRoot = filepath.Join(dir, "proc")
+	defer func() { procRoot = "/proc" }()
+
+	os.MkdirAll(filepath.Join(procRoot, "42", "net"), 0755)
+	os.MkdirAll(filepath.Join(procRoot, "42", "root", "sys", "class", "net", "eth0"), 0755)
+	ioutil.WriteFile(filepath.Join(procRoot, "42", "net", "dev"), []byte("Inter-|   Receive\n face |bytes\n    lo: 0 0\n  eth0: 0 0\n"), 0644)
+	ioutil.WriteFile(filepath.Join(procRoot, "42", "root", "sys", "class", "net", "eth0", "iflink"), []byte(strconv.Itoa(lo.Index)+"\n"), 0644)
+
+	client := newDockerClient(filepath.Join(dir, "docker.sock"))
+
+	interfaces, err := containerInterfaces(client, "app=api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(interfaces, []string{"lo"}) {
+		t.Error("Wrong interfaces:", interfaces)
+	}
+
+	if _, err = containerInterfaces(client, "proxy"); err == nil {
+		t.Error("Container in host network should not be captured")
+	}
+	if _, err = containerInterfaces(client, "missing"); err == nil {
+		t.Error("Missing container should return error")
+	}
+}
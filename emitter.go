@@ -1,87 +1,247 @@
-package main
+package goreplay
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var wg sync.WaitGroup
 var closeOnce sync.Once
 
-// Start initialize loop for sending data from inputs to outputs
-func Start(plugins *InOutPlugins, stop chan int) {
-	if Settings.middleware != "" {
-		middleware := NewMiddleware(Settings.middleware)
+// Number of requests dropped by replay schedule and modifier, reported by NullOutput and admin API
+var filteredRequestsCount int64
+
+// EmitterConfig configures how Emitter copies payloads. Gor binary fills it from flags, see Settings.
+type EmitterConfig struct {
+	// Size of buffer for single payload, 5mb by default
+	CopyBufferSize int64
+	// Command which payloads are passed through, see --middleware
+	Middleware string
+	// Write payloads to each output through own queue of given size, see --output-dispatch-queue
+	DispatchQueue int
+	// Forward payloads after given delay, buffering at most DelayMaxSize bytes per output, see --output-delay
+	Delay        time.Duration
+	DelayMaxSize int64
+	// Split payloads among outputs instead of copying them to every output, see --split-output
+	SplitOutput bool
+	// Modifier of requests, see --http-* flags
+	Modifier       *HTTPModifierConfig
+	HTTPDecompress bool
+	PrettifyHTTP   bool
+	PrettifyDNS    bool
+	// Log payloads read from inputs, see --debug
+	Debug bool
+
+	replaySchedule  *replaySchedule
+	captureSchedule captureSchedule
+	// Verifier of --verify, memory budget of --max-memory and terminal UI of --tui, nil if they are not enabled
+	verifier *deliveryVerifier
+	memory   *memoryBudget
+	terminal *terminalUI
+}
+
+// emitterConfig returns configuration of Emitter set by flags
+func (s *AppSettings) emitterConfig() EmitterConfig {
+	return EmitterConfig{
+		CopyBufferSize:  s.copyBufferSize,
+		Middleware:      s.middleware,
+		DispatchQueue:   s.outputDispatchQueue,
+		Delay:           s.outputDelay,
+		DelayMaxSize:    s.outputDelayMaxSize,
+		SplitOutput:     s.splitOutput,
+		Modifier:        &s.modifierConfig,
+		HTTPDecompress:  s.httpDecompress,
+		PrettifyHTTP:    s.prettifyHTTP,
+		PrettifyDNS:     s.prettifyDNS,
+		Debug:           s.debug,
+		replaySchedule:  s.replaySchedule,
+		captureSchedule: s.captureSchedule,
+		verifier:        mirrorVerifier,
+		memory:          memoryGuard,
+		terminal:        terminal,
+	}
+}
+
+// truncatingRequest is request split into chunks, which body is truncated by --http-truncate-body once it reaches
+// the limit
+type truncatingRequest struct {
+	remaining int
+	updated   time.Time
+}
+
+// Emitter connects plugins together: it copies payloads from every input
+// (and from outputs which are readers as well, e.g. returning responses) to all outputs
+type Emitter struct {
+	plugins *InOutPlugins
+	config  EmitterConfig
+}
+
+// NewEmitter constructor for Emitter, accepts plugins which should be connected and configuration of copying
+func NewEmitter(plugins *InOutPlugins, config EmitterConfig) *Emitter {
+	if config.CopyBufferSize <= 0 {
+		config.CopyBufferSize = 5 << 20
+	}
+	if config.Modifier == nil {
+		config.Modifier = &HTTPModifierConfig{}
+	}
+
+	return &Emitter{plugins: plugins, config: config}
+}
+
+// Start initialize loop for sending data from inputs to outputs.
+// It blocks until given context is cancelled or copying fails, and closes all plugins before returning.
+func (e *Emitter) Start(ctx context.Context) error {
+	errs := make(chan error, 1)
+
+	// Best-effort outputs always have own queue, so they can drop payloads instead of slowing down other outputs
+	outputs := make([]io.Writer, len(e.plugins.Outputs))
+	var dispatchers []*outputDispatcher
+	var delayed []*delayedOutput
+	for i, out := range e.plugins.Outputs {
+		priority := e.plugins.outputPriority(i)
+		queue := e.config.DispatchQueue
+		if queue <= 0 && priority == priorityBestEffort {
+			queue = bestEffortQueue
+		}
+
+		outputs[i] = out
+		if queue > 0 {
+			d := newOutputDispatcher(out, queue, priority)
+			dispatchers = append(dispatchers, d)
+			outputs[i] = d
+		}
+
+		if e.config.Delay > 0 {
+			maxSize := e.config.DelayMaxSize
+			// Critical outputs never drop payloads
+			if priority == priorityCritical {
+				maxSize = 0
+			}
+			d := newDelayedOutput(outputs[i], e.config.Delay, maxSize, priority)
+			delayed = append(delayed, d)
+			outputs[i] = d
+		}
+	}
+
+	copyFrom := func(src io.Reader) {
+		go func() {
+			if err := e.copy(src, outputs...); err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+		}()
+	}
 
-		for _, in := range plugins.Inputs {
+	if e.config.Middleware != "" {
+		middleware := NewMiddleware(e.config.Middleware)
+
+		for _, in := range e.plugins.Inputs {
 			middleware.ReadFrom(in)
 		}
 
 		// We are going only to read responses, so using same ReadFrom method
-		for _, out := range plugins.Outputs {
+		for _, out := range e.plugins.Outputs {
 			if r, ok := out.(io.Reader); ok {
 				middleware.ReadFrom(r)
 			}
 		}
-		wg.Add(1)
-		go func() {
-			if err := CopyMulty(middleware, plugins.Outputs...); err != nil {
-				log.Println("Error during copy: ", err)
-				Close(stop)
-			}
-		}()
+
+		copyFrom(middleware)
 	} else {
-		for _, in := range plugins.Inputs {
-			wg.Add(1)
-			go func(in io.Reader) {
-				if err := CopyMulty(in, plugins.Outputs...); err != nil {
-					log.Println("Error during copy: ", err)
-					Close(stop)
-				}
-			}(in)
+		for _, in := range e.plugins.Inputs {
+			copyFrom(in)
 		}
 
-		for _, out := range plugins.Outputs {
+		for _, out := range e.plugins.Outputs {
 			if r, ok := out.(io.Reader); ok {
-				wg.Add(1)
-				go func(r io.Reader) {
-					if err := CopyMulty(r, plugins.Outputs...); err != nil {
-						log.Println("Error during copy: ", err)
-						Close(stop)
-					}
-				}(r)
+				copyFrom(r)
 			}
 		}
 	}
 
-	for {
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+
+	for _, d := range delayed {
+		d.Close()
+	}
+	for _, d := range dispatchers {
+		d.Close()
+	}
+	finalize(e.plugins)
+
+	return err
+}
+
+// Start initialize loop for sending data from inputs to outputs, until stop channel is closed.
+// It is a shortcut for running Emitter without context, configured by flags.
+func Start(plugins *InOutPlugins, stop chan int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
 		select {
 		case <-stop:
-			finalize(plugins)
-			return
-		case <-time.After(100 * time.Millisecond):
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
+
+	if err := NewEmitter(plugins, Settings.emitterConfig()).Start(ctx); err != nil {
+		log.Println("Error during copy: ", err)
+		Close(stop)
 	}
 }
 
-// Close closes all the goroutine and waits for it to finish.
+// Close stops pipeline started by Start
 func Close(quit chan int) {
 	closeOnce.Do(func() {
 		close(quit)
 	})
-	wg.Wait()
 }
 
-// CopyMulty copies from 1 reader to multiple writers
+// dispatched tells if writer is output dispatcher or delayed output, which record payloads in terminal UI once output
+// writes them
+func dispatched(w io.Writer) bool {
+	switch w.(type) {
+	case *outputDispatcher, *delayedOutput:
+		return true
+	}
+	return false
+}
+
+// outputPaused tells if output with given index is paused by admin API
+func (e *Emitter) outputPaused(index int) bool {
+	return e.plugins != nil && e.plugins.outputPaused(index)
+}
+
+// CopyMulty copies from 1 reader to multiple writers, configured by flags
 func CopyMulty(src io.Reader, writers ...io.Writer) error {
-	defer wg.Done()
-	buf := make([]byte, Settings.copyBufferSize)
+	return NewEmitter(nil, Settings.emitterConfig()).copy(src, writers...)
+}
+
+// copy copies from 1 reader to multiple writers
+func (e *Emitter) copy(src io.Reader, writers ...io.Writer) error {
+	buf := make([]byte, e.config.CopyBufferSize)
 	wIndex := 0
-	modifier := NewHTTPModifier(&Settings.modifierConfig)
+	modifier := NewHTTPModifier(e.config.Modifier)
+	schedule := e.config.replaySchedule
+	captureSchedule := e.config.captureSchedule
+	verifier, memory, terminal := e.config.verifier, e.config.memory, e.config.terminal
 	filteredRequests := make(map[string]time.Time)
+	// Requests split into chunks, which body was truncated, and requests which body is not truncated yet, with number
+	// of body bytes left to the limit of --http-truncate-body
+	truncatedRequests := make(map[string]time.Time)
+	truncatingRequests := make(map[string]truncatingRequest)
 	filteredRequestsLastCleanTime := time.Now()
 
 	i := 0
@@ -102,62 +262,179 @@ func CopyMulty(src io.Reader, writers ...io.Writer) error {
 		}
 		if nr > 0 && len(buf) > nr {
 			payload := buf[:nr]
-			meta := payloadMeta(payload)
-			if len(meta) < 3 {
-				if Settings.debug {
+			info, ok := parsePayloadInfo(payload)
+			if !ok {
+				if e.config.Debug {
 					Debug("[EMITTER] Found malformed record", string(payload[0:_maxN]), nr, "from:", src)
 				}
 				continue
 			}
-			requestID := string(meta[1])
+			chunked := info.chunked
+
+			// Requests are counted as soon as they are read, so requests dropped on the way are reported
+			if verifier != nil && info.kind == RequestPayload && info.chunk == 0 {
+				verifier.capture(info.id)
+			}
+
+			if terminal != nil {
+				terminal.read(src, payload)
+			}
 
 			if nr >= 5*1024*1024 {
 				log.Println("INFO: Large packet... We received ", len(payload), " bytes from ", src)
 			}
 
-			if Settings.debug {
+			if e.config.Debug {
 				Debug("[EMITTER] input:", string(payload[0:_maxN]), nr, "from:", src)
 			}
 
-			if modifier != nil {
-				if isRequestPayload(payload) {
+			// Bodies are decompressed before filters, so they see the same body as outputs
+			if e.config.HTTPDecompress && !chunked {
+				payload = decompressHTTP(payload)
+			}
+
+			// Map lookups by string(info.id) don't allocate, ID is copied only when request is filtered
+			if info.kind == RequestPayload && info.chunk > 0 {
+				// Only the first chunk has HTTP headers, following chunks share its decision
+				if _, ok := filteredRequests[string(info.id)]; ok {
+					continue
+				}
+				// Following chunks are beyond truncated body
+				if _, ok := truncatedRequests[string(info.id)]; ok {
+					if !info.more {
+						delete(truncatedRequests, string(info.id))
+					}
+					continue
+				}
+				// Body is truncated in the chunk reaching the limit
+				if r, ok := truncatingRequests[string(info.id)]; ok {
+					headSize := bytes.IndexByte(payload, '\n') + 1
+					if size := len(payload) - headSize; size >= r.remaining {
+						payload = payloadLastChunk(payload[:headSize+r.remaining])
+						delete(truncatingRequests, string(info.id))
+						if info.more {
+							truncatedRequests[string(info.id)] = time.Now()
+						}
+					} else if !info.more {
+						delete(truncatingRequests, string(info.id))
+					} else {
+						truncatingRequests[string(info.id)] = truncatingRequest{r.remaining - size, time.Now()}
+					}
+				}
+			} else if info.kind == RequestPayload {
+				// Requests outside of replay windows are dropped, with their responses
+				if schedule != nil && !schedule.Active(time.Now()) {
+					filteredRequests[string(info.id)] = time.Now()
+					atomic.AddInt64(&filteredRequestsCount, 1)
+					if verifier != nil {
+						verifier.filter(info.id)
+					}
+					continue
+				}
+
+				// Requests captured outside of capture windows are dropped, with their responses
+				if captureSchedule != nil {
+					if !captureSchedule.Contains(time.Unix(0, info.timestamp)) {
+						filteredRequests[string(info.id)] = time.Now()
+						atomic.AddInt64(&filteredRequestsCount, 1)
+						if verifier != nil {
+							verifier.filter(info.id)
+						}
+						continue
+					}
+				}
+
+				// Input is sampled down while memory budget is exceeded
+				if memory != nil && !memory.keepRequest() {
+					filteredRequests[string(info.id)] = time.Now()
+					if verifier != nil {
+						verifier.shed(info.id, true)
+					}
+					continue
+				}
+
+				if modifier != nil {
 					headSize := bytes.IndexByte(payload, '\n') + 1
 					body := payload[headSize:]
 					originalBodyLen := len(body)
-					body = modifier.Rewrite(body)
+					if modifier.AllowClient(info.addr) {
+						body = modifier.Rewrite(body)
+					} else {
+						body = nil
+					}
 
 					// If modifier tells to skip request
 					if len(body) == 0 {
-						filteredRequests[requestID] = time.Now()
+						filteredRequests[string(info.id)] = time.Now()
+						atomic.AddInt64(&filteredRequestsCount, 1)
+						if verifier != nil {
+							verifier.filter(info.id)
+						}
 						continue
 					}
 
-					if originalBodyLen != len(body) {
+					if originalBodyLen != len(body) || !bytes.Equal(body, payload[headSize:]) {
 						payload = append(payload[:headSize], body...)
 					}
 
-					if Settings.debug {
+					if info.more {
+						if remaining, ok := modifier.BodyRemaining(body); ok && remaining <= 0 {
+							payload = payloadLastChunk(payload)
+							truncatedRequests[string(info.id)] = time.Now()
+						} else if ok {
+							truncatingRequests[string(info.id)] = truncatingRequest{remaining, time.Now()}
+						}
+					}
+
+					if e.config.Debug {
 						Debug("[EMITTER] Rewritten input:", len(payload), "First 500 bytes:", string(payload[0:_maxN]))
 					}
-				} else {
-					if _, ok := filteredRequests[requestID]; ok {
-						delete(filteredRequests, requestID)
-						continue
+				}
+			} else {
+				if _, ok := filteredRequests[string(info.id)]; ok {
+					if !info.more {
+						delete(filteredRequests, string(info.id))
 					}
+					continue
 				}
 			}
 
-			if Settings.prettifyHTTP {
+			// Prettifier needs the whole body
+			if e.config.PrettifyHTTP && !chunked {
 				payload = prettifyHTTP(payload)
 				if len(payload) == 0 {
+					if verifier != nil && info.kind == RequestPayload {
+						verifier.filter(info.id)
+					}
 					continue
 				}
 			}
 
-			if Settings.splitOutput {
-				// Simple round robin
-				if _, err := writers[wIndex].Write(payload); err != nil {
-					return err
+			if e.config.PrettifyDNS {
+				payload = prettifyDNS(payload)
+			}
+
+			if e.config.SplitOutput {
+				// Simple round robin, skipping outputs shed while memory budget is exceeded, and paused outputs
+				for n := 0; n < len(writers) && (memory != nil && memory.shedOutput(wIndex) || e.outputPaused(wIndex)); n++ {
+					wIndex = (wIndex + 1) % len(writers)
+				}
+				if e.outputPaused(wIndex) {
+					// All outputs are paused
+					atomic.AddUint64(&pausedPayloads, 1)
+				} else if memory != nil && memory.shedOutput(wIndex) {
+					// All outputs which are not paused are shed
+					memory.dropShed(wIndex)
+					if verifier != nil && info.kind == RequestPayload && info.chunk == 0 {
+						verifier.shed(info.id, false)
+					}
+				} else {
+					if _, err := writers[wIndex].Write(payload); err != nil {
+						return err
+					}
+					if terminal != nil && !dispatched(writers[wIndex]) {
+						terminal.write(writers[wIndex], payload)
+					}
 				}
 
 				wIndex++
@@ -166,10 +443,24 @@ func CopyMulty(src io.Reader, writers ...io.Writer) error {
 					wIndex = 0
 				}
 			} else {
-				for _, dst := range writers {
+				for i, dst := range writers {
+					if e.outputPaused(i) {
+						atomic.AddUint64(&pausedPayloads, 1)
+						continue
+					}
+					if memory != nil && memory.shedOutput(i) {
+						memory.dropShed(i)
+						if verifier != nil && info.kind == RequestPayload && info.chunk == 0 {
+							verifier.shed(info.id, false)
+						}
+						continue
+					}
 					if _, err := dst.Write(payload); err != nil {
 						return err
 					}
+					if terminal != nil && !dispatched(dst) {
+						terminal.write(dst, payload)
+					}
 				}
 			}
 		} else if nr > 0 {
@@ -186,6 +477,16 @@ func CopyMulty(src io.Reader, writers ...io.Writer) error {
 						delete(filteredRequests, k)
 					}
 				}
+				for k, v := range truncatedRequests {
+					if now.Sub(v) > 60*time.Second {
+						delete(truncatedRequests, k)
+					}
+				}
+				for k, v := range truncatingRequests {
+					if now.Sub(v.updated) > 60*time.Second {
+						delete(truncatingRequests, k)
+					}
+				}
 				filteredRequestsLastCleanTime = time.Now()
 			}
 		}
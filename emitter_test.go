@@ -1,7 +1,12 @@
-package main
+package goreplay
 
 import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
 	"io"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -34,9 +39,60 @@ func TestEmitter(t *testing.T) {
 	close(quit)
 }
 
+func TestEmitterContext(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+	output := NewTestOutput(func(data []byte) {
+		wg.Done()
+	})
+
+	plugins := NewPlugins()
+	plugins.AddPlugin(input, "")
+	plugins.AddPlugin(output, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- NewEmitter(plugins, EmitterConfig{}).Start(ctx)
+	}()
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		input.EmitGET()
+	}
+
+	wg.Wait()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Should stop without error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Emitter should stop after context cancellation")
+	}
+}
+
+// startEmitter runs emitter with given configuration, instead of configuration of Settings. Returned function stops
+// emitter and waits until it stops reading inputs.
+func startEmitter(plugins *InOutPlugins, config EmitterConfig) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- NewEmitter(plugins, config).Start(ctx)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
 func TestEmitterFiltered(t *testing.T) {
 	wg := new(sync.WaitGroup)
-	quit := make(chan int)
 
 	input := NewTestInput()
 	input.skipHeader = true
@@ -50,9 +106,7 @@ func TestEmitterFiltered(t *testing.T) {
 		Outputs: []io.Writer{output},
 	}
 	methods := HTTPMethods{[]byte("GET")}
-	Settings.modifierConfig = HTTPModifierConfig{methods: methods}
-
-	go Start(plugins, quit)
+	stop := startEmitter(plugins, EmitterConfig{Modifier: &HTTPModifierConfig{methods: methods}})
 
 	wg.Add(2)
 
@@ -78,14 +132,132 @@ func TestEmitterFiltered(t *testing.T) {
 
 	wg.Wait()
 
-	Close(quit)
+	stop()
+}
 
-	Settings.modifierConfig = HTTPModifierConfig{}
+func TestEmitterVerify(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+	input.skipHeader = true
+
+	output := NewTestOutput(func(data []byte) {
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+	verifier := newDeliveryVerifier("X-Gor-Verify")
+	stop := startEmitter(plugins, EmitterConfig{Modifier: &HTTPModifierConfig{methods: HTTPMethods{[]byte("GET")}}, verifier: verifier})
+	defer stop()
+
+	wg.Add(1)
+	filtered, sent := uuid(), uuid()
+	input.EmitBytes(append(payloadHeader(RequestPayload, filtered, time.Now().UnixNano(), -1), "POST / HTTP/1.1\r\n\r\n"...))
+	input.EmitBytes(append(payloadHeader(RequestPayload, sent, time.Now().UnixNano(), -1), "GET / HTTP/1.1\r\n\r\n"...))
+	wg.Wait()
+
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+
+	// Request is counted when it is read, and filtered request is not expected to reach target
+	if verifier.captured != 2 || verifier.filtered != 1 {
+		t.Errorf("Expected 2 captured and 1 filtered requests, got %d and %d", verifier.captured, verifier.filtered)
+	}
+	if _, ok := verifier.pending[string(sent)]; !ok {
+		t.Error("Request written to output should be pending")
+	}
+}
+
+func TestEmitterFilteredChunks(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+	input.skipHeader = true
+
+	output := NewTestOutput(func(data []byte) {
+		if !bytes.Contains(data, []byte("GET")) && !bytes.Contains(data, []byte("body")) {
+			t.Error("Chunks of filtered message should be dropped", string(data))
+		}
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+	methods := HTTPMethods{[]byte("GET")}
+	stop := startEmitter(plugins, EmitterConfig{Modifier: &HTTPModifierConfig{methods: methods}})
+
+	// Filtered request is emitted first, so all its chunks are processed before the last expected chunk
+	wg.Add(2)
+
+	for _, method := range []string{"POST", "GET"} {
+		header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1)
+		input.EmitBytes(append(payloadChunkHeader(header, 0, true), []byte(method+" / HTTP/1.1\r\nContent-Length: 4\r\n\r\n")...))
+
+		if method == "POST" {
+			input.EmitBytes(append(payloadChunkHeader(header, 1, false), []byte("data")...))
+		} else {
+			input.EmitBytes(append(payloadChunkHeader(header, 1, false), []byte("body")...))
+		}
+	}
+
+	wg.Wait()
+
+	stop()
+}
+
+func TestEmitterTruncatedChunks(t *testing.T) {
+	input := NewTestInput()
+	input.skipHeader = true
+
+	written := make(chan []byte, 10)
+	output := NewTestOutput(func(data []byte) {
+		written <- append([]byte(nil), data...)
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+	stop := startEmitter(plugins, EmitterConfig{Modifier: &HTTPModifierConfig{truncateBodySize: 10}})
+	defer stop()
+
+	// The first chunk is shorter than the limit, which is reached in the third chunk
+	header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1)
+	input.EmitBytes(append(payloadChunkHeader(header, 0, true), "POST / HTTP/1.1\r\nContent-Length: 20\r\n\r\nabc"...))
+	input.EmitBytes(append(payloadChunkHeader(header, 1, true), "defgh"...))
+	input.EmitBytes(append(payloadChunkHeader(header, 2, true), "ijklmn"...))
+	input.EmitBytes(append(payloadChunkHeader(header, 3, false), "opqrst"...))
+
+	expected := []string{
+		string(payloadChunkHeader(header, 0, true)) + "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc",
+		string(payloadChunkHeader(header, 1, true)) + "defgh",
+		string(payloadChunkHeader(header, 2, false)) + "ij",
+	}
+	for _, e := range expected {
+		select {
+		case data := <-written:
+			if string(data) != e {
+				t.Errorf("Expected %q, got %q", e, data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Chunk should be written", e)
+		}
+	}
+
+	select {
+	case data := <-written:
+		t.Error("Chunks beyond truncated body should be dropped", string(data))
+	case <-time.After(50 * time.Millisecond):
+	}
 }
 
 func TestEmitterRoundRobin(t *testing.T) {
 	wg := new(sync.WaitGroup)
-	quit := make(chan int)
 
 	input := NewTestInput()
 
@@ -106,9 +278,7 @@ func TestEmitterRoundRobin(t *testing.T) {
 		Outputs: []io.Writer{output1, output2},
 	}
 
-	Settings.splitOutput = true
-
-	go Start(plugins, quit)
+	stop := startEmitter(plugins, EmitterConfig{SplitOutput: true})
 
 	for i := 0; i < 1000; i++ {
 		wg.Add(1)
@@ -117,13 +287,179 @@ func TestEmitterRoundRobin(t *testing.T) {
 
 	wg.Wait()
 
-	close(quit)
+	stop()
 
 	if counter1 == 0 || counter2 == 0 {
 		t.Errorf("Round robin should split traffic equally: %d vs %d", counter1, counter2)
 	}
+}
+
+func TestEmitterConfig(t *testing.T) {
+	// Importing package doesn't define flags of embedding program
+	if flag.Lookup("input-raw") != nil {
+		t.Error("Flags should be defined by RegisterFlags only")
+	}
+
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+
+	var counter1, counter2 int32
+
+	output1 := NewTestOutput(func(data []byte) {
+		atomic.AddInt32(&counter1, 1)
+		wg.Done()
+	})
+
+	output2 := NewTestOutput(func(data []byte) {
+		atomic.AddInt32(&counter2, 1)
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output1, output2},
+	}
+
+	// Configuration is passed to emitter, not read from Settings
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- NewEmitter(plugins, EmitterConfig{SplitOutput: true, DispatchQueue: 10}).Start(ctx)
+	}()
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		input.EmitGET()
+	}
 
-	Settings.splitOutput = false
+	wg.Wait()
+	cancel()
+	<-done
+
+	if counter1+counter2 != 100 || counter1 == 0 || counter2 == 0 {
+		t.Errorf("Traffic should be split among outputs: %d vs %d", counter1, counter2)
+	}
+}
+
+func TestEmitterDispatch(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+
+	var outputs []io.Writer
+	for i := 0; i < 3; i++ {
+		next := 0
+		outputs = append(outputs, NewTestOutput(func(data []byte) {
+			// Each output gets payloads in order they were read
+			if want := fmt.Sprintf("GET /%d ", next); !bytes.Contains(data, []byte(want)) {
+				t.Errorf("Expected %q, got %q", want, payloadBody(data))
+			}
+			next++
+			wg.Done()
+		}))
+	}
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: outputs,
+	}
+
+	stop := startEmitter(plugins, EmitterConfig{DispatchQueue: 10})
+
+	for i := 0; i < 1000; i++ {
+		wg.Add(len(outputs))
+		input.EmitBytes([]byte(fmt.Sprintf("GET /%d HTTP/1.1\r\n\r\n", i)))
+	}
+
+	wg.Wait()
+
+	stop()
+}
+
+func TestEmitterOutputDelay(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	var times []time.Time
+
+	output := NewTestOutput(func(data []byte) {
+		mu.Lock()
+		received = append(received, string(payloadBody(data)))
+		times = append(times, time.Now())
+		mu.Unlock()
+	})
+
+	delayed := newDelayedOutput(output, 100*time.Millisecond, 0, priorityNormal)
+
+	start := time.Now()
+	// Response is captured 50ms after request, and is written first. Payload read from file has old timestamp.
+	delayed.Write(append(payloadHeader(ResponsePayload, uuid(), start.UnixNano(), 1), "HTTP/1.1 200 OK\r\n\r\n"...))
+	delayed.Write(append(payloadHeader(RequestPayload, uuid(), start.Add(-50*time.Millisecond).UnixNano(), -1), "GET / HTTP/1.1\r\n\r\n"...))
+	delayed.Write(append(payloadHeader(RequestPayload, uuid(), start.Add(-time.Hour).UnixNano(), -1), "GET /old HTTP/1.1\r\n\r\n"...))
+	// Not due before close
+	delayed.Write(append(payloadHeader(RequestPayload, uuid(), start.Add(time.Hour).UnixNano(), -1), "GET /late HTTP/1.1\r\n\r\n"...))
+
+	time.Sleep(30 * time.Millisecond)
+	mu.Lock()
+	if len(received) != 0 {
+		t.Error("Payloads should not be forwarded before delay", received)
+	}
+	mu.Unlock()
+
+	time.Sleep(150 * time.Millisecond)
+	delayed.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"GET / HTTP/1.1\r\n\r\n", "HTTP/1.1 200 OK\r\n\r\n", "GET /old HTTP/1.1\r\n\r\n"}
+	if strings.Join(received, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Expected %q, got %q", expected, received)
+	}
+
+	// Response keeps its original distance from request
+	if d := times[1].Sub(times[0]); d < 40*time.Millisecond {
+		t.Errorf("Expected original timing, response forwarded %s after request", d)
+	}
+}
+
+func TestEmitterOutputDelayMaxSize(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+
+	output := NewTestOutput(func(data []byte) {
+		mu.Lock()
+		received = append(received, string(payloadBody(data)))
+		mu.Unlock()
+	})
+
+	request := func(path string) []byte {
+		return append(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), "GET "+path+" HTTP/1.1\r\n\r\n"...)
+	}
+	first, second := request("/1"), request("/2")
+
+	// Buffer fits only the first payload
+	delayed := newDelayedOutput(output, 50*time.Millisecond, int64(len(first)+len(second)-1), priorityNormal)
+	dropped := atomic.LoadUint64(&delayDroppedPayloads)
+
+	delayed.Write(first)
+	delayed.Write(second)
+
+	if n := atomic.LoadUint64(&delayDroppedPayloads) - dropped; n != 1 {
+		t.Errorf("Expected 1 dropped payload, got %d", n)
+	}
+
+	// Buffer has space again once payload is forwarded
+	time.Sleep(100 * time.Millisecond)
+	delayed.Write(request("/3"))
+	time.Sleep(100 * time.Millisecond)
+	delayed.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"GET /1 HTTP/1.1\r\n\r\n", "GET /3 HTTP/1.1\r\n\r\n"}
+	if strings.Join(received, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected %q, got %q", expected, received)
+	}
 }
 
 func BenchmarkEmitter(b *testing.B) {
@@ -153,3 +489,60 @@ func BenchmarkEmitter(b *testing.B) {
 	wg.Wait()
 	close(quit)
 }
+
+func TestEmitterPausedOutput(t *testing.T) {
+	input := NewTestInput()
+	written := make(chan []byte, 10)
+	output := NewTestOutput(func(data []byte) {
+		written <- data
+	})
+
+	plugins := NewPlugins()
+	plugins.AddPlugin(input, "")
+	plugins.AddPlugin(output, "")
+	plugins.pauseOutput(0, true)
+
+	quit := make(chan int)
+	go Start(plugins, quit)
+	defer close(quit)
+
+	input.EmitGET()
+	select {
+	case <-written:
+		t.Error("payload is written to paused output")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	plugins.pauseOutput(0, false)
+	input.EmitGET()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Error("payload is not written to resumed output")
+	}
+}
+
+func TestEmitterReplaySchedule(t *testing.T) {
+
+	input := NewTestInput()
+	input.skipHeader = true
+
+	output := NewTestOutput(func(data []byte) {
+		t.Error("Traffic outside of replay window should be dropped", string(data))
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+	// Schedule without windows is never active
+	stop := startEmitter(plugins, EmitterConfig{replaySchedule: &replaySchedule{}})
+
+	id := uuid()
+	input.EmitBytes(append(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), []byte("GET / HTTP/1.1\r\n\r\n")...))
+	input.EmitBytes(append(payloadHeader(ResponsePayload, id, time.Now().UnixNano()+1, 1), []byte("HTTP/1.1 200 OK\r\n\r\n")...))
+
+	time.Sleep(50 * time.Millisecond)
+
+	stop()
+}
@@ -0,0 +1,180 @@
+package fastcgi
+
+import (
+	"bytes"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Request is a request sent by web server to application
+type Request struct {
+	ID     uint16
+	Params []Param
+	Stdin  []byte
+}
+
+// Param returns value of param with given name
+func (r *Request) Param(name string) string {
+	for _, p := range r.Params {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+
+	return ""
+}
+
+// ParseRequest parses records of single request. Management records and aborts are not requests, and nil is returned.
+func ParseRequest(data []byte) (*Request, error) {
+	records, err := Records(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 || records[0].Type != TypeBeginRequest {
+		return nil, nil
+	}
+
+	r := &Request{ID: records[0].RequestID}
+
+	var params []byte
+	for _, record := range records[1:] {
+		if record.RequestID != r.ID {
+			continue
+		}
+
+		switch record.Type {
+		case TypeParams:
+			params = append(params, record.Content...)
+		case TypeStdin:
+			r.Stdin = append(r.Stdin, record.Content...)
+		}
+	}
+
+	if r.Params, err = ParseParams(params); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// HTTP translates request into equivalent HTTP/1.1 request. Headers are restored from `HTTP_*` params, and URI from
+// REQUEST_URI, or from script name, path info and query string if it is not set.
+func (r *Request) HTTP() ([]byte, error) {
+	method := r.Param("REQUEST_METHOD")
+	if method == "" {
+		return nil, ErrMalformed
+	}
+
+	uri := r.Param("REQUEST_URI")
+	if uri == "" {
+		uri = r.Param("SCRIPT_NAME") + r.Param("PATH_INFO")
+		if q := r.Param("QUERY_STRING"); q != "" {
+			uri += "?" + q
+		}
+	}
+	if uri == "" {
+		return nil, ErrMalformed
+	}
+
+	var b bytes.Buffer
+	b.WriteString(method + " " + uri + " HTTP/1.1\r\n")
+
+	if r.Param("HTTP_HOST") == "" && r.Param("SERVER_NAME") != "" {
+		b.WriteString("Host: " + r.Param("SERVER_NAME") + "\r\n")
+	}
+
+	for _, p := range r.Params {
+		var name string
+		switch {
+		case p.Name == "CONTENT_TYPE" && p.Value != "":
+			name = "Content-Type"
+		case strings.HasPrefix(p.Name, "HTTP_"):
+			name = textproto.CanonicalMIMEHeaderKey(strings.Replace(p.Name[5:], "_", "-", -1))
+		}
+
+		// Body is already decoded by web server, and its length is set below
+		if name == "" || name == "Content-Length" || name == "Transfer-Encoding" {
+			continue
+		}
+
+		b.WriteString(name + ": " + p.Value + "\r\n")
+	}
+
+	if len(r.Stdin) > 0 {
+		b.WriteString("Content-Length: " + strconv.Itoa(len(r.Stdin)) + "\r\n")
+	}
+	b.WriteString("\r\n")
+	b.Write(r.Stdin)
+
+	return b.Bytes(), nil
+}
+
+// ParseResponse parses records of single response, and translates CGI response written by application to stdout into
+// equivalent HTTP/1.1 response. Responses to management records are not translated, and nil is returned.
+func ParseResponse(data []byte) ([]byte, error) {
+	records, err := Records(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 || records[0].RequestID == 0 {
+		return nil, nil
+	}
+
+	var stdout []byte
+	for _, record := range records {
+		if record.Type == TypeStdout {
+			stdout = append(stdout, record.Content...)
+		}
+	}
+
+	// Header lines can end with LF only
+	end, sep := bytes.Index(stdout, []byte("\r\n\r\n")), 4
+	if lf := bytes.Index(stdout, []byte("\n\n")); lf != -1 && (end == -1 || lf < end) {
+		end, sep = lf, 2
+	}
+	if end == -1 {
+		return nil, ErrMalformed
+	}
+
+	body := stdout[end+sep:]
+	status := "200 OK"
+	var headers bytes.Buffer
+
+	for _, line := range strings.Split(string(stdout[:end]), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		i := strings.IndexByte(line, ':')
+		if i == -1 {
+			return nil, ErrMalformed
+		}
+
+		name, value := textproto.CanonicalMIMEHeaderKey(line[:i]), strings.TrimSpace(line[i+1:])
+		switch name {
+		case "Status":
+			status = value
+			if code, err := strconv.Atoi(value); err == nil {
+				status += " " + http.StatusText(code)
+			}
+			continue
+		case "Location":
+			if status == "200 OK" && strings.HasPrefix(value, "http") {
+				status = "302 Found"
+			}
+		case "Content-Length", "Transfer-Encoding":
+			continue
+		}
+
+		headers.WriteString(name + ": " + value + "\r\n")
+	}
+
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 " + status + "\r\n")
+	b.Write(headers.Bytes())
+	b.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n")
+	b.Write(body)
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,71 @@
+package fastcgi
+
+import (
+	"testing"
+)
+
+func TestRequestHTTP(t *testing.T) {
+	data := beginRequest(1)
+	data = AppendRecord(data, TypeParams, 1, AppendParams(nil,
+		Param{"SCRIPT_FILENAME", "/var/www/index.php"},
+		Param{"QUERY_STRING", "page=2"},
+		Param{"REQUEST_METHOD", "POST"},
+		Param{"CONTENT_TYPE", "application/json"},
+		Param{"CONTENT_LENGTH", "7"},
+		Param{"REQUEST_URI", "/orders?page=2"},
+		Param{"REMOTE_ADDR", "203.0.113.5"},
+		Param{"HTTP_HOST", "shop.example.com"},
+		Param{"HTTP_X_REQUEST_ID", "abc"},
+		Param{"HTTP_TRANSFER_ENCODING", "chunked"},
+	))
+	data = AppendRecord(data, TypeParams, 1, nil)
+	data = AppendRecord(data, TypeStdin, 1, []byte(`{"a":`))
+	data = AppendRecord(data, TypeStdin, 1, []byte(`1}`))
+	data = AppendRecord(data, TypeStdin, 1, nil)
+
+	r, err := ParseRequest(data)
+	if err != nil || r.ID != 1 || r.Param("REMOTE_ADDR") != "203.0.113.5" {
+		t.Fatal("Wrong request", r, err)
+	}
+
+	req, err := r.HTTP()
+	expected := "POST /orders?page=2 HTTP/1.1\r\nContent-Type: application/json\r\nHost: shop.example.com\r\nX-Request-Id: abc\r\nContent-Length: 7\r\n\r\n{\"a\":1}"
+	if err != nil || string(req) != expected {
+		t.Errorf("Wrong HTTP request: %q", req)
+	}
+
+	// URI is restored from script name, and host from server name
+	r = &Request{Params: []Param{{"REQUEST_METHOD", "GET"}, {"SCRIPT_NAME", "/index.php"}, {"PATH_INFO", "/users"}, {"QUERY_STRING", "id=1"}, {"SERVER_NAME", "example.com"}}}
+	if req, _ = r.HTTP(); string(req) != "GET /index.php/users?id=1 HTTP/1.1\r\nHost: example.com\r\n\r\n" {
+		t.Errorf("Wrong HTTP request: %q", req)
+	}
+
+	if r, err = ParseRequest(AppendRecord(nil, TypeGetValues, 0, nil)); r != nil || err != nil {
+		t.Error("Management records are not requests")
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	data := AppendRecord(nil, TypeStdout, 1, []byte("Status: 404\r\nContent-type: text/html\r\n"))
+	data = AppendRecord(data, TypeStderr, 1, []byte("PHP Notice"))
+	data = AppendRecord(data, TypeStdout, 1, []byte("\r\nNot found"))
+	data = AppendRecord(data, TypeStdout, 1, nil)
+	data = AppendRecord(data, TypeEndRequest, 1, make([]byte, 8))
+
+	resp, err := ParseResponse(data)
+	if err != nil || string(resp) != "HTTP/1.1 404 Not Found\r\nContent-Type: text/html\r\nContent-Length: 9\r\n\r\nNot found" {
+		t.Errorf("Wrong HTTP response: %q %v", resp, err)
+	}
+
+	// Headers can end with LF, and absolute location without status is a redirect
+	data = AppendRecord(nil, TypeStdout, 1, []byte("Location: https://example.com/\nX-Powered-By: PHP\n\n"))
+	data = AppendRecord(data, TypeEndRequest, 1, make([]byte, 8))
+
+	if resp, _ = ParseResponse(data); string(resp) != "HTTP/1.1 302 Found\r\nLocation: https://example.com/\r\nX-Powered-By: PHP\r\nContent-Length: 0\r\n\r\n" {
+		t.Errorf("Wrong HTTP response: %q", resp)
+	}
+
+	if _, err = ParseResponse(AppendRecord(nil, TypeStdout, 1, []byte("no headers"))); err != ErrMalformed {
+		t.Error("Should reject response without headers")
+	}
+}
@@ -0,0 +1,194 @@
+// Package fastcgi parses FastCGI records exchanged between web server and application, e.g. nginx and PHP-FPM,
+// and translates them into equivalent HTTP messages. See https://fastcgi-archives.github.io/FastCGI_Specification.html
+package fastcgi
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Record types
+const (
+	TypeBeginRequest    = 1
+	TypeAbortRequest    = 2
+	TypeEndRequest      = 3
+	TypeParams          = 4
+	TypeStdin           = 5
+	TypeStdout          = 6
+	TypeStderr          = 7
+	TypeData            = 8
+	TypeGetValues       = 9
+	TypeGetValuesResult = 10
+	TypeUnknownType     = 11
+)
+
+// Size of record header: version, type, request ID, content length, padding length and reserved byte
+const headerSize = 8
+
+// ErrMalformed is returned for records which can't be parsed
+var ErrMalformed = errors.New("malformed FastCGI record")
+
+// Record is a single FastCGI record
+type Record struct {
+	Type      byte
+	RequestID uint16
+	Content   []byte
+}
+
+// recordLength returns length of the first record in data including padding, or -1 if it is not complete
+func recordLength(data []byte) int {
+	if len(data) < headerSize {
+		return -1
+	}
+
+	length := headerSize + int(binary.BigEndian.Uint16(data[4:])) + int(data[6])
+	if length > len(data) {
+		return -1
+	}
+
+	return length
+}
+
+// streamLength returns length of records up to the first one of given type, which ends the stream, or -1 if
+// it is not complete. Records of management requests are sent alone.
+func streamLength(data []byte, end func(typ byte, contentLength int) bool) int {
+	for offset := 0; ; {
+		record := data[offset:]
+		n := recordLength(record)
+		if n == -1 {
+			return -1
+		}
+		offset += n
+
+		// Management records have request ID 0
+		if offset == n && binary.BigEndian.Uint16(record[2:]) == 0 || end(record[1], int(binary.BigEndian.Uint16(record[4:]))) {
+			return offset
+		}
+	}
+}
+
+// RequestLength returns length of the first request in data, or -1 if it is not complete. Request ends with empty
+// stdin record, aborts are sent alone.
+func RequestLength(data []byte) int {
+	if len(data) > 1 && data[1] == TypeAbortRequest {
+		return recordLength(data)
+	}
+
+	return streamLength(data, func(typ byte, contentLength int) bool {
+		return typ == TypeStdin && contentLength == 0
+	})
+}
+
+// ResponseLength returns length of the first response in data, or -1 if it is not complete. Response ends with
+// end request record.
+func ResponseLength(data []byte) int {
+	return streamLength(data, func(typ byte, _ int) bool {
+		return typ == TypeEndRequest
+	})
+}
+
+// HasResponse returns false for requests which application does not answer separately: aborts of running requests
+func HasResponse(data []byte) bool {
+	return len(data) > 1 && data[1] != TypeAbortRequest
+}
+
+// Records splits data into records
+func Records(data []byte) ([]Record, error) {
+	var records []Record
+
+	for len(data) > 0 {
+		n := recordLength(data)
+		if n == -1 || data[0] != 1 {
+			return nil, ErrMalformed
+		}
+
+		contentLength := int(binary.BigEndian.Uint16(data[4:]))
+		records = append(records, Record{
+			Type:      data[1],
+			RequestID: binary.BigEndian.Uint16(data[2:]),
+			Content:   data[headerSize : headerSize+contentLength],
+		})
+		data = data[n:]
+	}
+
+	return records, nil
+}
+
+// AppendRecord appends record with given content, which should not be longer than 65535 bytes
+func AppendRecord(b []byte, typ byte, requestID uint16, content []byte) []byte {
+	header := make([]byte, headerSize)
+	header[0] = 1
+	header[1] = typ
+	binary.BigEndian.PutUint16(header[2:], requestID)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+
+	return append(append(b, header...), content...)
+}
+
+// Param is a name-value pair sent in params stream
+type Param struct {
+	Name  string
+	Value string
+}
+
+// paramLength reads length of param name or value, encoded as 1 byte, or 4 bytes with the highest bit set
+func paramLength(data []byte) (int, int) {
+	if len(data) == 0 {
+		return -1, 0
+	}
+
+	if data[0]>>7 == 0 {
+		return int(data[0]), 1
+	}
+
+	if len(data) < 4 {
+		return -1, 0
+	}
+
+	return int(binary.BigEndian.Uint32(data) &^ (1 << 31)), 4
+}
+
+// ParseParams parses content of params stream
+func ParseParams(data []byte) ([]Param, error) {
+	var params []Param
+
+	for len(data) > 0 {
+		nameLength, n := paramLength(data)
+		if nameLength == -1 {
+			return nil, ErrMalformed
+		}
+		data = data[n:]
+
+		valueLength, n := paramLength(data)
+		if valueLength == -1 || n+nameLength+valueLength > len(data) {
+			return nil, ErrMalformed
+		}
+		data = data[n:]
+
+		params = append(params, Param{string(data[:nameLength]), string(data[nameLength : nameLength+valueLength])})
+		data = data[nameLength+valueLength:]
+	}
+
+	return params, nil
+}
+
+// AppendParams appends params encoded for params stream
+func AppendParams(b []byte, params ...Param) []byte {
+	appendLength := func(b []byte, n int) []byte {
+		if n < 128 {
+			return append(b, byte(n))
+		}
+
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(n)|1<<31)
+		return append(b, length...)
+	}
+
+	for _, p := range params {
+		b = appendLength(b, len(p.Name))
+		b = appendLength(b, len(p.Value))
+		b = append(append(b, p.Name...), p.Value...)
+	}
+
+	return b
+}
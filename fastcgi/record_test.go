@@ -0,0 +1,73 @@
+package fastcgi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func beginRequest(id uint16) []byte {
+	// Responder role, keep connection
+	return AppendRecord(nil, TypeBeginRequest, id, []byte{0, 1, 1, 0, 0, 0, 0, 0})
+}
+
+func TestRequestLength(t *testing.T) {
+	req := beginRequest(1)
+	req = AppendRecord(req, TypeParams, 1, AppendParams(nil, Param{"REQUEST_METHOD", "GET"}))
+	req = AppendRecord(req, TypeParams, 1, nil)
+	req = AppendRecord(req, TypeStdin, 1, nil)
+
+	next := AppendRecord(nil, TypeGetValues, 0, AppendParams(nil, Param{"FCGI_MPXS_CONNS", ""}))
+
+	if n := RequestLength(append(req, next...)); n != len(req) {
+		t.Error("Wrong request length", n)
+	}
+
+	if n := RequestLength(next); n != len(next) {
+		t.Error("Management record should be sent alone", n)
+	}
+
+	for i := range req {
+		if RequestLength(req[:i]) != -1 {
+			t.Fatal("Should wait for the whole request", i)
+		}
+	}
+
+	abort := AppendRecord(nil, TypeAbortRequest, 1, nil)
+	if RequestLength(abort) != len(abort) || HasResponse(abort) || !HasResponse(req) {
+		t.Error("Abort is sent alone, and is not answered")
+	}
+
+	// Padding follows content
+	padded := AppendRecord(nil, TypeStdout, 1, []byte("abc"))
+	padded[6] = 5
+	padded = append(padded, make([]byte, 5)...)
+	resp := AppendRecord(padded, TypeEndRequest, 1, make([]byte, 8))
+
+	if n := ResponseLength(append(resp, 1, 6)); n != len(resp) {
+		t.Error("Wrong response length", n)
+	}
+
+	records, err := Records(resp)
+	if err != nil || len(records) != 2 || string(records[0].Content) != "abc" || records[1].Type != TypeEndRequest {
+		t.Error("Wrong records", records, err)
+	}
+}
+
+func TestParams(t *testing.T) {
+	params := []Param{{"SCRIPT_FILENAME", "/var/www/index.php"}, {"HTTP_COOKIE", string(bytes.Repeat([]byte("a"), 200))}, {"QUERY_STRING", ""}}
+
+	parsed, err := ParseParams(AppendParams(nil, params...))
+	if err != nil || len(parsed) != 3 {
+		t.Fatal("Wrong params", parsed, err)
+	}
+
+	for i, p := range parsed {
+		if p != params[i] {
+			t.Errorf("Wrong param %d: %v", i, p)
+		}
+	}
+
+	if _, err = ParseParams([]byte{3, 5, 'a'}); err != ErrMalformed {
+		t.Error("Should reject truncated param")
+	}
+}
@@ -0,0 +1,264 @@
+package goreplay
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Encrypted file starts with magic bytes and random nonce prefix, followed by segments. Each segment is ciphertext
+// length and AES-GCM sealed data, with nonce made of prefix and segment index. The last segment is marked in high bit
+// of length and in additional data, so truncated files are detected.
+var encryptedFileMagic = []byte("GOR\x00ENC1")
+
+const (
+	encryptedSegmentSize = 64 * 1024
+	encryptedNoncePrefix = 8
+	encryptedLastSegment = 1 << 31
+)
+
+// loadKey reads AES-256 key from `file:<path>`, `env:<variable>`, or `exec:<command>` which prints key to stdout,
+// e.g. to decrypt data key using KMS. Key is 32 bytes, raw or encoded as hex or base64.
+func loadKey(source string) ([]byte, error) {
+	var data []byte
+	var err error
+
+	switch {
+	case strings.HasPrefix(source, "file:"):
+		data, err = ioutil.ReadFile(source[len("file:"):])
+	case strings.HasPrefix(source, "env:"):
+		data = []byte(os.Getenv(source[len("env:"):]))
+	case strings.HasPrefix(source, "exec:"):
+		cmd := exec.Command("sh", "-c", source[len("exec:"):])
+		cmd.Stderr = os.Stderr
+		data, err = cmd.Output()
+	default:
+		return nil, fmt.Errorf("expected file:, env: or exec: key source, got %q", source)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKey(data)
+}
+
+func parseKey(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+
+	return nil, errors.New("key should be 32 bytes, raw or encoded as hex or base64")
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptWriter encrypts data written to file. Data is buffered until segment is full or Flush is called.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	index  uint32
+	buf    []byte
+	sealed []byte
+}
+
+func newEncryptWriter(w io.Writer, key []byte) (*encryptWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &encryptWriter{w: w, aead: aead, nonce: make([]byte, aead.NonceSize())}
+	if _, err = rand.Read(e.nonce[:encryptedNoncePrefix]); err != nil {
+		return nil, err
+	}
+
+	if _, err = w.Write(append(append([]byte{}, encryptedFileMagic...), e.nonce[:encryptedNoncePrefix]...)); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *encryptWriter) Write(data []byte) (int, error) {
+	e.buf = append(e.buf, data...)
+
+	for len(e.buf) >= encryptedSegmentSize {
+		if err := e.seal(e.buf[:encryptedSegmentSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[encryptedSegmentSize:]
+	}
+
+	return len(data), nil
+}
+
+func (e *encryptWriter) seal(data []byte, last bool) error {
+	binary.BigEndian.PutUint32(e.nonce[encryptedNoncePrefix:], e.index)
+	e.index++
+
+	ad := []byte{0}
+	if last {
+		ad[0] = 1
+	}
+
+	e.sealed = append(e.sealed[:0], 0, 0, 0, 0)
+	e.sealed = e.aead.Seal(e.sealed, e.nonce, data, ad)
+
+	length := uint32(len(e.sealed) - 4)
+	if last {
+		length |= encryptedLastSegment
+	}
+	binary.BigEndian.PutUint32(e.sealed, length)
+
+	_, err := e.w.Write(e.sealed)
+	return err
+}
+
+// Flush encrypts buffered data, so it can be read before file is closed
+func (e *encryptWriter) Flush() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+
+	err := e.seal(e.buf, false)
+	e.buf = e.buf[:0]
+
+	return err
+}
+
+// Close writes the last segment, file is not closed
+func (e *encryptWriter) Close() error {
+	err := e.seal(e.buf, true)
+	e.buf = nil
+
+	return err
+}
+
+// decryptReader reads file written by encryptWriter. io.ErrUnexpectedEOF is returned if file ends before the last
+// segment, e.g. when it is still written.
+type decryptReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	index uint32
+	buf   []byte
+	plain []byte
+	last  bool
+}
+
+// isEncryptedFile checks if header of file is written by encryptWriter
+func isEncryptedFile(header []byte) bool {
+	return bytes.HasPrefix(header, encryptedFileMagic)
+}
+
+func newDecryptReader(r io.Reader, key []byte) (*decryptReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encryptedFileMagic)+encryptedNoncePrefix)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if !isEncryptedFile(header) {
+		return nil, errors.New("file is not encrypted")
+	}
+
+	d := &decryptReader{r: r, aead: aead, nonce: make([]byte, aead.NonceSize())}
+	copy(d.nonce, header[len(encryptedFileMagic):])
+
+	return d, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.last {
+			return 0, io.EOF
+		}
+
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	var header [4]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	last := length&encryptedLastSegment != 0
+	length &^= encryptedLastSegment
+
+	if length > encryptedSegmentSize+uint32(d.aead.Overhead()) {
+		return errors.New("malformed encrypted segment")
+	}
+
+	if cap(d.buf) < int(length) {
+		d.buf = make([]byte, length)
+	}
+	d.buf = d.buf[:length]
+	if _, err := io.ReadFull(d.r, d.buf); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	ad := []byte{0}
+	if last {
+		ad[0] = 1
+	}
+
+	binary.BigEndian.PutUint32(d.nonce[encryptedNoncePrefix:], d.index)
+	plain, err := d.aead.Open(d.buf[:0], d.nonce, d.buf, ad)
+	if err != nil {
+		return err
+	}
+
+	d.index++
+	d.plain = plain
+	d.last = last
+
+	return nil
+}
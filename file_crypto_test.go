@@ -0,0 +1,106 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+
+	os.Setenv("GOR_TEST_KEY", hex.EncodeToString(key))
+	defer os.Unsetenv("GOR_TEST_KEY")
+
+	for _, source := range []string{"env:GOR_TEST_KEY", "exec:echo BwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwc="} {
+		if k, err := loadKey(source); err != nil || !bytes.Equal(k, key) {
+			t.Errorf("Wrong key from %q: %x %v", source, k, err)
+		}
+	}
+
+	for _, source := range []string{"GOR_TEST_KEY", "env:GOR_MISSING_KEY", "exec:echo 0707"} {
+		if _, err := loadKey(source); err == nil {
+			t.Errorf("Expected error for %q", source)
+		}
+	}
+}
+
+func TestEncryptedStream(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	data := make([]byte, 3*encryptedSegmentSize/2)
+	rand.Read(data)
+
+	var file bytes.Buffer
+	w, _ := newEncryptWriter(&file, key)
+	w.Write(data[:100])
+	w.Flush()
+	w.Write(data[100:])
+
+	if bytes.Contains(file.Bytes(), data[:100]) {
+		t.Fatal("Data should be encrypted")
+	}
+
+	// File without the last segment is incomplete
+	r, _ := newDecryptReader(bytes.NewReader(file.Bytes()), key)
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF, got %v", err)
+	}
+
+	w.Close()
+	r, _ = newDecryptReader(bytes.NewReader(file.Bytes()), key)
+	if decrypted, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(decrypted, data) {
+		t.Errorf("Decrypted data should match: %v", err)
+	}
+
+	r, _ = newDecryptReader(bytes.NewReader(file.Bytes()), bytes.Repeat([]byte{2}, 32))
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("Data should not be decrypted with wrong key")
+	}
+
+	tampered := append([]byte{}, file.Bytes()...)
+	tampered[len(tampered)-1] ^= 1
+	r, _ = newDecryptReader(bytes.NewReader(tampered), key)
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("Tampered data should not be decrypted")
+	}
+}
+
+func TestFileOutputEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+
+	for _, ext := range []string{".gor", ".gor.gz"} {
+		name := fmt.Sprintf("/tmp/%d%s", rand.Int63(), ext)
+
+		output := NewFileOutput(name, &FileOutputConfig{flushInterval: time.Minute, append: true, key: key})
+		for i := 0; i < 3; i++ {
+			output.Write([]byte(fmt.Sprintf("1 %d %d\nrequest%d", i, i, i)))
+		}
+		output.Close()
+
+		if data, _ := ioutil.ReadFile(name); bytes.Contains(data, []byte("request")) {
+			t.Errorf("%s: file should be encrypted", ext)
+		}
+
+		if r := NewFileInputReader(name, 0, nil); r != nil {
+			t.Errorf("%s: file should not be read without key", ext)
+		}
+
+		input := NewFileInput(name, &FileInputConfig{key: key})
+		buf := make([]byte, 1000)
+		for i := 0; i < 3; i++ {
+			n, _ := input.Read(buf)
+			if body := fmt.Sprintf("request%d", i); !bytes.Equal(payloadBody(buf[:n]), []byte(body)) {
+				t.Errorf("%s: expected %s, got %q", ext, body, buf[:n])
+			}
+		}
+		input.Close()
+
+		os.Remove(name)
+	}
+}
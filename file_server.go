@@ -0,0 +1,189 @@
+package goreplay
+
+import (
+	"compress/gzip"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Paths of captures index and slices, prefixed so they do not hide served files
+const (
+	fileServerCaptures = "/_gor/captures"
+	fileServerSlice    = "/_gor/slice"
+)
+
+var fileServerIndex = template.Must(template.New("captures").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Captures</title></head>
+<body>
+<h1>Captures</h1>
+<table>
+<tr><th>File</th><th>Size</th><th>First payload</th><th>Modified</th><th></th></tr>
+{{range .}}<tr>
+<td><a href="/{{.Name}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{if not .First.IsZero}}{{.First.Format "2006-01-02T15:04:05Z07:00"}}{{end}}</td><td>{{.Modified.Format "2006-01-02T15:04:05Z07:00"}}</td>
+<td><form action="` + fileServerSlice + `"><input type="hidden" name="file" value="{{.Name}}">
+<input name="from" placeholder="from, e.g. 10m or RFC3339"> <input name="to" placeholder="to"> <input name="url" placeholder="URL regexp">
+<input type="submit" value="Download slice"></form></td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type fileServerCapture struct {
+	Name     string
+	Size     int64
+	First    time.Time
+	Modified time.Time
+}
+
+// fileServer serves files of directory, with index of captures and their slices selected by time range, method and
+// URL, like `gor inspect` does. Responses are compressed if client accepts it, so replay hosts can pull parts of
+// captures over HTTP instead of copying whole files.
+type fileServer struct {
+	dir   string
+	files http.Handler
+}
+
+func newFileServer(dir string) http.Handler {
+	return &fileServer{dir: dir, files: http.FileServer(http.Dir(dir))}
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") && r.Header.Get("Range") == "" && !strings.HasSuffix(r.URL.Path, ".gz") {
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		w = gw
+	}
+
+	switch r.URL.Path {
+	case fileServerCaptures:
+		s.captures(w, r)
+	case fileServerSlice:
+		s.slice(w, r)
+	default:
+		s.files.ServeHTTP(w, r)
+	}
+}
+
+// captures lists files with payloads, timestamp of the first payload is read from each of them
+func (s *fileServer) captures(w http.ResponseWriter, r *http.Request) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var captures []fileServerCapture
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !strings.Contains(info.Name(), ".gor") && !strings.HasSuffix(info.Name(), ".gz") {
+			continue
+		}
+
+		c := fileServerCapture{Name: info.Name(), Size: info.Size(), Modified: info.ModTime()}
+		if reader := NewFileInputReader(filepath.Join(s.dir, info.Name()), 0, nil); reader != nil {
+			if atomic.LoadInt32(&reader.closed) == 0 {
+				c.First = time.Unix(0, reader.timestamp)
+			}
+			reader.Close()
+		}
+		captures = append(captures, c)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fileServerIndex.Execute(w, captures)
+}
+
+// slice writes payloads of files matching `file` pattern, which are selected by `from`, `to`, `method` and `url`
+// parameters, merged by time
+func (s *fileServer) slice(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	pattern := query.Get("file")
+	if pattern == "" || filepath.IsAbs(pattern) || strings.Contains(pattern, "..") {
+		http.Error(w, "file should be pattern of files in served directory", http.StatusBadRequest)
+		return
+	}
+	paths, err := filepath.Glob(filepath.Join(s.dir, pattern))
+	if err != nil || len(paths) == 0 {
+		http.Error(w, fmt.Sprintf("no files match %q", pattern), http.StatusNotFound)
+		return
+	}
+
+	filter, err := newInspectFilter(query.Get("from"), query.Get("to"), query["method"], query.Get("url"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename="+url.PathEscape("slice-"+filepath.Base(paths[0])))
+
+	readPayloads(paths, nil, func(payload []byte) {
+		meta := payloadMeta(payload)
+		if len(meta) < 3 {
+			return
+		}
+
+		var timestamp int64
+		fmt.Sscan(string(meta[2]), &timestamp)
+		if filter.match(payload, string(meta[1]), timestamp) {
+			w.Write(payload)
+			io.WriteString(w, payloadSeparator)
+		}
+	})
+}
+
+// gzipResponseWriter compresses body of successful responses, which don't set content encoding themselves
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gzip        *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		w.gzip = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gzip != nil {
+		return w.gzip.Write(data)
+	}
+
+	return w.ResponseWriter.Write(data)
+}
+
+// Close writes end of compressed body
+func (w *gzipResponseWriter) Close() error {
+	if w.gzip != nil {
+		return w.gzip.Close()
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package goreplay
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileServer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor")
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2021, 3, 1, 22, 0, 0, 0, time.UTC)
+	var capture []byte
+	for i, path := range []string{"/first", "/second", "/third"} {
+		capture = append(capture, payloadHeader(RequestPayload, uuid(), start.Add(time.Duration(i)*time.Hour).UnixNano(), -1)...)
+		capture = append(capture, "GET "+path+" HTTP/1.1\r\n\r\n"+payloadSeparator...)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "requests_0.gor"), capture, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>"), 0644)
+
+	server := httptest.NewServer(newFileServer(dir))
+	defer server.Close()
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	if _, body := get("/index.html"); body != "<html>" {
+		t.Error("Files should be served:", body)
+	}
+
+	_, body := get(fileServerCaptures)
+	if !strings.Contains(body, "requests_0.gor") || !strings.Contains(body, "2021-03-01T22:00:00Z") || strings.Contains(body, "index.html") {
+		t.Error("Captures should be listed with time of the first payload:\n", body)
+	}
+
+	resp, body := get(fileServerSlice + "?file=requests_*.gor&from=30m&to=2021-03-02T00:00:00Z")
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, "/first") || !strings.Contains(body, "GET /second") || strings.Contains(body, "/third") {
+		t.Error("Slice should contain payloads of time range:\n", resp.Status, body)
+	}
+	// Transport decompresses response it asked compressed
+	if !resp.Uncompressed {
+		t.Error("Response should be compressed")
+	}
+
+	if resp, _ := get(fileServerSlice + "?file=../*"); resp.StatusCode != http.StatusBadRequest {
+		t.Error("Files outside of directory should not be served:", resp.Status)
+	}
+
+	// Compressed body is valid gzip stream
+	req, _ := http.NewRequest("GET", server.URL+fileServerSlice+"?file=requests_0.gor", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	raw, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Body.Close()
+	gz, err := gzip.NewReader(raw.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(gz); strings.Count(string(data), payloadSeparator) != 3 {
+		t.Error("Slice without bounds should contain all payloads:\n", string(data))
+	}
+}
@@ -1,8 +1,13 @@
-// Gor is simple http traffic replication tool written in Go. Its main goal to replay traffic from production servers to staging and dev environments.
+// Package goreplay is simple http traffic replication tool written in Go. Its main goal to replay traffic from production servers to staging and dev environments.
 // Now you can test your code on real user sessions in an automated and repeatable fashion.
-package main
+//
+// The `gor` binary lives in cmd/gor, everything else can be imported and embedded:
+// plugins are created with their constructors, collected into InOutPlugins and
+// connected together by an Emitter.
+package goreplay
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -15,15 +20,12 @@ import (
 	"runtime"
 	_ "runtime/debug"
 	"runtime/pprof"
+	"strings"
 	"syscall"
 	"time"
 )
 
-var (
-	mode       string
-	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
-	memprofile = flag.String("memprofile", "", "write memory profile to this file")
-)
+var mode string
 
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -35,7 +37,8 @@ func loggingMiddleware(next http.Handler) http.Handler {
 
 var closeCh chan int
 
-func main() {
+// Main runs gor as a command line application, using os.Args for configuration
+func Main() {
 	closeCh = make(chan int)
 	// // Don't exit on panic
 	// defer func() {
@@ -49,6 +52,9 @@ func main() {
 		runtime.GOMAXPROCS(runtime.NumCPU() * 2)
 	}
 
+	RegisterFlags(flag.CommandLine)
+	flag.Usage = usage
+
 	args := os.Args[1:]
 	var plugins *InOutPlugins
 	if len(args) > 0 && args[0] == "file-server" {
@@ -58,9 +64,15 @@ func main() {
 		dir, _ := os.Getwd()
 
 		log.Println("Started example file server for current directory on address ", args[1])
+		log.Println("Captures are listed on", fileServerCaptures)
 
-		log.Fatal(http.ListenAndServe(args[1], loggingMiddleware(http.FileServer(http.Dir(dir)))))
+		log.Fatal(http.ListenAndServe(args[1], loggingMiddleware(newFileServer(dir))))
+	} else if len(args) > 0 && cliCommands[args[0]] != nil {
+		runCommand(args[0], args[1:])
+		checkSettings()
+		plugins = InitPlugins()
 	} else {
+		flag.Usage = cliUsage
 		flag.Parse()
 		checkSettings()
 		plugins = InitPlugins()
@@ -72,12 +84,20 @@ func main() {
 		log.Fatal("Required at least 1 input and 1 output")
 	}
 
-	if *memprofile != "" {
-		profileMEM(*memprofile)
+	if Settings.tui {
+		terminal = newTerminalUI(plugins)
+		log.SetOutput(terminal)
+		defer log.SetOutput(os.Stderr)
+
+		go terminal.run(os.Stdout, os.Stdin)
 	}
 
-	if *cpuprofile != "" {
-		profileCPU(*cpuprofile)
+	if Settings.memProfile != "" {
+		profileMEM(Settings.memProfile)
+	}
+
+	if Settings.cpuProfile != "" {
+		profileCPU(Settings.cpuProfile)
 	}
 
 	if Settings.pprof != "" {
@@ -86,10 +106,58 @@ func main() {
 		}()
 	}
 
+	if Settings.httpAdmin != "" {
+		go func() {
+			log.Println(http.ListenAndServe(Settings.httpAdmin, newAdminServer(plugins)))
+		}()
+	}
+
+	if Settings.grpcAdmin != "" {
+		go func() {
+			log.Println(serveAdminGRPC(Settings.grpcAdmin, plugins))
+		}()
+	}
+
+	watchLimitSignals(plugins)
+
+	if Settings.watchdogSustain > 0 {
+		captureWatchdog = newWatchdog(plugins, Settings.watchdogSustain, Settings.watchdogWebhook)
+		go captureWatchdog.run()
+	}
+
+	if Settings.maxMemory > 0 {
+		memoryGuard = newMemoryBudget(uint64(Settings.maxMemory), Settings.maxMemoryPolicy, plugins)
+		go memoryGuard.run()
+	}
+
+	started := time.Now()
+	if Settings.notifyWebhook != "" {
+		pipelineNotifier = newNotifier(Settings.notifyWebhook)
+		notify(eventReplayStarted, "Gor "+VERSION+" started: "+strings.Join(os.Args[1:], " "), nil)
+	}
+
+	if Settings.verify > 0 {
+		mirrorVerifier = newDeliveryVerifier(Settings.verifyHeader)
+		log.Println("Verifying delivery of captured requests for", Settings.verify)
+
+		time.AfterFunc(Settings.verify, func() {
+			mirrorVerifier.stop()
+			// Requests in flight get time to be answered
+			mirrorVerifier.wait(Settings.outputHTTPConfig.Timeout)
+			mirrorVerifier.report(os.Stdout)
+			Close(closeCh)
+		})
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		if mirrorVerifier != nil {
+			mirrorVerifier.report(os.Stdout)
+		}
+		notify(eventReplayFinished, "Gor interrupted", replaySummary(plugins, started))
+		flushNotifications()
 		finalize(plugins)
 		os.Exit(1)
 	}()
@@ -99,11 +167,27 @@ func main() {
 
 		time.AfterFunc(Settings.exitAfter, func() {
 			log.Println("Stopping gor after", Settings.exitAfter)
-			close(closeCh)
+			Close(closeCh)
 		})
 	}
 
-	Start(plugins, closeCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-closeCh
+		cancel()
+	}()
+
+	if err := NewEmitter(plugins, Settings.emitterConfig()).Start(ctx); err != nil {
+		log.Println("Error during copy: ", err)
+	}
+
+	// Verification could be interrupted by --exit-after, or by end of input
+	if mirrorVerifier != nil {
+		mirrorVerifier.report(os.Stdout)
+	}
+
+	notify(eventReplayFinished, "Gor finished", replaySummary(plugins, started))
+	flushNotifications()
 }
 
 func finalize(plugins *InOutPlugins) {
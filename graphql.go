@@ -0,0 +1,127 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// graphQLRequest is JSON body of GraphQL request sent over HTTP
+type graphQLRequest struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+}
+
+// graphQLOperation returns type and name of operation executed by GraphQL POST request, like "mutation CreateUser",
+// or just type for anonymous operations. Empty string is returned if payload is not a GraphQL request. Batched
+// requests, and bodies of chunked requests which don't fit into the first chunk are not recognized.
+func graphQLOperation(payload []byte) string {
+	if !bytes.Equal(proto.Method(payload), []byte("POST")) {
+		return ""
+	}
+
+	body := bytes.TrimSpace(proto.Body(payload))
+	if len(body) == 0 {
+		return ""
+	}
+
+	var req graphQLRequest
+	if bytes.Contains(proto.Header(payload, []byte("Content-Type")), []byte("application/graphql")) {
+		req.Query = string(body)
+	} else if body[0] != '{' || !bytes.Contains(body, []byte(`"query"`)) || json.Unmarshal(body, &req) != nil {
+		return ""
+	}
+
+	kind, name := parseGraphQLOperation(req.Query, req.OperationName)
+	if kind == "" || name == "" {
+		return kind
+	}
+	return kind + " " + name
+}
+
+// parseGraphQLOperation finds operation with given name in GraphQL document, or the first one if name is not given,
+// and returns its type and name. Only top level of document is parsed, selection sets and arguments are skipped.
+func parseGraphQLOperation(query, operationName string) (kind, name string) {
+	depth := 0
+	// Set right after operation type, when the next name is name of operation
+	afterKeyword := false
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			i = skipGraphQLString(query, i)
+		case c == '{' || c == '(' || c == '[':
+			if depth == 0 && c == '{' {
+				// Selection set without operation type is anonymous query
+				if kind == "" {
+					kind = "query"
+				}
+				if kind != "fragment" && (operationName == "" || name == operationName) {
+					return kind, name
+				}
+				kind, name = "", ""
+			}
+			afterKeyword = false
+			depth++
+		case c == '}' || c == ')' || c == ']':
+			depth--
+		case isGraphQLName(c, true):
+			start := i
+			for i+1 < len(query) && isGraphQLName(query[i+1], false) {
+				i++
+			}
+			if depth > 0 {
+				continue
+			}
+
+			token := query[start : i+1]
+			switch {
+			case afterKeyword:
+				name = token
+				afterKeyword = false
+			case kind == "" && (token == "query" || token == "mutation" || token == "subscription" || token == "fragment"):
+				kind = token
+				afterKeyword = true
+			default:
+				afterKeyword = false
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+		default:
+			afterKeyword = false
+		}
+	}
+
+	return "", ""
+}
+
+// skipGraphQLString returns index of the last quote of string or block string starting at i
+func skipGraphQLString(query string, i int) int {
+	if len(query) >= i+3 && query[i:i+3] == `"""` {
+		for j := i + 3; j+3 <= len(query); j++ {
+			if query[j:j+3] == `"""` && query[j-1] != '\\' {
+				return j + 2
+			}
+		}
+		return len(query)
+	}
+
+	for j := i + 1; j < len(query); j++ {
+		switch query[j] {
+		case '\\':
+			j++
+		case '"':
+			return j
+		}
+	}
+	return len(query)
+}
+
+func isGraphQLName(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
@@ -0,0 +1,42 @@
+package goreplay
+
+import (
+	"strconv"
+	"testing"
+)
+
+func graphQLPayload(body string) []byte {
+	return []byte("POST /graphql HTTP/1.1\r\nContent-Type: application/json\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body)
+}
+
+func TestGraphQLOperation(t *testing.T) {
+	tests := []struct {
+		body      string
+		operation string
+	}{
+		{`{"query": "query GetUser($id: ID!) { user(id: $id) { name } }"}`, "query GetUser"},
+		{`{"query": "{ user(id: 1) { name } }"}`, "query"},
+		{`{"query": "mutation { createUser(name: \"{\") { id } }"}`, "mutation"},
+		{`{"query": "# comment with query Fake\nsubscription OnEvent @live { event { id } }"}`, "subscription OnEvent"},
+		{`{"query": "fragment F on User { name } query A { user { ...F } } mutation B { x }", "operationName": "B"}`, "mutation B"},
+		{`{"query": "query A { a } query B { b }", "operationName": "C"}`, ""},
+		{`{"user": "query"}`, ""},
+		{`[{"query": "query A { a }"}]`, ""},
+		{`not json`, ""},
+	}
+
+	for _, tt := range tests {
+		if operation := graphQLOperation(graphQLPayload(tt.body)); operation != tt.operation {
+			t.Errorf("Expected %q operation of %s, got %q", tt.operation, tt.body, operation)
+		}
+	}
+
+	if operation := graphQLOperation([]byte("GET /graphql?query=%7Ba%7D HTTP/1.1\r\n\r\n")); operation != "" {
+		t.Error("Only POST requests should be parsed", operation)
+	}
+
+	payload := []byte("POST /graphql HTTP/1.1\r\nContent-Type: application/graphql\r\n\r\nquery Search { items { id } }")
+	if operation := graphQLOperation(payload); operation != "query Search" {
+		t.Error("Query should be read from application/graphql body", operation)
+	}
+}
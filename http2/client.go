@@ -0,0 +1,347 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Receive window of connection, raised from default so server is not blocked by flow control while responses are read
+const connWindow = maxStreamSize
+
+// ErrGoAway is returned for request which was not processed because server is closing connection
+var ErrGoAway = errors.New("server is closing connection")
+
+// Conn sends HTTP/1.1 requests to HTTP/2 server one by one, and returns responses translated into HTTP/1.1. Request
+// fields are sent as literals without indexing, so only decoder of server fields keeps state.
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *Decoder
+
+	// Settings of server
+	maxFrameSize  int
+	initialWindow int
+	// Send windows of connection and of current stream
+	connWindow   int
+	streamWindow int
+
+	nextStream uint32
+	goAway     bool
+
+	// Response to request of current stream, and error which ended it early
+	stream   uint32
+	response streamHalf
+	err      error
+
+	// Header block split into HEADERS and CONTINUATION frames
+	block       []byte
+	blockStream uint32
+	blockEnd    bool
+
+	frame []byte
+}
+
+// NewConn starts HTTP/2 connection by sending connection preface. Connection should be already negotiated by TLS
+// ALPN, or server should accept HTTP/2 with prior knowledge.
+func NewConn(conn net.Conn) (*Conn, error) {
+	c := &Conn{
+		conn:          conn,
+		reader:        bufio.NewReader(conn),
+		decoder:       NewDecoder(),
+		maxFrameSize:  defaultMaxFrameSize,
+		initialWindow: defaultWindowSize,
+		connWindow:    defaultWindowSize,
+		nextStream:    1,
+	}
+
+	settings := make([]byte, 6)
+	binary.BigEndian.PutUint16(settings, SettingEnablePush)
+
+	b := append([]byte{}, Preface...)
+	b = AppendFrame(b, FrameSettings, 0, 0, settings)
+	b = AppendFrame(b, FrameWindowUpdate, 0, 0, windowIncrement(connWindow-defaultWindowSize))
+
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// RoundTrip sends HTTP/1.1 request using new stream, and returns response. Chunked request body is decoded, and its
+// trailer fields are sent as trailer section. Response trailer section is returned as trailer fields of chunked
+// response. Deadlines of connection limit the time of request.
+func (c *Conn) RoundTrip(request []byte, scheme string) ([]byte, error) {
+	if c.goAway {
+		return nil, ErrGoAway
+	}
+
+	fields, trailers, body, err := requestFields(request, scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	c.stream = c.nextStream
+	c.nextStream += 2
+	c.response = streamHalf{}
+	c.err = nil
+	c.streamWindow = c.initialWindow
+
+	var block []byte
+	for _, f := range fields {
+		block = AppendField(block, f)
+	}
+	if err := c.writeHeaders(block, len(body) == 0 && len(trailers) == 0); err != nil {
+		return nil, err
+	}
+
+	// Server can respond before the whole body is sent, e.g. with error
+	for len(body) > 0 && !c.response.done && c.err == nil {
+		n := len(body)
+		for _, limit := range []int{c.maxFrameSize, c.connWindow, c.streamWindow} {
+			if limit < n {
+				n = limit
+			}
+		}
+
+		if n <= 0 {
+			if err := c.readFrame(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var flags byte
+		if n == len(body) && len(trailers) == 0 {
+			flags = FlagEndStream
+		}
+		if _, err := c.conn.Write(AppendFrame(nil, FrameData, flags, c.stream, body[:n])); err != nil {
+			return nil, err
+		}
+		c.connWindow -= n
+		c.streamWindow -= n
+		body = body[n:]
+	}
+
+	if len(body) == 0 && len(trailers) > 0 && !c.response.done && c.err == nil {
+		block = block[:0]
+		for _, f := range trailers {
+			block = AppendField(block, f)
+		}
+		if err := c.writeHeaders(block, true); err != nil {
+			return nil, err
+		}
+	}
+
+	for !c.response.done && c.err == nil {
+		if err := c.readFrame(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return responseHTTP(c.response.fields, c.response.trailers, c.response.body)
+}
+
+// writeHeaders sends header block of current stream in HEADERS frame, followed by CONTINUATION frames if block
+// exceeds maximum frame size
+func (c *Conn) writeHeaders(block []byte, endStream bool) error {
+	_, err := c.conn.Write(appendHeaders(nil, c.stream, block, endStream, c.maxFrameSize))
+	return err
+}
+
+// readFrame reads and handles single frame sent by server
+func (c *Conn) readFrame() error {
+	header, err := c.reader.Peek(frameHeaderSize)
+	if err != nil {
+		return err
+	}
+
+	length := frameHeaderSize + (int(header[0])<<16 | int(header[1])<<8 | int(header[2]))
+	if length > frameHeaderSize+maxStreamSize {
+		return errors.New("frame is too large")
+	}
+
+	if cap(c.frame) < length {
+		c.frame = make([]byte, length)
+	}
+	c.frame = c.frame[:length]
+	if _, err := io.ReadFull(c.reader, c.frame); err != nil {
+		return err
+	}
+
+	f, _, err := ReadFrame(c.frame)
+	if err != nil {
+		return err
+	}
+
+	return c.handle(f)
+}
+
+func (c *Conn) handle(f Frame) error {
+	if c.block != nil && f.Type != FrameContinuation {
+		return errors.New("header block is not continued by CONTINUATION frame")
+	}
+
+	switch f.Type {
+	case FrameSettings:
+		if f.Flags&FlagAck != 0 {
+			return nil
+		}
+		return c.settings(f.Payload)
+	case FramePing:
+		if f.Flags&FlagAck != 0 {
+			return nil
+		}
+		_, err := c.conn.Write(AppendFrame(nil, FramePing, FlagAck, 0, f.Payload))
+		return err
+	case FrameGoAway:
+		if len(f.Payload) < 8 {
+			return errTruncated
+		}
+		c.goAway = true
+		if last := binary.BigEndian.Uint32(f.Payload) & 0x7fffffff; last < c.stream && !c.response.done {
+			c.err = ErrGoAway
+		}
+	case FrameWindowUpdate:
+		if len(f.Payload) < 4 {
+			return errTruncated
+		}
+		increment := int(binary.BigEndian.Uint32(f.Payload) & 0x7fffffff)
+		if f.Stream == 0 {
+			c.connWindow += increment
+		} else if f.Stream == c.stream {
+			c.streamWindow += increment
+		}
+	case FrameRSTStream:
+		if len(f.Payload) < 4 {
+			return errTruncated
+		}
+		if f.Stream == c.stream && !c.response.done {
+			c.err = fmt.Errorf("stream reset by server with error code %d", binary.BigEndian.Uint32(f.Payload))
+		}
+	case FrameData:
+		content, err := f.content()
+		if err != nil {
+			return err
+		}
+
+		// Received data is returned to flow control windows at once
+		if len(f.Payload) > 0 {
+			b := AppendFrame(nil, FrameWindowUpdate, 0, 0, windowIncrement(len(f.Payload)))
+			if f.Flags&FlagEndStream == 0 {
+				b = AppendFrame(b, FrameWindowUpdate, 0, f.Stream, windowIncrement(len(f.Payload)))
+			}
+			if _, err := c.conn.Write(b); err != nil {
+				return err
+			}
+		}
+
+		if f.Stream != c.stream || c.response.done {
+			return nil
+		}
+		if len(c.response.body)+len(content) > maxStreamSize {
+			return errors.New("response body is too large")
+		}
+		c.response.body = append(c.response.body, content...)
+		c.response.done = f.Flags&FlagEndStream != 0
+	case FrameHeaders:
+		content, err := f.content()
+		if err != nil {
+			return err
+		}
+		c.block = append([]byte{}, content...)
+		c.blockStream = f.Stream
+		c.blockEnd = f.Flags&FlagEndStream != 0
+		if f.Flags&FlagEndHeaders != 0 {
+			return c.headerBlock()
+		}
+	case FrameContinuation:
+		if c.block == nil || f.Stream != c.blockStream {
+			return errors.New("unexpected CONTINUATION frame")
+		}
+		c.block = append(c.block, f.Payload...)
+		if f.Flags&FlagEndHeaders != 0 {
+			return c.headerBlock()
+		}
+	case FramePushPromise:
+		return errors.New("server push is disabled")
+	}
+
+	return nil
+}
+
+// settings applies SETTINGS frame of server and acknowledges it
+func (c *Conn) settings(payload []byte) error {
+	for ; len(payload) >= 6; payload = payload[6:] {
+		value := int(binary.BigEndian.Uint32(payload[2:]))
+		switch binary.BigEndian.Uint16(payload) {
+		case SettingMaxFrameSize:
+			c.maxFrameSize = value
+		case SettingInitialWindowSize:
+			c.streamWindow += value - c.initialWindow
+			c.initialWindow = value
+		}
+	}
+
+	_, err := c.conn.Write(AppendFrame(nil, FrameSettings, FlagAck, 0, nil))
+	return err
+}
+
+// headerBlock decodes complete header block, blocks of other streams are decoded to keep dynamic table in sync
+func (c *Conn) headerBlock() error {
+	block := c.block
+	c.block = nil
+
+	fields, err := c.decoder.Decode(block)
+	if err != nil {
+		return err
+	}
+
+	if c.blockStream != c.stream || c.response.done {
+		return nil
+	}
+
+	if !c.response.headers {
+		// Interim responses are skipped
+		if status := fieldValue(fields, ":status"); len(status) == 3 && status[0] == '1' {
+			return nil
+		}
+		c.response.fields = fields
+		c.response.headers = true
+	} else {
+		c.response.trailers = fields
+	}
+	c.response.done = c.blockEnd
+
+	return nil
+}
+
+// Alive handles frames server sent since the last response, like PING or GOAWAY, and reports if connection can be
+// used for the next request
+func (c *Conn) Alive() bool {
+	for !c.goAway {
+		c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+		_, err := c.reader.Peek(frameHeaderSize)
+		c.conn.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			e, ok := err.(net.Error)
+			return ok && e.Timeout()
+		}
+
+		if err := c.readFrame(); err != nil {
+			return false
+		}
+	}
+
+	return false
+}
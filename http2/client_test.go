@@ -0,0 +1,112 @@
+package http2
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordedConn passes data sent and received by client to sessions, like it is captured
+type recordedConn struct {
+	net.Conn
+	sessions *Sessions
+	seq      [2]uint32
+	messages []*Message
+}
+
+func (c *recordedConn) record(incoming bool, data []byte) {
+	dir := fromServer
+	if incoming {
+		dir = fromClient
+	}
+
+	msgs, _ := c.sessions.Segment("client-server", incoming, c.seq[dir], data, time.Now())
+	c.messages = append(c.messages, msgs...)
+	c.seq[dir] += uint32(len(data))
+}
+
+func (c *recordedConn) Write(b []byte) (int, error) {
+	c.record(true, b)
+	return c.Conn.Write(b)
+}
+
+func (c *recordedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.record(false, b[:n])
+	return n, err
+}
+
+func TestConnTrailers(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.ProtoMajor != 2 || r.Trailer.Get("Grpc-Timeout") != "1S" {
+			w.WriteHeader(400)
+			return
+		}
+
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	tlsConn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsConn.Close()
+	if tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+		t.Fatal("HTTP/2 is not negotiated")
+	}
+
+	recorded := &recordedConn{Conn: tlsConn, sessions: NewSessions(time.Minute)}
+	c, err := NewConn(recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := "POST /pkg.Service/Method HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/grpc\r\nTE: trailers\r\n" +
+		"Trailer: Grpc-Timeout\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nGrpc-Timeout: 1S\r\n\r\n"
+	for i := 0; i < 2; i++ {
+		response, err := c.RoundTrip([]byte(request), "https")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := string(response)
+		if !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n") || !strings.Contains(resp, "\r\nTrailer: grpc-status\r\n") ||
+			!strings.HasSuffix(resp, "\r\n5\r\nhello\r\n0\r\ngrpc-status: 0\r\n\r\n") {
+			t.Errorf("unexpected response %q", resp)
+		}
+	}
+
+	if !c.Alive() {
+		t.Error("connection is not alive")
+	}
+
+	// Captured requests are replayed with their trailers, and responses keep grpc-status
+	if len(recorded.messages) != 4 {
+		t.Fatal("unexpected number of captured messages", len(recorded.messages))
+	}
+	req, resp := string(recorded.messages[2].HTTP), string(recorded.messages[3].HTTP)
+	if !strings.HasPrefix(req, "POST /pkg.Service/Method HTTP/1.1\r\nHost: example.com\r\n") || !strings.HasSuffix(req, "\r\n0\r\ngrpc-timeout: 1S\r\n\r\n") {
+		t.Errorf("unexpected captured request %q", req)
+	}
+	if !strings.HasSuffix(resp, "\r\n0\r\ngrpc-status: 0\r\n\r\n") {
+		t.Errorf("unexpected captured response %q", resp)
+	}
+
+	response, err := c.RoundTrip([]byte(req), "https")
+	if err != nil || !strings.HasSuffix(string(response), "\r\n0\r\ngrpc-status: 0\r\n\r\n") {
+		t.Errorf("captured request is not replayed %q %v", response, err)
+	}
+}
@@ -0,0 +1,151 @@
+// Package http2 decodes HTTP/2 connections sent in cleartext (h2c), like gRPC between services, and translates their
+// requests and responses into equivalent HTTP/1.1 messages. It also sends HTTP/1.1 requests to HTTP/2 servers.
+// Trailer sections, e.g. with grpc-status, are kept as trailer fields of chunked messages. See RFC 9113.
+package http2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Frame types
+const (
+	FrameData         = 0x0
+	FrameHeaders      = 0x1
+	FramePriority     = 0x2
+	FrameRSTStream    = 0x3
+	FrameSettings     = 0x4
+	FramePushPromise  = 0x5
+	FramePing         = 0x6
+	FrameGoAway       = 0x7
+	FrameWindowUpdate = 0x8
+	FrameContinuation = 0x9
+)
+
+// Frame flags
+const (
+	FlagEndStream  = 0x1
+	FlagAck        = 0x1
+	FlagEndHeaders = 0x4
+	FlagPadded     = 0x8
+	FlagPriority   = 0x20
+)
+
+// Settings parameters
+const (
+	SettingHeaderTableSize   = 0x1
+	SettingEnablePush        = 0x2
+	SettingInitialWindowSize = 0x4
+	SettingMaxFrameSize      = 0x5
+)
+
+// Size of frame header: length, type, flags and stream ID
+const frameHeaderSize = 9
+
+// Default values of SETTINGS_MAX_FRAME_SIZE and SETTINGS_INITIAL_WINDOW_SIZE
+const (
+	defaultMaxFrameSize = 16384
+	defaultWindowSize   = 65535
+)
+
+// Preface is connection preface sent by client before its first frame
+var Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+var errTruncated = errors.New("truncated data")
+
+// Frame is a single HTTP/2 frame
+type Frame struct {
+	Type    byte
+	Flags   byte
+	Stream  uint32
+	Payload []byte
+}
+
+// FrameLength returns length of the first frame in data including its header, or -1 if it is not complete. Client
+// connection preface is treated as a separate frame.
+func FrameLength(data []byte) int {
+	if len(data) > 0 && data[0] == Preface[0] {
+		if len(data) < len(Preface) {
+			if bytes.HasPrefix(Preface, data) {
+				return -1
+			}
+		} else if bytes.HasPrefix(data, Preface) {
+			return len(Preface)
+		}
+	}
+
+	if len(data) < frameHeaderSize {
+		return -1
+	}
+
+	length := frameHeaderSize + (int(data[0])<<16 | int(data[1])<<8 | int(data[2]))
+	if length > len(data) {
+		return -1
+	}
+
+	return length
+}
+
+// ReadFrame parses the first frame in data, and returns it and its length
+func ReadFrame(data []byte) (Frame, int, error) {
+	if len(data) < frameHeaderSize {
+		return Frame{}, 0, errTruncated
+	}
+
+	length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	if frameHeaderSize+length > len(data) {
+		return Frame{}, 0, errTruncated
+	}
+
+	f := Frame{
+		Type:    data[3],
+		Flags:   data[4],
+		Stream:  binary.BigEndian.Uint32(data[5:]) & 0x7fffffff,
+		Payload: data[frameHeaderSize : frameHeaderSize+length],
+	}
+
+	return f, frameHeaderSize + length, nil
+}
+
+// AppendFrame appends frame to b
+func AppendFrame(b []byte, typ, flags byte, stream uint32, payload []byte) []byte {
+	b = append(b, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)), typ, flags)
+	b = append(b, byte(stream>>24)&0x7f, byte(stream>>16), byte(stream>>8), byte(stream))
+
+	return append(b, payload...)
+}
+
+func windowIncrement(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+
+	return b
+}
+
+// content returns payload of DATA or HEADERS frame without padding and priority fields
+func (f *Frame) content() ([]byte, error) {
+	p := f.Payload
+
+	pad := 0
+	if f.Flags&FlagPadded != 0 {
+		if len(p) == 0 {
+			return nil, errTruncated
+		}
+		pad = int(p[0])
+		p = p[1:]
+	}
+
+	if f.Type == FrameHeaders && f.Flags&FlagPriority != 0 {
+		if len(p) < 5 {
+			return nil, errTruncated
+		}
+		p = p[5:]
+	}
+
+	if pad > len(p) {
+		return nil, errors.New("padding exceeds frame payload")
+	}
+
+	return p[:len(p)-pad], nil
+}
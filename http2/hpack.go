@@ -0,0 +1,317 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HeaderField is a single field of header or trailer section
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// HPACK static table, RFC 7541 appendix A
+var staticTable = []HeaderField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+// Default SETTINGS_HEADER_TABLE_SIZE
+const defaultTableSize = 4096
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	symbol   int
+}
+
+var huffmanRoot = newHuffmanTree()
+
+func newHuffmanTree() *huffmanNode {
+	root := &huffmanNode{symbol: -1}
+	for symbol, code := range huffmanCodes {
+		n := root
+		for i := int(huffmanCodeLen[symbol]) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{symbol: -1}
+			}
+			n = n.children[bit]
+		}
+		n.symbol = symbol
+	}
+
+	return root
+}
+
+// huffmanDecode decodes Huffman-encoded string. Padding is not validated.
+func huffmanDecode(data []byte) (string, error) {
+	out := make([]byte, 0, len(data)*8/5)
+	n := huffmanRoot
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			if n = n.children[(b>>uint(i))&1]; n == nil {
+				return "", errors.New("invalid Huffman code")
+			}
+			if n.symbol >= 0 {
+				out = append(out, byte(n.symbol))
+				n = huffmanRoot
+			}
+		}
+	}
+
+	return string(out), nil
+}
+
+// readPrefixInt reads integer with N-bit prefix, RFC 7541 section 5.1. Returns integer and number of bytes read.
+func readPrefixInt(b []byte, prefix uint) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errTruncated
+	}
+
+	max := uint64(1)<<prefix - 1
+	v := uint64(b[0]) & max
+	if v < max {
+		return v, 1, nil
+	}
+
+	var m uint
+	for i := 1; i < len(b); i++ {
+		v += uint64(b[i]&0x7f) << m
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+		if m += 7; m > 62 {
+			return 0, 0, errors.New("integer overflow")
+		}
+	}
+
+	return 0, 0, errTruncated
+}
+
+// readString reads string literal with Huffman flag followed by length with 7-bit prefix
+func readString(b []byte) (string, int, error) {
+	if len(b) == 0 {
+		return "", 0, errTruncated
+	}
+
+	huffman := b[0]&0x80 != 0
+	length, n, err := readPrefixInt(b, 7)
+	if err != nil {
+		return "", 0, err
+	}
+	if uint64(len(b)-n) < length {
+		return "", 0, errTruncated
+	}
+
+	data := b[n : n+int(length)]
+	if !huffman {
+		return string(data), n + int(length), nil
+	}
+
+	s, err := huffmanDecode(data)
+	return s, n + int(length), err
+}
+
+func appendPrefixInt(b []byte, flags byte, prefix uint, v uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if v < max {
+		return append(b, flags|byte(v))
+	}
+
+	b = append(b, flags|byte(max))
+	for v -= max; v >= 0x80; v >>= 7 {
+		b = append(b, byte(v)|0x80)
+	}
+	return append(b, byte(v))
+}
+
+// AppendField appends field encoded as literal without indexing, with literal name and without Huffman coding. Such
+// fields are decoded by any HPACK decoder without changing its dynamic table.
+func AppendField(b []byte, f HeaderField) []byte {
+	b = append(b, 0)
+	b = append(appendPrefixInt(b, 0, 7, uint64(len(f.Name))), f.Name...)
+	return append(appendPrefixInt(b, 0, 7, uint64(len(f.Value))), f.Value...)
+}
+
+// Decoder decodes field sections sent by one endpoint, using dynamic table built by them, RFC 7541
+type Decoder struct {
+	// SETTINGS_HEADER_TABLE_SIZE of the peer which decodes field sections
+	maxSize int
+	size    int
+	// Maximum size set by encoder, defaults to maxSize
+	capacity int
+	// Entries in the table, newest first
+	entries []HeaderField
+}
+
+// NewDecoder returns decoder with default table size
+func NewDecoder() *Decoder {
+	return &Decoder{maxSize: defaultTableSize, capacity: defaultTableSize}
+}
+
+func (d *Decoder) get(index uint64) (HeaderField, error) {
+	if index == 0 {
+		return HeaderField{}, errors.New("field index 0")
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], nil
+	}
+
+	index -= uint64(len(staticTable)) + 1
+	if index >= uint64(len(d.entries)) {
+		return HeaderField{}, fmt.Errorf("dynamic table entry %d does not exist", index)
+	}
+
+	return d.entries[index], nil
+}
+
+func (d *Decoder) insert(f HeaderField) {
+	d.entries = append([]HeaderField{f}, d.entries...)
+	d.size += len(f.Name) + len(f.Value) + 32
+	d.evict()
+}
+
+func (d *Decoder) evict() {
+	for d.size > d.capacity && len(d.entries) > 0 {
+		last := d.entries[len(d.entries)-1]
+		d.size -= len(last.Name) + len(last.Value) + 32
+		d.entries = d.entries[:len(d.entries)-1]
+	}
+}
+
+// Decode decodes complete field section, and updates dynamic table
+func (d *Decoder) Decode(b []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+
+	for len(b) > 0 {
+		var f HeaderField
+		var n int
+		var err error
+
+		switch {
+		// Indexed field
+		case b[0]&0x80 != 0:
+			var index uint64
+			if index, n, err = readPrefixInt(b, 7); err == nil {
+				f, err = d.get(index)
+			}
+			b = b[n:]
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+			continue
+		// Dynamic table size update
+		case b[0]&0xe0 == 0x20:
+			var size uint64
+			if size, n, err = readPrefixInt(b, 5); err != nil {
+				return nil, err
+			}
+			if size > uint64(d.maxSize) {
+				return nil, errors.New("dynamic table size exceeds limit")
+			}
+			d.capacity = int(size)
+			d.evict()
+			b = b[n:]
+			continue
+		}
+
+		// Literal field with incremental indexing has 6-bit prefix, without indexing and never indexed 4-bit
+		prefix := uint(4)
+		indexed := b[0]&0xc0 == 0x40
+		if indexed {
+			prefix = 6
+		}
+
+		index, n, err := readPrefixInt(b, prefix)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+
+		if index == 0 {
+			if f.Name, n, err = readString(b); err != nil {
+				return nil, err
+			}
+			b = b[n:]
+		} else {
+			name, err := d.get(index)
+			if err != nil {
+				return nil, err
+			}
+			f.Name = name.Name
+		}
+
+		if f.Value, n, err = readString(b); err != nil {
+			return nil, err
+		}
+		b = b[n:]
+
+		if indexed {
+			d.insert(f)
+		}
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
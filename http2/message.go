@@ -0,0 +1,175 @@
+package http2
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Connection-specific headers of HTTP/1.1, which are not allowed in HTTP/2
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+func fieldValue(fields []HeaderField, name string) string {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+
+	return ""
+}
+
+func requestHTTP(fields, trailers []HeaderField, body []byte) ([]byte, error) {
+	method, path, authority := fieldValue(fields, ":method"), fieldValue(fields, ":path"), fieldValue(fields, ":authority")
+	if method == "CONNECT" {
+		path = authority
+	}
+	if method == "" || path == "" {
+		return nil, errors.New("request without :method or :path field")
+	}
+
+	return httpMessage(method+" "+path+" HTTP/1.1", authority, fields, trailers, body), nil
+}
+
+func responseHTTP(fields, trailers []HeaderField, body []byte) ([]byte, error) {
+	status := fieldValue(fields, ":status")
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, errors.New("response without :status field")
+	}
+
+	return httpMessage(strings.TrimSpace("HTTP/1.1 "+status+" "+http.StatusText(code)), "", fields, trailers, body), nil
+}
+
+// httpMessage returns HTTP/1.1 message with given start line. Body is sent with Content-Length, and cookie fields
+// are joined into single header. Message with trailers is chunked, with trailer fields after the last chunk, so
+// they are replayed too.
+func httpMessage(startLine, host string, fields, trailers []HeaderField, body []byte) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(startLine + "\r\n")
+	if host != "" {
+		buf.WriteString("Host: " + host + "\r\n")
+	}
+
+	var cookies []string
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			continue
+		}
+
+		switch f.Name {
+		case "host", "content-length", "transfer-encoding", "connection":
+			continue
+		case "cookie":
+			cookies = append(cookies, f.Value)
+			continue
+		}
+
+		buf.WriteString(f.Name + ": " + f.Value + "\r\n")
+	}
+
+	if len(cookies) > 0 {
+		buf.WriteString("cookie: " + strings.Join(cookies, "; ") + "\r\n")
+	}
+
+	if len(trailers) > 0 {
+		var names []string
+		for _, f := range trailers {
+			names = append(names, f.Name)
+		}
+		buf.WriteString("Trailer: " + strings.Join(names, ", ") + "\r\n")
+		buf.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+
+		if len(body) > 0 {
+			buf.WriteString(strconv.FormatInt(int64(len(body)), 16) + "\r\n")
+			buf.Write(body)
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("0\r\n")
+		for _, f := range trailers {
+			buf.WriteString(f.Name + ": " + f.Value + "\r\n")
+		}
+		buf.WriteString("\r\n")
+
+		return buf.Bytes()
+	}
+
+	if len(body) > 0 {
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	}
+
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	return buf.Bytes()
+}
+
+// parseFields parses header lines, `Name: value\r\n`, into fields with lowercase names
+func parseFields(lines []byte) []HeaderField {
+	var fields []HeaderField
+
+	for _, line := range bytes.Split(lines, []byte("\n")) {
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+
+		name := strings.ToLower(string(bytes.TrimSpace(line[:i])))
+		fields = append(fields, HeaderField{Name: name, Value: string(bytes.TrimSpace(line[i+1:]))})
+	}
+
+	return fields
+}
+
+// requestFields translates HTTP/1.1 request into fields of HTTP/2 header section, body, and fields of trailer section
+// if body is chunked. Host header becomes :authority pseudo-header, and connection-specific headers are removed.
+func requestFields(data []byte, scheme string) (fields, trailers []HeaderField, body []byte, err error) {
+	if bytes.IndexByte(data, ' ') <= 0 || !bytes.Contains(data, proto.EmptyLine) {
+		return nil, nil, nil, errors.New("malformed HTTP request")
+	}
+
+	method, path := proto.Method(data), proto.Path(data)
+	end := proto.MIMEHeadersEndPos(data)
+	headers := parseFields(data[bytes.IndexByte(data, '\n')+1 : end])
+
+	fields = []HeaderField{{":method", string(method)}, {":scheme", scheme}, {":authority", fieldValue(headers, "host")}}
+	if string(method) != "CONNECT" {
+		fields = append(fields, HeaderField{":path", string(path)})
+	}
+
+	// Length of chunked body is known after it is decoded
+	chunked := strings.EqualFold(fieldValue(headers, "transfer-encoding"), "chunked")
+	for _, f := range headers {
+		switch {
+		case f.Name == "host" || connectionHeaders[f.Name]:
+			continue
+		case f.Name == "te" && f.Value != "trailers":
+			continue
+		case f.Name == "content-length" && chunked:
+			continue
+		}
+		fields = append(fields, f)
+	}
+
+	body = data[end:]
+	if chunked {
+		var lines []byte
+		if body, lines, err = proto.DecodeChunked(body); err != nil {
+			return nil, nil, nil, err
+		}
+		trailers = parseFields(lines)
+	}
+
+	return fields, trailers, body, nil
+}
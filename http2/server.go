@@ -0,0 +1,364 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// Request is request received by server
+type Request struct {
+	Stream   uint32
+	Fields   []HeaderField
+	Trailers []HeaderField
+	Body     []byte
+}
+
+// Response is response sent by server. Fields should start with :status pseudo-header field. Response without body
+// and trailers is sent as single field section, like trailers-only response of gRPC.
+type Response struct {
+	Fields   []HeaderField
+	Body     []byte
+	Trailers []HeaderField
+}
+
+// Handler returns response to request
+type Handler func(r *Request) *Response
+
+// serverConn is state of connection served by ServeConn
+type serverConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *Decoder
+	handler Handler
+
+	// Settings of client
+	maxFrameSize  int
+	initialWindow int
+	// Send windows of connection and of open streams
+	connWindow    int
+	streamWindows map[uint32]int
+
+	// Requests being received, and requests received completely, waiting for response
+	requests  map[uint32]*Request
+	completed []*Request
+	// Highest stream opened by client, streams with lower IDs can't be opened anymore
+	lastStream uint32
+	goAway     bool
+
+	// Header block split into HEADERS and CONTINUATION frames
+	block       []byte
+	blockStream uint32
+	blockEnd    bool
+
+	frame []byte
+}
+
+// ServeConn serves HTTP/2 connection started by client with prior knowledge, or negotiated by TLS ALPN. Requests are
+// handled one by one in order they are received completely, which is enough for control APIs, and server push is not
+// used. It returns when client closes connection, or on connection error.
+func ServeConn(conn net.Conn, handler Handler) error {
+	c := &serverConn{
+		conn:          conn,
+		reader:        bufio.NewReader(conn),
+		decoder:       NewDecoder(),
+		handler:       handler,
+		maxFrameSize:  defaultMaxFrameSize,
+		initialWindow: defaultWindowSize,
+		connWindow:    defaultWindowSize,
+		streamWindows: make(map[uint32]int),
+		requests:      make(map[uint32]*Request),
+	}
+
+	preface := make([]byte, len(Preface))
+	if _, err := io.ReadFull(c.reader, preface); err != nil {
+		return err
+	}
+	if !bytes.Equal(preface, Preface) {
+		return errors.New("connection preface is not received")
+	}
+
+	if _, err := conn.Write(AppendFrame(nil, FrameSettings, 0, 0, nil)); err != nil {
+		return err
+	}
+
+	for {
+		for len(c.completed) == 0 {
+			if c.goAway {
+				return nil
+			}
+			if err := c.readFrame(); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+
+		r := c.completed[0]
+		c.completed = c.completed[1:]
+
+		if err := c.respond(r.Stream, c.handler(r)); err != nil {
+			return err
+		}
+	}
+}
+
+// respond sends response to request of given stream, waiting for flow control windows if needed
+func (c *serverConn) respond(stream uint32, resp *Response) error {
+	if _, ok := c.streamWindows[stream]; !ok {
+		// Stream is reset by client
+		return nil
+	}
+	defer delete(c.streamWindows, stream)
+
+	body := resp.Body
+	end := len(body) == 0 && len(resp.Trailers) == 0
+	if err := c.writeHeaders(stream, resp.Fields, end); err != nil || end {
+		return err
+	}
+
+	for len(body) > 0 {
+		n := len(body)
+		for _, limit := range []int{c.maxFrameSize, c.connWindow, c.streamWindows[stream]} {
+			if limit < n {
+				n = limit
+			}
+		}
+
+		if n <= 0 {
+			if err := c.readFrame(); err != nil {
+				return err
+			}
+			if _, ok := c.streamWindows[stream]; !ok {
+				return nil
+			}
+			continue
+		}
+
+		var flags byte
+		if n == len(body) && len(resp.Trailers) == 0 {
+			flags = FlagEndStream
+		}
+		if _, err := c.conn.Write(AppendFrame(nil, FrameData, flags, stream, body[:n])); err != nil {
+			return err
+		}
+		c.connWindow -= n
+		c.streamWindows[stream] -= n
+		body = body[n:]
+	}
+
+	if len(resp.Trailers) > 0 {
+		return c.writeHeaders(stream, resp.Trailers, true)
+	}
+
+	return nil
+}
+
+func (c *serverConn) writeHeaders(stream uint32, fields []HeaderField, endStream bool) error {
+	var block []byte
+	for _, f := range fields {
+		block = AppendField(block, f)
+	}
+
+	_, err := c.conn.Write(appendHeaders(nil, stream, block, endStream, c.maxFrameSize))
+	return err
+}
+
+// readFrame reads and handles single frame sent by client
+func (c *serverConn) readFrame() error {
+	header, err := c.reader.Peek(frameHeaderSize)
+	if err != nil {
+		return err
+	}
+
+	length := frameHeaderSize + (int(header[0])<<16 | int(header[1])<<8 | int(header[2]))
+	if length > frameHeaderSize+defaultMaxFrameSize {
+		return errors.New("frame is too large")
+	}
+
+	if cap(c.frame) < length {
+		c.frame = make([]byte, length)
+	}
+	c.frame = c.frame[:length]
+	if _, err := io.ReadFull(c.reader, c.frame); err != nil {
+		return err
+	}
+
+	f, _, err := ReadFrame(c.frame)
+	if err != nil {
+		return err
+	}
+
+	return c.handle(f)
+}
+
+func (c *serverConn) handle(f Frame) error {
+	if c.block != nil && f.Type != FrameContinuation {
+		return errors.New("header block is not continued by CONTINUATION frame")
+	}
+
+	switch f.Type {
+	case FrameSettings:
+		if f.Flags&FlagAck != 0 {
+			return nil
+		}
+		return c.settings(f.Payload)
+	case FramePing:
+		if f.Flags&FlagAck != 0 {
+			return nil
+		}
+		_, err := c.conn.Write(AppendFrame(nil, FramePing, FlagAck, 0, f.Payload))
+		return err
+	case FrameGoAway:
+		c.goAway = true
+	case FrameWindowUpdate:
+		if len(f.Payload) < 4 {
+			return errTruncated
+		}
+		increment := int(binary.BigEndian.Uint32(f.Payload) & 0x7fffffff)
+		if f.Stream == 0 {
+			c.connWindow += increment
+		} else if _, ok := c.streamWindows[f.Stream]; ok {
+			c.streamWindows[f.Stream] += increment
+		}
+	case FrameRSTStream:
+		delete(c.requests, f.Stream)
+		delete(c.streamWindows, f.Stream)
+	case FrameData:
+		content, err := f.content()
+		if err != nil {
+			return err
+		}
+
+		// Received data is returned to flow control windows at once
+		if len(f.Payload) > 0 {
+			b := AppendFrame(nil, FrameWindowUpdate, 0, 0, windowIncrement(len(f.Payload)))
+			if f.Flags&FlagEndStream == 0 {
+				b = AppendFrame(b, FrameWindowUpdate, 0, f.Stream, windowIncrement(len(f.Payload)))
+			}
+			if _, err := c.conn.Write(b); err != nil {
+				return err
+			}
+		}
+
+		r := c.requests[f.Stream]
+		if r == nil {
+			return nil
+		}
+		if len(r.Body)+len(content) > maxStreamSize {
+			return errors.New("request body is too large")
+		}
+		r.Body = append(r.Body, content...)
+		if f.Flags&FlagEndStream != 0 {
+			c.complete(r)
+		}
+	case FrameHeaders:
+		content, err := f.content()
+		if err != nil {
+			return err
+		}
+		c.block = append([]byte{}, content...)
+		c.blockStream = f.Stream
+		c.blockEnd = f.Flags&FlagEndStream != 0
+		if f.Flags&FlagEndHeaders != 0 {
+			return c.headerBlock()
+		}
+	case FrameContinuation:
+		if c.block == nil || f.Stream != c.blockStream {
+			return errors.New("unexpected CONTINUATION frame")
+		}
+		if c.block = append(c.block, f.Payload...); len(c.block) > maxStreamSize {
+			return errors.New("header block is too large")
+		}
+		if f.Flags&FlagEndHeaders != 0 {
+			return c.headerBlock()
+		}
+	case FramePushPromise:
+		return errors.New("client can't push")
+	}
+
+	return nil
+}
+
+// settings applies SETTINGS frame of client and acknowledges it
+func (c *serverConn) settings(payload []byte) error {
+	for ; len(payload) >= 6; payload = payload[6:] {
+		value := int(binary.BigEndian.Uint32(payload[2:]))
+		switch binary.BigEndian.Uint16(payload) {
+		case SettingMaxFrameSize:
+			c.maxFrameSize = value
+		case SettingInitialWindowSize:
+			for id := range c.streamWindows {
+				c.streamWindows[id] += value - c.initialWindow
+			}
+			c.initialWindow = value
+		}
+	}
+
+	_, err := c.conn.Write(AppendFrame(nil, FrameSettings, FlagAck, 0, nil))
+	return err
+}
+
+// headerBlock decodes complete header block, which opens new stream or ends request with trailers
+func (c *serverConn) headerBlock() error {
+	block, id := c.block, c.blockStream
+	c.block = nil
+
+	fields, err := c.decoder.Decode(block)
+	if err != nil {
+		return err
+	}
+
+	r := c.requests[id]
+	switch {
+	case r != nil:
+		r.Trailers = fields
+	case id%2 == 1 && id > c.lastStream:
+		c.lastStream = id
+		r = &Request{Stream: id, Fields: fields}
+		c.requests[id] = r
+		c.streamWindows[id] = c.initialWindow
+	default:
+		return nil
+	}
+
+	if c.blockEnd {
+		c.complete(r)
+	}
+
+	return nil
+}
+
+func (c *serverConn) complete(r *Request) {
+	delete(c.requests, r.Stream)
+	c.completed = append(c.completed, r)
+}
+
+// appendHeaders appends header block of stream in HEADERS frame, followed by CONTINUATION frames if block exceeds
+// maximum frame size
+func appendHeaders(b []byte, stream uint32, block []byte, endStream bool, maxFrameSize int) []byte {
+	typ, flags := byte(FrameHeaders), byte(0)
+	if endStream {
+		flags = FlagEndStream
+	}
+
+	for {
+		n := len(block)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		if n == len(block) {
+			flags |= FlagEndHeaders
+		}
+
+		b = AppendFrame(b, typ, flags, stream, block[:n])
+		if block = block[n:]; len(block) == 0 {
+			return b
+		}
+		typ, flags = FrameContinuation, 0
+	}
+}
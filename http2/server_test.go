@@ -0,0 +1,129 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func readTestFrame(t *testing.T, r *bufio.Reader) Frame {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, frameHeaderSize+(int(header[0])<<16|int(header[1])<<8|int(header[2])))
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[frameHeaderSize:]); err != nil {
+		t.Fatal(err)
+	}
+
+	f, _, err := ReadFrame(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestServeConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Echo request body, with trailers of request
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		ServeConn(conn, func(r *Request) *Response {
+			var path string
+			for _, f := range r.Fields {
+				if f.Name == ":path" {
+					path = f.Value
+				}
+			}
+			return &Response{
+				Fields:   []HeaderField{{":status", "200"}, {"content-type", "application/grpc"}, {"x-path", path}},
+				Body:     r.Body,
+				Trailers: append(r.Trailers, HeaderField{"grpc-status", "0"}),
+			}
+		})
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Small stream window of client makes server wait for WINDOW_UPDATE frames
+	settings := make([]byte, 6)
+	binary.BigEndian.PutUint16(settings, SettingInitialWindowSize)
+	binary.BigEndian.PutUint32(settings[2:], 1000)
+
+	var block []byte
+	for _, f := range []HeaderField{{":method", "POST"}, {":scheme", "http"}, {":path", "/pkg.Service/Method"}, {":authority", "example.com"}} {
+		block = AppendField(block, f)
+	}
+	body := bytes.Repeat([]byte("0123456789"), 4000)
+
+	b := append([]byte{}, Preface...)
+	b = AppendFrame(b, FrameSettings, 0, 0, settings)
+	b = appendHeaders(b, 1, block, false, defaultMaxFrameSize)
+	for rest := body; len(rest) > 0; {
+		n := len(rest)
+		if n > defaultMaxFrameSize {
+			n = defaultMaxFrameSize
+		}
+		b = AppendFrame(b, FrameData, 0, 1, rest[:n])
+		rest = rest[n:]
+	}
+	b = appendHeaders(b, 1, AppendField(nil, HeaderField{"x-request", "1"}), true, defaultMaxFrameSize)
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	decoder := NewDecoder()
+	var fields, trailers []HeaderField
+	var received []byte
+	for trailers == nil {
+		f := readTestFrame(t, r)
+		switch f.Type {
+		case FrameHeaders:
+			decoded, err := decoder.Decode(f.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fields == nil {
+				fields = decoded
+			} else {
+				trailers = decoded
+			}
+		case FrameData:
+			received = append(received, f.Payload...)
+			if _, err := conn.Write(AppendFrame(nil, FrameWindowUpdate, 0, 1, windowIncrement(len(f.Payload)))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if len(fields) != 3 || fields[0] != (HeaderField{":status", "200"}) || fields[2] != (HeaderField{"x-path", "/pkg.Service/Method"}) {
+		t.Errorf("unexpected response fields %v", fields)
+	}
+	if !bytes.Equal(received, body) {
+		t.Errorf("expected echoed body of %d bytes, got %d", len(body), len(received))
+	}
+	if len(trailers) != 2 || trailers[0] != (HeaderField{"x-request", "1"}) || trailers[1] != (HeaderField{"grpc-status", "0"}) {
+		t.Errorf("unexpected trailers %v", trailers)
+	}
+}
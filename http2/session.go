@@ -0,0 +1,431 @@
+package http2
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Directions of TCP segments, indexes of per-direction state
+const (
+	fromClient = 0
+	fromServer = 1
+)
+
+// Maximum size of data buffered for single stream or connection direction, larger messages are dropped
+const maxStreamSize = 16 << 20
+
+// Message is HTTP/2 request or response, translated into HTTP/1.1 message
+type Message struct {
+	Request bool
+	// ID of request stream
+	Stream uint32
+	// Time of the first and the last frame of message
+	Start time.Time
+	End   time.Time
+	// Response only: time between end of request and end of response
+	Latency time.Duration
+	// HTTP/1.1 message, chunked with trailer fields if message has trailer section
+	HTTP []byte
+
+	connection string
+	connSeq    uint64
+}
+
+// UUID returns ID of request, shared by its response
+func (m *Message) UUID() []byte {
+	key := []byte(m.connection)
+	key = strconv.AppendUint(key, m.connSeq, 10)
+	key = strconv.AppendUint(key, uint64(m.Stream), 10)
+
+	uuid := make([]byte, 40)
+	sha := sha1.Sum(key)
+	hex.Encode(uuid, sha[:20])
+
+	return uuid
+}
+
+// tcpBuffer reassembles data sent in one direction of TCP connection, ordered by sequence numbers
+type tcpBuffer struct {
+	// Contiguous data not consumed yet, starting at sequence number seq
+	data []byte
+	seq  uint32
+	// Segments received out of order, by their sequence number
+	pending     map[uint32][]byte
+	pendingSize int
+	started     bool
+}
+
+// seqLess compares sequence numbers, which wrap around
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func (b *tcpBuffer) write(seq uint32, data []byte) error {
+	if !b.started {
+		b.started = true
+		b.seq = seq
+	}
+
+	end := b.seq + uint32(len(b.data))
+	if !seqLess(end, seq+uint32(len(data))) {
+		// Retransmission of data already received
+		return nil
+	}
+
+	if seqLess(end, seq) {
+		if b.pending == nil {
+			b.pending = make(map[uint32][]byte)
+		}
+		if len(data) > len(b.pending[seq]) {
+			b.pendingSize += len(data) - len(b.pending[seq])
+			b.pending[seq] = append([]byte{}, data...)
+		}
+	} else {
+		b.data = append(b.data, data[end-seq:]...)
+	}
+
+	// Segments received earlier can follow appended data now
+	for progress := true; progress && len(b.pending) > 0; {
+		progress = false
+		for s, chunk := range b.pending {
+			end := b.seq + uint32(len(b.data))
+			if seqLess(end, s) {
+				continue
+			}
+
+			if seqLess(end, s+uint32(len(chunk))) {
+				b.data = append(b.data, chunk[end-s:]...)
+			}
+			b.pendingSize -= len(chunk)
+			delete(b.pending, s)
+			progress = true
+		}
+	}
+
+	if len(b.data)+b.pendingSize > maxStreamSize {
+		return errors.New("too much data buffered, connection is dropped")
+	}
+
+	return nil
+}
+
+// consume removes n bytes from the beginning of data
+func (b *tcpBuffer) consume(n int) {
+	b.seq += uint32(n)
+	b.data = b.data[n:]
+}
+
+// streamHalf is request or response sent over a stream
+type streamHalf struct {
+	fields   []HeaderField
+	trailers []HeaderField
+	body     []byte
+	headers  bool
+	done     bool
+	// Body exceeded maxStreamSize, and message is dropped
+	dropped bool
+
+	start time.Time
+	end   time.Time
+}
+
+type stream struct {
+	id      uint32
+	halves  [2]streamHalf
+	request *Message
+}
+
+// conn is state of single HTTP/2 connection
+type conn struct {
+	seq      uint64
+	lastSeen time.Time
+	// Sequence number of client connection preface
+	prefaceSeq uint32
+
+	data    [2]tcpBuffer
+	decoder [2]*Decoder
+	// Header block split into HEADERS and CONTINUATION frames, and stream it belongs to
+	block       [2][]byte
+	blockStream [2]uint32
+	blockEnd    [2]bool
+	blockPush   [2]bool
+
+	streams map[uint32]*stream
+	closed  bool
+}
+
+// Sessions decodes HTTP/2 connections sent in cleartext, and translates their requests and responses into HTTP/1.1
+// messages. Connections should be captured from the client connection preface, otherwise their header compression
+// state is unknown and they are skipped.
+type Sessions struct {
+	expire     time.Duration
+	conns      map[string]*conn
+	seq        uint64
+	lastExpire time.Time
+}
+
+// NewSessions returns sessions. Connections without segments for expire duration are forgotten.
+func NewSessions(expire time.Duration) *Sessions {
+	return &Sessions{expire: expire, conns: make(map[string]*conn)}
+}
+
+// Segment decodes data of TCP segment sent by client, if incoming is true, or by server, and returns HTTP requests
+// and responses completed by it. Connection identifies client and server, e.g. by their addresses, and seq is TCP
+// sequence number of data, used to reorder segments and skip retransmissions.
+func (s *Sessions) Segment(connection string, incoming bool, seq uint32, data []byte, t time.Time) ([]*Message, error) {
+	if t.Sub(s.lastExpire) >= s.expire/10 {
+		for id, c := range s.conns {
+			if t.Sub(c.lastSeen) >= s.expire {
+				delete(s.conns, id)
+			}
+		}
+		s.lastExpire = t
+	}
+
+	dir := fromServer
+	if incoming {
+		dir = fromClient
+	}
+
+	c := s.conns[connection]
+	// Connection is decoded from client connection preface, which starts new connection with the same addresses too
+	if incoming && bytes.HasPrefix(data, Preface[:len(Preface)/2]) && (c == nil || c.prefaceSeq != seq) {
+		s.seq++
+		c = &conn{seq: s.seq, prefaceSeq: seq, streams: make(map[uint32]*stream), decoder: [2]*Decoder{NewDecoder(), NewDecoder()}}
+		s.conns[connection] = c
+	}
+	if c == nil {
+		return nil, nil
+	}
+	c.lastSeen = t
+
+	messages, err := c.segment(dir, seq, data, t)
+
+	for _, m := range messages {
+		m.connection = connection
+		m.connSeq = c.seq
+	}
+
+	if c.closed {
+		delete(s.conns, connection)
+	}
+
+	return messages, err
+}
+
+func (c *conn) segment(dir int, seq uint32, data []byte, t time.Time) ([]*Message, error) {
+	b := &c.data[dir]
+	if err := b.write(seq, data); err != nil {
+		c.closed = true
+		return nil, err
+	}
+
+	var messages []*Message
+	for {
+		n := FrameLength(b.data)
+		if n == -1 {
+			return messages, nil
+		}
+
+		if n == len(Preface) && bytes.HasPrefix(b.data, Preface) {
+			b.consume(n)
+			continue
+		}
+
+		f, _, _ := ReadFrame(b.data)
+		msgs, err := c.frame(dir, f, t)
+		messages = append(messages, msgs...)
+		b.consume(n)
+
+		if err != nil {
+			c.closed = true
+			return messages, err
+		}
+	}
+}
+
+func (c *conn) stream(id uint32) *stream {
+	s := c.streams[id]
+	if s == nil {
+		s = &stream{id: id}
+		c.streams[id] = s
+	}
+
+	return s
+}
+
+// frame decodes single frame sent in direction dir
+func (c *conn) frame(dir int, f Frame, t time.Time) ([]*Message, error) {
+	if c.block[dir] != nil && f.Type != FrameContinuation {
+		return nil, errors.New("header block is not continued by CONTINUATION frame")
+	}
+
+	switch f.Type {
+	case FrameSettings:
+		if f.Flags&FlagAck == 0 {
+			c.settings(dir, f.Payload)
+		}
+	case FrameRSTStream:
+		delete(c.streams, f.Stream)
+	case FrameData:
+		if f.Stream == 0 {
+			return nil, errors.New("DATA frame of stream 0")
+		}
+		content, err := f.content()
+		if err != nil {
+			return nil, err
+		}
+
+		s := c.streams[f.Stream]
+		if s == nil {
+			return nil, nil
+		}
+		h := &s.halves[dir]
+		h.end = t
+		if !h.dropped {
+			if h.dropped = len(h.body)+len(content) > maxStreamSize; h.dropped {
+				h.body = nil
+			} else {
+				h.body = append(h.body, content...)
+			}
+		}
+		if f.Flags&FlagEndStream != 0 {
+			return c.finish(s, dir), nil
+		}
+	case FrameHeaders, FramePushPromise:
+		content, err := f.content()
+		if err != nil {
+			return nil, err
+		}
+		if f.Type == FramePushPromise {
+			if len(content) < 4 {
+				return nil, errTruncated
+			}
+			content = content[4:]
+		}
+
+		c.block[dir] = append([]byte{}, content...)
+		c.blockStream[dir] = f.Stream
+		c.blockEnd[dir] = f.Type == FrameHeaders && f.Flags&FlagEndStream != 0
+		c.blockPush[dir] = f.Type == FramePushPromise
+		if f.Flags&FlagEndHeaders != 0 {
+			return c.headerBlock(dir, t)
+		}
+	case FrameContinuation:
+		if c.block[dir] == nil || f.Stream != c.blockStream[dir] {
+			return nil, errors.New("unexpected CONTINUATION frame")
+		}
+		if c.block[dir] = append(c.block[dir], f.Payload...); len(c.block[dir]) > maxStreamSize {
+			return nil, errors.New("header block is too large")
+		}
+		if f.Flags&FlagEndHeaders != 0 {
+			return c.headerBlock(dir, t)
+		}
+	}
+
+	return nil, nil
+}
+
+// settings reads SETTINGS frame of endpoint. Its header table size limits table of the other endpoint.
+func (c *conn) settings(dir int, payload []byte) {
+	for ; len(payload) >= 6; payload = payload[6:] {
+		if binary.BigEndian.Uint16(payload) == SettingHeaderTableSize {
+			c.decoder[1-dir].maxSize = int(binary.BigEndian.Uint32(payload[2:]))
+		}
+	}
+}
+
+// headerBlock decodes complete header block. It is decoded even if it is not used, so dynamic table stays in sync
+// with encoder.
+func (c *conn) headerBlock(dir int, t time.Time) ([]*Message, error) {
+	block, id, end, push := c.block[dir], c.blockStream[dir], c.blockEnd[dir], c.blockPush[dir]
+	c.block[dir] = nil
+
+	fields, err := c.decoder[dir].Decode(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pushed requests are not sent by client, and are not replayed
+	if push {
+		return nil, nil
+	}
+
+	// Responses to requests captured before their stream are skipped
+	s := c.streams[id]
+	if s == nil && dir == fromServer {
+		return nil, nil
+	}
+	s = c.stream(id)
+
+	h := &s.halves[dir]
+	if h.start.IsZero() {
+		h.start = t
+	}
+	h.end = t
+
+	switch {
+	case !h.headers:
+		// Interim responses are skipped
+		if status := fieldValue(fields, ":status"); len(status) == 3 && status[0] == '1' {
+			return nil, nil
+		}
+		h.fields = fields
+		h.headers = true
+	default:
+		h.trailers = fields
+	}
+
+	if end {
+		return c.finish(s, dir), nil
+	}
+
+	return nil, nil
+}
+
+// finish completes request or response of stream, and returns messages which can be emitted. Response can be
+// completed before request, and is emitted after it.
+func (c *conn) finish(s *stream, dir int) []*Message {
+	s.halves[dir].done = true
+
+	var messages []*Message
+
+	req := &s.halves[fromClient]
+	if dir == fromClient {
+		if req.dropped {
+			delete(c.streams, s.id)
+			return nil
+		}
+
+		s.request = &Message{Request: true, Stream: s.id, Start: req.start, End: req.end}
+		var err error
+		if s.request.HTTP, err = requestHTTP(req.fields, req.trailers, req.body); err != nil {
+			delete(c.streams, s.id)
+			return nil
+		}
+		messages = append(messages, s.request)
+	}
+
+	resp := &s.halves[fromServer]
+	if s.request == nil || !resp.done {
+		return messages
+	}
+	delete(c.streams, s.id)
+
+	if resp.dropped {
+		return messages
+	}
+
+	m := &Message{Stream: s.id, Start: resp.start, End: resp.end, Latency: resp.end.Sub(s.request.End)}
+	var err error
+	if m.HTTP, err = responseHTTP(resp.fields, resp.trailers, resp.body); err == nil {
+		messages = append(messages, m)
+	}
+
+	return messages
+}
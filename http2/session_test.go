@@ -0,0 +1,148 @@
+package http2
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHPACKDecoder(t *testing.T) {
+	d := NewDecoder()
+
+	// RFC 7541 appendix C.4, requests with Huffman coding
+	for i, c := range []struct {
+		block  string
+		fields []HeaderField
+		size   int
+	}{
+		{"828684418cf1e3c2e5f23a6ba0ab90f4ff", []HeaderField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}}, 57},
+		{"828684be5886a8eb10649cbf", []HeaderField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}, {"cache-control", "no-cache"}}, 110},
+	} {
+		block, _ := hex.DecodeString(c.block)
+		fields, err := d.Decode(block)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if len(fields) != len(c.fields) {
+			t.Fatal(i, "unexpected fields", fields)
+		}
+		for j := range fields {
+			if fields[j] != c.fields[j] {
+				t.Error(i, "unexpected field", fields[j], c.fields[j])
+			}
+		}
+		if d.size != c.size {
+			t.Error(i, "unexpected table size", d.size)
+		}
+	}
+
+	// Literal fields are decoded without changing table
+	fields, err := d.Decode(AppendField(nil, HeaderField{"grpc-status", "0"}))
+	if err != nil || len(fields) != 1 || fields[0].Value != "0" || d.size != 110 {
+		t.Error("unexpected literal field", fields, err)
+	}
+}
+
+func headersFrame(stream uint32, flags byte, fields ...HeaderField) []byte {
+	var block []byte
+	for _, f := range fields {
+		block = AppendField(block, f)
+	}
+
+	return AppendFrame(nil, FrameHeaders, flags|FlagEndHeaders, stream, block)
+}
+
+func TestSessions(t *testing.T) {
+	s := NewSessions(time.Minute)
+	now := time.Now()
+
+	client := append([]byte{}, Preface...)
+	client = AppendFrame(client, FrameSettings, 0, 0, nil)
+	client = append(client, headersFrame(1, 0, HeaderField{":method", "POST"}, HeaderField{":scheme", "http"},
+		HeaderField{":authority", "example.com"}, HeaderField{":path", "/pkg.Service/Method"}, HeaderField{"te", "trailers"})...)
+	client = AppendFrame(client, FrameData, FlagEndStream, 1, []byte("request"))
+
+	server := AppendFrame(nil, FrameSettings, 0, 0, nil)
+	server = append(server, headersFrame(1, 0, HeaderField{":status", "200"}, HeaderField{"content-type", "application/grpc"})...)
+	server = AppendFrame(server, FrameData, 0, 1, []byte("response"))
+	server = append(server, headersFrame(1, FlagEndStream, HeaderField{"grpc-status", "0"})...)
+
+	var messages []*Message
+	segment := func(incoming bool, seq uint32, data []byte) {
+		msgs, err := s.Segment("client-server", incoming, seq, data, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, msgs...)
+	}
+
+	// Client segments are reordered and retransmitted, sequence numbers wrap around
+	seq := uint32(1<<32 - 40)
+	segment(true, seq, client[:40])
+	segment(true, seq+60, client[60:])
+	segment(true, seq+40, client[40:60])
+	segment(true, seq+40, client[40:60])
+	if len(messages) != 1 || !messages[0].Request {
+		t.Fatal("request is not decoded", messages)
+	}
+
+	segment(false, 1000, server[:30])
+	segment(false, 1030, server[30:])
+	if len(messages) != 2 || messages[1].Request {
+		t.Fatal("response is not decoded", messages)
+	}
+
+	req, resp := messages[0], messages[1]
+	if !bytes.Equal(req.UUID(), resp.UUID()) {
+		t.Error("request and response have different UUID")
+	}
+
+	expected := "POST /pkg.Service/Method HTTP/1.1\r\nHost: example.com\r\nte: trailers\r\nContent-Length: 7\r\n\r\nrequest"
+	if string(req.HTTP) != expected {
+		t.Errorf("unexpected request %q", req.HTTP)
+	}
+
+	expected = "HTTP/1.1 200 OK\r\ncontent-type: application/grpc\r\nTrailer: grpc-status\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"8\r\nresponse\r\n0\r\ngrpc-status: 0\r\n\r\n"
+	if string(resp.HTTP) != expected {
+		t.Errorf("unexpected response %q", resp.HTTP)
+	}
+
+	// Connection captured without its preface is skipped
+	msgs, err := s.Segment("other", true, 1, client[len(Preface):], now)
+	if err != nil || len(msgs) != 0 {
+		t.Error("connection without preface is decoded", msgs, err)
+	}
+
+	// Request of new connection with the same addresses has new UUID
+	messages = nil
+	segment(true, 5000, client)
+	if len(messages) != 1 || bytes.Equal(messages[0].UUID(), req.UUID()) {
+		t.Error("new connection is not decoded", messages)
+	}
+}
+
+func TestRequestFields(t *testing.T) {
+	fields, trailers, body, err := requestFields([]byte("POST /path HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive\r\n"+
+		"Transfer-Encoding: chunked\r\nTE: trailers\r\n\r\n4\r\nbody\r\n0\r\ngrpc-status: 0\r\n\r\n"), "https")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range fields {
+		names = append(names, f.Name+"="+f.Value)
+	}
+	if strings.Join(names, " ") != ":method=POST :scheme=https :authority=example.com :path=/path te=trailers" {
+		t.Error("unexpected fields", names)
+	}
+	if string(body) != "body" || len(trailers) != 1 || trailers[0] != (HeaderField{"grpc-status", "0"}) {
+		t.Errorf("unexpected body %q or trailers %v", body, trailers)
+	}
+
+	if _, _, _, err := requestFields([]byte("malformed"), "http"); err == nil {
+		t.Error("malformed request is translated")
+	}
+}
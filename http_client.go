@@ -1,11 +1,13 @@
-package main
+package goreplay
 
 import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -18,7 +20,9 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/buger/goreplay/http2"
 	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/quic"
 )
 
 var httpMu sync.Mutex
@@ -28,13 +32,14 @@ const (
 	maxResponseSize = 1073741824
 )
 
-var chunkedSuffix = []byte("0\r\n\r\n")
-
 var defaultPorts = map[string]string{
 	"http":  "80",
 	"https": "443",
 }
 
+// Interval of trying HTTP/3 again after QUIC handshake failed
+const http3RetryInterval = time.Minute
+
 type HTTPClientConfig struct {
 	FollowRedirects    int
 	Debug              bool
@@ -43,8 +48,46 @@ type HTTPClientConfig struct {
 	Timeout            time.Duration
 	ResponseBufferSize int
 	CompatibilityMode  bool
+	// Timeout of TLS handshake, ConnectionTimeout by default
+	TLSHandshakeTimeout time.Duration
+	// Time to wait for response headers after request is sent, Timeout by default
+	ResponseHeaderTimeout time.Duration
+	// Total time of request including redirects, request is abandoned when it is exceeded
+	Deadline time.Duration
+	// IP addresses used instead of resolving host names, e.g. to switch target during blue/green deployment
+	Resolve map[string]string
+	// Interval of resolving host again, connection is closed if its address is not resolved anymore
+	ResolveInterval time.Duration
+	// Send PROXY protocol v2 header with address set by SetClientAddr
+	ProxyProtocol bool
+	// Host header sent instead of target host, unless OriginalHost is set
+	Host string
+	// TLS server name sent instead of target host name, OriginalServerName to use host of request Host header
+	ServerName string
+	// Close connection after each request, or after it is not used for IdleTimeout
+	DisableKeepAlive bool
+	IdleTimeout      time.Duration
+	// Streaming responses, e.g. server-sent events, are read until StreamTimeout after their headers, and connection
+	// is closed after it. Timeout by default.
+	StreamTimeout time.Duration
+	// Maximum number of response bytes read, connection is closed if response is longer. 1GB by default.
+	MaxResponseRead int
+	// Keep order and name casing of request headers, headers set by client follow them
+	PreserveHeaders bool
+	// Send requests using HTTP/2, so trailers like grpc-status are replayed. HTTP/2 is used with prior knowledge for
+	// http targets, unless they are reached through proxy, and negotiated with ALPN for https targets, which fall back
+	// to HTTP/1.1 if server does not support it.
+	HTTP2 bool
+	// Send requests to https targets using HTTP/3, unless they are reached through proxy. If QUIC handshake fails, e.g.
+	// when UDP is blocked, requests are sent over TCP, and HTTP/3 is tried again after http3RetryInterval.
+	HTTP3 bool
+	// Pool limiting connections of clients sharing it
+	pool *connPool
 }
 
+// OriginalServerName value of ServerName option sets TLS server name to host of request Host header
+const OriginalServerName = "original"
+
 type HTTPClient struct {
 	baseURL        string
 	scheme         string
@@ -57,8 +100,28 @@ type HTTPClient struct {
 	config         *HTTPClientConfig
 	goClient       *http.Client
 	redirectsCount int
+	resolvedAt     time.Time
+	// Address of client whose requests are sent using current connection
+	clientAddr string
+	// TLS server name of current connection
+	serverName string
+	// Time current request is abandoned at, zero if Deadline is not set
+	deadline time.Time
+	// Time connection was last used, and if it is counted as idle by pool
+	usedAt time.Time
+	idle   bool
+	// HTTP/2 connection wrapping conn, nil if HTTP/1.1 is used
+	h2 *http2.Conn
+	// HTTP/3 connection using conn as UDP socket, and time its handshake last failed at
+	h3         *quic.Conn
+	h3FailedAt time.Time
+	// Protocol of the last request, "http/1.1", "h2" or "h3"
+	protocol string
 }
 
+// errDeadlineExceeded is returned for requests abandoned after Deadline
+var errDeadlineExceeded = errors.New("request deadline exceeded")
+
 func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 	if !strings.HasPrefix(baseURL, "http") {
 		baseURL = "http://" + baseURL
@@ -70,23 +133,60 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 		config.Timeout = time.Second
 	}
 
-	config.ConnectionTimeout = config.Timeout
+	// Go client uses its default transport unless it is configured
+	customTransport := len(config.Resolve) > 0 || config.ServerName != "" || config.TLSHandshakeTimeout > 0 || config.ResponseHeaderTimeout > 0 ||
+		config.DisableKeepAlive || config.IdleTimeout > 0
+
+	if config.ConnectionTimeout == 0 {
+		config.ConnectionTimeout = config.Timeout
+	}
+
+	if config.TLSHandshakeTimeout == 0 {
+		config.TLSHandshakeTimeout = config.ConnectionTimeout
+	}
+
+	if config.ResponseHeaderTimeout == 0 {
+		config.ResponseHeaderTimeout = config.Timeout
+	}
 
 	if config.ResponseBufferSize == 0 {
 		config.ResponseBufferSize = 100 * 1024 // 100kb
 	}
 
+	if config.StreamTimeout == 0 {
+		config.StreamTimeout = config.Timeout
+	}
+
+	if config.MaxResponseRead == 0 {
+		config.MaxResponseRead = maxResponseSize
+	}
+
 	client := new(HTTPClient)
 	client.baseURL = u.String()
 	client.host = u.Host
 	client.scheme = u.Scheme
 	client.respBuf = make([]byte, config.ResponseBufferSize)
 	client.config = config
+	client.serverName = u.Hostname()
+	if config.ServerName != "" && config.ServerName != OriginalServerName {
+		client.serverName = config.ServerName
+	}
 
 	if config.CompatibilityMode {
 		client.goClient = &http.Client{
-			// #TODO
-			// CheckRedirect: redirectPolicyFunc,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > config.FollowRedirects {
+					return http.ErrUseLastResponse
+				}
+				return nil
+			},
+			Timeout: config.Deadline,
+		}
+
+		if config.pool != nil {
+			client.goClient.Transport = config.pool.goTransport(config)
+		} else if customTransport {
+			client.goClient.Transport = newTransport(config)
 		}
 	}
 
@@ -113,6 +213,27 @@ func (c *HTTPClient) Connect() (err error) {
 		toDial = c.host
 	}
 
+	if c.config.pool != nil {
+		if !c.config.pool.acquire(c.host, c.config.ConnectionTimeout) {
+			return errors.New("too many connections to " + c.host)
+		}
+
+		// Slot is freed by Disconnect, or if connection fails
+		defer func() {
+			if c.conn == nil {
+				c.config.pool.release(c.host)
+			}
+		}()
+	}
+
+	if c.config.HTTP3 && c.scheme == "https" && !c.isProxy() && time.Since(c.h3FailedAt) >= http3RetryInterval {
+		if err = c.connectHTTP3(toDial); err == nil {
+			return
+		}
+		log.Println("[HTTPClient] HTTP/3 connection error, falling back to TCP:", err)
+		c.h3FailedAt = time.Now()
+	}
+
 	if c.isProxy() {
 		if c.proxy.Scheme != "http" {
 			panic("Unsupported HTTP Proxy method")
@@ -153,37 +274,239 @@ func (c *HTTPClient) Connect() (err error) {
 		}
 		Debug("[HTTPClient] Proxy successfully connected")
 	} else {
-		c.conn, err = net.DialTimeout("tcp", toDial, c.config.ConnectionTimeout)
+		c.conn, err = net.DialTimeout("tcp", c.resolve(toDial), c.config.ConnectionTimeout)
 		if err != nil {
 			return
 		}
+
+		if c.config.ProxyProtocol {
+			if _, err = c.conn.Write(proxyProtocolHeader(c.clientAddr, c.conn.RemoteAddr())); err != nil {
+				return
+			}
+		}
 	}
 
+	c.resolvedAt = time.Now()
+
 	if c.scheme == "https" {
 		// Wrap our socket in TLS
 		Debug("[HTTPClient] Wrapping socket in TLS", c.host)
-		tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true, ServerName: c.host})
+		config := &tls.Config{InsecureSkipVerify: true, ServerName: c.serverName}
+		if c.config.HTTP2 {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
+		tlsConn := tls.Client(c.conn, config)
 
+		tlsConn.SetDeadline(time.Now().Add(c.config.TLSHandshakeTimeout))
 		if err = tlsConn.Handshake(); err != nil {
+			c.conn.Close()
+			c.conn = nil
 			return
 		}
+		tlsConn.SetDeadline(time.Time{})
 
 		c.conn = tlsConn
 		Debug("[HTTPClient] Successfully wrapped in TLS")
 	}
 
+	if c.config.HTTP2 && (c.scheme == "http" && !c.isProxy() || c.scheme == "https" && c.conn.(*tls.Conn).ConnectionState().NegotiatedProtocol == "h2") {
+		c.conn.SetWriteDeadline(time.Now().Add(c.config.ConnectionTimeout))
+		if c.h2, err = http2.NewConn(c.conn); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return
+		}
+		Debug("[HTTPClient] Using HTTP/2", c.host)
+	}
+
 	return
 }
 
+// connectHTTP3 establishes QUIC connection, and sets conn to its UDP socket
+func (c *HTTPClient) connectHTTP3(address string) error {
+	conn, err := net.DialTimeout("udp", c.resolve(address), c.config.ConnectionTimeout)
+	if err != nil {
+		return err
+	}
+
+	h3 := quic.NewConn(conn, &tls.Config{InsecureSkipVerify: true, ServerName: c.serverName})
+	h3.SetDeadline(time.Now().Add(c.config.TLSHandshakeTimeout))
+	if err := h3.Handshake(); err != nil {
+		h3.Close()
+		return err
+	}
+	h3.SetDeadline(time.Time{})
+
+	c.conn, c.h3 = conn, h3
+	c.resolvedAt = time.Now()
+	Debug("[HTTPClient] Using HTTP/3", c.host)
+
+	return nil
+}
+
+// SetClientAddr sets address of client sent in PROXY protocol header. Connection established for another client is
+// closed.
+func (c *HTTPClient) SetClientAddr(addr string) {
+	if addr != c.clientAddr {
+		c.Disconnect()
+		c.clientAddr = addr
+	}
+}
+
+// setServerName sets TLS server name to name of host, without port. Connection established with another name is closed.
+func (c *HTTPClient) setServerName(host []byte) {
+	name := string(host)
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+
+	if name != "" && name != c.serverName {
+		c.Disconnect()
+		c.serverName = name
+	}
+}
+
+// Signature of PROXY protocol v2 header, see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolHeader returns PROXY protocol v2 header of connection from client address to dst. LOCAL command is
+// sent if client address is not known, and target uses real address of connection.
+func proxyProtocolHeader(clientAddr string, dst net.Addr) []byte {
+	header := append([]byte{}, proxyProtocolSignature...)
+
+	src, err := net.ResolveTCPAddr("tcp", clientAddr)
+	to, ok := dst.(*net.TCPAddr)
+	if err != nil || !ok || src.IP == nil {
+		// Version 2, LOCAL command, unspecified family, no addresses
+		return append(header, 0x20, 0x00, 0, 0)
+	}
+
+	// Version 2, PROXY command, TCP over IPv4 or IPv6
+	srcIP, dstIP := src.IP.To4(), to.IP.To4()
+	family := byte(0x11)
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = src.IP.To16(), to.IP.To16()
+		family = 0x21
+	}
+
+	length := 2*len(srcIP) + 4
+	header = append(header, 0x21, family, byte(length>>8), byte(length))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = append(header, byte(src.Port>>8), byte(src.Port), byte(to.Port>>8), byte(to.Port))
+
+	return header
+}
+
+// resolve replaces host of address with IP set by Resolve option
+func (c *HTTPClient) resolve(address string) string {
+	return resolveAddress(c.config.Resolve, address)
+}
+
+func resolveAddress(resolve map[string]string, address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	if ip, ok := resolve[host]; ok {
+		return net.JoinHostPort(ip, port)
+	}
+
+	return address
+}
+
+// isResolved checks that connection is established with address host is currently resolved to
+func (c *HTTPClient) isResolved() bool {
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return true
+	}
+
+	name := c.host
+	if h, _, err := net.SplitHostPort(c.host); err == nil {
+		name = h
+	}
+
+	if ip, ok := c.config.Resolve[name]; ok {
+		return net.ParseIP(ip).Equal(net.ParseIP(host))
+	}
+
+	addrs, err := net.LookupHost(name)
+	if err != nil {
+		// Connection is kept if DNS is not available
+		return true
+	}
+
+	for _, addr := range addrs {
+		if net.ParseIP(addr).Equal(net.ParseIP(host)) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (c *HTTPClient) Disconnect() {
 	if c.conn != nil {
+		if c.h3 != nil {
+			c.h3.Close()
+		}
 		c.conn.Close()
 		c.conn = nil
+		c.h2 = nil
+		c.h3 = nil
 		Debug("[HTTP] Disconnected: ", c.baseURL)
+
+		if c.config.pool != nil {
+			if c.idle {
+				c.idle = false
+				c.config.pool.setBusy()
+			}
+			c.config.pool.release(c.host)
+		}
+	}
+}
+
+// CloseIdle closes connection which is not used for IdleTimeout
+func (c *HTTPClient) CloseIdle() {
+	if c.conn != nil && c.config.IdleTimeout > 0 && time.Since(c.usedAt) >= c.config.IdleTimeout {
+		Debug("[HTTPClient] Closing idle connection:", c.baseURL)
+		c.Disconnect()
+	}
+}
+
+// release keeps connection open for the next request, unless keep-alive is disabled or pool has enough idle
+// connections
+func (c *HTTPClient) release() {
+	if c.conn == nil || c.idle {
+		return
+	}
+
+	c.usedAt = time.Now()
+
+	if c.config.DisableKeepAlive {
+		c.Disconnect()
+		return
+	}
+
+	if c.config.pool != nil {
+		if !c.config.pool.setIdle() {
+			c.Disconnect()
+			return
+		}
+		c.idle = true
 	}
 }
 
 func (c *HTTPClient) isAlive(readBytes *int) bool {
+	if c.h3 != nil {
+		return c.h3.Alive()
+	}
+	if c.h2 != nil {
+		return c.h2.Alive()
+	}
+
 	// Ready 1 byte from socket without timeout to check if it not closed
 	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
 	n, err := c.conn.Read(c.respBuf[:1])
@@ -214,7 +537,9 @@ func (c *HTTPClient) SendGoClient(data []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	if !c.config.OriginalHost {
+	if c.config.Host != "" {
+		req.Host = c.config.Host
+	} else if !c.config.OriginalHost {
 		req.Host = c.host
 	}
 
@@ -227,13 +552,26 @@ func (c *HTTPClient) SendGoClient(data []byte) ([]byte, error) {
 
 	resp, err = c.goClient.Do(req)
 	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() && c.config.Deadline > 0 {
+			return errorPayload(HTTP_TIMEOUT), errDeadlineExceeded
+		}
 		return nil, err
 	}
 
+	c.protocol = "http/1.1"
+	if resp.ProtoMajor == 2 {
+		c.protocol = "h2"
+	}
+
 	return httputil.DumpResponse(resp, true)
 }
 
 func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
+	return c.SendStream(data, nil)
+}
+
+// SendStream sends request which rest is read from body, used for messages too large to be buffered
+func (c *HTTPClient) SendStream(data []byte, body io.Reader) (response []byte, err error) {
 	// Don't exit on panic
 	defer func() {
 		if r := recover(); r != nil {
@@ -248,9 +586,47 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 	}()
 
 	if c.config.CompatibilityMode {
+		if c.config.ResolveInterval > 0 && time.Since(c.resolvedAt) >= c.config.ResolveInterval {
+			c.resolvedAt = time.Now()
+			c.goClient.CloseIdleConnections()
+		}
+
+		if body != nil {
+			var rest []byte
+			if rest, err = ioutil.ReadAll(body); err != nil {
+				return errorPayload(HTTP_TIMEOUT), err
+			}
+			data = append(data, rest...)
+		}
 		return c.SendGoClient(data)
 	}
 
+	c.CloseIdle()
+	if c.idle {
+		c.idle = false
+		c.config.pool.setBusy()
+	}
+	defer c.release()
+
+	// Redirects are followed within deadline of original request
+	if c.config.Deadline > 0 && c.redirectsCount == 0 {
+		c.deadline = time.Now().Add(c.config.Deadline)
+	}
+
+	// Target switched to another address, requests to proxy are resolved by proxy
+	if c.conn != nil && c.config.ResolveInterval > 0 && !c.isProxy() && time.Since(c.resolvedAt) >= c.config.ResolveInterval {
+		c.resolvedAt = time.Now()
+		if !c.isResolved() {
+			Debug("[HTTPClient] Host resolved to another address, reconnecting:", c.baseURL)
+			c.Disconnect()
+		}
+	}
+
+	// Connection is established for server name of another virtual host
+	if c.config.ServerName == OriginalServerName && c.scheme == "https" {
+		c.setServerName(proto.Header(data, []byte("Host")))
+	}
+
 	var readBytes int
 	if c.conn == nil || !c.isAlive(&readBytes) {
 		Debug("[HTTPClient] Connecting:", c.baseURL)
@@ -261,11 +637,31 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 		}
 	}
 
+	if c.expired() {
+		return c.abandon()
+	}
+
+	switch {
+	case c.h3 != nil:
+		c.protocol = "h3"
+	case c.h2 != nil:
+		c.protocol = "h2"
+	default:
+		c.protocol = "http/1.1"
+	}
+
 	timeout := time.Now().Add(c.config.Timeout)
 
-	c.conn.SetWriteDeadline(timeout)
+	c.conn.SetWriteDeadline(c.limit(timeout))
+
+	var headers []byte
+	if c.config.PreserveHeaders {
+		headers = append(headers, data[:proto.MIMEHeadersEndPos(data)]...)
+	}
 
-	if !c.config.OriginalHost {
+	if c.config.Host != "" {
+		data = proto.SetHeader(data, []byte("Host"), []byte(c.config.Host))
+	} else if !c.config.OriginalHost {
 		data = proto.SetHost(data, []byte(c.baseURL), []byte(c.host))
 	}
 
@@ -283,32 +679,97 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 		data = proto.SetHeader(data, []byte("Authorization"), []byte(c.auth))
 	}
 
+	if headers != nil {
+		data = proto.ReorderHeaders(data, headers)
+	}
+
 	if c.config.Debug {
 		Debug("[HTTPClient] Sending:", string(data))
 	}
 
-	return c.send(data, readBytes, timeout)
+	if c.h2 != nil || c.h3 != nil {
+		return c.roundTrip(data, body, timeout)
+	}
+
+	return c.send(data, body, readBytes, timeout)
 }
 
-func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (response []byte, err error) {
+// roundTrip sends request using new stream of HTTP/2 or HTTP/3 connection. Response is translated into HTTP/1.1,
+// and its trailer section is kept as trailer fields of chunked body.
+func (c *HTTPClient) roundTrip(data []byte, body io.Reader, timeout time.Time) (response []byte, err error) {
+	if body != nil {
+		var rest []byte
+		if rest, err = ioutil.ReadAll(body); err != nil {
+			return errorPayload(HTTP_TIMEOUT), err
+		}
+		data = append(data, rest...)
+	}
+
+	var payload []byte
+	if c.h3 != nil {
+		c.h3.SetDeadline(c.limit(timeout))
+		payload, err = c.h3.RoundTrip(data, c.scheme)
+		c.h3.SetDeadline(time.Time{})
+	} else {
+		c.conn.SetDeadline(c.limit(timeout))
+		payload, err = c.h2.RoundTrip(data, c.scheme)
+		c.conn.SetDeadline(time.Time{})
+	}
+
+	if err != nil {
+		if c.expired() {
+			return c.abandon()
+		}
+		Debug("[HTTPClient]", c.protocol, "request error:", err, c.baseURL)
+		c.Disconnect()
+		return errorPayload(HTTP_TIMEOUT), err
+	}
+
+	if len(payload) > len(c.respBuf) {
+		payload = payload[:len(c.respBuf)]
+	}
+
+	return c.received(data, body, payload, nil)
+}
+
+func (c *HTTPClient) send(data []byte, body io.Reader, readBytes int, timeout time.Time) (response []byte, err error) {
 	var payload []byte
 	var n int
 	if _, err = c.conn.Write(data); err != nil {
+		if c.expired() {
+			return c.abandon()
+		}
 		Debug("[HTTPClient] Write error:", err, c.baseURL)
 		response = errorPayload(HTTP_TIMEOUT)
 		c.Disconnect()
 		return
 	}
 
+	if body != nil {
+		if err = c.writeBody(body); err != nil {
+			if c.expired() {
+				return c.abandon()
+			}
+			Debug("[HTTPClient] Body write error:", err, c.baseURL)
+			response = errorPayload(HTTP_TIMEOUT)
+			c.Disconnect()
+			return
+		}
+	}
+
 	var currentChunk []byte
-	timeout = time.Now().Add(c.config.Timeout)
+	timeout = time.Now().Add(c.config.ResponseHeaderTimeout)
 	chunked := false
+	var chunkedBody proto.ChunkedBody
+	var chunkedErr error
 	contentLength := -1
 	currentContentLength := 0
 	chunks := 0
+	// Time streaming response is cut at, zero for other responses
+	var streamEnd time.Time
 
 	for {
-		c.conn.SetReadDeadline(timeout)
+		c.conn.SetReadDeadline(c.limit(timeout))
 
 		if readBytes < len(c.respBuf) {
 			n, err = c.conn.Read(c.respBuf[readBytes:])
@@ -318,6 +779,10 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 			// First chunk
 			if chunked || contentLength != -1 {
 				currentContentLength += n
+
+				if chunked {
+					_, chunkedErr = chunkedBody.Parse(c.respBuf[readBytes-n : readBytes])
+				}
 			} else {
 				// If headers are finished
 				var firstEmptyLine = bytes.Index(c.respBuf[:readBytes], proto.EmptyLine)
@@ -328,7 +793,7 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 						status, _ := strconv.Atoi(string(proto.Status(c.respBuf[:readBytes])))
 						// We want to soak up all 100 Continues received to get the real result code
 						if status >= 100 && status < 200 {
-							timeout = time.Now().Add(c.config.Timeout)
+							timeout = time.Now().Add(c.config.ResponseHeaderTimeout)
 							var deleteLen = firstEmptyLine + len(proto.EmptyLine)
 							copy(c.respBuf, c.respBuf[deleteLen:readBytes])
 							readBytes -= deleteLen
@@ -345,13 +810,22 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 						}
 					}
 
-					currentContentLength += len(proto.Body(c.respBuf[:readBytes]))
+					if isStreamingResponse(c.respBuf[:readBytes]) {
+						streamEnd = time.Now().Add(c.config.StreamTimeout)
+					}
+
+					body := proto.Body(c.respBuf[:readBytes])
+					currentContentLength += len(body)
+
+					if chunked {
+						_, chunkedErr = chunkedBody.Parse(body)
+					}
 				}
 			}
 
 			if chunked {
-				// Check if chunked message finished
-				if bytes.HasSuffix(c.respBuf[:readBytes], chunkedSuffix) {
+				// Check if chunked message finished, malformed body is returned as is
+				if chunkedBody.Done() || chunkedErr != nil {
 					break
 				}
 			} else if contentLength != -1 {
@@ -383,7 +857,7 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 
 			if chunked {
 				// Check if chunked message finished
-				if bytes.HasSuffix(currentChunk[:n], chunkedSuffix) {
+				if _, chunkedErr = chunkedBody.Parse(currentChunk[:n]); chunkedBody.Done() || chunkedErr != nil {
 					break
 				}
 			} else if contentLength != -1 {
@@ -409,14 +883,31 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 
 		}
 
-		if readBytes >= maxResponseSize {
-			Debug("[HTTPClient] Body is more than the max size", maxResponseSize,
+		if readBytes >= c.config.MaxResponseRead {
+			Debug("[HTTPClient] Body is more than the max size", c.config.MaxResponseRead,
 				c.baseURL)
+			c.Disconnect()
 			break
 		}
 
-		// For following chunks expect less timeout
-		timeout = time.Now().Add(c.config.Timeout / 5)
+		// For following chunks expect less timeout, streaming response is read until its end time
+		if streamEnd.IsZero() {
+			timeout = time.Now().Add(c.config.Timeout / 5)
+		} else {
+			timeout = streamEnd
+		}
+	}
+
+	// Streaming response is cut, its rest is discarded together with connection
+	if !streamEnd.IsZero() && isTimeout(err) && !c.expired() {
+		Debug("[HTTPClient] Streaming response is read for", c.config.StreamTimeout, c.baseURL)
+		err = nil
+		c.Disconnect()
+	}
+
+	// Response which is not read completely is discarded
+	if err != nil && c.expired() {
+		return c.abandon()
 	}
 
 	if err != nil && readBytes == 0 {
@@ -443,22 +934,23 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 	payload = make([]byte, readBytes)
 	copy(payload, c.respBuf[:readBytes])
 
+	return c.received(data, body, payload, err)
+}
+
+// received handles response to request sent using connection: redirect is followed, and connection is closed after
+// 400 response
+func (c *HTTPClient) received(data []byte, body io.Reader, payload []byte, err error) ([]byte, error) {
 	if c.config.Debug {
 		Debug("[HTTPClient] Received:", string(payload))
 	}
 
-	if c.config.FollowRedirects > 0 && c.redirectsCount < c.config.FollowRedirects {
-		status := payload[9:12]
-
-		// 3xx requests
-		if status[0] == '3' {
+	// Streamed body can't be sent again. Response of the last request is returned, so its status is recorded.
+	if body == nil && c.config.FollowRedirects > 0 && c.redirectsCount < c.config.FollowRedirects {
+		if redirectPayload := redirectRequest(data, payload); redirectPayload != nil {
 			c.redirectsCount++
 
-			location := proto.Header(payload, []byte("Location"))
-			redirectPayload := proto.SetPath(data, location)
-
 			if c.config.Debug {
-				Debug("[HTTPClient] Redirecting to: " + string(location))
+				Debug("[HTTPClient] Redirecting to: " + string(proto.Path(redirectPayload)))
 			}
 
 			return c.Send(redirectPayload)
@@ -475,6 +967,103 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 	return payload, err
 }
 
+// redirectRequest returns request following redirect response, or nil if response is not a redirect which can be
+// followed using connection to the same host. 303 responses, and 301 and 302 responses to POST, are followed with GET
+// request without body, like browsers do.
+func redirectRequest(request, response []byte) []byte {
+	status, _ := strconv.Atoi(string(proto.Status(response)))
+	switch status {
+	case 301, 302, 303, 307, 308:
+	default:
+		return nil
+	}
+
+	location := proto.Header(response, []byte("Location"))
+	if len(location) == 0 {
+		return nil
+	}
+
+	base, err := url.Parse(string(proto.Path(request)))
+	if err != nil {
+		return nil
+	}
+	target, err := base.Parse(string(location))
+	if err != nil {
+		return nil
+	}
+
+	if target.Host != "" && target.Host != base.Host && target.Host != string(proto.Header(request, []byte("Host"))) {
+		return nil
+	}
+
+	redirect := proto.SetPath(request, []byte(target.RequestURI()))
+
+	method := proto.Method(request)
+	if status == 303 && string(method) != "HEAD" || (status == 301 || status == 302) && string(method) == "POST" {
+		redirect = append([]byte("GET"), redirect[len(method):proto.MIMEHeadersEndPos(redirect)]...)
+		redirect = proto.DeleteHeader(redirect, []byte("Content-Length"))
+		redirect = proto.DeleteHeader(redirect, []byte("Transfer-Encoding"))
+	}
+
+	return redirect
+}
+
+// isStreamingResponse reports if response headers announce stream of events, which is not finished by server
+func isStreamingResponse(payload []byte) bool {
+	contentType := proto.Header(payload, []byte("Content-Type"))
+
+	return bytes.HasPrefix(bytes.ToLower(contentType), []byte("text/event-stream"))
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// limit returns the earlier of timeout and deadline of current request
+func (c *HTTPClient) limit(timeout time.Time) time.Time {
+	if !c.deadline.IsZero() && c.deadline.Before(timeout) {
+		return c.deadline
+	}
+
+	return timeout
+}
+
+// expired checks if deadline of current request is exceeded
+func (c *HTTPClient) expired() bool {
+	return !c.deadline.IsZero() && !time.Now().Before(c.deadline)
+}
+
+// abandon closes connection of request which exceeded deadline, its response can't be read anymore
+func (c *HTTPClient) abandon() ([]byte, error) {
+	Debug("[HTTPClient] Request deadline exceeded:", c.baseURL)
+	c.Disconnect()
+	c.redirectsCount = 0
+
+	return errorPayload(HTTP_TIMEOUT), errDeadlineExceeded
+}
+
+// writeBody copies rest of the request to connection, write deadline is extended for each chunk
+func (c *HTTPClient) writeBody(body io.Reader) error {
+	buf := make([]byte, readChunkSize)
+
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			c.conn.SetWriteDeadline(c.limit(time.Now().Add(c.config.Timeout)))
+			if _, werr := c.conn.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
 func (c *HTTPClient) Get(path string) (response []byte, err error) {
 	payload := "GET " + path + " HTTP/1.1\r\n\r\n"
 
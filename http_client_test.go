@@ -1,8 +1,11 @@
-package main
+package goreplay
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
+	"fmt"
+	"io"
 	"io/ioutil"
 	_ "log"
 	"net"
@@ -12,6 +15,7 @@ import (
 	_ "reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -139,6 +143,164 @@ func TestHTTPClientResonseByClose(t *testing.T) {
 	wg.Wait()
 }
 
+func TestHTTPClientChunkedTrailers(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\r\n\r\n")
+	response := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n0\r\nExpires: never\r\n\r\n"
+
+	ln, _ := net.Listen("tcp", ":0")
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 4096)
+		conn.Read(buf)
+
+		// Last chunk is split between reads
+		split := strings.Index(response, "0\r\n") + 2
+		conn.Write([]byte(response[:split]))
+		time.Sleep(10 * time.Millisecond)
+		conn.Write([]byte(response[split:]))
+
+		conn.Read(buf)
+	}()
+
+	client := NewHTTPClient(ln.Addr().String(), &HTTPClientConfig{Timeout: time.Second})
+
+	start := time.Now()
+	resp, _ := client.Send(payload)
+
+	if string(resp) != response {
+		t.Errorf("Should return whole response: %q", resp)
+	}
+
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("Should not wait for read timeout")
+	}
+}
+
+func TestHTTPClientRequestTrailers(t *testing.T) {
+	payload := []byte("POST / HTTP/1.1\r\nHost: www.w3.org\r\nTrailer: Grpc-Status\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n0\r\nGrpc-Status: 0\r\n\r\n")
+
+	for _, compatibilityMode := range []bool{false, true} {
+		ln, _ := net.Listen("tcp", "127.0.0.1:0")
+
+		received := make(chan string, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			// Request is complete when trailers are read
+			var request []byte
+			buf := make([]byte, 4096)
+			for !bytes.HasSuffix(request, []byte("\r\n0\r\nGrpc-Status: 0\r\n\r\n")) {
+				n, err := conn.Read(buf)
+				if err != nil {
+					break
+				}
+				request = append(request, buf[:n]...)
+			}
+			received <- string(request)
+
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+		}()
+
+		client := NewHTTPClient("http://"+ln.Addr().String(), &HTTPClientConfig{Timeout: time.Second, CompatibilityMode: compatibilityMode})
+		client.Send(payload)
+
+		select {
+		case request := <-received:
+			if !strings.Contains(request, "Trailer: Grpc-Status\r\n") || !strings.HasSuffix(request, "\r\n0\r\nGrpc-Status: 0\r\n\r\n") {
+				t.Errorf("Trailers should be sent, compatibility mode %v: %q", compatibilityMode, request)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Request is not received, compatibility mode %v", compatibilityMode)
+		}
+
+		ln.Close()
+	}
+}
+
+func TestHTTPClientHTTP2Trailers(t *testing.T) {
+	payload := []byte("POST /pkg.Service/Method HTTP/1.1\r\nHost: www.w3.org\r\nTE: trailers\r\nTrailer: Grpc-Timeout\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n0\r\nGrpc-Timeout: 1S\r\n\r\n")
+
+	for _, enableHTTP2 := range []bool{true, false} {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Header().Set("X-Proto", r.Proto)
+			w.Write(body)
+			w.Header().Set("Grpc-Status", r.Trailer.Get("Grpc-Timeout"))
+		}))
+		server.EnableHTTP2 = enableHTTP2
+		server.StartTLS()
+
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, HTTP2: true})
+
+		// Server which does not support HTTP/2 is sent HTTP/1.1 requests
+		proto := "HTTP/1.1"
+		if enableHTTP2 {
+			proto = "HTTP/2.0"
+		}
+
+		for i := 0; i < 2; i++ {
+			resp, err := client.Send(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Names of HTTP/2 fields are lowercase
+			response := strings.ToLower(string(resp))
+			if !strings.Contains(response, "\r\nx-proto: "+strings.ToLower(proto)+"\r\n") {
+				t.Errorf("Request should be sent using %s: %q", proto, resp)
+			}
+			if !strings.HasSuffix(response, "\r\n4\r\nwiki\r\n0\r\ngrpc-status: 1s\r\n\r\n") {
+				t.Errorf("Trailers should be sent and received using %s: %q", proto, resp)
+			}
+		}
+
+		server.Close()
+	}
+}
+
+func TestHTTPClientHTTP3Fallback(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	// Server does not listen on UDP port, so QUIC handshake fails and requests are sent over TCP
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, HTTP2: true, HTTP3: true})
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Send([]byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(strings.ToLower(string(resp)), "\r\nx-proto: http/2.0\r\n") {
+			t.Errorf("Request should be sent using HTTP/2: %q", resp)
+		}
+		if client.protocol != "h2" {
+			t.Errorf("Expected protocol h2, got %q", client.protocol)
+		}
+	}
+
+	if client.h3FailedAt.IsZero() {
+		t.Error("Failed QUIC handshake should be recorded")
+	}
+}
+
 // https://github.com/buger/gor/issues/184
 func TestHTTPClientResponseBuffer(t *testing.T) {
 	testCases := []struct {
@@ -321,6 +483,46 @@ func TestHTTPClientServerNoKeepAlive(t *testing.T) {
 	wg.Wait()
 }
 
+func TestHTTPClientResolve(t *testing.T) {
+	blue, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blue.Close()
+
+	_, port, _ := net.SplitHostPort(blue.Addr().String())
+	green, err := net.Listen("tcp", "127.0.0.2:"+port)
+	if err != nil {
+		t.Skip("Can't listen on 127.0.0.2:", err)
+	}
+	defer green.Close()
+
+	for name, ln := range map[string]net.Listener{"blue": blue, "green": green} {
+		name := name
+		go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host != "app.test:"+port {
+				t.Error("Host header should not be changed", r.Host)
+			}
+			w.Write([]byte(name))
+		}))
+	}
+
+	resolve := map[string]string{"app.test": "127.0.0.1"}
+	client := NewHTTPClient("http://app.test:"+port, &HTTPClientConfig{Resolve: resolve, ResolveInterval: time.Nanosecond})
+
+	for _, expected := range []string{"blue", "blue", "green"} {
+		// Target is switched after the second request
+		if expected == "green" {
+			resolve["app.test"] = "127.0.0.2"
+		}
+
+		resp, err := client.Get("/")
+		if err != nil || !bytes.HasSuffix(resp, []byte(expected)) {
+			t.Errorf("Expected response of %s, got %q %v", expected, resp, err)
+		}
+	}
+}
+
 func TestHTTPClientRedirect(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
@@ -377,6 +579,46 @@ func TestHTTPClientRedirectLimit(t *testing.T) {
 	wg.Wait()
 }
 
+func TestHTTPClientRedirectFinalStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/form":
+			http.Redirect(w, r, "http://"+r.Host+"/done?id=1", 303)
+		case "/done":
+			if r.Method != "GET" || r.ContentLength > 0 {
+				t.Errorf("Expected GET request without body, got %s with %d bytes", r.Method, r.ContentLength)
+			}
+			w.WriteHeader(201)
+		case "/external":
+			http.Redirect(w, r, "http://example.com/", 302)
+		}
+	}))
+	defer server.Close()
+
+	for _, compat := range []bool{false, true} {
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{FollowRedirects: 2, CompatibilityMode: compat})
+
+		resp, err := client.Send([]byte("POST /form HTTP/1.1\r\nContent-Length: 4\r\n\r\nname"))
+		if err != nil || !bytes.Equal(proto.Status(resp), []byte("201")) {
+			t.Errorf("Expected status of the last request, got %q %v", resp, err)
+		}
+
+		if compat {
+			continue
+		}
+
+		resp, err = client.Get("/external")
+		if err != nil || !bytes.Equal(proto.Status(resp), []byte("302")) {
+			t.Errorf("Redirect to other host should not be followed, got %q %v", resp, err)
+		}
+	}
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{CompatibilityMode: true})
+	if resp, err := client.Get("/form"); err != nil || !bytes.Equal(proto.Status(resp), []byte("303")) {
+		t.Errorf("Redirects should not be followed by default, got %q %v", resp, err)
+	}
+}
+
 func TestHTTPClientKeepHeadersRedirect(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
@@ -531,3 +773,230 @@ func TestHTTPClientErrors(t *testing.T) {
 		t.Error("Should throw error")
 	}
 }
+
+func TestHTTPClientProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var connections int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				header := make([]byte, 16)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				if !bytes.Equal(header[:12], proxyProtocolSignature) {
+					t.Errorf("Expected PROXY protocol signature, got %q", header)
+					return
+				}
+				addrs := make([]byte, int(header[14])<<8|int(header[15]))
+				io.ReadFull(conn, addrs)
+
+				// Client address is returned in response
+				client := "local"
+				if header[12] == 0x21 && header[13] == 0x11 {
+					client = fmt.Sprintf("%s:%d", net.IP(addrs[:4]), int(addrs[8])<<8|int(addrs[9]))
+				}
+
+				br := bufio.NewReader(conn)
+				for {
+					if _, err := http.ReadRequest(br); err != nil {
+						return
+					}
+					fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(client), client)
+				}
+			}(conn)
+		}
+	}()
+
+	client := NewHTTPClient(ln.Addr().String(), &HTTPClientConfig{ProxyProtocol: true})
+
+	for i, addr := range []string{"", "10.0.0.1:5000", "10.0.0.1:5000", "10.0.0.2:6000"} {
+		client.SetClientAddr(addr)
+
+		expected := addr
+		if addr == "" {
+			expected = "local"
+		}
+
+		resp, err := client.Get("/")
+		if err != nil || !bytes.HasSuffix(resp, []byte(expected)) {
+			t.Errorf("%d: Expected response for %s, got %q %v", i, expected, resp, err)
+		}
+	}
+
+	// Connection is reused by requests of the same client
+	if n := atomic.LoadInt32(&connections); n != 3 {
+		t.Errorf("Expected 3 connections, got %d", n)
+	}
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 443}
+
+	header := proxyProtocolHeader("10.0.0.1:5000", dst)
+	expected := append(append([]byte{}, proxyProtocolSignature...), 0x21, 0x11, 0, 12, 10, 0, 0, 1, 192, 168, 0, 1, 0x13, 0x88, 0x01, 0xbb)
+	if !bytes.Equal(header, expected) {
+		t.Errorf("Expected %v, got %v", expected, header)
+	}
+
+	// IPv4 address is mapped to IPv6 if the other one is IPv6
+	header = proxyProtocolHeader("[2001:db8::1]:5000", dst)
+	if header[13] != 0x21 || len(header) != 16+36 || !net.IP(header[32:48]).Equal(dst.IP) {
+		t.Errorf("Expected TCP over IPv6 header, got %v", header)
+	}
+
+	header = proxyProtocolHeader("", dst)
+	if !bytes.Equal(header[12:], []byte{0x20, 0, 0, 0}) {
+		t.Errorf("Expected LOCAL command, got %v", header[12:])
+	}
+}
+
+func TestHTTPClientHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer server.Close()
+
+	for _, compat := range []bool{false, true} {
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{Host: "www.example.com", CompatibilityMode: compat})
+
+		resp, err := client.Send([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		if err != nil || !bytes.HasSuffix(resp, []byte("\r\n\r\nwww.example.com")) {
+			t.Errorf("Expected custom Host header, got %q %v", resp, err)
+		}
+	}
+}
+
+func TestHTTPClientServerName(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.ServerName))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	target := "https://localhost:" + port
+
+	client := NewHTTPClient(target, &HTTPClientConfig{})
+	if resp, err := client.Get("/"); err != nil || !bytes.HasSuffix(resp, []byte("\r\n\r\nlocalhost")) {
+		t.Errorf("Expected target host name, got %q %v", resp, err)
+	}
+
+	client = NewHTTPClient(target, &HTTPClientConfig{ServerName: "api.example.com", OriginalHost: true})
+	if resp, err := client.Send([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != nil || !bytes.HasSuffix(resp, []byte("api.example.com")) {
+		t.Errorf("Expected custom server name, got %q %v", resp, err)
+	}
+
+	atomic.StoreInt32(&connections, 0)
+	client = NewHTTPClient(target, &HTTPClientConfig{ServerName: OriginalServerName, OriginalHost: true})
+	for _, host := range []string{"a.example.com", "a.example.com:443", "b.example.com"} {
+		resp, err := client.Send([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		if err != nil || !bytes.HasSuffix(resp, []byte(host[:13])) {
+			t.Errorf("Expected server name of %s, got %q %v", host, resp, err)
+		}
+	}
+
+	// Connection is reconnected only when host changes
+	if n := atomic.LoadInt32(&connections); n != 2 {
+		t.Errorf("Expected 2 connections, got %d", n)
+	}
+}
+
+func TestHTTPClientTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, ResponseHeaderTimeout: 50 * time.Millisecond})
+	resp, err := client.Get("/")
+	if err == nil || err == errDeadlineExceeded || !bytes.Equal(proto.Status(resp), []byte(HTTP_TIMEOUT)) {
+		t.Errorf("Expected response header timeout, got %q %v", resp, err)
+	}
+
+	for _, compat := range []bool{false, true} {
+		client = NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, Deadline: 50 * time.Millisecond, CompatibilityMode: compat})
+
+		start := time.Now()
+		resp, err = client.Get("/")
+		if err != errDeadlineExceeded || !bytes.Equal(proto.Status(resp), []byte(HTTP_TIMEOUT)) {
+			t.Errorf("Expected request to be abandoned, got %q %v", resp, err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+			t.Error("Request should be abandoned after deadline, took", elapsed)
+		}
+	}
+
+	client = NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, Deadline: time.Second})
+	if resp, err = client.Get("/"); err != nil || !bytes.Equal(proto.Status(resp), []byte("200")) {
+		t.Errorf("Expected response within deadline, got %q %v", resp, err)
+	}
+}
+
+func TestHTTPClientStreamingResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			for i := 0; i < 16; i++ {
+				w.Write(make([]byte, 1024))
+				w.(http.Flusher).Flush()
+				time.Sleep(10 * time.Millisecond)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			if _, err := w.Write([]byte("data: ping\n\n")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, StreamTimeout: 100 * time.Millisecond})
+
+	start := time.Now()
+	resp, err := client.Get("/")
+	if err != nil || !bytes.Equal(proto.Status(resp), []byte("200")) || !bytes.Contains(resp, []byte("data: ping")) {
+		t.Errorf("Expected first events of stream, got %q %v", resp, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("Stream should be read until stream timeout, took", elapsed)
+	}
+
+	if client.conn != nil {
+		t.Error("Connection with unfinished response should be closed")
+	}
+
+	client = NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, ResponseBufferSize: 1024, MaxResponseRead: 4096})
+	if resp, err = client.Get("/large"); err != nil || len(resp) != 1024 || client.conn != nil {
+		t.Errorf("Expected response cut after max read, got %d bytes %v", len(resp), err)
+	}
+
+	if resp, err = client.Get("/"); err != nil || !bytes.Equal(proto.Status(resp), []byte("200")) {
+		t.Errorf("Expected client to reconnect, got %q %v", resp, err)
+	}
+}
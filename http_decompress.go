@@ -0,0 +1,164 @@
+package goreplay
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Header set to original Content-Encoding of decompressed body, so it can be compressed again by
+// --output-http-recompress
+var decompressedEncodingHeader = []byte("X-Gor-Content-Encoding")
+
+var errDecompressedTooLarge = errors.New("decompressed body is larger than --copy-buffer-size")
+
+// Number of bodies passed compressed because their Content-Encoding, e.g. br, can't be decoded, and encodings which
+// were already logged
+var (
+	undecodedBodies    uint64
+	undecodedEncodings sync.Map
+)
+
+// decompressHTTP decodes gzip and deflate bodies of requests and responses for --http-decompress. Content-Encoding
+// is replaced by decompressedEncodingHeader, and chunked bodies are decoded like with --prettify-http. Payload is
+// returned as is if it is not compressed, or it can't be decompressed. Bodies with other encodings, like br, are
+// counted in undecodedBodies, and the first of each encoding is logged.
+func decompressHTTP(p []byte) []byte {
+	headSize := bytes.IndexByte(p, '\n') + 1
+	body := p[headSize:]
+	if !proto.IsHTTPPayload(body) && !bytes.HasPrefix(body, []byte("HTTP/")) {
+		return p
+	}
+
+	headersPos := proto.MIMEHeadersEndPos(body)
+	if headersPos < 5 || headersPos > len(body) {
+		return p
+	}
+
+	encoding := bytes.ToLower(bytes.TrimSpace(proto.Header(body[:headersPos], []byte("Content-Encoding"))))
+	switch string(encoding) {
+	case "gzip", "x-gzip", "deflate":
+	case "", "identity":
+		return p
+	default:
+		atomic.AddUint64(&undecodedBodies, 1)
+		if _, logged := undecodedEncodings.LoadOrStore(string(encoding), true); !logged {
+			log.Printf("[DECOMPRESS] Can't decode %s bodies, they are passed compressed\n", encoding)
+		}
+		return p
+	}
+
+	headers := append([]byte(nil), body[:headersPos]...)
+	content := body[headersPos:]
+
+	if bytes.Equal(proto.Header(headers, []byte("Transfer-Encoding")), []byte("chunked")) {
+		decoded, trailers, err := proto.DecodeChunked(content)
+		if err != nil {
+			Debug("[DECOMPRESS] Chunked encoding error:", err)
+			return p
+		}
+		content = decoded
+
+		headers = proto.DeleteHeader(headers, []byte("Transfer-Encoding"))
+		if len(trailers) > 0 {
+			headers = proto.DeleteHeader(headers, []byte("Trailer"))
+			headers = append(append(headers[:len(headers)-2:len(headers)-2], trailers...), proto.CLRF...)
+		}
+	}
+
+	content, err := decodeContent(string(encoding), content)
+	if err != nil {
+		Debug("[DECOMPRESS] Can't decode", string(encoding), "body:", err)
+		return p
+	}
+
+	headers = proto.DeleteHeader(headers, []byte("Content-Encoding"))
+	headers = proto.SetHeader(headers, decompressedEncodingHeader, encoding)
+	headers = proto.SetHeader(headers, []byte("Content-Length"), []byte(strconv.Itoa(len(content))))
+
+	payload := make([]byte, 0, headSize+len(headers)+len(content))
+	payload = append(payload, p[:headSize]...)
+	payload = append(payload, headers...)
+	return append(payload, content...)
+}
+
+// decodeContent decompresses body with given Content-Encoding, up to --copy-buffer-size, so bodies which are
+// compressed very well can't use all memory
+func decodeContent(encoding string, content []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(content))
+	case "deflate":
+		// Deflate bodies should have zlib wrapper, but some servers send raw deflate stream
+		if r, err = zlib.NewReader(bytes.NewReader(content)); err != nil {
+			r, err = flate.NewReader(bytes.NewReader(content)), nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	limit := Settings.copyBufferSize
+	if limit <= 0 {
+		limit = 5 << 20
+	}
+
+	decoded, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > limit {
+		return nil, errDecompressedTooLarge
+	}
+
+	return decoded, nil
+}
+
+// writeDecompressMetrics writes number of bodies --http-decompress can't decode in Prometheus text format
+func writeDecompressMetrics(out io.Writer) {
+	fmt.Fprintln(out, "# HELP gor_http_decompress_undecoded_total Bodies passed compressed by --http-decompress because their Content-Encoding, like br, is not supported.")
+	fmt.Fprintln(out, "# TYPE gor_http_decompress_undecoded_total counter")
+	fmt.Fprintf(out, "gor_http_decompress_undecoded_total %d\n", atomic.LoadUint64(&undecodedBodies))
+}
+
+// recompressHTTP compresses body of request decompressed by --http-decompress again, with its original encoding,
+// before it is replayed by --output-http-recompress
+func recompressHTTP(payload []byte) []byte {
+	encoding := proto.Header(payload, decompressedEncodingHeader)
+	if len(encoding) == 0 {
+		return payload
+	}
+
+	headersPos := proto.MIMEHeadersEndPos(payload)
+	content := payload[headersPos:]
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if bytes.Equal(encoding, []byte("deflate")) {
+		w = zlib.NewWriter(&buf)
+	} else {
+		w = gzip.NewWriter(&buf)
+	}
+	w.Write(content)
+	w.Close()
+
+	headers := append([]byte(nil), payload[:headersPos]...)
+	headers = proto.DeleteHeader(headers, decompressedEncodingHeader)
+	headers = proto.SetHeader(headers, []byte("Content-Encoding"), encoding)
+	headers = proto.SetHeader(headers, []byte("Content-Length"), []byte(strconv.Itoa(buf.Len())))
+
+	return append(headers, buf.Bytes()...)
+}
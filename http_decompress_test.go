@@ -0,0 +1,92 @@
+package goreplay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestHTTPDecompressGzip(t *testing.T) {
+	b := bytes.NewBufferString("")
+	w := gzip.NewWriter(b)
+	w.Write([]byte("test"))
+	w.Close()
+
+	payload := []byte("2 1 1\nHTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n" + strconv.FormatInt(int64(b.Len()), 16) + "\r\n")
+	payload = append(payload, b.Bytes()...)
+	payload = append(payload, "\r\n0\r\n\r\n"...)
+
+	newPayload := decompressHTTP(payload)
+
+	if string(newPayload) != "2 1 1\nHTTP/1.1 200 OK\r\nContent-Length: 4\r\nX-Gor-Content-Encoding: gzip\r\n\r\ntest" {
+		t.Error("Payload not match:", string(newPayload))
+	}
+}
+
+func TestHTTPDecompressDeflate(t *testing.T) {
+	b := bytes.NewBufferString("")
+	w := zlib.NewWriter(b)
+	w.Write([]byte("a=1&b=2"))
+	w.Close()
+
+	payload := []byte("1 1 1\nPOST / HTTP/1.1\r\nContent-Encoding: deflate\r\nContent-Length: " + strconv.Itoa(b.Len()) + "\r\n\r\n")
+	payload = append(payload, b.Bytes()...)
+
+	newPayload := decompressHTTP(payload)
+	if string(proto.Body(payloadBody(newPayload))) != "a=1&b=2" {
+		t.Fatal("Payload not match:", string(newPayload))
+	}
+
+	// Replayed request is compressed with the original encoding
+	recompressed := recompressHTTP(payloadBody(newPayload))
+	if string(proto.Header(recompressed, []byte("Content-Encoding"))) != "deflate" || len(proto.Header(recompressed, decompressedEncodingHeader)) > 0 {
+		t.Fatal("Content-Encoding should be restored:", string(recompressed))
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(proto.Body(recompressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded bytes.Buffer
+	decoded.ReadFrom(r)
+	if decoded.String() != "a=1&b=2" {
+		t.Error("Body should be compressed again:", decoded.String())
+	}
+}
+
+func TestHTTPDecompressInvalid(t *testing.T) {
+	for _, payload := range [][]byte{
+		[]byte("1 1 1\nPOST / HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc"),
+		[]byte("1 1 1\nPOST / HTTP/1.1\r\nContent-Encoding: gzip\r\nContent-Length: 3\r\n\r\nabc"),
+		[]byte("1 1 1\nPOST / HTTP/1.1\r\nContent-Encoding: br\r\nContent-Length: 3\r\n\r\nabc"),
+	} {
+		if newPayload := decompressHTTP(payload); !bytes.Equal(newPayload, payload) {
+			t.Error("Payload should not be changed:", string(newPayload))
+		}
+	}
+}
+
+func TestHTTPDecompressUnsupported(t *testing.T) {
+	undecoded := atomic.LoadUint64(&undecodedBodies)
+
+	decompressHTTP([]byte("1 1 1\nPOST / HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc"))
+	decompressHTTP([]byte("1 1 1\nPOST / HTTP/1.1\r\nContent-Encoding: identity\r\nContent-Length: 3\r\n\r\nabc"))
+	decompressHTTP([]byte("1 1 1\nPOST / HTTP/1.1\r\nContent-Encoding: br\r\nContent-Length: 3\r\n\r\nabc"))
+	decompressHTTP([]byte("1 1 1\nHTTP/1.1 200 OK\r\nContent-Encoding: br\r\nContent-Length: 3\r\n\r\nabc"))
+
+	if n := atomic.LoadUint64(&undecodedBodies) - undecoded; n != 2 {
+		t.Error("Brotli bodies should be counted as undecoded, got", n)
+	}
+
+	var metrics bytes.Buffer
+	writeDecompressMetrics(&metrics)
+	if !strings.Contains(metrics.String(), "\ngor_http_decompress_undecoded_total ") {
+		t.Error("Undecoded bodies should be exposed as metric:", metrics.String())
+	}
+}
@@ -1,9 +1,12 @@
-package main
+package goreplay
 
 import (
 	"bytes"
 	"encoding/base64"
 	"hash/fnv"
+	"math/rand"
+	"net"
+	"strconv"
 	"strings"
 
 	"github.com/buger/goreplay/proto"
@@ -24,6 +27,21 @@ func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
 		len(config.headerBasicAuthFilters) == 0 &&
 		len(config.headerHashFilters) == 0 &&
 		len(config.paramHashFilters) == 0 &&
+		len(config.graphQLOperations) == 0 &&
+		len(config.graphQLNegativeOperations) == 0 &&
+		len(config.graphQLLimiters) == 0 &&
+		len(config.xmlFilters) == 0 &&
+		len(config.xmlNegativeFilters) == 0 &&
+		len(config.xmlRewrite) == 0 &&
+		len(config.multipartDrop) == 0 &&
+		len(config.multipartReplace) == 0 &&
+		len(config.ipFilters) == 0 &&
+		len(config.ipNegativeFilters) == 0 &&
+		len(config.userAgentFilters) == 0 &&
+		len(config.userAgentNegativeFilters) == 0 &&
+		!config.disallowBots &&
+		config.maxBodySize == 0 &&
+		config.truncateBodySize == 0 &&
 		len(config.params) == 0 &&
 		len(config.headers) == 0 &&
 		len(config.methods) == 0 {
@@ -33,11 +51,37 @@ func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
 	return &HTTPModifier{config: config}
 }
 
+// AllowClient tells if request sent by client with given address, host and port, passes --http-allow-ip and
+// --http-disallow-ip filters. Requests without client address are dropped only by allow filters.
+func (m *HTTPModifier) AllowClient(addr []byte) bool {
+	if len(m.config.ipFilters) == 0 && len(m.config.ipNegativeFilters) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		host = string(addr)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return len(m.config.ipFilters) == 0
+	}
+
+	if len(m.config.ipFilters) > 0 && !m.config.ipFilters.Contains(ip) {
+		return false
+	}
+	return !m.config.ipNegativeFilters.Contains(ip)
+}
+
 func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 	if !proto.IsHTTPPayload(payload) {
 		return payload
 	}
 
+	if m.config.maxBodySize > 0 && requestBodySize(payload) > m.config.maxBodySize {
+		return
+	}
+
 	if len(m.config.methods) > 0 {
 		method := proto.Method(payload)
 
@@ -165,6 +209,72 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 	}
 
+	if len(m.config.userAgentFilters) > 0 || len(m.config.userAgentNegativeFilters) > 0 || m.config.disallowBots {
+		if !m.allowUserAgent(payload) {
+			return
+		}
+	}
+
+	// GraphQL filters apply only to GraphQL requests, other requests are passed
+	if len(m.config.graphQLOperations) > 0 || len(m.config.graphQLNegativeOperations) > 0 || len(m.config.graphQLLimiters) > 0 {
+		if operation := graphQLOperation(payload); operation != "" {
+			if len(m.config.graphQLOperations) > 0 {
+				matched := false
+
+				for _, f := range m.config.graphQLOperations {
+					if f.regexp.MatchString(operation) {
+						matched = true
+						break
+					}
+				}
+
+				if !matched {
+					return
+				}
+			}
+
+			for _, f := range m.config.graphQLNegativeOperations {
+				if f.regexp.MatchString(operation) {
+					return
+				}
+			}
+
+			for _, f := range m.config.graphQLLimiters {
+				if f.regexp.MatchString(operation) {
+					if rand.Intn(100) >= f.percent {
+						return
+					}
+					break
+				}
+			}
+		}
+	}
+
+	// XML filters and rewrites apply only to requests with XML body, like SOAP requests
+	if len(m.config.xmlFilters) > 0 || len(m.config.xmlNegativeFilters) > 0 || len(m.config.xmlRewrite) > 0 {
+		if isXMLRequest(payload) {
+			for _, f := range m.config.xmlFilters {
+				if !xmlFilterMatch(payload, f) {
+					return
+				}
+			}
+
+			for _, f := range m.config.xmlNegativeFilters {
+				if xmlFilterMatch(payload, f) {
+					return
+				}
+			}
+
+			for _, r := range m.config.xmlRewrite {
+				payload = rewriteXML(payload, r)
+			}
+		}
+	}
+
+	if len(m.config.multipartDrop) > 0 || len(m.config.multipartReplace) > 0 {
+		payload = m.rewriteMultipart(payload)
+	}
+
 	if len(m.config.urlRewrite) > 0 {
 		path := proto.Path(payload)
 
@@ -192,5 +302,62 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 	}
 
+	if m.config.truncateBodySize > 0 {
+		payload = truncateBody(payload, m.config.truncateBodySize)
+	}
+
 	return payload
 }
+
+// BodyTruncated tells if body of request was truncated by --http-truncate-body, so following chunks of request,
+// which are beyond the limit, should be dropped
+func (m *HTTPModifier) BodyTruncated(payload []byte) bool {
+	remaining, ok := m.BodyRemaining(payload)
+	return ok && remaining <= 0
+}
+
+// BodyRemaining returns number of body bytes which can follow the first chunk of request split into chunks, before
+// its body reaches size of --http-truncate-body, and false if body of request is not truncated
+func (m *HTTPModifier) BodyRemaining(payload []byte) (int, bool) {
+	if m.config.truncateBodySize == 0 || len(proto.Header(payload, []byte("Transfer-Encoding"))) > 0 {
+		return 0, false
+	}
+
+	return m.config.truncateBodySize - len(proto.Body(payload)), true
+}
+
+// requestBodySize returns size of body given by Content-Length, so size of request split into chunks is known from
+// its first chunk, or size of captured body
+func requestBodySize(payload []byte) int {
+	if size, err := strconv.Atoi(string(proto.Header(payload, []byte("Content-Length")))); err == nil {
+		return size
+	}
+
+	return len(proto.Body(payload))
+}
+
+// truncateBody cuts body of request to given size, and sets Content-Length to it. Chunked bodies are not truncated,
+// as chunked encoding would be broken. Body of the first chunk of large request can be shorter than size, it is
+// kept, and following chunks are cut by emitter, see BodyRemaining.
+func truncateBody(payload []byte, size int) []byte {
+	if len(proto.Header(payload, []byte("Transfer-Encoding"))) > 0 || requestBodySize(payload) <= size {
+		return payload
+	}
+
+	body := proto.Body(payload)
+	if len(body) > size {
+		body = body[:size]
+	}
+
+	return proto.SetHeader(replaceBody(payload, body), []byte("Content-Length"), []byte(strconv.Itoa(size)))
+}
+
+// replaceBody returns request with given body, Content-Length is updated if request has it
+func replaceBody(payload, body []byte) []byte {
+	headers := append([]byte(nil), payload[:proto.MIMEHeadersEndPos(payload)]...)
+	if len(proto.Header(headers, []byte("Content-Length"))) > 0 {
+		headers = proto.SetHeader(headers, []byte("Content-Length"), []byte(strconv.Itoa(len(body))))
+	}
+
+	return append(headers, body...)
+}
@@ -0,0 +1,130 @@
+package goreplay
+
+import (
+	"bytes"
+	"mime"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// multipartBoundary returns boundary of request with multipart/form-data body, which is not chunked
+func multipartBoundary(payload []byte) []byte {
+	if len(proto.Header(payload, []byte("Transfer-Encoding"))) > 0 {
+		return nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(string(proto.Header(payload, []byte("Content-Type"))))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil
+	}
+
+	return []byte(params["boundary"])
+}
+
+// multipartPartName returns form field name of part, given by Content-Disposition header in part headers
+func multipartPartName(headers []byte) string {
+	for _, line := range bytes.Split(headers, proto.CLRF) {
+		i := bytes.IndexByte(line, ':')
+		if i == -1 || !bytes.EqualFold(bytes.TrimSpace(line[:i]), []byte("Content-Disposition")) {
+			continue
+		}
+
+		_, params, err := mime.ParseMediaType(string(bytes.TrimSpace(line[i+1:])))
+		if err != nil {
+			return ""
+		}
+		return params["name"]
+	}
+
+	return ""
+}
+
+// rewriteMultipart drops and replaces parts of multipart/form-data request by their field names. Parts are copied
+// as is, with their headers and delimiters, so encoding stays valid, and Content-Length is updated. Request is not
+// changed if its body is not complete, e.g. it is the first chunk of large upload.
+func (m *HTTPModifier) rewriteMultipart(payload []byte) []byte {
+	boundary := multipartBoundary(payload)
+	if boundary == nil {
+		return payload
+	}
+
+	body := proto.Body(payload)
+	delim := append([]byte("--"), boundary...)
+	nextDelim := append([]byte("\r\n"), delim...)
+
+	pos := 0
+	if !bytes.HasPrefix(body, delim) {
+		if pos = bytes.Index(body, nextDelim); pos == -1 {
+			return payload
+		}
+		pos += 2
+	}
+
+	rewritten := bytes.NewBuffer(make([]byte, 0, len(body)))
+	// Preamble is kept
+	rewritten.Write(body[:pos])
+	changed := false
+
+	for {
+		after := pos + len(delim)
+		if after > len(body) {
+			return payload
+		}
+
+		// The last delimiter and epilogue
+		if bytes.HasPrefix(body[after:], []byte("--")) {
+			rewritten.Write(body[pos:])
+			break
+		}
+
+		next := bytes.Index(body[after:], nextDelim)
+		if next == -1 {
+			return payload
+		}
+		end := after + next
+		part := body[pos:end]
+		pos = end + 2
+
+		headersStart := bytes.Index(part, proto.CLRF) + 2
+		headersEnd := bytes.Index(part, proto.EmptyLine)
+		if headersStart < 2 || headersEnd < headersStart {
+			rewritten.Write(part)
+			rewritten.Write(proto.CLRF)
+			continue
+		}
+		name := multipartPartName(part[headersStart:headersEnd])
+
+		dropped := false
+		for _, f := range m.config.multipartDrop {
+			if f.regexp.MatchString(name) {
+				dropped = true
+				break
+			}
+		}
+		if dropped {
+			changed = true
+			continue
+		}
+
+		replaced := false
+		for _, r := range m.config.multipartReplace {
+			if r.name.MatchString(name) {
+				rewritten.Write(part[:headersEnd+len(proto.EmptyLine)])
+				rewritten.Write(r.content)
+				replaced = true
+				changed = true
+				break
+			}
+		}
+		if !replaced {
+			rewritten.Write(part)
+		}
+		rewritten.Write(proto.CLRF)
+	}
+
+	if !changed {
+		return payload
+	}
+
+	return replaceBody(payload, rewritten.Bytes())
+}
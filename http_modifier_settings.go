@@ -1,8 +1,10 @@
-package main
+package goreplay
 
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"regexp"
 	"strconv"
 	"strings"
@@ -20,6 +22,28 @@ type HTTPModifierConfig struct {
 	headerHashFilters      HTTPHashFilters
 	paramHashFilters       HTTPHashFilters
 
+	graphQLOperations         HTTPUrlRegexp
+	graphQLNegativeOperations HTTPUrlRegexp
+	graphQLLimiters           HTTPGraphQLLimiters
+
+	xmlFilters         HTTPXMLFilters
+	xmlNegativeFilters HTTPXMLFilters
+	xmlRewrite         HTTPXMLRewrite
+
+	multipartDrop    HTTPUrlRegexp
+	multipartReplace HTTPMultipartReplace
+
+	ipFilters         HTTPIPFilters
+	ipNegativeFilters HTTPIPFilters
+
+	userAgentFilters         HTTPUrlRegexp
+	userAgentNegativeFilters HTTPUrlRegexp
+	disallowBots             bool
+
+	// Requests with larger bodies are dropped, or their bodies are truncated, 0 if not limited
+	maxBodySize      int
+	truncateBodySize int
+
 	params  HTTPParams
 	headers HTTPHeaders
 	methods HTTPMethods
@@ -279,3 +303,197 @@ func (r *HTTPUrlRegexp) Set(value string) error {
 
 	return err
 }
+
+//
+// Handling of --http-graphql-limiter option
+//
+type graphQLLimiter struct {
+	regexp  *regexp.Regexp
+	percent int
+}
+
+// HTTPGraphQLLimiters holds regexps of GraphQL operations and percent of their requests to keep
+type HTTPGraphQLLimiters []graphQLLimiter
+
+func (l *HTTPGraphQLLimiters) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *HTTPGraphQLLimiters) Set(value string) error {
+	// Regexp can contain colons, so percent is after the last one
+	i := strings.LastIndexByte(value, ':')
+	if i == -1 || !strings.HasSuffix(value, "%") {
+		return errors.New("need both operation regexp and percent, colon-delimited (ex. ^query Search$:10%)")
+	}
+
+	percent, err := strconv.Atoi(strings.TrimSpace(value[i+1 : len(value)-1]))
+	if err != nil || percent < 0 || percent > 100 {
+		return errors.New("percent should be between 0% and 100%")
+	}
+
+	r, err := regexp.Compile(value[:i])
+	if err != nil {
+		return err
+	}
+
+	*l = append(*l, graphQLLimiter{regexp: r, percent: percent})
+
+	return nil
+}
+
+//
+// Handling of --http-allow-xml and --http-disallow-xml options
+//
+type xmlFilter struct {
+	path xmlPath
+	// Filter matches SOAP action instead of element text
+	soapAction bool
+	regexp     *regexp.Regexp
+}
+
+// HTTPXMLFilters holds list of XML element paths and regexps of their text
+type HTTPXMLFilters []xmlFilter
+
+func (h *HTTPXMLFilters) String() string {
+	return fmt.Sprint(*h)
+}
+
+func (h *HTTPXMLFilters) Set(value string) error {
+	valArr := strings.SplitN(value, ":", 2)
+	if len(valArr) < 2 {
+		return errors.New("need both element path or SOAPAction and value, colon-delimited (ex. GetQuote/Symbol:^MSFT$)")
+	}
+
+	r, err := regexp.Compile(strings.TrimSpace(valArr[1]))
+	if err != nil {
+		return err
+	}
+
+	f := xmlFilter{regexp: r}
+	if strings.EqualFold(valArr[0], "SOAPAction") {
+		f.soapAction = true
+	} else {
+		f.path = parseXMLPath(valArr[0])
+	}
+
+	*h = append(*h, f)
+
+	return nil
+}
+
+//
+// Handling of --http-rewrite-xml option
+//
+type xmlRewrite struct {
+	path   xmlPath
+	src    *regexp.Regexp
+	target []byte
+}
+
+// HTTPXMLRewrite holds list of XML element paths and rewrites of their text
+type HTTPXMLRewrite []xmlRewrite
+
+func (r *HTTPXMLRewrite) String() string {
+	return fmt.Sprint(*r)
+}
+
+func (r *HTTPXMLRewrite) Set(value string) error {
+	pathArr := strings.SplitN(value, ":", 2)
+	if len(pathArr) < 2 {
+		return errors.New("need element path, regexp and rewrite target, colon-delimited (ex. GetQuote/Symbol: regexp,target)")
+	}
+
+	valArr := strings.SplitN(strings.TrimSpace(pathArr[1]), ",", 2)
+	if len(valArr) < 2 {
+		return errors.New("need element path, regexp and rewrite target, colon-delimited (ex. GetQuote/Symbol: regexp,target)")
+	}
+
+	regexp, err := regexp.Compile(valArr[0])
+	if err != nil {
+		return err
+	}
+	*r = append(*r, xmlRewrite{path: parseXMLPath(pathArr[0]), src: regexp, target: []byte(valArr[1])})
+	return nil
+}
+
+//
+// Handling of --http-replace-multipart-part option
+//
+type multipartReplace struct {
+	name    *regexp.Regexp
+	file    string
+	content []byte
+}
+
+// HTTPMultipartReplace holds regexps of form field names, and fixtures replacing content of their parts
+type HTTPMultipartReplace []multipartReplace
+
+func (r *HTTPMultipartReplace) String() string {
+	return fmt.Sprint(*r)
+}
+
+func (r *HTTPMultipartReplace) Set(value string) error {
+	valArr := strings.SplitN(value, ":", 2)
+	if len(valArr) < 2 {
+		return errors.New("need both field name regexp and fixture file, colon-delimited (ex. ^avatar$:fixtures/avatar.png)")
+	}
+
+	name, err := regexp.Compile(valArr[0])
+	if err != nil {
+		return err
+	}
+
+	file := strings.TrimSpace(valArr[1])
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	*r = append(*r, multipartReplace{name: name, file: file, content: content})
+	return nil
+}
+
+//
+// Handling of --http-allow-ip and --http-disallow-ip options
+//
+
+// HTTPIPFilters holds networks of client addresses
+type HTTPIPFilters []*net.IPNet
+
+func (f *HTTPIPFilters) String() string {
+	return fmt.Sprint(*f)
+}
+
+// Set parses network in CIDR notation, or single IP address
+func (f *HTTPIPFilters) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address or CIDR network %q", value)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		*f = append(*f, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, network)
+	return nil
+}
+
+// Contains tells if IP is in any of networks
+func (f HTTPIPFilters) Contains(ip net.IP) bool {
+	for _, network := range f {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
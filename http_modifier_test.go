@@ -1,7 +1,13 @@
-package main
+package goreplay
 
 import (
+	"bufio"
 	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/buger/goreplay/proto"
@@ -318,3 +324,264 @@ func TestHTTPModifierSetParam(t *testing.T) {
 		t.Error("Should override param", string(payload))
 	}
 }
+
+func TestHTTPModifierGraphQLFilters(t *testing.T) {
+	config := &HTTPModifierConfig{}
+	config.graphQLNegativeOperations.Set("^mutation ")
+	config.graphQLLimiters.Set("^query Search$:0%")
+	config.graphQLLimiters.Set("^query:100%")
+
+	modifier := NewHTTPModifier(config)
+
+	if p := modifier.Rewrite(graphQLPayload(`{"query": "mutation CreateUser { createUser { id } }"}`)); len(p) > 0 {
+		t.Error("Mutation should be dropped", string(p))
+	}
+
+	if p := modifier.Rewrite(graphQLPayload(`{"query": "query Search { items { id } }"}`)); len(p) > 0 {
+		t.Error("Operation should be limited by the first matching limiter", string(p))
+	}
+
+	if p := modifier.Rewrite(graphQLPayload(`{"query": "query GetUser { user { id } }"}`)); len(p) == 0 {
+		t.Error("Query should pass filters")
+	}
+
+	if p := modifier.Rewrite([]byte("POST /users HTTP/1.1\r\nContent-Length: 7\r\n\r\na=1&b=2")); len(p) == 0 {
+		t.Error("Requests which are not GraphQL should not be filtered")
+	}
+}
+
+func TestHTTPModifierXML(t *testing.T) {
+	soap := func(action, symbol, password string) []byte {
+		body := `<?xml version="1.0" encoding="ISO-8859-1"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Header><Security><Password>` + password + `</Password></Security></soap:Header>
+  <soap:Body><m:GetQuote xmlns:m="urn:quotes"><m:Symbol> ` + symbol + ` </m:Symbol><m:Empty/></m:GetQuote></soap:Body>
+</soap:Envelope>`
+		return []byte("POST /quotes HTTP/1.1\r\nContent-Type: application/soap+xml; charset=utf-8; action=\"urn:" + action + "\"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body)
+	}
+
+	config := &HTTPModifierConfig{}
+	config.xmlFilters.Set("SOAPAction:GetQuote$")
+	config.xmlNegativeFilters.Set("/Envelope/Body/GetQuote/Symbol:^TEST$")
+	config.xmlRewrite.Set("Security/Password: .*,<hidden>")
+
+	modifier := NewHTTPModifier(config)
+
+	if p := modifier.Rewrite(soap("GetPrice", "MSFT", "secret")); len(p) > 0 {
+		t.Error("Request with other SOAP action should be dropped", string(p))
+	}
+
+	if p := modifier.Rewrite(soap("GetQuote", "TEST", "secret")); len(p) > 0 {
+		t.Error("Request with matching element should be dropped", string(p))
+	}
+
+	p := modifier.Rewrite(soap("GetQuote", "MSFT", "secret"))
+	if len(p) == 0 {
+		t.Fatal("Request should pass filters")
+	}
+	if !bytes.Contains(p, []byte("<Password>&lt;hidden&gt;</Password>")) || bytes.Contains(p, []byte("secret")) {
+		t.Error("Element text should be rewritten and escaped", string(p))
+	}
+	if length, _ := strconv.Atoi(string(proto.Header(p, []byte("Content-Length")))); length != len(proto.Body(p)) {
+		t.Error("Content-Length should be updated", length, len(proto.Body(p)))
+	}
+
+	if p := modifier.Rewrite([]byte("POST /users HTTP/1.1\r\nContent-Type: application/json\r\n\r\n{}")); len(p) == 0 {
+		t.Error("Requests which are not XML should not be filtered")
+	}
+}
+
+func TestXMLPath(t *testing.T) {
+	body := []byte(`<a><b><c>1</c></b><c>2</c><d><b><c>3</c></b></d></a>`)
+
+	for path, expected := range map[string]string{
+		"/a/b/c": "1",
+		"b/c":    "13",
+		"//c":    "123",
+		"a/*/c":  "1",
+		"/b/c":   "",
+	} {
+		texts, err := xmlElementTexts(body, parseXMLPath(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var values string
+		for _, text := range texts {
+			values += string(text.value)
+		}
+		if values != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, path, values)
+		}
+	}
+}
+
+func TestHTTPModifierMultipart(t *testing.T) {
+	fixture, err := ioutil.TempFile("", "fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fixture.Name())
+	fixture.WriteString("fixture")
+	fixture.Close()
+
+	config := &HTTPModifierConfig{}
+	config.multipartDrop.Set("^attachment$")
+	if err := config.multipartReplace.Set("^avatar$:" + fixture.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	modifier := NewHTTPModifier(config)
+
+	body := "preamble\r\n" +
+		"--XyZ\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nHello\r\n" +
+		"--XyZ\r\nContent-Disposition: form-data; name=\"attachment\"; filename=\"big.bin\"\r\nContent-Type: application/octet-stream\r\n\r\n" + strings.Repeat("x", 1000) + "\r\n" +
+		"--XyZ\r\nContent-Disposition: form-data; name=\"avatar\"; filename=\"me.png\"\r\nContent-Type: image/png\r\n\r\n\x89PNG...\r\n" +
+		"--XyZ--\r\n"
+	payload := []byte("POST /upload HTTP/1.1\r\nContent-Type: multipart/form-data; boundary=XyZ\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body)
+
+	p := modifier.Rewrite(payload)
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(p)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal("Body should stay valid multipart", err, string(p))
+	}
+
+	if req.FormValue("title") != "Hello" {
+		t.Error("Fields should be kept", req.FormValue("title"))
+	}
+	if _, ok := req.MultipartForm.File["attachment"]; ok {
+		t.Error("Matching part should be dropped")
+	}
+
+	avatar, header, err := req.FormFile("avatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(avatar)
+	if string(content) != "fixture" || header.Filename != "me.png" {
+		t.Errorf("Part content should be replaced by fixture, got %q %q", content, header.Filename)
+	}
+
+	// Incomplete body, like the first chunk of large upload, is not changed
+	truncated := payload[:len(payload)-20]
+	if p := modifier.Rewrite(truncated); !bytes.Equal(p, truncated) {
+		t.Error("Incomplete body should not be rewritten", string(p))
+	}
+}
+
+func TestHTTPModifierIPFilters(t *testing.T) {
+	config := HTTPModifierConfig{}
+	config.ipFilters.Set("10.0.0.0/8")
+	config.ipFilters.Set("2001:db8::1")
+	config.ipNegativeFilters.Set("10.0.0.1")
+	modifier := NewHTTPModifier(&config)
+
+	cases := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.1.2.3:5000", true},
+		{"10.0.0.1:5000", false},
+		{"192.168.0.1:5000", false},
+		{"[2001:db8::1]:5000", true},
+		{"[2001:db8::2]:5000", false},
+		// Client address is not known
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if allowed := modifier.AllowClient([]byte(c.addr)); allowed != c.allowed {
+			t.Errorf("Expected %v for %q, got %v", c.allowed, c.addr, allowed)
+		}
+	}
+
+	config = HTTPModifierConfig{}
+	config.ipNegativeFilters.Set("10.0.0.0/8")
+	modifier = NewHTTPModifier(&config)
+	if !modifier.AllowClient(nil) || modifier.AllowClient([]byte("10.0.0.1:80")) || !modifier.AllowClient([]byte("192.168.0.1:80")) {
+		t.Error("Requests should be dropped only from disallowed networks")
+	}
+
+	if err := config.ipFilters.Set("10.0.0.0/33"); err == nil {
+		t.Error("Invalid network should not be accepted")
+	}
+}
+
+func TestHTTPModifierBodySize(t *testing.T) {
+	modifier := NewHTTPModifier(&HTTPModifierConfig{maxBodySize: 10})
+
+	if p := modifier.Rewrite([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nsmall")); len(p) == 0 {
+		t.Error("Small request should be forwarded")
+	}
+	// The first chunk of large upload
+	if p := modifier.Rewrite([]byte("POST / HTTP/1.1\r\nContent-Length: 1000\r\n\r\nlarge")); len(p) != 0 {
+		t.Error("Large request should be dropped by Content-Length", string(p))
+	}
+
+	modifier = NewHTTPModifier(&HTTPModifierConfig{truncateBodySize: 5})
+
+	cases := []struct {
+		payload, expected string
+		truncated         bool
+	}{
+		{"POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\nbody", "POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\nbody", false},
+		{"POST / HTTP/1.1\r\nContent-Length: 11\r\n\r\nlarge body!", "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nlarge", true},
+		// The first chunk of large upload, following chunks are dropped
+		{"POST / HTTP/1.1\r\nContent-Length: 1000\r\n\r\nlarge body", "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nlarge", true},
+		// The first chunk shorter than limit, following chunks are cut by emitter
+		{"POST / HTTP/1.1\r\nContent-Length: 1000\r\n\r\nlar", "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nlar", false},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\na\r\nlarge body\r\n0\r\n\r\n", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\na\r\nlarge body\r\n0\r\n\r\n", false},
+	}
+
+	for _, c := range cases {
+		p := modifier.Rewrite([]byte(c.payload))
+		if string(p) != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, p)
+		}
+		if truncated := modifier.BodyTruncated(p); truncated != c.truncated {
+			t.Errorf("Expected truncated %v for %q", c.truncated, c.payload)
+		}
+	}
+
+	if remaining, ok := modifier.BodyRemaining([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nlar")); !ok || remaining != 2 {
+		t.Error("Expected 2 bytes of body to follow the first chunk, got", remaining, ok)
+	}
+}
+
+func TestHTTPModifierUserAgent(t *testing.T) {
+	config := HTTPModifierConfig{disallowBots: true}
+	config.userAgentFilters.Set("Mozilla|MyApp")
+	config.userAgentNegativeFilters.Set("^MyApp/0\\.")
+	modifier := NewHTTPModifier(&config)
+
+	cases := []struct {
+		userAgent string
+		allowed   bool
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0 Safari/537.36", true},
+		{"MyApp/1.2", true},
+		{"MyApp/0.9", false},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", false},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", false},
+		{"Mozilla/5.0 (compatible; Baiduspider/2.0)", false},
+		{"facebookexternalhit/1.1", false},
+		{"curl/7.64.1", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		payload := []byte("GET / HTTP/1.1\r\nUser-Agent: " + c.userAgent + "\r\n\r\n")
+		if allowed := len(modifier.Rewrite(payload)) > 0; allowed != c.allowed {
+			t.Errorf("Expected %v for %q, got %v", c.allowed, c.userAgent, allowed)
+		}
+	}
+
+	modifier = NewHTTPModifier(&HTTPModifierConfig{disallowBots: true})
+	if len(modifier.Rewrite([]byte("GET / HTTP/1.1\r\n\r\n"))) == 0 {
+		t.Error("Requests without User-Agent should not be dropped as bots")
+	}
+}
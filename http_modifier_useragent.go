@@ -0,0 +1,44 @@
+package goreplay
+
+import (
+	"regexp"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// botUserAgent matches User-Agent of well-known crawlers, spiders, link preview fetchers and uptime checkers, used
+// by --http-disallow-bots
+var botUserAgent = regexp.MustCompile(`(?i)bot\b|crawl|spider|slurp|archiver|facebookexternalhit|mediapartners-google|` +
+	`adsbot|feedfetcher|lighthouse|pingdom|statuscake|site24x7|headlesschrome|phantomjs`)
+
+// isBotUserAgent tells if User-Agent belongs to well-known bot
+func isBotUserAgent(userAgent []byte) bool {
+	return botUserAgent.Match(userAgent)
+}
+
+// allowUserAgent tells if request passes --http-allow-user-agent, --http-disallow-user-agent and --http-disallow-bots
+// filters. Requests without User-Agent are dropped only by allow filters.
+func (m *HTTPModifier) allowUserAgent(payload []byte) bool {
+	userAgent := proto.Header(payload, []byte("User-Agent"))
+
+	if len(m.config.userAgentFilters) > 0 {
+		matched := false
+		for _, f := range m.config.userAgentFilters {
+			if f.regexp.Match(userAgent) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for _, f := range m.config.userAgentNegativeFilters {
+		if f.regexp.Match(userAgent) {
+			return false
+		}
+	}
+
+	return !m.config.disallowBots || !isBotUserAgent(userAgent)
+}
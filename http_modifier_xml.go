@@ -0,0 +1,175 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// xmlPath is XPath-like path of XML element, like Envelope/Body/GetQuote/Symbol. Element names are matched without
+// namespace prefixes, "*" matches element with any name. Path starting with "/" is matched from root element, other
+// paths are matched at any depth, so GetQuote/Symbol matches Symbol elements of GetQuote element wherever it is.
+type xmlPath struct {
+	names    []string
+	absolute bool
+}
+
+func parseXMLPath(path string) xmlPath {
+	p := xmlPath{absolute: strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//")}
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name != "" {
+			p.names = append(p.names, name)
+		}
+	}
+
+	return p
+}
+
+func (p xmlPath) String() string {
+	if p.absolute {
+		return "/" + strings.Join(p.names, "/")
+	}
+	return strings.Join(p.names, "/")
+}
+
+// match tells if element with given names of its ancestors and itself is matched by path
+func (p xmlPath) match(stack []string) bool {
+	if len(p.names) == 0 || len(stack) < len(p.names) || (p.absolute && len(stack) != len(p.names)) {
+		return false
+	}
+
+	stack = stack[len(stack)-len(p.names):]
+	for i, name := range p.names {
+		if name != "*" && name != stack[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// xmlText is text of element, and its position in body
+type xmlText struct {
+	value      []byte
+	start, end int
+}
+
+// xmlElementTexts returns texts of elements matching path, in order of document. Whitespace around text is trimmed,
+// and elements without text are skipped. Error is returned if body is not well-formed XML.
+func xmlElementTexts(body []byte, path xmlPath) (texts []xmlText, err error) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	// Only names and text are needed, so text in legacy charsets is matched as is
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	var stack []string
+	for {
+		start := d.InputOffset()
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			return texts, nil
+		}
+		if err != nil {
+			return texts, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if value := bytes.TrimSpace(t); len(value) > 0 && path.match(stack) {
+				texts = append(texts, xmlText{value: append([]byte(nil), value...), start: int(start), end: int(d.InputOffset())})
+			}
+		}
+	}
+}
+
+// isXMLRequest tells if request has XML body, which is not chunked
+func isXMLRequest(payload []byte) bool {
+	if len(proto.Header(payload, []byte("Transfer-Encoding"))) > 0 {
+		return false
+	}
+
+	if bytes.Contains(proto.Header(payload, []byte("Content-Type")), []byte("xml")) {
+		return true
+	}
+
+	body := bytes.TrimSpace(proto.Body(payload))
+	return len(body) > 0 && body[0] == '<'
+}
+
+// soapAction returns action of SOAP request, given by SOAPAction header in SOAP 1.1, or by action parameter of
+// Content-Type in SOAP 1.2
+func soapAction(payload []byte) []byte {
+	if action := proto.Header(payload, []byte("SOAPAction")); len(action) > 0 {
+		return bytes.Trim(action, `"`)
+	}
+
+	for _, param := range bytes.Split(proto.Header(payload, []byte("Content-Type")), []byte(";")) {
+		param = bytes.TrimSpace(param)
+		if bytes.HasPrefix(param, []byte("action=")) {
+			return bytes.Trim(param[len("action="):], `"`)
+		}
+	}
+
+	return nil
+}
+
+// xmlFilterMatch tells if request matches filter, by its SOAP action or by text of any element matching path
+func xmlFilterMatch(payload []byte, f xmlFilter) bool {
+	if f.soapAction {
+		return f.regexp.Match(soapAction(payload))
+	}
+
+	texts, _ := xmlElementTexts(proto.Body(payload), f.path)
+	for _, text := range texts {
+		if f.regexp.Match(text.value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rewriteXML replaces text of elements matching path, and updates Content-Length of request
+func rewriteXML(payload []byte, r xmlRewrite) []byte {
+	bodyStart := proto.MIMEHeadersEndPos(payload)
+	body := payload[bodyStart:]
+
+	texts, err := xmlElementTexts(body, r.path)
+	if err != nil || len(texts) == 0 {
+		return payload
+	}
+
+	var rewritten bytes.Buffer
+	last := 0
+	changed := false
+	for _, text := range texts {
+		if !r.src.Match(text.value) {
+			continue
+		}
+
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, r.src.ReplaceAll(text.value, r.target))
+
+		rewritten.Write(body[last:text.start])
+		rewritten.Write(escaped.Bytes())
+		last = text.end
+		changed = true
+	}
+
+	if !changed {
+		return payload
+	}
+	rewritten.Write(body[last:])
+
+	return replaceBody(payload, rewritten.Bytes())
+}
@@ -1,10 +1,9 @@
-package main
+package goreplay
 
 import (
 	"bytes"
 	"compress/gzip"
 	"io/ioutil"
-	"net/http/httputil"
 	"strconv"
 
 	"github.com/buger/goreplay/proto"
@@ -42,12 +41,21 @@ func prettifyHTTP(p []byte) []byte {
 	}
 
 	if bytes.Equal(tEnc, []byte("chunked")) {
-		buf := bytes.NewBuffer(content)
-		r := httputil.NewChunkedReader(buf)
-		content, _ = ioutil.ReadAll(r)
+		decoded, trailers, err := proto.DecodeChunked(content)
+		if err != nil {
+			Debug("[Prettifier] Chunked encoding error:", err)
+			return p
+		}
+		content = decoded
 
 		headers = proto.DeleteHeader(headers, []byte("Transfer-Encoding"))
 
+		// Trailer fields are moved to headers, since body is not chunked anymore
+		if len(trailers) > 0 {
+			headers = proto.DeleteHeader(headers, []byte("Trailer"))
+			headers = append(append(headers[:len(headers)-2:len(headers)-2], trailers...), proto.CLRF...)
+		}
+
 		newLen := strconv.Itoa(len(content))
 		headers = proto.SetHeader(headers, []byte("Content-Length"), []byte(newLen))
 	}
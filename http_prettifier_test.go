@@ -1,4 +1,4 @@
-package main
+package goreplay
 
 import (
 	"bytes"
@@ -34,3 +34,13 @@ func TestHTTPPrettifierChunked(t *testing.T) {
 		t.Error("Payload not match:", string(newPayload))
 	}
 }
+
+func TestHTTPPrettifierChunkedTrailers(t *testing.T) {
+	payload := []byte("1 1 1\nPOST / HTTP/1.1\r\nTrailer: Expires\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n0\r\nExpires: never\r\n\r\n")
+
+	newPayload := prettifyHTTP(payload)
+
+	if string(newPayload) != "1 1 1\nPOST / HTTP/1.1\r\nContent-Length: 4\r\nExpires: never\r\n\r\nWiki" {
+		t.Errorf("Payload not match: %q", newPayload)
+	}
+}
@@ -0,0 +1,400 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Access log formats supported by access log input
+const (
+	// Apache and Nginx formats, lines of both formats are accepted by either of them
+	AccessLogCombined = "combined"
+	AccessLogCommon   = "common"
+	// AWS Application Load Balancer
+	AccessLogALB = "alb"
+	// AWS Classic Load Balancer
+	AccessLogELB = "elb"
+)
+
+const accessLogTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+var errAccessLogSkip = errors.New("request can't be replayed")
+
+// AccessLogInputConfig access log input configuration
+type AccessLogInputConfig struct {
+	format string
+	// Region of S3 bucket, AWS_REGION by default
+	region string
+	// S3 API endpoint, used by tests
+	endpoint string
+}
+
+// accessLogEntry is request reconstructed from access log line
+type accessLogEntry struct {
+	timestamp time.Time
+	client    string
+	method    string
+	host      string
+	path      string
+	userAgent string
+	referer   string
+}
+
+// splitAccessLogLine splits line into fields separated by spaces. Quoted fields and fields in brackets are kept
+// whole, without quotes or brackets.
+func splitAccessLogLine(line string) (fields []string) {
+	for i := 0; i < len(line); {
+		switch line[i] {
+		case ' ', '\t':
+			i++
+		case '"':
+			var field strings.Builder
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				// Nginx escapes quotes as \x22, Apache as \"
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				field.WriteByte(line[i])
+			}
+			fields = append(fields, field.String())
+			i++
+		case '[':
+			end := strings.IndexByte(line[i:], ']')
+			if end == -1 {
+				end = len(line) - i
+			}
+			fields = append(fields, line[i+1:i+end])
+			i += end + 1
+		default:
+			end := strings.IndexAny(line[i:], " \t")
+			if end == -1 {
+				end = len(line) - i
+			}
+			fields = append(fields, line[i:i+end])
+			i += end
+		}
+	}
+
+	return
+}
+
+// parseAccessLogLine parses line of given format. errAccessLogSkip is returned for requests with body, since it is
+// not logged, and for malformed requests.
+func parseAccessLogLine(line, format string) (e accessLogEntry, err error) {
+	fields := splitAccessLogLine(line)
+
+	var request string
+	switch format {
+	case AccessLogCombined, AccessLogCommon:
+		// host ident user [time] "request" status size ["referer" "user agent"]
+		if len(fields) < 7 {
+			return e, fmt.Errorf("expected at least 7 fields, got %d", len(fields))
+		}
+		if e.timestamp, err = time.Parse(accessLogTimeLayout, fields[3]); err != nil {
+			return
+		}
+		e.client = net.JoinHostPort(fields[0], "0")
+		request = fields[4]
+		if len(fields) >= 9 {
+			e.referer, e.userAgent = fields[7], fields[8]
+		}
+	case AccessLogALB:
+		// type time elb client:port target:port 3 x processing time, 2 x status, 2 x bytes "request" "user agent" ...
+		if len(fields) < 14 {
+			return e, fmt.Errorf("expected at least 14 fields, got %d", len(fields))
+		}
+		if e.timestamp, err = time.Parse(time.RFC3339Nano, fields[1]); err != nil {
+			return
+		}
+		e.client, request, e.userAgent = fields[3], fields[12], fields[13]
+	case AccessLogELB:
+		// time elb client:port backend:port 3 x processing time, 2 x status, 2 x bytes "request" "user agent" ...
+		if len(fields) < 12 {
+			return e, fmt.Errorf("expected at least 12 fields, got %d", len(fields))
+		}
+		if e.timestamp, err = time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+			return
+		}
+		e.client, request = fields[2], fields[11]
+		if len(fields) >= 13 {
+			e.userAgent = fields[12]
+		}
+	default:
+		return e, fmt.Errorf("unknown format %q", format)
+	}
+
+	parts := strings.Fields(request)
+	if len(parts) < 2 {
+		return e, errAccessLogSkip
+	}
+
+	e.method = parts[0]
+	if e.method != "GET" && e.method != "HEAD" {
+		return e, errAccessLogSkip
+	}
+
+	// Load balancers log absolute URL, host is taken from it
+	e.path = parts[1]
+	if !strings.HasPrefix(e.path, "/") {
+		u, err := url.Parse(e.path)
+		if err != nil || u.Host == "" {
+			return e, errAccessLogSkip
+		}
+
+		e.host = u.Host
+		if port := u.Port(); u.Scheme == "http" && port == "80" || u.Scheme == "https" && port == "443" {
+			e.host = u.Hostname()
+		}
+		e.path = u.RequestURI()
+	}
+
+	if e.userAgent == "-" {
+		e.userAgent = ""
+	}
+	if e.referer == "-" {
+		e.referer = ""
+	}
+
+	return e, nil
+}
+
+// payload returns request payload, with client address in payload header
+func (e *accessLogEntry) payload() []byte {
+	var buf bytes.Buffer
+
+	header := payloadHeader(RequestPayload, uuid(), e.timestamp.UnixNano(), -1)
+	if e.client != "" && e.client != "-" {
+		header = payloadAddrHeader(header, e.client)
+	}
+	buf.Write(header)
+
+	buf.WriteString(e.method + " " + e.path + " HTTP/1.1\r\n")
+	if e.host != "" {
+		buf.WriteString("Host: " + e.host + "\r\n")
+	}
+	if e.userAgent != "" {
+		buf.WriteString("User-Agent: " + e.userAgent + "\r\n")
+	}
+	if e.referer != "" {
+		buf.WriteString("Referer: " + e.referer + "\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	return buf.Bytes()
+}
+
+// AccessLogInput replays GET and HEAD requests reconstructed from access logs, with original timing. Files matching
+// path pattern are read in order of their first requests, gzip compressed files are supported. Logs of load
+// balancers can be read from S3 bucket, given as s3://bucket/prefix.
+type AccessLogInput struct {
+	path        string
+	config      *AccessLogInputConfig
+	speedFactor float64
+	data        chan []byte
+	exit        chan bool
+	// Client of bucket if logs are read from S3
+	s3 *s3Client
+}
+
+// NewAccessLogInput constructor for AccessLogInput. Accepts file path pattern, or S3 bucket and key prefix as argument.
+func NewAccessLogInput(path string, config *AccessLogInputConfig) *AccessLogInput {
+	i := &AccessLogInput{
+		path:        path,
+		config:      config,
+		speedFactor: 1,
+		data:        make(chan []byte, 1000),
+		exit:        make(chan bool, 1),
+	}
+
+	var files []string
+	if strings.HasPrefix(path, "s3://") {
+		files = i.listS3()
+	} else {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			log.Fatalf("Wrong access log pattern %q: %v", path, err)
+		}
+		i.sortFiles(matches)
+		files = matches
+	}
+	if len(files) == 0 {
+		log.Fatalf("No access logs match %q", path)
+	}
+
+	go i.emit(files)
+
+	return i
+}
+
+// listS3 lists keys of objects in S3 bucket starting with prefix of s3://bucket/prefix path. Load balancers write
+// log of each node every 5 minutes, so objects are ordered by time they were written, instead of reading their first
+// requests.
+func (i *AccessLogInput) listS3() []string {
+	u, err := url.Parse(i.path)
+	if err != nil || u.Host == "" {
+		log.Fatalf("Wrong access log bucket %q, expected s3://bucket/prefix", i.path)
+	}
+
+	region := i.config.region
+	if region == "" {
+		region = awsRegion()
+	}
+	if i.s3, err = newS3Client(u.Host, region, i.config.endpoint); err != nil {
+		log.Fatalln("input-access-log error:", err)
+	}
+
+	objects, err := i.s3.list(strings.TrimPrefix(u.Path, "/"))
+	if err != nil {
+		log.Fatalf("Cannot list access logs of %q: %v", i.path, err)
+	}
+	sort.SliceStable(objects, func(a, b int) bool {
+		return objects[a].LastModified.Before(objects[b].LastModified)
+	})
+
+	keys := make([]string, 0, len(objects))
+	for _, o := range objects {
+		// Console creates empty objects for folders
+		if o.Size > 0 {
+			keys = append(keys, o.Key)
+		}
+	}
+
+	return keys
+}
+
+// sortFiles orders files by timestamp of their first request, since names of rotated logs, e.g. `access.log.1`, do not
+// follow their order
+func (i *AccessLogInput) sortFiles(files []string) {
+	first := make(map[string]time.Time, len(files))
+	for _, path := range files {
+		i.readFile(path, func(e accessLogEntry) bool {
+			first[path] = e.timestamp
+			return false
+		})
+	}
+
+	sort.SliceStable(files, func(a, b int) bool {
+		return first[files[a]].Before(first[files[b]])
+	})
+}
+
+func (i *AccessLogInput) Read(data []byte) (int, error) {
+	buf := <-i.data
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (i *AccessLogInput) emit(files []string) {
+	var lastTime time.Time
+
+	for _, path := range files {
+		err := i.readFile(path, func(e accessLogEntry) bool {
+			if !lastTime.IsZero() {
+				// Lines of access log are written when response is sent, so they can be slightly out of order
+				if diff := e.timestamp.Sub(lastTime); diff > 0 {
+					time.Sleep(time.Duration(float64(diff) / i.speedFactor))
+				}
+			}
+			if lastTime.IsZero() || e.timestamp.After(lastTime) {
+				lastTime = e.timestamp
+			}
+
+			select {
+			case i.data <- e.payload():
+				return true
+			case <-i.exit:
+				return false
+			}
+		})
+
+		if err == io.ErrClosedPipe {
+			return
+		}
+		if err != nil {
+			log.Printf("Cannot read access log '%s': %v\n", path, err)
+		}
+	}
+
+	log.Printf("AccessLogInput: end of file '%s'\n", i.path)
+
+	// Give outputs time to send queued requests, like file input does
+	time.Sleep(time.Second)
+	if closeCh != nil {
+		Close(closeCh)
+	}
+}
+
+// open opens local file, or object of S3 bucket with given key
+func (i *AccessLogInput) open(path string) (io.ReadCloser, error) {
+	if i.s3 != nil {
+		return i.s3.open(path)
+	}
+	return os.Open(path)
+}
+
+// readFile calls fn for each request of file, io.ErrClosedPipe is returned if fn stops reading
+func (i *AccessLogInput) readFile(path string, fn func(accessLogEntry) bool) error {
+	file, err := i.open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		e, err := parseAccessLogLine(scanner.Text(), i.config.format)
+		if err == errAccessLogSkip {
+			continue
+		}
+		if err != nil {
+			Debug("[ACCESS-LOG] Skipping line", line, "of", path+":", err)
+			continue
+		}
+
+		if !fn(e) {
+			return io.ErrClosedPipe
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (i *AccessLogInput) setSpeedFactor(factor float64) {
+	i.speedFactor = factor
+}
+
+func (i *AccessLogInput) String() string {
+	return "Access log input: " + i.path
+}
+
+// Close stops reading access logs
+func (i *AccessLogInput) Close() error {
+	i.exit <- true
+	return nil
+}
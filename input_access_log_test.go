@@ -0,0 +1,167 @@
+package goreplay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAccessLogLine(t *testing.T) {
+	tests := []struct {
+		format   string
+		line     string
+		expected string
+		err      bool
+	}{
+		{
+			AccessLogCombined,
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif?a=1 HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`,
+			"GET /apache_pb.gif?a=1 HTTP/1.1\r\nUser-Agent: Mozilla/4.08 [en] (Win98; I ;Nav)\r\nReferer: http://www.example.com/start.html\r\n\r\n",
+			false,
+		},
+		{
+			AccessLogCommon,
+			`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "HEAD / HTTP/1.0" 200 2326`,
+			"HEAD / HTTP/1.1\r\n\r\n",
+			false,
+		},
+		{
+			AccessLogCombined,
+			`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "POST /login HTTP/1.1" 200 2326 "-" "-"`,
+			"",
+			true,
+		},
+		{
+			AccessLogALB,
+			`https 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.086 0.048 0.037 200 200 0 57 "GET https://www.example.com:443/path?x=1 HTTP/1.1" "curl/7.46.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337281-1d84f3d73c47ec4e58577259" "www.example.com" "arn:aws:acm:us-east-2:123456789012:certificate/12345678-1234-1234-1234-123456789012" 1 2018-07-02T22:22:48.364000Z "authenticate,forward" "-" "-" "10.0.0.1:80" "200" "-" "-"`,
+			"GET /path?x=1 HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: curl/7.46.0\r\n\r\n",
+			false,
+		},
+		{
+			AccessLogELB,
+			`2015-05-13T23:39:43.945958Z my-loadbalancer 192.168.131.39:2817 10.0.0.1:80 0.000073 0.001048 0.000057 200 200 0 29 "GET http://www.example.com:8080/ HTTP/1.1" "curl/7.38.0" - -`,
+			"GET / HTTP/1.1\r\nHost: www.example.com:8080\r\nUser-Agent: curl/7.38.0\r\n\r\n",
+			false,
+		},
+	}
+
+	for i, tc := range tests {
+		e, err := parseAccessLogLine(tc.line, tc.format)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+
+		payload := e.payload()
+		if body := payloadBody(payload); string(body) != tc.expected {
+			t.Errorf("%d: expected %q, got %q", i, tc.expected, body)
+		}
+		if payloadClientAddr(payload) == "" {
+			t.Errorf("%d: expected client address in %q", i, payload)
+		}
+	}
+}
+
+func TestAccessLogInput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-access-log")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "access.log"), []byte(
+		`2015-05-13T23:39:43.050Z lb 10.0.0.1:2817 10.0.0.2:80 0 0 0 200 200 0 1 "GET http://example.com/2 HTTP/1.1" "-" - -
+2015-05-13T23:39:43.000Z lb 10.0.0.1:2817 10.0.0.2:80 0 0 0 200 200 0 1 "POST http://example.com/skip HTTP/1.1" "-" - -
+`), 0644)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(`2015-05-13T23:39:43.000Z lb 10.0.0.1:2817 10.0.0.2:80 0 0 0 200 200 0 1 "GET http://example.com/1 HTTP/1.1" "-" - -` + "\n"))
+	gz.Close()
+	// Rotated log is read first
+	ioutil.WriteFile(filepath.Join(dir, "access.log.1.gz"), buf.Bytes(), 0644)
+
+	input := NewAccessLogInput(filepath.Join(dir, "access.log*"), &AccessLogInputConfig{format: AccessLogELB})
+	defer input.Close()
+
+	data := make([]byte, 1000)
+	start := time.Now()
+	for _, path := range []string{"/1", "/2"} {
+		n, _ := input.Read(data)
+		if !bytes.HasPrefix(payloadBody(data[:n]), []byte("GET "+path+" ")) {
+			t.Errorf("Expected %s request, got %q", path, data[:n])
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected requests to be replayed with original timing, got %s", elapsed)
+	}
+}
+
+func TestAccessLogInputS3(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(`2015-05-13T23:39:43.000Z lb 10.0.0.1:2817 10.0.0.2:80 0 0 0 200 200 0 1 "GET http://example.com/1 HTTP/1.1" "-" - -` + "\n"))
+	gz.Close()
+
+	objects := map[string][]byte{
+		"logs/a.log":    []byte(`2015-05-13T23:39:43.050Z lb 10.0.0.1:2817 10.0.0.2:80 0 0 0 200 200 0 1 "GET http://example.com/2 HTTP/1.1" "-" - -` + "\n"),
+		"logs/b.log.gz": buf.Bytes(),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>"))
+			return
+		}
+
+		if r.URL.Path != "/bucket" {
+			w.Write(objects[strings.TrimPrefix(r.URL.Path, "/bucket/")])
+			return
+		}
+
+		if r.FormValue("list-type") != "2" || r.FormValue("prefix") != "logs/" {
+			t.Error("Wrong list request", r.URL)
+		}
+
+		// Listing is paginated, and the second file was written first
+		if r.FormValue("continuation-token") == "" {
+			w.Write([]byte(`<ListBucketResult><IsTruncated>true</IsTruncated><NextContinuationToken>next</NextContinuationToken>` +
+				`<Contents><Key>logs/</Key><LastModified>2015-05-13T23:35:00.000Z</LastModified><Size>0</Size></Contents>` +
+				`<Contents><Key>logs/a.log</Key><LastModified>2015-05-13T23:45:00.000Z</LastModified><Size>128</Size></Contents>` +
+				`</ListBucketResult>`))
+			return
+		}
+		w.Write([]byte(`<ListBucketResult><IsTruncated>false</IsTruncated>` +
+			`<Contents><Key>logs/b.log.gz</Key><LastModified>2015-05-13T23:40:00.000Z</LastModified><Size>128</Size></Contents>` +
+			`</ListBucketResult>`))
+	}))
+	defer server.Close()
+
+	input := NewAccessLogInput("s3://bucket/logs/", &AccessLogInputConfig{format: AccessLogELB, region: "us-east-1", endpoint: server.URL})
+	defer input.Close()
+
+	data := make([]byte, 1000)
+	for _, path := range []string{"/1", "/2"} {
+		n, _ := input.Read(data)
+		if !bytes.HasPrefix(payloadBody(data[:n]), []byte("GET "+path+" ")) {
+			t.Errorf("Expected %s request, got %q", path, data[:n])
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package goreplay
+
+import (
+	"io"
+	"log"
+	"net/url"
+	"time"
+)
+
+// AMQPInput consumes payloads published by AMQPOutput from queue of AMQP 0-9-1 broker, like RabbitMQ. Queue is
+// declared durable if it does not exist, and bound to exchange if it is set. Number of unacknowledged messages is
+// limited by prefetch count, and messages are acknowledged after they are read, so unread messages are redelivered
+// after restart. Connection is re-established after it is lost.
+type AMQPInput struct {
+	address *url.URL
+	config  *AMQPConfig
+	data    chan []byte
+	quit    chan struct{}
+}
+
+// NewAMQPInput constructor for AMQPInput, accepts address in `amqp://[user:password@]host[:port][/vhost]` format
+func NewAMQPInput(address string, config *AMQPConfig) *AMQPInput {
+	u, err := parseAMQPAddress(address)
+	if err != nil {
+		log.Fatalln("input-amqp error:", err)
+	}
+
+	i := &AMQPInput{
+		address: u,
+		config:  config,
+		data:    make(chan []byte),
+		quit:    make(chan struct{}),
+	}
+
+	conn, err := i.consume()
+	if err != nil {
+		log.Fatalln("input-amqp error:", err)
+	}
+
+	go func() {
+		for {
+			i.read(conn)
+			conn.Close()
+
+			for {
+				select {
+				case <-i.quit:
+					return
+				case <-time.After(time.Second):
+				}
+
+				if conn, err = i.consume(); err == nil {
+					break
+				}
+				log.Println("[AMQP-INPUT] connection error:", err)
+			}
+		}
+	}()
+
+	return i
+}
+
+// consume connects to broker, declares and binds queue, and starts consuming it
+func (i *AMQPInput) consume() (*amqpConn, error) {
+	conn, err := dialAMQP(i.address, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := i.setup(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (i *AMQPInput) setup(conn *amqpConn) error {
+	var args amqpBuffer
+	args.writeLong(0)
+	args.writeShort(uint16(i.config.prefetch))
+	args.writeBits(false)
+	if _, err := conn.call(amqpBasicQos, args.Bytes(), amqpBasicQosOk); err != nil {
+		return err
+	}
+
+	// Durable queue, which is not deleted when consumer disconnects
+	args.Reset()
+	args.writeShort(0)
+	args.writeShortstr(i.config.queue)
+	args.writeBits(false, true, false, false, false)
+	args.writeTable(nil)
+	if _, err := conn.call(amqpQueueDeclare, args.Bytes(), amqpQueueDeclareOk); err != nil {
+		return err
+	}
+
+	if i.config.exchange != "" {
+		args.Reset()
+		args.writeShort(0)
+		args.writeShortstr(i.config.queue)
+		args.writeShortstr(i.config.exchange)
+		args.writeShortstr(i.config.routingKey)
+		args.writeBits(false)
+		args.writeTable(nil)
+		if _, err := conn.call(amqpQueueBind, args.Bytes(), amqpQueueBindOk); err != nil {
+			return err
+		}
+	}
+
+	args.Reset()
+	args.writeShort(0)
+	args.writeShortstr(i.config.queue)
+	args.writeShortstr("gor-" + string(uuid()[:8]))
+	args.writeBits(false, false, false, false)
+	args.writeTable(nil)
+	_, err := conn.call(amqpBasicConsume, args.Bytes(), amqpBasicConsumeOk)
+
+	return err
+}
+
+// read reads deliveries until connection is closed or input is stopped
+func (i *AMQPInput) read(conn *amqpConn) {
+	for {
+		select {
+		case <-i.quit:
+			return
+		case <-conn.closed:
+			log.Println("[AMQP-INPUT] connection error:", conn.err)
+			return
+		case delivery := <-conn.deliveries:
+			select {
+			case <-i.quit:
+				return
+			case i.data <- delivery.body:
+			}
+
+			conn.ack(delivery.tag)
+			// Acknowledgements are sent when there are no more deliveries to read
+			if len(conn.deliveries) == 0 {
+				conn.Flush()
+			}
+		}
+	}
+}
+
+func (i *AMQPInput) Read(data []byte) (int, error) {
+	var buf []byte
+	select {
+	case <-i.quit:
+		return 0, io.EOF
+	case buf = <-i.data:
+	}
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (i *AMQPInput) String() string {
+	return "AMQP input: " + i.address.Host + "/" + i.config.queue
+}
+
+// Close stops consuming, messages which are not acknowledged are redelivered
+func (i *AMQPInput) Close() error {
+	close(i.quit)
+	return nil
+}
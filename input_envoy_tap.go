@@ -0,0 +1,341 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval of checking Envoy tap directory for new traces
+const envoyTapScanInterval = time.Second
+
+// EnvoyTapInputConfig Envoy tap input configuration
+type EnvoyTapInputConfig struct {
+	// ID of tap config registered in Envoy admin API for streaming
+	configID string
+}
+
+// envoyTrace is JSON trace of Envoy tap filter, written with JSON_BODY_AS_BYTES or JSON_BODY_AS_STRING format
+type envoyTrace struct {
+	HTTPBufferedTrace *struct {
+		Request  *envoyTraceMessage `json:"request"`
+		Response *envoyTraceMessage `json:"response"`
+	} `json:"http_buffered_trace"`
+}
+
+type envoyTraceMessage struct {
+	Headers []envoyTraceHeader `json:"headers"`
+	Body    *struct {
+		AsBytes   []byte `json:"as_bytes"`
+		AsString  string `json:"as_string"`
+		Truncated bool   `json:"truncated"`
+	} `json:"body"`
+}
+
+// envoyTraceHeader has value as string, or base64 encoded raw_value in newer Envoy versions
+type envoyTraceHeader struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	RawValue []byte `json:"raw_value"`
+}
+
+func (h *envoyTraceHeader) value() string {
+	if h.Value == "" && h.RawValue != nil {
+		return string(h.RawValue)
+	}
+
+	return h.Value
+}
+
+// header returns value of header, pseudo headers like `:path` are included
+func (m *envoyTraceMessage) header(name string) string {
+	for _, h := range m.Headers {
+		if h.Key == name {
+			return h.value()
+		}
+	}
+
+	return ""
+}
+
+func (m *envoyTraceMessage) body() []byte {
+	if m.Body == nil {
+		return nil
+	}
+	if m.Body.AsBytes != nil {
+		return m.Body.AsBytes
+	}
+
+	return []byte(m.Body.AsString)
+}
+
+// http returns HTTP/1.1 message with given start line. Envoy traces contain decoded body, so it is sent with
+// Content-Length instead of original transfer encoding.
+func (m *envoyTraceMessage) http(startLine string) []byte {
+	var buf bytes.Buffer
+	body := m.body()
+
+	buf.WriteString(startLine + "\r\n")
+	if host := m.header(":authority"); host != "" {
+		buf.WriteString("Host: " + host + "\r\n")
+	}
+
+	for _, h := range m.Headers {
+		if strings.HasPrefix(h.Key, ":") {
+			continue
+		}
+
+		switch strings.ToLower(h.Key) {
+		case "host", "content-length", "transfer-encoding":
+			continue
+		}
+
+		buf.WriteString(h.Key + ": " + h.value() + "\r\n")
+	}
+
+	if len(body) > 0 {
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	}
+
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	return buf.Bytes()
+}
+
+// payloads converts trace to request and response payloads, response is omitted if it is not traced. Traces with
+// truncated request body can't be replayed, error is returned for them.
+func (t *envoyTrace) payloads(timestamp time.Time) ([][]byte, error) {
+	if t.HTTPBufferedTrace == nil || t.HTTPBufferedTrace.Request == nil {
+		return nil, fmt.Errorf("expected http_buffered_trace with request")
+	}
+
+	req := t.HTTPBufferedTrace.Request
+	if req.Body != nil && req.Body.Truncated {
+		return nil, fmt.Errorf("request body is truncated")
+	}
+
+	method, path := req.header(":method"), req.header(":path")
+	if method == "" || path == "" {
+		return nil, fmt.Errorf("request without :method or :path header")
+	}
+
+	id := uuid()
+	payloads := [][]byte{append(payloadHeader(RequestPayload, id, timestamp.UnixNano(), -1), req.http(method+" "+path+" HTTP/1.1")...)}
+
+	if resp := t.HTTPBufferedTrace.Response; resp != nil {
+		status := resp.header(":status")
+		code, _ := strconv.Atoi(status)
+		statusLine := strings.TrimSpace("HTTP/1.1 " + status + " " + http.StatusText(code))
+		payloads = append(payloads, append(payloadHeader(ResponsePayload, id, timestamp.UnixNano(), 0), resp.http(statusLine)...))
+	}
+
+	return payloads, nil
+}
+
+// EnvoyTapInput reads HTTP traces of Envoy tap filter, so traffic of service mesh can be replayed without capturing
+// packets on the host. Traces are streamed from Envoy admin API, e.g. `http://127.0.0.1:15000`, or read from files
+// written by `file_per_tap` sink, matching path prefix or directory, which is checked for new files every second.
+type EnvoyTapInput struct {
+	path   string
+	config *EnvoyTapInputConfig
+	data   chan []byte
+	exit   chan struct{}
+}
+
+// NewEnvoyTapInput constructor for EnvoyTapInput
+func NewEnvoyTapInput(path string, config *EnvoyTapInputConfig) *EnvoyTapInput {
+	i := &EnvoyTapInput{
+		path:   path,
+		config: config,
+		data:   make(chan []byte, 1000),
+		exit:   make(chan struct{}),
+	}
+
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		go i.stream()
+	} else {
+		go i.watch()
+	}
+
+	return i
+}
+
+func (i *EnvoyTapInput) Read(data []byte) (int, error) {
+	buf := <-i.data
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+// send passes payloads of trace to outputs, io.ErrClosedPipe is returned if input is closed
+func (i *EnvoyTapInput) send(trace *envoyTrace, timestamp time.Time) error {
+	payloads, err := trace.payloads(timestamp)
+	if err != nil {
+		Debug("[ENVOY-TAP] Skipping trace:", err)
+		return nil
+	}
+
+	for _, payload := range payloads {
+		select {
+		case i.data <- payload:
+		case <-i.exit:
+			return io.ErrClosedPipe
+		}
+	}
+
+	return nil
+}
+
+// stream registers tap config in Envoy admin API, and reads traces streamed in response. Tap is removed by Envoy when
+// connection is closed, connection is reopened on errors.
+func (i *EnvoyTapInput) stream() {
+	tapConfig := fmt.Sprintf(`{"config_id": %q, "tap_config": {"match": {"any_match": true}, "output_config": {"sinks": [{"format": "JSON_BODY_AS_BYTES", "streaming_admin": {}}]}}}`, i.config.configID)
+	url := strings.TrimSuffix(i.path, "/") + "/tap"
+
+	for {
+		err := func() error {
+			resp, err := http.Post(url, "application/json", strings.NewReader(tapConfig))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+				return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+			}
+
+			// Unblock reading when input is closed
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-i.exit:
+					resp.Body.Close()
+				case <-done:
+				}
+			}()
+
+			decoder := json.NewDecoder(resp.Body)
+			for {
+				var trace envoyTrace
+				if err := decoder.Decode(&trace); err != nil {
+					return err
+				}
+				if err := i.send(&trace, time.Now()); err != nil {
+					return err
+				}
+			}
+		}()
+
+		select {
+		case <-i.exit:
+			return
+		case <-time.After(envoyTapScanInterval):
+		}
+
+		log.Printf("[ENVOY-TAP] Streaming traces from %s failed, reconnecting: %v", url, err)
+	}
+}
+
+// watch reads JSON trace files which were not read yet. Incomplete files are retried, since they can still be written.
+func (i *EnvoyTapInput) watch() {
+	pattern := i.path + "*.json"
+	if info, err := os.Stat(i.path); err == nil && info.IsDir() {
+		pattern = filepath.Join(i.path, "*.json")
+	}
+
+	seen := make(map[string]bool)
+
+	for {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			if seen[path] {
+				continue
+			}
+
+			if err := i.readFile(path); err == io.ErrClosedPipe {
+				return
+			} else if err == io.ErrUnexpectedEOF {
+				continue
+			} else if err != nil {
+				log.Printf("[ENVOY-TAP] Can't read trace file '%s': %v", path, err)
+			}
+
+			seen[path] = true
+		}
+
+		select {
+		case <-i.exit:
+			return
+		case <-time.After(envoyTapScanInterval):
+		}
+	}
+}
+
+// readFile sends payloads of traces of file, file modification time is used as their timestamp. io.ErrClosedPipe is
+// returned if input is closed.
+func (i *EnvoyTapInput) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	// Traces are decoded before they are sent, so partially written file is not sent twice
+	var buf bytes.Buffer
+	if _, err = buf.ReadFrom(file); err != nil {
+		return err
+	}
+	if buf.Len() == 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	var traces []envoyTrace
+	decoder := json.NewDecoder(&buf)
+	for {
+		var trace envoyTrace
+		if err = decoder.Decode(&trace); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		traces = append(traces, trace)
+	}
+
+	for k := range traces {
+		if err = i.send(&traces[k], info.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *EnvoyTapInput) String() string {
+	return "Envoy tap input: " + i.path
+}
+
+// Close stops reading traces
+func (i *EnvoyTapInput) Close() error {
+	close(i.exit)
+	return nil
+}
@@ -0,0 +1,105 @@
+package goreplay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const envoyTapTrace = `{
+ "http_buffered_trace": {
+  "request": {
+   "headers": [
+    {"key": ":authority", "value": "example.com"},
+    {"key": ":path", "value": "/orders?id=1"},
+    {"key": ":method", "value": "POST"},
+    {"key": "transfer-encoding", "value": "chunked"},
+    {"key": "x-token", "raw_value": "YWJj"}
+   ],
+   "body": {"truncated": false, "as_bytes": "aGVsbG8="}
+  },
+  "response": {
+   "headers": [{"key": ":status", "value": "201"}],
+   "body": {"as_string": "ok"}
+  }
+ }
+}`
+
+func TestEnvoyTrace(t *testing.T) {
+	var trace envoyTrace
+	if err := json.Unmarshal([]byte(envoyTapTrace), &trace); err != nil {
+		t.Fatal(err)
+	}
+
+	payloads, err := trace.payloads(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payloads) != 2 || payloads[0][0] != RequestPayload || payloads[1][0] != ResponsePayload {
+		t.Fatalf("Expected request and response, got %q", payloads)
+	}
+
+	if req := string(payloadBody(payloads[0])); req != "POST /orders?id=1 HTTP/1.1\r\nHost: example.com\r\nx-token: abc\r\nContent-Length: 5\r\n\r\nhello" {
+		t.Errorf("Wrong request %q", req)
+	}
+	if resp := string(payloadBody(payloads[1])); resp != "HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok" {
+		t.Errorf("Wrong response %q", resp)
+	}
+
+	trace.HTTPBufferedTrace.Request.Body.Truncated = true
+	if _, err := trace.payloads(time.Now()); err == nil {
+		t.Error("Trace with truncated request should not be replayed")
+	}
+}
+
+func TestEnvoyTapInputFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-envoy-tap")
+	defer os.RemoveAll(dir)
+
+	// File created by Envoy is read once it is written
+	ioutil.WriteFile(filepath.Join(dir, "tap_1.json"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "tap_2.pb"), []byte("binary"), 0644)
+
+	input := NewEnvoyTapInput(dir, &EnvoyTapInputConfig{})
+	defer input.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	ioutil.WriteFile(filepath.Join(dir, "tap_1.json"), []byte(envoyTapTrace), 0644)
+
+	data := make([]byte, 1000)
+	for _, expected := range []string{"POST /orders", "HTTP/1.1 201"} {
+		n, _ := input.Read(data)
+		if !strings.HasPrefix(string(payloadBody(data[:n])), expected) {
+			t.Errorf("Expected %q, got %q", expected, data[:n])
+		}
+	}
+}
+
+func TestEnvoyTapInputStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/tap" || !strings.Contains(string(body), `"config_id": "test"`) {
+			t.Errorf("Unexpected tap request %s %s", r.URL.Path, body)
+		}
+
+		w.Write([]byte(envoyTapTrace + envoyTapTrace))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	input := NewEnvoyTapInput(server.URL, &EnvoyTapInputConfig{configID: "test"})
+	defer input.Close()
+
+	data := make([]byte, 1000)
+	for n := 0; n < 4; n++ {
+		input.Read(data)
+	}
+}
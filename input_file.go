@@ -1,12 +1,15 @@
-package main
+package goreplay
 
 import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -20,27 +23,36 @@ type fileInputReader struct {
 	reader    *bufio.Reader
 	data      []byte
 	file      *os.File
+	path      string
 	timestamp int64
 	closed    int32 // Value of 0 indicates that the file is still open.
+	// Number of bytes read, and position after the current payload
+	read int64
+	end  int64
+	// Payloads are in binary format, see binaryPayloadMagic
+	binary bool
 }
 
 func (f *fileInputReader) parseNext() error {
+	if f.binary {
+		return f.parseNextBinary()
+	}
+
 	payloadSeparatorAsBytes := []byte(payloadSeparator)
 	var buffer bytes.Buffer
 
 	for {
 		line, err := f.reader.ReadBytes('\n')
+		f.read += int64(len(line))
 
 		if err != nil {
-			if err != io.EOF {
+			// Compressed file which is still being written ends unexpectedly
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
 				log.Println(err)
-				return err
 			}
 
-			if err == io.EOF {
-				f.Close()
-				return err
-			}
+			f.Close()
+			return err
 		}
 
 		if bytes.Equal(payloadSeparatorAsBytes[1:], line) {
@@ -49,6 +61,7 @@ func (f *fileInputReader) parseNext() error {
 
 			f.timestamp, _ = strconv.ParseInt(string(meta[2]), 10, 64)
 			f.data = asBytes[:len(asBytes)-1]
+			f.end = f.read
 
 			return nil
 		}
@@ -59,6 +72,26 @@ func (f *fileInputReader) parseNext() error {
 	return nil
 }
 
+func (f *fileInputReader) parseNextBinary() error {
+	payload, n, err := readBinaryPayload(f.reader)
+	f.read += int64(n)
+
+	if err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			log.Println(err)
+		}
+
+		f.Close()
+		return err
+	}
+
+	f.timestamp, _ = strconv.ParseInt(string(payloadMeta(payload)[2]), 10, 64)
+	f.data = payload
+	f.end = f.read
+
+	return nil
+}
+
 func (f *fileInputReader) ReadPayload() []byte {
 	defer f.parseNext()
 
@@ -73,7 +106,9 @@ func (f *fileInputReader) Close() error {
 	return nil
 }
 
-func NewFileInputReader(path string) *fileInputReader {
+// NewFileInputReader opens file and reads its first payload after offset. Offset of compressed or encrypted file is
+// position in its decoded data. Files encrypted by FileOutput are decrypted using key.
+func NewFileInputReader(path string, offset int64, key []byte) *fileInputReader {
 	file, err := os.Open(path)
 
 	if err != nil {
@@ -81,42 +116,181 @@ func NewFileInputReader(path string) *fileInputReader {
 		return nil
 	}
 
-	r := &fileInputReader{file: file, closed: 0}
+	r := &fileInputReader{file: file, path: path, closed: 0, read: offset, end: offset}
+
+	var src io.Reader = bufio.NewReader(file)
+	header, _ := src.(*bufio.Reader).Peek(len(encryptedFileMagic))
+	encrypted := isEncryptedFile(header)
+	if encrypted {
+		if key == nil {
+			log.Println("File is encrypted, set --input-file-key to read it:", path)
+			file.Close()
+			return nil
+		}
+
+		if src, err = newDecryptReader(src, key); err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Header is not written yet
+			r.Close()
+			return r
+		} else if err != nil {
+			log.Println(err)
+			file.Close()
+			return nil
+		}
+	}
+
 	if strings.HasSuffix(path, ".gz") {
-		gzReader, err := gzip.NewReader(file)
+		gzReader, err := gzip.NewReader(src)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Header of compressed file is not written yet
+			r.Close()
+			return r
+		}
 		if err != nil {
 			log.Println(err)
+			file.Close()
+			return nil
+		}
+		src = gzReader
+	}
+
+	if encrypted || strings.HasSuffix(path, ".gz") {
+		r.reader = bufio.NewReader(src)
+		header, _ := r.reader.Peek(len(binaryPayloadMagic))
+		r.binary = isBinaryPayloadStream(header)
+
+		// Decoded stream can't be seeked, so data before offset is skipped
+		if _, err = io.CopyN(ioutil.Discard, r.reader, offset); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			log.Println(err)
+			file.Close()
 			return nil
 		}
-		r.reader = bufio.NewReader(gzReader)
 	} else {
+		header := make([]byte, len(binaryPayloadMagic))
+		file.ReadAt(header, 0)
+		r.binary = isBinaryPayloadStream(header)
+
+		if _, err = file.Seek(offset, io.SeekStart); err != nil {
+			log.Println(err)
+			file.Close()
+			return nil
+		}
 		r.reader = bufio.NewReader(file)
 	}
 
+	if r.binary && offset == 0 {
+		r.reader.Discard(len(binaryPayloadMagic))
+		r.read += int64(len(binaryPayloadMagic))
+		r.end = r.read
+	}
+
 	r.parseNext()
 
 	return r
 }
 
+// fileInputBound limits replayed part of capture, by time of payload or its offset from the first payload of capture
+type fileInputBound struct {
+	at     time.Time
+	offset time.Duration
+}
+
+// parseFileInputBound parses either RFC3339 timestamp, e.g. `2021-03-01T22:00:00Z`, or offset duration, e.g. `1h30m`
+func parseFileInputBound(value string) (b fileInputBound, err error) {
+	if value == "" {
+		return
+	}
+
+	if b.offset, err = time.ParseDuration(value); err == nil {
+		if b.offset < 0 {
+			return b, errors.New("offset should not be negative")
+		}
+		return b, nil
+	}
+
+	if b.at, err = time.Parse(time.RFC3339Nano, value); err != nil {
+		return b, fmt.Errorf("expected RFC3339 timestamp or duration, got %q", value)
+	}
+
+	return b, nil
+}
+
+// isZero returns true if bound is not set
+func (b fileInputBound) isZero() bool {
+	return b.at.IsZero() && b.offset == 0
+}
+
+// timestamp returns bound in nanoseconds, as payload timestamp. start is timestamp of the first payload of capture.
+func (b fileInputBound) timestamp(start int64) int64 {
+	if !b.at.IsZero() {
+		return b.at.UnixNano()
+	}
+
+	return start + int64(b.offset)
+}
+
+// FileInputConfig file input configuration
+type FileInputConfig struct {
+	loop bool
+	// Only payloads with timestamps between these bounds are replayed, if set
+	from fileInputBound
+	to   fileInputBound
+	// Path of file where replay cursor is saved, and resumed from
+	resume string
+	// Pick up new files, and new payloads of files which are still written
+	watch bool
+	// AES-256 key to decrypt files written with --output-file-key
+	key []byte
+}
+
+// How often watched files are checked for changes
+const fileWatchInterval = time.Second
+
+// filePayload is payload read from file, with position of the next payload
+type filePayload struct {
+	data []byte
+	path string
+	end  int64
+}
+
 // FileInput can read requests generated by FileOutput
 type FileInput struct {
 	mu          sync.Mutex
-	data        chan []byte
+	data        chan filePayload
 	exit        chan bool
+	stop        chan struct{}
 	path        string
-	readers     []*fileInputReader
+	files       *fileMerge
 	speedFactor float64
 	loop        bool
+	watch       bool
+	key         []byte
+	from        fileInputBound
+	to          fileInputBound
+	cursor      *fileCursor
 }
 
 // NewFileInput constructor for FileInput. Accepts file path as argument.
-func NewFileInput(path string, loop bool) (i *FileInput) {
+func NewFileInput(path string, config *FileInputConfig) (i *FileInput) {
 	i = new(FileInput)
-	i.data = make(chan []byte, 1000)
+	i.data = make(chan filePayload, 1000)
 	i.exit = make(chan bool, 1)
+	i.stop = make(chan struct{})
 	i.path = path
 	i.speedFactor = 1
-	i.loop = loop
+	i.loop = config.loop
+	i.watch = config.watch
+	i.key = config.key
+	i.from = config.from
+	i.to = config.to
+
+	if config.resume != "" {
+		var err error
+		if i.cursor, err = loadFileCursor(config.resume); err != nil {
+			log.Println("Can't load replay cursor", config.resume, err)
+			return
+		}
+	}
 
 	if err := i.init(); err != nil {
 		return
@@ -124,6 +298,10 @@ func NewFileInput(path string, loop bool) (i *FileInput) {
 
 	go i.emit()
 
+	if i.cursor != nil {
+		go i.saveCursor()
+	}
+
 	return
 }
 
@@ -133,47 +311,92 @@ func (i *FileInput) init() (err error) {
 
 	var matches []string
 
-	if matches, err = filepath.Glob(i.path); err != nil {
+	if matches, err = i.match(); err != nil {
 		log.Println("Wrong file pattern", i.path, err)
 		return
 	}
 
-	if len(matches) == 0 {
+	// Watched directory can be empty until capture starts
+	if len(matches) == 0 && !i.watch {
 		log.Println("No files match pattern: ", i.path)
 		return errors.New("No matching files")
 	}
 
-	i.readers = make([]*fileInputReader, len(matches))
+	i.files = newFileMerge(matches, func(p string) int64 {
+		if i.cursor != nil {
+			return i.cursor.offset(p)
+		}
+		return 0
+	}, i.key, i.watch)
+
+	return nil
+}
 
-	for idx, p := range matches {
-		i.readers[idx] = NewFileInputReader(p)
+// match returns files matching path pattern. If path is directory, its files are returned, except hidden ones like
+// temporary files.
+func (i *FileInput) match() ([]string, error) {
+	if info, err := os.Stat(i.path); err != nil || !info.IsDir() {
+		return filepath.Glob(i.path)
 	}
 
-	return nil
+	matches, err := filepath.Glob(filepath.Join(i.path, "*"))
+	files := matches[:0]
+	for _, p := range matches {
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() && !strings.HasPrefix(filepath.Base(p), ".") {
+			files = append(files, p)
+		}
+	}
+
+	return files, err
 }
 
 func (i *FileInput) Read(data []byte) (int, error) {
-	buf := <-i.data
-	copy(data, buf)
+	payload := <-i.data
+	copy(data, payload.data)
 
-	return len(buf), nil
+	// Payload is passed to outputs, so replay continues after it
+	if i.cursor != nil {
+		i.cursor.set(payload.path, payload.end)
+	}
+
+	return len(payload.data), nil
+}
+
+func (i *FileInput) saveCursor() {
+	ticker := time.NewTicker(fileCursorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := i.cursor.save(); err != nil {
+				log.Println("Can't save replay cursor", err)
+			}
+		case <-i.stop:
+			return
+		}
+	}
+}
+
+func (i *FileInput) setSpeedFactor(factor float64) {
+	i.speedFactor = factor
 }
 
 func (i *FileInput) String() string {
 	return "File input: " + i.path
 }
 
-// Find reader with smallest timestamp e.g next payload in row
-func (i *FileInput) nextReader() (next *fileInputReader) {
-	for _, r := range i.readers {
-		if r == nil || atomic.LoadInt32(&r.closed) != 0 {
-			continue
-		}
+// timeRange returns timestamps of the first and the next after last payload to replay
+func (i *FileInput) timeRange() (from, to int64) {
+	var start int64
+	if reader := i.files.next(); reader != nil {
+		start = reader.timestamp
+	}
 
-		if next == nil || r.timestamp < next.timestamp {
-			next = r
-			continue
-		}
+	from = i.from.timestamp(start)
+	to = math.MaxInt64
+	if !i.to.isZero() {
+		to = i.to.timestamp(start)
 	}
 
 	return
@@ -181,6 +404,8 @@ func (i *FileInput) nextReader() (next *fileInputReader) {
 
 func (i *FileInput) emit() {
 	var lastTime int64 = -1
+	from, to := i.timeRange()
+	lastScan := time.Now()
 
 	for {
 		select {
@@ -189,18 +414,56 @@ func (i *FileInput) emit() {
 		default:
 		}
 
-		reader := i.nextReader()
+		if i.watch && time.Since(lastScan) >= fileWatchInterval {
+			if matches, err := i.match(); err == nil {
+				i.files.scan(matches)
+			}
+			lastScan = time.Now()
+		}
+
+		reader := i.files.next()
+
+		// Payloads are read in order of timestamps, so the rest of capture is after the range
+		if reader != nil && reader.timestamp >= to {
+			i.files.Close()
+			if !i.loop {
+				break
+			}
+			reader = nil
+		}
 
 		if reader == nil {
+			if i.watch {
+				select {
+				case <-i.exit:
+					return
+				case <-time.After(fileWatchInterval):
+				}
+
+				// Payloads written while waiting are replayed without delay
+				lastTime = -1
+				continue
+			}
+
 			if i.loop {
+				if i.cursor != nil {
+					i.cursor.reset()
+				}
 				i.init()
 				lastTime = -1
+				from, to = i.timeRange()
 				continue
 			} else {
 				break
 			}
 		}
 
+		// Skip payloads before the range without waiting
+		if reader.timestamp < from {
+			reader.ReadPayload()
+			continue
+		}
+
 		if lastTime != -1 {
 			diff := reader.timestamp - lastTime
 			lastTime = reader.timestamp
@@ -214,7 +477,9 @@ func (i *FileInput) emit() {
 			lastTime = reader.timestamp
 		}
 
-		i.data <- reader.ReadPayload()
+		payload := filePayload{path: reader.path, end: reader.end}
+		payload.data = reader.ReadPayload()
+		i.data <- payload
 	}
 
 	log.Printf("FileInput: end of file '%s'\n", i.path)
@@ -223,7 +488,7 @@ func (i *FileInput) emit() {
 	// Further should be modified, so outputs can report if their queue empty or not
 	time.Sleep(time.Second)
 	if closeCh != nil {
-		close(closeCh)
+		Close(closeCh)
 	}
 }
 
@@ -233,8 +498,15 @@ func (i *FileInput) Close() error {
 
 	i.exit <- true
 
-	for _, r := range i.readers {
-		r.Close()
+	if i.files != nil {
+		i.files.Close()
+	}
+
+	if i.cursor != nil {
+		close(i.stop)
+		if err := i.cursor.save(); err != nil {
+			log.Println("Can't save replay cursor", err)
+		}
 	}
 
 	return nil
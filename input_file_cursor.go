@@ -0,0 +1,120 @@
+package goreplay
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often replay cursor is saved to file
+const fileCursorInterval = time.Second
+
+// fileCursor keeps position of the next payload to replay in each of input files. It is saved periodically, so
+// interrupted replay can be resumed from the same position. Each line of cursor file contains offset and file name:
+//
+//	1048576 /var/log/gor/requests_0.gor
+type fileCursor struct {
+	mu      sync.Mutex
+	path    string
+	offsets map[string]int64
+	changed bool
+}
+
+// loadFileCursor reads cursor saved to path, cursor is empty if file does not exist
+func loadFileCursor(path string) (*fileCursor, error) {
+	c := &fileCursor{path: path, offsets: make(map[string]int64)}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed cursor %q", scanner.Text())
+		}
+
+		offset, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("malformed cursor %q", scanner.Text())
+		}
+		c.offsets[fields[1]] = offset
+	}
+
+	return c, scanner.Err()
+}
+
+// offset returns position of the next payload to replay in file
+func (c *fileCursor) offset(file string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.offsets[file]
+}
+
+func (c *fileCursor) set(file string, offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.offsets[file] = offset
+	c.changed = true
+}
+
+// reset moves cursor to the beginning of all files
+func (c *fileCursor) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.offsets = make(map[string]int64)
+	c.changed = true
+}
+
+// save writes cursor to file if it was changed. File is replaced atomically, so it is not corrupted if Gor is
+// killed while saving.
+func (c *fileCursor) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.changed {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for file, offset := range c.offsets {
+		fmt.Fprintf(w, "%d %s\n", offset, file)
+	}
+
+	if err = w.Flush(); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.changed = false
+
+	return nil
+}
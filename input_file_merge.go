@@ -0,0 +1,182 @@
+package goreplay
+
+import (
+	"container/heap"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pendingFile is input file which is not opened yet, timestamp is of its first payload to replay
+type pendingFile struct {
+	path      string
+	offset    int64
+	timestamp int64
+}
+
+// fileReaders is heap of open files, ordered by timestamp of the next payload
+type fileReaders []*fileInputReader
+
+func (h fileReaders) Len() int           { return len(h) }
+func (h fileReaders) Less(i, j int) bool { return h[i].timestamp < h[j].timestamp }
+func (h fileReaders) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *fileReaders) Push(x interface{}) {
+	*h = append(*h, x.(*fileInputReader))
+}
+
+func (h *fileReaders) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// fileMerge merges payloads of multiple files by timestamp. Rotated captures usually do not overlap in time, so file
+// is opened only when the next payload to replay can be in it, and number of open files stays small even for
+// thousands of chunks.
+type fileMerge struct {
+	mu      sync.Mutex
+	readers fileReaders
+	pending []pendingFile
+	offset  func(string) int64
+	key     []byte
+
+	// In watch mode files are added as they appear, and read files wait for new payloads until they are rotated
+	watch   bool
+	seen    map[string]bool
+	waiting []pendingFile
+}
+
+// newFileMerge reads the first payload of each file after its offset, files without payloads are skipped
+func newFileMerge(paths []string, offset func(string) int64, key []byte, watch bool) *fileMerge {
+	m := &fileMerge{offset: offset, key: key, watch: watch, seen: make(map[string]bool)}
+	m.add(paths)
+
+	return m
+}
+
+func (m *fileMerge) add(paths []string) {
+	for _, p := range paths {
+		if m.seen[p] {
+			continue
+		}
+		m.seen[p] = true
+
+		r := NewFileInputReader(p, m.offset(p), m.key)
+		if r == nil {
+			continue
+		}
+
+		if atomic.LoadInt32(&r.closed) == 0 {
+			m.pending = append(m.pending, pendingFile{path: p, offset: m.offset(p), timestamp: r.timestamp})
+		} else if m.watch {
+			// File can be just created, and not written yet
+			m.waiting = append(m.waiting, pendingFile{path: p, offset: m.offset(p)})
+		}
+		r.Close()
+	}
+
+	sort.SliceStable(m.pending, func(i, j int) bool {
+		return m.pending[i].timestamp < m.pending[j].timestamp
+	})
+}
+
+// settle updates position of the top reader, which could be read since the previous call of next
+func (m *fileMerge) settle() {
+	if len(m.readers) == 0 {
+		return
+	}
+
+	if r := m.readers[0]; atomic.LoadInt32(&r.closed) != 0 {
+		heap.Pop(&m.readers)
+
+		if m.watch {
+			m.waiting = append(m.waiting, pendingFile{path: r.path, offset: r.end})
+		}
+	} else {
+		heap.Fix(&m.readers, 0)
+	}
+}
+
+// next returns reader with the smallest timestamp e.g next payload in row, or nil if all files are read.
+// Payload should be read from returned reader before the next call.
+func (m *fileMerge) next() *fileInputReader {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.settle()
+
+	for len(m.pending) > 0 && (len(m.readers) == 0 || m.pending[0].timestamp <= m.readers[0].timestamp) {
+		f := m.pending[0]
+		m.pending = m.pending[1:]
+
+		if r := NewFileInputReader(f.path, f.offset, m.key); r != nil && atomic.LoadInt32(&r.closed) == 0 {
+			heap.Push(&m.readers, r)
+		} else if r != nil && m.watch {
+			m.waiting = append(m.waiting, pendingFile{path: f.path, offset: r.end})
+		}
+	}
+
+	if len(m.readers) == 0 {
+		return nil
+	}
+
+	return m.readers[0]
+}
+
+// scan adds new files, and reopens files waiting for new payloads. Waiting file is finished once newer file
+// appears, as writers close rotated file before starting the next one.
+func (m *fileMerge) scan(paths []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.settle()
+	m.add(paths)
+
+	var latest time.Time
+	modified := make(map[string]time.Time, len(m.seen))
+	for p := range m.seen {
+		if info, err := os.Stat(p); err == nil {
+			modified[p] = info.ModTime()
+			if info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+		}
+	}
+
+	waiting := m.waiting[:0]
+	for _, f := range m.waiting {
+		// Incomplete payload at the end of file is read again
+		r := NewFileInputReader(f.path, f.offset, m.key)
+		if r == nil {
+			continue
+		}
+
+		if atomic.LoadInt32(&r.closed) == 0 {
+			heap.Push(&m.readers, r)
+			continue
+		}
+
+		if modified[f.path].Before(latest) {
+			continue
+		}
+		waiting = append(waiting, f)
+	}
+	m.waiting = waiting
+}
+
+// Close closes open files, and skips the rest
+func (m *fileMerge) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range m.readers {
+		r.Close()
+	}
+	m.readers = nil
+	m.pending = nil
+	m.waiting = nil
+}
@@ -0,0 +1,123 @@
+package goreplay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gor_merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Rotated chunks follow each other, the last file overlaps with them, and empty file is skipped
+	chunks := map[string][]int{
+		"requests_0.gor": {1, 2, 3},
+		"requests_1.gor": {4, 5},
+		"requests_2.gor": {6, 8},
+		"requests_3.gor": {},
+		"late.gor":       {5, 7},
+	}
+
+	var paths []string
+	for name, timestamps := range chunks {
+		path := filepath.Join(dir, name)
+		file, _ := os.Create(path)
+		for _, ts := range timestamps {
+			file.Write([]byte(fmt.Sprintf("1 %d %d\n%s", ts, ts, name)))
+			file.Write([]byte(payloadSeparator))
+		}
+		file.Close()
+		paths = append(paths, path)
+	}
+
+	m := newFileMerge(paths, func(string) int64 { return 0 }, nil, false)
+	if len(m.pending) != 4 || len(m.readers) != 0 {
+		t.Fatalf("Files should be opened only when they are read, got %d pending", len(m.pending))
+	}
+
+	var timestamps []int64
+	maxOpen := 0
+	for r := m.next(); r != nil; r = m.next() {
+		if len(m.readers) > maxOpen {
+			maxOpen = len(m.readers)
+		}
+		timestamps = append(timestamps, r.timestamp)
+		r.ReadPayload()
+	}
+
+	if fmt.Sprint(timestamps) != "[1 2 3 4 5 5 6 7 8]" {
+		t.Errorf("Payloads should be merged by timestamp, got %v", timestamps)
+	}
+
+	if maxOpen != 2 {
+		t.Errorf("Only overlapping files should be open at the same time, got %d", maxOpen)
+	}
+}
+
+func TestFileMergeWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gor_watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := &FileInput{path: dir}
+	write := func(name string, data string) {
+		file, _ := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+		file.Write([]byte(data))
+		file.Close()
+	}
+	payload := func(ts int) string {
+		return fmt.Sprintf("1 %d %d\nrequest", ts, ts) + payloadSeparator
+	}
+	read := func(m *fileMerge) (timestamps []int64) {
+		for r := m.next(); r != nil; r = m.next() {
+			timestamps = append(timestamps, r.timestamp)
+			r.ReadPayload()
+		}
+		return
+	}
+
+	write("requests_0.gor", payload(1))
+	write(".requests_1.gor.tmp", payload(2))
+
+	matches, _ := input.match()
+	m := newFileMerge(matches, func(string) int64 { return 0 }, nil, true)
+	if ts := read(m); fmt.Sprint(ts) != "[1]" {
+		t.Errorf("Hidden files should be skipped, got %v", ts)
+	}
+
+	// Incomplete payload is read once it is written
+	write("requests_0.gor", payload(2)+"1 3 3\nreq")
+	matches, _ = input.match()
+	m.scan(matches)
+	if ts := read(m); fmt.Sprint(ts) != "[2]" {
+		t.Errorf("Expected new payload, got %v", ts)
+	}
+
+	write("requests_0.gor", "uest"+payloadSeparator)
+	m.scan(matches)
+	if ts := read(m); fmt.Sprint(ts) != "[3]" {
+		t.Errorf("Expected completed payload, got %v", ts)
+	}
+
+	// File is finished when newer file appears
+	time.Sleep(10 * time.Millisecond)
+	write("requests_1.gor", payload(4))
+	matches, _ = input.match()
+	m.scan(matches)
+	if ts := read(m); fmt.Sprint(ts) != "[4]" {
+		t.Errorf("Expected payload of new file, got %v", ts)
+	}
+
+	if len(m.waiting) != 1 || m.waiting[0].path != filepath.Join(dir, "requests_1.gor") {
+		t.Errorf("Only the last file should wait for new payloads, got %v", m.waiting)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package goreplay
 
 import (
 	"bytes"
@@ -97,6 +97,28 @@ func TestInputFileWithGETAndPOST(t *testing.T) {
 
 }
 
+func TestInputFileWithTrailers(t *testing.T) {
+	input := NewTestInput()
+	rg := NewRequestGenerator([]io.Reader{input}, func() {
+		input.EmitBytes([]byte("POST /helloworld.Greeter/SayHello HTTP/1.1\r\nTrailer: grpc-status\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n0\r\ngrpc-status: 0\r\n\r\n"))
+	}, 1)
+	readPayloads := [][]byte{}
+
+	expectedCaptureFile := CreateCaptureFile(rg)
+	defer expectedCaptureFile.TearDown()
+
+	err := ReadFromCaptureFile(expectedCaptureFile.file, 1, func(data []byte) {
+		readPayloads = append(readPayloads, Duplicate(data))
+	})
+
+	// Trailers after the last chunk are kept
+	if err != nil {
+		t.Error(err)
+	} else if !expectedCaptureFile.PayloadsEqual(readPayloads) {
+		t.Error("Request read back from file should match")
+	}
+}
+
 func TestInputFileMultipleFilesWithRequestsOnly(t *testing.T) {
 	rnd := rand.Int63()
 
@@ -114,7 +136,7 @@ func TestInputFileMultipleFilesWithRequestsOnly(t *testing.T) {
 	file2.Write([]byte(payloadSeparator))
 	file2.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 
 	for i := '1'; i <= '4'; i++ {
@@ -141,7 +163,7 @@ func TestInputFileRequestsWithLatency(t *testing.T) {
 	file.Write([]byte("1 3 250000000\nrequest3"))
 	file.Write([]byte(payloadSeparator))
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 
 	start := time.Now().UnixNano()
@@ -162,6 +184,97 @@ func TestInputFileRequestsWithLatency(t *testing.T) {
 	}
 }
 
+func TestInputFileTimeRange(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	defer os.Remove(file.Name())
+
+	for i := 1; i <= 5; i++ {
+		file.Write([]byte(fmt.Sprintf("1 %d %d\nrequest%d", i, time.Duration(i)*10*time.Millisecond, i)))
+		file.Write([]byte(payloadSeparator))
+	}
+	file.Close()
+
+	tests := []struct {
+		from, to string
+		expected []string
+	}{
+		{"10ms", "30ms", []string{"request2", "request3"}},
+		{"", "10ms", []string{"request1"}},
+		{time.Unix(0, 0).Add(40 * time.Millisecond).Format(time.RFC3339Nano), "", []string{"request4", "request5"}},
+	}
+
+	for _, tt := range tests {
+		from, _ := parseFileInputBound(tt.from)
+		to, _ := parseFileInputBound(tt.to)
+
+		input := NewFileInput(file.Name(), &FileInputConfig{from: from, to: to})
+		buf := make([]byte, 1000)
+
+		for _, expected := range tt.expected {
+			n, _ := input.Read(buf)
+			if !bytes.Equal(payloadBody(buf[:n]), []byte(expected)) {
+				t.Errorf("Range %q-%q: expected %s, got %q", tt.from, tt.to, expected, buf[:n])
+			}
+		}
+
+		select {
+		case payload := <-input.data:
+			t.Errorf("Range %q-%q: payload after range should not be emitted: %q", tt.from, tt.to, payload.data)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	if _, err := parseFileInputBound("yesterday"); err == nil {
+		t.Error("Expected error for wrong bound")
+	}
+}
+
+func TestInputFileResume(t *testing.T) {
+	rnd := rand.Int63()
+	cursor := fmt.Sprintf("/tmp/%d.cursor", rnd)
+	defer os.Remove(cursor)
+
+	output := NewFileOutput(fmt.Sprintf("/tmp/%d_0.gor", rnd), &FileOutputConfig{flushInterval: time.Minute, append: true})
+	output2 := NewFileOutput(fmt.Sprintf("/tmp/%d_1.gor.gz", rnd), &FileOutputConfig{flushInterval: time.Minute, append: true})
+	for i := 1; i <= 4; i++ {
+		output.Write([]byte(fmt.Sprintf("1 %d %d\nrequest%d", i, 2*i, 2*i)))
+		output2.Write([]byte(fmt.Sprintf("1 %d %d\nrequest%d", i, 2*i+1, 2*i+1)))
+	}
+	output.Close()
+	output2.Close()
+	defer os.Remove(output.file.Name())
+	defer os.Remove(output2.file.Name())
+
+	buf := make([]byte, 1000)
+	expected := 2
+
+	// Replay is interrupted twice, and then resumed until the end
+	for _, count := range []int{3, 2, 3} {
+		input := NewFileInput(fmt.Sprintf("/tmp/%d_*", rnd), &FileInputConfig{resume: cursor})
+		for j := 0; j < count; j++ {
+			n, _ := input.Read(buf)
+			if body := fmt.Sprintf("request%d", expected); !bytes.Equal(payloadBody(buf[:n]), []byte(body)) {
+				t.Errorf("Expected %s, got %q", body, buf[:n])
+			}
+			expected++
+		}
+		input.Close()
+	}
+
+	if expected != 10 {
+		t.Errorf("All payloads should be replayed")
+	}
+
+	input := NewFileInput(fmt.Sprintf("/tmp/%d_*", rnd), &FileInputConfig{resume: cursor})
+	select {
+	case payload := <-input.data:
+		t.Errorf("Finished replay should not be repeated: %q", payload.data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
 func TestInputFileMultipleFilesWithRequestsAndResponses(t *testing.T) {
 	rnd := rand.Int63()
 
@@ -187,7 +300,7 @@ func TestInputFileMultipleFilesWithRequestsAndResponses(t *testing.T) {
 	file2.Write([]byte(payloadSeparator))
 	file2.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 
 	for i := '1'; i <= '4'; i++ {
@@ -216,7 +329,7 @@ func TestInputFileLoop(t *testing.T) {
 	file.Write([]byte(payloadSeparator))
 	file.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), true)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{loop: true})
 	buf := make([]byte, 1000)
 
 	// Even if we have just 2 requests in file, it should indifinitly loop
@@ -245,7 +358,7 @@ func TestInputFileCompressed(t *testing.T) {
 	name2 := output2.file.Name()
 	output2.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 	for i := 0; i < 2000; i++ {
 		input.Read(buf)
@@ -346,7 +459,7 @@ func ReadFromCaptureFile(captureFile *os.File, count int, callback writeCallback
 	quit := make(chan int)
 	wg := new(sync.WaitGroup)
 
-	input := NewFileInput(captureFile.Name(), false)
+	input := NewFileInput(captureFile.Name(), &FileInputConfig{})
 	output := NewTestOutput(func(data []byte) {
 		callback(data)
 		wg.Done()
@@ -0,0 +1,288 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// generatorConfig is template file of generator input, in JSON format:
+//
+//	{
+//	  "rps": 100,
+//	  "vars": {"user": ["alice", "bob"]},
+//	  "requests": [
+//	    {"method": "GET", "url": "/users/{{pick .user}}?page={{randInt 1 10}}", "weight": 3},
+//	    {"method": "POST", "url": "/orders", "headers": {"Content-Type": "application/json"},
+//	     "body": "{\"id\": \"{{uuid}}\", \"seq\": {{seq}}}"}
+//	  ]
+//	}
+//
+// URL, header values and body are Go templates, see funcs for available functions.
+type generatorConfig struct {
+	RPS      float64                  `json:"rps"`
+	Vars     map[string][]interface{} `json:"vars"`
+	Requests []generatorRequestConfig `json:"requests"`
+}
+
+type generatorRequestConfig struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	Weight  int               `json:"weight"`
+}
+
+type generatorRequest struct {
+	method  string
+	url     *template.Template
+	headers []generatorHeader
+	body    *template.Template
+	// Sum of weights of this and previous requests
+	weight int
+}
+
+type generatorHeader struct {
+	name  string
+	value *template.Template
+}
+
+// GeneratorInput synthesizes requests from template file with given rate, so Gor can be used as load generator with
+// the same outputs, limiters and stats.
+type GeneratorInput struct {
+	path     string
+	rps      float64
+	vars     map[string][]interface{}
+	requests []generatorRequest
+	rand     *rand.Rand
+	seq      int64
+	data     chan []byte
+	exit     chan bool
+}
+
+// NewGeneratorInput constructor for GeneratorInput, it reads template file from given path
+func NewGeneratorInput(path string) *GeneratorInput {
+	i, err := newGeneratorInput(path)
+	if err != nil {
+		log.Fatalf("Cannot load generator template %q: %v", path, err)
+	}
+
+	go i.emit()
+
+	return i
+}
+
+func newGeneratorInput(path string) (*GeneratorInput, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config generatorConfig
+	if err = json.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+
+	i := &GeneratorInput{
+		path: path,
+		rps:  config.RPS,
+		vars: config.Vars,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+		data: make(chan []byte),
+		exit: make(chan bool, 1),
+	}
+
+	if i.rps <= 0 {
+		i.rps = 1
+	}
+
+	if len(config.Requests) == 0 {
+		return nil, fmt.Errorf("no requests in template")
+	}
+
+	total := 0
+	for n, c := range config.Requests {
+		if c.Weight < 0 {
+			return nil, fmt.Errorf("request %d: negative weight", n)
+		}
+		if c.Weight == 0 {
+			c.Weight = 1
+		}
+		total += c.Weight
+
+		r := generatorRequest{method: strings.ToUpper(c.Method), weight: total}
+		if r.method == "" {
+			r.method = "GET"
+		}
+
+		if r.url, err = i.parse(c.URL); err != nil {
+			return nil, fmt.Errorf("request %d url: %v", n, err)
+		}
+		if r.body, err = i.parse(c.Body); err != nil {
+			return nil, fmt.Errorf("request %d body: %v", n, err)
+		}
+
+		for name, value := range c.Headers {
+			h := generatorHeader{name: name}
+			if h.value, err = i.parse(value); err != nil {
+				return nil, fmt.Errorf("request %d header %s: %v", n, name, err)
+			}
+			r.headers = append(r.headers, h)
+		}
+
+		// Headers are written in stable order
+		sort.Slice(r.headers, func(a, b int) bool { return r.headers[a].name < r.headers[b].name })
+
+		i.requests = append(i.requests, r)
+	}
+
+	return i, nil
+}
+
+func (i *GeneratorInput) parse(text string) (*template.Template, error) {
+	return template.New("").Funcs(i.funcs()).Option("missingkey=error").Parse(text)
+}
+
+// funcs returns functions available in templates:
+// `randInt min max` random integer in [min, max], `randString n` random alphanumeric string, `uuid` random ID,
+// `seq` number of request starting from 1, `now` unix timestamp, and `pick` random argument, or item of list variable
+func (i *GeneratorInput) funcs() template.FuncMap {
+	return template.FuncMap{
+		"randInt": func(min, max int) int {
+			if max <= min {
+				return min
+			}
+			return min + i.rand.Intn(max-min+1)
+		},
+		"randString": func(n int) string {
+			const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+			b := make([]byte, n)
+			for k := range b {
+				b[k] = letters[i.rand.Intn(len(letters))]
+			}
+			return string(b)
+		},
+		"uuid": func() string {
+			return string(uuid())
+		},
+		"seq": func() int64 {
+			return i.seq
+		},
+		"now": func() int64 {
+			return time.Now().Unix()
+		},
+		"pick": func(values ...interface{}) interface{} {
+			if len(values) == 1 {
+				if list, ok := values[0].([]interface{}); ok {
+					values = list
+				}
+			}
+			if len(values) == 0 {
+				return ""
+			}
+			return values[i.rand.Intn(len(values))]
+		},
+	}
+}
+
+// generate renders randomly picked request, requests are picked according to their weights
+func (i *GeneratorInput) generate() ([]byte, error) {
+	i.seq++
+
+	n := i.rand.Intn(i.requests[len(i.requests)-1].weight)
+	r := i.requests[0]
+	for _, r = range i.requests {
+		if n < r.weight {
+			break
+		}
+	}
+
+	var url, body bytes.Buffer
+	if err := r.url.Execute(&url, i.vars); err != nil {
+		return nil, err
+	}
+	if err := r.body.Execute(&body, i.vars); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1))
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", r.method, url.Bytes())
+
+	hasLength := false
+	for _, h := range r.headers {
+		buf.WriteString(h.name)
+		buf.WriteString(": ")
+		if err := h.value.Execute(&buf, i.vars); err != nil {
+			return nil, err
+		}
+		buf.WriteString("\r\n")
+
+		if strings.EqualFold(h.name, "Content-Length") {
+			hasLength = true
+		}
+	}
+
+	if !hasLength && (body.Len() > 0 || r.method == "POST" || r.method == "PUT" || r.method == "PATCH") {
+		buf.WriteString("Content-Length: " + strconv.Itoa(body.Len()) + "\r\n")
+	}
+
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+func (i *GeneratorInput) Read(data []byte) (int, error) {
+	buf := <-i.data
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+// emit generates requests with configured rate. Requests are scheduled from start of generation, so if outputs are
+// slower than the rate, delayed requests are sent as soon as possible to catch up.
+func (i *GeneratorInput) emit() {
+	start := time.Now()
+	interval := float64(time.Second) / i.rps
+
+	for n := 0; ; n++ {
+		if wait := time.Until(start.Add(time.Duration(float64(n) * interval))); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-i.exit:
+				return
+			}
+		}
+
+		payload, err := i.generate()
+		if err != nil {
+			log.Println("Cannot generate request:", err)
+			continue
+		}
+
+		select {
+		case i.data <- payload:
+		case <-i.exit:
+			return
+		}
+	}
+}
+
+func (i *GeneratorInput) String() string {
+	return "Generator input: " + i.path
+}
+
+// Close stops generating requests
+func (i *GeneratorInput) Close() error {
+	i.exit <- true
+	return nil
+}
@@ -0,0 +1,99 @@
+package goreplay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeGeneratorTemplate(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "gor-generator")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "load.json")
+	if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestGeneratorInputTemplate(t *testing.T) {
+	path := writeGeneratorTemplate(t, `{
+		"vars": {"user": ["alice"]},
+		"requests": [
+			{"method": "post", "url": "/users/{{pick .user}}/{{randInt 5 5}}", "headers": {"Host": "{{pick \"example.com\"}}", "X-Seq": "{{seq}}"}, "body": "{{randString 4}}"}
+		]
+	}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	i, err := newGeneratorInput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for seq := 1; seq <= 2; seq++ {
+		payload, err := i.generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if payload[0] != RequestPayload {
+			t.Error("Expected request payload, got", string(payload))
+		}
+
+		body := payloadBody(payload)
+		expected := "POST /users/alice/5 HTTP/1.1\r\nHost: example.com\r\nX-Seq: " + string('0'+rune(seq)) + "\r\nContent-Length: 4\r\n\r\n"
+		if !bytes.HasPrefix(body, []byte(expected)) || len(body) != len(expected)+4 {
+			t.Errorf("Expected %q, got %q", expected, body)
+		}
+	}
+
+	for _, invalid := range []string{`{}`, `{"requests": [{"url": "{{unknown}}"}]}`, `{"requests": [{"url": "/", "weight": -1}]}`} {
+		path := writeGeneratorTemplate(t, invalid)
+		if _, err := newGeneratorInput(path); err == nil {
+			t.Errorf("Template %s should not be accepted", invalid)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func TestGeneratorInputWeights(t *testing.T) {
+	path := writeGeneratorTemplate(t, `{"requests": [{"url": "/a", "weight": 1}, {"url": "/b", "weight": 3}]}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	i, _ := newGeneratorInput(path)
+
+	counts := make(map[string]int)
+	for n := 0; n < 1000; n++ {
+		payload, _ := i.generate()
+		counts[string(bytes.Fields(payloadBody(payload))[1])]++
+	}
+
+	if counts["/a"] < 150 || counts["/a"] > 350 || counts["/a"]+counts["/b"] != 1000 {
+		t.Errorf("Expected requests to be picked by weight, got %v", counts)
+	}
+}
+
+func TestGeneratorInputRate(t *testing.T) {
+	path := writeGeneratorTemplate(t, `{"rps": 100, "requests": [{"url": "/"}]}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	input := NewGeneratorInput(path)
+	defer input.Close()
+
+	start := time.Now()
+	buf := make([]byte, 1000)
+	for n := 0; n < 11; n++ {
+		input.Read(buf)
+	}
+
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected 10 intervals of 10ms, got %s", elapsed)
+	}
+}
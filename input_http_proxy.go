@@ -0,0 +1,121 @@
+package goreplay
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+type httpProxyRequestKey struct{}
+
+// httpProxyRequest is passed in context of proxied request, so its response gets the same payload ID
+type httpProxyRequest struct {
+	id    []byte
+	start time.Time
+}
+
+// HTTPProxyInputConfig holds configuration of reverse proxy input
+type HTTPProxyInputConfig struct {
+	// Address of upstream, e.g. `http://backend:8080`
+	upstream string
+}
+
+// HTTPProxyInput is inline reverse proxy, for environments where traffic can't be captured. Requests are forwarded to
+// upstream and its responses are returned to clients, and at the same time both are emitted to outputs, the same as
+// request and response payloads of RAWInput. Payloads are dropped if outputs can't process them fast enough, so proxy
+// never waits for them.
+type HTTPProxyInput struct {
+	data     chan []byte
+	address  string
+	listener net.Listener
+	server   *http.Server
+	proxy    *httputil.ReverseProxy
+}
+
+// NewHTTPProxyInput constructor for HTTPProxyInput. Accepts address with port which it will listen on.
+func NewHTTPProxyInput(address string, config *HTTPProxyInputConfig) (i *HTTPProxyInput) {
+	upstream, err := url.Parse(config.upstream)
+	if err != nil || upstream.Host == "" {
+		log.Fatalf("proxy-upstream error: invalid upstream address %q\n", config.upstream)
+	}
+
+	i = new(HTTPProxyInput)
+	i.data = make(chan []byte, 10000)
+	i.address = address
+	i.proxy = httputil.NewSingleHostReverseProxy(upstream)
+	i.proxy.ModifyResponse = i.response
+
+	i.listener, err = net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal("HTTP proxy input listener failure:", err)
+	}
+
+	i.server = &http.Server{Handler: i}
+	go func() {
+		if err := i.server.Serve(i.listener); err != nil && err != http.ErrServerClosed {
+			log.Fatal("HTTP proxy input serve failure:", err)
+		}
+	}()
+
+	return
+}
+
+func (i *HTTPProxyInput) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &httpProxyRequest{id: uuid(), start: time.Now()}
+
+	// Body is read into memory, and restored for proxy
+	if buf, err := httputil.DumpRequest(r, true); err == nil {
+		header := payloadHeader(RequestPayload, req.id, req.start.UnixNano(), -1)
+		header = payloadAddrHeader(header, r.RemoteAddr)
+		i.emit(append(header, buf...))
+	}
+
+	i.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), httpProxyRequestKey{}, req)))
+}
+
+// response emits upstream response before it is returned to client
+func (i *HTTPProxyInput) response(resp *http.Response) error {
+	req, ok := resp.Request.Context().Value(httpProxyRequestKey{}).(*httpProxyRequest)
+	if !ok {
+		return nil
+	}
+
+	buf, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	header := payloadHeader(ResponsePayload, req.id, now.UnixNano(), now.Sub(req.start).Nanoseconds())
+	i.emit(append(header, buf...))
+
+	return nil
+}
+
+func (i *HTTPProxyInput) emit(payload []byte) {
+	select {
+	case i.data <- payload:
+	default:
+		Debug("[INPUT-HTTP-PROXY] Dropping requests because output can't process them fast enough")
+	}
+}
+
+func (i *HTTPProxyInput) Read(data []byte) (int, error) {
+	buf := <-i.data
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (i *HTTPProxyInput) String() string {
+	return "HTTP proxy input: " + i.address
+}
+
+// Close stops accepting requests
+func (i *HTTPProxyInput) Close() error {
+	return i.server.Close()
+}
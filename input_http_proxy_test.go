@@ -0,0 +1,70 @@
+package goreplay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHTTPProxyInput(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", "1")
+		w.Write(append([]byte("echo "), body...))
+	}))
+	defer upstream.Close()
+
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	var mu sync.Mutex
+	payloads := make(map[byte][]byte)
+	input := NewHTTPProxyInput("127.0.0.1:0", &HTTPProxyInputConfig{upstream: upstream.URL})
+	output := NewTestOutput(func(data []byte) {
+		mu.Lock()
+		payloads[data[0]] = append([]byte{}, data...)
+		mu.Unlock()
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+
+	go Start(plugins, quit)
+	defer close(quit)
+
+	wg.Add(2)
+	resp, err := http.Post("http://"+input.listener.Addr().String()+"/api?a=1", "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "echo ping" || resp.Header.Get("X-Upstream") != "1" {
+		t.Errorf("client should get upstream response, got %q", body)
+	}
+
+	wg.Wait()
+
+	req, res := payloads[RequestPayload], payloads[ResponsePayload]
+	if !bytes.HasPrefix(payloadBody(req), []byte("POST /api?a=1 HTTP/1.1\r\n")) || !bytes.HasSuffix(req, []byte("\r\n\r\nping")) {
+		t.Errorf("unexpected request payload %q", req)
+	}
+	if payloadClientAddr(req) == "" {
+		t.Error("request should have client address")
+	}
+	if !bytes.HasPrefix(payloadBody(res), []byte("HTTP/1.1 200 OK\r\n")) || !bytes.HasSuffix(res, []byte("echo ping")) {
+		t.Errorf("unexpected response payload %q", res)
+	}
+	if !bytes.Equal(payloadMeta(req)[1], payloadMeta(res)[1]) {
+		t.Error("response should have ID of request")
+	}
+}
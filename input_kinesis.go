@@ -0,0 +1,247 @@
+package goreplay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// KinesisInput reads payloads put by KinesisOutput from AWS Kinesis data stream, using enhanced fan-out consumer, so
+// each Gor instance reading the stream has dedicated throughput. Consumer is registered if it does not exist. All open
+// shards are read from the latest record, and children of closed shards from their start. Aggregated records are
+// de-aggregated.
+type KinesisInput struct {
+	stream string
+	config *KinesisConfig
+	client *awsClient
+
+	consumerARN string
+	data        chan []byte
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	mu         sync.Mutex
+	subscribed map[string]bool
+}
+
+type kinesisStartingPosition struct {
+	Type           string
+	SequenceNumber string `json:",omitempty"`
+}
+
+type kinesisShardEvent struct {
+	Records []struct {
+		Data           []byte
+		SequenceNumber string
+	}
+	ContinuationSequenceNumber *string
+	ChildShards                []struct {
+		ShardID string `json:"ShardId"`
+	}
+}
+
+// NewKinesisInput constructor for KinesisInput, accepts stream name or ARN
+func NewKinesisInput(stream string, config *KinesisConfig) *KinesisInput {
+	name, region := parseKinesisStream(stream)
+	if config.region != "" {
+		region = config.region
+	} else if region == "" {
+		region = awsRegion()
+	}
+
+	client, err := newAWSClient("kinesis", kinesisTarget, region, config.endpoint)
+	if err != nil {
+		log.Fatalln("input-kinesis error:", err)
+	}
+
+	i := &KinesisInput{
+		stream:     name,
+		config:     config,
+		client:     client,
+		data:       make(chan []byte),
+		subscribed: make(map[string]bool),
+	}
+	i.ctx, i.cancel = context.WithCancel(context.Background())
+
+	if i.consumerARN, err = i.registerConsumer(); err != nil {
+		log.Fatalln("input-kinesis error:", err)
+	}
+
+	var shards struct {
+		Shards []struct {
+			ShardID             string `json:"ShardId"`
+			SequenceNumberRange struct {
+				EndingSequenceNumber string
+			}
+		}
+	}
+	if err := client.call("ListShards", map[string]string{"StreamName": name}, &shards); err != nil {
+		log.Fatalln("input-kinesis error:", err)
+	}
+	for _, s := range shards.Shards {
+		if s.SequenceNumberRange.EndingSequenceNumber == "" {
+			i.subscribe(s.ShardID, kinesisStartingPosition{Type: "LATEST"})
+		}
+	}
+
+	return i
+}
+
+// registerConsumer registers enhanced fan-out consumer, or finds existing one, and waits until it is active
+func (i *KinesisInput) registerConsumer() (string, error) {
+	var summary struct {
+		StreamDescriptionSummary struct {
+			StreamARN string
+		}
+	}
+	if err := i.client.call("DescribeStreamSummary", map[string]string{"StreamName": i.stream}, &summary); err != nil {
+		return "", err
+	}
+	streamARN := summary.StreamDescriptionSummary.StreamARN
+
+	// Consumer registered by previous run is reused
+	err := i.client.call("RegisterStreamConsumer", map[string]string{"StreamARN": streamARN, "ConsumerName": i.config.consumer}, nil)
+	if e, ok := err.(*awsError); err != nil && !(ok && e.Type == "ResourceInUseException") {
+		return "", err
+	}
+
+	for deadline := time.Now().Add(2 * time.Minute); ; time.Sleep(2 * time.Second) {
+		var described struct {
+			ConsumerDescription struct {
+				ConsumerARN    string
+				ConsumerStatus string
+			}
+		}
+		if err := i.client.call("DescribeStreamConsumer", map[string]string{"StreamARN": streamARN, "ConsumerName": i.config.consumer}, &described); err != nil {
+			return "", err
+		}
+		if described.ConsumerDescription.ConsumerStatus == "ACTIVE" {
+			return described.ConsumerDescription.ConsumerARN, nil
+		}
+		if time.Now().After(deadline) {
+			return "", errors.New("consumer " + i.config.consumer + " is " + described.ConsumerDescription.ConsumerStatus)
+		}
+	}
+}
+
+// subscribe starts reading shard, if it is not read yet
+func (i *KinesisInput) subscribe(shardID string, position kinesisStartingPosition) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.subscribed[shardID] {
+		return
+	}
+	i.subscribed[shardID] = true
+
+	go i.readShard(shardID, position)
+}
+
+// readShard reads records of shard. Subscription expires after 5 minutes, and is renewed from the last read record.
+func (i *KinesisInput) readShard(shardID string, position kinesisStartingPosition) {
+	for {
+		closed, err := i.subscription(shardID, &position)
+		if closed || i.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("[KINESIS-INPUT] shard %s error: %v\n", shardID, err)
+
+			select {
+			case <-i.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// subscription reads events of single subscription to shard, and updates position to the last read record. It returns
+// true when shard is closed and its children are subscribed.
+func (i *KinesisInput) subscription(shardID string, position *kinesisStartingPosition) (bool, error) {
+	req, err := i.client.request("SubscribeToShard", map[string]interface{}{
+		"ConsumerARN":      i.consumerARN,
+		"ShardId":          shardID,
+		"StartingPosition": position,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := i.client.stream.Do(req.WithContext(i.ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if err := awsResponseError(resp); err != nil {
+		return false, err
+	}
+
+	for {
+		headers, payload, err := readEventStreamMessage(resp.Body)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if headers[":message-type"] == "exception" {
+			return false, errors.New(headers[":exception-type"] + ": " + string(payload))
+		}
+		if headers[":event-type"] != "SubscribeToShardEvent" {
+			continue
+		}
+
+		var event kinesisShardEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return false, err
+		}
+
+		for _, record := range event.Records {
+			for _, data := range kplDeaggregate(record.Data) {
+				select {
+				case <-i.ctx.Done():
+					return false, nil
+				case i.data <- data:
+				}
+			}
+			*position = kinesisStartingPosition{Type: "AFTER_SEQUENCE_NUMBER", SequenceNumber: record.SequenceNumber}
+		}
+
+		if event.ContinuationSequenceNumber == nil {
+			for _, child := range event.ChildShards {
+				i.subscribe(child.ShardID, kinesisStartingPosition{Type: "TRIM_HORIZON"})
+			}
+			return true, nil
+		}
+		*position = kinesisStartingPosition{Type: "AFTER_SEQUENCE_NUMBER", SequenceNumber: *event.ContinuationSequenceNumber}
+	}
+}
+
+func (i *KinesisInput) Read(data []byte) (int, error) {
+	var buf []byte
+	select {
+	case <-i.ctx.Done():
+		return 0, io.EOF
+	case buf = <-i.data:
+	}
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (i *KinesisInput) String() string {
+	return "Kinesis input: " + i.stream
+}
+
+// Close stops reading shards
+func (i *KinesisInput) Close() error {
+	i.cancel()
+	return nil
+}
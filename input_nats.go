@@ -0,0 +1,224 @@
+package goreplay
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"time"
+)
+
+// JetStream messages are pulled in batches of this size, pull request expires if there are no messages
+const (
+	natsPullBatch   = 100
+	natsPullExpires = 5 * time.Second
+)
+
+// NATSInput reads payloads published by NATSOutput from NATS subject, using core subscription, optionally in queue
+// group, or durable pull consumer of JetStream stream. JetStream messages are acknowledged after they are read, and
+// consumer resumes from the first unacknowledged message after restart. Connection is re-established after it is lost.
+type NATSInput struct {
+	address *url.URL
+	subject string
+	config  *NATSConfig
+	data    chan []byte
+	quit    chan struct{}
+}
+
+// NewNATSInput constructor for NATSInput, accepts address in `nats://[user:password@]host[:port]/subject` format
+func NewNATSInput(address string, config *NATSConfig) *NATSInput {
+	u, subject, err := parseNATSAddress(address)
+	if err != nil {
+		log.Fatalln("input-nats error:", err)
+	}
+
+	i := &NATSInput{
+		address: u,
+		subject: subject,
+		config:  config,
+		data:    make(chan []byte),
+		quit:    make(chan struct{}),
+	}
+
+	conn, err := i.connect()
+	if err != nil {
+		log.Fatalln("input-nats error:", err)
+	}
+
+	go func() {
+		for {
+			i.read(conn)
+			conn.Close()
+
+			for {
+				select {
+				case <-i.quit:
+					return
+				case <-time.After(time.Second):
+				}
+
+				if conn, err = i.connect(); err == nil {
+					break
+				}
+				log.Println("[NATS-INPUT] connection error:", err)
+			}
+		}
+	}()
+
+	return i
+}
+
+// connect dials server and subscribes to subject, or creates durable consumer
+func (i *NATSInput) connect() (*natsConn, error) {
+	conn, err := dialNATS(i.address)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.config.stream != "" {
+		err = i.createConsumer(conn)
+	} else {
+		_, err = conn.subscribe(i.subject, i.config.queue, func(msg natsMsg) {
+			select {
+			case <-i.quit:
+			case i.data <- msg.data:
+			}
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// createConsumer creates durable pull consumer of messages of subject, or finds existing one. New consumer starts
+// from messages published after it is created.
+func (i *NATSInput) createConsumer(conn *natsConn) error {
+	request, _ := json.Marshal(map[string]interface{}{
+		"stream_name": i.config.stream,
+		"config": map[string]interface{}{
+			"durable_name":   i.config.durable,
+			"deliver_policy": "new",
+			"ack_policy":     "explicit",
+			"filter_subject": i.subject,
+		},
+	})
+
+	msg, err := conn.request("$JS.API.CONSUMER.DURABLE.CREATE."+i.config.stream+"."+i.config.durable, request, natsAckTimeout)
+	if err != nil {
+		return err
+	}
+
+	var response natsAPIError
+	if err := json.Unmarshal(msg.data, &response); err != nil {
+		return err
+	}
+
+	return response.err()
+}
+
+// read reads messages until connection is closed or input is stopped
+func (i *NATSInput) read(conn *natsConn) {
+	if i.config.stream == "" {
+		select {
+		case <-i.quit:
+		case <-conn.closed:
+			log.Println("[NATS-INPUT] connection error:", conn.err)
+		}
+		return
+	}
+
+	for {
+		if err := i.pull(conn); err != nil {
+			select {
+			case <-i.quit:
+			default:
+				log.Println("[NATS-INPUT] pull error:", err)
+			}
+			return
+		}
+	}
+}
+
+// pull requests batch of messages from consumer and reads them, until batch is complete or request expires
+func (i *NATSInput) pull(conn *natsConn) error {
+	messages := make(chan natsMsg, natsPullBatch+1)
+	reply := conn.newInbox(func(msg natsMsg) {
+		select {
+		case messages <- msg:
+		default:
+		}
+	})
+	defer conn.cancelInbox(reply)
+
+	request, _ := json.Marshal(map[string]interface{}{
+		"batch":   natsPullBatch,
+		"expires": natsPullExpires.Nanoseconds(),
+	})
+	if err := conn.publish("$JS.API.CONSUMER.MSG.NEXT."+i.config.stream+"."+i.config.durable, reply, request); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	// Acknowledgements are buffered and sent when batch ends
+	defer conn.Flush()
+
+	timeout := time.After(natsPullExpires + natsAckTimeout)
+	for received := 0; received < natsPullBatch; {
+		select {
+		case <-i.quit:
+			return errors.New("input is closed")
+		case <-conn.closed:
+			return conn.err
+		case <-timeout:
+			return nil
+		case msg := <-messages:
+			// Status messages, e.g. 404 if there are no messages or 408 if request expired, end the batch
+			if msg.status == "404" || msg.status == "408" {
+				return nil
+			}
+			if msg.status != "" {
+				return errors.New("pull request status " + msg.status + " " + string(msg.data))
+			}
+
+			select {
+			case <-i.quit:
+				return errors.New("input is closed")
+			case i.data <- msg.data:
+			}
+			if err := conn.publish(msg.reply, "", []byte("+ACK")); err != nil {
+				return err
+			}
+			received++
+		}
+	}
+
+	return nil
+}
+
+func (i *NATSInput) Read(data []byte) (int, error) {
+	var buf []byte
+	select {
+	case <-i.quit:
+		return 0, io.EOF
+	case buf = <-i.data:
+	}
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (i *NATSInput) String() string {
+	return "NATS input: " + i.address.Host + "/" + i.subject
+}
+
+// Close stops reading messages, JetStream messages which are not acknowledged are redelivered
+func (i *NATSInput) Close() error {
+	close(i.quit)
+	return nil
+}
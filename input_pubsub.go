@@ -0,0 +1,107 @@
+package goreplay
+
+import (
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// PubSubInput pulls payloads published by PubSubOutput from Google Cloud Pub/Sub subscription. Messages are
+// acknowledged after all pulled messages are read, so messages with ordering key are read in order they were published.
+type PubSubInput struct {
+	subscription string
+	client       *pubsubClient
+	data         chan []byte
+	quit         chan struct{}
+}
+
+// NewPubSubInput constructor for PubSubInput, accepts subscription in `projects/<project>/subscriptions/<subscription>`
+// format
+func NewPubSubInput(subscription string, config *PubSubConfig) *PubSubInput {
+	if !strings.HasPrefix(subscription, "projects/") || !strings.Contains(subscription, "/subscriptions/") {
+		log.Fatalln("input-pubsub error: subscription should be in projects/<project>/subscriptions/<subscription> format, got", subscription)
+	}
+
+	client, err := newPubSubClient(config)
+	if err != nil {
+		log.Fatalln("input-pubsub error:", err)
+	}
+
+	i := &PubSubInput{
+		subscription: subscription,
+		client:       client,
+		data:         make(chan []byte),
+		quit:         make(chan struct{}),
+	}
+
+	go i.pull()
+
+	return i
+}
+
+func (i *PubSubInput) pull() {
+	request := struct {
+		MaxMessages int `json:"maxMessages"`
+	}{pubsubMaxBatchSize}
+
+	for {
+		var response struct {
+			ReceivedMessages []struct {
+				AckID   string        `json:"ackId"`
+				Message pubsubMessage `json:"message"`
+			} `json:"receivedMessages"`
+		}
+
+		if err := i.client.call(i.subscription+":pull", &request, &response); err != nil {
+			log.Println("[PUBSUB-INPUT] pull error:", err)
+
+			select {
+			case <-i.quit:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		ack := struct {
+			AckIDs []string `json:"ackIds"`
+		}{}
+		for _, m := range response.ReceivedMessages {
+			select {
+			case <-i.quit:
+				return
+			case i.data <- m.Message.Data:
+			}
+			ack.AckIDs = append(ack.AckIDs, m.AckID)
+		}
+
+		if len(ack.AckIDs) > 0 {
+			if err := i.client.call(i.subscription+":acknowledge", &ack, nil); err != nil {
+				log.Println("[PUBSUB-INPUT] acknowledge error:", err)
+			}
+		}
+	}
+}
+
+func (i *PubSubInput) Read(data []byte) (int, error) {
+	var buf []byte
+	select {
+	case <-i.quit:
+		return 0, io.EOF
+	case buf = <-i.data:
+	}
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (i *PubSubInput) String() string {
+	return "Pub/Sub input: " + i.subscription
+}
+
+// Close stops pulling messages, messages which are not acknowledged are redelivered
+func (i *PubSubInput) Close() error {
+	close(i.quit)
+	return nil
+}
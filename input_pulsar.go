@@ -0,0 +1,143 @@
+package goreplay
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Consumer receives this many messages before they are acknowledged
+const pulsarReceiverQueueSize = 1000
+
+type pulsarConsumerMessage struct {
+	MessageID string `json:"messageId"`
+	Payload   []byte `json:"payload"`
+}
+
+// PulsarInput consumes payloads published by PulsarOutput from Apache Pulsar topic, using WebSocket API of broker.
+// Subscription is Key_Shared by default, so consumers of the same subscription split traffic by sessions, and each
+// session is replayed in order. Messages are acknowledged after they are read, so unread messages are redelivered after
+// restart. Connection is re-established after it is lost.
+type PulsarInput struct {
+	address  *url.URL
+	topic    string
+	config   *PulsarConfig
+	messages chan pulsarConsumerMessage
+	data     chan []byte
+	quit     chan struct{}
+}
+
+// NewPulsarInput constructor for PulsarInput, accepts address in `ws://host[:port]/[persistent/]tenant/namespace/topic`
+// format
+func NewPulsarInput(address string, config *PulsarConfig) *PulsarInput {
+	u, topic, err := parsePulsarAddress(address)
+	if err != nil {
+		log.Fatalln("input-pulsar error:", err)
+	}
+
+	i := &PulsarInput{
+		address:  u,
+		topic:    topic,
+		config:   config,
+		messages: make(chan pulsarConsumerMessage, pulsarReceiverQueueSize),
+		data:     make(chan []byte),
+		quit:     make(chan struct{}),
+	}
+
+	conn, err := i.connect()
+	if err != nil {
+		log.Fatalln("input-pulsar error:", err)
+	}
+
+	go func() {
+		for {
+			i.read(conn)
+			conn.Close()
+
+			for {
+				select {
+				case <-i.quit:
+					return
+				case <-time.After(time.Second):
+				}
+
+				if conn, err = i.connect(); err == nil {
+					break
+				}
+				log.Println("[PULSAR-INPUT] connection error:", err)
+			}
+		}
+	}()
+
+	return i
+}
+
+func (i *PulsarInput) connect() (*pulsarConn, error) {
+	query := url.Values{}
+	query.Set("subscriptionType", i.config.subscriptionType)
+	query.Set("receiverQueueSize", strconv.Itoa(pulsarReceiverQueueSize))
+
+	return dialPulsar(i.address, "consumer/"+i.topic+"/"+url.PathEscape(i.config.subscription), query, i.config.token, func(data []byte) {
+		var msg pulsarConsumerMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.MessageID == "" {
+			return
+		}
+
+		select {
+		case <-i.quit:
+		case i.messages <- msg:
+		}
+	})
+}
+
+// read reads messages until connection is closed or input is stopped. Messages received by previous connection are
+// read too, broker may ignore their acknowledgements and redeliver them.
+func (i *PulsarInput) read(conn *pulsarConn) {
+	for {
+		select {
+		case <-i.quit:
+			return
+		case <-conn.closed:
+			log.Println("[PULSAR-INPUT] connection error:", conn.err)
+			return
+		case msg := <-i.messages:
+			select {
+			case <-i.quit:
+				return
+			case i.data <- msg.Payload:
+			}
+
+			ack, _ := json.Marshal(map[string]string{"messageId": msg.MessageID})
+			conn.send(ack)
+			// Acknowledgements are sent when there are no more messages to read
+			if len(i.messages) == 0 {
+				conn.Flush()
+			}
+		}
+	}
+}
+
+func (i *PulsarInput) Read(data []byte) (int, error) {
+	var buf []byte
+	select {
+	case <-i.quit:
+		return 0, io.EOF
+	case buf = <-i.data:
+	}
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (i *PulsarInput) String() string {
+	return "Pulsar input: " + i.address.Host + "/" + i.topic
+}
+
+// Close stops consuming, messages which are not acknowledged are redelivered
+func (i *PulsarInput) Close() error {
+	close(i.quit)
+	return nil
+}
@@ -1,12 +1,27 @@
-package main
+package goreplay
 
 import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
 	"net"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/buger/goreplay/fastcgi"
+	"github.com/buger/goreplay/http2"
+	"github.com/buger/goreplay/mongo"
+	"github.com/buger/goreplay/mysql"
+	"github.com/buger/goreplay/postgres"
 	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/quic"
 	raw "github.com/buger/goreplay/raw_socket_listener"
+	"github.com/buger/goreplay/redis"
+	"github.com/google/gopacket/layers"
 )
 
 // RAWInput used for intercepting traffic for given address
@@ -18,10 +33,61 @@ type RAWInput struct {
 	engine        int
 	realIPHeader  []byte
 	trackResponse bool
-	listener      *raw.Listener
+	listeners     []*raw.Listener
 	bpfFilter     string
 	timestampType string
 	bufferSize    int64
+
+	// Message which does not fit into emitter buffer is read in chunks
+	chunker *payloadChunker
+
+	// DNS mode: DNS over UDP and TCP is captured, payloads contain DNS messages without TCP length prefix
+	dns       bool
+	dnsFilter func(query *layers.DNS) bool
+
+	// MySQL mode: payloads of requests contain replayable commands in text form, responses are raw server packets
+	mysql         bool
+	mysqlSessions *mysql.Sessions
+	mysqlFilter   func(cmd *mysql.Command) bool
+
+	// PostgreSQL mode: same as MySQL mode, but batch of extended query protocol can contain multiple commands
+	postgres         bool
+	postgresSessions *postgres.Sessions
+	postgresFilter   func(cmd *postgres.Command) bool
+	// Payloads decoded together with previously returned one: commands of PostgreSQL batch following the first one,
+	// which are read with new IDs, or HTTP/3 and HTTP/2 messages completed by the same QUIC datagram or TCP segment
+	pending [][]byte
+	// Connections whose last request contained commands accepted by filter
+	postgresAccepted map[string]bool
+
+	// Redis mode: same as MySQL mode, payloads of requests contain commands with selected database
+	redis         bool
+	redisSessions *redis.Sessions
+	redisFilter   func(cmd *redis.Command) bool
+
+	// MongoDB mode: payloads of requests contain replayable commands, responses are raw server messages
+	mongo       bool
+	mongoFilter func(cmd *mongo.Command) bool
+
+	// FastCGI mode: requests of web server to application are translated into equivalent HTTP messages
+	fastcgi bool
+
+	// QUIC mode: connections are decrypted using key log, and HTTP/3 messages are translated into HTTP/1.1 messages
+	quic         bool
+	quicSessions *quic.Sessions
+
+	// HTTP/2 mode: connections are reassembled from TCP segments, and their messages are translated into HTTP/1.1
+	// messages, see http2.Sessions
+	http2         bool
+	http2Sessions *http2.Sessions
+
+	// Add address of client to request payload headers, see payloadAddrHeader
+	clientAddr bool
+	// Percent of sessions which are captured, 0 if all traffic is captured, and key identifying sessions
+	sampleSessions float64
+	sessionKey     string
+	// Add metadata of pod which received request to payload headers, see payloadK8sHeader
+	k8sPods *k8sPods
 }
 
 // Available engines for intercepting traffic
@@ -29,6 +95,9 @@ const (
 	EngineRawSocket = 1 << iota
 	EnginePcap
 	EnginePcapFile
+	EngineEBPF
+	EngineAFPacket
+	EngineXDP
 )
 
 // NewRAWInput constructor for RAWInput. Accepts address with port as argument.
@@ -44,32 +113,567 @@ func NewRAWInput(address string, engine int, trackResponse bool, expire time.Dur
 	i.trackResponse = trackResponse
 	i.timestampType = timestampType
 	i.bufferSize = bufferSize
+	i.dns = Settings.inputRAWProtocol == "dns"
+	i.dnsFilter = Settings.inputRAWDNSFilter
+	i.mysql = Settings.inputRAWProtocol == "mysql"
+	i.mysqlSessions = mysql.NewSessions(time.Hour)
+	i.mysqlFilter = Settings.inputRAWMySQLFilter
+	i.postgres = Settings.inputRAWProtocol == "postgres"
+	i.postgresSessions = postgres.NewSessions(time.Hour)
+	i.postgresFilter = Settings.inputRAWPostgresFilter
+	i.postgresAccepted = make(map[string]bool)
+	i.redis = Settings.inputRAWProtocol == "redis"
+	i.redisSessions = redis.NewSessions(time.Hour)
+	i.redisFilter = Settings.inputRAWRedisFilter
+	i.mongo = Settings.inputRAWProtocol == "mongo"
+	i.mongoFilter = Settings.inputRAWMongoFilter
+	i.fastcgi = Settings.inputRAWProtocol == "fastcgi"
+	i.quic = Settings.inputRAWProtocol == "quic"
+	if i.quic {
+		i.quicSessions = quic.NewSessions(quic.NewKeyLog(Settings.inputRAWQUICKeyLog), time.Hour)
+	}
+	i.http2 = Settings.inputRAWProtocol == "http2"
+	if i.http2 {
+		i.http2Sessions = http2.NewSessions(time.Hour)
+	}
+	i.clientAddr = Settings.inputRAWClientAddr
+	i.sampleSessions = Settings.inputRAWSampleSessions
+	i.sessionKey = Settings.inputRAWSessionKey
+	i.k8sPods = Settings.inputRAWK8sPods
 
 	i.listen(address)
-	i.listener.IsReady()
+	for _, l := range i.listeners {
+		l.IsReady()
+	}
 
 	return
 }
 
 func (i *RAWInput) Read(data []byte) (int, error) {
+	if i.chunker != nil {
+		n, err := i.chunker.Read(data)
+		if err != nil || i.chunker.done() {
+			i.chunker = nil
+		}
+		return n, err
+	}
+
+	if len(i.pending) > 0 {
+		n := copy(data, i.pending[0])
+		i.pending = i.pending[1:]
+		return n, nil
+	}
+
 	msg := <-i.data
-	buf := msg.Bytes()
 
-	var header []byte
+	if i.dns {
+		return i.readDNS(msg, data)
+	}
+
+	if i.mysql {
+		return i.readMySQL(msg, data)
+	}
+
+	if i.postgres {
+		return i.readPostgres(msg, data)
+	}
+
+	if i.redis {
+		return i.readRedis(msg, data)
+	}
+
+	if i.mongo {
+		return i.readMongo(msg, data)
+	}
+
+	if i.fastcgi {
+		return i.readFastCGI(msg, data)
+	}
+
+	if i.quic {
+		return i.readQUIC(msg, data)
+	}
+
+	if i.http2 {
+		return i.readHTTP2(msg, data)
+	}
+
+	// Messages of sessions which are not sampled are skipped
+	for i.sampleSessions > 0 && !i.sessionSampled(msg) {
+		msg.Release()
+		msg = <-i.data
+	}
+
+	header := i.messageHeader(msg)
+
+	// Extra space for Real IP header
+	if size := msg.Size(); len(header)+size+len(i.realIPHeader)+64 >= len(data) {
+		i.chunker = i.messageChunker(msg, header, size, len(data)/2)
+		return i.Read(data)
+	}
 
+	copy(data[0:len(header)], header)
+	n := msg.CopyBytes(data[len(header):])
+
+	// Header is set in place, extra space is left for it above
+	if msg.IsIncoming && len(i.realIPHeader) > 0 {
+		buf := proto.SetHeader(data[len(header):len(header)+n], i.realIPHeader, []byte(msg.IP().String()))
+		n = copy(data[len(header):], buf)
+	}
+	msg.Release()
+
+	return len(header) + n, nil
+}
+
+func messageHeader(msg *raw.TCPMessage) []byte {
 	if msg.IsIncoming {
-		header = payloadHeader(RequestPayload, msg.UUID(), msg.Start.UnixNano(), -1)
+		return payloadHeader(RequestPayload, msg.UUID(), msg.Start.UnixNano(), -1)
+	}
+
+	return payloadHeader(ResponsePayload, msg.UUID(), msg.Start.UnixNano(), msg.End.UnixNano()-msg.AssocMessage.End.UnixNano())
+}
+
+// messageHeader returns payload header of the message, with client address and pod metadata for requests if they are
+// enabled
+func (i *RAWInput) messageHeader(msg *raw.TCPMessage) []byte {
+	header := messageHeader(msg)
+	if i.clientAddr && msg.IsIncoming {
+		header = payloadAddrHeader(header, msg.ClientAddr().String())
+	}
+	if i.k8sPods != nil && msg.IsIncoming {
+		if metadata := i.k8sPods.metadata(msg.ServerAddr()); metadata != "" {
+			header = payloadK8sHeader(header, metadata)
+		}
+	}
+
+	return header
+}
+
+// sessionSampled tells if message belongs to session sampled by --input-raw-sample-sessions. Sessions are sampled by
+// hash of their key, so no state is kept, and responses are sampled by session of their requests. Requests without
+// session key are sampled by their ID, together with their responses.
+func (i *RAWInput) sessionSampled(msg *raw.TCPMessage) bool {
+	request := msg
+	if !msg.IsIncoming && msg.AssocMessage != nil {
+		request = msg.AssocMessage
+	}
+
+	var addr string
+	if a := request.ClientAddr(); a != nil {
+		addr = a.String()
+	}
+
+	var payload []byte
+	if strings.Contains(i.sessionKey, ":") && request.IsIncoming {
+		payload = request.Bytes()
+	}
+
+	key := requestSessionKey(i.sessionKey, addr, payload)
+	if key == "" {
+		key = string(msg.UUID())
+	}
+
+	hasher := fnv.New32a()
+	hasher.Write([]byte(key))
+
+	return float64(hasher.Sum32()%10000) < i.sampleSessions*100
+}
+
+// readDNS skips messages which are not DNS queries and their responses, and queries rejected by filter
+func (i *RAWInput) readDNS(msg *raw.TCPMessage, data []byte) (int, error) {
+	for ; ; msg = <-i.data {
+		query := msg
+		if !msg.IsIncoming {
+			query = msg.AssocMessage
+		}
+
+		q, err := decodeDNS(query.Payload())
+		if err != nil || q.QR {
+			Debug("[INPUT-RAW] Skipping non DNS query:", err)
+			continue
+		}
+
+		if i.dnsFilter != nil && !i.dnsFilter(q) {
+			continue
+		}
+
+		buf := msg.Payload()
+		header := i.messageHeader(msg)
+
+		if len(header)+len(buf) > len(data) {
+			log.Println("input-raw: DNS message does not fit into --copy-buffer-size, skipping")
+			continue
+		}
+
+		copy(data[0:len(header)], header)
+		copy(data[len(header):], buf)
+
+		return len(buf) + len(header), nil
+	}
+}
+
+// readMySQL tracks client sessions, and returns commands which can be replayed. Responses are returned only to commands
+// accepted by filter, if --input-raw-track-response is on.
+func (i *RAWInput) readMySQL(msg *raw.TCPMessage, data []byte) (int, error) {
+	for ; ; msg = <-i.data {
+		conn := msg.ClientAddr().String()
+
+		var buf []byte
+		if msg.IsIncoming {
+			cmd, err := i.mysqlSessions.Request(conn, msg.Bytes(), msg.Start)
+			if err != nil {
+				Debug("[INPUT-RAW] Skipping MySQL command:", err)
+				continue
+			}
+
+			if cmd == nil || i.mysqlFilter != nil && !i.mysqlFilter(cmd) {
+				continue
+			}
+
+			buf, _ = cmd.MarshalText()
+		} else {
+			req := msg.AssocMessage.Bytes()
+			i.mysqlSessions.Response(conn, req, msg.Bytes())
+
+			if !i.trackResponse {
+				continue
+			}
+
+			cmd := i.mysqlSessions.Command(conn, req)
+			if cmd == nil || i.mysqlFilter != nil && !i.mysqlFilter(cmd) {
+				continue
+			}
+
+			buf = msg.Bytes()
+		}
+
+		header := i.messageHeader(msg)
+
+		if len(header)+len(buf) > len(data) {
+			log.Println("input-raw: MySQL message does not fit into --copy-buffer-size, skipping")
+			continue
+		}
+
+		copy(data[0:len(header)], header)
+		copy(data[len(header):], buf)
+
+		return len(buf) + len(header), nil
+	}
+}
+
+// readPostgres tracks client sessions, and returns commands which can be replayed. Response to a batch of extended
+// query protocol is returned once, with ID of its first command, if any of its commands is accepted by filter.
+func (i *RAWInput) readPostgres(msg *raw.TCPMessage, data []byte) (int, error) {
+	for ; ; msg = <-i.data {
+		conn := msg.ClientAddr().String()
+
+		var payloads [][]byte
+		if msg.IsIncoming {
+			cmds, err := i.postgresSessions.Request(conn, msg.Bytes(), msg.Start)
+			if err != nil {
+				Debug("[INPUT-RAW] Skipping PostgreSQL command:", err)
+			}
+
+			id := msg.UUID()
+			for _, cmd := range cmds {
+				if i.postgresFilter != nil && !i.postgresFilter(cmd) {
+					continue
+				}
+
+				text, _ := cmd.MarshalText()
+				header := payloadHeader(RequestPayload, id, msg.Start.UnixNano(), -1)
+				if i.clientAddr {
+					header = payloadAddrHeader(header, msg.ClientAddr().String())
+				}
+				payloads = append(payloads, append(header, text...))
+				id = uuid()
+			}
+
+			if len(payloads) > 0 && i.trackResponse {
+				i.postgresAccepted[conn] = true
+			} else {
+				delete(i.postgresAccepted, conn)
+			}
+		} else {
+			// Server answers requests of connection in order, and response is read right after its request
+			accepted := i.postgresAccepted[conn]
+			delete(i.postgresAccepted, conn)
+			if !accepted {
+				continue
+			}
+
+			payloads = [][]byte{append(i.messageHeader(msg), msg.Bytes()...)}
+		}
+
+		var fit [][]byte
+		for _, p := range payloads {
+			if len(p) > len(data) {
+				log.Println("input-raw: PostgreSQL message does not fit into --copy-buffer-size, skipping")
+				continue
+			}
+			fit = append(fit, p)
+		}
+
+		if len(fit) == 0 {
+			continue
+		}
+
+		i.pending = fit[1:]
+
+		return copy(data, fit[0]), nil
+	}
+}
+
+// readRedis tracks client sessions, and returns commands which can be replayed. Replies are returned only to commands
+// accepted by filter.
+func (i *RAWInput) readRedis(msg *raw.TCPMessage, data []byte) (int, error) {
+	for ; ; msg = <-i.data {
+		conn := msg.ClientAddr().String()
+
+		var buf []byte
+		if msg.IsIncoming {
+			cmd, err := i.redisSessions.Request(conn, msg.Bytes(), msg.Start)
+			if err != nil {
+				Debug("[INPUT-RAW] Skipping Redis command:", err)
+				continue
+			}
+
+			if cmd == nil || i.redisFilter != nil && !i.redisFilter(cmd) {
+				continue
+			}
+
+			buf, _ = cmd.MarshalText()
+		} else {
+			cmd := i.redisSessions.Command(conn, msg.AssocMessage.Bytes())
+			if cmd == nil || i.redisFilter != nil && !i.redisFilter(cmd) {
+				continue
+			}
+
+			buf = msg.Bytes()
+		}
+
+		header := i.messageHeader(msg)
+
+		if len(header)+len(buf) > len(data) {
+			log.Println("input-raw: Redis message does not fit into --copy-buffer-size, skipping")
+			continue
+		}
+
+		copy(data[0:len(header)], header)
+		copy(data[len(header):], buf)
+
+		return len(buf) + len(header), nil
+	}
+}
+
+// readMongo returns commands which can be replayed, and replies to commands accepted by filter
+func (i *RAWInput) readMongo(msg *raw.TCPMessage, data []byte) (int, error) {
+	for ; ; msg = <-i.data {
+		req := msg
+		if !msg.IsIncoming {
+			req = msg.AssocMessage
+		}
+
+		cmd, err := mongo.ParseCommand(req.Bytes())
+		if err != nil {
+			if msg.IsIncoming {
+				Debug("[INPUT-RAW] Skipping MongoDB command:", err)
+			}
+			continue
+		}
+
+		if cmd == nil || i.mongoFilter != nil && !i.mongoFilter(cmd) {
+			continue
+		}
+
+		var buf []byte
+		if msg.IsIncoming {
+			cmd.Connection = msg.ClientAddr().String()
+			buf, _ = cmd.MarshalText()
+		} else {
+			buf = msg.Bytes()
+		}
+
+		header := i.messageHeader(msg)
+
+		if len(header)+len(buf) > len(data) {
+			log.Println("input-raw: MongoDB message does not fit into --copy-buffer-size, skipping")
+			continue
+		}
+
+		copy(data[0:len(header)], header)
+		copy(data[len(header):], buf)
+
+		return len(buf) + len(header), nil
+	}
+}
+
+// readFastCGI translates requests and responses into HTTP messages, management records are skipped. Real IP header
+// and client address are set to address of client connected to web server.
+func (i *RAWInput) readFastCGI(msg *raw.TCPMessage, data []byte) (int, error) {
+	for ; ; msg = <-i.data {
+		var buf []byte
+		var err error
+		var req *fastcgi.Request
+
+		if msg.IsIncoming {
+			if req, err = fastcgi.ParseRequest(msg.Bytes()); req != nil {
+				buf, err = req.HTTP()
+				if err == nil && len(i.realIPHeader) > 0 && req.Param("REMOTE_ADDR") != "" {
+					buf = proto.SetHeader(buf, i.realIPHeader, []byte(req.Param("REMOTE_ADDR")))
+				}
+			}
+		} else {
+			buf, err = fastcgi.ParseResponse(msg.Bytes())
+		}
+
+		if err != nil {
+			Debug("[INPUT-RAW] Skipping FastCGI message:", err)
+			continue
+		}
+
+		if buf == nil {
+			continue
+		}
+
+		header := messageHeader(msg)
+		if i.clientAddr && req != nil {
+			header = payloadAddrHeader(header, fastcgiClientAddr(req, msg))
+		}
+
+		if len(header)+len(buf) > len(data) {
+			log.Println("input-raw: FastCGI message does not fit into --copy-buffer-size, skipping")
+			continue
+		}
+
+		copy(data[0:len(header)], header)
+		copy(data[len(header):], buf)
+
+		return len(buf) + len(header), nil
+	}
+}
+
+// fastcgiClientAddr returns address of client connected to web server, or address of web server if it is not known
+func fastcgiClientAddr(req *fastcgi.Request, msg *raw.TCPMessage) string {
+	if ip := req.Param("REMOTE_ADDR"); ip != "" {
+		port := req.Param("REMOTE_PORT")
+		if port == "" {
+			port = "0"
+		}
+		return net.JoinHostPort(ip, port)
+	}
+
+	return msg.ClientAddr().String()
+}
+
+// readQUIC decrypts QUIC datagrams of client and server, and returns HTTP/3 requests and responses translated into
+// HTTP/1.1 messages. Datagrams which can't be decrypted are skipped.
+func (i *RAWInput) readQUIC(msg *raw.TCPMessage, data []byte) (int, error) {
+	for ; ; msg = <-i.data {
+		client := msg.ClientAddr()
+		if client == nil {
+			continue
+		}
+
+		messages, err := i.quicSessions.Datagram(client.String()+"-"+msg.ServerAddr().String(), msg.IsIncoming, msg.Payload(), msg.Start)
+		if err != nil {
+			Debug("[INPUT-RAW] Skipping QUIC packet:", err)
+		}
+
+		var payloads [][]byte
+		for _, m := range messages {
+			if p := i.translatedPayload(m.Request, m.UUID(), m.Start, m.Latency, m.HTTP, client, len(data)); p != nil {
+				payloads = append(payloads, p)
+			}
+		}
+
+		if len(payloads) == 0 {
+			continue
+		}
+
+		i.pending = payloads[1:]
+
+		return copy(data, payloads[0]), nil
+	}
+}
+
+// readHTTP2 decodes TCP segments of HTTP/2 connections, and returns requests and responses translated into HTTP/1.1,
+// with trailer sections kept as trailer fields of chunked messages
+func (i *RAWInput) readHTTP2(msg *raw.TCPMessage, data []byte) (int, error) {
+	for ; ; msg = <-i.data {
+		client := msg.ClientAddr()
+		if client == nil {
+			continue
+		}
+
+		messages, err := i.http2Sessions.Segment(client.String()+"-"+msg.ServerAddr().String(), msg.IsIncoming, msg.Seq, msg.Bytes(), msg.Start)
+		if err != nil {
+			Debug("[INPUT-RAW] Skipping HTTP/2 connection:", err)
+		}
+
+		var payloads [][]byte
+		for _, m := range messages {
+			if p := i.translatedPayload(m.Request, m.UUID(), m.Start, m.Latency, m.HTTP, client, len(data)); p != nil {
+				payloads = append(payloads, p)
+			}
+		}
+
+		if len(payloads) == 0 {
+			continue
+		}
+
+		i.pending = payloads[1:]
+
+		return copy(data, payloads[0]), nil
+	}
+}
+
+// translatedPayload returns payload of HTTP/3 or HTTP/2 message translated into HTTP/1.1, or nil if it is skipped
+func (i *RAWInput) translatedPayload(request bool, uuid []byte, start time.Time, latency time.Duration, buf []byte, client *net.TCPAddr, size int) []byte {
+	var header []byte
+
+	if request {
+		header = payloadHeader(RequestPayload, uuid, start.UnixNano(), -1)
+		if i.clientAddr {
+			header = payloadAddrHeader(header, client.String())
+		}
 		if len(i.realIPHeader) > 0 {
-			buf = proto.SetHeader(buf, i.realIPHeader, []byte(msg.IP().String()))
+			buf = proto.SetHeader(buf, i.realIPHeader, []byte(client.IP.String()))
 		}
 	} else {
-		header = payloadHeader(ResponsePayload, msg.UUID(), msg.Start.UnixNano(), msg.End.UnixNano()-msg.AssocMessage.End.UnixNano())
+		if !i.trackResponse {
+			return nil
+		}
+		header = payloadHeader(ResponsePayload, uuid, start.UnixNano(), latency.Nanoseconds())
 	}
 
-	copy(data[0:len(header)], header)
-	copy(data[len(header):], buf)
+	if len(header)+len(buf) > size {
+		log.Println("input-raw: translated HTTP message does not fit into --copy-buffer-size, skipping")
+		return nil
+	}
+
+	return append(header, buf...)
+}
+
+// messageChunker streams message body from captured packets. HTTP headers are expected to fit into headSize,
+// which is read in advance to add Real IP header.
+func (i *RAWInput) messageChunker(msg *raw.TCPMessage, header []byte, size int, headSize int) *payloadChunker {
+	body := msg.Reader()
+
+	if msg.IsIncoming && len(i.realIPHeader) > 0 {
+		if headSize > size {
+			headSize = size
+		}
+
+		head := make([]byte, headSize)
+		io.ReadFull(body, head)
+
+		modified := proto.SetHeader(head, i.realIPHeader, []byte(msg.IP().String()))
+		size += len(modified) - len(head)
+		body = io.MultiReader(bytes.NewReader(modified), body)
+	}
 
-	return len(buf) + len(header), nil
+	return newPayloadChunker(header, body, size)
 }
 
 func (i *RAWInput) listen(address string) {
@@ -81,24 +685,260 @@ func (i *RAWInput) listen(address string) {
 		log.Fatalf("input-raw: error while parsing address: %s", err)
 	}
 
-	i.listener = raw.NewListener(host, port, i.engine, i.trackResponse, i.expire, i.bpfFilter, i.timestampType, i.bufferSize, Settings.inputRAWOverrideSnapLen, Settings.inputRAWImmediateMode)
+	// Datagrams, DNS and database messages are not HTTP messages
+	if (Settings.inputRAWEngineConfig.UDP || i.dns || i.mysql || i.postgres || i.redis || i.mongo) && len(i.realIPHeader) > 0 {
+		log.Println("input-raw: --input-raw-realip-header is ignored for UDP, DNS, MySQL, PostgreSQL, Redis and MongoDB traffic")
+		i.realIPHeader = nil
+	}
+
+	configs := []raw.EngineConfig{Settings.inputRAWEngineConfig}
+
+	// Responses to prepared statements are needed to map their IDs, even if responses are not emitted
+	trackResponse := i.trackResponse
+	if i.mysql {
+		configs[0].Framing = raw.FramingMySQL
+		trackResponse = true
+	}
+
+	if i.postgres {
+		configs[0].Framing = raw.FramingPostgres
+	}
+
+	if i.redis {
+		configs[0].Framing = raw.FramingRedis
+	}
+
+	if i.mongo {
+		configs[0].Framing = raw.FramingMongo
+	}
+
+	if i.fastcgi {
+		configs[0].Framing = raw.FramingFastCGI
+	}
+
+	// Sessions are tracked by decoder, datagrams of server are not associated with requests
+	if i.quic {
+		configs[0].UDP = true
+		configs[0].UnpairedDatagrams = true
+		trackResponse = false
+	}
+
+	// Streams are multiplexed over connection, so segments are passed to decoder as they are captured
+	if i.http2 {
+		configs[0].RawSegments = true
+		trackResponse = false
+	}
+
+	// DNS is served over both transports, TCP is used for large responses and zone transfers
+	if i.dns {
+		udp, tcp := Settings.inputRAWEngineConfig, Settings.inputRAWEngineConfig
+		udp.UDP = true
+		tcp.Framing = raw.FramingLengthPrefixed
+		configs = []raw.EngineConfig{udp, tcp}
+	}
+
+	for _, config := range configs {
+		listener := raw.NewListener(host, port, i.engine, trackResponse, i.expire, i.bpfFilter, i.timestampType, i.bufferSize, Settings.inputRAWOverrideSnapLen, Settings.inputRAWImmediateMode, config)
+		i.listeners = append(i.listeners, listener)
+
+		go i.receive(listener.Receiver())
+	}
+
+	if Settings.stats {
+		go i.reportStats()
+	}
+}
+
+func (i *RAWInput) receive(ch chan *raw.TCPMessage) {
+	for {
+		select {
+		case <-i.quit:
+			return
+		default:
+		}
+
+		// Receiving TCPMessage object
+		m := <-ch
+
+		i.data <- m
+	}
+}
+
+func (i *RAWInput) reportStats() {
+	// Drops reported previous time, by listener, interface and worker
+	drops := make(map[string]uint64)
+
+	for {
+		select {
+		case <-i.quit:
+			return
+		case <-time.After(5 * time.Second):
+		}
+
+		for n, listener := range i.listeners {
+			for _, s := range listener.Stats() {
+				iface := s.Interface
+				if iface == "" {
+					iface = "all"
+				}
+
+				log.Printf("input_raw:%s interface:%s worker:%d packets:%d kernel_packets:%d kernel_drops:%d interface_drops:%d ring_usage:%.1f%% freeze_count:%d", i.address, iface, s.Worker, s.Packets, s.KernelPackets, s.KernelDrops, s.InterfaceDrops, s.RingUsage*100, s.FreezeCount)
+
+				key := strconv.Itoa(n) + "/" + iface + "/" + strconv.Itoa(s.Worker)
+				if dropped := s.KernelDrops + s.InterfaceDrops; dropped > drops[key] {
+					log.Printf("input_raw:%s interface:%s dropped %d packets, captured requests may be incomplete. Consider increasing --input-raw-buffer-size or using af_packet engine", i.address, iface, dropped-drops[key])
+					drops[key] = dropped
+				}
+			}
+
+			if i.trackResponse {
+				a := listener.AssemblerStats()
+				log.Printf("input_raw:%s listener:%d unanswered_requests:%d orphan_responses:%d oversized:%d", i.address, n, a.Unanswered, a.Orphans, a.Oversized)
+			}
+		}
+	}
+}
+
+// healthSamples reports packets dropped by kernel for each capture worker, and overflow of TCP assembler of each
+// listener
+func (i *RAWInput) healthSamples() (samples []healthSample) {
+	for n, listener := range i.listeners {
+		for _, s := range listener.Stats() {
+			iface := s.Interface
+			if iface == "" {
+				iface = "all"
+			}
+
+			samples = append(samples, healthSample{
+				check:  healthKernelDrops,
+				source: fmt.Sprintf("input_raw:%s interface:%s worker:%d", i.address, iface, s.Worker),
+				lost:   s.KernelDrops + s.InterfaceDrops,
+			})
+		}
+
+		a := listener.AssemblerStats()
+		usage := float64(a.QueuedPackets) / float64(a.PacketsCapacity)
+		if messages := float64(a.QueuedMessages) / float64(a.MessagesCapacity); messages > usage {
+			usage = messages
+		}
+
+		samples = append(samples, healthSample{
+			check:  healthAssemblerOverflow,
+			source: fmt.Sprintf("input_raw:%s listener:%d", i.address, n),
+			lost:   a.Oversized,
+			usage:  usage,
+		})
+	}
+
+	return
+}
+
+// payloadFilter returns function accepting payloads which match all allow regexps and none of disallow regexps
+func payloadFilter(allow, disallow PayloadRegexps) func(payload []byte) bool {
+	return func(payload []byte) bool {
+		for _, re := range allow {
+			if !re.Match(payload) {
+				return false
+			}
+		}
+
+		for _, re := range disallow {
+			if re.Match(payload) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// mysqlCommandFilter returns function accepting commands with SQL matching all allow regexps and none of disallow regexps.
+// If readOnly is set, only statements which do not modify data are accepted.
+func mysqlCommandFilter(readOnly bool, allow, disallow PayloadRegexps) func(cmd *mysql.Command) bool {
+	match := payloadFilter(allow, disallow)
+
+	return func(cmd *mysql.Command) bool {
+		if readOnly && !mysql.IsReadOnly(cmd.SQL) {
+			return false
+		}
+
+		return match([]byte(cmd.SQL))
+	}
+}
+
+// postgresCommandFilter returns function accepting commands with SQL matching all allow regexps and none of disallow regexps.
+// If readOnly is set, only statements which do not modify data are accepted.
+func postgresCommandFilter(readOnly bool, allow, disallow PayloadRegexps) func(cmd *postgres.Command) bool {
+	match := payloadFilter(allow, disallow)
+
+	return func(cmd *postgres.Command) bool {
+		if readOnly && !postgres.IsReadOnly(cmd.SQL) {
+			return false
+		}
+
+		return match([]byte(cmd.SQL))
+	}
+}
+
+// redisCommandFilter returns function accepting commands matching any of allow list entries, and none of disallow list
+// entries. Entry is a command name, or ACL category like `@write`.
+func redisCommandFilter(allow, disallow []string) func(cmd *redis.Command) bool {
+	match := func(name string, list []string) bool {
+		for _, entry := range list {
+			if strings.HasPrefix(entry, "@") && redis.InCategory(name, entry) || strings.EqualFold(name, entry) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(cmd *redis.Command) bool {
+		name := cmd.Name()
+		if len(allow) > 0 && !match(name, allow) {
+			return false
+		}
 
-	ch := i.listener.Receiver()
+		return !match(name, disallow)
+	}
+}
 
-	go func() {
-		for {
-			select {
-			case <-i.quit:
-				return
-			default:
+// mongoCommandFilter returns function accepting commands matching any of allow lists, and none of disallow lists.
+// Namespaces are matched as `db.collection` and may contain wildcards, e.g. `shop.*`. Command names are case-insensitive.
+// If readOnly is set, only commands which do not modify data are accepted.
+func mongoCommandFilter(readOnly bool, allowNamespace, disallowNamespace, allowCommand, disallowCommand []string) func(cmd *mongo.Command) bool {
+	matchNamespace := func(ns string, list []string) bool {
+		for _, pattern := range list {
+			if ok, _ := path.Match(pattern, ns); ok {
+				return true
 			}
+		}
+		return false
+	}
 
-			// Receiving TCPMessage object
-			m := <-ch
+	matchCommand := func(name string, list []string) bool {
+		for _, entry := range list {
+			if strings.EqualFold(name, entry) {
+				return true
+			}
+		}
+		return false
+	}
 
-			i.data <- m
+	return func(cmd *mongo.Command) bool {
+		if readOnly && !mongo.IsReadOnly(cmd) {
+			return false
 		}
-	}()
+
+		if len(allowNamespace) > 0 && !matchNamespace(cmd.Namespace, allowNamespace) || matchNamespace(cmd.Namespace, disallowNamespace) {
+			return false
+		}
+
+		if len(allowCommand) > 0 && !matchCommand(cmd.Name, allowCommand) {
+			return false
+		}
+
+		return !matchCommand(cmd.Name, disallowCommand)
+	}
 }
 
 func (i *RAWInput) String() string {
@@ -107,7 +947,9 @@ func (i *RAWInput) String() string {
 
 // Close closes the input raw listener
 func (i *RAWInput) Close() error {
-	i.listener.Close()
+	for _, l := range i.listeners {
+		l.Close()
+	}
 	close(i.quit)
 	return nil
 }
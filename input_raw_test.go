@@ -1,7 +1,8 @@
-package main
+package goreplay
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -19,7 +20,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/buger/goreplay/mongo"
+	"github.com/buger/goreplay/mysql"
+	"github.com/buger/goreplay/postgres"
 	"github.com/buger/goreplay/proto"
+	raw "github.com/buger/goreplay/raw_socket_listener"
+	"github.com/buger/goreplay/redis"
 )
 
 const testRawExpire = time.Millisecond * 200
@@ -444,3 +450,136 @@ func BenchmarkRAWInput(b *testing.B) {
 
 	close(quit)
 }
+
+func TestRAWInputSampleSessions(t *testing.T) {
+	input := &RAWInput{sampleSessions: 50, sessionKey: "header:X-User"}
+
+	message := func(incoming bool, port uint16, data string) *raw.TCPMessage {
+		msg := raw.NewTCPMessage(1, 1, incoming, time.Now())
+		msg.AddPacket(&raw.TCPPacket{Addr: net.ParseIP("10.0.0.1").To4(), SrcPort: port, DestPort: 80, Seq: 1, Data: []byte(data)})
+		return msg
+	}
+
+	sampled := 0
+	for user := 0; user < 200; user++ {
+		var decision bool
+		// Requests of user come from different connections
+		for port := uint16(5000); port < 5003; port++ {
+			req := message(true, port, fmt.Sprintf("GET / HTTP/1.1\r\nX-User: %d\r\n\r\n", user))
+			resp := message(false, 80, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+			resp.AssocMessage = req
+
+			ok := input.sessionSampled(req)
+			if port > 5000 && ok != decision {
+				t.Fatalf("Requests of user %d are sampled differently", user)
+			}
+			if input.sessionSampled(resp) != ok {
+				t.Fatalf("Response should be sampled with its request")
+			}
+			decision = ok
+		}
+		if decision {
+			sampled++
+		}
+	}
+
+	if sampled < 70 || sampled > 130 {
+		t.Errorf("Expected about half of 200 sessions, got %d", sampled)
+	}
+}
+
+func TestPayloadFilter(t *testing.T) {
+	var allow, disallow PayloadRegexps
+	allow.Set("^GET")
+	disallow.Set("secret")
+
+	filter := payloadFilter(allow, disallow)
+
+	for payload, expected := range map[string]bool{"GET /": true, "POST /": false, "GET /secret": false} {
+		if filter([]byte(payload)) != expected {
+			t.Error("Wrong filter result", payload)
+		}
+	}
+}
+
+func TestMySQLCommandFilter(t *testing.T) {
+	var allow, disallow PayloadRegexps
+	allow.Set("(?i)from orders")
+	disallow.Set("secret")
+
+	filter := mysqlCommandFilter(true, allow, disallow)
+
+	for sql, expected := range map[string]bool{
+		"SELECT * FROM orders":            true,
+		"SELECT * FROM users":             false,
+		"SELECT secret FROM orders":       false,
+		"DELETE FROM orders WHERE id = 1": false,
+	} {
+		if filter(&mysql.Command{Type: mysql.CommandQuery, SQL: sql}) != expected {
+			t.Error("Wrong filter result", sql)
+		}
+	}
+}
+
+func TestPostgresCommandFilter(t *testing.T) {
+	var allow, disallow PayloadRegexps
+	allow.Set("(?i)from orders")
+	disallow.Set("secret")
+
+	filter := postgresCommandFilter(true, allow, disallow)
+
+	for sql, expected := range map[string]bool{
+		"SELECT * FROM orders":             true,
+		"SELECT * FROM users":              false,
+		"SELECT secret FROM orders":        false,
+		"SELECT * FROM orders FOR UPDATE":  false,
+		"DELETE FROM orders WHERE id = $1": false,
+	} {
+		if filter(&postgres.Command{Type: postgres.CommandExecute, SQL: sql}) != expected {
+			t.Error("Wrong filter result", sql)
+		}
+	}
+}
+
+func TestRedisCommandFilter(t *testing.T) {
+	filter := redisCommandFilter([]string{"@write", "ping"}, []string{"FLUSHALL"})
+
+	for name, expected := range map[string]bool{
+		"set":      true,
+		"PING":     true,
+		"GET":      false,
+		"FLUSHALL": false,
+	} {
+		if filter(&redis.Command{Args: [][]byte{[]byte(name)}}) != expected {
+			t.Error("Wrong filter result", name)
+		}
+	}
+
+	if filter = redisCommandFilter(nil, []string{"@read"}); filter(&redis.Command{Args: [][]byte{[]byte("GET")}}) || !filter(&redis.Command{Args: [][]byte{[]byte("EVAL")}}) {
+		t.Error("Should skip only disallowed commands")
+	}
+}
+
+func TestMongoCommandFilter(t *testing.T) {
+	filter := mongoCommandFilter(false, []string{"shop.*"}, []string{"shop.audit"}, nil, []string{"dropDatabase"})
+
+	for ns, expected := range map[string]bool{
+		"shop.orders": true,
+		"shop.$cmd":   true,
+		"shop.audit":  false,
+		"blog.posts":  false,
+	} {
+		if filter(&mongo.Command{Name: "find", Namespace: ns}) != expected {
+			t.Error("Wrong filter result", ns)
+		}
+	}
+
+	if filter(&mongo.Command{Name: "dropdatabase", Namespace: "shop.$cmd"}) {
+		t.Error("Command names should be case-insensitive")
+	}
+
+	filter = mongoCommandFilter(true, nil, nil, []string{"find", "insert"}, nil)
+	if !filter(&mongo.Command{Name: "find", Namespace: "shop.orders"}) || filter(&mongo.Command{Name: "insert", Namespace: "shop.orders"}) || filter(&mongo.Command{Name: "count", Namespace: "shop.orders"}) {
+		t.Error("Should accept only allowed read-only commands")
+	}
+}
@@ -0,0 +1,75 @@
+package goreplay
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// StdinInput reads payloads from standard input, in Gor or binary format, as written by FileOutput. It allows to
+// compose Gor with other tools, e.g. `zcat requests.gor.gz | gor --input-stdin --output-http staging.com`. Payloads are
+// emitted as fast as they are read, without original timing. Gor stops after input is read.
+type StdinInput struct {
+	data chan []byte
+	exit chan struct{}
+}
+
+// NewStdinInput constructor for StdinInput
+func NewStdinInput() *StdinInput {
+	return newStdinInput(os.Stdin)
+}
+
+func newStdinInput(r io.Reader) *StdinInput {
+	i := &StdinInput{
+		data: make(chan []byte, 1000),
+		exit: make(chan struct{}),
+	}
+
+	go i.read(r)
+
+	return i
+}
+
+func (i *StdinInput) read(r io.Reader) {
+	err := readPayloadStream(bufio.NewReader(r), func(payload []byte) {
+		select {
+		case i.data <- payload:
+		case <-i.exit:
+		}
+	})
+	if err != io.EOF {
+		log.Println("StdinInput: read error:", err)
+	}
+
+	log.Println("StdinInput: end of input")
+
+	// Same as FileInput, outputs get time to send queued payloads
+	time.Sleep(time.Second)
+	if closeCh != nil {
+		Close(closeCh)
+	}
+}
+
+func (i *StdinInput) Read(data []byte) (int, error) {
+	var buf []byte
+	select {
+	case <-i.exit:
+		return 0, io.EOF
+	case buf = <-i.data:
+	}
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (i *StdinInput) String() string {
+	return "Stdin input"
+}
+
+// Close stops emitting payloads
+func (i *StdinInput) Close() error {
+	close(i.exit)
+	return nil
+}
@@ -0,0 +1,50 @@
+package goreplay
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestStdinInput(t *testing.T) {
+	for _, format := range []string{FileFormatGor, FileFormatBinary} {
+		t.Run(format, func(t *testing.T) {
+			var stdin bytes.Buffer
+			if format == FileFormatBinary {
+				stdin.Write(binaryPayloadMagic)
+			}
+			for i := 0; i < 10; i++ {
+				payload := []byte("1 1 1\nGET / HTTP/1.1\r\n\r\n")
+				if format == FileFormatBinary {
+					stdin.Write(encodeBinaryPayload(payload))
+				} else {
+					stdin.Write(payload)
+					stdin.WriteString(payloadSeparator)
+				}
+			}
+
+			wg := new(sync.WaitGroup)
+			wg.Add(10)
+			quit := make(chan int)
+
+			input := newStdinInput(&stdin)
+			output := NewTestOutput(func(data []byte) {
+				if !bytes.Equal(payloadBody(data), []byte("GET / HTTP/1.1\r\n\r\n")) {
+					t.Errorf("unexpected payload %q", data)
+				}
+				wg.Done()
+			})
+
+			plugins := &InOutPlugins{
+				Inputs:  []io.Reader{input},
+				Outputs: []io.Writer{output},
+			}
+
+			go Start(plugins, quit)
+
+			wg.Wait()
+			close(quit)
+		})
+	}
+}
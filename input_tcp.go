@@ -1,4 +1,4 @@
-package main
+package goreplay
 
 import (
 	"bufio"
@@ -15,6 +15,7 @@ import (
 type TCPInput struct {
 	data     chan []byte
 	listener net.Listener
+	network  string
 	address  string
 	config   *TCPInputConfig
 }
@@ -29,6 +30,7 @@ type TCPInputConfig struct {
 func NewTCPInput(address string, config *TCPInputConfig) (i *TCPInput) {
 	i = new(TCPInput)
 	i.data = make(chan []byte, 1000)
+	i.network = "tcp"
 	i.address = address
 	i.config = config
 
@@ -37,6 +39,24 @@ func NewTCPInput(address string, config *TCPInputConfig) (i *TCPInput) {
 	return
 }
 
+// NewUnixInput constructor for TCPInput listening on unix socket, so local processes can send payloads without TCP
+// port. Socket file left by previous run is removed.
+func NewUnixInput(path string, config *TCPInputConfig) (i *TCPInput) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	i = new(TCPInput)
+	i.data = make(chan []byte, 1000)
+	i.network = "unix"
+	i.address = path
+	i.config = config
+
+	i.listen(path)
+
+	return
+}
+
 func (i *TCPInput) Read(data []byte) (int, error) {
 	buf := <-i.data
 	copy(data, buf)
@@ -52,13 +72,13 @@ func (i *TCPInput) listen(address string) {
 		}
 
 		config := &tls.Config{Certificates: []tls.Certificate{cer}}
-		listener, err := tls.Listen("tcp", address, config)
+		listener, err := tls.Listen(i.network, address, config)
 		if err != nil {
 			log.Fatal("Can't start --input-tcp with secure connection:", err)
 		}
 		i.listener = listener
 	} else {
-		listener, err := net.Listen("tcp", address)
+		listener, err := net.Listen(i.network, address)
 		if err != nil {
 			log.Fatal("Can't start:", err)
 		}
@@ -83,19 +103,38 @@ func (i *TCPInput) listen(address string) {
 func (i *TCPInput) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
+	err := readPayloadStream(bufio.NewReader(conn), func(payload []byte) {
+		i.data <- payload
+	})
+	if err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, "Unexpected error in input tcp connection:", err)
+	}
+}
+
+// readPayloadStream reads payloads in Gor or binary format, detected by binaryPayloadMagic, until reader fails. Each
+// payload is passed to emit in its own buffer.
+func readPayloadStream(reader *bufio.Reader, emit func([]byte)) error {
 	payloadSeparatorAsBytes := []byte(payloadSeparator)
-	reader := bufio.NewReader(conn)
 	var buffer bytes.Buffer
 
+	if header, _ := reader.Peek(len(binaryPayloadMagic)); isBinaryPayloadStream(header) {
+		reader.Discard(len(binaryPayloadMagic))
+
+		for {
+			payload, _, err := readBinaryPayload(reader)
+			if err != nil {
+				return err
+			}
+
+			emit(payload)
+		}
+	}
+
 	for {
 		line, err := reader.ReadBytes('\n')
 
 		if err != nil {
-			if err != io.EOF {
-				fmt.Fprintln(os.Stderr, "Unexpected error in input tcp connection:", err)
-			}
-			break
-
+			return err
 		}
 
 		if bytes.Equal(payloadSeparatorAsBytes[1:], line) {
@@ -105,7 +144,7 @@ func (i *TCPInput) handleConnection(conn net.Conn) {
 			newBuf := make([]byte, len(asBytes)-1)
 			copy(newBuf, asBytes)
 
-			i.data <- newBuf
+			emit(newBuf)
 		} else {
 			buffer.Write(line)
 		}
@@ -113,5 +152,8 @@ func (i *TCPInput) handleConnection(conn net.Conn) {
 }
 
 func (i *TCPInput) String() string {
+	if i.network == "unix" {
+		return "Unix input: " + i.address
+	}
 	return "TCP input: " + i.address
 }
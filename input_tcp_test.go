@@ -1,4 +1,4 @@
-package main
+package goreplay
 
 import (
 	"bytes"
@@ -138,3 +138,43 @@ func TestTCPInputSecure(t *testing.T) {
 
 	close(quit)
 }
+
+func TestUnixInputOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gor_unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+	path := dir + "/gor.sock"
+
+	input := NewUnixInput(path, &TCPInputConfig{})
+	output := NewTestOutput(func(data []byte) {
+		if !bytes.Equal(payloadBody(data), []byte("GET / HTTP/1.1\r\n\r\n")) {
+			t.Errorf("unexpected payload %q", data)
+		}
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+
+	go Start(plugins, quit)
+
+	for _, format := range []string{FileFormatGor, FileFormatBinary} {
+		unixOutput := NewUnixOutput(path, &TCPOutputConfig{format: format})
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			unixOutput.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+		}
+
+		wg.Wait()
+	}
+
+	close(quit)
+}
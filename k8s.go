@@ -0,0 +1,270 @@
+package goreplay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Credentials of service account mounted into pods
+const (
+	k8sTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	k8sCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// Interval of listing pods, used to attribute captured traffic
+const k8sPodsRefreshInterval = 30 * time.Second
+
+// k8sClient sends requests to Kubernetes API server
+type k8sClient struct {
+	api       string
+	tokenFile string
+	client    *http.Client
+}
+
+// newK8sClient returns client of API server with given address, e.g. of `kubectl proxy`. Inside cluster API server is
+// reached using service account of the pod if address is empty, otherwise error mentions flag to set it.
+func newK8sClient(api, flag string) (*k8sClient, error) {
+	c := &k8sClient{client: &http.Client{}}
+
+	if api != "" {
+		if !strings.HasPrefix(api, "http") {
+			api = "http://" + api
+		}
+		c.api = strings.TrimSuffix(api, "/")
+
+		return c, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in Kubernetes cluster, set " + flag)
+	}
+
+	ca, err := ioutil.ReadFile(k8sCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	c.api = "https://" + net.JoinHostPort(host, port)
+	c.tokenFile = k8sTokenFile
+	c.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+
+	return c, nil
+}
+
+func (c *k8sClient) get(path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.api+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Token is read for each request, because it is rotated by kubelet
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return resp, nil
+}
+
+type k8sPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec struct {
+			HostNetwork bool `json:"hostNetwork"`
+			Containers  []struct {
+				Name  string `json:"name"`
+				Ports []struct {
+					ContainerPort int `json:"containerPort"`
+				} `json:"ports"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			PodIPs []struct {
+				IP string `json:"ip"`
+			} `json:"podIPs"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// k8sPod is pod metadata encoded as payload metadata, see payloadK8sHeader. Container is picked by port.
+type k8sPod struct {
+	metadata url.Values
+	// Container names by their ports, and name of the only container
+	ports     map[int]string
+	container string
+}
+
+// k8sPods attributes captured traffic to pods, which are listed periodically. Only pods of node given by NODE_NAME
+// environment variable are listed if it is set, e.g. by DaemonSet using downward API.
+type k8sPods struct {
+	client *k8sClient
+	node   string
+	labels []string
+
+	mu   sync.RWMutex
+	pods map[string]*k8sPod
+}
+
+func newK8sPods(api string, labels []string) (*k8sPods, error) {
+	client, err := newK8sClient(api, "--input-raw-k8s-address")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &k8sPods{client: client, node: os.Getenv("NODE_NAME"), labels: labels}
+	if err = p.refresh(); err != nil {
+		log.Println("[K8S] Can't list pods:", err)
+	}
+
+	go func() {
+		for range time.Tick(k8sPodsRefreshInterval) {
+			if err := p.refresh(); err != nil {
+				log.Println("[K8S] Can't list pods:", err)
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+func (p *k8sPods) refresh() error {
+	path := "/api/v1/pods"
+	if p.node != "" {
+		path += "?" + url.Values{"fieldSelector": {"spec.nodeName=" + p.node}}.Encode()
+	}
+
+	resp, err := p.client.get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var list k8sPodList
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+
+	pods := make(map[string]*k8sPod)
+	for _, item := range list.Items {
+		// Pods in host network share node address, so their traffic can't be attributed
+		if item.Spec.HostNetwork {
+			continue
+		}
+
+		pod := &k8sPod{
+			metadata: url.Values{"namespace": {item.Metadata.Namespace}, "pod": {item.Metadata.Name}},
+			ports:    make(map[int]string),
+		}
+		for _, label := range p.labels {
+			if value, ok := item.Metadata.Labels[label]; ok {
+				pod.metadata.Set("label."+label, value)
+			}
+		}
+		for _, c := range item.Spec.Containers {
+			for _, port := range c.Ports {
+				pod.ports[port.ContainerPort] = c.Name
+			}
+		}
+		if len(item.Spec.Containers) == 1 {
+			pod.container = item.Spec.Containers[0].Name
+		}
+
+		ips := []string{item.Status.PodIP}
+		for _, ip := range item.Status.PodIPs {
+			ips = append(ips, ip.IP)
+		}
+		for _, ip := range ips {
+			if ip != "" {
+				pods[ip] = pod
+			}
+		}
+	}
+
+	p.mu.Lock()
+	p.pods = pods
+	p.mu.Unlock()
+
+	return nil
+}
+
+// metadata returns encoded metadata of pod with given address, or empty string if pod is not known
+func (p *k8sPods) metadata(addr *net.TCPAddr) string {
+	if addr == nil {
+		return ""
+	}
+
+	p.mu.RLock()
+	pod := p.pods[addr.IP.String()]
+	p.mu.RUnlock()
+
+	if pod == nil {
+		return ""
+	}
+
+	metadata := url.Values{}
+	for k, v := range pod.metadata {
+		metadata[k] = v
+	}
+
+	if container, ok := pod.ports[addr.Port]; ok {
+		metadata.Set("container", container)
+	} else if pod.container != "" {
+		metadata.Set("container", pod.container)
+	}
+
+	return metadata.Encode()
+}
+
+// setK8sHeaders sets headers with given prefix to pod metadata, e.g. `X-Gor-K8s-Namespace` or `X-Gor-K8s-Label-App`
+func setK8sHeaders(payload []byte, prefix string, metadata url.Values) []byte {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name := prefix + strings.Replace(strings.Title(strings.NewReplacer(".", " ", "/", " ", "_", " ").Replace(k)), " ", "-", -1)
+		payload = proto.SetHeader(payload, []byte(name), []byte(metadata.Get(k)))
+	}
+
+	return payload
+}
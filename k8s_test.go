@@ -0,0 +1,80 @@
+package goreplay
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestK8sPods(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/pods" || r.URL.Query().Get("fieldSelector") != "spec.nodeName=node-1" {
+			t.Errorf("Unexpected request %s", r.URL)
+		}
+
+		w.Write([]byte(`{"items": [
+			{"metadata": {"name": "web-1", "namespace": "shop", "labels": {"app": "web", "tier": "front"}},
+			 "spec": {"containers": [{"name": "app", "ports": [{"containerPort": 8080}]}, {"name": "proxy", "ports": [{"containerPort": 15001}]}]},
+			 "status": {"podIP": "10.0.0.1"}},
+			{"metadata": {"name": "api-1", "namespace": "shop"},
+			 "spec": {"containers": [{"name": "api"}]},
+			 "status": {"podIP": "10.0.0.2", "podIPs": [{"ip": "10.0.0.2"}, {"ip": "fd00::2"}]}},
+			{"metadata": {"name": "node-exporter", "namespace": "monitoring"},
+			 "spec": {"hostNetwork": true, "containers": [{"name": "exporter"}]},
+			 "status": {"podIP": "192.168.0.1"}}
+		]}`))
+	}))
+	defer server.Close()
+
+	client, _ := newK8sClient(server.URL, "")
+	pods := &k8sPods{client: client, node: "node-1", labels: []string{"app"}}
+	if err := pods.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr     *net.TCPAddr
+		expected string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080}, "container=app&label.app=web&namespace=shop&pod=web-1"},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9090}, "label.app=web&namespace=shop&pod=web-1"},
+		{&net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 80}, "container=api&namespace=shop&pod=api-1"},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 80}, ""},
+		{nil, ""},
+	}
+
+	for i, tc := range tests {
+		if metadata := pods.metadata(tc.addr); metadata != tc.expected {
+			t.Errorf("%d: expected %q, got %q", i, tc.expected, metadata)
+		}
+	}
+}
+
+func TestPayloadK8sMetadata(t *testing.T) {
+	header := payloadAddrHeader(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), "10.0.0.5:4000")
+	header = payloadK8sHeader(header, "label.app=web+shop&namespace=shop&pod=web-1")
+	payload := append(header, []byte("GET / HTTP/1.1\r\nX-Gor-K8s-Pod: web-2\r\n\r\n")...)
+
+	metadata := payloadK8sMetadata(payload)
+	if metadata.Get("pod") != "web-1" || metadata.Get("label.app") != "web shop" {
+		t.Fatalf("Wrong metadata %v", metadata)
+	}
+	if addr := payloadClientAddr(payload); addr != "10.0.0.5:4000" {
+		t.Errorf("Client address should be kept, got %q", addr)
+	}
+
+	body := setK8sHeaders(payloadBody(payload), "X-Gor-K8s-", metadata)
+	for name, value := range map[string]string{"X-Gor-K8s-Pod": "web-1", "X-Gor-K8s-Namespace": "shop", "X-Gor-K8s-Label-App": "web shop"} {
+		if v := proto.Header(body, []byte(name)); string(v) != value {
+			t.Errorf("Expected %s header %q, got %q", name, value, v)
+		}
+	}
+
+	if payloadK8sMetadata(payloadHeader(RequestPayload, uuid(), 1, -1)) != nil {
+		t.Error("Payload without metadata should return nil")
+	}
+}
@@ -1,8 +1,9 @@
-package main
+package goreplay
 
 import (
 	"bytes"
 	"fmt"
+	"time"
 
 	"github.com/buger/goreplay/proto"
 
@@ -17,6 +18,11 @@ type KafkaConfig struct {
 	producer sarama.AsyncProducer
 	consumer sarama.Consumer
 	useJSON  bool
+	// Producer sends messages collected during flush interval, or when they reach batch size in bytes
+	batchSize     int
+	flushInterval time.Duration
+	// Removes credentials from payloads before they are sent to Kafka
+	redactor *headerRedactor
 }
 
 // KafkaMessage should contains catched request information that should be
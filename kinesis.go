@@ -0,0 +1,215 @@
+package goreplay
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+)
+
+// KinesisConfig holds configuration of AWS Kinesis Data Streams input and output
+type KinesisConfig struct {
+	region string
+	// Payloads are aggregated into records using KPL aggregation format
+	aggregate     bool
+	flushInterval time.Duration
+	// Name of enhanced fan-out consumer registered by input
+	consumer string
+	// Removes credentials from payloads before they are sent to Kinesis
+	redactor *headerRedactor
+	// Kinesis API URL, set to LocalStack or test server
+	endpoint string
+}
+
+const kinesisTarget = "Kinesis_20131202"
+
+// parseKinesisStream returns name of stream given by name or ARN, and region of ARN
+func parseKinesisStream(stream string) (name, region string) {
+	// arn:aws:kinesis:us-east-1:123456789012:stream/gor
+	if parts := strings.Split(stream, ":"); len(parts) == 6 && parts[0] == "arn" && strings.HasPrefix(parts[5], "stream/") {
+		return strings.TrimPrefix(parts[5], "stream/"), parts[3]
+	}
+
+	return stream, ""
+}
+
+// Records aggregated by Kinesis Producer Library start with magic, followed by protobuf message and its MD5:
+//
+//	message AggregatedRecord {
+//	  repeated string partition_key_table = 1;
+//	  repeated string explicit_hash_key_table = 2;
+//	  repeated Record records = 3;
+//	}
+//
+//	message Record {
+//	  required uint64 partition_key_index = 1;
+//	  optional uint64 explicit_hash_key_index = 2;
+//	  required bytes data = 3;
+//	}
+//
+// Consumers using Kinesis Client Library de-aggregate such records automatically.
+var kplMagic = []byte{0xf3, 0x89, 0x9a, 0xc2}
+
+// kplAggregator collects payloads into single aggregated record
+type kplAggregator struct {
+	keys    []string
+	records []byte
+	// Indexes of partition keys in keys table
+	keyIndex map[string]int
+	count    int
+}
+
+func (a *kplAggregator) add(key string, data []byte) {
+	if a.keyIndex == nil {
+		a.keyIndex = make(map[string]int)
+	}
+
+	index, ok := a.keyIndex[key]
+	if !ok {
+		index = len(a.keys)
+		a.keys = append(a.keys, key)
+		a.keyIndex[key] = index
+	}
+
+	record := appendVarintField(nil, 1, uint64(index))
+	record = appendBytesField(record, 3, data)
+	a.records = appendBytesField(a.records, 3, record)
+	a.count++
+}
+
+// size returns approximate size of aggregated record
+func (a *kplAggregator) size() int {
+	size := len(kplMagic) + len(a.records) + md5.Size
+	for _, key := range a.keys {
+		size += len(key) + 3
+	}
+	return size
+}
+
+// encode returns aggregated record, and partition key of the first record
+func (a *kplAggregator) encode() ([]byte, string) {
+	var msg []byte
+	for _, key := range a.keys {
+		msg = appendBytesField(msg, 1, []byte(key))
+	}
+	msg = append(msg, a.records...)
+	sum := md5.Sum(msg)
+
+	record := make([]byte, 0, len(kplMagic)+len(msg)+len(sum))
+	record = append(append(append(record, kplMagic...), msg...), sum[:]...)
+
+	return record, a.keys[0]
+}
+
+func (a *kplAggregator) reset() {
+	a.keys, a.records, a.keyIndex, a.count = nil, nil, nil, 0
+}
+
+// kplDeaggregate returns payloads of aggregated record, records which are not aggregated are returned as is
+func kplDeaggregate(data []byte) [][]byte {
+	if len(data) < len(kplMagic)+md5.Size || !bytes.HasPrefix(data, kplMagic) {
+		return [][]byte{data}
+	}
+
+	msg := data[len(kplMagic) : len(data)-md5.Size]
+	if sum := md5.Sum(msg); !bytes.Equal(sum[:], data[len(data)-md5.Size:]) {
+		return [][]byte{data}
+	}
+
+	var payloads [][]byte
+	err := forEachProtoField(msg, func(field int, _ uint64, record []byte) {
+		if field != 3 {
+			return
+		}
+		forEachProtoField(record, func(field int, _ uint64, payload []byte) {
+			if field == 3 {
+				payloads = append(payloads, payload)
+			}
+		})
+	})
+	if err != nil {
+		return [][]byte{data}
+	}
+
+	return payloads
+}
+
+var errEventStream = errors.New("malformed event stream message")
+
+// readEventStreamMessage reads message of event stream encoding, used by streaming AWS APIs like SubscribeToShard.
+// Message starts with prelude of total and headers length and its CRC, followed by headers, payload and CRC of
+// message. Only string values of headers are returned.
+func readEventStreamMessage(r io.Reader) (headers map[string]string, payload []byte, err error) {
+	var prelude [12]byte
+	if _, err = io.ReadFull(r, prelude[:]); err != nil {
+		return
+	}
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:]) {
+		return nil, nil, errEventStream
+	}
+
+	total := binary.BigEndian.Uint32(prelude[:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if total < 16 || headersLen > total-16 || total > 16<<20 {
+		return nil, nil, errEventStream
+	}
+
+	msg := make([]byte, total)
+	copy(msg, prelude[:])
+	if _, err = io.ReadFull(r, msg[12:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if crc32.ChecksumIEEE(msg[:total-4]) != binary.BigEndian.Uint32(msg[total-4:]) {
+		return nil, nil, errEventStream
+	}
+
+	headers = make(map[string]string)
+	h := msg[12 : 12+headersLen]
+	for len(h) > 0 {
+		nameLen := int(h[0])
+		if len(h) < 1+nameLen+1 {
+			return nil, nil, errEventStream
+		}
+		name := string(h[1 : 1+nameLen])
+		valueType := h[1+nameLen]
+		h = h[2+nameLen:]
+
+		var size int
+		switch valueType {
+		case 0, 1:
+		case 2:
+			size = 1
+		case 3:
+			size = 2
+		case 4:
+			size = 4
+		case 5, 8:
+			size = 8
+		case 9:
+			size = 16
+		case 6, 7:
+			if len(h) < 2 {
+				return nil, nil, errEventStream
+			}
+			size = 2 + int(binary.BigEndian.Uint16(h))
+		default:
+			return nil, nil, errEventStream
+		}
+		if len(h) < size {
+			return nil, nil, errEventStream
+		}
+		if valueType == 7 {
+			headers[name] = string(h[2:size])
+		}
+		h = h[size:]
+	}
+
+	return headers, msg[12+headersLen : total-4], nil
+}
@@ -0,0 +1,188 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAWSSignature(t *testing.T) {
+	// get-vanilla case of AWS Signature Version 4 test suite
+	c := &awsClient{region: "us-east-1", service: "service"}
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	now, _ := time.Parse("20060102T150405Z", "20150830T123600Z")
+	c.sign(req, nil, awsCredentials{accessKey: "AKIDEXAMPLE", secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}, now)
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Expected %s, got %s", expected, auth)
+	}
+}
+
+func TestKPLAggregation(t *testing.T) {
+	var a kplAggregator
+	a.add("10.0.0.1:5000", []byte("first"))
+	a.add("a2", []byte("second"))
+	a.add("10.0.0.1:5000", []byte(""))
+
+	record, key := a.encode()
+	if key != "10.0.0.1:5000" {
+		t.Error("Wrong partition key", key)
+	}
+
+	payloads := kplDeaggregate(record)
+	if len(payloads) != 3 || string(payloads[0]) != "first" || string(payloads[1]) != "second" || len(payloads[2]) != 0 {
+		t.Errorf("Wrong payloads %q", payloads)
+	}
+
+	// Corrupted record is returned as is
+	record[len(record)-1]++
+	if payloads := kplDeaggregate(record); len(payloads) != 1 || !bytes.Equal(payloads[0], record) {
+		t.Error("Corrupted record should not be de-aggregated")
+	}
+}
+
+func writeEventStreamMessage(w *bytes.Buffer, headers map[string]string, payload []byte) {
+	var h bytes.Buffer
+	for name, value := range headers {
+		h.WriteByte(byte(len(name)))
+		h.WriteString(name)
+		h.WriteByte(7)
+		binary.Write(&h, binary.BigEndian, uint16(len(value)))
+		h.WriteString(value)
+	}
+
+	msg := make([]byte, 12, 16+h.Len()+len(payload))
+	binary.BigEndian.PutUint32(msg, uint32(16+h.Len()+len(payload)))
+	binary.BigEndian.PutUint32(msg[4:], uint32(h.Len()))
+	binary.BigEndian.PutUint32(msg[8:], crc32.ChecksumIEEE(msg[:8]))
+	msg = append(append(msg, h.Bytes()...), payload...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(msg))
+	msg = append(msg, crc[:]...)
+
+	w.Write(msg)
+}
+
+// kinesisServer emulates Kinesis stream with two shards, records put to it are sent to subscribers once
+type kinesisServer struct {
+	mu      sync.Mutex
+	records []kinesisRecord
+	sent    bool
+}
+
+func (s *kinesisServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var request map[string]json.RawMessage
+	json.NewDecoder(r.Body).Decode(&request)
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "Kinesis_20131202.ListShards":
+		w.Write([]byte(`{"Shards": [
+			{"ShardId": "shard-0", "HashKeyRange": {"StartingHashKey": "0", "EndingHashKey": "170141183460469231731687303715884105727"}, "SequenceNumberRange": {}},
+			{"ShardId": "shard-1", "HashKeyRange": {"StartingHashKey": "170141183460469231731687303715884105728", "EndingHashKey": "340282366920938463463374607431768211455"}, "SequenceNumberRange": {}},
+			{"ShardId": "shard-closed", "HashKeyRange": {"StartingHashKey": "0", "EndingHashKey": "1"}, "SequenceNumberRange": {"EndingSequenceNumber": "1"}}
+		]}`))
+	case "Kinesis_20131202.PutRecords":
+		var records []kinesisRecord
+		json.Unmarshal(request["Records"], &records)
+		s.records = append(s.records, records...)
+		w.Write([]byte(`{"FailedRecordCount": 0}`))
+	case "Kinesis_20131202.DescribeStreamSummary":
+		w.Write([]byte(`{"StreamDescriptionSummary": {"StreamARN": "arn:aws:kinesis:us-east-1:1:stream/gor"}}`))
+	case "Kinesis_20131202.RegisterStreamConsumer":
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type": "ResourceInUseException", "message": "exists"}`))
+	case "Kinesis_20131202.DescribeStreamConsumer":
+		w.Write([]byte(`{"ConsumerDescription": {"ConsumerARN": "arn:consumer", "ConsumerStatus": "ACTIVE"}}`))
+	case "Kinesis_20131202.SubscribeToShard":
+		var shard string
+		json.Unmarshal(request["ShardId"], &shard)
+
+		var events bytes.Buffer
+		writeEventStreamMessage(&events, map[string]string{":message-type": "event", ":event-type": "initial-response"}, []byte(`{}`))
+		if shard == "shard-0" && !s.sent {
+			s.sent = true
+			event, _ := json.Marshal(map[string]interface{}{"Records": s.records, "ContinuationSequenceNumber": "2"})
+			writeEventStreamMessage(&events, map[string]string{":message-type": "event", ":event-type": "SubscribeToShardEvent"}, event)
+		}
+		w.Write(events.Bytes())
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestKinesisOutputInput(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	backend := new(kinesisServer)
+	server := httptest.NewServer(backend)
+	defer server.Close()
+
+	output := NewKinesisOutput("arn:aws:kinesis:us-east-1:1:stream/gor", &KinesisConfig{endpoint: server.URL, aggregate: true}).(*KinesisOutput)
+	if len(output.shards) != 2 {
+		t.Fatal("Expected 2 open shards, got", len(output.shards))
+	}
+
+	var payloads [][]byte
+	for i := 0; i < 10; i++ {
+		id := []byte{'a', byte('0' + i)}
+		payloads = append(payloads,
+			append(payloadAddrHeader(payloadHeader(RequestPayload, id, 1, -1), "10.0.0."+string(rune('0'+i))+":5000"), "GET / HTTP/1.1\r\n\r\n"...),
+			append(payloadHeader(ResponsePayload, id, 2, 1), "HTTP/1.1 200 OK\r\n\r\n"...))
+	}
+	for _, p := range payloads {
+		output.Write(p)
+	}
+	output.Close()
+
+	// Payloads are aggregated to record per shard
+	if len(backend.records) != 2 {
+		t.Fatal("Expected 2 aggregated records, got", len(backend.records))
+	}
+	total := 0
+	for _, r := range backend.records {
+		if r.ExplicitHashKey != output.shards[0].start.String() && r.ExplicitHashKey != output.shards[1].start.String() {
+			t.Error("Wrong explicit hash key", r.ExplicitHashKey)
+		}
+		// Requests are followed by their responses in the same shard
+		aggregated := kplDeaggregate(r.Data)
+		for i := 0; i < len(aggregated); i += 2 {
+			if payloadMeta(aggregated[i])[1][1] != payloadMeta(aggregated[i+1])[1][1] {
+				t.Error("Response should follow its request")
+			}
+		}
+		total += len(aggregated)
+	}
+	if total != len(payloads) {
+		t.Error("Expected all payloads, got", total)
+	}
+
+	input := NewKinesisInput("gor", &KinesisConfig{endpoint: server.URL, region: "us-east-1", consumer: "gor"})
+	defer input.Close()
+
+	buf := make([]byte, 1000)
+	for i := 0; i < len(payloads); i++ {
+		if _, err := input.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
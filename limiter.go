@@ -1,22 +1,55 @@
-package main
+package goreplay
 
 import (
 	"fmt"
 	"io"
+	"log"
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// Limiter is a wrapper for input or output plugin which adds rate limiting
+// Limiter is a wrapper for input or output plugin which adds rate limiting. Limit can be changed at runtime with
+// SetLimit and Step, fields below mu are guarded by it.
 type Limiter struct {
 	plugin    interface{}
-	limit     int
 	isPercent bool
+	// Limit is number of requests in flight, see inFlightCounter
+	isConcurrency bool
+
+	// Reports current limit with each request when --stats is enabled
+	stats *GorStat
+
+	mu    sync.Mutex
+	limit int
+	// Limit set by options, Step changes limit by its tenth
+	initial int
 
 	currentRPS  int
 	currentTime int64
+
+	// IDs of passed requests, their responses and following chunks are passed too, and of other requests dropped.
+	// IDs are kept for at least limiterIDsExpire, older ones are dropped together with previous map.
+	passed     map[string]struct{}
+	passedPrev map[string]struct{}
+	rotatedAt  time.Time
+}
+
+// Time IDs of requests passed by limiter are remembered for
+const limiterIDsExpire = time.Minute
+
+// inFlightCounter is implemented by outputs which can be limited by number of requests sent to target, and not
+// responded yet
+type inFlightCounter interface {
+	InFlight() int
+}
+
+// speedAdjuster is implemented by inputs replaying traffic with original timing. Percentage limit changes speed of
+// replay, instead of dropping requests.
+type speedAdjuster interface {
+	setSpeedFactor(factor float64)
 }
 
 func parseLimitOptions(options string) (limit int, isPercent bool) {
@@ -35,21 +68,130 @@ func parseLimitOptions(options string) (limit int, isPercent bool) {
 // `options` allow to sprcify relatve or absolute limiting
 func NewLimiter(plugin interface{}, options string) io.ReadWriter {
 	l := new(Limiter)
-	l.limit, l.isPercent = parseLimitOptions(options)
 	l.plugin = plugin
 	l.currentTime = time.Now().UnixNano()
 
-	// FileInput have its own rate limiting. Unlike other inputs we not just dropping requests, we can slow down or speed up request emittion.
-	if fi, ok := l.plugin.(*FileInput); ok && l.isPercent {
-		fi.speedFactor = float64(l.limit) / float64(100)
+	// Concurrency limit: `c=200`
+	if strings.HasPrefix(options, "c=") {
+		l.limit, _ = strconv.Atoi(options[2:])
+		l.initial = l.limit
+		l.isConcurrency = true
+
+		if _, ok := plugin.(inFlightCounter); !ok {
+			log.Fatalf("Concurrency limit is not supported by %v\n", plugin)
+		}
+
+		return l
 	}
 
+	l.limit, l.isPercent = parseLimitOptions(options)
+	l.initial = l.limit
+	l.adjustSpeed()
+
 	return l
 }
 
+// adjustSpeed sets speed of input replaying traffic with original timing to percentage limit
+func (l *Limiter) adjustSpeed() {
+	// FileInput have its own rate limiting. Unlike other inputs we not just dropping requests, we can slow down or speed up request emittion.
+	if in, ok := l.plugin.(speedAdjuster); ok && l.isPercent {
+		in.setSpeedFactor(float64(l.limit) / float64(100))
+	}
+}
+
+// Limit returns current limit in the format of options: number, percentage or `c=` followed by number
+func (l *Limiter) Limit() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.format(l.limit)
+}
+
+func (l *Limiter) format(limit int) string {
+	switch {
+	case l.isConcurrency:
+		return "c=" + strconv.Itoa(limit)
+	case l.isPercent:
+		return strconv.Itoa(limit) + "%"
+	default:
+		return strconv.Itoa(limit)
+	}
+}
+
+// SetLimit changes limit at runtime. Options have the same format as options of limiter, and kind of limit can't be
+// changed.
+func (l *Limiter) SetLimit(options string) error {
+	var limit int
+	var err error
+
+	switch {
+	case strings.HasPrefix(options, "c="):
+		if !l.isConcurrency {
+			return fmt.Errorf("limit %q is not a concurrency limit", options)
+		}
+		limit, err = strconv.Atoi(options[2:])
+	case strings.HasSuffix(options, "%"):
+		if !l.isPercent {
+			return fmt.Errorf("limit %q is not a percentage limit", options)
+		}
+		limit, err = strconv.Atoi(options[:len(options)-1])
+	default:
+		if l.isPercent || l.isConcurrency {
+			return fmt.Errorf("limit %q is not a rate limit", options)
+		}
+		limit, err = strconv.Atoi(options)
+	}
+
+	if err != nil || limit < 0 {
+		return fmt.Errorf("expected non-negative limit, got %q", options)
+	}
+
+	l.set(limit)
+
+	return nil
+}
+
+// Step increases limit by tenth of its initial value if steps is positive, and decreases if it is negative. Percentage
+// limits of outputs can't exceed 100%.
+func (l *Limiter) Step(steps int) {
+	l.mu.Lock()
+	step := l.initial / 10
+	if step == 0 {
+		step = 1
+	}
+	limit := l.limit + steps*step
+	l.mu.Unlock()
+
+	if limit < 0 {
+		limit = 0
+	}
+	if _, ok := l.plugin.(speedAdjuster); l.isPercent && !ok && limit > 100 {
+		limit = 100
+	}
+
+	l.set(limit)
+}
+
+func (l *Limiter) set(limit int) {
+	l.mu.Lock()
+	previous := l.limit
+	l.limit = limit
+	l.adjustSpeed()
+	l.mu.Unlock()
+
+	if previous != limit {
+		log.Printf("[LIMITER] Limit of %s changed from %s to %s\n", l.plugin, l.format(previous), l.format(limit))
+	}
+}
+
+// isLimited decides if request is dropped, should be called with mu held
 func (l *Limiter) isLimited() bool {
+	if l.stats != nil {
+		l.stats.Write(l.limit)
+	}
+
 	// File input have its own limiting algorithm
-	if _, ok := l.plugin.(*FileInput); ok && l.isPercent {
+	if _, ok := l.plugin.(speedAdjuster); ok && l.isPercent {
 		return false
 	}
 
@@ -71,8 +213,75 @@ func (l *Limiter) isLimited() bool {
 	return false
 }
 
+// isPayloadLimited decides if request is limited, and passes responses and following chunks of request only if the
+// request was passed. Each output limited separately gets consistent subset of requests together with their responses.
+func (l *Limiter) isPayloadLimited(data []byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	meta := payloadMeta(data)
+	if len(data) == 0 || len(meta) < 2 {
+		return l.isLimited()
+	}
+	id := string(meta[1])
+
+	index, _, chunked := payloadChunk(data)
+	if isRequestPayload(data) && (!chunked || index == 0) {
+		if l.isLimited() {
+			return true
+		}
+		l.remember(id)
+		return false
+	}
+
+	return !l.isPassed(id)
+}
+
+func (l *Limiter) remember(id string) {
+	if l.passed == nil || time.Since(l.rotatedAt) >= limiterIDsExpire {
+		l.passedPrev = l.passed
+		l.passed = make(map[string]struct{})
+		l.rotatedAt = time.Now()
+	}
+
+	l.passed[id] = struct{}{}
+}
+
+func (l *Limiter) isPassed(id string) bool {
+	if _, ok := l.passed[id]; ok {
+		return true
+	}
+	_, ok := l.passedPrev[id]
+	return ok
+}
+
+// isConcurrencyLimited checks if output has too many requests in flight. Only new requests are limited, responses and
+// following chunks of requests are passed.
+func (l *Limiter) isConcurrencyLimited(data []byte) bool {
+	if !isRequestPayload(data) {
+		return false
+	}
+
+	if index, _, chunked := payloadChunk(data); chunked && index > 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	limit := l.limit
+	if l.stats != nil {
+		l.stats.Write(limit)
+	}
+	l.mu.Unlock()
+
+	return l.plugin.(inFlightCounter).InFlight() >= limit
+}
+
 func (l *Limiter) Write(data []byte) (n int, err error) {
-	if l.isLimited() {
+	if l.isConcurrency {
+		if l.isConcurrencyLimited(data) {
+			return 0, nil
+		}
+	} else if l.isPayloadLimited(data) {
 		return 0, nil
 	}
 
@@ -88,7 +297,7 @@ func (l *Limiter) Read(data []byte) (n int, err error) {
 		return 0, nil
 	}
 
-	if l.isLimited() {
+	if !l.isConcurrency && n > 0 && l.isPayloadLimited(data[:n]) {
 		return 0, nil
 	}
 
@@ -96,5 +305,8 @@ func (l *Limiter) Read(data []byte) (n int, err error) {
 }
 
 func (l *Limiter) String() string {
-	return fmt.Sprintf("Limiting %s to: %d (isPercent: %v)", l.plugin, l.limit, l.isPercent)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return fmt.Sprintf("Limiting %s to: %d (isPercent: %v, isConcurrency: %v)", l.plugin, l.limit, l.isPercent, l.isConcurrency)
 }
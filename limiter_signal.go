@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package goreplay
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLimitSignals steps limits of all limiters up on SIGUSR1, and down on SIGUSR2
+func watchLimitSignals(plugins *InOutPlugins) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range c {
+			if sig == syscall.SIGUSR1 {
+				stepLimits(plugins, 1)
+			} else {
+				stepLimits(plugins, -1)
+			}
+		}
+	}()
+}
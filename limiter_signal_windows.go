@@ -0,0 +1,4 @@
+package goreplay
+
+// watchLimitSignals does nothing, Windows has no user signals. Limits are changed with --http-admin API.
+func watchLimitSignals(plugins *InOutPlugins) {}
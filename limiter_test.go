@@ -1,11 +1,15 @@
 // +build !race
 
-package main
+package goreplay
 
 import (
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestOutputLimiter(t *testing.T) {
@@ -112,3 +116,69 @@ func TestPercentLimiter2(t *testing.T) {
 
 	close(quit)
 }
+
+func TestConcurrencyLimiter(t *testing.T) {
+	var received int32
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&received, 1)
+		<-release
+	}))
+	defer server.Close()
+
+	output := NewLimiter(NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMin: 10, workersMax: 10, queueLen: 10, Timeout: 5 * time.Second}), "c=2")
+	request := func() []byte {
+		return append(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), "GET / HTTP/1.1\r\n\r\n"...)
+	}
+
+	waitReceived := func(expected int32) {
+		for i := 0; i < 100 && atomic.LoadInt32(&received) < expected; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		if n := atomic.LoadInt32(&received); n != expected {
+			t.Errorf("Expected %d requests, got %d", expected, n)
+		}
+	}
+
+	// Requests exceeding limit are dropped, even if there are free workers
+	for i := 0; i < 5; i++ {
+		output.Write(request())
+	}
+	waitReceived(2)
+
+	close(release)
+	for output.(*Limiter).plugin.(*HTTPOutput).InFlight() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	output.Write(request())
+	waitReceived(3)
+}
+
+// Responses and following chunks should be passed only together with their requests
+func TestPercentLimiterResponses(t *testing.T) {
+	passed := make(map[string]int)
+	output := NewLimiter(NewTestOutput(func(data []byte) {
+		passed[string(payloadMeta(data)[1])]++
+	}), "50%")
+
+	for i := 0; i < 200; i++ {
+		id := uuid()
+		output.Write(append(payloadChunkHeader(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), 0, true), "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"...))
+		output.Write(append(payloadChunkHeader(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), 1, false), "0\r\n\r\n"...))
+		output.Write(append(payloadHeader(ResponsePayload, id, time.Now().UnixNano(), 1), "HTTP/1.1 200 OK\r\n\r\n"...))
+	}
+
+	if len(passed) == 0 || len(passed) == 200 {
+		t.Errorf("Expected about half of requests to pass, got %d", len(passed))
+	}
+
+	for id, n := range passed {
+		if n != 3 {
+			t.Errorf("Expected request %s to be passed with following chunk and response, got %d payloads", id, n)
+		}
+	}
+}
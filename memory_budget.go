@@ -0,0 +1,185 @@
+package goreplay
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Policies applied when memory budget is exceeded
+const (
+	memoryPolicySample = "sample"
+	memoryPolicyShed   = "shed"
+	memoryPolicySpill  = "spill"
+)
+
+const (
+	// Interval of checking memory usage, reading memory stats stops the world, so it is not done too often
+	memoryBudgetInterval = 250 * time.Millisecond
+	// Pressure is lowered only when usage falls below this share of budget, so policy does not flap
+	memoryBudgetLowWatermark = 0.9
+	// With sample policy at most 1 of 2^memoryMaxSampleLevel requests is kept
+	memoryMaxSampleLevel = 6
+)
+
+// memoryBudget keeps memory used by captured and queued payloads under --max-memory, instead of letting capture host
+// run out of memory when outputs can't keep up. Pressure is raised every check while Go heap exceeds budget, and
+// lowered when it is back under budget. Depending on policy pressure is relieved by:
+//
+//	sample  keeping 1 of 2^pressure requests read from inputs, other requests and their responses are dropped
+//	shed    dropping payloads of one more output each step, in order of InOutPlugins.shedOrder
+//	spill   writing payloads queued by --output-dispatch-queue to temporary file, until outputs catch up
+type memoryBudget struct {
+	limit  uint64
+	policy string
+	// Step of pressure at which output with given index is shed, 0 if it is never shed, and priorities of outputs
+	shedAt     []int32
+	priorities []outputPriority
+
+	usage    uint64
+	pressure int32
+
+	requests uint64
+	sampled  uint64
+	shed     uint64
+	spilled  uint64
+}
+
+// memoryGuard is budget set by --max-memory, nil if memory is not limited
+var memoryGuard *memoryBudget
+
+func newMemoryBudget(limit uint64, policy string, plugins *InOutPlugins) *memoryBudget {
+	b := &memoryBudget{limit: limit, policy: policy}
+	b.shedAt = make([]int32, len(plugins.Outputs))
+	for step, index := range plugins.shedOrder() {
+		b.shedAt[index] = int32(step + 1)
+	}
+	for i := range plugins.Outputs {
+		b.priorities = append(b.priorities, plugins.outputPriority(i))
+	}
+
+	return b
+}
+
+func (b *memoryBudget) run() {
+	var stats runtime.MemStats
+	for range time.Tick(memoryBudgetInterval) {
+		runtime.ReadMemStats(&stats)
+		b.check(stats.HeapInuse)
+	}
+}
+
+// check updates pressure for given memory usage
+func (b *memoryBudget) check(usage uint64) {
+	atomic.StoreUint64(&b.usage, usage)
+
+	pressure := atomic.LoadInt32(&b.pressure)
+	switch {
+	case usage > b.limit && pressure < b.maxPressure():
+		pressure++
+	case float64(usage) < float64(b.limit)*memoryBudgetLowWatermark && pressure > 0:
+		pressure--
+	default:
+		return
+	}
+	atomic.StoreInt32(&b.pressure, pressure)
+
+	if pressure == 0 {
+		log.Printf("[MEMORY] Usage %s is back under budget %s\n", formatBytes(usage), formatBytes(b.limit))
+		return
+	}
+
+	var action string
+	switch b.policy {
+	case memoryPolicySample:
+		action = fmt.Sprintf("keeping 1 of %d requests", 1<<uint(pressure))
+	case memoryPolicyShed:
+		action = fmt.Sprintf("dropping payloads of %d outputs", pressure)
+	case memoryPolicySpill:
+		action = "spilling queued payloads to disk"
+	}
+	log.Printf("[MEMORY] Usage %s, budget %s: %s\n", formatBytes(usage), formatBytes(b.limit), action)
+}
+
+func (b *memoryBudget) maxPressure() int32 {
+	switch b.policy {
+	case memoryPolicySample:
+		return memoryMaxSampleLevel
+	case memoryPolicyShed:
+		var max int32
+		for _, step := range b.shedAt {
+			if step > max {
+				max = step
+			}
+		}
+		return max
+	default:
+		return 1
+	}
+}
+
+// keepRequest tells if request read from input is kept by sample policy
+func (b *memoryBudget) keepRequest() bool {
+	pressure := atomic.LoadInt32(&b.pressure)
+	if b.policy != memoryPolicySample || pressure == 0 {
+		return true
+	}
+
+	if atomic.AddUint64(&b.requests, 1)%(1<<uint(pressure)) == 0 {
+		return true
+	}
+	atomic.AddUint64(&b.sampled, 1)
+	return false
+}
+
+// shedOutput tells if output with given index in order of command line is shed by shed policy
+func (b *memoryBudget) shedOutput(index int) bool {
+	if b.policy != memoryPolicyShed || index >= len(b.shedAt) {
+		return false
+	}
+
+	step := b.shedAt[index]
+	return step > 0 && step <= atomic.LoadInt32(&b.pressure)
+}
+
+// dropShed counts payload not written to shed output
+func (b *memoryBudget) dropShed(index int) {
+	atomic.AddUint64(&b.shed, 1)
+	atomic.AddUint64(&droppedPayloads[b.priorities[index]], 1)
+}
+
+// spilling tells if outputs should spill queued payloads by spill policy
+func (b *memoryBudget) spilling() bool {
+	return b.policy == memoryPolicySpill && atomic.LoadInt32(&b.pressure) > 0
+}
+
+// writeMetrics writes memory usage and shed payloads in Prometheus text format
+func (b *memoryBudget) writeMetrics(out io.Writer) {
+	fmt.Fprintln(out, "# HELP gor_memory_usage_bytes Go heap in use, checked against --max-memory.")
+	fmt.Fprintln(out, "# TYPE gor_memory_usage_bytes gauge")
+	fmt.Fprintf(out, "gor_memory_usage_bytes %d\n", atomic.LoadUint64(&b.usage))
+
+	fmt.Fprintln(out, "# HELP gor_memory_pressure Steps of policy applied since memory budget was exceeded, 0 if under budget.")
+	fmt.Fprintln(out, "# TYPE gor_memory_pressure gauge")
+	fmt.Fprintf(out, "gor_memory_pressure{policy=%q} %d\n", b.policy, atomic.LoadInt32(&b.pressure))
+
+	fmt.Fprintln(out, "# HELP gor_memory_shed_total Payloads dropped or spilled to disk to keep memory under budget, by action.")
+	fmt.Fprintln(out, "# TYPE gor_memory_shed_total counter")
+	fmt.Fprintf(out, "gor_memory_shed_total{action=\"sampled\"} %d\n", atomic.LoadUint64(&b.sampled))
+	fmt.Fprintf(out, "gor_memory_shed_total{action=\"shed\"} %d\n", atomic.LoadUint64(&b.shed))
+	fmt.Fprintf(out, "gor_memory_shed_total{action=\"spilled\"} %d\n", atomic.LoadUint64(&b.spilled))
+}
+
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fgb", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fmb", float64(n)/(1<<20))
+	default:
+		return fmt.Sprintf("%dkb", n>>10)
+	}
+}
@@ -0,0 +1,166 @@
+package goreplay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudgetSample(t *testing.T) {
+	b := newMemoryBudget(1000, memoryPolicySample, NewPlugins())
+
+	b.check(500)
+	if b.pressure != 0 {
+		t.Fatal("Pressure should not be raised under budget", b.pressure)
+	}
+
+	b.check(2000)
+	b.check(2000)
+	if b.pressure != 2 {
+		t.Fatal("Pressure should be raised each check over budget", b.pressure)
+	}
+
+	kept := 0
+	for i := 0; i < 100; i++ {
+		if b.keepRequest() {
+			kept++
+		}
+	}
+	if kept != 25 || b.sampled != 75 {
+		t.Errorf("Expected 1 of 4 requests kept, got %d, sampled %d", kept, b.sampled)
+	}
+
+	// Between low watermark and budget pressure is kept
+	b.check(950)
+	if b.pressure != 2 {
+		t.Error("Pressure should not be lowered above low watermark", b.pressure)
+	}
+
+	b.check(500)
+	b.check(500)
+	if b.pressure != 0 || !b.keepRequest() {
+		t.Error("All requests should be kept after usage falls", b.pressure)
+	}
+}
+
+func TestMemoryBudgetShed(t *testing.T) {
+	b := newMemoryBudget(1000, memoryPolicyShed, &InOutPlugins{Outputs: make([]io.Writer, 3)})
+
+	for i := 0; i < 5; i++ {
+		b.check(2000)
+	}
+	if b.pressure != 2 {
+		t.Fatal("The first output should never be shed", b.pressure)
+	}
+
+	if b.shedOutput(0) || !b.shedOutput(1) || !b.shedOutput(2) {
+		t.Error("All outputs except the first one should be shed")
+	}
+
+	b.check(0)
+	if b.shedOutput(1) || !b.shedOutput(2) {
+		t.Error("Outputs should be restored in order of priority")
+	}
+}
+
+func TestEmitterSplitOutputShed(t *testing.T) {
+	input := NewTestInput()
+	var written int32
+	output := NewTestOutput(func(data []byte) {
+		atomic.AddInt32(&written, 1)
+	})
+
+	plugins := NewPlugins()
+	plugins.AddPlugin(input, "")
+	plugins.AddPlugin(output, "")
+	plugins.AddPlugin(output, "")
+
+	budget := newMemoryBudget(1000, memoryPolicyShed, plugins)
+	budget.check(2000)
+
+	// Output which is not shed is paused, so split payloads have nowhere to go
+	for i := range plugins.Outputs {
+		if !budget.shedOutput(i) {
+			plugins.pauseOutput(i, true)
+		}
+	}
+
+	paused := atomic.LoadUint64(&pausedPayloads)
+	dropped := func() uint64 {
+		return atomic.LoadUint64(&budget.shed) + atomic.LoadUint64(&pausedPayloads) - paused
+	}
+
+	stop := startEmitter(plugins, EmitterConfig{SplitOutput: true, memory: budget})
+
+	for i := 0; i < 10; i++ {
+		input.EmitGET()
+	}
+	for deadline := time.Now().Add(time.Second); dropped() < 10 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+
+	if n := atomic.LoadInt32(&written); n != 0 {
+		t.Error("Payloads should not be written to shed output", n)
+	}
+	if atomic.LoadUint64(&budget.shed) == 0 || dropped() != 10 {
+		t.Error("Payloads dropped by shed output should be counted", budget.shed, dropped())
+	}
+}
+
+func TestOutputDispatcherSpill(t *testing.T) {
+	memoryGuard = newMemoryBudget(1000, memoryPolicySpill, NewPlugins())
+	defer func() { memoryGuard = nil }()
+
+	var received []string
+	var mu sync.Mutex
+	unblock := make(chan struct{})
+	output := NewTestOutput(func(data []byte) {
+		<-unblock
+		mu.Lock()
+		received = append(received, string(data))
+		mu.Unlock()
+	})
+
+	d := newOutputDispatcher(output, 20, priorityNormal)
+
+	for i := 0; i < 100; i++ {
+		if i == 10 {
+			memoryGuard.check(2000)
+		}
+		if i == 50 {
+			memoryGuard.check(0)
+		}
+		if _, err := d.Write([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 30 {
+			// Output is stuck until payloads are spilled
+			close(unblock)
+		}
+	}
+
+	spill := d.spill
+	d.Close()
+
+	if len(received) != 100 {
+		t.Fatal("All payloads should be written, got", len(received))
+	}
+	for i, payload := range received {
+		if payload != fmt.Sprint(i) {
+			t.Fatalf("Payloads should be written in order, got %s at %d", payload, i)
+		}
+	}
+
+	if memoryGuard.spilled == 0 {
+		t.Error("Payloads should be spilled while budget is exceeded")
+	}
+	if _, err := os.Stat(spill.file.Name()); !os.IsNotExist(err) {
+		t.Error("Spill file should be removed", err)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package goreplay
 
 import (
 	"bufio"
@@ -72,6 +72,17 @@ func (m *Middleware) copy(to io.Writer, from io.Reader) {
 
 		payload := buf[0:nr]
 
+		if Settings.httpDecompress {
+			if info, ok := parsePayloadInfo(payload); ok && !info.chunked {
+				payload = decompressHTTP(payload)
+				nr = len(payload)
+
+				if nr*2 > len(dst) {
+					continue
+				}
+			}
+		}
+
 		if Settings.prettifyHTTP {
 			payload = prettifyHTTP(payload)
 			nr = len(payload)
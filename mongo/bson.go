@@ -0,0 +1,195 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// BSON element types, see https://bsonspec.org/spec.html
+const (
+	typeDouble   = 0x01
+	typeString   = 0x02
+	typeDocument = 0x03
+	typeArray    = 0x04
+	typeBinary   = 0x05
+	typeBool     = 0x08
+	typeInt32    = 0x10
+	typeInt64    = 0x12
+)
+
+// element is a key and raw value of BSON document element
+type element struct {
+	typ   byte
+	key   string
+	value []byte
+}
+
+// valueLength returns length of value of given type at the beginning of data, or -1 if it is malformed
+func valueLength(typ byte, data []byte) int {
+	n := -1
+
+	switch typ {
+	case 0x06, 0x0a, 0x7f, 0xff: // undefined, null, max and min keys
+		n = 0
+	case typeBool:
+		n = 1
+	case typeInt32:
+		n = 4
+	case typeDouble, 0x09, 0x11, typeInt64: // datetime and timestamp
+		n = 8
+	case 0x07: // ObjectId
+		n = 12
+	case 0x13: // decimal128
+		n = 16
+	case typeString, 0x0d, 0x0e: // JavaScript code and symbol
+		if len(data) >= 4 {
+			n = 4 + int(int32(binary.LittleEndian.Uint32(data)))
+		}
+	case typeDocument, typeArray, 0x0f: // code with scope
+		if len(data) >= 4 {
+			n = int(int32(binary.LittleEndian.Uint32(data)))
+		}
+	case typeBinary:
+		if len(data) >= 4 {
+			n = 5 + int(int32(binary.LittleEndian.Uint32(data)))
+		}
+	case 0x0b: // regular expression: pattern and options
+		if i := bytes.IndexByte(data, 0); i != -1 {
+			if j := bytes.IndexByte(data[i+1:], 0); j != -1 {
+				n = i + j + 2
+			}
+		}
+	case 0x0c: // DBPointer
+		if len(data) >= 4 {
+			n = 4 + int(int32(binary.LittleEndian.Uint32(data))) + 12
+		}
+	}
+
+	if n < 0 || n > len(data) {
+		return -1
+	}
+
+	return n
+}
+
+// elements returns elements of BSON document
+func elements(doc []byte) ([]element, error) {
+	if len(doc) < 5 || int(binary.LittleEndian.Uint32(doc)) != len(doc) || doc[len(doc)-1] != 0 {
+		return nil, ErrMalformed
+	}
+
+	var elems []element
+	data := doc[4 : len(doc)-1]
+
+	for len(data) > 0 {
+		typ := data[0]
+		end := bytes.IndexByte(data[1:], 0)
+		if end == -1 {
+			return nil, ErrMalformed
+		}
+		key := string(data[1 : end+1])
+		data = data[end+2:]
+
+		n := valueLength(typ, data)
+		if n == -1 {
+			return nil, ErrMalformed
+		}
+
+		elems = append(elems, element{typ: typ, key: key, value: data[:n]})
+		data = data[n:]
+	}
+
+	return elems, nil
+}
+
+// lookup returns element with given key
+func lookup(elems []element, key string) (element, bool) {
+	for _, e := range elems {
+		if e.key == key {
+			return e, true
+		}
+	}
+
+	return element{}, false
+}
+
+// document writes elements as BSON document
+func document(elems ...element) []byte {
+	doc := []byte{0, 0, 0, 0}
+	for _, e := range elems {
+		doc = append(doc, e.typ)
+		doc = append(doc, e.key...)
+		doc = append(doc, 0)
+		doc = append(doc, e.value...)
+	}
+	doc = append(doc, 0)
+	binary.LittleEndian.PutUint32(doc, uint32(len(doc)))
+
+	return doc
+}
+
+func (e element) str() (string, bool) {
+	if e.typ != typeString || len(e.value) < 5 {
+		return "", false
+	}
+
+	return string(e.value[4 : len(e.value)-1]), true
+}
+
+func (e element) number() (float64, bool) {
+	switch e.typ {
+	case typeInt32:
+		return float64(int32(binary.LittleEndian.Uint32(e.value))), true
+	case typeInt64:
+		return float64(int64(binary.LittleEndian.Uint64(e.value))), true
+	case typeDouble:
+		return math.Float64frombits(binary.LittleEndian.Uint64(e.value)), true
+	}
+
+	return 0, false
+}
+
+// binary returns data of binary element
+func (e element) binary() ([]byte, bool) {
+	if e.typ != typeBinary {
+		return nil, false
+	}
+
+	return e.value[5:], true
+}
+
+func stringElement(key, s string) element {
+	value := make([]byte, 4, 4+len(s)+1)
+	binary.LittleEndian.PutUint32(value, uint32(len(s)+1))
+	value = append(append(value, s...), 0)
+
+	return element{typ: typeString, key: key, value: value}
+}
+
+func int32Element(key string, n int32) element {
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, uint32(n))
+
+	return element{typ: typeInt32, key: key, value: value}
+}
+
+func boolElement(key string, b bool) element {
+	value := []byte{0}
+	if b {
+		value[0] = 1
+	}
+
+	return element{typ: typeBool, key: key, value: value}
+}
+
+func binaryElement(key string, data []byte) element {
+	value := make([]byte, 5, 5+len(data))
+	binary.LittleEndian.PutUint32(value, uint32(len(data)))
+
+	return element{typ: typeBinary, key: key, value: append(value, data...)}
+}
+
+func documentElement(key string, elems ...element) element {
+	return element{typ: typeDocument, key: key, value: document(elems...)}
+}
@@ -0,0 +1,50 @@
+package mongo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestElements(t *testing.T) {
+	doc := document(
+		stringElement("find", "orders"),
+		int32Element("limit", 10),
+		boolElement("singleBatch", true),
+		binaryElement("data", []byte("abc")),
+		documentElement("filter", stringElement("status", "new")),
+		element{typ: 0x0b, key: "regex", value: []byte("^a\x00i\x00")},
+		element{typ: 0x0a, key: "null"},
+		element{typ: 0x07, key: "_id", value: bytes.Repeat([]byte{1}, 12)},
+	)
+
+	elems, err := elements(doc)
+	if err != nil || len(elems) != 8 {
+		t.Fatal("Wrong elements", elems, err)
+	}
+
+	if s, ok := elems[0].str(); !ok || s != "orders" || elems[0].key != "find" {
+		t.Error("Wrong string element", elems[0])
+	}
+
+	if n, ok := elems[1].number(); !ok || n != 10 {
+		t.Error("Wrong number element", elems[1])
+	}
+
+	if b, ok := elems[3].binary(); !ok || string(b) != "abc" {
+		t.Error("Wrong binary element", elems[3])
+	}
+
+	if filter, err := elements(elems[4].value); err != nil || len(filter) != 1 || filter[0].key != "status" {
+		t.Error("Wrong nested document", filter, err)
+	}
+
+	if !bytes.Equal(document(elems...), doc) {
+		t.Error("Should write the same document")
+	}
+
+	for _, doc := range [][]byte{doc[:len(doc)-1], {5, 0, 0, 0, 1}, document(element{typ: typeString, key: "a", value: []byte{100, 0, 0, 0}}), document(element{typ: 0x42, key: "a"})} {
+		if _, err := elements(doc); err == nil {
+			t.Errorf("Should reject %q", doc)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package mongo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/buger/goreplay/scram"
+)
+
+// Config holds connection options
+type Config struct {
+	User     string
+	Password string
+	// Database user is defined in, `admin` by default
+	AuthDatabase string
+	Timeout      time.Duration
+}
+
+// Conn is a client connection replaying captured commands
+type Conn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	config    Config
+	requestID int32
+}
+
+// Error is an error returned by server
+type Error struct {
+	Code    int32
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("MongoDB error %d: %s", e.Code, e.Message)
+}
+
+// Dial connects to server, and authenticates using SCRAM-SHA-256 if user is set. Connections are not encrypted.
+func Dial(address string, config Config) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{conn: conn, r: bufio.NewReader(conn), config: config}
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+
+	if config.User != "" {
+		if err = c.authenticate(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *Conn) authenticate() error {
+	db := c.config.AuthDatabase
+	if db == "" {
+		db = "admin"
+	}
+
+	sasl, err := scram.NewClient(c.config.User, c.config.Password)
+	if err != nil {
+		return err
+	}
+
+	reply, err := c.call(
+		int32Element("saslStart", 1),
+		stringElement("mechanism", scram.Mechanism),
+		binaryElement("payload", sasl.ClientFirst()),
+		documentElement("options", boolElement("skipEmptyExchange", true)),
+		stringElement("$db", db),
+	)
+	if err != nil {
+		return err
+	}
+
+	conversation, _ := lookup(reply, "conversationId")
+	payload, _ := lookup(reply, "payload")
+	serverFirst, ok := payload.binary()
+	if !ok {
+		return ErrMalformed
+	}
+
+	final, err := sasl.ClientFinal(serverFirst)
+	if err != nil {
+		return err
+	}
+
+	verified := false
+	for !isDone(reply) {
+		if reply, err = c.call(
+			int32Element("saslContinue", 1),
+			element{typ: conversation.typ, key: "conversationId", value: conversation.value},
+			binaryElement("payload", final),
+			stringElement("$db", db),
+		); err != nil {
+			return err
+		}
+
+		payload, _ = lookup(reply, "payload")
+		if serverFinal, _ := payload.binary(); len(serverFinal) > 0 {
+			if !sasl.Verify(serverFinal) {
+				return errors.New("MongoDB server signature is not valid")
+			}
+			verified = true
+		}
+
+		// Empty message finishes exchange, if server does not skip it
+		final = nil
+	}
+
+	if !verified {
+		return errors.New("MongoDB server did not send its signature")
+	}
+
+	return nil
+}
+
+func isDone(reply []element) bool {
+	done, ok := lookup(reply, "done")
+	return ok && done.typ == typeBool && done.value[0] == 1
+}
+
+// send writes OP_MSG, and reads reply unless moreToCome flag is set
+func (c *Conn) send(msg []byte) ([]byte, error) {
+	if c.config.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	}
+
+	c.requestID++
+	if _, err := c.conn.Write(AppendMessage(nil, c.requestID, 0, OpMsg, msg)); err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(msg)&flagMoreToCome != 0 {
+		return nil, nil
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return nil, err
+	}
+
+	length := int(int32(binary.LittleEndian.Uint32(header)))
+	if length < headerSize {
+		return nil, ErrMalformed
+	}
+
+	reply := make([]byte, length)
+	copy(reply, header)
+	if _, err := io.ReadFull(c.r, reply[headerSize:]); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// call runs command with body of given elements, and returns error if it fails
+func (c *Conn) call(elems ...element) ([]element, error) {
+	msg := append([]byte{0, 0, 0, 0, 0}, document(elems...)...)
+
+	data, err := c.send(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := parseReply(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, _ := lookup(reply, "ok"); !isOK(ok) {
+		e := &Error{}
+		if code, ok := lookup(reply, "code"); ok {
+			n, _ := code.number()
+			e.Code = int32(n)
+		}
+		if msg, ok := lookup(reply, "errmsg"); ok {
+			e.Message, _ = msg.str()
+		}
+		return nil, e
+	}
+
+	return reply, nil
+}
+
+func isOK(e element) bool {
+	n, ok := e.number()
+	return ok && n == 1
+}
+
+// Exec replays command, and returns raw server reply. Errors returned by server are returned as reply.
+func (c *Conn) Exec(cmd *Command) ([]byte, error) {
+	return c.send(cmd.Message)
+}
+
+// Close closes connection, server does not expect any message before it
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
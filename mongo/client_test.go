@@ -0,0 +1,104 @@
+package mongo
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func readMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, MessageLength(append(header, make([]byte, 1<<16)...)))
+	copy(data, header)
+	_, err := io.ReadFull(r, data[headerSize:])
+
+	return data, err
+}
+
+// startServer accepts single connection, rejects authentication, and answers other commands with their names
+func startServer(t *testing.T, commands chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		for {
+			data, err := readMessage(r)
+			if err != nil {
+				return
+			}
+
+			body, _ := parseReply(data)
+			commands <- body[0].key
+
+			switch {
+			case body[0].key == "saslStart":
+				conn.Write(opMsg(0, int32Element("ok", 0), stringElement("errmsg", "Authentication failed."), int32Element("code", 18)))
+			case !HasResponse(data):
+			default:
+				conn.Write(opMsg(0, stringElement("command", body[0].key), element{typ: typeDouble, key: "ok", value: []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}}))
+			}
+		}
+	}()
+
+	return ln
+}
+
+func TestClient(t *testing.T) {
+	commands := make(chan string, 10)
+	ln := startServer(t, commands)
+	defer ln.Close()
+
+	conn, err := Dial(ln.Addr().String(), Config{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cmd, _ := ParseCommand(opMsg(0, stringElement("find", "orders"), stringElement("$db", "shop")))
+	reply, err := conn.Exec(cmd)
+	if err != nil || !bytes.Contains(reply, []byte("command\x00\x05\x00\x00\x00find\x00")) || RequestID(reply) != 7 {
+		t.Fatalf("Wrong reply: %q %v", reply, err)
+	}
+
+	// Unacknowledged write has no reply
+	cmd, _ = ParseCommand(opMsg(flagMoreToCome, stringElement("insert", "orders"), stringElement("$db", "shop")))
+	if reply, err = conn.Exec(cmd); reply != nil || err != nil {
+		t.Error("Should not wait for reply", reply, err)
+	}
+
+	if _, err = conn.call(int32Element("ping", 1), stringElement("$db", "admin")); err != nil {
+		t.Error(err)
+	}
+
+	for _, expected := range []string{"find", "insert", "ping"} {
+		if c := <-commands; c != expected {
+			t.Errorf("Expected %q, got %q", expected, c)
+		}
+	}
+}
+
+func TestClientAuthenticationFailed(t *testing.T) {
+	ln := startServer(t, make(chan string, 10))
+	defer ln.Close()
+
+	_, err := Dial(ln.Addr().String(), Config{User: "app", Password: "wrong", Timeout: time.Second})
+	if e, ok := err.(*Error); !ok || e.Code != 18 || e.Message != "Authentication failed." {
+		t.Error("Should return server error", err)
+	}
+}
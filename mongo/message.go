@@ -0,0 +1,349 @@
+// Package mongo implements parts of MongoDB wire protocol needed to capture and replay commands sent with OP_MSG.
+// See https://www.mongodb.com/docs/manual/reference/mongodb-wire-protocol/
+package mongo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Opcodes of wire protocol messages
+const (
+	OpReply      = 1
+	OpQuery      = 2004
+	OpGetMore    = 2005
+	OpCompressed = 2012
+	OpMsg        = 2013
+)
+
+// Size of message header: length, request ID, ID of request the message responds to, and opcode
+const headerSize = 16
+
+// Flags of OP_MSG
+const (
+	flagChecksumPresent = 1 << 0
+	flagMoreToCome      = 1 << 1
+)
+
+// Errors returned for messages which can't be replayed
+var (
+	ErrMalformed   = errors.New("malformed MongoDB message")
+	ErrUnsupported = errors.New("only uncompressed OP_MSG messages are supported")
+	ErrTransaction = errors.New("commands of multi-document transactions are not supported")
+)
+
+// Commands managing connection, authentication, cursors and transactions are not replayed. Output connections
+// authenticate themselves, and cursors created by captured commands do not exist on other server.
+var connectionCommands = map[string]bool{
+	"hello": true, "ismaster": true, "saslstart": true, "saslcontinue": true, "authenticate": true, "logout": true,
+	"getnonce": true, "getmore": true, "killcursors": true, "endsessions": true, "committransaction": true,
+	"aborttransaction": true,
+}
+
+// Fields of command body bound to captured deployment or session: signed cluster time, logical session,
+// and transaction number of retryable write
+var sessionFields = map[string]bool{"$clusterTime": true, "lsid": true, "txnNumber": true}
+
+// MessageLength returns length of the first message in data, or -1 if it is not complete
+func MessageLength(data []byte) int {
+	if len(data) < headerSize {
+		return -1
+	}
+
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+	if length < headerSize || length > len(data) {
+		return -1
+	}
+
+	return length
+}
+
+// RequestID returns ID of the message
+func RequestID(data []byte) int32 {
+	return int32(binary.LittleEndian.Uint32(data[4:]))
+}
+
+// OpCode returns opcode of the message
+func OpCode(data []byte) int32 {
+	return int32(binary.LittleEndian.Uint32(data[12:]))
+}
+
+// HasResponse returns false for messages which server does not answer: OP_MSG with moreToCome flag, e.g. unacknowledged
+// writes, and legacy opcodes other than OP_QUERY and OP_GET_MORE
+func HasResponse(data []byte) bool {
+	if len(data) < headerSize+4 {
+		return false
+	}
+
+	switch OpCode(data) {
+	case OpMsg:
+		return binary.LittleEndian.Uint32(data[headerSize:])&flagMoreToCome == 0
+	case OpQuery, OpGetMore, OpCompressed:
+		return true
+	}
+
+	return false
+}
+
+// AppendMessage appends message with given header fields and body
+func AppendMessage(b []byte, requestID, responseTo, opCode int32, body []byte) []byte {
+	header := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(header, uint32(headerSize+len(body)))
+	binary.LittleEndian.PutUint32(header[4:], uint32(requestID))
+	binary.LittleEndian.PutUint32(header[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(header[12:], uint32(opCode))
+
+	return append(append(b, header...), body...)
+}
+
+// msgBody returns body document of OP_MSG without header: flag bits followed by sections, and its offset
+func msgBody(msg []byte) ([]byte, int, error) {
+	if len(msg) < 4 {
+		return nil, 0, ErrMalformed
+	}
+
+	for offset := 4; offset < len(msg); {
+		data := msg[offset:]
+		if len(data) < 5 {
+			return nil, 0, ErrMalformed
+		}
+
+		n := int(int32(binary.LittleEndian.Uint32(data[1:])))
+		if n < 5 || 1+n > len(data) {
+			return nil, 0, ErrMalformed
+		}
+
+		// Section of kind 0 is a single document, and kind 1 is a sequence of documents
+		if data[0] == 0 {
+			return data[1 : 1+n], offset + 1, nil
+		}
+		offset += 1 + n
+	}
+
+	return nil, 0, ErrMalformed
+}
+
+// Command is a client command which can be replayed.
+//
+// It is written as text, similar to HTTP message, followed by OP_MSG without header:
+//
+//	find\r\n
+//	Connection: 10.0.0.1:51234\r\n
+//	Namespace: shop.orders\r\n
+//	\r\n
+//	<flag bits and sections>
+type Command struct {
+	// Client connection, commands of the same connection should be replayed in order using single connection
+	Connection string
+	// Name of command, the first field of its body
+	Name string
+	// Database and collection, or database and `$cmd` for commands which are not run on collection
+	Namespace string
+	// OP_MSG without header and checksum
+	Message []byte
+}
+
+// Database returns database command is run on
+func (c *Command) Database() string {
+	return c.Namespace[:strings.IndexByte(c.Namespace+".", '.')]
+}
+
+// MarshalText writes command as text
+func (c *Command) MarshalText() ([]byte, error) {
+	var b bytes.Buffer
+
+	b.WriteString(c.Name + "\r\n")
+	b.WriteString("Connection: " + c.Connection + "\r\n")
+	b.WriteString("Namespace: " + c.Namespace + "\r\n")
+	b.WriteString("\r\n")
+	b.Write(c.Message)
+
+	return b.Bytes(), nil
+}
+
+// UnmarshalText parses command written by MarshalText
+func (c *Command) UnmarshalText(data []byte) error {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end == -1 {
+		return ErrMalformed
+	}
+
+	lines := strings.Split(string(data[:end]), "\r\n")
+	*c = Command{Name: lines[0], Message: data[end+4:]}
+
+	for _, line := range lines[1:] {
+		i := strings.Index(line, ": ")
+		if i == -1 {
+			return ErrMalformed
+		}
+
+		value := line[i+2:]
+		switch line[:i] {
+		case "Connection":
+			c.Connection = value
+		case "Namespace":
+			c.Namespace = value
+		}
+	}
+
+	_, _, err := msgBody(c.Message)
+
+	return err
+}
+
+// body returns elements of command body
+func (c *Command) body() ([]element, error) {
+	doc, _, err := msgBody(c.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	return elements(doc)
+}
+
+// ParseCommand parses OP_MSG sent by client, and returns command which can be replayed on other deployment.
+// Fields bound to captured session and deployment are removed. Commands managing connection and cursors are not
+// replayed, and nil is returned.
+func ParseCommand(data []byte) (*Command, error) {
+	if MessageLength(data) != len(data) {
+		return nil, ErrMalformed
+	}
+
+	if OpCode(data) != OpMsg {
+		return nil, ErrUnsupported
+	}
+
+	msg := data[headerSize:]
+	if len(msg) < 4 {
+		return nil, ErrMalformed
+	}
+
+	flags := binary.LittleEndian.Uint32(msg)
+	if flags&flagChecksumPresent != 0 {
+		if len(msg) < 8 {
+			return nil, ErrMalformed
+		}
+		msg = msg[:len(msg)-4]
+	}
+
+	doc, offset, err := msgBody(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	elems, err := elements(doc)
+	if err != nil || len(elems) == 0 {
+		return nil, ErrMalformed
+	}
+
+	cmd := &Command{Name: elems[0].key}
+	if connectionCommands[strings.ToLower(cmd.Name)] {
+		return nil, nil
+	}
+
+	if _, ok := lookup(elems, "autocommit"); ok {
+		return nil, ErrTransaction
+	}
+
+	db, ok := lookup(elems, "$db")
+	if !ok {
+		return nil, ErrMalformed
+	}
+	cmd.Namespace, _ = db.str()
+	if collection, ok := elems[0].str(); ok {
+		cmd.Namespace += "." + collection
+	} else {
+		cmd.Namespace += ".$cmd"
+	}
+
+	var kept []element
+	for _, e := range elems {
+		if sessionFields[e.key] {
+			continue
+		}
+
+		// Causally consistent reads wait for cluster time of captured deployment
+		if e.key == "readConcern" && e.typ == typeDocument {
+			if rc, err := elements(e.value); err == nil {
+				var fields []element
+				for _, f := range rc {
+					if f.key != "afterClusterTime" && f.key != "atClusterTime" {
+						fields = append(fields, f)
+					}
+				}
+				e = documentElement(e.key, fields...)
+			}
+		}
+
+		kept = append(kept, e)
+	}
+
+	// Body section is replaced, other sections are kept in place
+	cmd.Message = make([]byte, 4, len(msg))
+	binary.LittleEndian.PutUint32(cmd.Message, flags&^flagChecksumPresent)
+	cmd.Message = append(cmd.Message, msg[4:offset]...)
+	cmd.Message = append(cmd.Message, document(kept...)...)
+	cmd.Message = append(cmd.Message, msg[offset+len(doc):]...)
+
+	return cmd, nil
+}
+
+// parseReply returns elements of reply body, sent as OP_MSG
+func parseReply(data []byte) ([]element, error) {
+	if MessageLength(data) != len(data) || OpCode(data) != OpMsg {
+		return nil, ErrUnsupported
+	}
+
+	msg := data[headerSize:]
+	if len(msg) >= 4 && binary.LittleEndian.Uint32(msg)&flagChecksumPresent != 0 {
+		msg = msg[:len(msg)-4]
+	}
+
+	doc, _, err := msgBody(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return elements(doc)
+}
+
+// IsReadOnly checks that command does not modify data: queries, counts, and aggregations without $out and $merge stages
+func IsReadOnly(cmd *Command) bool {
+	switch strings.ToLower(cmd.Name) {
+	case "find", "count", "distinct", "listindexes", "listcollections", "explain":
+		return true
+	case "aggregate":
+	default:
+		return false
+	}
+
+	elems, err := cmd.body()
+	if err != nil {
+		return false
+	}
+
+	pipeline, ok := lookup(elems, "pipeline")
+	if !ok || pipeline.typ != typeArray {
+		return false
+	}
+
+	stages, err := elements(pipeline.value)
+	if err != nil {
+		return false
+	}
+
+	for _, stage := range stages {
+		fields, err := elements(stage.value)
+		if stage.typ != typeDocument || err != nil || len(fields) == 0 {
+			return false
+		}
+
+		if fields[0].key == "$out" || fields[0].key == "$merge" {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,158 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func opMsg(flags uint32, elems ...element) []byte {
+	msg := make([]byte, 4)
+	binary.LittleEndian.PutUint32(msg, flags)
+	msg = append(msg, 0)
+	msg = append(msg, document(elems...)...)
+
+	return AppendMessage(nil, 7, 0, OpMsg, msg)
+}
+
+func TestMessageLength(t *testing.T) {
+	data := opMsg(0, int32Element("ping", 1), stringElement("$db", "admin"))
+
+	if n := MessageLength(append(data, 1, 2, 3)); n != len(data) {
+		t.Error("Wrong message length", n)
+	}
+
+	if MessageLength(data[:len(data)-1]) != -1 || MessageLength(data[:10]) != -1 {
+		t.Error("Should wait for the whole message")
+	}
+
+	if !HasResponse(data) || HasResponse(opMsg(flagMoreToCome, int32Element("insert", 1))) {
+		t.Error("Message with moreToCome flag has no response")
+	}
+
+	if RequestID(data) != 7 || OpCode(data) != OpMsg {
+		t.Error("Wrong header")
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	filter := documentElement("filter", stringElement("status", "new"))
+	readConcern := documentElement("readConcern", stringElement("level", "majority"), element{typ: 0x11, key: "afterClusterTime", value: make([]byte, 8)})
+	data := opMsg(flagChecksumPresent,
+		stringElement("find", "orders"),
+		filter,
+		readConcern,
+		documentElement("lsid", binaryElement("id", make([]byte, 16))),
+		documentElement("$clusterTime", element{typ: 0x11, key: "clusterTime", value: make([]byte, 8)}),
+		stringElement("$db", "shop"),
+	)
+	// Checksum is not validated
+	data = append(data, 1, 2, 3, 4)
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+
+	cmd, err := ParseCommand(data)
+	if err != nil || cmd.Name != "find" || cmd.Namespace != "shop.orders" || cmd.Database() != "shop" {
+		t.Fatal("Wrong command", cmd, err)
+	}
+
+	// Session fields, cluster time of read concern and checksum are removed
+	expected := append([]byte{0, 0, 0, 0, 0}, document(stringElement("find", "orders"), filter, documentElement("readConcern", stringElement("level", "majority")), stringElement("$db", "shop"))...)
+	if !bytes.Equal(cmd.Message, expected) {
+		t.Errorf("Wrong message: %q", cmd.Message)
+	}
+
+	if cmd, err = ParseCommand(opMsg(0, int32Element("dropDatabase", 1), stringElement("$db", "shop"))); err != nil || cmd.Namespace != "shop.$cmd" {
+		t.Error("Wrong database command", cmd, err)
+	}
+
+	if cmd, err = ParseCommand(opMsg(0, int32Element("hello", 1), stringElement("$db", "admin"))); cmd != nil || err != nil {
+		t.Error("Connection commands should not be replayed", cmd, err)
+	}
+
+	if _, err = ParseCommand(opMsg(0, stringElement("insert", "orders"), boolElement("autocommit", false), stringElement("$db", "shop"))); err != ErrTransaction {
+		t.Error("Transactions should not be replayed", err)
+	}
+
+	if _, err = ParseCommand(AppendMessage(nil, 1, 0, OpQuery, make([]byte, 20))); err != ErrUnsupported {
+		t.Error("Only OP_MSG should be supported", err)
+	}
+}
+
+func TestParseCommandSequence(t *testing.T) {
+	// Documents of insert are sent in sequence before body
+	seq := []byte{1, 0, 0, 0, 0}
+	seq = append(seq, "documents\x00"...)
+	seq = append(seq, document(int32Element("_id", 1))...)
+	binary.LittleEndian.PutUint32(seq[1:], uint32(len(seq)-1))
+
+	body := document(stringElement("insert", "orders"), int32Element("txnNumber", 1), stringElement("$db", "shop"))
+	data := AppendMessage(nil, 1, 0, OpMsg, append(append([]byte{0, 0, 0, 0}, seq...), append([]byte{0}, body...)...))
+
+	cmd, err := ParseCommand(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(append([]byte{0, 0, 0, 0}, seq...), append([]byte{0}, document(stringElement("insert", "orders"), stringElement("$db", "shop"))...)...)
+	if !bytes.Equal(cmd.Message, expected) {
+		t.Errorf("Wrong message: %q", cmd.Message)
+	}
+}
+
+func TestCommandText(t *testing.T) {
+	cmd, _ := ParseCommand(opMsg(0, stringElement("count", "orders"), stringElement("$db", "shop")))
+	cmd.Connection = "10.0.0.1:51234"
+
+	text, _ := cmd.MarshalText()
+	if !bytes.HasPrefix(text, []byte("count\r\nConnection: 10.0.0.1:51234\r\nNamespace: shop.orders\r\n\r\n\x00\x00\x00\x00\x00")) {
+		t.Errorf("Wrong text: %q", text)
+	}
+
+	decoded := new(Command)
+	if err := decoded.UnmarshalText(text); err != nil || decoded.Name != "count" || decoded.Connection != cmd.Connection || decoded.Namespace != cmd.Namespace || !bytes.Equal(decoded.Message, cmd.Message) {
+		t.Error("Wrong command", decoded, err)
+	}
+
+	for _, text := range []string{"count\r\nConnection: a", "GET / HTTP/1.1\r\n\r\n", "count\r\n\r\n\x00\x00\x00\x00"} {
+		if err := decoded.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("Should reject %q", text)
+		}
+	}
+}
+
+func TestIsReadOnly(t *testing.T) {
+	stage := func(name string) element {
+		return documentElement("0", documentElement(name))
+	}
+
+	cases := []struct {
+		elems    []element
+		expected bool
+	}{
+		{[]element{stringElement("find", "orders")}, true},
+		{[]element{stringElement("distinct", "orders")}, true},
+		{[]element{stringElement("aggregate", "orders"), documentElement("pipeline", stage("$match"))}, true},
+		{[]element{stringElement("aggregate", "orders"), element{typ: typeArray, key: "pipeline", value: document(stage("$match"), documentElement("1", documentElement("$out")))}}, false},
+		{[]element{stringElement("aggregate", "orders"), element{typ: typeArray, key: "pipeline", value: document(stage("$merge"))}}, false},
+		{[]element{stringElement("insert", "orders")}, false},
+		{[]element{stringElement("findAndModify", "orders")}, false},
+	}
+
+	for _, c := range cases {
+		// Pipeline is an array
+		for i, e := range c.elems {
+			if e.key == "pipeline" {
+				c.elems[i].typ = typeArray
+			}
+		}
+
+		cmd, err := ParseCommand(opMsg(0, append(c.elems, stringElement("$db", "shop"))...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if IsReadOnly(cmd) != c.expected {
+			t.Errorf("%s: expected %v", cmd.Name, c.expected)
+		}
+	}
+}
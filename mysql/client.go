@@ -0,0 +1,427 @@
+package mysql
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Authentication plugins supported by client
+const (
+	nativePassword      = "mysql_native_password"
+	cachingSHA2Password = "caching_sha2_password"
+)
+
+// Packets of caching_sha2_password exchange
+const (
+	authMoreData     = 0x01
+	requestPublicKey = 0x02
+	fastAuthSuccess  = 0x03
+	performFullAuth  = 0x04
+)
+
+// Limit of statements prepared by connection
+const maxPreparedStatements = 1000
+
+// Charset sent in handshake: utf8mb4_general_ci
+const utf8mb4 = 45
+
+// Config holds connection options
+type Config struct {
+	User     string
+	Password string
+	// Default schema, used if command does not specify one
+	Schema  string
+	Timeout time.Duration
+}
+
+// Conn is a client connection replaying captured commands
+type Conn struct {
+	conn         net.Conn
+	config       Config
+	capabilities uint32
+	schema       string
+	// IDs of prepared statements by SQL
+	statements map[string]uint32
+}
+
+// Error is an error returned by server
+type Error struct {
+	Code    uint16
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("MySQL error %d: %s", e.Code, e.Message)
+}
+
+func parseError(p []byte) error {
+	if len(p) < 3 {
+		return ErrMalformed
+	}
+
+	e := &Error{Code: binary.LittleEndian.Uint16(p[1:3]), Message: string(p[3:])}
+	// SQL state marker followed by 5 characters
+	if len(p) >= 9 && p[3] == '#' {
+		e.Message = string(p[9:])
+	}
+
+	return e
+}
+
+// Dial connects to server, and authenticates using mysql_native_password or caching_sha2_password
+func Dial(address string, config Config) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{conn: conn, config: config, statements: make(map[string]uint32)}
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+
+	if err = c.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.schema = config.Schema
+
+	return c, nil
+}
+
+func (c *Conn) handshake() error {
+	p, seq, err := ReadPacket(c.conn)
+	if err != nil {
+		return err
+	}
+
+	if len(p) > 0 && p[0] == errHeader {
+		return parseError(p)
+	}
+
+	// Protocol version, server version, and connection ID
+	end := bytes.IndexByte(p, 0)
+	if len(p) == 0 || p[0] != 10 || end == -1 || len(p) < end+1+4+8+1+2 {
+		return ErrMalformed
+	}
+	rest := p[end+1+4:]
+
+	scramble := append([]byte{}, rest[:8]...)
+	caps := uint32(binary.LittleEndian.Uint16(rest[9:11]))
+	rest = rest[11:]
+
+	plugin := nativePassword
+	if len(rest) >= 16 {
+		caps |= uint32(binary.LittleEndian.Uint16(rest[3:5])) << 16
+		rest = rest[16:]
+
+		// The second part of scramble is terminated with zero byte
+		if caps&clientSecureConnection != 0 {
+			n := bytes.IndexByte(rest, 0)
+			if n == -1 {
+				return ErrMalformed
+			}
+			scramble = append(scramble, rest[:n]...)
+			rest = rest[n+1:]
+		}
+
+		if caps&clientPluginAuth != 0 {
+			if n := bytes.IndexByte(rest, 0); n != -1 {
+				plugin = string(rest[:n])
+			} else {
+				plugin = string(rest)
+			}
+		}
+	}
+
+	if caps&clientProtocol41 == 0 {
+		return errors.New("MySQL server does not support protocol 4.1")
+	}
+
+	c.capabilities = caps & (clientLongPassword | clientProtocol41 | clientTransactions | clientSecureConnection |
+		clientMultiStatements | clientMultiResults | clientPSMultiResults | clientPluginAuth | clientPluginAuthLenenc)
+	if c.config.Schema != "" {
+		c.capabilities |= caps & clientConnectWithDB
+	}
+
+	if plugin != nativePassword && plugin != cachingSHA2Password {
+		plugin = nativePassword
+	}
+
+	auth := scramblePassword(plugin, c.config.Password, scramble)
+
+	resp := make([]byte, 4, 64)
+	binary.LittleEndian.PutUint32(resp, c.capabilities)
+	resp = append(resp, 0xff, 0xff, 0xff, 0x00, utf8mb4)
+	resp = append(resp, make([]byte, 23)...)
+	resp = append(resp, c.config.User...)
+	resp = append(resp, 0)
+
+	if c.capabilities&clientPluginAuthLenenc != 0 {
+		resp = appendLenencInt(resp, uint64(len(auth)))
+	} else {
+		resp = append(resp, byte(len(auth)))
+	}
+	resp = append(resp, auth...)
+
+	if c.capabilities&clientConnectWithDB != 0 {
+		resp = append(resp, c.config.Schema...)
+		resp = append(resp, 0)
+	}
+	if c.capabilities&clientPluginAuth != 0 {
+		resp = append(resp, plugin...)
+		resp = append(resp, 0)
+	}
+
+	seq++
+	if _, err = c.conn.Write(AppendPacket(nil, seq, resp)); err != nil {
+		return err
+	}
+
+	if err = c.authenticate(plugin, scramble); err != nil {
+		return err
+	}
+
+	// Schema is selected separately if server does not support selecting it in handshake
+	if c.config.Schema != "" && c.capabilities&clientConnectWithDB == 0 {
+		return c.initDB(c.config.Schema)
+	}
+
+	return nil
+}
+
+// authenticate reads server responses to authentication data, until server accepts or rejects it
+func (c *Conn) authenticate(plugin string, scramble []byte) error {
+	for {
+		p, seq, err := ReadPacket(c.conn)
+		if err != nil {
+			return err
+		}
+		if len(p) == 0 {
+			return ErrMalformed
+		}
+
+		var auth []byte
+
+		switch p[0] {
+		case okHeader:
+			return nil
+		case errHeader:
+			return parseError(p)
+		case eofHeader:
+			// Auth switch request: plugin name, followed by new scramble
+			n := bytes.IndexByte(p, 0)
+			if n == -1 {
+				return ErrMalformed
+			}
+			plugin = string(p[1:n])
+			scramble = bytes.TrimSuffix(p[n+1:], []byte{0})
+
+			if plugin != nativePassword && plugin != cachingSHA2Password {
+				return fmt.Errorf("MySQL authentication plugin %s is not supported", plugin)
+			}
+			auth = scramblePassword(plugin, c.config.Password, scramble)
+		case authMoreData:
+			if plugin != cachingSHA2Password || len(p) < 2 {
+				return ErrMalformed
+			}
+
+			switch p[1] {
+			case fastAuthSuccess:
+				// OK packet follows
+				continue
+			case performFullAuth:
+				auth = []byte{requestPublicKey}
+			default:
+				// Public key requested earlier
+				if auth, err = encryptPassword(c.config.Password, scramble, p[1:]); err != nil {
+					return err
+				}
+			}
+		default:
+			return ErrMalformed
+		}
+
+		if _, err = c.conn.Write(AppendPacket(nil, seq+1, auth)); err != nil {
+			return err
+		}
+	}
+}
+
+func scramblePassword(plugin, password string, scramble []byte) []byte {
+	if password == "" {
+		return nil
+	}
+
+	if len(scramble) > 20 {
+		scramble = scramble[:20]
+	}
+
+	if plugin == cachingSHA2Password {
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)), scramble)
+		h1 := sha256.Sum256([]byte(password))
+		h2 := sha256.Sum256(h1[:])
+		h3 := sha256.Sum256(append(h2[:], scramble...))
+		for i := range h1 {
+			h1[i] ^= h3[i]
+		}
+		return h1[:]
+	}
+
+	// SHA1(password) XOR SHA1(scramble, SHA1(SHA1(password)))
+	h1 := sha1.Sum([]byte(password))
+	h2 := sha1.Sum(h1[:])
+	h3 := sha1.Sum(append(append([]byte{}, scramble...), h2[:]...))
+	for i := range h1 {
+		h1[i] ^= h3[i]
+	}
+	return h1[:]
+}
+
+// encryptPassword encrypts password with server public key, if connection is not secure
+func encryptPassword(password string, scramble []byte, key []byte) ([]byte, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, errors.New("MySQL server sent invalid public key")
+	}
+
+	var pub *rsa.PublicKey
+	if parsed, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		pub, _ = parsed.(*rsa.PublicKey)
+	} else if pub, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+		return nil, err
+	}
+	if pub == nil {
+		return nil, errors.New("MySQL server sent invalid public key")
+	}
+
+	if len(scramble) > 20 {
+		scramble = scramble[:20]
+	}
+
+	plain := append([]byte(password), 0)
+	for i := range plain {
+		plain[i] ^= scramble[i%len(scramble)]
+	}
+
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, plain, nil)
+}
+
+// command sends command, and reads its response
+func (c *Conn) command(p []byte) ([]byte, error) {
+	if _, err := c.conn.Write(AppendPacket(nil, 0, p)); err != nil {
+		return nil, err
+	}
+
+	if !HasResponse(p[0]) {
+		return nil, nil
+	}
+
+	s := &scanner{r: c.conn}
+	for {
+		more, ok := readResult(p[0], s)
+		if !ok {
+			if s.err == nil {
+				s.err = ErrMalformed
+			}
+			return nil, s.err
+		}
+
+		if !more {
+			return s.data[:s.offset], nil
+		}
+	}
+}
+
+func (c *Conn) initDB(schema string) error {
+	resp, err := c.command(append([]byte{ComInitDB}, schema...))
+	if err != nil {
+		return err
+	}
+
+	if p := Payload(resp); p[0] == errHeader {
+		return parseError(p)
+	}
+
+	c.schema = schema
+
+	return nil
+}
+
+// prepare returns ID of prepared statement, statements are prepared once per connection
+func (c *Conn) prepare(sql string) (uint32, []byte, error) {
+	if id, ok := c.statements[sql]; ok {
+		return id, nil, nil
+	}
+
+	// Statements are not closed by clients replaying them, so their number is limited
+	if len(c.statements) >= maxPreparedStatements {
+		for _, id := range c.statements {
+			c.command(statementCommand(ComStmtClose, id))
+		}
+		c.statements = make(map[string]uint32)
+	}
+
+	resp, err := c.command(append([]byte{ComStmtPrepare}, sql...))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Error is returned as response to command
+	p := Payload(resp)
+	if p[0] != okHeader || len(p) < 5 {
+		return 0, resp, nil
+	}
+
+	id := binary.LittleEndian.Uint32(p[1:5])
+	c.statements[sql] = id
+
+	return id, nil, nil
+}
+
+func statementCommand(command byte, id uint32) []byte {
+	p := []byte{command, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(p[1:], id)
+	return p
+}
+
+// Exec replays command, and returns raw server response. Errors returned by server are returned as response.
+func (c *Conn) Exec(cmd *Command) ([]byte, error) {
+	if c.config.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	}
+
+	if cmd.Schema != "" && cmd.Schema != c.schema {
+		if err := c.initDB(cmd.Schema); err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Type == CommandQuery {
+		return c.command(append([]byte{ComQuery}, cmd.SQL...))
+	}
+
+	id, resp, err := c.prepare(cmd.SQL)
+	if err != nil || resp != nil {
+		return resp, err
+	}
+
+	return c.command(append(statementCommand(ComStmtExecute, id), cmd.Params...))
+}
+
+// Close sends COM_QUIT, and closes connection
+func (c *Conn) Close() error {
+	c.conn.Write(AppendPacket(nil, 0, []byte{ComQuit}))
+	return c.conn.Close()
+}
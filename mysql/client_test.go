@@ -0,0 +1,129 @@
+package mysql
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer accepts single connection: it asks client to switch to caching_sha2_password during authentication,
+// and answers commands with canned responses
+func startServer(t *testing.T, commands chan<- []byte) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := "\x00\x00\x00\x02\x00\x00\x00"
+	eof := "\xfe\x00\x00\x02\x00"
+	column := "\x03def\x00\x00\x00\x01a\x00\x0c\x3f\x00\x0b\x00\x00\x00\x03\x00\x00\x00\x00\x00"
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		scramble := []byte("abcdefghijklmnopqrst")
+		greeting := "\x0a8.0.36\x00\x01\x00\x00\x00" + string(scramble[:8]) + "\x00\xff\xff\x2d\x02\x00\xff\xff\x15" +
+			"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00" + string(scramble[8:]) + "\x00mysql_native_password\x00"
+		conn.Write(AppendPacket(nil, 0, []byte(greeting)))
+
+		p, _, _ := ReadPacket(conn)
+		if !bytes.Contains(p, append([]byte("app\x00\x14"), scramblePassword(nativePassword, "secret", scramble)...)) {
+			conn.Write(AppendPacket(nil, 2, []byte("\xff\x15\x04#28000Access denied")))
+			return
+		}
+
+		scramble = []byte("ABCDEFGHIJKLMNOPQRST")
+		conn.Write(AppendPacket(nil, 2, []byte("\xfecaching_sha2_password\x00"+string(scramble)+"\x00")))
+
+		p, _, _ = ReadPacket(conn)
+		if !bytes.Equal(p, scramblePassword(cachingSHA2Password, "secret", scramble)) {
+			conn.Write(AppendPacket(nil, 4, []byte("\xff\x15\x04#28000Access denied")))
+			return
+		}
+		conn.Write(AppendPacket(nil, 4, []byte("\x01\x03")))
+		conn.Write(AppendPacket(nil, 5, []byte(ok)))
+
+		for {
+			p, _, err := ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			commands <- p
+
+			var resp []byte
+			switch p[0] {
+			case ComQuery:
+				resp = packets("\x01", column, eof, "\x011", eof)
+			case ComStmtPrepare:
+				resp = packets("\x00\x07\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00", column, eof)
+			case ComInitDB, ComStmtExecute:
+				resp = packets(ok)
+			case ComQuit:
+				return
+			}
+			conn.Write(resp)
+		}
+	}()
+
+	return ln
+}
+
+func TestClient(t *testing.T) {
+	commands := make(chan []byte, 10)
+	ln := startServer(t, commands)
+	defer ln.Close()
+
+	conn, err := Dial(ln.Addr().String(), Config{User: "app", Password: "secret", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := conn.Exec(&Command{Type: CommandQuery, Schema: "shop", SQL: "SELECT 1"})
+	if err != nil || ResponseLength(ComQuery, resp) != len(resp) {
+		t.Fatal("Should read result set", resp, err)
+	}
+
+	if p := <-commands; string(p) != "\x02shop" {
+		t.Errorf("Should select schema: %q", p)
+	}
+	if p := <-commands; string(p) != "\x03SELECT 1" {
+		t.Errorf("Wrong query: %q", p)
+	}
+
+	// Statement is prepared once
+	cmd := &Command{Type: CommandExecute, Schema: "shop", SQL: "SELECT ?", Params: []byte{0, 1, 0, 0, 0, 0, 1, 0x08, 0, 1, 0, 0, 0, 0, 0, 0, 0}}
+	for i := 0; i < 2; i++ {
+		if resp, err = conn.Exec(cmd); err != nil || string(Payload(resp)) != "\x00\x00\x00\x02\x00\x00\x00" {
+			t.Fatal("Wrong response to execution", resp, err)
+		}
+	}
+
+	if p := <-commands; string(p) != "\x16SELECT ?" {
+		t.Errorf("Should prepare statement: %q", p)
+	}
+	for i := 0; i < 2; i++ {
+		if p := <-commands; !bytes.Equal(p, append([]byte{ComStmtExecute, 7, 0, 0, 0}, cmd.Params...)) {
+			t.Errorf("Wrong execution: %q", p)
+		}
+	}
+
+	conn.Close()
+	if p := <-commands; p[0] != ComQuit {
+		t.Errorf("Should send COM_QUIT: %q", p)
+	}
+}
+
+func TestClientAccessDenied(t *testing.T) {
+	ln := startServer(t, make(chan []byte, 10))
+	defer ln.Close()
+
+	_, err := Dial(ln.Addr().String(), Config{User: "app", Password: "wrong", Timeout: time.Second})
+	if e, ok := err.(*Error); !ok || e.Code != 1045 || e.Message != "Access denied" {
+		t.Error("Should return server error", err)
+	}
+}
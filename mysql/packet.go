@@ -0,0 +1,388 @@
+// Package mysql implements parts of MySQL client/server protocol needed to capture and replay client sessions.
+// See https://dev.mysql.com/doc/dev/mysql-server/latest/PAGE_PROTOCOL.html
+package mysql
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Commands sent by client, first byte of command packet payload
+const (
+	ComQuit             = 0x01
+	ComInitDB           = 0x02
+	ComQuery            = 0x03
+	ComFieldList        = 0x04
+	ComStatistics       = 0x09
+	ComPing             = 0x0e
+	ComStmtPrepare      = 0x16
+	ComStmtExecute      = 0x17
+	ComStmtSendLongData = 0x18
+	ComStmtClose        = 0x19
+	ComStmtReset        = 0x1a
+)
+
+// HasResponse returns false for commands which server does not answer
+func HasResponse(command byte) bool {
+	switch command {
+	case ComQuit, ComStmtSendLongData, ComStmtClose:
+		return false
+	}
+
+	return true
+}
+
+// Headers of server packets
+const (
+	okHeader     = 0x00
+	infileHeader = 0xfb
+	eofHeader    = 0xfe
+	errHeader    = 0xff
+)
+
+// Capability flags
+const (
+	clientLongPassword     = 0x00000001
+	clientConnectWithDB    = 0x00000008
+	clientProtocol41       = 0x00000200
+	clientSSL              = 0x00000800
+	clientTransactions     = 0x00002000
+	clientSecureConnection = 0x00008000
+	clientMultiStatements  = 0x00010000
+	clientMultiResults     = 0x00020000
+	clientPSMultiResults   = 0x00040000
+	clientPluginAuth       = 0x00080000
+	clientPluginAuthLenenc = 0x00200000
+	clientQueryAttributes  = 0x08000000
+)
+
+// Server status flag set if response is followed by another result set
+const serverMoreResultsExists = 0x0008
+
+// Payload of packet is limited to 16mb, larger payloads are split into multiple packets
+const maxPacketSize = 0xffffff
+
+// ErrMalformed returned if packet does not follow protocol
+var ErrMalformed = errors.New("malformed MySQL packet")
+
+// PacketLength returns length of the first packet in data including 4-byte header, or -1 if it is not complete.
+// Payloads split into multiple packets are treated as single packet.
+func PacketLength(data []byte) int {
+	length := 0
+
+	for {
+		if len(data) < length+4 {
+			return -1
+		}
+
+		size := int(data[length]) | int(data[length+1])<<8 | int(data[length+2])<<16
+		length += 4 + size
+
+		if length > len(data) {
+			return -1
+		}
+
+		if size < maxPacketSize {
+			return length
+		}
+	}
+}
+
+// payload joins payloads of packets which belong to the same command
+func payload(data []byte) []byte {
+	size := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+	if size < maxPacketSize {
+		return data[4 : 4+size]
+	}
+
+	var p []byte
+	for len(data) >= 4 {
+		size = int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		p = append(p, data[4:4+size]...)
+		data = data[4+size:]
+	}
+
+	return p
+}
+
+// Sequence returns sequence number of the first packet in data, commands start with 0
+func Sequence(data []byte) int {
+	if len(data) < 4 {
+		return -1
+	}
+
+	return int(data[3])
+}
+
+// Payload returns payload of the first packet in data, or nil if it is not complete
+func Payload(data []byte) []byte {
+	n := PacketLength(data)
+	if n == -1 {
+		return nil
+	}
+
+	return payload(data[:n])
+}
+
+// ResponseLength returns length of response to command, or -1 if it is not complete.
+// Result sets consist of multiple packets, and can be followed by more results, e.g. when stored procedure is called.
+func ResponseLength(command byte, data []byte) int {
+	s := &scanner{data: data}
+
+	for {
+		more, ok := readResult(command, s)
+		if !ok {
+			return -1
+		}
+
+		if !more {
+			return s.offset
+		}
+	}
+}
+
+// scanner reads packets from captured data, or from connection if it is set
+type scanner struct {
+	data   []byte
+	offset int
+	r      io.Reader
+	err    error
+}
+
+// next returns payload of the next packet, or nil if data is not complete or connection failed
+func (s *scanner) next() []byte {
+	for {
+		if n := PacketLength(s.data[s.offset:]); n != -1 {
+			p := payload(s.data[s.offset : s.offset+n])
+			s.offset += n
+
+			// Only parts of large payloads can be empty
+			if len(p) == 0 {
+				s.err = ErrMalformed
+				return nil
+			}
+
+			return p
+		}
+
+		if s.r == nil || s.err != nil {
+			return nil
+		}
+
+		buf := make([]byte, 16*1024)
+		n, err := s.r.Read(buf)
+		s.data = append(s.data, buf[:n]...)
+		s.err = err
+	}
+}
+
+// skipEOF skips EOF packet, unless EOF packets are deprecated
+func (s *scanner) skipEOF() {
+	// Captured data can end before EOF packet, or there may be no EOF packet
+	if s.r == nil && s.offset == len(s.data) {
+		return
+	}
+
+	offset := s.offset
+	if p := s.next(); p == nil || !isEOF(p) {
+		s.offset = offset
+	}
+}
+
+// skip skips count definitions, followed by EOF packet
+func (s *scanner) skip(count int) bool {
+	for i := 0; i < count; i++ {
+		if s.next() == nil {
+			return false
+		}
+	}
+
+	s.skipEOF()
+
+	return s.err == nil
+}
+
+// readResult reads single result, and returns whether it is followed by another one
+func readResult(command byte, s *scanner) (more bool, ok bool) {
+	p := s.next()
+	if p == nil {
+		return false, false
+	}
+
+	switch {
+	case p[0] == errHeader || p[0] == infileHeader:
+		return false, true
+	case command == ComStmtPrepare && p[0] == okHeader:
+		// Parameter and column definitions follow
+		if len(p) < 9 {
+			return false, true
+		}
+
+		columns := int(binary.LittleEndian.Uint16(p[5:7]))
+		params := int(binary.LittleEndian.Uint16(p[7:9]))
+
+		for _, count := range []int{params, columns} {
+			if count > 0 && !s.skip(count) {
+				return false, false
+			}
+		}
+
+		return false, true
+	case p[0] == okHeader || p[0] == eofHeader:
+		return moreResults(p), true
+	case command != ComQuery && command != ComStmtExecute && command != ComFieldList:
+		// e.g. COM_STATISTICS responds with human readable string
+		return false, true
+	}
+
+	// COM_FIELD_LIST response contains only column definitions
+	if command != ComFieldList {
+		columns, _, ok := lenencInt(p)
+		if !ok || !s.skip(int(columns)) {
+			return false, false
+		}
+	}
+
+	// Rows end with EOF packet, or with OK packet with EOF header if EOF packets are deprecated.
+	// Row can start with EOF header only if it is larger than 16mb.
+	for {
+		p := s.next()
+		if p == nil {
+			return false, false
+		}
+
+		switch {
+		case p[0] == errHeader:
+			return false, true
+		case p[0] == eofHeader && len(p) < maxPacketSize:
+			return moreResults(p), true
+		}
+	}
+}
+
+// isEOF checks if packet is EOF packet. OK packet with EOF header, which replaces it when EOF packets are deprecated,
+// is at least 7 bytes long.
+func isEOF(p []byte) bool {
+	return len(p) > 0 && p[0] == eofHeader && len(p) < 7
+}
+
+// moreResults checks status flags of OK or EOF packet
+func moreResults(p []byte) bool {
+	if isEOF(p) {
+		return len(p) >= 5 && binary.LittleEndian.Uint16(p[3:5])&serverMoreResultsExists != 0
+	}
+
+	// Affected rows and last insert ID precede status flags
+	_, n, ok := lenencInt(p[1:])
+	if !ok {
+		return false
+	}
+	_, m, ok := lenencInt(p[1+n:])
+	if !ok || len(p) < 1+n+m+2 {
+		return false
+	}
+
+	return binary.LittleEndian.Uint16(p[1+n+m:])&serverMoreResultsExists != 0
+}
+
+// lenencInt decodes length-encoded integer, and returns number of bytes it takes
+func lenencInt(b []byte) (v uint64, n int, ok bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+
+	switch b[0] {
+	case 0xfc:
+		n = 3
+	case 0xfd:
+		n = 4
+	case 0xfe:
+		n = 9
+	case 0xfb, 0xff:
+		return 0, 1, true
+	default:
+		return uint64(b[0]), 1, true
+	}
+
+	if len(b) < n {
+		return 0, 0, false
+	}
+
+	for i := n - 1; i > 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+
+	return v, n, true
+}
+
+func appendLenencInt(b []byte, v uint64) []byte {
+	switch {
+	case v < 251:
+		return append(b, byte(v))
+	case v < 1<<16:
+		return append(b, 0xfc, byte(v), byte(v>>8))
+	case v < 1<<24:
+		return append(b, 0xfd, byte(v), byte(v>>8), byte(v>>16))
+	}
+
+	b = append(b, 0xfe)
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(v>>(8*i)))
+	}
+
+	return b
+}
+
+// lenencString decodes length-encoded string, and returns number of bytes it takes
+func lenencString(b []byte) ([]byte, int, bool) {
+	length, n, ok := lenencInt(b)
+	if !ok || uint64(len(b)-n) < length {
+		return nil, 0, false
+	}
+
+	return b[n : n+int(length)], n + int(length), true
+}
+
+// ReadPacket reads payload of the next packet, payloads split into multiple packets are joined
+func ReadPacket(r io.Reader) (p []byte, seq byte, err error) {
+	header := make([]byte, 4)
+
+	for {
+		if _, err = io.ReadFull(r, header); err != nil {
+			return nil, 0, err
+		}
+
+		size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		seq = header[3]
+
+		chunk := make([]byte, size)
+		if _, err = io.ReadFull(r, chunk); err != nil {
+			return nil, 0, err
+		}
+		p = append(p, chunk...)
+
+		if size < maxPacketSize {
+			return p, seq, nil
+		}
+	}
+}
+
+// AppendPacket appends payload split into packets starting with given sequence number
+func AppendPacket(b []byte, seq byte, p []byte) []byte {
+	for {
+		size := len(p)
+		if size > maxPacketSize {
+			size = maxPacketSize
+		}
+
+		b = append(b, byte(size), byte(size>>8), byte(size>>16), seq)
+		b = append(b, p[:size]...)
+		p = p[size:]
+		seq++
+
+		if size < maxPacketSize {
+			return b
+		}
+	}
+}
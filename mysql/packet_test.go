@@ -0,0 +1,96 @@
+package mysql
+
+import (
+	"bytes"
+	"testing"
+)
+
+func packets(payloads ...string) []byte {
+	var b []byte
+	for i, p := range payloads {
+		b = AppendPacket(b, byte(i), []byte(p))
+	}
+	return b
+}
+
+func TestPacketLength(t *testing.T) {
+	if n := PacketLength(packets("\x03SELECT 1", "\x01")); n != 13 {
+		t.Error("Should return length of the first packet", n)
+	}
+
+	for _, data := range []string{"", "\x09\x00\x00", "\x09\x00\x00\x00\x03SELECT"} {
+		if n := PacketLength([]byte(data)); n != -1 {
+			t.Errorf("%q is not complete: %d", data, n)
+		}
+	}
+
+	// Payload of 16mb is followed by empty packet
+	large := append([]byte{ComQuery}, bytes.Repeat([]byte("a"), maxPacketSize)...)
+	data := AppendPacket(nil, 0, large)
+
+	if n := PacketLength(data); n != len(data) || n != maxPacketSize+1+8 {
+		t.Error("Should join split payload", n)
+	}
+	if PacketLength(data[:maxPacketSize+4]) != -1 {
+		t.Error("Split payload is not complete")
+	}
+	if !bytes.Equal(Payload(data), large) {
+		t.Error("Wrong payload")
+	}
+
+	p, seq, err := ReadPacket(bytes.NewReader(data))
+	if err != nil || seq != 1 || !bytes.Equal(p, large) {
+		t.Error("Should read split payload", seq, err)
+	}
+}
+
+func TestResponseLength(t *testing.T) {
+	ok := "\x00\x00\x00\x02\x00\x00\x00"
+	eof := "\xfe\x00\x00\x02\x00"
+	column := "\x03def\x00\x00\x00\x01a\x00\x0c\x3f\x00\x0b\x00\x00\x00\x03\x00\x00\x00\x00\x00"
+
+	cases := []struct {
+		name     string
+		command  byte
+		data     []byte
+		expected int
+	}{
+		{"ok", ComInitDB, packets(ok), 11},
+		{"error", ComQuery, packets("\xff\x48\x04#42000Unknown"), -2},
+		{"result set", ComQuery, packets("\x01", column, eof, "\x011", eof), -2},
+		{"incomplete result set", ComQuery, packets("\x01", column, eof, "\x011"), -1},
+		{"deprecated EOF", ComQuery, packets("\x01", column, "\x011", "\xfe\x00\x00\x02\x00\x00\x00"), -2},
+		{"more results", ComQuery, packets("\x01", column, eof, "\x011", "\xfe\x00\x00\x0a\x00", ok), -2},
+		{"incomplete more results", ComQuery, packets("\x01", column, eof, "\x011", "\xfe\x00\x00\x0a\x00"), -1},
+		{"prepare", ComStmtPrepare, packets("\x00\x01\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00", column, eof), -2},
+		{"prepare with deprecated EOF", ComStmtPrepare, packets("\x00\x01\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00", column), -2},
+		{"incomplete prepare", ComStmtPrepare, packets("\x00\x01\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00"), -1},
+		{"statistics", ComStatistics, packets("Uptime: 100"), 15},
+		{"field list", ComFieldList, packets(column, eof), -2},
+	}
+
+	for _, c := range cases {
+		expected := c.expected
+		if expected == -2 {
+			expected = len(c.data)
+		}
+
+		if n := ResponseLength(c.command, c.data); n != expected {
+			t.Errorf("%s: expected %d, got %d", c.name, expected, n)
+		}
+	}
+}
+
+func TestLenencInt(t *testing.T) {
+	for _, v := range []uint64{0, 250, 251, 1 << 16, 1<<24 - 1, 1 << 24, 1 << 40} {
+		b := appendLenencInt(nil, v)
+		decoded, n, ok := lenencInt(b)
+		if !ok || n != len(b) || decoded != v {
+			t.Errorf("%d: decoded %d (%d bytes)", v, decoded, n)
+		}
+	}
+
+	if _, _, ok := lenencInt([]byte{0xfc, 0x01}); ok {
+		t.Error("Should not decode incomplete integer")
+	}
+}
@@ -0,0 +1,120 @@
+package mysql
+
+import (
+	"strings"
+)
+
+// Statements which start with these keywords do not modify data, unless they use one of writeKeywords
+var readOnlyKeywords = map[string]bool{
+	"SELECT":   true,
+	"SHOW":     true,
+	"DESCRIBE": true,
+	"DESC":     true,
+	"EXPLAIN":  true,
+	"WITH":     true,
+}
+
+// SELECT ... INTO writes files or variables, and WITH and EXPLAIN can precede data modifying statements
+var writeKeywords = map[string]bool{
+	"INTO":    true,
+	"INSERT":  true,
+	"UPDATE":  true,
+	"DELETE":  true,
+	"REPLACE": true,
+}
+
+// IsReadOnly checks if SQL is a single statement which only reads data. Executable comments, e.g. /*! ... */,
+// and multiple statements are treated as modifying data, since they can't be checked reliably.
+func IsReadOnly(sql string) bool {
+	first := true
+	end := false
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case c == '#' || c == '-' && strings.HasPrefix(sql[i:], "-- "):
+			if n := strings.IndexByte(sql[i:], '\n'); n != -1 {
+				i += n + 1
+			} else {
+				i = len(sql)
+			}
+			continue
+		case strings.HasPrefix(sql[i:], "/*"):
+			if strings.HasPrefix(sql[i:], "/*!") {
+				return false
+			}
+			n := strings.Index(sql[i+2:], "*/")
+			if n == -1 {
+				return false
+			}
+			i += n + 4
+			continue
+		}
+
+		// Only whitespace and comments can follow the last statement
+		if end {
+			return false
+		}
+
+		switch {
+		case c == ';':
+			end = true
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			n := quoted(sql[i:], c)
+			if n == -1 {
+				return false
+			}
+			i += n
+		case isIdentifier(c):
+			n := i
+			for n < len(sql) && isIdentifier(sql[n]) {
+				n++
+			}
+
+			word := strings.ToUpper(sql[i:n])
+			if first && !readOnlyKeywords[word] || writeKeywords[word] {
+				return false
+			}
+
+			first = false
+			i = n
+		default:
+			if first {
+				return false
+			}
+			i++
+		}
+	}
+
+	return !first
+}
+
+// quoted returns length of quoted string or identifier, or -1 if it is not terminated
+func quoted(s string, quote byte) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			// Quote is escaped by doubling it
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+func isIdentifier(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$' || c >= 0x80
+}
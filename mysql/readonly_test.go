@@ -0,0 +1,36 @@
+package mysql
+
+import (
+	"testing"
+)
+
+func TestIsReadOnly(t *testing.T) {
+	cases := []struct {
+		sql      string
+		expected bool
+	}{
+		{"SELECT * FROM users WHERE id = 1", true},
+		{"  select name from `insert` where note = 'update; delete' -- comment", true},
+		{"/* report */ SHOW TABLES;", true},
+		{"EXPLAIN SELECT 1", true},
+		{"WITH t AS (SELECT 1) SELECT * FROM t", true},
+		{"SELECT 'it''s', \"a\\\"b\" # note", true},
+		{"UPDATE users SET name = 'a'", false},
+		{"SELECT * FROM users INTO OUTFILE '/tmp/users'", false},
+		{"SELECT 1; DELETE FROM users", false},
+		{"WITH t AS (SELECT 1) DELETE FROM users", false},
+		{"EXPLAIN UPDATE users SET name = 'a'", false},
+		{"SELECT /*! 1; DROP TABLE users */ 1", false},
+		{"SELECT 'unterminated", false},
+		{"SELECT 1 /* unterminated", false},
+		{"(SELECT 1)", false},
+		{"-- only comment", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if IsReadOnly(c.sql) != c.expected {
+			t.Errorf("%q: expected %v", c.sql, c.expected)
+		}
+	}
+}
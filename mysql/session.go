@@ -0,0 +1,443 @@
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Types of replayed commands
+const (
+	CommandQuery   = "Query"
+	CommandExecute = "Execute"
+)
+
+// Errors returned for commands which can't be replayed
+var (
+	ErrUnknownStatement = errors.New("statement was prepared before capture started")
+	ErrUnsupported      = errors.New("query attributes and long data of prepared statements are not supported")
+)
+
+// Flag of COM_STMT_EXECUTE set if parameter count is sent, used with query attributes
+const parameterCountAvailable = 0x08
+
+// Command is a client command which can be replayed: query, or execution of prepared statement.
+//
+// It is written as text, similar to HTTP message:
+//
+//	Execute\r\n
+//	Connection: 10.0.0.1:51234\r\n
+//	Schema: shop\r\n
+//	Params: 00010000000001030001000000\r\n
+//	\r\n
+//	SELECT * FROM orders WHERE id = ?
+type Command struct {
+	// CommandQuery or CommandExecute
+	Type string
+	// Client connection, commands of the same connection should be replayed in order using single connection
+	Connection string
+	// Default schema selected by client
+	Schema string
+	// Query, or SQL of prepared statement
+	SQL string
+	// Execute: flags, iteration count, and parameters in binary protocol. Types of parameters are always included.
+	Params []byte
+}
+
+// MarshalText writes command as text
+func (c *Command) MarshalText() ([]byte, error) {
+	var b bytes.Buffer
+
+	b.WriteString(c.Type + "\r\n")
+	b.WriteString("Connection: " + c.Connection + "\r\n")
+	if c.Schema != "" {
+		b.WriteString("Schema: " + c.Schema + "\r\n")
+	}
+	if c.Type == CommandExecute {
+		b.WriteString("Params: " + hex.EncodeToString(c.Params) + "\r\n")
+	}
+	b.WriteString("\r\n")
+	b.WriteString(c.SQL)
+
+	return b.Bytes(), nil
+}
+
+// UnmarshalText parses command written by MarshalText
+func (c *Command) UnmarshalText(data []byte) error {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end == -1 {
+		return ErrMalformed
+	}
+
+	lines := strings.Split(string(data[:end]), "\r\n")
+	*c = Command{Type: lines[0], SQL: string(data[end+4:])}
+
+	if c.Type != CommandQuery && c.Type != CommandExecute {
+		return ErrMalformed
+	}
+
+	for _, line := range lines[1:] {
+		i := strings.Index(line, ": ")
+		if i == -1 {
+			return ErrMalformed
+		}
+
+		value := line[i+2:]
+		switch line[:i] {
+		case "Connection":
+			c.Connection = value
+		case "Schema":
+			c.Schema = value
+		case "Params":
+			params, err := hex.DecodeString(value)
+			if err != nil {
+				return ErrMalformed
+			}
+			c.Params = params
+		}
+	}
+
+	if c.Type == CommandExecute && len(c.Params) < 5 {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+type statement struct {
+	sql    string
+	params int
+	// Types of parameters sent with the first execution
+	types []byte
+	// Parameter data was sent separately, before execution
+	longData bool
+}
+
+// Session is a state of client connection needed to replay its commands
+type Session struct {
+	schema       string
+	capabilities uint32
+	// Handshake was captured, so capabilities are known
+	handshake bool
+	// Connection uses TLS, and can't be decoded
+	encrypted  bool
+	statements map[uint32]*statement
+	lastSeen   time.Time
+}
+
+// Sessions tracks state of captured client connections. It is not safe for concurrent use.
+type Sessions struct {
+	sessions map[string]*Session
+	// Sessions without commands for this time are forgotten
+	timeout    time.Duration
+	lastExpire time.Time
+}
+
+// NewSessions constructor for Sessions
+func NewSessions(timeout time.Duration) *Sessions {
+	return &Sessions{
+		sessions: make(map[string]*Session),
+		timeout:  timeout,
+	}
+}
+
+// Len returns number of tracked sessions
+func (s *Sessions) Len() int {
+	return len(s.sessions)
+}
+
+func (s *Sessions) session(conn string, ts time.Time) *Session {
+	session, ok := s.sessions[conn]
+	if !ok {
+		session = &Session{statements: make(map[uint32]*statement)}
+		s.sessions[conn] = session
+	}
+	session.lastSeen = ts
+
+	if ts.Sub(s.lastExpire) >= time.Minute {
+		s.lastExpire = ts
+		for id, other := range s.sessions {
+			if ts.Sub(other.lastSeen) >= s.timeout {
+				delete(s.sessions, id)
+			}
+		}
+	}
+
+	return session
+}
+
+// Request updates state of the session with packets sent by client, and returns command which can be replayed.
+// Handshake, prepared statements management and other commands do not need to be replayed, and nil is returned.
+func (s *Sessions) Request(conn string, data []byte, ts time.Time) (*Command, error) {
+	session := s.session(conn, ts)
+
+	cmd, err := session.request(data, true)
+	if cmd != nil {
+		cmd.Connection = conn
+	}
+
+	// Session ends once client sends COM_QUIT, which has no response
+	if p := Payload(data); Sequence(data) == 0 && len(p) > 0 && p[0] == ComQuit {
+		delete(s.sessions, conn)
+	}
+
+	return cmd, err
+}
+
+// Command returns command sent by client without updating state of the session, e.g. to decide if response should be replayed
+func (s *Sessions) Command(conn string, data []byte) *Command {
+	session, ok := s.sessions[conn]
+	if !ok {
+		return nil
+	}
+
+	cmd, _ := session.request(data, false)
+	if cmd != nil {
+		cmd.Connection = conn
+	}
+
+	return cmd
+}
+
+// Response updates state of the session with server response to request, e.g. to map IDs of prepared statements
+func (s *Sessions) Response(conn string, req, resp []byte) {
+	session, ok := s.sessions[conn]
+	if !ok || Sequence(req) != 0 {
+		return
+	}
+
+	p, r := Payload(req), Payload(resp)
+	if len(p) == 0 || len(r) < 9 || p[0] != ComStmtPrepare || r[0] != okHeader {
+		return
+	}
+
+	id := binary.LittleEndian.Uint32(r[1:5])
+	session.statements[id] = &statement{
+		sql:    string(p[1:]),
+		params: int(binary.LittleEndian.Uint16(r[7:9])),
+	}
+}
+
+var useStatement = regexp.MustCompile("(?i)^\\s*use\\s+`?([^`;\\s]+)`?\\s*;?\\s*$")
+
+func (session *Session) request(data []byte, update bool) (*Command, error) {
+	p := Payload(data)
+	if len(p) == 0 {
+		return nil, ErrMalformed
+	}
+
+	if session.encrypted {
+		return nil, nil
+	}
+
+	// Handshake response is answer to server greeting, and other packets of authentication exchange follow it
+	if seq := Sequence(data); seq != 0 {
+		if seq == 1 && update {
+			session.parseHandshake(p)
+		}
+		return nil, nil
+	}
+
+	switch p[0] {
+	case ComInitDB:
+		if update {
+			session.schema = string(p[1:])
+		}
+	case ComQuery:
+		query, err := session.queryText(p[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		cmd := &Command{Type: CommandQuery, Schema: session.schema, SQL: string(query)}
+
+		if m := useStatement.FindSubmatch(query); m != nil && update {
+			session.schema = string(m[1])
+		}
+
+		return cmd, nil
+	case ComStmtExecute:
+		if len(p) < 10 {
+			return nil, ErrMalformed
+		}
+
+		st, ok := session.statements[binary.LittleEndian.Uint32(p[1:5])]
+		if !ok {
+			return nil, ErrUnknownStatement
+		}
+
+		if st.longData {
+			if update {
+				st.longData = false
+			}
+			return nil, ErrUnsupported
+		}
+
+		params, err := session.executeParams(st, p[5:], update)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Command{Type: CommandExecute, Schema: session.schema, SQL: st.sql, Params: params}, nil
+	case ComStmtSendLongData:
+		if st, ok := session.statements[binary.LittleEndian.Uint32(p[1:])]; ok && update && len(p) >= 5 {
+			st.longData = true
+		}
+	case ComStmtClose:
+		if len(p) >= 5 && update {
+			delete(session.statements, binary.LittleEndian.Uint32(p[1:5]))
+		}
+	}
+
+	return nil, nil
+}
+
+// parseHandshake reads capabilities and default schema from HandshakeResponse41
+func (session *Session) parseHandshake(p []byte) {
+	if len(p) < 32 {
+		return
+	}
+
+	caps := binary.LittleEndian.Uint32(p)
+	if caps&clientProtocol41 == 0 {
+		return
+	}
+
+	session.capabilities = caps
+	session.handshake = true
+
+	// SSL request is sent instead of handshake response, and TLS handshake follows
+	if caps&clientSSL != 0 && len(p) == 32 {
+		session.encrypted = true
+		return
+	}
+
+	// Max packet size, charset and reserved bytes are followed by user name
+	rest := p[32:]
+	end := bytes.IndexByte(rest, 0)
+	if end == -1 {
+		return
+	}
+	rest = rest[end+1:]
+
+	switch {
+	case caps&clientPluginAuthLenenc != 0:
+		_, n, ok := lenencString(rest)
+		if !ok {
+			return
+		}
+		rest = rest[n:]
+	case caps&clientSecureConnection != 0:
+		if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+			return
+		}
+		rest = rest[1+int(rest[0]):]
+	default:
+		if end = bytes.IndexByte(rest, 0); end == -1 {
+			return
+		}
+		rest = rest[end+1:]
+	}
+
+	if caps&clientConnectWithDB != 0 {
+		if end = bytes.IndexByte(rest, 0); end != -1 {
+			session.schema = string(rest[:end])
+		}
+	}
+}
+
+// queryText strips query attributes which precede query. Attributes themselves are not supported.
+func (session *Session) queryText(p []byte) ([]byte, error) {
+	// If handshake was not captured, attributes are recognized by parameter count and parameter set count,
+	// since query can't start with zero byte
+	if session.capabilities&clientQueryAttributes == 0 && (session.handshake || len(p) < 2 || p[0] != 0 || p[1] != 1) {
+		return p, nil
+	}
+
+	count, n, ok := lenencInt(p)
+	if !ok {
+		return nil, ErrMalformed
+	}
+	if count > 0 {
+		return nil, ErrUnsupported
+	}
+
+	// Parameter set count
+	_, m, ok := lenencInt(p[n:])
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	return p[n+m:], nil
+}
+
+// executeParams returns flags, iteration count and parameters of COM_STMT_EXECUTE, with parameter types always included
+func (session *Session) executeParams(st *statement, p []byte, update bool) ([]byte, error) {
+	flags := p[0] &^ parameterCountAvailable
+	params := append([]byte{flags}, p[1:5]...)
+	rest := p[5:]
+
+	count := st.params
+	if session.capabilities&clientQueryAttributes != 0 && (count > 0 || p[0]&parameterCountAvailable != 0) {
+		c, n, ok := lenencInt(rest)
+		if !ok {
+			return nil, ErrMalformed
+		}
+		if int(c) != count {
+			return nil, ErrUnsupported
+		}
+		rest = rest[n:]
+	}
+
+	if count == 0 {
+		return params, nil
+	}
+
+	bitmap := (count + 7) / 8
+	if len(rest) < bitmap+1 {
+		return nil, ErrMalformed
+	}
+
+	params = append(params, rest[:bitmap]...)
+	bound := rest[bitmap]
+	rest = rest[bitmap+1:]
+
+	types := st.types
+	if bound == 1 {
+		types = nil
+
+		for i := 0; i < count; i++ {
+			if len(rest) < 2 {
+				return nil, ErrMalformed
+			}
+			types = append(types, rest[:2]...)
+			rest = rest[2:]
+
+			// Names of parameters are sent with query attributes
+			if session.capabilities&clientQueryAttributes != 0 {
+				_, n, ok := lenencString(rest)
+				if !ok {
+					return nil, ErrMalformed
+				}
+				rest = rest[n:]
+			}
+		}
+
+		if update {
+			st.types = types
+		}
+	}
+
+	if types == nil {
+		return nil, ErrUnknownStatement
+	}
+
+	params = append(params, 1)
+	params = append(params, types...)
+
+	return append(params, rest...), nil
+}
@@ -0,0 +1,116 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func handshakeResponse(caps uint32, user, schema string) []byte {
+	p := make([]byte, 32)
+	binary.LittleEndian.PutUint32(p, caps)
+	p = append(p, user...)
+	p = append(p, 0, 0)
+	p = append(p, schema...)
+
+	return AppendPacket(nil, 1, append(p, 0))
+}
+
+func command(p ...byte) []byte {
+	return AppendPacket(nil, 0, p)
+}
+
+func TestSessions(t *testing.T) {
+	sessions := NewSessions(time.Hour)
+	now := time.Now()
+	conn := "10.0.0.1:51234"
+
+	caps := uint32(clientProtocol41 | clientSecureConnection | clientConnectWithDB)
+	if cmd, err := sessions.Request(conn, handshakeResponse(caps, "app", "shop"), now); cmd != nil || err != nil {
+		t.Fatal("Handshake should not be replayed", cmd, err)
+	}
+
+	cmd, err := sessions.Request(conn, command(append([]byte{ComQuery}, "USE inventory"...)...), now)
+	if err != nil || cmd.Type != CommandQuery || cmd.Schema != "shop" || cmd.SQL != "USE inventory" || cmd.Connection != conn {
+		t.Fatal("Wrong query", cmd, err)
+	}
+
+	prepare := command(append([]byte{ComStmtPrepare}, "SELECT * FROM items WHERE id = ? AND name = ?"...)...)
+	if cmd, err = sessions.Request(conn, prepare, now); cmd != nil || err != nil {
+		t.Fatal("Prepare should not be replayed", cmd, err)
+	}
+	sessions.Response(conn, prepare, packets("\x00\x05\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00"))
+
+	// Parameter types are sent only with the first execution
+	execute := command(ComStmtExecute, 5, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0x08, 0, 0xfe, 0, 7, 0, 0, 0, 0, 0, 0, 0, 3, 'a', 'b', 'c')
+	params := []byte{0, 1, 0, 0, 0, 0, 1, 0x08, 0, 0xfe, 0, 7, 0, 0, 0, 0, 0, 0, 0, 3, 'a', 'b', 'c'}
+
+	cmd, err = sessions.Request(conn, execute, now)
+	if err != nil || cmd.Type != CommandExecute || cmd.Schema != "inventory" || cmd.SQL != "SELECT * FROM items WHERE id = ? AND name = ?" || !reflect.DeepEqual(cmd.Params, params) {
+		t.Fatal("Wrong execution", cmd, err)
+	}
+
+	execute = command(ComStmtExecute, 5, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 1, 'd')
+	params = []byte{0, 1, 0, 0, 0, 0, 1, 0x08, 0, 0xfe, 0, 8, 0, 0, 0, 0, 0, 0, 0, 1, 'd'}
+
+	if cmd = sessions.Command(conn, execute); cmd == nil || !reflect.DeepEqual(cmd.Params, params) {
+		t.Fatal("Should include types of the first execution", cmd)
+	}
+
+	sessions.Request(conn, command(ComStmtClose, 5, 0, 0, 0), now)
+	if _, err = sessions.Request(conn, execute, now); err != ErrUnknownStatement {
+		t.Error("Statement should be closed", err)
+	}
+
+	sessions.Request(conn, command(ComQuit), now)
+	if sessions.Len() != 0 {
+		t.Error("Session should be closed")
+	}
+
+	// Commands of connections established before capture started can be replayed, unless they use prepared statements
+	if cmd, _ = sessions.Request("10.0.0.2:4000", command(append([]byte{ComQuery, 0, 1}, "SELECT 1"...)...), now); cmd == nil || cmd.SQL != "SELECT 1" {
+		t.Error("Should strip query attributes", cmd)
+	}
+
+	sessions.Request("10.0.0.3:4000", command(ComPing), now)
+	if _, err = sessions.Request("10.0.0.2:4000", execute, now.Add(2*time.Hour)); err != ErrUnknownStatement {
+		t.Error("Statement should be unknown", err)
+	}
+	if sessions.Len() != 1 {
+		t.Error("Idle session should expire", sessions.Len())
+	}
+}
+
+func TestSessionsEncrypted(t *testing.T) {
+	sessions := NewSessions(time.Hour)
+	now := time.Now()
+
+	ssl := make([]byte, 32)
+	binary.LittleEndian.PutUint32(ssl, clientProtocol41|clientSSL)
+	sessions.Request("10.0.0.1:51234", AppendPacket(nil, 1, ssl), now)
+
+	if cmd, _ := sessions.Request("10.0.0.1:51234", command(append([]byte{ComQuery}, "SELECT 1"...)...), now); cmd != nil {
+		t.Error("Encrypted session should be ignored", cmd)
+	}
+}
+
+func TestCommandText(t *testing.T) {
+	cmd := &Command{Type: CommandExecute, Connection: "10.0.0.1:51234", Schema: "shop", SQL: "SELECT ?\r\n\r\nFROM t", Params: []byte{0, 1, 0, 0, 0}}
+
+	text, _ := cmd.MarshalText()
+	if string(text) != "Execute\r\nConnection: 10.0.0.1:51234\r\nSchema: shop\r\nParams: 0001000000\r\n\r\nSELECT ?\r\n\r\nFROM t" {
+		t.Errorf("Wrong text: %q", text)
+	}
+
+	decoded := new(Command)
+	if err := decoded.UnmarshalText(text); err != nil || !reflect.DeepEqual(decoded, cmd) {
+		t.Error("Wrong command", decoded, err)
+	}
+
+	for _, text := range []string{"Query\r\nConnection: a", "GET / HTTP/1.1\r\n\r\n", "Execute\r\nParams: zz\r\n\r\nSELECT 1"} {
+		if err := decoded.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("Should reject %q", text)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATSConfig holds configuration of NATS input and output
+type NATSConfig struct {
+	// Output publishes to JetStream stream and waits for acknowledgements
+	jetStream bool
+	// Input reads JetStream stream using durable pull consumer, if it is set
+	stream  string
+	durable string
+	// Input subscribes in queue group, so payloads are split among subscribers of the group
+	queue string
+	// Removes credentials from payloads before they are published
+	redactor *headerRedactor
+}
+
+// Acknowledgements of JetStream are awaited for this time, and this many of them can be pending
+const (
+	natsAckTimeout = 5 * time.Second
+	natsMaxPending = 1024
+)
+
+type natsMsg struct {
+	subject string
+	reply   string
+	// Status of JetStream pull request, e.g. `404` if there are no messages
+	status string
+	data   []byte
+}
+
+// natsConn is connection to NATS server using its text protocol, with publishing, subscriptions and replies to
+// requests. Connection is not re-established, it is closed on first error and users dial new one.
+type natsConn struct {
+	conn   net.Conn
+	mu     sync.Mutex
+	writer *bufio.Writer
+
+	subsMu sync.Mutex
+	subs   map[int]chan natsMsg
+	sid    int
+	// Replies to requests are received by single inbox subscription
+	inbox   string
+	replies map[string]func(natsMsg)
+	nextID  int
+
+	closed chan struct{}
+	err    error
+}
+
+// parseNATSAddress parses `nats://[user:password@]host[:port]/subject` address, `tls://` scheme enables TLS. Port is
+// 4222 by default.
+func parseNATSAddress(address string) (u *url.URL, subject string, err error) {
+	if !strings.Contains(address, "://") {
+		address = "nats://" + address
+	}
+	if u, err = url.Parse(address); err != nil {
+		return
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, "", errors.New("host is not specified")
+	}
+	if u.Port() == "" {
+		u.Host += ":4222"
+	}
+
+	subject = strings.Trim(u.Path, "/")
+	if subject == "" {
+		return nil, "", errors.New("subject is not specified")
+	}
+
+	return
+}
+
+func dialNATS(u *url.URL) (*natsConn, error) {
+	var conn net.Conn
+	var err error
+	if u.Scheme == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", u.Host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = net.DialTimeout("tcp", u.Host, 5*time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &natsConn{
+		conn:    conn,
+		writer:  bufio.NewWriter(conn),
+		subs:    make(map[int]chan natsMsg),
+		replies: make(map[string]func(natsMsg)),
+		closed:  make(chan struct{}),
+	}
+	c.inbox = "_INBOX." + string(uuid())
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting %q: %v", line, err)
+	}
+
+	options := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"headers":       true,
+		"no_responders": true,
+		"name":          "gor",
+		"lang":          "go",
+		"version":       VERSION,
+		"protocol":      1,
+	}
+	if u.User != nil {
+		options["user"] = u.User.Username()
+		options["pass"], _ = u.User.Password()
+	}
+	connect, _ := json.Marshal(options)
+
+	// Server replies with PONG if CONNECT is accepted, or with error
+	fmt.Fprintf(c.writer, "CONNECT %s\r\nPING\r\n", connect)
+	if err := c.writer.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if strings.HasPrefix(line, "PONG") {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, errors.New(strings.TrimSpace(line))
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	go c.read(reader)
+
+	if _, err := c.subscribe(c.inbox+".*", "", c.dispatchReplies()); err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *natsConn) close(err error) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+
+	c.err = err
+	close(c.closed)
+	c.conn.Close()
+}
+
+// Close closes connection
+func (c *natsConn) Close() error {
+	c.close(errors.New("connection closed"))
+	return nil
+}
+
+func (c *natsConn) read(reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			c.close(err)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case strings.HasPrefix(line, "MSG ") || strings.HasPrefix(line, "HMSG "):
+			msg, sid, err := readNATSMsg(reader, line)
+			if err != nil {
+				c.close(err)
+				return
+			}
+
+			c.subsMu.Lock()
+			ch := c.subs[sid]
+			c.subsMu.Unlock()
+			if ch != nil {
+				select {
+				case ch <- msg:
+				case <-c.closed:
+					return
+				}
+			}
+		case line == "PING":
+			c.write("PONG\r\n", nil)
+		case strings.HasPrefix(line, "-ERR"):
+			c.close(errors.New(line))
+			return
+		}
+	}
+}
+
+// readNATSMsg reads message with given control line:
+//
+//	MSG <subject> <sid> [reply] <size>
+//	HMSG <subject> <sid> [reply] <headers size> <total size>
+func readNATSMsg(reader *bufio.Reader, line string) (msg natsMsg, sid int, err error) {
+	fields := strings.Fields(line)
+	headers := fields[0] == "HMSG"
+
+	minFields := 4
+	if headers {
+		minFields = 5
+	}
+	if len(fields) < minFields || len(fields) > minFields+1 {
+		return msg, 0, fmt.Errorf("malformed message %q", line)
+	}
+
+	msg.subject = fields[1]
+	if sid, err = strconv.Atoi(fields[2]); err != nil {
+		return
+	}
+	if len(fields) == minFields+1 {
+		msg.reply = fields[3]
+	}
+
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < 0 {
+		return msg, 0, fmt.Errorf("malformed message %q", line)
+	}
+	headersSize := 0
+	if headers {
+		if headersSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil || headersSize > size {
+			return msg, 0, fmt.Errorf("malformed message %q", line)
+		}
+	}
+
+	data := make([]byte, size+2)
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return
+	}
+
+	if headers {
+		// NATS/1.0 404 No Messages
+		status := strings.Fields(string(data[:bytes.IndexByte(data[:headersSize], '\r')+1]))
+		if len(status) > 1 {
+			msg.status = status[1]
+		}
+	}
+	msg.data = data[headersSize:size]
+
+	return
+}
+
+func (c *natsConn) write(command string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return c.err
+	default:
+	}
+
+	c.writer.WriteString(command)
+	if data != nil {
+		c.writer.Write(data)
+		c.writer.WriteString("\r\n")
+	}
+
+	// Published messages are buffered until there are enough of them, or until they are flushed
+	if strings.HasPrefix(command, "PUB ") && c.writer.Buffered() < 32<<10 {
+		return nil
+	}
+
+	return c.flush()
+}
+
+func (c *natsConn) flush() error {
+	if err := c.writer.Flush(); err != nil {
+		go c.close(err)
+		return err
+	}
+	return nil
+}
+
+// Flush sends buffered messages
+func (c *natsConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
+func (c *natsConn) publish(subject, reply string, data []byte) error {
+	if reply != "" {
+		reply += " "
+	}
+	return c.write("PUB "+subject+" "+reply+strconv.Itoa(len(data))+"\r\n", data)
+}
+
+// subscribe subscribes to subject and calls fn for each message, from single goroutine
+func (c *natsConn) subscribe(subject, queue string, fn func(natsMsg)) (int, error) {
+	c.subsMu.Lock()
+	c.sid++
+	sid := c.sid
+	ch := make(chan natsMsg, 256)
+	c.subs[sid] = ch
+	c.subsMu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case msg := <-ch:
+				fn(msg)
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+
+	if queue != "" {
+		queue += " "
+	}
+	if err := c.write("SUB "+subject+" "+queue+strconv.Itoa(sid)+"\r\n", nil); err != nil {
+		return 0, err
+	}
+
+	return sid, nil
+}
+
+func (c *natsConn) dispatchReplies() func(natsMsg) {
+	return func(msg natsMsg) {
+		c.subsMu.Lock()
+		fn := c.replies[msg.subject]
+		c.subsMu.Unlock()
+
+		if fn != nil {
+			fn(msg)
+		}
+	}
+}
+
+// newInbox returns reply subject, fn is called with replies to it until it is cancelled
+func (c *natsConn) newInbox(fn func(natsMsg)) string {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	c.nextID++
+	reply := c.inbox + "." + strconv.Itoa(c.nextID)
+	c.replies[reply] = fn
+
+	return reply
+}
+
+func (c *natsConn) cancelInbox(reply string) {
+	c.subsMu.Lock()
+	delete(c.replies, reply)
+	c.subsMu.Unlock()
+}
+
+// request publishes message and waits for the first reply
+func (c *natsConn) request(subject string, data []byte, timeout time.Duration) (natsMsg, error) {
+	replies := make(chan natsMsg, 1)
+	reply := c.newInbox(func(msg natsMsg) {
+		select {
+		case replies <- msg:
+		default:
+		}
+	})
+	defer c.cancelInbox(reply)
+
+	if err := c.publish(subject, reply, data); err != nil {
+		return natsMsg{}, err
+	}
+	if err := c.Flush(); err != nil {
+		return natsMsg{}, err
+	}
+
+	select {
+	case msg := <-replies:
+		if msg.status == "503" {
+			return msg, errors.New("no responders for " + subject)
+		}
+		return msg, nil
+	case <-c.closed:
+		return natsMsg{}, c.err
+	case <-time.After(timeout):
+		return natsMsg{}, errors.New("request to " + subject + " timed out")
+	}
+}
+
+// natsAPIError is error of JetStream API response
+type natsAPIError struct {
+	Error *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+func (e natsAPIError) err() error {
+	if e.Error == nil {
+		return nil
+	}
+	return fmt.Errorf("%d: %s", e.Error.Code, e.Error.Description)
+}
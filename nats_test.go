@@ -0,0 +1,245 @@
+package goreplay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type natsSubscription struct {
+	conn    net.Conn
+	subject string
+	sid     string
+}
+
+// natsServer emulates NATS server with JetStream stream GOR capturing `gor.>` subjects
+type natsServer struct {
+	net.Listener
+	mu     sync.Mutex
+	subs   []natsSubscription
+	stream [][]byte
+	// Position of consumer in stream
+	delivered int
+	acks      int
+}
+
+func newNATSServer(t *testing.T) *natsServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &natsServer{Listener: listener}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func natsSubjectMatch(pattern, subject string) bool {
+	p, s := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i := range p {
+		if p[i] == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) || (p[i] != "*" && p[i] != s[i]) {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+// deliver sends message to subscribers, should be called under lock
+func (s *natsServer) deliver(subject, reply string, headers string, data []byte) {
+	if reply != "" {
+		reply += " "
+	}
+	for _, sub := range s.subs {
+		if !natsSubjectMatch(sub.subject, subject) {
+			continue
+		}
+		if headers != "" {
+			fmt.Fprintf(sub.conn, "HMSG %s %s %s%d %d\r\n%s%s\r\n", subject, sub.sid, reply, len(headers), len(headers)+len(data), headers, data)
+		} else {
+			fmt.Fprintf(sub.conn, "MSG %s %s %s%d\r\n%s\r\n", subject, sub.sid, reply, len(data), data)
+		}
+	}
+}
+
+func (s *natsServer) subscribers(subject string) (n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subs {
+		if sub.subject == subject {
+			n++
+		}
+	}
+	return
+}
+
+func (s *natsServer) stored() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.stream)
+}
+
+func (s *natsServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	conn.Write([]byte("INFO {\"headers\":true}\r\n"))
+	reader := bufio.NewReader(conn)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		s.mu.Lock()
+		switch fields[0] {
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case "SUB":
+			s.subs = append(s.subs, natsSubscription{conn, fields[1], fields[len(fields)-1]})
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, size+2)
+			io.ReadFull(reader, data)
+			data = data[:size]
+			reply := ""
+			if len(fields) == 4 {
+				reply = fields[2]
+			}
+			s.publish(fields[1], reply, data)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// publish handles published message, should be called under lock
+func (s *natsServer) publish(subject, reply string, data []byte) {
+	switch {
+	case strings.HasPrefix(subject, "$JS.API.CONSUMER.DURABLE.CREATE.GOR."):
+		s.deliver(reply, "", "", []byte(`{"type":"io.nats.jetstream.api.v1.consumer_create_response","name":"d"}`))
+	case strings.HasPrefix(subject, "$JS.API.CONSUMER.MSG.NEXT.GOR."):
+		for ; s.delivered < len(s.stream); s.delivered++ {
+			s.deliver(reply, "$JS.ACK.GOR.d.1."+strconv.Itoa(s.delivered+1), "", s.stream[s.delivered])
+		}
+		s.deliver(reply, "", "NATS/1.0 408 Request Timeout\r\n\r\n", nil)
+	case strings.HasPrefix(subject, "$JS.ACK."):
+		s.acks++
+	default:
+		if natsSubjectMatch("gor.>", subject) && reply != "" {
+			s.stream = append(s.stream, data)
+			s.deliver(reply, "", "", []byte(`{"stream":"GOR","seq":`+strconv.Itoa(len(s.stream))+`}`))
+		}
+		s.deliver(subject, "", "", data)
+	}
+}
+
+func TestNATSOutputInput(t *testing.T) {
+	server := newNATSServer(t)
+	defer server.Close()
+	address := "nats://" + server.Addr().String() + "/gor.traffic"
+
+	input := NewNATSInput(address, &NATSConfig{})
+	defer input.Close()
+	for server.subscribers("gor.traffic") == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	output := NewNATSOutput(address, &NATSConfig{}).(*NATSOutput)
+	for i := 0; i < 3; i++ {
+		output.Write([]byte("1 " + strconv.Itoa(i) + " 1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+	output.Close()
+
+	buf := make([]byte, 1000)
+	for i := 0; i < 3; i++ {
+		n, err := input.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "1 " + strconv.Itoa(i) + " 1\nGET / HTTP/1.1\r\n\r\n"; string(buf[:n]) != expected {
+			t.Errorf("Expected %q, got %q", expected, buf[:n])
+		}
+	}
+
+	// Core NATS payloads are not stored
+	if stored := server.stored(); stored != 0 {
+		t.Error("Expected no stored payloads, got", stored)
+	}
+}
+
+func TestNATSJetStream(t *testing.T) {
+	server := newNATSServer(t)
+	defer server.Close()
+	address := "nats://" + server.Addr().String() + "/gor.traffic"
+
+	output := NewNATSOutput(address, &NATSConfig{jetStream: true}).(*NATSOutput)
+	for i := 0; i < 3; i++ {
+		output.Write([]byte("1 " + strconv.Itoa(i) + " 1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+	output.Close()
+
+	// Close waits for acknowledgements, so payloads are stored
+	if stored := server.stored(); stored != 3 {
+		t.Fatal("Expected 3 stored payloads, got", stored)
+	}
+
+	input := NewNATSInput(address, &NATSConfig{stream: "GOR", durable: "d"})
+	defer input.Close()
+
+	buf := make([]byte, 1000)
+	for i := 0; i < 3; i++ {
+		n, err := input.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "1 " + strconv.Itoa(i) + " 1\nGET / HTTP/1.1\r\n\r\n"; string(buf[:n]) != expected {
+			t.Errorf("Expected %q, got %q", expected, buf[:n])
+		}
+	}
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		server.mu.Lock()
+		acks := server.acks
+		server.mu.Unlock()
+
+		if acks == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected 3 acknowledgements, got", acks)
+		}
+	}
+}
+
+func TestParseNATSAddress(t *testing.T) {
+	u, subject, err := parseNATSAddress("user:pass@localhost/gor.traffic")
+	if err != nil || u.Host != "localhost:4222" || subject != "gor.traffic" || u.User.Username() != "user" {
+		t.Error("Wrong address", u, subject, err)
+	}
+
+	if _, _, err := parseNATSAddress("nats://localhost:4222"); err == nil {
+		t.Error("Subject should be required")
+	}
+}
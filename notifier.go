@@ -0,0 +1,116 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Events of pipeline sent by notifier
+const (
+	eventReplayStarted      = "replay_started"
+	eventReplayFinished     = "replay_finished"
+	eventErrorRateExceeded  = "error_rate_exceeded"
+	eventErrorRateRecovered = "error_rate_recovered"
+	eventWatchdogAlarm      = "watchdog_alarm"
+	eventWatchdogRecovered  = "watchdog_recovered"
+)
+
+// notification is sent to webhook as JSON
+type notification struct {
+	Event   string                 `json:"event"`
+	Message string                 `json:"message"`
+	Host    string                 `json:"host"`
+	Time    time.Time              `json:"time"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// notifier posts events of pipeline to webhook, so replay jobs running unattended can be followed. Slack incoming
+// webhooks are detected by their host, and get text message instead of event.
+type notifier struct {
+	url    string
+	slack  bool
+	host   string
+	client *http.Client
+	wg     sync.WaitGroup
+}
+
+// pipelineNotifier sends events of running gor, nil if --notify-webhook is not set
+var pipelineNotifier *notifier
+
+func newNotifier(webhook string) *notifier {
+	n := &notifier{url: webhook, client: &http.Client{Timeout: 5 * time.Second}}
+	n.host, _ = os.Hostname()
+	if u, err := url.Parse(webhook); err == nil && u.Hostname() == "hooks.slack.com" {
+		n.slack = true
+	}
+
+	return n
+}
+
+// notify sends event in background, if notifications are enabled
+func notify(event, message string, fields map[string]interface{}) {
+	if pipelineNotifier == nil {
+		return
+	}
+
+	pipelineNotifier.send(notification{Event: event, Message: message, Host: pipelineNotifier.host, Time: time.Now(), Fields: fields})
+}
+
+func (n *notifier) send(e notification) {
+	var body []byte
+	if n.slack {
+		text := fmt.Sprintf("*%s* on %s: %s", e.Event, e.Host, e.Message)
+		for k, v := range e.Fields {
+			text += fmt.Sprintf("\n• %s: %v", k, v)
+		}
+		body, _ = json.Marshal(map[string]string{"text": text})
+	} else {
+		body, _ = json.Marshal(e)
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+
+		resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("[NOTIFY] Webhook error:", err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			log.Println("[NOTIFY] Webhook responded with status", resp.Status)
+		}
+	}()
+}
+
+// flushNotifications waits until sent events are delivered, before gor exits
+func flushNotifications() {
+	if pipelineNotifier != nil {
+		pipelineNotifier.wg.Wait()
+	}
+}
+
+// pipelineSummary is implemented by plugins which count processed traffic, counts are sent with replay_finished event
+type pipelineSummary interface {
+	summary() map[string]interface{}
+}
+
+func replaySummary(plugins *InOutPlugins, started time.Time) map[string]interface{} {
+	fields := map[string]interface{}{"duration": time.Since(started).Round(time.Second).String()}
+	for _, p := range plugins.All {
+		if s, ok := p.(pipelineSummary); ok {
+			fields[fmt.Sprint(p)] = s.summary()
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,69 @@
+package goreplay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotifier(t *testing.T) {
+	events := make(chan notification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e notification
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer server.Close()
+
+	pipelineNotifier = newNotifier(server.URL)
+	defer func() { pipelineNotifier = nil }()
+
+	output := &HTTPOutput{address: "http://staging.com", config: &HTTPOutputConfig{}}
+	go output.watchErrorRate(0.5, 50*time.Millisecond)
+
+	atomic.StoreInt64(&output.sent, 20)
+	atomic.StoreInt64(&output.failures, 15)
+	e := <-events
+	if e.Event != eventErrorRateExceeded || e.Fields["errors"] != float64(15) || e.Host == "" {
+		t.Errorf("expected error rate exceeded event, got %+v", e)
+	}
+
+	atomic.AddInt64(&output.sent, 20)
+	e = <-events
+	if e.Event != eventErrorRateRecovered {
+		t.Errorf("expected error rate recovered event, got %+v", e)
+	}
+
+	notify(eventReplayFinished, "Gor finished", map[string]interface{}{"duration": "1s"})
+	flushNotifications()
+	if e = <-events; e.Event != eventReplayFinished || e.Fields["duration"] != "1s" {
+		t.Errorf("expected replay finished event, got %+v", e)
+	}
+}
+
+func TestNotifierSlack(t *testing.T) {
+	var body map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	n := newNotifier("https://hooks.slack.com/services/T000/B000/XXX")
+	if !n.slack {
+		t.Fatal("expected Slack webhook to be detected")
+	}
+
+	n.url = server.URL
+	n.send(notification{Event: eventReplayStarted, Message: "Gor started", Host: "replay-1"})
+	n.wg.Wait()
+
+	if !strings.HasPrefix(body["text"], "*replay_started* on replay-1: Gor started") {
+		t.Errorf("unexpected Slack message: %q", body["text"])
+	}
+}
@@ -0,0 +1,223 @@
+package goreplay
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Publisher confirms are awaited for this time, and this many of payloads can wait for them
+const (
+	amqpConfirmTimeout = 5 * time.Second
+	amqpMaxUnconfirmed = 1024
+)
+
+// AMQPOutput publishes payloads to AMQP 0-9-1 broker, like RabbitMQ, as persistent messages in Gor format. With
+// publisher confirms, limited number of payloads can wait for confirmation of broker. Connection is re-established after
+// it is lost, payloads written while there is no connection are dropped.
+type AMQPOutput struct {
+	sync.Mutex
+	address *url.URL
+	config  *AMQPConfig
+
+	conn     *amqpConn
+	lastDial time.Time
+	// Semaphore of payloads waiting for confirmation, and delivery tags of current connection waiting for it
+	pending     chan struct{}
+	confirmMu   sync.Mutex
+	unconfirmed map[uint64]bool
+	tag         uint64
+	done        chan struct{}
+	closed      bool
+}
+
+// NewAMQPOutput constructor for AMQPOutput, accepts address in `amqp://[user:password@]host[:port][/vhost]` format
+func NewAMQPOutput(address string, config *AMQPConfig) io.Writer {
+	u, err := parseAMQPAddress(address)
+	if err != nil {
+		log.Fatalln("output-amqp error:", err)
+	}
+
+	o := &AMQPOutput{
+		address:     u,
+		config:      config,
+		pending:     make(chan struct{}, amqpMaxUnconfirmed),
+		unconfirmed: make(map[uint64]bool),
+		done:        make(chan struct{}),
+	}
+
+	if o.conn, err = o.connect(); err != nil {
+		log.Fatalln("output-amqp error:", err)
+	}
+	o.lastDial = time.Now()
+
+	go func() {
+		ticker := time.NewTicker(KafkaOutputFrequency * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				o.Lock()
+				o.conn.Flush()
+				o.Unlock()
+			case <-o.done:
+				return
+			}
+		}
+	}()
+
+	return o
+}
+
+func (o *AMQPOutput) connect() (*amqpConn, error) {
+	if !o.config.confirm {
+		return dialAMQP(o.address, nil)
+	}
+
+	conn, err := dialAMQP(o.address, o.confirmed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.call(amqpConfirmSelect, []byte{0}, amqpConfirmSelectOk); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// confirmed releases payloads confirmed by broker, with multiple flag all payloads up to the tag are confirmed
+func (o *AMQPOutput) confirmed(tag uint64, multiple, ack bool) {
+	o.confirmMu.Lock()
+	defer o.confirmMu.Unlock()
+
+	if !ack {
+		log.Println("[AMQP-OUTPUT] payload is rejected by broker")
+	}
+
+	for t := range o.unconfirmed {
+		if t == tag || (multiple && t < tag) {
+			delete(o.unconfirmed, t)
+			<-o.pending
+		}
+	}
+}
+
+// releaseUnconfirmed releases payloads of lost connection, which will not be confirmed
+func (o *AMQPOutput) releaseUnconfirmed() {
+	o.confirmMu.Lock()
+	defer o.confirmMu.Unlock()
+
+	for t := range o.unconfirmed {
+		delete(o.unconfirmed, t)
+		<-o.pending
+	}
+	o.tag = 0
+}
+
+// connection returns current connection, or dials new one if it is closed, at most once a second. Should be called
+// under lock.
+func (o *AMQPOutput) connection() *amqpConn {
+	select {
+	case <-o.conn.closed:
+	default:
+		return o.conn
+	}
+
+	if time.Since(o.lastDial) < time.Second {
+		return nil
+	}
+	o.lastDial = time.Now()
+	log.Println("[AMQP-OUTPUT] connection error:", o.conn.err)
+
+	o.releaseUnconfirmed()
+	conn, err := o.connect()
+	if err != nil {
+		log.Println("[AMQP-OUTPUT] connection error:", err)
+		return nil
+	}
+	o.conn = conn
+
+	return conn
+}
+
+func (o *AMQPOutput) Write(data []byte) (n int, err error) {
+	if o.config.redactor != nil {
+		data = o.config.redactor.Redact(data)
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return 0, errors.New("AMQP output is closed")
+	}
+
+	conn := o.connection()
+	if conn == nil {
+		return len(data), nil
+	}
+
+	if o.config.confirm {
+		select {
+		case o.pending <- struct{}{}:
+		default:
+			// Buffered payloads are sent, so their confirmations can free the room
+			conn.Flush()
+
+			select {
+			case o.pending <- struct{}{}:
+			case <-conn.closed:
+				return len(data), nil
+			case <-time.After(amqpConfirmTimeout):
+				log.Println("[AMQP-OUTPUT] broker does not confirm payloads, reconnecting")
+				conn.close(errors.New("publisher confirms timed out"))
+				return len(data), nil
+			}
+		}
+
+		o.confirmMu.Lock()
+		o.tag++
+		o.unconfirmed[o.tag] = true
+		o.confirmMu.Unlock()
+	}
+
+	conn.publish(o.config.exchange, o.config.routingKey, data)
+
+	return len(data), nil
+}
+
+func (o *AMQPOutput) String() string {
+	return "AMQP output: " + o.address.Host + "/" + o.config.exchange + "/" + o.config.routingKey
+}
+
+// Close sends buffered payloads and waits for their confirmations
+func (o *AMQPOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	close(o.done)
+	o.conn.Flush()
+
+	deadline := time.After(amqpConfirmTimeout)
+wait:
+	for i := 0; i < amqpMaxUnconfirmed; i++ {
+		select {
+		case o.pending <- struct{}{}:
+		case <-o.conn.closed:
+			break wait
+		case <-deadline:
+			break wait
+		}
+	}
+
+	return o.conn.Close()
+}
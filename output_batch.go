@@ -0,0 +1,89 @@
+package goreplay
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// Outputs buffer payloads and write them in batches, so each small payload does not cost a syscall. Batch is written
+// when buffer is full, and by shared flusher after flush interval, so payloads are not delayed when traffic is low.
+
+// outputFlusher calls flush functions of outputs using the same interval from single goroutine
+type outputFlusher struct {
+	mu      sync.Mutex
+	flushes map[int]func()
+	nextID  int
+}
+
+var (
+	flushersMu sync.Mutex
+	flushers   = make(map[time.Duration]*outputFlusher)
+)
+
+// registerFlush calls flush every interval, until returned function is called
+func registerFlush(interval time.Duration, flush func()) (unregister func()) {
+	flushersMu.Lock()
+	f := flushers[interval]
+	if f == nil {
+		f = &outputFlusher{flushes: make(map[int]func())}
+		flushers[interval] = f
+		go f.run(interval)
+	}
+	flushersMu.Unlock()
+
+	f.mu.Lock()
+	id := f.nextID
+	f.nextID++
+	f.flushes[id] = flush
+	f.mu.Unlock()
+
+	return func() {
+		f.mu.Lock()
+		delete(f.flushes, id)
+		f.mu.Unlock()
+	}
+}
+
+func (f *outputFlusher) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		// Outputs are flushed without holding lock, so they can unregister while flush waits for them
+		f.mu.Lock()
+		flushes := make([]func(), 0, len(f.flushes))
+		for _, flush := range f.flushes {
+			flushes = append(flushes, flush)
+		}
+		f.mu.Unlock()
+
+		for _, flush := range flushes {
+			flush()
+		}
+	}
+}
+
+// batchWriter buffers writes to connection until batch size is reached, or it is flushed. It is safe for concurrent
+// use, so flusher can flush it while output writes. Like bufio.Writer, after error all writes fail.
+type batchWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func newBatchWriter(w io.Writer, size int) *batchWriter {
+	return &batchWriter{w: bufio.NewWriterSize(w, size)}
+}
+
+func (b *batchWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.w.Write(p)
+}
+
+// Flush writes buffered payloads
+func (b *batchWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.w.Flush()
+}
@@ -0,0 +1,297 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// ClickHouseOutputConfig clickhouse output configuration
+type ClickHouseOutputConfig struct {
+	batchSize     int
+	flushInterval time.Duration
+	timeout       time.Duration
+	// Mapping of table columns to recorded fields in `column=field` format
+	columns MultiOption
+}
+
+// clickHouseFields are fields of requests and responses which can be mapped to table columns. Header values are mapped
+// with `header:<name>` field.
+var clickHouseFields = map[string]func(r *payloadRecord) interface{}{
+	"type":        func(r *payloadRecord) interface{} { return r.payloadType },
+	"id":          func(r *payloadRecord) interface{} { return r.id },
+	"timestamp":   func(r *payloadRecord) interface{} { return time.Unix(0, r.timestamp).UTC().Format(time.RFC3339Nano) },
+	"latency":     func(r *payloadRecord) interface{} { return r.latency },
+	"client_addr": func(r *payloadRecord) interface{} { return r.clientAddr },
+	"method":      func(r *payloadRecord) interface{} { return r.method },
+	"url":         func(r *payloadRecord) interface{} { return r.url },
+	"host":        func(r *payloadRecord) interface{} { return r.host },
+	"status":      func(r *payloadRecord) interface{} { return r.status },
+	"size":        func(r *payloadRecord) interface{} { return r.size },
+	"body": func(r *payloadRecord) interface{} {
+		if r.method != "" || r.status != 0 {
+			return string(proto.Body(r.body))
+		}
+		return string(r.body)
+	},
+}
+
+// Columns written if mapping is not configured
+var clickHouseDefaultColumns = []string{"type", "id", "timestamp", "latency", "client_addr", "method", "url", "host", "status", "size"}
+
+type clickHouseColumn struct {
+	name   string
+	header []byte
+	value  func(r *payloadRecord) interface{}
+}
+
+// ClickHouseOutput inserts requests and responses into ClickHouse table in batches, using HTTP interface and
+// JSONEachRow format.
+type ClickHouseOutput struct {
+	sync.Mutex
+	endpoint string
+	user     string
+	password string
+	config   *ClickHouseOutputConfig
+	columns  []clickHouseColumn
+	client   *http.Client
+
+	batch   bytes.Buffer
+	rows    int
+	batches chan []byte
+	done    chan struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewClickHouseOutput constructor for ClickHouseOutput. Accepts address in `[http[s]://][user[:password]@]host[:port]/[database.]table`
+// format, port is 8123 by default.
+func NewClickHouseOutput(address string, config *ClickHouseOutputConfig) io.Writer {
+	o := new(ClickHouseOutput)
+	o.config = config
+
+	if config.batchSize <= 0 {
+		config.batchSize = 10000
+	}
+	if config.timeout <= 0 {
+		config.timeout = 30 * time.Second
+	}
+
+	var err error
+	if o.columns, err = parseClickHouseColumns(config.columns); err != nil {
+		log.Fatalln("output-clickhouse error:", err)
+	}
+	if o.endpoint, o.user, o.password, err = parseClickHouseAddress(address, o.columns); err != nil {
+		log.Fatalln("output-clickhouse error:", err)
+	}
+
+	o.client = &http.Client{Timeout: config.timeout}
+	o.batches = make(chan []byte, 10)
+	o.done = make(chan struct{})
+
+	o.wg.Add(1)
+	go o.sender()
+
+	if config.flushInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(config.flushInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					o.Lock()
+					o.flush()
+					o.Unlock()
+				case <-o.done:
+					return
+				}
+			}
+		}()
+	}
+
+	return o
+}
+
+func parseClickHouseColumns(mapping []string) (columns []clickHouseColumn, err error) {
+	if len(mapping) == 0 {
+		for _, name := range clickHouseDefaultColumns {
+			columns = append(columns, clickHouseColumn{name: name, value: clickHouseFields[name]})
+		}
+		return
+	}
+
+	for _, m := range mapping {
+		i := strings.Index(m, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("column mapping should be in column=field format, got %q", m)
+		}
+
+		column := clickHouseColumn{name: m[:i]}
+		field := m[i+1:]
+		if strings.HasPrefix(field, "header:") {
+			column.header = []byte(strings.TrimPrefix(field, "header:"))
+		} else if column.value = clickHouseFields[field]; column.value == nil {
+			return nil, fmt.Errorf("unknown field %q of column %q", field, column.name)
+		}
+		columns = append(columns, column)
+	}
+
+	return
+}
+
+func parseClickHouseAddress(address string, columns []clickHouseColumn) (endpoint, user, password string, err error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return
+	}
+
+	table := strings.Trim(u.Path, "/")
+	if u.Hostname() == "" {
+		return "", "", "", errors.New("host is not specified")
+	}
+	if table == "" {
+		return "", "", "", errors.New("table is not specified")
+	}
+
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if u.Port() == "" {
+		u.Host += ":8123"
+	}
+
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = "`" + c.name + "`"
+	}
+
+	query := url.Values{}
+	query.Set("query", "INSERT INTO "+table+" ("+strings.Join(names, ", ")+") FORMAT JSONEachRow")
+	// Parses RFC3339 timestamps
+	query.Set("date_time_input_format", "best_effort")
+
+	endpoint = u.Scheme + "://" + u.Host + "/?" + query.Encode()
+
+	return
+}
+
+func (o *ClickHouseOutput) Write(data []byte) (n int, err error) {
+	// Following chunks of large messages are not recorded
+	if index, _, _ := payloadChunk(data); index > 0 {
+		return len(data), nil
+	}
+
+	record := newPayloadRecord(data, true)
+	row := make(map[string]interface{}, len(o.columns))
+	for _, c := range o.columns {
+		if c.header != nil {
+			row[c.name] = string(proto.Header(record.body, c.header))
+		} else {
+			row[c.name] = c.value(&record)
+		}
+	}
+	encoded, err := json.Marshal(row)
+	if err != nil {
+		return 0, err
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return 0, errors.New("ClickHouse output is closed")
+	}
+
+	o.batch.Write(encoded)
+	o.batch.WriteByte('\n')
+	o.rows++
+
+	if o.rows >= o.config.batchSize {
+		o.flush()
+	}
+
+	return len(data), nil
+}
+
+// flush passes batch to sender. Should be called under lock.
+func (o *ClickHouseOutput) flush() {
+	if o.rows == 0 {
+		return
+	}
+
+	o.batches <- append([]byte(nil), o.batch.Bytes()...)
+	o.batch.Reset()
+	o.rows = 0
+}
+
+func (o *ClickHouseOutput) sender() {
+	defer o.wg.Done()
+
+	for batch := range o.batches {
+		if err := o.insert(batch); err != nil {
+			log.Println("[CLICKHOUSE-OUTPUT] insert error:", err)
+		}
+	}
+}
+
+func (o *ClickHouseOutput) insert(batch []byte) error {
+	req, err := http.NewRequest("POST", o.endpoint, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	if o.user != "" {
+		req.Header.Set("X-ClickHouse-User", o.user)
+		req.Header.Set("X-ClickHouse-Key", o.password)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+func (o *ClickHouseOutput) String() string {
+	return "ClickHouse output"
+}
+
+// Close inserts remaining rows and waits for pending inserts
+func (o *ClickHouseOutput) Close() error {
+	o.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.done)
+		o.flush()
+		close(o.batches)
+	}
+	o.Unlock()
+
+	o.wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package goreplay
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClickHouseOutput(t *testing.T) {
+	var mu sync.Mutex
+	var queries, users []string
+	var rows []map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		queries = append(queries, r.URL.Query().Get("query"))
+		users = append(users, r.Header.Get("X-ClickHouse-User")+":"+r.Header.Get("X-ClickHouse-Key"))
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			row := make(map[string]interface{})
+			if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+				t.Error(err)
+			}
+			rows = append(rows, row)
+		}
+	}))
+	defer server.Close()
+
+	address := strings.Replace(server.URL, "http://", "http://gor:secret@", 1) + "/gor.traffic"
+	output := NewClickHouseOutput(address, &ClickHouseOutputConfig{
+		batchSize: 2,
+		columns:   MultiOption{"ts=timestamp", "path=url", "status=status", "ua=header:User-Agent", "body=body"},
+	}).(*ClickHouseOutput)
+
+	ts := time.Date(2021, 3, 1, 22, 0, 0, 0, time.UTC).UnixNano()
+	output.Write(append(payloadHeader(RequestPayload, []byte("a1"), ts, -1), "POST /a HTTP/1.1\r\nUser-Agent: curl\r\nContent-Length: 2\r\n\r\nhi"...))
+	output.Write(append(payloadHeader(ResponsePayload, []byte("a1"), ts, 1000), "HTTP/1.1 404 Not Found\r\n\r\n"...))
+	output.Write(append(payloadHeader(RequestPayload, []byte("a2"), ts, -1), "GET /b HTTP/1.1\r\n\r\n"...))
+	output.Close()
+
+	if len(queries) != 2 {
+		t.Fatal("Expected 2 batches, got", len(queries))
+	}
+	if queries[0] != "INSERT INTO gor.traffic (`ts`, `path`, `status`, `ua`, `body`) FORMAT JSONEachRow" {
+		t.Error("Wrong query:", queries[0])
+	}
+	if users[0] != "gor:secret" {
+		t.Error("Wrong credentials:", users[0])
+	}
+	if len(rows) != 3 {
+		t.Fatal("Expected 3 rows, got", len(rows))
+	}
+
+	if rows[0]["ts"] != "2021-03-01T22:00:00Z" || rows[0]["path"] != "/a" || rows[0]["ua"] != "curl" || rows[0]["body"] != "hi" {
+		t.Error("Wrong request row:", rows[0])
+	}
+	if rows[1]["status"] != float64(404) || rows[1]["path"] != "" {
+		t.Error("Wrong response row:", rows[1])
+	}
+	if rows[2]["path"] != "/b" {
+		t.Error("Wrong last row:", rows[2])
+	}
+}
+
+func TestClickHouseOutputConfig(t *testing.T) {
+	columns, err := parseClickHouseColumns(nil)
+	if err != nil || len(columns) != len(clickHouseDefaultColumns) {
+		t.Error("Default columns expected", err)
+	}
+
+	if _, err := parseClickHouseColumns([]string{"path=uri"}); err == nil {
+		t.Error("Unknown field should be rejected")
+	}
+	if _, err := parseClickHouseColumns([]string{"path"}); err == nil {
+		t.Error("Mapping without field should be rejected")
+	}
+
+	endpoint, user, _, err := parseClickHouseAddress("default@localhost/traffic", columns[:1])
+	if err != nil || user != "default" || !strings.HasPrefix(endpoint, "http://localhost:8123/?") {
+		t.Error("Wrong endpoint", endpoint, user, err)
+	}
+	if _, _, _, err := parseClickHouseAddress("localhost", columns); err == nil {
+		t.Error("Address without table should be rejected")
+	}
+}
@@ -0,0 +1,251 @@
+package goreplay
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errDelayedOutputClosed = errors.New("delayed output is closed")
+
+// Payloads buffered by all delayed outputs, and payloads dropped because buffer was full or they were not due when
+// Gor stopped
+var (
+	delayBufferedBytes   int64
+	delayDroppedPayloads uint64
+)
+
+// delayedPayload is payload waiting in delayed output until its time
+type delayedPayload struct {
+	at      time.Time
+	seq     uint64
+	payload []byte
+}
+
+// delayQueue is heap of payloads ordered by their time, payloads with the same time keep order they were written
+type delayQueue []*delayedPayload
+
+func (q delayQueue) Len() int { return len(q) }
+
+func (q delayQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+
+func (q delayQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *delayQueue) Push(x interface{}) { *q = append(*q, x.(*delayedPayload)) }
+
+func (q *delayQueue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return p
+}
+
+// delayedOutput forwards payloads to output after fixed delay, e.g. to replay live traffic 5 minutes behind
+// production. Payloads are kept in buffer indexed by time they were captured, so original timing of requests and
+// order of requests and responses are kept. Payloads with timestamps older than delay, like ones read from files,
+// are delayed from time they are written. Buffer is bounded by --output-delay-max-size: when it is full, new payloads
+// are dropped and counted like payloads dropped by output queues.
+type delayedOutput struct {
+	out      io.Writer
+	delay    time.Duration
+	priority outputPriority
+	// Payloads are dropped while buffer has this many bytes, 0 is unlimited
+	maxSize int64
+
+	mu    sync.Mutex
+	queue delayQueue
+	seq   uint64
+	size  int64
+	// Set while payloads are dropped, so it is logged once
+	full bool
+	// Signalled when payload due earlier than others is queued
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	errMu sync.Mutex
+	err   error
+}
+
+func newDelayedOutput(out io.Writer, delay time.Duration, maxSize int64, priority outputPriority) *delayedOutput {
+	o := &delayedOutput{
+		out:      out,
+		delay:    delay,
+		maxSize:  maxSize,
+		priority: priority,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	o.wg.Add(1)
+	go o.run()
+
+	return o
+}
+
+// Write queues copy of payload, since emitter reuses its buffer. Error of previous write to output is returned, so
+// emitter stops like it does when output fails synchronously.
+func (o *delayedOutput) Write(payload []byte) (int, error) {
+	o.errMu.Lock()
+	err := o.err
+	o.errMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	at := now.Add(o.delay)
+	if info, ok := parsePayloadInfo(payload); ok && info.timestamp > 0 {
+		if captured := time.Unix(0, info.timestamp).Add(o.delay); captured.After(now) {
+			at = captured
+		}
+	}
+
+	o.mu.Lock()
+	select {
+	case <-o.done:
+		o.mu.Unlock()
+		return 0, errDelayedOutputClosed
+	default:
+	}
+
+	if o.maxSize > 0 && o.size+int64(len(payload)) > o.maxSize {
+		if !o.full {
+			log.Println("[DELAY] Buffer of", o.out, "is full, payloads are dropped until it is forwarded")
+			o.full = true
+		}
+		o.mu.Unlock()
+		o.drop(1)
+		return len(payload), nil
+	}
+	o.full = false
+
+	o.seq++
+	p := &delayedPayload{at: at, seq: o.seq, payload: getPayloadBuffer(payload)}
+	heap.Push(&o.queue, p)
+	o.size += int64(len(payload))
+	atomic.AddInt64(&delayBufferedBytes, int64(len(payload)))
+	first := o.queue[0] == p
+	o.mu.Unlock()
+
+	if first {
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return len(payload), nil
+}
+
+func (o *delayedOutput) run() {
+	defer o.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		o.mu.Lock()
+		var wait time.Duration = -1
+		var due *delayedPayload
+		if len(o.queue) > 0 {
+			if wait = time.Until(o.queue[0].at); wait <= 0 {
+				due = heap.Pop(&o.queue).(*delayedPayload)
+				o.size -= int64(len(due.payload))
+				atomic.AddInt64(&delayBufferedBytes, -int64(len(due.payload)))
+			}
+		}
+		o.mu.Unlock()
+
+		if due != nil {
+			o.write(due.payload)
+			continue
+		}
+
+		var expired <-chan time.Time
+		if wait > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			expired = timer.C
+		}
+
+		select {
+		case <-expired:
+		case <-o.wake:
+		case <-o.done:
+			return
+		}
+	}
+}
+
+func (o *delayedOutput) write(payload []byte) {
+	defer putPayloadBuffer(payload)
+
+	if _, err := o.out.Write(payload); err != nil {
+		o.errMu.Lock()
+		if o.err == nil {
+			o.err = err
+		}
+		o.errMu.Unlock()
+		return
+	}
+
+	if terminal != nil && !dispatched(o.out) {
+		terminal.write(o.out, payload)
+	}
+}
+
+// Close stops forwarding, payloads which are not due yet are dropped. Output itself is closed by its owner.
+func (o *delayedOutput) Close() error {
+	o.mu.Lock()
+	close(o.done)
+	dropped := len(o.queue)
+	for _, p := range o.queue {
+		putPayloadBuffer(p.payload)
+	}
+	o.queue = nil
+	atomic.AddInt64(&delayBufferedBytes, -o.size)
+	o.size = 0
+	o.mu.Unlock()
+
+	o.wg.Wait()
+
+	if dropped > 0 {
+		o.drop(dropped)
+		log.Println("[DELAY]", dropped, "delayed payloads of", o.out, "were not forwarded")
+	}
+
+	return nil
+}
+
+// drop counts dropped payloads, they are also counted by priority of output
+func (o *delayedOutput) drop(n int) {
+	atomic.AddUint64(&delayDroppedPayloads, uint64(n))
+	atomic.AddUint64(&droppedPayloads[o.priority], uint64(n))
+}
+
+// writeDelayMetrics writes size of delay buffers and number of dropped payloads in Prometheus text format
+func writeDelayMetrics(out io.Writer) {
+	fmt.Fprintln(out, "# HELP gor_output_delay_buffered_bytes Size of payloads buffered by --output-delay.")
+	fmt.Fprintln(out, "# TYPE gor_output_delay_buffered_bytes gauge")
+	fmt.Fprintf(out, "gor_output_delay_buffered_bytes %d\n", atomic.LoadInt64(&delayBufferedBytes))
+	fmt.Fprintln(out, "# HELP gor_output_delay_dropped_total Payloads dropped by --output-delay because buffer was full, or they were not due when Gor stopped.")
+	fmt.Fprintln(out, "# TYPE gor_output_delay_dropped_total counter")
+	fmt.Fprintf(out, "gor_output_delay_dropped_total %d\n", atomic.LoadUint64(&delayDroppedPayloads))
+}
@@ -0,0 +1,206 @@
+package goreplay
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+var errDispatcherClosed = errors.New("output dispatcher is closed")
+
+// outputDispatcher writes payloads to output from its own goroutine, so with many outputs emitter does not wait for
+// each of them in turn, and dispatching scales beyond single core. Payloads are written in order they were queued,
+// so requests and responses of the same session keep their order. Queue is bounded: when output can't keep up,
+// emitter blocks like it would writing to output directly, unless output is best-effort: its payloads are dropped.
+//
+// With spill policy of memory budget, payloads are queued in temporary file while budget is exceeded. Once file has
+// payloads, following ones are queued there too until output catches up, so order is kept.
+type outputDispatcher struct {
+	out      io.Writer
+	priority outputPriority
+	queue    chan []byte
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	// Writes are serialized, so payload is never queued in memory after payloads spilled before it
+	mu      sync.Mutex
+	spill   *payloadSpill
+	spilled chan struct{}
+
+	errMu sync.Mutex
+	err   error
+}
+
+func newOutputDispatcher(out io.Writer, size int, priority outputPriority) *outputDispatcher {
+	d := &outputDispatcher{
+		out:      out,
+		priority: priority,
+		queue:    make(chan []byte, size),
+		done:     make(chan struct{}),
+		spilled:  make(chan struct{}, 1),
+	}
+
+	d.wg.Add(1)
+	go d.run()
+
+	return d
+}
+
+func (d *outputDispatcher) run() {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case payload := <-d.queue:
+			d.write(payload)
+		case <-d.spilled:
+			// Spill file is created before the first signal
+			d.unspill(d.spill)
+		case <-d.done:
+			// Payloads queued before emitter stopped are written, like they would be without dispatcher
+			for {
+				select {
+				case payload := <-d.queue:
+					d.write(payload)
+				default:
+					// Writers blocked on full queue have returned, so lock is not held for long
+					d.mu.Lock()
+					spill := d.spill
+					d.mu.Unlock()
+
+					if spill != nil {
+						d.unspill(spill)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// unspill writes payloads queued in memory, which are older than spilled ones, and then spilled payloads until spill
+// file is empty
+func (d *outputDispatcher) unspill(spill *payloadSpill) {
+	for {
+		select {
+		case payload := <-d.queue:
+			d.write(payload)
+			continue
+		default:
+		}
+
+		payload, err := spill.pop()
+		if payload != nil {
+			d.write(payload)
+		}
+		if err != nil {
+			d.fail(err)
+			return
+		}
+		if payload == nil {
+			return
+		}
+	}
+}
+
+func (d *outputDispatcher) write(payload []byte) {
+	defer putPayloadBuffer(payload)
+
+	if _, err := d.out.Write(payload); err != nil {
+		d.fail(err)
+		return
+	}
+
+	if terminal != nil {
+		terminal.write(d.out, payload)
+	}
+}
+
+func (d *outputDispatcher) fail(err error) {
+	d.errMu.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.errMu.Unlock()
+}
+
+// Write queues copy of payload, since emitter reuses its buffer. Error of previous write to output is returned, so
+// emitter stops like it does when output fails synchronously.
+func (d *outputDispatcher) Write(payload []byte) (int, error) {
+	d.errMu.Lock()
+	err := d.err
+	d.errMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return 0, errDispatcherClosed
+	default:
+	}
+
+	if d.spill != nil && d.spill.len() > 0 || memoryGuard != nil && memoryGuard.spilling() {
+		return d.pushSpill(payload)
+	}
+
+	if d.priority == priorityBestEffort {
+		buf := getPayloadBuffer(payload)
+		select {
+		case d.queue <- buf:
+		default:
+			putPayloadBuffer(buf)
+			atomic.AddUint64(&droppedPayloads[priorityBestEffort], 1)
+		}
+		return len(payload), nil
+	}
+
+	select {
+	case d.queue <- getPayloadBuffer(payload):
+		return len(payload), nil
+	case <-d.done:
+		return 0, errDispatcherClosed
+	}
+}
+
+func (d *outputDispatcher) pushSpill(payload []byte) (int, error) {
+	if d.spill == nil {
+		spill, err := newPayloadSpill()
+		if err != nil {
+			return 0, err
+		}
+		log.Println("[MEMORY] Spilling payloads of", d.out, "to", spill.file.Name())
+		d.spill = spill
+	}
+
+	if err := d.spill.push(payload); err != nil {
+		return 0, err
+	}
+	atomic.AddUint64(&memoryGuard.spilled, 1)
+
+	select {
+	case d.spilled <- struct{}{}:
+	default:
+	}
+
+	return len(payload), nil
+}
+
+// Close stops dispatching after queued payloads are written. Output itself is closed by its owner.
+func (d *outputDispatcher) Close() error {
+	close(d.done)
+	d.wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.spill != nil {
+		return d.spill.Close()
+	}
+
+	return nil
+}
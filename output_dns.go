@@ -0,0 +1,212 @@
+package goreplay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// DNSOutputConfig holds configuration options for DNS output
+type DNSOutputConfig struct {
+	Workers        int
+	Timeout        time.Duration
+	TrackResponses bool
+}
+
+// DNSOutput replays captured DNS queries against another resolver, e.g. to shadow-test DNS infrastructure.
+// Queries are sent over UDP, and repeated over TCP if reply is truncated.
+type DNSOutput struct {
+	address   string
+	config    *DNSOutputConfig
+	buf       chan []byte
+	responses chan response
+	quit      chan struct{}
+}
+
+// NewDNSOutput constructor for DNSOutput
+func NewDNSOutput(address string, config *DNSOutputConfig) io.Writer {
+	o := new(DNSOutput)
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+
+	o.address = address
+	o.config = config
+	o.buf = make(chan []byte, 1000)
+	o.responses = make(chan response, 1000)
+	o.quit = make(chan struct{})
+
+	if o.config.Workers <= 0 {
+		o.config.Workers = 10
+	}
+	if o.config.Timeout <= 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	for i := 0; i < o.config.Workers; i++ {
+		go o.worker()
+	}
+
+	return o
+}
+
+func (o *DNSOutput) worker() {
+	var conn net.Conn
+	var err error
+
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	reply := make([]byte, 64*1024)
+
+	for {
+		var data []byte
+		select {
+		case <-o.quit:
+			return
+		case data = <-o.buf:
+		}
+
+		if conn == nil {
+			if conn, err = net.Dial("udp", o.address); err != nil {
+				log.Println("DNS output: can't connect to", o.address, err)
+				conn = nil
+				continue
+			}
+		}
+
+		query := payloadBody(data)
+		start := time.Now()
+
+		if _, err = conn.Write(query); err != nil {
+			log.Println("DNS output: write error", err)
+			conn.Close()
+			conn = nil
+			continue
+		}
+
+		if !o.config.TrackResponses {
+			continue
+		}
+
+		conn.SetReadDeadline(start.Add(o.config.Timeout))
+		resp, err := readDNSReply(conn, reply, query)
+		if err != nil {
+			continue
+		}
+
+		// Truncated reply
+		if resp[2]&0x02 != 0 {
+			if resp, err = o.queryTCP(query, start); err != nil {
+				log.Println("DNS output: TCP fallback error", err)
+				continue
+			}
+		}
+
+		stop := time.Now()
+		o.responses <- response{resp, payloadMeta(data)[1], start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+	}
+}
+
+// readDNSReply reads datagrams until reply with ID of the query is received. Replies to queries which timed out
+// earlier are skipped.
+func readDNSReply(conn net.Conn, buf []byte, query []byte) ([]byte, error) {
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n >= 12 && buf[0] == query[0] && buf[1] == query[1] {
+			resp := make([]byte, n)
+			copy(resp, buf[:n])
+			return resp, nil
+		}
+	}
+}
+
+// queryTCP sends query over TCP connection, messages are prefixed with 2-byte length
+func (o *DNSOutput) queryTCP(query []byte, start time.Time) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", o.address, o.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(start.Add(o.config.Timeout))
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(conn, msg[:2]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(msg))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (o *DNSOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
+
+	// DNS message is limited to 64kb, and always fits into single payload
+	if _, _, chunked := payloadChunk(data); chunked {
+		return len(data), nil
+	}
+
+	// Header of DNS message has 12 bytes
+	if len(payloadBody(data)) < 12 {
+		return len(data), nil
+	}
+
+	// We have to copy, because sending data in multiple threads
+	newBuf := make([]byte, len(data))
+	copy(newBuf, data)
+
+	o.buf <- newBuf
+
+	return len(data), nil
+}
+
+func (o *DNSOutput) Read(data []byte) (int, error) {
+	var resp response
+	select {
+	case <-o.quit:
+		return 0, io.EOF
+	case resp = <-o.responses:
+	}
+
+	header := payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	copy(data[0:len(header)], header)
+	copy(data[len(header):], resp.payload)
+
+	return len(resp.payload) + len(header), nil
+}
+
+func (o *DNSOutput) String() string {
+	return fmt.Sprintf("DNS output %s", o.address)
+}
+
+// Close stops workers
+func (o *DNSOutput) Close() error {
+	close(o.quit)
+	return nil
+}
@@ -0,0 +1,114 @@
+package goreplay
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// startDNSServer answers queries with ID 1 with a stale reply before the real one, and truncates replies
+// sent over UDP to queries with ID 2
+func startDNSServer(t *testing.T) (net.PacketConn, net.Listener) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := func(query []byte, truncated bool) []byte {
+		msg, _ := decodeDNS(query)
+		msg.QR = true
+		msg.TC = truncated
+		return serializeDNS(msg)
+	}
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			query := buf[:n]
+			if _, err := decodeDNS(query); err != nil {
+				continue
+			}
+
+			id := binary.BigEndian.Uint16(query)
+			if id == 1 {
+				udp.WriteTo(reply(buildDNSQuery(100, "stale.example.com", layers.DNSTypeA), false), addr)
+			}
+			udp.WriteTo(reply(query, id == 2), addr)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+
+			size := make([]byte, 2)
+			io.ReadFull(conn, size)
+			query := make([]byte, binary.BigEndian.Uint16(size))
+			io.ReadFull(conn, query)
+
+			resp := reply(query, false)
+			binary.BigEndian.PutUint16(size, uint16(len(resp)))
+			conn.Write(append(size, resp...))
+			conn.Close()
+		}
+	}()
+
+	return udp, tcp
+}
+
+func TestDNSOutput(t *testing.T) {
+	udp, tcp := startDNSServer(t)
+	defer udp.Close()
+	defer tcp.Close()
+
+	output := NewDNSOutput(udp.LocalAddr().String(), &DNSOutputConfig{Workers: 1, TrackResponses: true, Timeout: time.Second})
+	defer output.(*DNSOutput).Close()
+
+	// Only requests are replayed
+	output.Write(append(payloadHeader(ResponsePayload, uuid(), 1, 1), buildDNSQuery(3, "example.com", layers.DNSTypeA)...))
+
+	buf := make([]byte, 64*1024)
+	for _, id := range []uint16{1, 2} {
+		output.Write(append(payloadHeader(RequestPayload, uuid(), 1, -1), buildDNSQuery(id, "example.com", layers.DNSTypeA)...))
+
+		n, _ := output.(*DNSOutput).Read(buf)
+		if buf[0] != ReplayedResponsePayload {
+			t.Fatal("Should return replayed response", string(buf[:n]))
+		}
+
+		resp, err := decodeDNS(payloadBody(buf[:n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.ID != id || !resp.QR || resp.TC || string(resp.Questions[0].Name) != "example.com" {
+			t.Errorf("Wrong reply to query %d: %+v", id, resp)
+		}
+	}
+}
+
+func TestDNSOutputDefaultPort(t *testing.T) {
+	output := NewDNSOutput("127.0.0.1", &DNSOutputConfig{})
+	defer output.(*DNSOutput).Close()
+
+	if output.(*DNSOutput).address != "127.0.0.1:53" {
+		t.Error("Should use port 53 by default", output.(*DNSOutput).address)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package goreplay
 
 import (
 	"bufio"
@@ -18,15 +18,24 @@ import (
 )
 
 var dateFileNameFuncs = map[string]func(*FileOutput) string{
-	"%Y":  func(o *FileOutput) string { return time.Now().Format("2006") },
-	"%m":  func(o *FileOutput) string { return time.Now().Format("01") },
-	"%d":  func(o *FileOutput) string { return time.Now().Format("02") },
-	"%H":  func(o *FileOutput) string { return time.Now().Format("15") },
-	"%M":  func(o *FileOutput) string { return time.Now().Format("04") },
-	"%S":  func(o *FileOutput) string { return time.Now().Format("05") },
-	"%NS": func(o *FileOutput) string { return fmt.Sprint(time.Now().Nanosecond()) },
-	"%r":  func(o *FileOutput) string { return string(o.currentID) },
-	"%t":  func(o *FileOutput) string { return string(o.payloadType) },
+	"%Y":        func(o *FileOutput) string { return time.Now().Format("2006") },
+	"%m":        func(o *FileOutput) string { return time.Now().Format("01") },
+	"%d":        func(o *FileOutput) string { return time.Now().Format("02") },
+	"%H":        func(o *FileOutput) string { return time.Now().Format("15") },
+	"%M":        func(o *FileOutput) string { return time.Now().Format("04") },
+	"%S":        func(o *FileOutput) string { return time.Now().Format("05") },
+	"%NS":       func(o *FileOutput) string { return fmt.Sprint(time.Now().Nanosecond()) },
+	"%y":        func(o *FileOutput) string { return time.Now().Format("06") },
+	"%j":        func(o *FileOutput) string { return fmt.Sprintf("%03d", time.Now().YearDay()) },
+	"%s":        func(o *FileOutput) string { return fmt.Sprint(time.Now().Unix()) },
+	"%hostname": func(o *FileOutput) string { return hostname() },
+	"%r":        func(o *FileOutput) string { return string(o.currentID) },
+	"%t":        func(o *FileOutput) string { return string(o.payloadType) },
+}
+
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
 }
 
 // FileOutputConfig ...
@@ -36,6 +45,19 @@ type FileOutputConfig struct {
 	outputFileMaxSize int64
 	queueLimit        int
 	append            bool
+	// Start new chunk each interval, aligned to UTC clock
+	rotateInterval time.Duration
+	// Retention of files written using path template, the oldest files are removed
+	maxFiles     int
+	maxTotalSize int64
+	// AES-256 key, files are encrypted if set
+	key []byte
+	// Removes credentials from payloads before they are written
+	redactor *headerRedactor
+	// Payloads are written in Gor format, or as JSON lines
+	format string
+	// Size of write buffer, payloads are written to file in batches of this size
+	batchSize int
 }
 
 // FileOutput output plugin
@@ -47,11 +69,15 @@ type FileOutput struct {
 	queueLength    int
 	chunkSize      int
 	writer         io.Writer
+	encrypter      *encryptWriter
 	requestPerFile bool
 	currentID      []byte
 	payloadType    []byte
 	closed         bool
 	totalFileSize  int64
+	chunkStart     time.Time
+	// Unregisters output from shared flusher
+	stopFlush func()
 
 	config *FileOutputConfig
 }
@@ -67,16 +93,17 @@ func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
 		o.requestPerFile = true
 	}
 
-	go func() {
-		for {
-			time.Sleep(config.flushInterval)
-			if o.IsClosed() {
-				break
-			}
-			o.updateName()
-			o.flush()
+	if config.flushInterval <= 0 {
+		return o
+	}
+
+	o.stopFlush = registerFlush(config.flushInterval, func() {
+		if o.IsClosed() {
+			return
 		}
-	}()
+		o.updateName()
+		o.flush()
+	})
 
 	return o
 }
@@ -149,7 +176,8 @@ func (o *FileOutput) filename() string {
 
 		if o.currentName == "" ||
 			((o.config.queueLimit > 0 && o.queueLength >= o.config.queueLimit) ||
-				(o.config.sizeLimit > 0 && o.chunkSize >= int(o.config.sizeLimit))) {
+				(o.config.sizeLimit > 0 && o.chunkSize >= int(o.config.sizeLimit)) ||
+				(o.config.rotateInterval > 0 && !time.Now().Truncate(o.config.rotateInterval).Equal(o.chunkStart))) {
 			nextChunk = true
 		}
 
@@ -188,6 +216,10 @@ func (o *FileOutput) updateName() {
 }
 
 func (o *FileOutput) Write(data []byte) (n int, err error) {
+	if o.config.redactor != nil {
+		data = o.config.redactor.Redact(data)
+	}
+
 	if o.requestPerFile {
 		o.Lock()
 		meta := payloadMeta(data)
@@ -201,15 +233,27 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 	defer o.Unlock()
 
 	if o.file == nil || o.currentName != o.file.Name() {
-		o.closeLocked()
+		o.closeFile()
 
 		o.file, err = os.OpenFile(o.currentName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
 		o.file.Sync()
 
+		var w io.Writer = o.file
+		o.encrypter = nil
+		if o.config.key != nil {
+			// Data is compressed before encryption
+			if o.encrypter, err = newEncryptWriter(o.file, o.config.key); err != nil {
+				log.Fatal(o, "Cannot encrypt file %q. Error: %s", o.currentName, err)
+			}
+			w = o.encrypter
+		}
+
 		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer = gzip.NewWriter(o.file)
+			o.writer = gzip.NewWriter(w)
+		} else if o.config.batchSize > 0 {
+			o.writer = bufio.NewWriterSize(w, o.config.batchSize)
 		} else {
-			o.writer = bufio.NewWriter(o.file)
+			o.writer = bufio.NewWriter(w)
 		}
 
 		if err != nil {
@@ -217,12 +261,33 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 		}
 
 		o.queueLength = 0
+		o.chunkSize = 0
+		if o.config.rotateInterval > 0 {
+			o.chunkStart = time.Now().Truncate(o.config.rotateInterval)
+		}
+
+		if o.config.maxFiles > 0 || o.config.maxTotalSize > 0 {
+			o.removeOldFiles()
+		}
+
+		if o.config.format == FileFormatBinary {
+			o.writer.Write(binaryPayloadMagic)
+			o.totalFileSize += int64(len(binaryPayloadMagic))
+		}
+	}
+
+	separator := payloadSeparator
+	switch o.config.format {
+	case FileFormatJSON:
+		data, separator = payloadJSON(data), "\n"
+	case FileFormatBinary:
+		data, separator = encodeBinaryPayload(data), ""
 	}
 
 	o.writer.Write(data)
-	o.writer.Write([]byte(payloadSeparator))
+	o.writer.Write([]byte(separator))
 
-	o.totalFileSize += int64(len(data) + len(payloadSeparator))
+	o.totalFileSize += int64(len(data) + len(separator))
 	o.queueLength++
 
 	if Settings.outputFileConfig.outputFileMaxSize > 0 && o.totalFileSize >= Settings.outputFileConfig.outputFileMaxSize {
@@ -250,6 +315,10 @@ func (o *FileOutput) flush() {
 			o.writer.(*bufio.Writer).Flush()
 		}
 
+		if o.encrypter != nil {
+			o.encrypter.Flush()
+		}
+
 		if stat, err := o.file.Stat(); err == nil {
 			o.chunkSize = int(stat.Size())
 		} else {
@@ -262,15 +331,87 @@ func (o *FileOutput) String() string {
 	return "File output: " + o.file.Name()
 }
 
-func (o *FileOutput) closeLocked() error {
+// removeOldFiles removes the oldest files matching path template, until their number and total size are within
+// limits. Current file is never removed.
+func (o *FileOutput) removeOldFiles() {
+	pattern := o.pathTemplate
+	for name := range dateFileNameFuncs {
+		pattern = strings.Replace(pattern, name, "*", -1)
+	}
+
+	// Chunk index is added before extension
+	ext := filepath.Ext(pattern)
+	matches, err := filepath.Glob(strings.TrimSuffix(pattern, ext) + "*" + ext)
+	if err != nil {
+		log.Println("Wrong file pattern", pattern, err)
+		return
+	}
+
+	var files []os.FileInfo
+	var paths []string
+	var totalSize int64
+	for _, p := range matches {
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() && filepath.Clean(p) != o.currentName {
+			files = append(files, info)
+			paths = append(paths, p)
+			totalSize += info.Size()
+		}
+	}
+
+	sort.Sort(sortByModTime{files, paths})
+
+	for idx, info := range files {
+		// Number of files includes the current one
+		if (o.config.maxFiles <= 0 || len(files)-idx < o.config.maxFiles) &&
+			(o.config.maxTotalSize <= 0 || totalSize <= o.config.maxTotalSize) {
+			break
+		}
+
+		if err := os.Remove(paths[idx]); err != nil {
+			log.Println("Can't remove old file", err)
+			continue
+		}
+		totalSize -= info.Size()
+	}
+}
+
+// sortByModTime sorts files and their paths from the oldest
+type sortByModTime struct {
+	files []os.FileInfo
+	paths []string
+}
+
+func (s sortByModTime) Len() int {
+	return len(s.files)
+}
+
+func (s sortByModTime) Swap(i, j int) {
+	s.files[i], s.files[j] = s.files[j], s.files[i]
+	s.paths[i], s.paths[j] = s.paths[j], s.paths[i]
+}
+
+func (s sortByModTime) Less(i, j int) bool {
+	return s.files[i].ModTime().Before(s.files[j].ModTime())
+}
+
+// closeFile closes current file, next write opens a new one
+func (o *FileOutput) closeFile() {
 	if o.file != nil {
 		if strings.HasSuffix(o.currentName, ".gz") {
 			o.writer.(*gzip.Writer).Close()
 		} else {
 			o.writer.(*bufio.Writer).Flush()
 		}
+
+		if o.encrypter != nil {
+			o.encrypter.Close()
+		}
 		o.file.Close()
 	}
+}
+
+func (o *FileOutput) closeLocked() error {
+	o.closeFile()
 
 	o.closed = true
 	return nil
@@ -278,6 +419,10 @@ func (o *FileOutput) closeLocked() error {
 
 // Close closes the output file that is being written to.
 func (o *FileOutput) Close() error {
+	if o.stopFlush != nil {
+		o.stopFlush()
+	}
+
 	o.Lock()
 	defer o.Unlock()
 	return o.closeLocked()
@@ -0,0 +1,86 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Formats of payloads written by file output, TCP output supports gor and binary formats
+const (
+	FileFormatGor    = "gor"
+	FileFormatJSON   = "json"
+	FileFormatBinary = "binary"
+)
+
+// filePayloadJSON is payload written by file output in JSON format, one object per line. Repeated headers are joined
+// by comma, body is base64 encoded. Following chunks of large messages have only body.
+type filePayloadJSON struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id"`
+	Timestamp  int64             `json:"timestamp"`
+	Time       string            `json:"time"`
+	Latency    int64             `json:"latency,omitempty"`
+	ClientAddr string            `json:"client_addr,omitempty"`
+	Chunk      int               `json:"chunk,omitempty"`
+	More       bool              `json:"more,omitempty"`
+	Method     string            `json:"method,omitempty"`
+	URL        string            `json:"url,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       []byte            `json:"body,omitempty"`
+}
+
+var filePayloadTypes = map[byte]string{
+	RequestPayload:          "request",
+	ResponsePayload:         "response",
+	ReplayedResponsePayload: "replayed_response",
+}
+
+// payloadJSON encodes payload as JSON object. Payloads of other protocols than HTTP have whole message as body.
+func payloadJSON(data []byte) []byte {
+	meta := payloadMeta(data)
+	body := payloadBody(data)
+
+	p := filePayloadJSON{Type: filePayloadTypes[data[0]], ClientAddr: payloadClientAddr(data)}
+	if len(meta) > 1 {
+		p.ID = string(meta[1])
+	}
+	if len(meta) > 2 {
+		p.Timestamp, _ = strconv.ParseInt(string(meta[2]), 10, 64)
+		p.Time = time.Unix(0, p.Timestamp).UTC().Format(time.RFC3339Nano)
+	}
+	if len(meta) > 3 && data[0] != RequestPayload {
+		p.Latency, _ = strconv.ParseInt(string(meta[3]), 10, 64)
+	}
+	p.Chunk, p.More, _ = payloadChunk(data)
+
+	isResponse := data[0] != RequestPayload && bytes.HasPrefix(body, []byte("HTTP/"))
+	if p.Chunk > 0 || !isResponse && !proto.IsHTTPPayload(body) {
+		p.Body = body
+	} else {
+		if isResponse {
+			p.Status, _ = strconv.Atoi(string(proto.Status(body)))
+		} else {
+			p.Method, p.URL = string(proto.Method(body)), string(proto.Path(body))
+		}
+
+		p.Headers = make(map[string]string)
+		proto.ParseHeaders([][]byte{body}, func(header []byte, value []byte) bool {
+			if v, ok := p.Headers[string(header)]; ok {
+				p.Headers[string(header)] = v + ", " + string(value)
+			} else {
+				p.Headers[string(header)] = string(value)
+			}
+			return true
+		})
+		p.Body = proto.Body(body)
+	}
+
+	encoded, _ := json.Marshal(&p)
+
+	return encoded
+}
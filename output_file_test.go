@@ -1,12 +1,15 @@
-package main
+package goreplay
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -40,7 +43,7 @@ func TestFileOutput(t *testing.T) {
 	quit = make(chan int)
 
 	var counter int64
-	input2 := NewFileInput("/tmp/test_requests.gor", false)
+	input2 := NewFileInput("/tmp/test_requests.gor", &FileInputConfig{})
 	output2 := NewTestOutput(func(data []byte) {
 		atomic.AddInt64(&counter, 1)
 		wg.Done()
@@ -161,6 +164,37 @@ func TestFileOutputCompression(t *testing.T) {
 	os.Remove(name)
 }
 
+func TestFileOutputJSON(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d.jsonl", rand.Int63())
+	defer os.Remove(name)
+
+	output := NewFileOutput(name, &FileOutputConfig{append: true, flushInterval: time.Minute, format: FileFormatJSON})
+	output.Write(append(payloadAddrHeader(payloadHeader(RequestPayload, []byte("a1"), 1614636000000000000, -1), "10.0.0.1:5000"), []byte("POST /users?id=1 HTTP/1.1\r\nHost: example.com\r\nAccept: a\r\nAccept: b\r\nContent-Length: 2\r\n\r\nab")...))
+	output.Write(append(payloadHeader(ResponsePayload, []byte("a1"), 1614636000000000001, 1000), []byte("HTTP/1.1 201 Created\r\n\r\n")...))
+	output.Close()
+
+	data, _ := ioutil.ReadFile(name)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Expected JSON object per line:", string(data))
+	}
+
+	var req, resp filePayloadJSON
+	json.Unmarshal([]byte(lines[0]), &req)
+	json.Unmarshal([]byte(lines[1]), &resp)
+
+	expected := filePayloadJSON{
+		Type: "request", ID: "a1", Timestamp: 1614636000000000000, Time: "2021-03-01T22:00:00Z", ClientAddr: "10.0.0.1:5000",
+		Method: "POST", URL: "/users?id=1", Headers: map[string]string{"Host": "example.com", "Accept": "a, b", "Content-Length": "2"}, Body: []byte("ab"),
+	}
+	if !reflect.DeepEqual(req, expected) {
+		t.Errorf("Wrong request:\n%+v\n%+v", req, expected)
+	}
+	if resp.Type != "response" || resp.Status != 201 || resp.Latency != 1000 || len(resp.Body) != 0 {
+		t.Errorf("Wrong response: %+v", resp)
+	}
+}
+
 func TestParseDataUnit(t *testing.T) {
 	var d = map[string]int64{
 		"42mb":                 42 << 20,
@@ -354,3 +388,69 @@ func TestFileOutputAppendSizeLimitOverflow(t *testing.T) {
 	os.Remove(name1)
 	os.Remove(name3)
 }
+
+func TestFileOutputRotate(t *testing.T) {
+	rnd := rand.Int63()
+	name := fmt.Sprintf("/tmp/%d", rnd)
+
+	output := NewFileOutput(name, &FileOutputConfig{flushInterval: time.Minute, rotateInterval: 100 * time.Millisecond})
+
+	output.Write([]byte("1 1 1\r\ntest"))
+	name1 := output.file.Name()
+	defer os.Remove(name1)
+
+	time.Sleep(100 * time.Millisecond)
+	output.Write([]byte("1 1 1\r\ntest"))
+	name2 := output.file.Name()
+	defer os.Remove(name2)
+
+	if name1 != fmt.Sprintf("/tmp/%d_0", rnd) || name2 != fmt.Sprintf("/tmp/%d_1", rnd) {
+		t.Error("New chunk should be started after interval:", name1, name2)
+	}
+
+	output.Write([]byte("1 1 1\r\ntest"))
+	if output.file.Name() != name2 {
+		t.Error("Chunk should not change within interval:", output.file.Name())
+	}
+	output.Close()
+}
+
+func TestFileOutputRetention(t *testing.T) {
+	rnd := rand.Int63()
+	name := fmt.Sprintf("/tmp/%d-%%hostname.gor", rnd)
+	message := []byte("1 1 1\r\ntest")
+
+	output := NewFileOutput(name, &FileOutputConfig{flushInterval: time.Minute, queueLimit: 1, maxFiles: 3})
+
+	var names []string
+	for i := 0; i < 5; i++ {
+		output.Write(message)
+		output.flush()
+		names = append(names, output.file.Name())
+		defer os.Remove(output.file.Name())
+
+		// Files are removed in order of modification
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if names[4] != fmt.Sprintf("/tmp/%d-%s_4.gor", rnd, hostname()) {
+		t.Error("Hostname should be added to file name:", names[4])
+	}
+
+	for i, name := range names {
+		if _, err := os.Stat(name); os.IsNotExist(err) != (i < 2) {
+			t.Errorf("Only 3 latest files should be kept, file %d exists: %v", i, err == nil)
+		}
+	}
+
+	output.config.maxFiles = 0
+	output.config.maxTotalSize = int64(len(message) + len(payloadSeparator))
+	output.Write(message)
+	output.Close()
+
+	for i, name := range names {
+		if _, err := os.Stat(name); os.IsNotExist(err) != (i < 4) {
+			t.Errorf("Files should be removed when total size is exceeded, file %d exists: %v", i, err == nil)
+		}
+	}
+}
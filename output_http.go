@@ -1,8 +1,13 @@
-package main
+package goreplay
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"log"
+	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -29,19 +34,94 @@ type HTTPOutputConfig struct {
 	workers    int
 	queueLen   int
 
+	// Workers are added when queue is longer than threshold, number of active workers by default. Dynamic workers
+	// stop after being idle for scaleDownIdle.
+	scaleUpThreshold int
+	scaleDownIdle    time.Duration
+
+	// Replay requests of each captured connection using its own connection, instead of workers
+	originalConcurrency bool
+	// Sessions of --output-http-original-concurrency, client-addr by default, client-ip, header:<name> or cookie:<name>
+	sessionKey string
+	// Keep original delays between requests of session
+	sessionDelays bool
+
 	elasticSearch string
 
+	// Addresses of service discovery APIs used by `consul://`, `etcd://` and `k8s://` targets
+	consulAddress string
+	etcdAddress   string
+	k8sAddress    string
+
+	// IP addresses used instead of resolving host names, and interval of resolving them again
+	resolve         map[string]string
+	resolveInterval time.Duration
+
+	// Host header and TLS server name sent instead of target host
+	host       string
+	serverName string
+
+	// Headers set to IP address of client which sent original request, and if PROXY protocol header is sent
+	clientIPHeaders MultiOption
+	proxyProtocol   bool
+
+	// Send requests using HTTP/2 and HTTP/3, see HTTPClientConfig.HTTP2 and HTTPClientConfig.HTTP3
+	http2 bool
+	http3 bool
+
+	// Header set to ID of captured request, so target logs can be joined with captured traffic
+	requestIDHeader string
+	// Prefix of headers set to Kubernetes pod metadata of captured request
+	k8sHeaderPrefix string
+	// Compress bodies decompressed by --http-decompress again
+	recompress bool
+	// Send captured headers in their original order and name casing, headers added by Gor follow them
+	preserveHeaders bool
+	// Session of cookie jars, client-ip or client-addr, empty if captured cookies are replayed as is
+	cookieJar string
+	// Rules extracting values from responses, which are replaced in following requests
+	correlate HTTPCorrelationRules
+
 	Timeout      time.Duration
 	OriginalHost bool
-	BufferSize   int
+
+	// Timeouts of connecting, TLS handshake and waiting for response headers, Timeout is used by default
+	connectTimeout        time.Duration
+	tlsTimeout            time.Duration
+	responseHeaderTimeout time.Duration
+	// Total time of request, requests exceeding it are abandoned
+	deadline time.Duration
+
+	// Limits of connections opened by workers, see connPool
+	maxConnsPerHost  int
+	maxIdleConns     int
+	idleTimeout      time.Duration
+	disableKeepAlive bool
+
+	BufferSize int
+
+	// Time streaming responses are read for, and maximum number of response bytes read
+	responseStreamTimeout time.Duration
+	responseMaxRead       int
+	// Tracked responses are cut to given size, responses are tracked whole if it is 0
+	trackResponseSize int
 
 	CompatibilityMode bool
 
 	Debug bool
 
 	TrackResponses bool
+
+	// Share of failed requests which triggers error_rate_exceeded notification, disabled if 0
+	notifyErrorRate float64
 }
 
+// Interval error rate of output is checked with, and minimal number of requests sent during it
+const (
+	errorRateInterval = time.Minute
+	errorRateRequests = 10
+)
+
 // HTTPOutput plugin manage pool of workers which send request to replayed server
 // By default workers pool is dynamic and starts with 10 workers
 // You can specify fixed number of workers using `--output-http-workers`
@@ -50,6 +130,11 @@ type HTTPOutput struct {
 	// alignment. atomic.* functions crash on 32bit machines if operand is not
 	// aligned at 64bit. See https://github.com/golang/go/issues/599
 	activeWorkers int64
+	// Requests accepted by output, and not responded yet
+	inFlight int64
+	// Requests sent, and requests which failed or got 5xx response
+	sent     int64
+	failures int64
 
 	address string
 	limit   int
@@ -62,8 +147,37 @@ type HTTPOutput struct {
 	config *HTTPOutputConfig
 
 	queueStats *GorStat
+	// Duration of requests abandoned after deadline, in milliseconds
+	deadlineStats *GorStat
+	// Number of active workers
+	workerStats *GorStat
+	// Number of open and idle connections
+	connStats     *GorStat
+	idleConnStats *GorStat
+	// Number of replayed client connections
+	sessionStats *GorStat
+	// Latency of requests is tracked by target, see latencyStats
+	trackLatency bool
+
+	pool *connPool
 
 	elasticSearch *ESPlugin
+
+	// Backends resolved by service discovery, nil if requests are sent to single address
+	backends *backendPool
+
+	// Bodies of chunked requests, keyed by request id
+	streams   map[string]*payloadStream
+	streamsMu sync.Mutex
+
+	// Sessions replaying captured connections, keyed by client address
+	sessions   map[string]*replaySession
+	sessionsMu sync.Mutex
+
+	// Cookies set by replayed responses, nil if --output-http-cookie-jar is not set
+	cookieJars *cookieJars
+	// Values of original responses replaced by values of replayed ones, nil if --output-http-correlate is not set
+	correlator *correlator
 }
 
 // NewHTTPOutput constructor for HTTPOutput
@@ -73,21 +187,59 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) io.Writer {
 
 	o.address = address
 	o.config = config
+	o.pool = newConnPool(config.maxConnsPerHost, config.maxIdleConns)
+
+	var err error
+	if o.backends, err = discoverBackends(address, config); err != nil {
+		log.Fatalln("output-http error:", err)
+	}
 
 	if o.config.stats {
 		o.queueStats = NewGorStat("output_http", o.config.statsMs)
+		o.workerStats = NewGorStat("output_http_workers", o.config.statsMs)
+		o.connStats = NewGorStat("output_http_conns", o.config.statsMs)
+		o.idleConnStats = NewGorStat("output_http_idle_conns", o.config.statsMs)
+		if o.config.originalConcurrency {
+			o.sessionStats = NewGorStat("output_http_sessions", o.config.statsMs)
+		}
+		if o.config.deadline > 0 {
+			o.deadlineStats = NewGorStat("output_http_deadline", o.config.statsMs)
+		}
+		outputHTTPLatency.reportEvery(time.Duration(o.config.statsMs) * time.Millisecond)
+		outputHTTPGraphQLLatency.reportEvery(time.Duration(o.config.statsMs) * time.Millisecond)
+		outputHTTPProtocolLatency.reportEvery(time.Duration(o.config.statsMs) * time.Millisecond)
+	}
+	o.trackLatency = o.config.stats || Settings.httpAdmin != ""
+
+	if o.config.notifyErrorRate > 0 {
+		go o.watchErrorRate(o.config.notifyErrorRate, errorRateInterval)
 	}
 
 	o.queue = make(chan []byte, o.config.queueLen)
 	o.responses = make(chan response, o.config.queueLen)
 	o.needWorker = make(chan int, 1)
+	o.streams = make(map[string]*payloadStream)
+	o.sessions = make(map[string]*replaySession)
+	if o.config.cookieJar != "" {
+		o.cookieJars = newCookieJars(o.config.cookieJar)
+	}
+	if len(o.config.correlate) > 0 {
+		o.correlator = newCorrelator(o.config.correlate)
+	}
+
+	if o.config.scaleDownIdle == 0 {
+		o.config.scaleDownIdle = 2 * time.Second
+	}
 
 	// Initial workers count
-	if o.config.workersMax == 0 {
-		o.needWorker <- initialDynamicWorkers
-	} else {
-		o.needWorker <- o.config.workersMax
+	initial := o.config.workersMax
+	if initial == 0 {
+		initial = initialDynamicWorkers
+	}
+	if initial < o.config.workersMin {
+		initial = o.config.workersMin
 	}
+	o.startWorkers(initial)
 
 	if o.config.elasticSearch != "" {
 		o.elasticSearch = new(ESPlugin)
@@ -102,83 +254,197 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) io.Writer {
 func (o *HTTPOutput) workerMaster() {
 	for {
 		newWorkers := <-o.needWorker
+		Debug("[OUTPUT-HTTP] Starting workers:", newWorkers)
+
 		for i := 0; i < newWorkers; i++ {
 			go o.startWorker()
 		}
 	}
 }
 
+func (o *HTTPOutput) clientConfig() *HTTPClientConfig {
+	return &HTTPClientConfig{
+		FollowRedirects:       o.config.redirectLimit,
+		Debug:                 o.config.Debug,
+		OriginalHost:          o.config.OriginalHost,
+		Timeout:               o.config.Timeout,
+		ConnectionTimeout:     o.config.connectTimeout,
+		TLSHandshakeTimeout:   o.config.tlsTimeout,
+		ResponseHeaderTimeout: o.config.responseHeaderTimeout,
+		Deadline:              o.config.deadline,
+		DisableKeepAlive:      o.config.disableKeepAlive,
+		IdleTimeout:           o.config.idleTimeout,
+		pool:                  o.pool,
+		ResponseBufferSize:    o.config.BufferSize,
+		StreamTimeout:         o.config.responseStreamTimeout,
+		MaxResponseRead:       o.config.responseMaxRead,
+		CompatibilityMode:     o.config.CompatibilityMode,
+		Resolve:               o.config.resolve,
+		ResolveInterval:       o.config.resolveInterval,
+		ProxyProtocol:         o.config.proxyProtocol,
+		Host:                  o.config.host,
+		ServerName:            o.config.serverName,
+		PreserveHeaders:       o.config.preserveHeaders,
+		HTTP2:                 o.config.http2,
+		HTTP3:                 o.config.http3,
+	}
+}
+
 func (o *HTTPOutput) startWorker() {
-	client := NewHTTPClient(o.address, &HTTPClientConfig{
-		FollowRedirects:    o.config.redirectLimit,
-		Debug:              o.config.Debug,
-		OriginalHost:       o.config.OriginalHost,
-		Timeout:            o.config.Timeout,
-		ResponseBufferSize: o.config.BufferSize,
-		CompatibilityMode:  o.config.CompatibilityMode,
-	})
+	var client *HTTPClient
+	var balancer *backendClients
 
-	deathCount := 0
+	// Each request is sent to the next discovered backend
+	if o.backends != nil {
+		balancer = newBackendClients(o.backends, o.clientConfig)
+	} else {
+		client = NewHTTPClient(o.address, o.clientConfig())
+	}
 
-	atomic.AddInt64(&o.activeWorkers, 1)
+	usedAt := time.Now()
 
 	for {
 		select {
 		case data := <-o.queue:
+			if balancer != nil {
+				client = balancer.next()
+			}
 			o.sendRequest(client, data)
-			deathCount = 0
+			usedAt = time.Now()
 		case <-time.After(time.Millisecond * 100):
-			// When dynamic scaling enabled workers die after 2s of inactivity
-			if o.config.workersMin == o.config.workersMax {
+			if balancer != nil {
+				balancer.closeIdle()
+			} else {
+				client.CloseIdle()
+			}
+
+			// When dynamic scaling enabled workers die after being idle
+			if o.config.workersMin == o.config.workersMax || time.Since(usedAt) < o.config.scaleDownIdle {
 				continue
 			}
 
-			deathCount++
-			if deathCount > 20 {
-				workersCount := int(atomic.LoadInt64(&o.activeWorkers))
+			// At least 1 worker should be alive
+			minWorkers := int64(o.config.workersMin)
+			if minWorkers < 1 {
+				minWorkers = 1
+			}
+			if atomic.AddInt64(&o.activeWorkers, -1) < minWorkers {
+				atomic.AddInt64(&o.activeWorkers, 1)
+				continue
+			}
 
-				// At least 1 startWorker should be alive
-				if workersCount != 1 && workersCount > o.config.workersMin {
-					atomic.AddInt64(&o.activeWorkers, -1)
-					return
-				}
+			Debug("[OUTPUT-HTTP] Stopping idle worker")
+
+			// Connections of stopped worker are not reused
+			if balancer != nil {
+				balancer.close()
+			} else {
+				client.Disconnect()
 			}
+			return
 		}
 	}
 }
 
 func (o *HTTPOutput) Write(data []byte) (n int, err error) {
 	if !isRequestPayload(data) {
+		if o.correlator != nil && len(data) > 0 && data[0] == ResponsePayload {
+			info, _ := parsePayloadInfo(data)
+			o.correlator.original(string(info.id), payloadBody(data))
+		}
 		return len(data), nil
 	}
 
-	buf := make([]byte, len(data))
-	copy(buf, data)
+	info, _ := parsePayloadInfo(data)
+
+	// Only first chunk is queued, following chunks are streamed to the worker sending it
+	if info.chunked {
+		if info.chunk > 0 {
+			o.streamsMu.Lock()
+			stream := o.streams[string(info.id)]
+			o.streamsMu.Unlock()
+
+			// Stream is read by worker after Write returns, so chunk is not copied to pooled buffer
+			if stream != nil {
+				stream.write(append([]byte(nil), payloadBody(data)...), info.more)
+			}
+
+			return len(data), nil
+		}
+
+		if info.more {
+			o.streamsMu.Lock()
+			o.streams[string(info.id)] = newPayloadStream(o.streamTimeout())
+			o.streamsMu.Unlock()
+		}
+	}
 
-	o.queue <- buf
+	// Buffer is returned to the pool by sendRequest
+	buf := getPayloadBuffer(data)
+
+	atomic.AddInt64(&o.inFlight, 1)
+
+	// Requests without session key, e.g. recorded without client address, are sent by workers
+	if key := o.sessionKey(info, data); key != "" {
+		o.sessionRequest(key, buf)
+	} else {
+		o.queue <- buf
+	}
 
 	if o.config.stats {
 		o.queueStats.Write(len(o.queue))
-	}
+		o.workerStats.Write(int(atomic.LoadInt64(&o.activeWorkers)))
 
-	if o.config.workersMax != o.config.workersMin {
-		workersCount := int(atomic.LoadInt64(&o.activeWorkers))
+		open, idle := o.pool.stats()
+		o.connStats.Write(open)
+		o.idleConnStats.Write(idle)
 
-		if len(o.queue) > workersCount {
-			extraWorkersReq := len(o.queue) - workersCount + 1
-			maxWorkersAvailable := o.config.workersMax - workersCount
-			if extraWorkersReq > maxWorkersAvailable {
-				extraWorkersReq = maxWorkersAvailable
-			}
-			if extraWorkersReq > 0 {
-				o.needWorker <- extraWorkersReq
-			}
+		if o.sessionStats != nil {
+			o.sessionStats.Write(o.sessionCount())
 		}
 	}
 
+	if o.config.workersMax != o.config.workersMin {
+		o.scaleUp()
+	}
+
 	return len(data), nil
 }
 
+// InFlight returns number of requests queued or sent, and not responded yet
+func (o *HTTPOutput) InFlight() int {
+	return int(atomic.LoadInt64(&o.inFlight))
+}
+
+// scaleUp requests workers for requests queued over threshold, up to maximum number of workers
+func (o *HTTPOutput) scaleUp() {
+	workersCount := int(atomic.LoadInt64(&o.activeWorkers))
+
+	threshold := o.config.scaleUpThreshold
+	if threshold == 0 {
+		threshold = workersCount
+	}
+
+	if len(o.queue) <= threshold {
+		return
+	}
+
+	extraWorkersReq := len(o.queue) - threshold + 1
+	if o.config.workersMax > 0 && extraWorkersReq > o.config.workersMax-workersCount {
+		extraWorkersReq = o.config.workersMax - workersCount
+	}
+
+	if extraWorkersReq > 0 {
+		o.startWorkers(extraWorkersReq)
+	}
+}
+
+// startWorkers requests workers from master. They are counted before they start, so they are not requested again.
+func (o *HTTPOutput) startWorkers(n int) {
+	atomic.AddInt64(&o.activeWorkers, int64(n))
+	o.needWorker <- n
+}
+
 func (o *HTTPOutput) Read(data []byte) (int, error) {
 	resp := <-o.responses
 
@@ -194,33 +460,142 @@ func (o *HTTPOutput) Read(data []byte) (int, error) {
 }
 
 func (o *HTTPOutput) sendRequest(client *HTTPClient, request []byte) {
-	meta := payloadMeta(request)
+	defer atomic.AddInt64(&o.inFlight, -1)
+
+	// Standard Go client can read request body after response is returned
+	if !o.config.CompatibilityMode {
+		defer putPayloadBuffer(request)
+	}
+
+	info, ok := parsePayloadInfo(request)
 
 	if Settings.debug {
-		Debug(meta)
+		Debug(string(request[:bytes.IndexByte(request, '\n')+1]))
 	}
 
-	if len(meta) < 2 {
+	if !ok {
 		return
 	}
-	uuid := meta[1]
+	uuid := info.id
+
+	o.streamsMu.Lock()
+	stream := o.streams[string(uuid)]
+	o.streamsMu.Unlock()
+
+	if stream != nil {
+		defer o.closeStream(string(uuid), stream)
+	}
 
 	body := payloadBody(request)
 	if !proto.IsHTTPPayload(body) {
 		return
 	}
 
+	// Headers are copied, as adding headers can shift them in request buffer
+	var captured []byte
+	if o.config.preserveHeaders {
+		captured = append(captured, body[:proto.MIMEHeadersEndPos(body)]...)
+	}
+
+	addr := string(info.addr)
+	if len(o.config.clientIPHeaders) > 0 && addr != "" {
+		body = setClientIP(body, o.config.clientIPHeaders, addr)
+	}
+
+	if o.config.requestIDHeader != "" {
+		body = proto.SetHeader(body, []byte(o.config.requestIDHeader), uuid)
+	}
+
+	probed := mirrorVerifier != nil && mirrorVerifier.probe(uuid)
+	if probed {
+		body = proto.SetHeader(body, mirrorVerifier.header, uuid)
+	}
+
+	if o.config.k8sHeaderPrefix != "" {
+		if metadata := payloadK8sMetadata(request); metadata != nil {
+			body = setK8sHeaders(body, o.config.k8sHeaderPrefix, metadata)
+		}
+	}
+
+	if o.config.recompress {
+		body = recompressHTTP(body)
+	}
+
+	if o.correlator != nil {
+		body = o.correlator.apply(body)
+	}
+
+	var jarKey string
+	if o.cookieJars != nil {
+		jarKey = o.cookieJars.key(addr)
+		body = o.cookieJars.apply(jarKey, body)
+	}
+
+	if captured != nil {
+		body = proto.ReorderHeaders(body, captured)
+	}
+
+	if client != nil && o.config.proxyProtocol {
+		client.SetClientAddr(addr)
+	}
+
+	var operation string
+	if o.trackLatency {
+		operation = graphQLOperation(body)
+	}
+
 	start := time.Now()
-	resp, err := client.Send(body)
+	var resp []byte
+	var err error
+	if client == nil {
+		resp, err = errorPayload(HTTP_UNREACHABLE), errNoBackends
+	} else if stream != nil {
+		resp, err = client.SendStream(body, stream)
+	} else {
+		resp, err = client.Send(body)
+	}
 	stop := time.Now()
 
+	if err == errDeadlineExceeded && o.deadlineStats != nil {
+		o.deadlineStats.Write(int(stop.Sub(start) / time.Millisecond))
+	}
+
+	if err == nil && o.trackLatency {
+		outputHTTPLatency.record(client.host, stop.Sub(start))
+		outputHTTPProtocolLatency.record(client.protocol, stop.Sub(start))
+		if operation != "" {
+			outputHTTPGraphQLLatency.record(operation, stop.Sub(start))
+		}
+	}
+
+	if probed {
+		mirrorVerifier.response(uuid, resp, err)
+	}
+
+	if err == nil && o.cookieJars != nil {
+		o.cookieJars.update(jarKey, resp)
+	}
+	if err == nil && o.correlator != nil {
+		o.correlator.replayed(string(uuid), resp)
+	}
+
+	atomic.AddInt64(&o.sent, 1)
+	if err != nil || bytes.HasPrefix(proto.Status(resp), []byte("5")) {
+		atomic.AddInt64(&o.failures, 1)
+	}
+
 	if err != nil {
 		log.Println("Error when sending ", err, time.Now())
 		Debug("Request error:", err)
 	}
 
 	if o.config.TrackResponses {
-		o.responses <- response{resp, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+		tracked := resp
+		if o.config.trackResponseSize > 0 && len(tracked) > o.config.trackResponseSize {
+			tracked = tracked[:o.config.trackResponseSize]
+		}
+		// Request buffer is reused after it is sent, so ID is copied
+		o.responses <- response{tracked, append([]byte(nil), uuid...), start.UnixNano(), stop.UnixNano() - start.UnixNano()}
 	}
 
 	if o.elasticSearch != nil {
@@ -228,6 +603,84 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, request []byte) {
 	}
 }
 
+// setClientIP sets headers to IP address of client, IP is appended to list of proxies in X-Forwarded-For header
+func setClientIP(payload []byte, headers []string, addr string) []byte {
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return payload
+	}
+
+	for _, name := range headers {
+		value := []byte(ip)
+		if strings.EqualFold(name, "X-Forwarded-For") {
+			if forwarded := proto.Header(payload, []byte(name)); len(forwarded) > 0 {
+				value = append(append(append([]byte{}, forwarded...), ", "...), ip...)
+			}
+		}
+
+		payload = proto.SetHeader(payload, []byte(name), value)
+	}
+
+	return payload
+}
+
+// closeStream unblocks input writing remaining chunks of the request
+func (o *HTTPOutput) closeStream(id string, stream *payloadStream) {
+	o.streamsMu.Lock()
+	delete(o.streams, id)
+	o.streamsMu.Unlock()
+
+	stream.close()
+}
+
+func (o *HTTPOutput) streamTimeout() time.Duration {
+	if o.config.Timeout == 0 {
+		return 5 * time.Second
+	}
+
+	return o.config.Timeout
+}
+
+func (o *HTTPOutput) queueLen() int {
+	return len(o.queue)
+}
+
+// watchErrorRate notifies when share of failed requests during interval crosses threshold, and when it recovers
+func (o *HTTPOutput) watchErrorRate(threshold float64, interval time.Duration) {
+	var sent, failures int64
+	exceeded := false
+
+	for range time.Tick(interval) {
+		s, f := atomic.LoadInt64(&o.sent), atomic.LoadInt64(&o.failures)
+		requests, failed := s-sent, f-failures
+		sent, failures = s, f
+
+		if requests < errorRateRequests {
+			continue
+		}
+
+		rate := float64(failed) / float64(requests)
+		fields := map[string]interface{}{"output": o.String(), "requests": requests, "errors": failed, "error_rate": rate}
+		if !exceeded && rate >= threshold {
+			exceeded = true
+			log.Printf("[OUTPUT-HTTP] %s: %.1f%% of requests failed during %v\n", o, rate*100, interval)
+			notify(eventErrorRateExceeded, fmt.Sprintf("%.1f%% of requests to %s failed during %v", rate*100, o.address, interval), fields)
+		} else if exceeded && rate < threshold {
+			exceeded = false
+			notify(eventErrorRateRecovered, fmt.Sprintf("%.1f%% of requests to %s failed during %v", rate*100, o.address, interval), fields)
+		}
+	}
+}
+
+func (o *HTTPOutput) summary() map[string]interface{} {
+	return map[string]interface{}{"requests": atomic.LoadInt64(&o.sent), "errors": atomic.LoadInt64(&o.failures)}
+}
+
+// healthSamples reports usage of request queue
+func (o *HTTPOutput) healthSamples() []healthSample {
+	return []healthSample{{check: healthQueueSaturation, source: "output_http:" + o.address, usage: float64(len(o.queue)) / float64(cap(o.queue))}}
+}
+
 func (o *HTTPOutput) String() string {
 	return "HTTP output: " + o.address
 }
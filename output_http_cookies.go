@@ -0,0 +1,140 @@
+package goreplay
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Sessions of --output-http-cookie-jar
+const (
+	// Requests of the same client IP share cookies, like requests sent by browser over several connections
+	cookieJarClientIP = "client-ip"
+	// Requests of each client connection have own cookies
+	cookieJarClientAddr = "client-addr"
+)
+
+// Cookie jars are reset when there are more sessions, so jars of finished sessions don't use memory forever
+const maxCookieJars = 100000
+
+// cookieJars keeps cookies set by replayed responses for each session of captured clients. Captured Cookie header of
+// the following requests of session is overridden by them, so requests after login are replayed with session
+// created by replayed server instead of the original one.
+type cookieJars struct {
+	session string
+
+	mu sync.Mutex
+	// Cookies of each session by name, removed cookies are kept as nil, so captured ones are removed too
+	jars map[string]map[string]*string
+}
+
+func newCookieJars(session string) *cookieJars {
+	return &cookieJars{session: session, jars: make(map[string]map[string]*string)}
+}
+
+// key returns session of request with given client address, or empty string if it has no client address
+func (c *cookieJars) key(addr string) string {
+	if c.session == cookieJarClientAddr {
+		return addr
+	}
+
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return ip
+}
+
+// apply sets cookies of session in Cookie header of request, and removes cookies expired by replayed server. Other
+// captured cookies are kept.
+func (c *cookieJars) apply(key string, payload []byte) []byte {
+	if key == "" {
+		return payload
+	}
+
+	c.mu.Lock()
+	jar := c.jars[key]
+	cookies := make(map[string]*string, len(jar))
+	for name, value := range jar {
+		cookies[name] = value
+	}
+	c.mu.Unlock()
+
+	if len(cookies) == 0 {
+		return payload
+	}
+
+	var pairs []string
+	for _, pair := range strings.Split(string(proto.Header(payload, []byte("Cookie"))), ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name := strings.SplitN(pair, "=", 2)[0]
+		if value, ok := cookies[name]; ok {
+			delete(cookies, name)
+			if value == nil {
+				continue
+			}
+			pair = name + "=" + *value
+		}
+		pairs = append(pairs, pair)
+	}
+
+	// Cookies which were not captured, e.g. set by replayed server only
+	for name, value := range cookies {
+		if value != nil {
+			pairs = append(pairs, name+"="+*value)
+		}
+	}
+
+	if len(pairs) == 0 {
+		return proto.DeleteHeader(payload, []byte("Cookie"))
+	}
+	return proto.SetHeader(payload, []byte("Cookie"), []byte(strings.Join(pairs, "; ")))
+}
+
+// update stores cookies set by replayed response in jar of session, expired cookies are marked as removed
+func (c *cookieJars) update(key string, resp []byte) {
+	if key == "" {
+		return
+	}
+
+	header := make(http.Header)
+	proto.ParseHeaders([][]byte{resp}, func(name, value []byte) bool {
+		if proto.HeadersEqual(name, []byte("Set-Cookie")) {
+			header.Add("Set-Cookie", string(value))
+		}
+		return true
+	})
+	if len(header) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	jar, ok := c.jars[key]
+	if !ok {
+		if len(c.jars) >= maxCookieJars {
+			c.jars = make(map[string]map[string]*string)
+		}
+		jar = make(map[string]*string)
+		c.jars[key] = jar
+	}
+
+	now := time.Now()
+	for _, cookie := range (&http.Response{Header: header}).Cookies() {
+		if cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(now)) {
+			jar[cookie.Name] = nil
+		} else {
+			value := cookie.Value
+			jar[cookie.Name] = &value
+		}
+	}
+}
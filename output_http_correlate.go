@@ -0,0 +1,224 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/buger/goreplay/proto"
+)
+
+const (
+	// Shorter values are not correlated, so unrelated parts of requests are not replaced
+	minCorrelatedValue = 6
+	// Correlated values and responses waiting for their pair are reset when there are more of them
+	maxCorrelatedValues = 10000
+)
+
+// correlationRule extracts values, like CSRF tokens, from responses by regexp or JSON path
+type correlationRule struct {
+	regexp   *regexp.Regexp
+	jsonPath []string
+}
+
+// HTTPCorrelationRules holds rules of --output-http-correlate
+type HTTPCorrelationRules []correlationRule
+
+func (r *HTTPCorrelationRules) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Set parses rule, `json:` prefix is followed by JSON path of value in body, like json:$.data.tokens[0], otherwise
+// rule is regexp matched against the whole response, and value is its first group
+func (r *HTTPCorrelationRules) Set(value string) error {
+	if strings.HasPrefix(value, "json:") {
+		path := strings.TrimPrefix(strings.TrimPrefix(value, "json:"), "$")
+		path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+
+		var rule correlationRule
+		for _, key := range strings.Split(path, ".") {
+			if key != "" {
+				rule.jsonPath = append(rule.jsonPath, key)
+			}
+		}
+		if len(rule.jsonPath) == 0 {
+			return errors.New("JSON path should not be empty")
+		}
+
+		*r = append(*r, rule)
+		return nil
+	}
+
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+
+	*r = append(*r, correlationRule{regexp: re})
+	return nil
+}
+
+// extract returns values found in response, in order they appear
+func (r correlationRule) extract(resp []byte) (values [][]byte) {
+	if r.regexp != nil {
+		for _, match := range r.regexp.FindAllSubmatch(resp, -1) {
+			// Response buffer is reused, while values wait for response to pair with
+			values = append(values, append([]byte(nil), match[len(match)-1]...))
+		}
+		return
+	}
+
+	d := json.NewDecoder(bytes.NewReader(proto.Body(resp)))
+	d.UseNumber()
+
+	var v interface{}
+	if d.Decode(&v) != nil {
+		return nil
+	}
+
+	for _, key := range r.jsonPath {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+
+	switch value := v.(type) {
+	case string:
+		return [][]byte{[]byte(value)}
+	case json.Number:
+		return [][]byte{[]byte(value)}
+	}
+	return nil
+}
+
+// correlatedResponse holds values extracted from original and replayed responses to the same request, until both
+// of them are received
+type correlatedResponse struct {
+	original, replayed [][][]byte
+}
+
+// correlator replaces values, like CSRF tokens and session IDs, which were returned by original server and sent back
+// in the following requests, with values returned by replayed server. Values are extracted by the same rules from
+// original and replayed responses to the same request, and paired in order they appear. Values are unique for
+// session which received them, so they are replaced in any request containing them.
+type correlator struct {
+	rules HTTPCorrelationRules
+
+	mu        sync.Mutex
+	responses map[string]*correlatedResponse
+	values    map[string]string
+}
+
+func newCorrelator(rules HTTPCorrelationRules) *correlator {
+	return &correlator{
+		rules:     rules,
+		responses: make(map[string]*correlatedResponse),
+		values:    make(map[string]string),
+	}
+}
+
+// original extracts values from captured response
+func (c *correlator) original(id string, resp []byte) {
+	c.add(id, resp, true)
+}
+
+// replayed extracts values from response of replayed server
+func (c *correlator) replayed(id string, resp []byte) {
+	c.add(id, resp, false)
+}
+
+func (c *correlator) add(id string, resp []byte, original bool) {
+	extracted := make([][][]byte, len(c.rules))
+	found := false
+	for i, rule := range c.rules {
+		extracted[i] = rule.extract(resp)
+		found = found || len(extracted[i]) > 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.responses[id]
+	if !ok {
+		// Nothing to pair with response which will come later
+		if !found {
+			return
+		}
+		if len(c.responses) >= maxCorrelatedValues {
+			c.responses = make(map[string]*correlatedResponse)
+		}
+		r = new(correlatedResponse)
+		c.responses[id] = r
+	}
+
+	if original {
+		r.original = extracted
+	} else {
+		r.replayed = extracted
+	}
+	if r.original == nil || r.replayed == nil {
+		return
+	}
+	delete(c.responses, id)
+
+	for i := range c.rules {
+		for j, value := range r.original[i] {
+			if j >= len(r.replayed[i]) {
+				break
+			}
+			if len(value) < minCorrelatedValue || bytes.Equal(value, r.replayed[i][j]) {
+				continue
+			}
+
+			if len(c.values) >= maxCorrelatedValues {
+				c.values = make(map[string]string)
+			}
+			c.values[string(value)] = string(r.replayed[i][j])
+		}
+	}
+}
+
+// apply replaces original values in request with replayed ones, values are also replaced in URL encoded form.
+// Content-Length is changed by difference of body size, so it stays valid for bodies streamed in chunks too.
+func (c *correlator) apply(payload []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.values) == 0 {
+		return payload
+	}
+	bodySize := len(proto.Body(payload))
+
+	for original, replayed := range c.values {
+		if bytes.Contains(payload, []byte(original)) {
+			payload = bytes.Replace(payload, []byte(original), []byte(replayed), -1)
+		}
+
+		if escaped := url.QueryEscape(original); escaped != original && bytes.Contains(payload, []byte(escaped)) {
+			payload = bytes.Replace(payload, []byte(escaped), []byte(url.QueryEscape(replayed)), -1)
+		}
+	}
+
+	if delta := len(proto.Body(payload)) - bodySize; delta != 0 {
+		if length, err := strconv.Atoi(string(proto.Header(payload, []byte("Content-Length")))); err == nil {
+			payload = proto.SetHeader(payload, []byte("Content-Length"), []byte(strconv.Itoa(length+delta)))
+		}
+	}
+
+	return payload
+}
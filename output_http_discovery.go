@@ -0,0 +1,682 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pause before watching discovered backends again after error
+const discoveryRetryInterval = 5 * time.Second
+
+var errNoBackends = errors.New("no backends discovered")
+
+// backendPool holds addresses of replay targets resolved by service discovery, and balances requests between them
+type backendPool struct {
+	// Keep this as first element of struct, atomic operations require 64bit alignment on 32bit machines
+	counter uint64
+
+	name string
+
+	mu       sync.RWMutex
+	backends []string
+	// Incremented each time list of backends changes
+	version int64
+}
+
+func (p *backendPool) update(backends []string) {
+	sort.Strings(backends)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(backends) == len(p.backends) {
+		changed := false
+		for i := range backends {
+			if backends[i] != p.backends[i] {
+				changed = true
+				break
+			}
+		}
+
+		if !changed {
+			return
+		}
+	}
+
+	p.backends = backends
+	p.version++
+
+	log.Printf("[OUTPUT-HTTP] Backends of %s: %v\n", p.name, backends)
+}
+
+// pick returns the next backend in round robin order, and version of the list. Empty string is returned if there
+// are no backends.
+func (p *backendPool) pick() (string, int64) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.backends) == 0 {
+		return "", p.version
+	}
+
+	n := atomic.AddUint64(&p.counter, 1)
+
+	return p.backends[n%uint64(len(p.backends))], p.version
+}
+
+func (p *backendPool) contains(backend string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, b := range p.backends {
+		if b == backend {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backendClients keeps client of a single worker for each backend, clients of removed backends are disconnected
+type backendClients struct {
+	pool      *backendPool
+	newConfig func() *HTTPClientConfig
+	clients   map[string]*HTTPClient
+	version   int64
+}
+
+func newBackendClients(pool *backendPool, newConfig func() *HTTPClientConfig) *backendClients {
+	return &backendClients{
+		pool:      pool,
+		newConfig: newConfig,
+		clients:   make(map[string]*HTTPClient),
+	}
+}
+
+// next returns client of the next backend, or nil if there are no backends
+func (c *backendClients) next() *HTTPClient {
+	backend, version := c.pool.pick()
+
+	if version != c.version {
+		c.version = version
+		for b, client := range c.clients {
+			if !c.pool.contains(b) {
+				client.Disconnect()
+				delete(c.clients, b)
+			}
+		}
+	}
+
+	if backend == "" {
+		return nil
+	}
+
+	client, ok := c.clients[backend]
+	if !ok {
+		client = NewHTTPClient(backend, c.newConfig())
+		c.clients[backend] = client
+	}
+
+	return client
+}
+
+// closeIdle closes connections to backends which are not used for idle timeout
+func (c *backendClients) closeIdle() {
+	for _, client := range c.clients {
+		client.CloseIdle()
+	}
+}
+
+// close closes connections to all backends
+func (c *backendClients) close() {
+	for _, client := range c.clients {
+		client.Disconnect()
+	}
+}
+
+// discoverBackends starts watching backends if address has `consul://`, `etcd://` or `k8s://` scheme, and returns pool
+// updated with them. Nil is returned for plain addresses.
+func discoverBackends(address string, config *HTTPOutputConfig) (*backendPool, error) {
+	var watch func(pool *backendPool)
+
+	switch {
+	case strings.HasPrefix(address, "consul://"):
+		d, err := newConsulDiscovery(address, config.consulAddress)
+		if err != nil {
+			return nil, err
+		}
+		watch = d.watch
+	case strings.HasPrefix(address, "etcd://"):
+		d, err := newEtcdDiscovery(address, config.etcdAddress)
+		if err != nil {
+			return nil, err
+		}
+		watch = d.watch
+	case strings.HasPrefix(address, "k8s://"):
+		d, err := newK8sDiscovery(address, config.k8sAddress)
+		if err != nil {
+			return nil, err
+		}
+		watch = d.watch
+	default:
+		return nil, nil
+	}
+
+	pool := &backendPool{name: address}
+	go watch(pool)
+
+	return pool, nil
+}
+
+// consulDiscovery watches healthy instances of Consul service using blocking queries
+type consulDiscovery struct {
+	service string
+	url     string
+	query   url.Values
+	token   string
+	client  *http.Client
+}
+
+// newConsulDiscovery accepts address in `consul://service?tag=tag&dc=dc` format. Agent address defaults to
+// CONSUL_HTTP_ADDR environment variable, and ACL token is read from CONSUL_HTTP_TOKEN.
+func newConsulDiscovery(address, agent string) (*consulDiscovery, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("service is not specified in %q", address)
+	}
+
+	if agent == "" {
+		agent = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if agent == "" {
+		agent = "127.0.0.1:8500"
+	}
+	if !strings.HasPrefix(agent, "http") {
+		agent = "http://" + agent
+	}
+
+	d := &consulDiscovery{
+		service: u.Host,
+		url:     strings.TrimSuffix(agent, "/") + "/v1/health/service/" + url.PathEscape(u.Host),
+		query:   url.Values{"passing": {"1"}, "wait": {"5m"}},
+		token:   os.Getenv("CONSUL_HTTP_TOKEN"),
+		client:  &http.Client{Timeout: 6 * time.Minute},
+	}
+
+	for _, param := range []string{"tag", "dc"} {
+		if value := u.Query().Get(param); value != "" {
+			d.query.Set(param, value)
+		}
+	}
+
+	return d, nil
+}
+
+func (d *consulDiscovery) watch(pool *backendPool) {
+	var index uint64
+
+	for {
+		backends, next, err := d.fetch(index)
+		if err != nil {
+			log.Printf("[OUTPUT-HTTP] Can't discover backends of Consul service %s: %v\n", d.service, err)
+			time.Sleep(discoveryRetryInterval)
+			continue
+		}
+
+		pool.update(backends)
+
+		// Index going backwards means that Consul state was restored, and query should start over
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+// fetch waits for changes of service after given index, and returns its instances and the new index
+func (d *consulDiscovery) fetch(index uint64) ([]string, uint64, error) {
+	query := url.Values{}
+	for k, v := range d.query {
+		query[k] = v
+	}
+	query.Set("index", strconv.FormatUint(index, 10))
+
+	req, err := http.NewRequest("GET", d.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if d.token != "" {
+		req.Header.Set("X-Consul-Token", d.token)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+
+	backends := make([]string, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		backends = append(backends, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	return backends, next, nil
+}
+
+// etcdDiscovery watches keys with given prefix using etcd v3 JSON gateway. Value of each key is a backend address,
+// optionally with scheme, or JSON object with `Addr` field used by etcd naming resolver.
+type etcdDiscovery struct {
+	prefix   string
+	endpoint string
+	client   *http.Client
+}
+
+// newEtcdDiscovery accepts address in `etcd://prefix` format, e.g. `etcd:///services/api/`
+func newEtcdDiscovery(address, endpoint string) (*etcdDiscovery, error) {
+	prefix := strings.TrimPrefix(address, "etcd://")
+	if prefix == "" {
+		return nil, fmt.Errorf("key prefix is not specified in %q", address)
+	}
+
+	if endpoint == "" {
+		endpoint = "127.0.0.1:2379"
+	}
+	if !strings.HasPrefix(endpoint, "http") {
+		endpoint = "http://" + endpoint
+	}
+
+	return &etcdDiscovery{
+		prefix:   prefix,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{},
+	}, nil
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// rangeEnd returns the smallest key greater than all keys with prefix
+func (d *etcdDiscovery) rangeEnd() []byte {
+	end := []byte(d.prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	// All keys
+	return []byte{0}
+}
+
+func (d *etcdDiscovery) watch(pool *backendPool) {
+	for {
+		backends, revision, err := d.fetch()
+		if err == nil {
+			pool.update(values(backends))
+			err = d.watchChanges(revision+1, backends, pool)
+		}
+
+		if err != nil {
+			log.Printf("[OUTPUT-HTTP] Can't discover backends with etcd prefix %s: %v\n", d.prefix, err)
+			time.Sleep(discoveryRetryInterval)
+		}
+	}
+}
+
+func (d *etcdDiscovery) post(path string, request interface{}) (*http.Response, error) {
+	body, _ := json.Marshal(request)
+
+	resp, err := d.client.Post(d.endpoint+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return resp, nil
+}
+
+// fetch returns backends keyed by etcd key, and revision they were read at
+func (d *etcdDiscovery) fetch() (map[string]string, int64, error) {
+	resp, err := d.post("/v3/kv/range", map[string][]byte{"key": []byte(d.prefix), "range_end": d.rangeEnd()})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Header struct {
+			Revision int64 `json:"revision,string"`
+		} `json:"header"`
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, err
+	}
+
+	backends := make(map[string]string)
+	for _, kv := range result.Kvs {
+		if backend := etcdBackend(kv.Value); backend != "" {
+			backends[string(kv.Key)] = backend
+		}
+	}
+
+	return backends, result.Header.Revision, nil
+}
+
+// watchChanges applies changes of keys to backends until watch is canceled, e.g. because revision was compacted
+func (d *etcdDiscovery) watchChanges(revision int64, backends map[string]string, pool *backendPool) error {
+	resp, err := d.post("/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(d.prefix),
+			"range_end":      d.rangeEnd(),
+			"start_revision": strconv.FormatInt(revision, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Canceled bool `json:"canceled"`
+				Events   []struct {
+					Type string       `json:"type"`
+					Kv   etcdKeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+
+		if err = decoder.Decode(&msg); err != nil {
+			return err
+		}
+
+		if msg.Error != nil {
+			return errors.New(msg.Error.Message)
+		}
+
+		if msg.Result.Canceled {
+			return errors.New("watch canceled")
+		}
+
+		for _, e := range msg.Result.Events {
+			if backend := etcdBackend(e.Kv.Value); e.Type != "DELETE" && backend != "" {
+				backends[string(e.Kv.Key)] = backend
+			} else {
+				delete(backends, string(e.Kv.Key))
+			}
+		}
+
+		if len(msg.Result.Events) > 0 {
+			pool.update(values(backends))
+		}
+	}
+}
+
+func etcdBackend(value []byte) string {
+	value = bytes.TrimSpace(value)
+
+	if len(value) > 0 && value[0] == '{' {
+		var v struct {
+			Addr string
+		}
+		json.Unmarshal(value, &v)
+		return v.Addr
+	}
+
+	return string(value)
+}
+
+func values(m map[string]string) []string {
+	list := make([]string, 0, len(m))
+	for _, v := range m {
+		list = append(list, v)
+	}
+
+	return list
+}
+
+// k8sDiscovery watches ready addresses of Kubernetes service endpoints using API server
+type k8sDiscovery struct {
+	*k8sClient
+
+	namespace string
+	service   string
+	// Name or number of service port, empty if service has single port
+	port string
+}
+
+// newK8sDiscovery accepts address in `k8s://namespace/service:port` format. Inside cluster API server is reached using
+// service account of the pod, otherwise its address should be given, e.g. of `kubectl proxy`.
+func newK8sDiscovery(address, api string) (*k8sDiscovery, error) {
+	d := new(k8sDiscovery)
+
+	path := strings.TrimPrefix(address, "k8s://")
+	if i := strings.LastIndex(path, ":"); i != -1 {
+		d.port = path[i+1:]
+		path = path[:i]
+	}
+
+	if i := strings.Index(path, "/"); i != -1 {
+		d.namespace, d.service = path[:i], path[i+1:]
+	}
+	if d.namespace == "" || d.service == "" || strings.Contains(d.service, "/") {
+		return nil, fmt.Errorf("expected k8s://namespace/service:port, got %q", address)
+	}
+
+	var err error
+	if d.k8sClient, err = newK8sClient(api, "--output-http-k8s-address"); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *k8sDiscovery) watch(pool *backendPool) {
+	for {
+		portName, err := d.portName()
+		if err == nil {
+			err = d.watchEndpoints(portName, pool)
+		}
+
+		log.Printf("[OUTPUT-HTTP] Can't discover backends of Kubernetes service %s/%s: %v\n", d.namespace, d.service, err)
+		time.Sleep(discoveryRetryInterval)
+	}
+}
+
+// portName returns name of service port, endpoints list ports of pods by names of service ports
+func (d *k8sDiscovery) portName() (string, error) {
+	if _, err := strconv.Atoi(d.port); err != nil && d.port != "" {
+		return d.port, nil
+	}
+
+	resp, err := d.get("/api/v1/namespaces/" + url.PathEscape(d.namespace) + "/services/" + url.PathEscape(d.service))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var service struct {
+		Spec struct {
+			Ports []struct {
+				Name string `json:"name"`
+				Port int    `json:"port"`
+			} `json:"ports"`
+		} `json:"spec"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&service); err != nil {
+		return "", err
+	}
+
+	ports := service.Spec.Ports
+	for _, p := range ports {
+		if strconv.Itoa(p.Port) == d.port || d.port == "" && len(ports) == 1 {
+			return p.Name, nil
+		}
+	}
+
+	if d.port == "" {
+		return "", errors.New("service has multiple ports, port should be specified")
+	}
+
+	return "", fmt.Errorf("service has no port %s", d.port)
+}
+
+type k8sEndpoints struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// backends returns ready addresses of pods with given port
+func (e *k8sEndpoints) backends(portName string) []string {
+	var backends []string
+
+	for _, subset := range e.Subsets {
+		for _, p := range subset.Ports {
+			if p.Name != portName {
+				continue
+			}
+
+			for _, a := range subset.Addresses {
+				backends = append(backends, net.JoinHostPort(a.IP, strconv.Itoa(p.Port)))
+			}
+		}
+	}
+
+	return backends
+}
+
+// watchEndpoints reads endpoints, and applies their changes until watch fails, e.g. because resource version expired
+func (d *k8sDiscovery) watchEndpoints(portName string, pool *backendPool) error {
+	path := "/api/v1/namespaces/" + url.PathEscape(d.namespace) + "/endpoints"
+
+	resp, err := d.get(path + "/" + url.PathEscape(d.service))
+	if err != nil {
+		return err
+	}
+
+	var endpoints k8sEndpoints
+	err = json.NewDecoder(resp.Body).Decode(&endpoints)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	pool.update(endpoints.backends(portName))
+	version := endpoints.Metadata.ResourceVersion
+
+	// API server closes watch after timeout, and it is started again from the last seen version
+	for {
+		query := url.Values{
+			"watch":           {"1"},
+			"fieldSelector":   {"metadata.name=" + d.service},
+			"resourceVersion": {version},
+			"timeoutSeconds":  {"300"},
+		}
+
+		resp, err := d.get(path + "?" + query.Encode())
+		if err != nil {
+			return err
+		}
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var event struct {
+				Type   string          `json:"type"`
+				Object json.RawMessage `json:"object"`
+			}
+
+			if err = decoder.Decode(&event); err != nil {
+				break
+			}
+
+			if event.Type == "ERROR" {
+				err = fmt.Errorf("watch error: %s", event.Object)
+				break
+			}
+
+			var endpoints k8sEndpoints
+			if err = json.Unmarshal(event.Object, &endpoints); err != nil {
+				break
+			}
+			version = endpoints.Metadata.ResourceVersion
+
+			if event.Type == "DELETED" {
+				pool.update(nil)
+			} else {
+				pool.update(endpoints.backends(portName))
+			}
+		}
+		resp.Body.Close()
+
+		if err != io.EOF {
+			return err
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package goreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul answers blocking queries of service health, query waits while index is not changed
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   int
+	entries []string
+	changed chan struct{}
+	done    chan struct{}
+	queries []string
+}
+
+func newFakeConsul(entries ...string) *fakeConsul {
+	return &fakeConsul{index: 1, entries: entries, changed: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (c *fakeConsul) set(entries ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.index++
+	c.entries = entries
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	c.queries = append(c.queries, r.URL.Path+"?"+r.URL.RawQuery)
+	index, changed := c.index, c.changed
+	c.mu.Unlock()
+
+	if i, _ := strconv.Atoi(r.URL.Query().Get("index")); i >= index {
+		select {
+		case <-changed:
+		case <-c.done:
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entries []string
+	for _, e := range c.entries {
+		host, port := e[:strings.LastIndex(e, ":")], e[strings.LastIndex(e, ":")+1:]
+		// Service without address is registered at address of node
+		if host == "node" {
+			entries = append(entries, fmt.Sprintf(`{"Node":{"Address":"10.0.0.9"},"Service":{"Address":"","Port":%s}}`, port))
+		} else {
+			entries = append(entries, fmt.Sprintf(`{"Node":{"Address":"10.0.0.9"},"Service":{"Address":%q,"Port":%s}}`, host, port))
+		}
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.Itoa(c.index))
+	w.Write([]byte("[" + strings.Join(entries, ",") + "]"))
+}
+
+func waitBackends(t *testing.T, pool *backendPool, expected ...string) {
+	sort.Strings(expected)
+
+	for i := 0; i < 100; i++ {
+		pool.mu.RLock()
+		backends := pool.backends
+		pool.mu.RUnlock()
+
+		if reflect.DeepEqual(backends, expected) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Expected backends %v, got %v", expected, pool.backends)
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	consul := newFakeConsul("10.0.0.1:8080", "node:8081")
+	server := httptest.NewServer(consul)
+	defer server.Close()
+	defer close(consul.done)
+
+	pool, err := discoverBackends("consul://api?tag=v2", &HTTPOutputConfig{consulAddress: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitBackends(t, pool, "10.0.0.1:8080", "10.0.0.9:8081")
+
+	consul.set("10.0.0.2:8080")
+	waitBackends(t, pool, "10.0.0.2:8080")
+
+	consul.mu.Lock()
+	query := consul.queries[1]
+	consul.mu.Unlock()
+	if query != "/v1/health/service/api?index=1&passing=1&tag=v2&wait=5m" {
+		t.Error("Wrong query", query)
+	}
+
+	if _, err = discoverBackends("consul://", &HTTPOutputConfig{}); err == nil {
+		t.Error("Should reject address without service")
+	}
+}
+
+func TestEtcdDiscovery(t *testing.T) {
+	done := make(chan struct{})
+	var mu sync.Mutex
+	var watchRequest map[string]map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			var req map[string][]byte
+			json.NewDecoder(r.Body).Decode(&req)
+			if string(req["key"]) != "/services/api/" || string(req["range_end"]) != "/services/api0" {
+				t.Error("Wrong range", req)
+			}
+
+			// Values are base64 encoded
+			w.Write([]byte(`{"header":{"revision":"7"},"kvs":[{"key":"L3NlcnZpY2VzL2FwaS8x","value":"MTAuMC4wLjE6ODA4MA=="},{"key":"L3NlcnZpY2VzL2FwaS8y","value":"eyJBZGRyIjoiMTAuMC4wLjI6ODA4MCJ9"}]}`))
+		case "/v3/watch":
+			mu.Lock()
+			json.NewDecoder(r.Body).Decode(&watchRequest)
+			mu.Unlock()
+
+			w.Write([]byte(`{"result":{"created":true}}` + "\n"))
+			// Update of the first key, and removal of the second
+			w.Write([]byte(`{"result":{"events":[{"kv":{"key":"L3NlcnZpY2VzL2FwaS8x","value":"aHR0cHM6Ly8xMC4wLjAuMzo4NDQz"}},{"type":"DELETE","kv":{"key":"L3NlcnZpY2VzL2FwaS8y"}}]}}` + "\n"))
+			w.(http.Flusher).Flush()
+			<-done
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	pool, err := discoverBackends("etcd:///services/api/", &HTTPOutputConfig{etcdAddress: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitBackends(t, pool, "https://10.0.0.3:8443")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if watchRequest["create_request"]["start_revision"] != "8" {
+		t.Error("Should watch changes after range revision", watchRequest)
+	}
+}
+
+func TestHTTPOutputDiscovery(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	wg := new(sync.WaitGroup)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Host]++
+		mu.Unlock()
+		wg.Done()
+	})
+
+	backend1 := httptest.NewServer(handler)
+	defer backend1.Close()
+	backend2 := httptest.NewServer(handler)
+	defer backend2.Close()
+
+	consul := newFakeConsul(backend1.Listener.Addr().String(), backend2.Listener.Addr().String())
+	server := httptest.NewServer(consul)
+	defer server.Close()
+	defer close(consul.done)
+
+	output := NewHTTPOutput("consul://api", &HTTPOutputConfig{consulAddress: server.URL, workersMin: 1, workersMax: 1, queueLen: 10})
+	waitBackends(t, output.(*HTTPOutput).backends, backend1.Listener.Addr().String(), backend2.Listener.Addr().String())
+
+	wg.Add(4)
+	for i := 0; i < 4; i++ {
+		output.Write(append(payloadHeader(RequestPayload, uuid(), 1, -1), "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"...))
+	}
+	wg.Wait()
+
+	if requests[backend1.Listener.Addr().String()] != 2 || requests[backend2.Listener.Addr().String()] != 2 {
+		t.Error("Requests should be balanced between backends", requests)
+	}
+}
+
+func TestK8sDiscovery(t *testing.T) {
+	done := make(chan struct{})
+	var mu sync.Mutex
+	var watchQuery string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/staging/services/api":
+			w.Write([]byte(`{"spec":{"ports":[{"name":"http","port":80,"targetPort":8080},{"name":"metrics","port":9090}]}}`))
+		case "/api/v1/namespaces/staging/endpoints/api":
+			w.Write([]byte(`{"metadata":{"resourceVersion":"5"},"subsets":[{"addresses":[{"ip":"10.1.0.1"},{"ip":"10.1.0.2"}],"notReadyAddresses":[{"ip":"10.1.0.3"}],"ports":[{"name":"metrics","port":9090},{"name":"http","port":8080}]}]}`))
+		case "/api/v1/namespaces/staging/endpoints":
+			mu.Lock()
+			watchQuery = r.URL.RawQuery
+			mu.Unlock()
+
+			// Pod is replaced with new one
+			w.Write([]byte(`{"type":"MODIFIED","object":{"metadata":{"resourceVersion":"6"},"subsets":[{"addresses":[{"ip":"10.1.0.2"},{"ip":"10.1.0.4"}],"ports":[{"name":"http","port":8080}]}]}}` + "\n"))
+			w.(http.Flusher).Flush()
+			<-done
+		default:
+			t.Error("Unexpected request", r.URL)
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	// Service port is given by number
+	pool, err := discoverBackends("k8s://staging/api:80", &HTTPOutputConfig{k8sAddress: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitBackends(t, pool, "10.1.0.2:8080", "10.1.0.4:8080")
+
+	mu.Lock()
+	query := watchQuery
+	mu.Unlock()
+	if query != "fieldSelector=metadata.name%3Dapi&resourceVersion=5&timeoutSeconds=300&watch=1" {
+		t.Error("Wrong watch query", query)
+	}
+
+	for _, address := range []string{"k8s://api:80", "k8s:///api", "k8s://staging/"} {
+		if _, err = discoverBackends(address, &HTTPOutputConfig{k8sAddress: server.URL}); err == nil {
+			t.Errorf("Should reject %q", address)
+		}
+	}
+}
+
+func TestK8sEndpointsBackends(t *testing.T) {
+	var endpoints k8sEndpoints
+	json.Unmarshal([]byte(`{"subsets":[{"addresses":[{"ip":"10.1.0.1"}],"ports":[{"port":8080}]},{"addresses":[{"ip":"fd00::1"}],"ports":[{"port":8081}]}]}`), &endpoints)
+
+	// Service with single unnamed port
+	if backends := endpoints.backends(""); !reflect.DeepEqual(backends, []string{"10.1.0.1:8080", "[fd00::1]:8081"}) {
+		t.Error("Wrong backends", backends)
+	}
+}
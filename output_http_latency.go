@@ -0,0 +1,202 @@
+package goreplay
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Each power of two of latency in microseconds is split into 2^latencySubBits linear buckets, like in HDR histogram,
+// so percentiles are precise to 1/64 of their value whatever the scale is
+const latencySubBits = 6
+
+// Percentiles reported by --output-http-stats and admin API metrics
+var latencyQuantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+// latencyHistogram counts latencies in log-linear buckets, its memory does not depend on number of requests
+type latencyHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func latencyBucket(v uint64) int {
+	if v < 1<<latencySubBits {
+		return int(v)
+	}
+
+	shift := bits.Len64(v) - latencySubBits - 1
+	top := v >> uint(shift)
+
+	return (shift+1)<<latencySubBits + int(top-1<<latencySubBits)
+}
+
+// latencyBucketMax returns the highest value counted in bucket
+func latencyBucketMax(i int) uint64 {
+	if i < 1<<latencySubBits {
+		return uint64(i)
+	}
+
+	shift := uint(i>>latencySubBits - 1)
+	top := uint64(i&(1<<latencySubBits-1)) + 1<<latencySubBits
+
+	return (top+1)<<shift - 1
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	i := latencyBucket(uint64(d / time.Microsecond))
+	if i >= len(h.counts) {
+		counts := make([]uint64, i+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// quantile returns latency which q of recorded latencies do not exceed
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := uint64(q*float64(h.count) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			d := time.Duration(latencyBucketMax(i)) * time.Microsecond
+			if d > h.max {
+				d = h.max
+			}
+			return d
+		}
+	}
+
+	return h.max
+}
+
+func (h *latencyHistogram) reset() {
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.count, h.sum, h.max = 0, 0, 0
+}
+
+// targetLatency keeps histogram of all latencies of target, exposed as metrics, and of latencies since last report
+type targetLatency struct {
+	total    latencyHistogram
+	interval latencyHistogram
+}
+
+// latencyStats tracks latency of replayed requests per target host, or per other label like GraphQL operation. It is
+// shared by all HTTP outputs, so targets discovered by service discovery and targets of different outputs are
+// compared in one report.
+type latencyStats struct {
+	// Name of stats in reports and metrics, and name of label they are tracked by
+	name  string
+	label string
+
+	mu      sync.Mutex
+	targets map[string]*targetLatency
+	report  sync.Once
+}
+
+func newLatencyStats(name, label string) *latencyStats {
+	return &latencyStats{name: name, label: label, targets: make(map[string]*targetLatency)}
+}
+
+var outputHTTPLatency = newLatencyStats("output_http_latency", "target")
+
+// Latency by protocol requests are sent with, "http/1.1", "h2" or "h3", so HTTP/3 can be compared with fallback to TCP
+var outputHTTPProtocolLatency = newLatencyStats("output_http_protocol_latency", "protocol")
+
+// Latency of GraphQL requests by operation, so operations sent to the same endpoint are reported separately
+var outputHTTPGraphQLLatency = newLatencyStats("output_http_graphql_latency", "operation")
+
+func (s *latencyStats) record(target string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.targets[target]
+	if t == nil {
+		t = new(targetLatency)
+		s.targets[target] = t
+	}
+
+	t.total.record(d)
+	t.interval.record(d)
+}
+
+func (s *latencyStats) sortedTargets() []string {
+	targets := make([]string, 0, len(s.targets))
+	for target := range s.targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	return targets
+}
+
+// reportEvery logs percentiles of latencies recorded since previous report, for each target which got requests
+func (s *latencyStats) reportEvery(interval time.Duration) {
+	s.report.Do(func() {
+		go func() {
+			for range time.Tick(interval) {
+				s.mu.Lock()
+				for _, target := range s.sortedTargets() {
+					h := &s.targets[target].interval
+					if h.count == 0 {
+						continue
+					}
+
+					log.Printf("%s:%s p50=%v p90=%v p99=%v p999=%v max=%v count=%d\n", s.name, target,
+						h.quantile(0.5), h.quantile(0.9), h.quantile(0.99), h.quantile(0.999), h.max, h.count)
+					h.reset()
+				}
+				s.mu.Unlock()
+			}
+		}()
+	})
+}
+
+// writeMetrics writes latencies of all targets in Prometheus text format, as summary with percentiles
+func (s *latencyStats) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.targets) == 0 {
+		return
+	}
+
+	metric := "gor_" + s.name + "_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of requests replayed by output-http, by %s.\n", metric, s.label)
+	fmt.Fprintf(w, "# TYPE %s summary\n", metric)
+
+	for _, target := range s.sortedTargets() {
+		h := &s.targets[target].total
+		for _, q := range latencyQuantiles {
+			fmt.Fprintf(w, "%s{%s=%q,quantile=\"%v\"} %v\n", metric, s.label, target, q, h.quantile(q).Seconds())
+		}
+		fmt.Fprintf(w, "%s_sum{%s=%q} %v\n", metric, s.label, target, h.sum.Seconds())
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", metric, s.label, target, h.count)
+	}
+}
@@ -0,0 +1,60 @@
+package goreplay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	for _, v := range []uint64{0, 1, 63, 64, 65, 127, 128, 1000, 123456, 1 << 40} {
+		i := latencyBucket(v)
+		if max := latencyBucketMax(i); v > max || (i > 0 && v <= latencyBucketMax(i-1)) {
+			t.Errorf("Value %d should be counted in bucket %d, which ends at %d", v, i, max)
+		}
+	}
+
+	var h latencyHistogram
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+
+	for _, tc := range []struct {
+		q        float64
+		expected time.Duration
+	}{{0.5, 500 * time.Millisecond}, {0.9, 900 * time.Millisecond}, {0.99, 990 * time.Millisecond}, {0.999, 999 * time.Millisecond}} {
+		got := h.quantile(tc.q)
+		if got < tc.expected || got > tc.expected+tc.expected/64 {
+			t.Errorf("Expected p%v to be about %v, got %v", tc.q*100, tc.expected, got)
+		}
+	}
+
+	if h.quantile(1) != time.Second || h.count != 1000 {
+		t.Errorf("Expected max of 1s from 1000 values, got %v from %d", h.quantile(1), h.count)
+	}
+
+	h.reset()
+	if h.quantile(0.5) != 0 || h.count != 0 {
+		t.Error("Histogram should be empty after reset")
+	}
+}
+
+func TestLatencyMetrics(t *testing.T) {
+	stats := newLatencyStats("output_http_latency", "target")
+	stats.record("staging.com", 10*time.Millisecond)
+	stats.record("canary.com", 20*time.Millisecond)
+
+	var buf bytes.Buffer
+	stats.writeMetrics(&buf)
+
+	for _, line := range []string{
+		`gor_output_http_latency_seconds{target="canary.com",quantile="0.5"} 0.02`,
+		`gor_output_http_latency_seconds{target="staging.com",quantile="0.999"} 0.01`,
+		`gor_output_http_latency_seconds_count{target="staging.com"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package goreplay
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connPool limits connections opened by HTTP clients of the output, and counts its usage. Each worker keeps its own
+// connection, pool decides if it can be opened, and if it can be kept open between requests.
+type connPool struct {
+	// Keep these as first elements of struct, atomic operations require 64bit alignment on 32bit machines
+	open int64
+	idle int64
+
+	maxConnsPerHost int
+	maxIdleConns    int64
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+
+	// Transport shared by clients in compatibility mode
+	transport     *http.Transport
+	transportOnce sync.Once
+}
+
+func newConnPool(maxConnsPerHost, maxIdleConns int) *connPool {
+	return &connPool{
+		maxConnsPerHost: maxConnsPerHost,
+		maxIdleConns:    int64(maxIdleConns),
+		slots:           make(map[string]chan struct{}),
+	}
+}
+
+// acquire waits until connection to host can be opened, false is returned if it is not possible until timeout
+func (p *connPool) acquire(host string, timeout time.Duration) bool {
+	if p.maxConnsPerHost > 0 {
+		p.mu.Lock()
+		slots, ok := p.slots[host]
+		if !ok {
+			slots = make(chan struct{}, p.maxConnsPerHost)
+			p.slots[host] = slots
+		}
+		p.mu.Unlock()
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+
+			select {
+			case slots <- struct{}{}:
+			case <-timer.C:
+				return false
+			}
+		}
+	}
+
+	atomic.AddInt64(&p.open, 1)
+
+	return true
+}
+
+// release frees slot of closed connection to host
+func (p *connPool) release(host string) {
+	atomic.AddInt64(&p.open, -1)
+
+	if p.maxConnsPerHost > 0 {
+		p.mu.Lock()
+		slots := p.slots[host]
+		p.mu.Unlock()
+
+		<-slots
+	}
+}
+
+// setIdle marks connection idle after request, false is returned if there are too many idle connections, and it
+// should be closed
+func (p *connPool) setIdle() bool {
+	if n := atomic.AddInt64(&p.idle, 1); p.maxIdleConns > 0 && n > p.maxIdleConns {
+		atomic.AddInt64(&p.idle, -1)
+		return false
+	}
+
+	return true
+}
+
+// setBusy marks idle connection used again, or closed
+func (p *connPool) setBusy() {
+	atomic.AddInt64(&p.idle, -1)
+}
+
+// stats returns number of open and idle connections
+func (p *connPool) stats() (open, idle int) {
+	return int(atomic.LoadInt64(&p.open)), int(atomic.LoadInt64(&p.idle))
+}
+
+// goTransport returns transport shared by clients in compatibility mode, created with options of the first client
+func (p *connPool) goTransport(config *HTTPClientConfig) *http.Transport {
+	p.transportOnce.Do(func() {
+		p.transport = newTransport(config)
+
+		// Transport keeps only 2 idle connections to host by default, connections of other workers are closed
+		p.transport.MaxIdleConnsPerHost = math.MaxInt32
+		if p.maxIdleConns > 0 {
+			p.transport.MaxIdleConns = int(p.maxIdleConns)
+			p.transport.MaxIdleConnsPerHost = int(p.maxIdleConns)
+		}
+		p.transport.MaxConnsPerHost = p.maxConnsPerHost
+	})
+
+	return p.transport
+}
+
+// newTransport returns transport of Go client with given options
+func newTransport(config *HTTPClientConfig) *http.Transport {
+	dialer := &net.Dialer{Timeout: config.ConnectionTimeout}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, resolveAddress(config.Resolve, address))
+		},
+		// Host of request URL is used if server name is empty
+		TLSClientConfig:       &tls.Config{ServerName: config.ServerName},
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		IdleConnTimeout:       config.IdleTimeout,
+		DisableKeepAlives:     config.DisableKeepAlive,
+	}
+}
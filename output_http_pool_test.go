@@ -0,0 +1,134 @@
+package goreplay
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestConnPool(t *testing.T) {
+	pool := newConnPool(1, 1)
+
+	if !pool.acquire("a", time.Millisecond) || !pool.acquire("b", time.Millisecond) {
+		t.Fatal("Connections to different hosts should be allowed")
+	}
+
+	if pool.acquire("a", 10*time.Millisecond) {
+		t.Error("Second connection to host should not be allowed")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pool.release("a")
+	}()
+
+	if !pool.acquire("a", time.Second) {
+		t.Error("Connection should be allowed after slot is released")
+	}
+
+	if !pool.setIdle() || pool.setIdle() {
+		t.Error("Only one connection should be kept idle")
+	}
+
+	if open, idle := pool.stats(); open != 2 || idle != 1 {
+		t.Errorf("Expected 2 open and 1 idle connections, got %d %d", open, idle)
+	}
+}
+
+func startCountingServer(t *testing.T) (*httptest.Server, *int32) {
+	var connections int32
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+
+	return server, &connections
+}
+
+func TestHTTPClientPool(t *testing.T) {
+	server, connections := startCountingServer(t)
+	defer server.Close()
+
+	pool := newConnPool(1, 0)
+	first := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: 50 * time.Millisecond, pool: pool})
+	second := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: 50 * time.Millisecond, pool: pool})
+
+	if resp, _ := first.Get("/"); !bytes.Equal(proto.Status(resp), []byte("200")) {
+		t.Errorf("Expected response, got %q", resp)
+	}
+
+	// Connection of the first client is kept open
+	if resp, _ := second.Get("/"); !bytes.Equal(proto.Status(resp), []byte(HTTP_CONNECTION_ERROR)) {
+		t.Errorf("Expected connection error, got %q", resp)
+	}
+
+	if open, idle := pool.stats(); open != 1 || idle != 1 {
+		t.Errorf("Expected 1 open and idle connection, got %d %d", open, idle)
+	}
+
+	first.Disconnect()
+	if resp, _ := second.Get("/"); !bytes.Equal(proto.Status(resp), []byte("200")) {
+		t.Errorf("Expected response after connection is closed, got %q", resp)
+	}
+
+	if n := atomic.LoadInt32(connections); n != 2 {
+		t.Errorf("Expected 2 connections, got %d", n)
+	}
+}
+
+func TestHTTPClientKeepAlive(t *testing.T) {
+	server, connections := startCountingServer(t)
+	defer server.Close()
+
+	pool := newConnPool(0, 1)
+	first := NewHTTPClient(server.URL, &HTTPClientConfig{pool: pool})
+	second := NewHTTPClient(server.URL, &HTTPClientConfig{pool: pool})
+
+	// Connection of the second client exceeds idle limit, and is closed after each request
+	for i := 0; i < 2; i++ {
+		first.Get("/")
+		second.Get("/")
+	}
+
+	if n := atomic.LoadInt32(connections); n != 3 {
+		t.Errorf("Expected 3 connections, got %d", n)
+	}
+
+	if open, idle := pool.stats(); open != 1 || idle != 1 {
+		t.Errorf("Expected 1 open and idle connection, got %d %d", open, idle)
+	}
+
+	atomic.StoreInt32(connections, 0)
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{DisableKeepAlive: true})
+	client.Get("/")
+	client.Get("/")
+
+	if n := atomic.LoadInt32(connections); n != 2 {
+		t.Errorf("Expected connection for each request, got %d", n)
+	}
+
+	atomic.StoreInt32(connections, 0)
+	client = NewHTTPClient(server.URL, &HTTPClientConfig{IdleTimeout: 20 * time.Millisecond})
+	client.Get("/")
+	client.CloseIdle()
+	if client.conn == nil {
+		t.Error("Connection should be kept open before idle timeout")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	client.Get("/")
+
+	if n := atomic.LoadInt32(connections); n != 2 {
+		t.Errorf("Expected connection to be reopened after idle timeout, got %d", n)
+	}
+}
@@ -0,0 +1,117 @@
+package goreplay
+
+import (
+	"time"
+)
+
+// Connection of session is closed after it does not receive requests for this time, unless idle timeout is set
+const sessionIdleTimeout = 5 * time.Second
+
+// replaySession replays requests of a single captured client connection, or of other session key. Requests are sent
+// in order using its own connection as soon as they are read, so replay has the same number of simultaneously open
+// connections as capture, and requests of session are never sent concurrently.
+type replaySession struct {
+	requests chan []byte
+	// Requests being queued outside of sessionsMu, session does not stop while they are pending
+	pending int
+}
+
+// sessionKey returns session of request, or empty string if request is sent by workers
+func (o *HTTPOutput) sessionKey(info payloadInfo, data []byte) string {
+	if !o.config.originalConcurrency {
+		return ""
+	}
+
+	return requestSessionKey(o.config.sessionKey, string(info.addr), payloadBody(data))
+}
+
+// sessionRequest queues request to session with given key, session is started if it is not running
+func (o *HTTPOutput) sessionRequest(addr string, data []byte) {
+	o.sessionsMu.Lock()
+	s, ok := o.sessions[addr]
+	if !ok {
+		s = &replaySession{requests: make(chan []byte, o.config.queueLen)}
+		o.sessions[addr] = s
+		go o.runSession(addr, s)
+	}
+	s.pending++
+	o.sessionsMu.Unlock()
+
+	// Lock is not held while queue of session is full, so other sessions are not blocked by slow one
+	s.requests <- data
+
+	o.sessionsMu.Lock()
+	s.pending--
+	o.sessionsMu.Unlock()
+}
+
+func (o *HTTPOutput) runSession(addr string, s *replaySession) {
+	var client *HTTPClient
+	defer func() {
+		if client != nil {
+			client.Disconnect()
+		}
+	}()
+
+	idle := o.config.idleTimeout
+	if idle == 0 {
+		idle = sessionIdleTimeout
+	}
+
+	// Original time of the previous request, and when it was sent, for --output-http-session-delays
+	var prevTimestamp int64
+	var prevSent time.Time
+
+	for {
+		select {
+		case data := <-s.requests:
+			// Backend is picked once, requests of connection are sent to the same server
+			if client == nil {
+				client = o.sessionClient()
+			}
+
+			if o.config.sessionDelays {
+				info, _ := parsePayloadInfo(data)
+				timestamp := info.timestamp
+				// If previous request took longer than original delay, request is sent right after it
+				if prevTimestamp > 0 && timestamp > prevTimestamp {
+					if wait := time.Duration(timestamp-prevTimestamp) - time.Since(prevSent); wait > 0 {
+						time.Sleep(wait)
+					}
+				}
+				prevTimestamp, prevSent = timestamp, time.Now()
+			}
+
+			o.sendRequest(client, data)
+		case <-time.After(idle):
+			o.sessionsMu.Lock()
+			// Session does not stop while it has queued requests
+			if len(s.requests) == 0 && s.pending == 0 {
+				delete(o.sessions, addr)
+				o.sessionsMu.Unlock()
+				return
+			}
+			o.sessionsMu.Unlock()
+		}
+	}
+}
+
+// sessionClient returns client of the next backend, or nil if there are no backends
+func (o *HTTPOutput) sessionClient() *HTTPClient {
+	address := o.address
+	if o.backends != nil {
+		if address, _ = o.backends.pick(); address == "" {
+			return nil
+		}
+	}
+
+	return NewHTTPClient(address, o.clientConfig())
+}
+
+// sessionCount returns number of running sessions
+func (o *HTTPOutput) sessionCount() int {
+	o.sessionsMu.Lock()
+	defer o.sessionsMu.Unlock()
+
+	return len(o.sessions)
+}
@@ -1,12 +1,19 @@
-package main
+package goreplay
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	_ "net/http/httputil"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -164,3 +171,486 @@ func BenchmarkHTTPOutput(b *testing.B) {
 
 	close(quit)
 }
+
+func TestHTTPOutputChunkedRequest(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	body := bytes.Repeat([]byte("a"), 1024*1024)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+
+		if !bytes.Equal(data, body) {
+			t.Error("Wrong POST body size:", len(data))
+		}
+
+		wg.Done()
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{})
+
+	request := []byte("POST / HTTP/1.1\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n")
+	header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1)
+	chunker := newPayloadChunker(header, io.MultiReader(bytes.NewReader(request), bytes.NewReader(body)), len(request)+len(body))
+
+	wg.Add(1)
+	data := make([]byte, 64*1024)
+	for !chunker.done() {
+		n, _ := chunker.Read(data)
+		output.Write(data[:n])
+	}
+
+	wg.Wait()
+}
+
+func TestHTTPOutputClientIP(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ip := req.Header.Get("X-Real-IP"); ip != "10.0.0.1" {
+			t.Error("Wrong X-Real-IP header:", ip)
+		}
+
+		if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "192.168.0.1, 10.0.0.1" {
+			t.Error("Wrong X-Forwarded-For header:", forwarded)
+		}
+
+		wg.Done()
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{clientIPHeaders: MultiOption{"X-Forwarded-For", "X-Real-IP"}})
+
+	header := payloadAddrHeader(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), "10.0.0.1:5000")
+	request := []byte("GET / HTTP/1.1\r\nX-Forwarded-For: 192.168.0.1\r\nX-Real-IP: 192.168.0.1\r\n\r\n")
+
+	wg.Add(1)
+	output.Write(append(header, request...))
+	wg.Wait()
+}
+
+func TestHTTPOutputRequestID(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	id := uuid()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if header := req.Header.Get("X-Gor-Request-Id"); header != string(id) {
+			t.Errorf("Expected request ID %q, got %q", id, header)
+		}
+
+		wg.Done()
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{requestIDHeader: "X-Gor-Request-Id"})
+
+	header := payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1)
+	request := []byte("GET / HTTP/1.1\r\nX-Gor-Request-Id: 1\r\n\r\n")
+
+	wg.Add(1)
+	output.Write(append(header, request...))
+	wg.Wait()
+}
+
+func TestHTTPOutputVerify(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/echo" {
+			w.Header().Set("X-Gor-Verify", req.Header.Get("X-Gor-Verify"))
+		}
+	}))
+	defer server.Close()
+
+	mirrorVerifier = newDeliveryVerifier("X-Gor-Verify")
+	defer func() { mirrorVerifier = nil }()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{})
+
+	echoed, unechoed, lost, filtered, sampled, shed := uuid(), uuid(), uuid(), uuid(), uuid(), uuid()
+	for _, id := range [][]byte{echoed, unechoed, lost, filtered, sampled, shed} {
+		mirrorVerifier.capture(id)
+	}
+	mirrorVerifier.filter(filtered)
+	mirrorVerifier.shed(sampled, true)
+	// Request not written to shed output, which no other output accepted
+	mirrorVerifier.shed(shed, false)
+	mirrorVerifier.stop()
+	// Requests captured after verification stopped are not tracked
+	mirrorVerifier.capture(uuid())
+
+	output.Write(append(payloadHeader(RequestPayload, echoed, time.Now().UnixNano(), -1), "GET /echo HTTP/1.1\r\n\r\n"...))
+	output.Write(append(payloadHeader(RequestPayload, unechoed, time.Now().UnixNano(), -1), "GET / HTTP/1.1\r\n\r\n"...))
+
+	for i := 0; i < 100; i++ {
+		mirrorVerifier.mu.Lock()
+		pending := len(mirrorVerifier.pending)
+		mirrorVerifier.mu.Unlock()
+		if pending == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var report bytes.Buffer
+	mirrorVerifier.report(&report)
+
+	for _, line := range []string{
+		"Captured requests: 6",
+		"Filtered: 1",
+		"Dropped by memory budget: 2",
+		"Accepted by target: 1",
+		"Responses without X-Gor-Verify header: 1",
+		"Failed: 0",
+		"Lost: 1",
+		"Delivery ratio: 20.00%",
+	} {
+		if !strings.Contains(report.String(), line) {
+			t.Errorf("Expected %q in report:\n%s", line, report.String())
+		}
+	}
+}
+
+func TestHTTPOutputPreserveHeaders(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Request is read raw, as Go server canonicalizes headers
+		r := bufio.NewReader(conn)
+		var headers []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+			headers = append(headers, strings.TrimSpace(line))
+		}
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+		received <- strings.Join(headers[1:], "|")
+	}()
+
+	output := NewHTTPOutput("http://"+ln.Addr().String(), &HTTPOutputConfig{requestIDHeader: "X-Gor-Request-Id", preserveHeaders: true, OriginalHost: true})
+
+	id := uuid()
+	output.Write(append(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), "GET / HTTP/1.1\r\nhost: example.com\r\nx-custom: 1\r\nACCEPT: */*\r\n\r\n"...))
+
+	select {
+	case headers := <-received:
+		if expected := "host: example.com|x-custom: 1|ACCEPT: */*|X-Gor-Request-Id: " + string(id); headers != expected {
+			t.Errorf("Expected %q, got %q", expected, headers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Request is not received")
+	}
+}
+
+func TestHTTPOutputWorkerScaling(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	config := &HTTPOutputConfig{workersMin: 2, workersMax: 5, queueLen: 100, scaleUpThreshold: 2, scaleDownIdle: 100 * time.Millisecond, Timeout: 5 * time.Second}
+	output := NewHTTPOutput(server.URL, config).(*HTTPOutput)
+
+	waitWorkers := func(expected int64) {
+		for i := 0; i < 100; i++ {
+			if atomic.LoadInt64(&output.activeWorkers) == expected {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("Expected %d workers, got %d", expected, atomic.LoadInt64(&output.activeWorkers))
+	}
+
+	// Idle workers stop, but minimum number of workers is kept
+	waitWorkers(2)
+
+	// Queued requests over threshold start workers up to maximum
+	for i := 0; i < 10; i++ {
+		output.Write(append(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), "GET / HTTP/1.1\r\n\r\n"...))
+	}
+	waitWorkers(5)
+
+	close(release)
+	waitWorkers(2)
+}
+
+func TestHTTPOutputOriginalConcurrency(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	conns := make(map[string]string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+
+		// Requests of captured connection are sent using the same connection
+		client := req.Header.Get("Client")
+		if conn, ok := conns[client]; ok && conn != req.RemoteAddr {
+			t.Errorf("Requests of %s are sent using different connections", client)
+		}
+		conns[client] = req.RemoteAddr
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		wg.Done()
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMin: 1, workersMax: 1, queueLen: 10, originalConcurrency: true}).(*HTTPOutput)
+
+	for i := 0; i < 2; i++ {
+		for _, addr := range []string{"10.0.0.1:5000", "10.0.0.1:5001", "10.0.0.2:5000"} {
+			header := payloadAddrHeader(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), addr)
+
+			wg.Add(1)
+			output.Write(append(header, "GET / HTTP/1.1\r\nClient: "+addr+"\r\n\r\n"...))
+		}
+	}
+
+	wg.Wait()
+
+	// Single worker would send requests one by one
+	if maxInFlight != 3 {
+		t.Errorf("Expected 3 concurrent requests, got %d", maxInFlight)
+	}
+
+	if n := output.sessionCount(); n != 3 {
+		t.Errorf("Expected 3 sessions, got %d", n)
+	}
+}
+
+func TestHTTPOutputSessionSlowSession(t *testing.T) {
+	release := make(chan struct{})
+	fast := make(chan struct{}, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Client") == "slow" {
+			<-release
+			return
+		}
+		fast <- struct{}{}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	// Without queue, request is handed to session directly
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMin: 1, workersMax: 1, queueLen: 0, originalConcurrency: true, Timeout: 10 * time.Second}).(*HTTPOutput)
+
+	write := func(addr, client string) {
+		header := payloadAddrHeader(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), addr)
+		output.Write(append(header, "GET / HTTP/1.1\r\nClient: "+client+"\r\n\r\n"...))
+	}
+
+	// The second request of slow session waits until the first one is answered
+	write("10.0.0.1:5000", "slow")
+	go write("10.0.0.1:5000", "slow")
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		go write(fmt.Sprintf("10.0.0.2:%d", 5000+i), "fast")
+		select {
+		case <-fast:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("Requests of other sessions are blocked by slow session")
+		}
+	}
+}
+
+func TestHTTPOutputSessionKey(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	var mu sync.Mutex
+	inFlight := make(map[string]int)
+	seqs := make(map[string][]string)
+	sent := make(map[string][]time.Time)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user := req.Header.Get("User")
+
+		mu.Lock()
+		inFlight[user]++
+		if inFlight[user] > 1 {
+			t.Errorf("Requests of %s are sent concurrently", user)
+		}
+		seqs[user] = append(seqs[user], req.Header.Get("Seq"))
+		sent[user] = append(sent[user], time.Now())
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inFlight[user]--
+		mu.Unlock()
+		wg.Done()
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMin: 4, workersMax: 4, queueLen: 10, originalConcurrency: true, sessionKey: "header:User", sessionDelays: true}).(*HTTPOutput)
+
+	start := time.Now().UnixNano()
+	for i := 0; i < 3; i++ {
+		// Requests of the same user come from different connections, and are 100ms apart in capture
+		for j, user := range []string{"alice", "bob"} {
+			addr := fmt.Sprintf("10.0.0.%d:%d", j+1, 5000+i)
+			header := payloadAddrHeader(payloadHeader(RequestPayload, uuid(), start+int64(i)*int64(100*time.Millisecond), -1), addr)
+
+			wg.Add(1)
+			output.Write(append(header, fmt.Sprintf("GET / HTTP/1.1\r\nUser: %s\r\nSeq: %d\r\n\r\n", user, i)...))
+		}
+	}
+
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, user := range []string{"alice", "bob"} {
+		if got := strings.Join(seqs[user], ","); got != "0,1,2" {
+			t.Errorf("Expected requests of %s in order, got %s", user, got)
+		}
+		for i := 1; i < len(sent[user]); i++ {
+			if d := sent[user][i].Sub(sent[user][i-1]); d < 90*time.Millisecond {
+				t.Errorf("Expected original delay between requests of %s, got %s", user, d)
+			}
+		}
+	}
+
+	if n := output.sessionCount(); n != 2 {
+		t.Errorf("Expected 2 sessions, got %d", n)
+	}
+}
+
+func TestHTTPOutputCookieJar(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	var mu sync.Mutex
+	cookies := make(map[string]string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer wg.Done()
+
+		if req.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "staging-" + req.Header.Get("Client")})
+			http.SetCookie(w, &http.Cookie{Name: "flash", MaxAge: -1})
+			return
+		}
+
+		mu.Lock()
+		cookies[req.Header.Get("Client")] = req.Header.Get("Cookie")
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMin: 1, workersMax: 1, queueLen: 10, originalConcurrency: true, cookieJar: cookieJarClientIP}).(*HTTPOutput)
+
+	send := func(addr, request string) {
+		header := payloadAddrHeader(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), addr)
+
+		wg.Add(1)
+		output.Write(append(header, request...))
+		wg.Wait()
+	}
+
+	send("10.0.0.1:5000", "POST /login HTTP/1.1\r\nClient: 10.0.0.1\r\nContent-Length: 0\r\n\r\n")
+	// Jar is updated after response is read
+	for i := 0; i < 100; i++ {
+		output.cookieJars.mu.Lock()
+		_, ok := output.cookieJars.jars["10.0.0.1"]
+		output.cookieJars.mu.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Session of client IP is shared by its connections
+	send("10.0.0.1:5001", "GET /account HTTP/1.1\r\nClient: 10.0.0.1\r\nCookie: sid=production; flash=hello; theme=dark\r\n\r\n")
+	send("10.0.0.2:5000", "GET /account HTTP/1.1\r\nClient: 10.0.0.2\r\nCookie: sid=production\r\n\r\n")
+
+	if c := cookies["10.0.0.1"]; c != "sid=staging-10.0.0.1; theme=dark" {
+		t.Error("Cookies set and removed by replayed response should override captured ones, got", c)
+	}
+	if c := cookies["10.0.0.2"]; c != "sid=production" {
+		t.Error("Cookies of other sessions should not be changed, got", c)
+	}
+}
+
+func TestHTTPOutputCorrelate(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	var mu sync.Mutex
+	var received []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer wg.Done()
+
+		if req.URL.Path == "/form" {
+			w.Write([]byte(`<input name="csrf" value="staging-csrf/42">`))
+			return
+		}
+		if req.URL.Path == "/api/login" {
+			w.Write([]byte(`{"session": {"tokens": ["replayed-token"]}}`))
+			return
+		}
+
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		received = append(received, req.Header.Get("X-Token")+" "+string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	var rules HTTPCorrelationRules
+	rules.Set(`name="csrf" value="([^"]+)"`)
+	rules.Set(`json:$.session.tokens[0]`)
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMin: 1, workersMax: 1, queueLen: 10, correlate: rules}).(*HTTPOutput)
+
+	exchange := func(request, response string) {
+		id := uuid()
+		wg.Add(1)
+		output.Write(append(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), request...))
+		wg.Wait()
+		output.Write(append(payloadHeader(ResponsePayload, id, time.Now().UnixNano(), 1), response...))
+	}
+
+	exchange("GET /form HTTP/1.1\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 43\r\n\r\n<input name=\"csrf\" value=\"original-csrf/1\">")
+	exchange("POST /api/login HTTP/1.1\r\nContent-Length: 0\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 44\r\n\r\n{\"session\": {\"tokens\": [\"original-token\"]}}")
+
+	// Values are paired when both responses are received
+	for i := 0; i < 100; i++ {
+		output.correlator.mu.Lock()
+		n := len(output.correlator.values)
+		output.correlator.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	body := "csrf=original-csrf%2F1&a=1"
+	wg.Add(1)
+	output.Write(append(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1),
+		"POST /submit HTTP/1.1\r\nX-Token: original-token\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body...))
+	wg.Wait()
+
+	if len(received) != 1 || received[0] != "replayed-token csrf=staging-csrf%2F42&a=1" {
+		t.Errorf("Values of original responses should be replaced, got %q", received)
+	}
+}
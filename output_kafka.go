@@ -1,4 +1,4 @@
-package main
+package goreplay
 
 import (
 	"encoding/json"
@@ -34,6 +34,10 @@ func NewKafkaOutput(address string, config *KafkaConfig) io.Writer {
 		c.Producer.RequiredAcks = sarama.WaitForLocal
 		c.Producer.Compression = sarama.CompressionSnappy
 		c.Producer.Flush.Frequency = KafkaOutputFrequency * time.Millisecond
+		if config.flushInterval > 0 {
+			c.Producer.Flush.Frequency = config.flushInterval
+		}
+		c.Producer.Flush.Bytes = config.batchSize
 
 		brokerList := strings.Split(config.host, ",")
 
@@ -67,6 +71,10 @@ func (o *KafkaOutput) ErrorHandler() {
 func (o *KafkaOutput) Write(data []byte) (n int, err error) {
 	var message sarama.StringEncoder
 
+	if o.config.redactor != nil {
+		data = o.config.redactor.Redact(data)
+	}
+
 	if !o.config.useJSON {
 		message = sarama.StringEncoder(data)
 	} else {
@@ -0,0 +1,345 @@
+package goreplay
+
+import (
+	"crypto/md5"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// PutRecords request can have up to 500 records and 5MB of data, record can have up to 1MB
+const (
+	kinesisMaxBatchSize   = 500
+	kinesisMaxBatchBytes  = 4 << 20
+	kinesisMaxRecordBytes = 1000 << 10
+	// Aggregated records are sent when they reach this size, the same as KPL default
+	kinesisMaxAggregateBytes = 50 << 10
+	kinesisShardsRefresh     = time.Minute
+	kinesisMaxRetries        = 3
+)
+
+type kinesisRecord struct {
+	Data            []byte `json:"Data"`
+	PartitionKey    string `json:"PartitionKey"`
+	ExplicitHashKey string `json:"ExplicitHashKey,omitempty"`
+}
+
+// kinesisShard is open shard of stream with range of MD5 hashes of partition keys it receives
+type kinesisShard struct {
+	id         string
+	start, end *big.Int
+	aggregator kplAggregator
+}
+
+// KinesisOutput puts payloads to AWS Kinesis data stream in Gor format, in batches. Partition key is session of
+// payload, so payloads of the same captured connection are put to the same shard in order. With aggregation, payloads
+// of each shard are aggregated into records like Kinesis Producer Library does.
+type KinesisOutput struct {
+	sync.Mutex
+	stream string
+	config *KinesisConfig
+	client *awsClient
+
+	shards     []*kinesisShard
+	sessions   payloadSessions
+	batch      []kinesisRecord
+	batchBytes int
+	batches    chan []kinesisRecord
+	done       chan struct{}
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// NewKinesisOutput constructor for KinesisOutput, accepts stream name or ARN
+func NewKinesisOutput(stream string, config *KinesisConfig) io.Writer {
+	name, region := parseKinesisStream(stream)
+	if config.region != "" {
+		region = config.region
+	} else if region == "" {
+		region = awsRegion()
+	}
+
+	client, err := newAWSClient("kinesis", kinesisTarget, region, config.endpoint)
+	if err != nil {
+		log.Fatalln("output-kinesis error:", err)
+	}
+
+	o := &KinesisOutput{
+		stream:  name,
+		config:  config,
+		client:  client,
+		batches: make(chan []kinesisRecord, 10),
+		done:    make(chan struct{}),
+	}
+
+	if config.aggregate {
+		if o.shards, err = o.listShards(); err != nil {
+			log.Fatalln("output-kinesis error:", err)
+		}
+	}
+
+	o.wg.Add(1)
+	go o.publisher()
+
+	go func() {
+		interval := config.flushInterval
+		if interval <= 0 {
+			interval = KafkaOutputFrequency * time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		lastRefresh := time.Now()
+
+		for {
+			select {
+			case <-ticker.C:
+				o.Lock()
+				o.flush()
+				o.Unlock()
+
+				if config.aggregate && time.Since(lastRefresh) >= kinesisShardsRefresh {
+					lastRefresh = time.Now()
+					o.refreshShards()
+				}
+			case <-o.done:
+				return
+			}
+		}
+	}()
+
+	return o
+}
+
+func (o *KinesisOutput) listShards() (shards []*kinesisShard, err error) {
+	request := map[string]interface{}{"StreamName": o.stream}
+
+	for {
+		var response struct {
+			Shards []struct {
+				ShardID      string `json:"ShardId"`
+				HashKeyRange struct {
+					StartingHashKey string
+					EndingHashKey   string
+				}
+				SequenceNumberRange struct {
+					EndingSequenceNumber string
+				}
+			}
+			NextToken string
+		}
+		if err = o.client.call("ListShards", request, &response); err != nil {
+			return
+		}
+
+		for _, s := range response.Shards {
+			// Closed shard
+			if s.SequenceNumberRange.EndingSequenceNumber != "" {
+				continue
+			}
+			shard := &kinesisShard{id: s.ShardID, start: new(big.Int), end: new(big.Int)}
+			if _, ok := shard.start.SetString(s.HashKeyRange.StartingHashKey, 10); !ok {
+				return nil, errors.New("wrong hash key range of shard " + s.ShardID)
+			}
+			if _, ok := shard.end.SetString(s.HashKeyRange.EndingHashKey, 10); !ok {
+				return nil, errors.New("wrong hash key range of shard " + s.ShardID)
+			}
+			shards = append(shards, shard)
+		}
+
+		if response.NextToken == "" {
+			return
+		}
+		// Stream name can't be given with next token
+		request = map[string]interface{}{"NextToken": response.NextToken}
+	}
+}
+
+// refreshShards updates shards after stream is resharded
+func (o *KinesisOutput) refreshShards() {
+	shards, err := o.listShards()
+	if err != nil {
+		log.Println("[KINESIS-OUTPUT] can't list shards:", err)
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	o.flushAggregates()
+	o.shards = shards
+}
+
+// shard returns shard receiving partition key
+func (o *KinesisOutput) shard(key string) *kinesisShard {
+	sum := md5.Sum([]byte(key))
+	hash := new(big.Int).SetBytes(sum[:])
+
+	for _, s := range o.shards {
+		if hash.Cmp(s.start) >= 0 && hash.Cmp(s.end) <= 0 {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func (o *KinesisOutput) Write(data []byte) (n int, err error) {
+	if o.config.redactor != nil {
+		data = o.config.redactor.Redact(data)
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return 0, errors.New("Kinesis output is closed")
+	}
+
+	key := o.sessions.key(data)
+	// Kinesis limits partition key to 256 characters
+	if len(key) > 256 {
+		key = key[:256]
+	}
+
+	if len(data)+len(key) > kinesisMaxRecordBytes {
+		log.Printf("[KINESIS-OUTPUT] payload of %d bytes exceeds record size limit, lower --copy-buffer-size\n", len(data))
+		return len(data), nil
+	}
+
+	if shard := o.shard(key); shard != nil {
+		if shard.aggregator.count > 0 && shard.aggregator.size()+len(data)+len(key) > kinesisMaxAggregateBytes {
+			o.flushAggregate(shard)
+		}
+		shard.aggregator.add(key, data)
+	} else {
+		o.add(kinesisRecord{Data: append([]byte(nil), data...), PartitionKey: key})
+	}
+
+	return len(data), nil
+}
+
+// add adds record to batch, batch is passed to publisher when it is full. Should be called under lock.
+func (o *KinesisOutput) add(record kinesisRecord) {
+	size := len(record.Data) + len(record.PartitionKey)
+	if o.batchBytes+size > kinesisMaxBatchBytes {
+		o.flushBatch()
+	}
+
+	o.batch = append(o.batch, record)
+	o.batchBytes += size
+
+	if len(o.batch) >= kinesisMaxBatchSize {
+		o.flushBatch()
+	}
+}
+
+// flushAggregate adds aggregated record of shard to batch. Explicit hash key puts it to the shard, even if partition
+// key of the first record is mapped to other shard after resharding. Should be called under lock.
+func (o *KinesisOutput) flushAggregate(shard *kinesisShard) {
+	if shard.aggregator.count == 0 {
+		return
+	}
+
+	data, key := shard.aggregator.encode()
+	o.add(kinesisRecord{Data: data, PartitionKey: key, ExplicitHashKey: shard.start.String()})
+	shard.aggregator.reset()
+}
+
+func (o *KinesisOutput) flushAggregates() {
+	for _, shard := range o.shards {
+		o.flushAggregate(shard)
+	}
+}
+
+func (o *KinesisOutput) flushBatch() {
+	if len(o.batch) == 0 {
+		return
+	}
+
+	o.batches <- o.batch
+	o.batch = nil
+	o.batchBytes = 0
+}
+
+// flush passes all collected records to publisher. Should be called under lock.
+func (o *KinesisOutput) flush() {
+	o.flushAggregates()
+	o.flushBatch()
+}
+
+func (o *KinesisOutput) publisher() {
+	defer o.wg.Done()
+
+	for batch := range o.batches {
+		o.putRecords(batch)
+	}
+}
+
+// putRecords puts records to stream, records which failed, e.g. because of exceeded throughput of shard, are retried
+func (o *KinesisOutput) putRecords(records []kinesisRecord) {
+	for attempt := 0; len(records) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+
+		request := struct {
+			StreamName string
+			Records    []kinesisRecord
+		}{o.stream, records}
+		var response struct {
+			FailedRecordCount int
+			Records           []struct {
+				ErrorCode    string
+				ErrorMessage string
+			}
+		}
+
+		if err := o.client.call("PutRecords", &request, &response); err != nil {
+			if attempt >= kinesisMaxRetries {
+				log.Println("[KINESIS-OUTPUT] put error:", err)
+				return
+			}
+			continue
+		}
+		if response.FailedRecordCount == 0 {
+			return
+		}
+
+		var failed []kinesisRecord
+		var lastError string
+		for i, r := range response.Records {
+			if r.ErrorCode != "" && i < len(records) {
+				failed = append(failed, records[i])
+				lastError = r.ErrorCode + ": " + r.ErrorMessage
+			}
+		}
+		if attempt >= kinesisMaxRetries {
+			log.Printf("[KINESIS-OUTPUT] %d records failed: %s\n", len(failed), lastError)
+			return
+		}
+		records = failed
+	}
+}
+
+func (o *KinesisOutput) String() string {
+	return "Kinesis output: " + o.stream
+}
+
+// Close puts remaining records and waits for pending requests
+func (o *KinesisOutput) Close() error {
+	o.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.done)
+		o.flush()
+		close(o.batches)
+	}
+	o.Unlock()
+
+	o.wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package goreplay
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/mongo"
+)
+
+// Connections not used for this time are closed, captured clients do not close sessions through output
+const mongoIdleTimeout = time.Minute
+
+// MongoOutputConfig holds configuration options for MongoDB output
+type MongoOutputConfig struct {
+	Workers        int
+	Timeout        time.Duration
+	TrackResponses bool
+}
+
+// MongoOutput replays captured MongoDB commands against another deployment, e.g. shadow server with new indexes.
+// Commands of captured connection are replayed in order by the same worker, using separate connection.
+type MongoOutput struct {
+	address    string
+	config     *MongoOutputConfig
+	connConfig mongo.Config
+	queues     []chan []byte
+	responses  chan response
+	quit       chan struct{}
+}
+
+// NewMongoOutput constructor for MongoOutput. Accepts address in `user:password@host:port/authdb` format, credentials,
+// port and authentication database are optional.
+func NewMongoOutput(address string, config *MongoOutputConfig) io.Writer {
+	o := new(MongoOutput)
+
+	var err error
+	if o.address, o.connConfig, err = parseMongoAddress(address); err != nil {
+		log.Fatalln("output-mongo error:", err)
+	}
+
+	o.config = config
+	o.responses = make(chan response, 1000)
+	o.quit = make(chan struct{})
+
+	if o.config.Workers <= 0 {
+		o.config.Workers = 10
+	}
+	if o.config.Timeout <= 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+	o.connConfig.Timeout = o.config.Timeout
+
+	for i := 0; i < o.config.Workers; i++ {
+		queue := make(chan []byte, 100)
+		o.queues = append(o.queues, queue)
+		go o.worker(queue)
+	}
+
+	return o
+}
+
+func parseMongoAddress(address string) (string, mongo.Config, error) {
+	var config mongo.Config
+
+	if i := strings.LastIndex(address, "@"); i != -1 {
+		config.User = address[:i]
+		address = address[i+1:]
+
+		if j := strings.Index(config.User, ":"); j != -1 {
+			config.Password = config.User[j+1:]
+			config.User = config.User[:j]
+		}
+
+		if config.User == "" {
+			return "", config, errors.New("user is not specified")
+		}
+	}
+
+	if i := strings.Index(address, "/"); i != -1 {
+		config.AuthDatabase = address[i+1:]
+		address = address[:i]
+	}
+
+	if address == "" {
+		return "", config, errors.New("host is not specified")
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "27017")
+	}
+
+	return address, config, nil
+}
+
+type mongoConn struct {
+	*mongo.Conn
+	lastUsed time.Time
+}
+
+func (o *MongoOutput) worker(queue chan []byte) {
+	conns := make(map[string]*mongoConn)
+	lastExpire := time.Now()
+
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		var data []byte
+		select {
+		case <-o.quit:
+			return
+		case data = <-queue:
+		}
+
+		cmd := new(mongo.Command)
+		if err := cmd.UnmarshalText(payloadBody(data)); err != nil {
+			continue
+		}
+
+		start := time.Now()
+
+		if start.Sub(lastExpire) >= mongoIdleTimeout {
+			lastExpire = start
+			for id, conn := range conns {
+				if start.Sub(conn.lastUsed) >= mongoIdleTimeout {
+					conn.Close()
+					delete(conns, id)
+				}
+			}
+		}
+
+		conn, ok := conns[cmd.Connection]
+		if !ok {
+			c, err := mongo.Dial(o.address, o.connConfig)
+			if err != nil {
+				log.Println("MongoDB output: can't connect to", o.address, err)
+				continue
+			}
+
+			conn = &mongoConn{Conn: c}
+			conns[cmd.Connection] = conn
+		}
+		conn.lastUsed = start
+
+		resp, err := conn.Exec(cmd)
+		if err != nil {
+			log.Println("MongoDB output: error replaying command", err)
+			conn.Close()
+			delete(conns, cmd.Connection)
+			continue
+		}
+
+		// Unacknowledged writes have no reply
+		if !o.config.TrackResponses || resp == nil {
+			continue
+		}
+
+		stop := time.Now()
+		o.responses <- response{resp, payloadMeta(data)[1], start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+	}
+}
+
+func (o *MongoOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
+
+	// Commands larger than copy buffer are skipped by input
+	if _, _, chunked := payloadChunk(data); chunked {
+		return len(data), nil
+	}
+
+	cmd := new(mongo.Command)
+	if err := cmd.UnmarshalText(payloadBody(data)); err != nil {
+		return len(data), nil
+	}
+
+	// We have to copy, because sending data in multiple threads
+	newBuf := make([]byte, len(data))
+	copy(newBuf, data)
+
+	h := fnv.New32a()
+	h.Write([]byte(cmd.Connection))
+	o.queues[h.Sum32()%uint32(len(o.queues))] <- newBuf
+
+	return len(data), nil
+}
+
+func (o *MongoOutput) Read(data []byte) (int, error) {
+	var resp response
+	select {
+	case <-o.quit:
+		return 0, io.EOF
+	case resp = <-o.responses:
+	}
+
+	header := payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	copy(data[0:len(header)], header)
+	copy(data[len(header):], resp.payload)
+
+	return len(resp.payload) + len(header), nil
+}
+
+func (o *MongoOutput) String() string {
+	return fmt.Sprintf("MongoDB output %s", o.address)
+}
+
+// Close stops workers, and closes their connections
+func (o *MongoOutput) Close() error {
+	close(o.quit)
+	return nil
+}
@@ -0,0 +1,126 @@
+package goreplay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/mongo"
+)
+
+// mongoMessage returns OP_MSG with body document {name: collection, $db: db}
+func mongoMessage(name, collection, db string) []byte {
+	doc := []byte{0, 0, 0, 0}
+	for _, e := range [][2]string{{name, collection}, {"$db", db}} {
+		length := make([]byte, 4)
+		binary.LittleEndian.PutUint32(length, uint32(len(e[1])+1))
+
+		doc = append(append(doc, 2), e[0]+"\x00"...)
+		doc = append(append(doc, length...), e[1]+"\x00"...)
+	}
+	doc = append(doc, 0)
+	binary.LittleEndian.PutUint32(doc, uint32(len(doc)))
+
+	return mongo.AppendMessage(nil, 1, 0, mongo.OpMsg, append([]byte{0, 0, 0, 0, 0}, doc...))
+}
+
+// startMongoServer accepts clients without authentication, and answers commands with their body. Commands are sent
+// to channel together with number of connection.
+func startMongoServer(t *testing.T, commands chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for n := 1; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn, n int) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				for {
+					header := make([]byte, 16)
+					if _, err := io.ReadFull(r, header); err != nil {
+						return
+					}
+
+					data := make([]byte, binary.LittleEndian.Uint32(header))
+					copy(data, header)
+					if _, err := io.ReadFull(r, data[16:]); err != nil {
+						return
+					}
+
+					cmd, _ := mongo.ParseCommand(data)
+					commands <- string('0'+rune(n)) + " " + cmd.Name + " " + cmd.Namespace
+					conn.Write(mongo.AppendMessage(nil, 2, mongo.RequestID(data), mongo.OpMsg, data[16:]))
+				}
+			}(conn, n)
+		}
+	}()
+
+	return ln
+}
+
+func mongoCommand(connection, name, collection string) []byte {
+	cmd, _ := mongo.ParseCommand(mongoMessage(name, collection, "shop"))
+	cmd.Connection = connection
+
+	text, _ := cmd.MarshalText()
+	return append(payloadHeader(RequestPayload, uuid(), 1, -1), text...)
+}
+
+func TestMongoOutput(t *testing.T) {
+	commands := make(chan string, 10)
+	ln := startMongoServer(t, commands)
+	defer ln.Close()
+
+	output := NewMongoOutput(ln.Addr().String(), &MongoOutputConfig{Workers: 1, TrackResponses: true, Timeout: time.Second})
+	defer output.(*MongoOutput).Close()
+
+	// Only requests are replayed
+	output.Write(append(payloadHeader(ResponsePayload, uuid(), 1, 1), mongoMessage("ok", "", "")...))
+
+	// Each captured connection is replayed using separate connection
+	output.Write(mongoCommand("10.0.0.1:5000", "insert", "orders"))
+	output.Write(mongoCommand("10.0.0.2:5000", "find", "users"))
+	output.Write(mongoCommand("10.0.0.1:5000", "delete", "orders"))
+
+	for _, expected := range []string{"1 insert shop.orders", "2 find shop.users", "1 delete shop.orders"} {
+		if c := <-commands; c != expected {
+			t.Errorf("Expected %q, got %q", expected, c)
+		}
+	}
+
+	buf := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		n, _ := output.(*MongoOutput).Read(buf)
+		if buf[0] != ReplayedResponsePayload || mongo.OpCode(payloadBody(buf[:n])) != mongo.OpMsg {
+			t.Errorf("Wrong replayed reply: %q", buf[:n])
+		}
+	}
+}
+
+func TestParseMongoAddress(t *testing.T) {
+	address, config, err := parseMongoAddress("app:p@ss:w@rd@db.local/shop")
+	if err != nil || address != "db.local:27017" || config.User != "app" || config.Password != "p@ss:w@rd" || config.AuthDatabase != "shop" {
+		t.Error("Wrong address", address, config, err)
+	}
+
+	if address, config, _ = parseMongoAddress("[::1]:27018"); address != "[::1]:27018" || config.User != "" || config.AuthDatabase != "" {
+		t.Error("Wrong address", address, config)
+	}
+
+	for _, address := range []string{":secret@db.local", "app@/admin"} {
+		if _, _, err = parseMongoAddress(address); err == nil {
+			t.Errorf("Should reject %q", address)
+		}
+	}
+}
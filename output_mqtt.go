@@ -0,0 +1,486 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// MQTTOutputConfig holds configuration of MQTT output
+type MQTTOutputConfig struct {
+	// Topic template, {path}, {method} and {host} are replaced by values of request
+	topic    string
+	qos      int
+	clientID string
+}
+
+// MQTT 3.1.1 control packets used by output
+const (
+	mqttConnect   = 0x10
+	mqttConnack   = 0x20
+	mqttPublish   = 0x30
+	mqttPuback    = 0x40
+	mqttPubrec    = 0x50
+	mqttPubrel    = 0x62
+	mqttPubcomp   = 0x70
+	mqttPingreq   = 0xc0
+	mqttKeepAlive = 60 * time.Second
+	// This many QoS 1 and 2 messages can wait for acknowledgement, they are awaited for this time
+	mqttMaxInflight     = 256
+	mqttInflightTimeout = 5 * time.Second
+)
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// parseMQTTAddress parses `tcp://[user:password@]host[:port]` address of broker, `ssl://` scheme enables TLS. Port is
+// 1883 by default, and 8883 with TLS.
+func parseMQTTAddress(address string) (*url.URL, error) {
+	if !strings.Contains(address, "://") {
+		address = "tcp://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if u.Port() == "" {
+			u.Host += ":1883"
+		}
+	case "ssl", "tls", "mqtts":
+		if u.Port() == "" {
+			u.Host += ":8883"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("host is not specified")
+	}
+
+	return u, nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(s)))
+	return append(append(b, size[:]...), s...)
+}
+
+// appendMQTTPacket appends packet with fixed header of given type and flags, and remaining length
+func appendMQTTPacket(b []byte, header byte, body []byte) []byte {
+	b = append(b, header)
+	for size := len(body); ; {
+		digit := byte(size % 128)
+		size /= 128
+		if size > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if size == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+func readMQTTPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	if header, err = r.ReadByte(); err != nil {
+		return
+	}
+
+	size := 0
+	for shift := uint(0); ; shift += 7 {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if shift > 21 {
+			return 0, nil, errors.New("malformed MQTT packet")
+		}
+		size |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	body = make([]byte, size)
+	_, err = io.ReadFull(r, body)
+
+	return
+}
+
+// mqttConn is connection to MQTT broker with clean session. Connection is not re-established, it is closed on first
+// error and output dials new one.
+type mqttConn struct {
+	conn   net.Conn
+	mu     sync.Mutex
+	writer *bufio.Writer
+	// Called with IDs of packets which are acknowledged, from reading goroutine
+	onAck func(id uint16)
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error
+}
+
+func dialMQTT(u *url.URL, clientID string, onAck func(id uint16)) (*mqttConn, error) {
+	var conn net.Conn
+	var err error
+	if u.Scheme == "tcp" || u.Scheme == "mqtt" {
+		conn, err = net.DialTimeout("tcp", u.Host, 5*time.Second)
+	} else {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", u.Host, &tls.Config{ServerName: u.Hostname()})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Protocol name and level, connect flags with clean session, and keep alive
+	connect := appendMQTTString(nil, "MQTT")
+	connect = append(connect, 4, 0x02, 0, byte(mqttKeepAlive/time.Second))
+	connect = appendMQTTString(connect, clientID)
+	if u.User != nil {
+		connect[7] |= 0x80
+		connect = appendMQTTString(connect, u.User.Username())
+		if password, ok := u.User.Password(); ok {
+			connect[7] |= 0x40
+			connect = appendMQTTString(connect, password)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(appendMQTTPacket(nil, mqttConnect, connect)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	header, body, err := readMQTTPacket(reader)
+	if err == nil && (header != mqttConnack || len(body) != 2) {
+		err = errors.New("unexpected reply to CONNECT")
+	}
+	if err == nil && body[1] != 0 {
+		err = errors.New("connection refused: " + mqttConnackErrors[body[1]])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &mqttConn{
+		conn:   conn,
+		writer: bufio.NewWriter(conn),
+		onAck:  onAck,
+		closed: make(chan struct{}),
+	}
+	go c.read(reader)
+
+	return c, nil
+}
+
+func (c *mqttConn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+func (c *mqttConn) read(reader *bufio.Reader) {
+	for {
+		header, body, err := readMQTTPacket(reader)
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		switch header {
+		case mqttPuback, mqttPubcomp:
+			if len(body) >= 2 {
+				c.onAck(binary.BigEndian.Uint16(body))
+			}
+		case mqttPubrec:
+			// Message is stored by broker, and is released to subscribers by PUBREL
+			if len(body) >= 2 {
+				c.write(appendMQTTPacket(nil, mqttPubrel, body[:2]), true)
+			}
+		}
+	}
+}
+
+// write writes packet, packets are buffered until there are enough of them or they are flushed
+func (c *mqttConn) write(packet []byte, flush bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return c.err
+	default:
+	}
+
+	c.writer.Write(packet)
+	if !flush && c.writer.Buffered() < 32<<10 {
+		return nil
+	}
+	if err := c.writer.Flush(); err != nil {
+		go c.close(err)
+		return err
+	}
+
+	return nil
+}
+
+// Flush sends buffered packets
+func (c *mqttConn) Flush() error {
+	return c.write(nil, true)
+}
+
+// Close disconnects gracefully
+func (c *mqttConn) Close() error {
+	c.write([]byte{0xe0, 0}, true)
+	c.close(errors.New("connection closed"))
+	return nil
+}
+
+// MQTTOutput publishes bodies of requests to MQTT broker, with topic rendered from template using URL path, method and
+// host of request, so HTTP telemetry can be bridged into MQTT pipelines. Responses are not published. With QoS 1 and 2
+// limited number of messages can wait for acknowledgement. Connection is re-established after it is lost, requests
+// written while there is no connection are dropped.
+type MQTTOutput struct {
+	sync.Mutex
+	address *url.URL
+	config  *MQTTOutputConfig
+
+	conn     *mqttConn
+	lastDial time.Time
+	// Semaphore of messages waiting for acknowledgement, and their packet IDs
+	pending    chan struct{}
+	inflightMu sync.Mutex
+	inflight   map[uint16]bool
+	packetID   uint16
+	done       chan struct{}
+	closed     bool
+}
+
+// NewMQTTOutput constructor for MQTTOutput, accepts address in `tcp://[user:password@]host[:port]` format
+func NewMQTTOutput(address string, config *MQTTOutputConfig) io.Writer {
+	u, err := parseMQTTAddress(address)
+	if err != nil {
+		log.Fatalln("output-mqtt error:", err)
+	}
+	if config.clientID == "" {
+		config.clientID = "gor-" + string(uuid()[:12])
+	}
+
+	o := &MQTTOutput{
+		address:  u,
+		config:   config,
+		pending:  make(chan struct{}, mqttMaxInflight),
+		inflight: make(map[uint16]bool),
+		done:     make(chan struct{}),
+	}
+
+	if o.conn, err = dialMQTT(u, config.clientID, o.acknowledged); err != nil {
+		log.Fatalln("output-mqtt error:", err)
+	}
+	o.lastDial = time.Now()
+
+	go func() {
+		ticker := time.NewTicker(KafkaOutputFrequency * time.Millisecond)
+		defer ticker.Stop()
+		lastPing := time.Now()
+
+		for {
+			select {
+			case <-ticker.C:
+				o.Lock()
+				if time.Since(lastPing) > mqttKeepAlive/2 {
+					lastPing = time.Now()
+					o.conn.write([]byte{mqttPingreq, 0}, false)
+				}
+				o.conn.Flush()
+				o.Unlock()
+			case <-o.done:
+				return
+			}
+		}
+	}()
+
+	return o
+}
+
+func (o *MQTTOutput) acknowledged(id uint16) {
+	o.inflightMu.Lock()
+	defer o.inflightMu.Unlock()
+
+	if o.inflight[id] {
+		delete(o.inflight, id)
+		<-o.pending
+	}
+}
+
+// releaseInflight releases messages of lost connection, which will not be acknowledged with clean session
+func (o *MQTTOutput) releaseInflight() {
+	o.inflightMu.Lock()
+	defer o.inflightMu.Unlock()
+
+	for id := range o.inflight {
+		delete(o.inflight, id)
+		<-o.pending
+	}
+}
+
+// connection returns current connection, or dials new one if it is closed, at most once a second. Should be called
+// under lock.
+func (o *MQTTOutput) connection() *mqttConn {
+	select {
+	case <-o.conn.closed:
+	default:
+		return o.conn
+	}
+
+	if time.Since(o.lastDial) < time.Second {
+		return nil
+	}
+	o.lastDial = time.Now()
+	log.Println("[MQTT-OUTPUT] connection error:", o.conn.err)
+
+	o.releaseInflight()
+	conn, err := dialMQTT(o.address, o.config.clientID, o.acknowledged)
+	if err != nil {
+		log.Println("[MQTT-OUTPUT] connection error:", err)
+		return nil
+	}
+	o.conn = conn
+
+	return conn
+}
+
+// mqttTopicValue removes wildcards from value inserted into topic
+var mqttTopicValue = strings.NewReplacer("+", "_", "#", "_")
+
+// topic renders topic template for request, path is given without query and leading and trailing slashes
+func (o *MQTTOutput) topic(req []byte) string {
+	path := proto.Path(req)
+	if i := bytes.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+
+	return strings.NewReplacer(
+		"{path}", mqttTopicValue.Replace(strings.Trim(string(path), "/")),
+		"{method}", mqttTopicValue.Replace(string(proto.Method(req))),
+		"{host}", mqttTopicValue.Replace(string(proto.Header(req, []byte("Host")))),
+	).Replace(o.config.topic)
+}
+
+func (o *MQTTOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
+
+	req := payloadBody(data)
+	topic := o.topic(req)
+	if topic == "" {
+		return len(data), nil
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return 0, errors.New("MQTT output is closed")
+	}
+
+	conn := o.connection()
+	if conn == nil {
+		return len(data), nil
+	}
+
+	publish := appendMQTTString(nil, topic)
+	if o.config.qos > 0 {
+		select {
+		case o.pending <- struct{}{}:
+		default:
+			// Buffered messages are sent, so their acknowledgements can free the room
+			conn.Flush()
+
+			select {
+			case o.pending <- struct{}{}:
+			case <-conn.closed:
+				return len(data), nil
+			case <-time.After(mqttInflightTimeout):
+				log.Println("[MQTT-OUTPUT] broker does not acknowledge messages, reconnecting")
+				conn.close(errors.New("acknowledgements timed out"))
+				return len(data), nil
+			}
+		}
+
+		o.inflightMu.Lock()
+		for o.packetID++; o.packetID == 0 || o.inflight[o.packetID]; o.packetID++ {
+		}
+		o.inflight[o.packetID] = true
+		o.inflightMu.Unlock()
+
+		var id [2]byte
+		binary.BigEndian.PutUint16(id[:], o.packetID)
+		publish = append(publish, id[:]...)
+	}
+	publish = append(publish, proto.Body(req)...)
+
+	conn.write(appendMQTTPacket(nil, mqttPublish|byte(o.config.qos)<<1, publish), false)
+
+	return len(data), nil
+}
+
+func (o *MQTTOutput) String() string {
+	return "MQTT output: " + o.address.Host + "/" + o.config.topic
+}
+
+// Close sends buffered messages and waits for their acknowledgements
+func (o *MQTTOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	close(o.done)
+	o.conn.Flush()
+
+	deadline := time.After(mqttInflightTimeout)
+wait:
+	for i := 0; i < mqttMaxInflight; i++ {
+		select {
+		case o.pending <- struct{}{}:
+		case <-o.conn.closed:
+			break wait
+		case <-deadline:
+			break wait
+		}
+	}
+
+	return o.conn.Close()
+}
@@ -0,0 +1,141 @@
+package goreplay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mqttMessage struct {
+	topic, payload string
+	qos            byte
+}
+
+// mqttBroker accepts connections of user:password and records published messages
+type mqttBroker struct {
+	net.Listener
+	mu       sync.Mutex
+	messages []mqttMessage
+	released int
+}
+
+func newMQTTBroker(t *testing.T) *mqttBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &mqttBroker{Listener: listener}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *mqttBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for {
+		header, body, err := readMQTTPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch header & 0xf0 {
+		case mqttConnect:
+			// Protocol name, level, flags, keep alive, client ID, user name and password
+			flags := body[7]
+			code := byte(4)
+			if flags&0xc0 == 0xc0 && string(body[len(body)-8:]) == "password" {
+				code = 0
+			}
+			conn.Write([]byte{mqttConnack, 2, 0, code})
+		case mqttPublish:
+			qos := (header >> 1) & 3
+			size := int(binary.BigEndian.Uint16(body))
+			msg := mqttMessage{topic: string(body[2 : 2+size]), qos: qos}
+			body = body[2+size:]
+			if qos > 0 {
+				conn.Write(appendMQTTPacket(nil, byte(0x40+0x10*(qos-1)), body[:2]))
+				body = body[2:]
+			}
+			msg.payload = string(body)
+
+			b.mu.Lock()
+			b.messages = append(b.messages, msg)
+			b.mu.Unlock()
+		case mqttPubrel & 0xf0:
+			b.mu.Lock()
+			b.released++
+			b.mu.Unlock()
+			conn.Write(appendMQTTPacket(nil, mqttPubcomp, body))
+		}
+	}
+}
+
+func TestMQTTOutput(t *testing.T) {
+	for qos := 0; qos <= 2; qos++ {
+		broker := newMQTTBroker(t)
+
+		output := NewMQTTOutput("tcp://user:password@"+broker.Addr().String(), &MQTTOutputConfig{topic: "gor/{method}/{path}", qos: qos}).(*MQTTOutput)
+		output.Write([]byte("1 1 1\nPOST /devices/42/temperature?unit=c HTTP/1.1\r\nHost: api\r\nContent-Length: 4\r\n\r\n21.5"))
+		output.Write([]byte("2 1 1\nHTTP/1.1 200 OK\r\n\r\n"))
+		output.Write([]byte("1 2 1\nPOST /devices/+/# HTTP/1.1\r\n\r\n{}"))
+		output.Close()
+
+		// QoS 0 messages are not acknowledged, so they can still be read by broker
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			broker.mu.Lock()
+			n := len(broker.messages)
+			broker.mu.Unlock()
+			if n >= 2 {
+				break
+			}
+		}
+
+		broker.mu.Lock()
+		expected := []mqttMessage{
+			{"gor/POST/devices/42/temperature", "21.5", byte(qos)},
+			{"gor/POST/devices/_/_", "{}", byte(qos)},
+		}
+		if len(broker.messages) != len(expected) {
+			t.Fatalf("QoS %d: expected %d messages, got %v", qos, len(expected), broker.messages)
+		}
+		for i, msg := range expected {
+			if broker.messages[i] != msg {
+				t.Errorf("QoS %d: expected %v, got %v", qos, msg, broker.messages[i])
+			}
+		}
+		if qos == 2 && broker.released != len(expected) {
+			t.Errorf("Expected %d released messages, got %d", len(expected), broker.released)
+		}
+		broker.mu.Unlock()
+
+		if len(output.pending) != mqttMaxInflight {
+			t.Errorf("QoS %d: messages are not acknowledged", qos)
+		}
+
+		broker.Close()
+	}
+}
+
+func TestMQTTAuthentication(t *testing.T) {
+	broker := newMQTTBroker(t)
+	defer broker.Close()
+
+	u, _ := parseMQTTAddress("user:wrong@" + broker.Addr().String())
+	if _, err := dialMQTT(u, "gor", nil); err == nil || err.Error() != "connection refused: bad user name or password" {
+		t.Error("Expected authentication error, got", err)
+	}
+}
@@ -0,0 +1,102 @@
+package goreplay
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/mysql"
+)
+
+// startMySQLServer accepts clients without password, and answers queries with OK packet. Queries are sent to channel
+// together with number of connection.
+func startMySQLServer(t *testing.T, queries chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := []byte("\x00\x00\x00\x02\x00\x00\x00")
+	greeting := "\x0a8.0.36\x00\x01\x00\x00\x00abcdefgh\x00\xff\xff\x2d\x02\x00\xff\xff\x15" +
+		"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00ijklmnopqrst\x00mysql_native_password\x00"
+
+	go func() {
+		for n := 1; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn, n int) {
+				defer conn.Close()
+
+				conn.Write(mysql.AppendPacket(nil, 0, []byte(greeting)))
+				mysql.ReadPacket(conn)
+				conn.Write(mysql.AppendPacket(nil, 2, ok))
+
+				for {
+					p, _, err := mysql.ReadPacket(conn)
+					if err != nil || p[0] == mysql.ComQuit {
+						return
+					}
+
+					queries <- string('0'+rune(n)) + " " + string(p[1:])
+					conn.Write(mysql.AppendPacket(nil, 1, ok))
+				}
+			}(conn, n)
+		}
+	}()
+
+	return ln
+}
+
+func mysqlQuery(connection, sql string) []byte {
+	text, _ := (&mysql.Command{Type: mysql.CommandQuery, Connection: connection, SQL: sql}).MarshalText()
+	return append(payloadHeader(RequestPayload, uuid(), 1, -1), text...)
+}
+
+func TestMySQLOutput(t *testing.T) {
+	queries := make(chan string, 10)
+	ln := startMySQLServer(t, queries)
+	defer ln.Close()
+
+	output := NewMySQLOutput("app@"+ln.Addr().String(), &MySQLOutputConfig{Workers: 1, TrackResponses: true, Timeout: time.Second})
+	defer output.(*MySQLOutput).Close()
+
+	// Only requests are replayed
+	output.Write(append(payloadHeader(ResponsePayload, uuid(), 1, 1), "\x07\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00"...))
+
+	// Each captured connection is replayed using separate connection
+	output.Write(mysqlQuery("10.0.0.1:5000", "SELECT 1"))
+	output.Write(mysqlQuery("10.0.0.2:5000", "SELECT 2"))
+	output.Write(mysqlQuery("10.0.0.1:5000", "SELECT 3"))
+
+	for _, expected := range []string{"1 SELECT 1", "2 SELECT 2", "1 SELECT 3"} {
+		if q := <-queries; q != expected {
+			t.Errorf("Expected %q, got %q", expected, q)
+		}
+	}
+
+	buf := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		n, _ := output.(*MySQLOutput).Read(buf)
+		if buf[0] != ReplayedResponsePayload || string(payloadBody(buf[:n])) != "\x07\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00" {
+			t.Errorf("Wrong replayed response: %q", buf[:n])
+		}
+	}
+}
+
+func TestParseMySQLAddress(t *testing.T) {
+	address, config, err := parseMySQLAddress("app:p@ss:w@rd@db.local/shop")
+	if err != nil || address != "db.local:3306" || config.User != "app" || config.Password != "p@ss:w@rd" || config.Schema != "shop" {
+		t.Error("Wrong address", address, config, err)
+	}
+
+	if address, config, _ = parseMySQLAddress("[::1]:3307"); address != "[::1]:3307" || config.User != "" {
+		t.Error("Wrong address", address, config)
+	}
+
+	if _, _, err = parseMySQLAddress("app@/shop"); err == nil {
+		t.Error("Should require host")
+	}
+}
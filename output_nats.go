@@ -0,0 +1,175 @@
+package goreplay
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// NATSOutput publishes payloads to NATS subject in Gor format. With JetStream, publishing is acknowledged by stream
+// capturing the subject, and limited number of payloads can wait for acknowledgement. Connection is re-established
+// after it is lost, payloads written while there is no connection are dropped.
+type NATSOutput struct {
+	sync.Mutex
+	address *url.URL
+	subject string
+	config  *NATSConfig
+
+	conn     *natsConn
+	lastDial time.Time
+	// Semaphore of payloads waiting for JetStream acknowledgement
+	pending chan struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+// NewNATSOutput constructor for NATSOutput, accepts address in `nats://[user:password@]host[:port]/subject` format
+func NewNATSOutput(address string, config *NATSConfig) io.Writer {
+	u, subject, err := parseNATSAddress(address)
+	if err != nil {
+		log.Fatalln("output-nats error:", err)
+	}
+
+	o := &NATSOutput{
+		address: u,
+		subject: subject,
+		config:  config,
+		pending: make(chan struct{}, natsMaxPending),
+		done:    make(chan struct{}),
+	}
+
+	if o.conn, err = dialNATS(u); err != nil {
+		log.Fatalln("output-nats error:", err)
+	}
+	o.lastDial = time.Now()
+
+	go func() {
+		ticker := time.NewTicker(KafkaOutputFrequency * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				o.Lock()
+				o.conn.Flush()
+				o.Unlock()
+			case <-o.done:
+				return
+			}
+		}
+	}()
+
+	return o
+}
+
+// connection returns current connection, or dials new one if it is closed, at most once a second. Should be called
+// under lock.
+func (o *NATSOutput) connection() *natsConn {
+	select {
+	case <-o.conn.closed:
+	default:
+		return o.conn
+	}
+
+	if time.Since(o.lastDial) < time.Second {
+		return nil
+	}
+	o.lastDial = time.Now()
+
+	conn, err := dialNATS(o.address)
+	if err != nil {
+		log.Println("[NATS-OUTPUT] connection error:", err)
+		return nil
+	}
+	o.conn = conn
+
+	return conn
+}
+
+func (o *NATSOutput) Write(data []byte) (n int, err error) {
+	if o.config.redactor != nil {
+		data = o.config.redactor.Redact(data)
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return 0, errors.New("NATS output is closed")
+	}
+
+	conn := o.connection()
+	if conn == nil {
+		return len(data), nil
+	}
+
+	if !o.config.jetStream {
+		conn.publish(o.subject, "", data)
+		return len(data), nil
+	}
+
+	select {
+	case o.pending <- struct{}{}:
+	default:
+		// Buffered payloads are sent, so their acknowledgements can free the room
+		conn.Flush()
+		o.pending <- struct{}{}
+	}
+
+	var once sync.Once
+	release := func(reply string) {
+		once.Do(func() {
+			conn.cancelInbox(reply)
+			<-o.pending
+		})
+	}
+
+	reply := conn.newInbox(func(msg natsMsg) {
+		defer release(msg.subject)
+
+		if msg.status == "503" {
+			log.Println("[NATS-OUTPUT] no JetStream stream captures subject", o.subject)
+			return
+		}
+		var ack natsAPIError
+		json.Unmarshal(msg.data, &ack)
+		if err := ack.err(); err != nil {
+			log.Println("[NATS-OUTPUT] publish error:", err)
+		}
+	})
+	if err := conn.publish(o.subject, reply, data); err != nil {
+		release(reply)
+		return len(data), nil
+	}
+	time.AfterFunc(natsAckTimeout, func() { release(reply) })
+
+	return len(data), nil
+}
+
+func (o *NATSOutput) String() string {
+	return "NATS output: " + o.address.Host + "/" + o.subject
+}
+
+// Close sends buffered payloads and waits for their acknowledgements
+func (o *NATSOutput) Close() error {
+	o.Lock()
+	if o.closed {
+		o.Unlock()
+		return nil
+	}
+	o.closed = true
+	close(o.done)
+	o.conn.Flush()
+	o.Unlock()
+
+	// Pending acknowledgements are released after timeout at the latest
+	for i := 0; i < natsMaxPending; i++ {
+		o.pending <- struct{}{}
+	}
+
+	return o.conn.Close()
+}
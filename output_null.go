@@ -1,18 +1,145 @@
-package main
+package goreplay
 
-// NullOutput used for debugging, prints nothing
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// NullOutputConfig null output configuration
+type NullOutputConfig struct {
+	// Interval of reporting stats, they are reported only when output is closed if zero
+	statsInterval time.Duration
+}
+
+// NullOutput drops all payloads, which pass filters, rewriting and middleware, and counts them. It is used to benchmark
+// inputs, and to check filters against production traffic without replaying it.
 type NullOutput struct {
+	config *NullOutputConfig
+	start  time.Time
+	done   chan struct{}
+
+	mu        sync.Mutex
+	requests  int
+	responses int
+	replayed  int
+	bytes     int
+	methods   map[string]int
+	statuses  map[string]int
 }
 
 // NewNullOutput constructor for NullOutput
-func NewNullOutput() (o *NullOutput) {
-	return new(NullOutput)
+func NewNullOutput(config *NullOutputConfig) (o *NullOutput) {
+	o = &NullOutput{
+		config:   config,
+		start:    time.Now(),
+		done:     make(chan struct{}),
+		methods:  make(map[string]int),
+		statuses: make(map[string]int),
+	}
+
+	if config.statsInterval > 0 {
+		go o.reportStats()
+	}
+
+	return
 }
 
 func (o *NullOutput) Write(data []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.bytes += len(data)
+
+	// Following chunks are counted only by size
+	if index, _, _ := payloadChunk(data); index > 0 {
+		return len(data), nil
+	}
+
+	body := payloadBody(data)
+	switch data[0] {
+	case RequestPayload:
+		o.requests++
+		if proto.IsHTTPPayload(body) {
+			o.methods[string(proto.Method(body))]++
+		}
+	case ResponsePayload:
+		o.responses++
+		if status := proto.Status(body); len(status) > 0 {
+			o.statuses[string(status)]++
+		}
+	case ReplayedResponsePayload:
+		o.replayed++
+	}
+
 	return len(data), nil
 }
 
+func (o *NullOutput) reportStats() {
+	ticker := time.NewTicker(o.config.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			log.Println(o.stats())
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// stats returns counts of payloads since start, with counts of HTTP methods of requests and statuses of responses
+func (o *NullOutput) stats() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	elapsed := time.Since(o.start).Seconds()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[NULL-OUTPUT] %d requests (%.1f/s), %d responses, %d replayed responses, %d bytes, %d requests filtered",
+		o.requests, float64(o.requests)/elapsed, o.responses, o.replayed, o.bytes, atomic.LoadInt64(&filteredRequestsCount))
+	writeCounts(&b, "methods", o.methods)
+	writeCounts(&b, "statuses", o.statuses)
+
+	return b.String()
+}
+
+func writeCounts(b *strings.Builder, title string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b.WriteString(", " + title + ":")
+	for _, k := range keys {
+		fmt.Fprintf(b, " %s=%d", k, counts[k])
+	}
+}
+
 func (o *NullOutput) String() string {
 	return "Null Output"
 }
+
+// Close reports stats of all dropped payloads
+func (o *NullOutput) Close() error {
+	select {
+	case <-o.done:
+	default:
+		close(o.done)
+		log.Println(o.stats())
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package goreplay
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNullOutputStats(t *testing.T) {
+	output := NewNullOutput(&NullOutputConfig{})
+
+	output.Write(append(payloadHeader(RequestPayload, []byte("a1"), time.Now().UnixNano(), -1), []byte("GET / HTTP/1.1\r\n\r\n")...))
+	output.Write(append(payloadHeader(RequestPayload, []byte("a2"), time.Now().UnixNano(), -1), []byte("POST / HTTP/1.1\r\n\r\n")...))
+	// Following chunk is not counted as request
+	output.Write(append(payloadChunkHeader(payloadHeader(RequestPayload, []byte("a2"), time.Now().UnixNano(), -1), 1, false), []byte("body")...))
+	output.Write(append(payloadHeader(ResponsePayload, []byte("a1"), time.Now().UnixNano(), 1), []byte("HTTP/1.1 404 Not Found\r\n\r\n")...))
+	output.Write(append(payloadHeader(ReplayedResponsePayload, []byte("a1"), time.Now().UnixNano(), 1), []byte("HTTP/1.1 200 OK\r\n\r\n")...))
+
+	stats := output.stats()
+	for _, expected := range []string{"2 requests", "1 responses", "1 replayed responses", "methods: GET=1 POST=1", "statuses: 404=1"} {
+		if !strings.Contains(stats, expected) {
+			t.Errorf("Stats should contain %q: %s", expected, stats)
+		}
+	}
+
+	output.Close()
+	output.Close()
+}
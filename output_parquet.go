@@ -0,0 +1,453 @@
+package goreplay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// ParquetOutputConfig parquet output configuration
+type ParquetOutputConfig struct {
+	// Maximum number of rows in file. File is written earlier when flush interval passes, or hour of capture changes.
+	batchSize     int
+	flushInterval time.Duration
+	// Bodies are written to `body` column, only the first chunk of large messages
+	body bool
+}
+
+// ParquetOutput writes metadata of requests and responses to Parquet files, partitioned by hour of capture time, so
+// captured traffic can be queried by Athena, DuckDB or Spark:
+//
+//	<dir>/dt=2021-03-01/hour=22/<unix nano>.parquet
+//
+// Files are written to temporary name and renamed, so queries never read partial files.
+type ParquetOutput struct {
+	sync.Mutex
+	dir     string
+	config  *ParquetOutputConfig
+	columns []parquetColumn
+	rows    []payloadRecord
+	hour    time.Time
+	done    chan struct{}
+	closed  bool
+}
+
+// payloadRecord is metadata of request or response recorded by analytics outputs
+type payloadRecord struct {
+	payloadType string
+	id          string
+	timestamp   int64
+	latency     int64
+	clientAddr  string
+	method      string
+	url         string
+	host        string
+	status      int32
+	size        int64
+	body        []byte
+}
+
+// NewParquetOutput constructor for ParquetOutput, accepts directory
+func NewParquetOutput(dir string, config *ParquetOutputConfig) *ParquetOutput {
+	o := &ParquetOutput{
+		dir:    dir,
+		config: config,
+		done:   make(chan struct{}),
+	}
+
+	for _, c := range parquetColumns {
+		if c.name != "body" || config.body {
+			o.columns = append(o.columns, c)
+		}
+	}
+
+	if config.flushInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(config.flushInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					o.Lock()
+					o.flush()
+					o.Unlock()
+				case <-o.done:
+					return
+				}
+			}
+		}()
+	}
+
+	return o
+}
+
+func (o *ParquetOutput) Write(data []byte) (n int, err error) {
+	// Following chunks of large messages are not recorded
+	if index, _, _ := payloadChunk(data); index > 0 {
+		return len(data), nil
+	}
+
+	row := newPayloadRecord(data, o.config.body)
+	hour := time.Unix(0, row.timestamp).UTC().Truncate(time.Hour)
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return 0, errors.New("Parquet output is closed")
+	}
+
+	if len(o.rows) > 0 && !hour.Equal(o.hour) {
+		o.flush()
+	}
+	o.hour = hour
+	o.rows = append(o.rows, row)
+
+	if o.config.batchSize > 0 && len(o.rows) >= o.config.batchSize {
+		o.flush()
+	}
+
+	return len(data), nil
+}
+
+func newPayloadRecord(data []byte, withBody bool) (row payloadRecord) {
+	meta := payloadMeta(data)
+	body := payloadBody(data)
+
+	row.payloadType = filePayloadTypes[data[0]]
+	row.clientAddr = payloadClientAddr(data)
+	row.size = int64(len(body))
+	if len(meta) > 1 {
+		row.id = string(meta[1])
+	}
+	if len(meta) > 2 {
+		row.timestamp, _ = strconv.ParseInt(string(meta[2]), 10, 64)
+	}
+	if len(meta) > 3 && data[0] != RequestPayload {
+		row.latency, _ = strconv.ParseInt(string(meta[3]), 10, 64)
+	}
+
+	if data[0] == RequestPayload {
+		if proto.IsHTTPPayload(body) {
+			row.method, row.url = string(proto.Method(body)), string(proto.Path(body))
+			row.host = string(proto.Header(body, []byte("Host")))
+		}
+	} else if bytes.HasPrefix(body, []byte("HTTP/")) {
+		status, _ := strconv.Atoi(string(proto.Status(body)))
+		row.status = int32(status)
+	}
+
+	if withBody {
+		row.body = append([]byte(nil), body...)
+	}
+
+	return
+}
+
+// flush writes batch of rows to file of their hour. Should be called under lock.
+func (o *ParquetOutput) flush() {
+	if len(o.rows) == 0 {
+		return
+	}
+
+	name := filepath.Join(o.dir, o.hour.Format("dt=2006-01-02/hour=15"), fmt.Sprintf("%d.parquet", time.Now().UnixNano()))
+	if err := writeParquetFile(name, o.columns, o.rows); err != nil {
+		log.Println("[PARQUET-OUTPUT] error writing file:", err)
+	}
+
+	o.rows = o.rows[:0]
+}
+
+func writeParquetFile(name string, columns []parquetColumn, rows []payloadRecord) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := encodeParquet(&buf, columns, rows); err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+func (o *ParquetOutput) String() string {
+	return "Parquet output: " + o.dir
+}
+
+// Close writes remaining rows
+func (o *ParquetOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+
+	if !o.closed {
+		o.closed = true
+		close(o.done)
+		o.flush()
+	}
+
+	return nil
+}
+
+// Parquet physical and converted types, and codes of thrift compact protocol used by file metadata,
+// see https://github.com/apache/parquet-format
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+	parquetNoConverted     = -1
+
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+	parquetCodecGzip     = 2
+
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// parquetColumn is required column, written as single data page with plain encoding
+type parquetColumn struct {
+	name      string
+	typ       int32
+	converted int32
+	value     func(r *payloadRecord, b *bytes.Buffer)
+}
+
+func parquetString(v func(r *payloadRecord) string) func(*payloadRecord, *bytes.Buffer) {
+	return func(r *payloadRecord, b *bytes.Buffer) {
+		s := v(r)
+		binary.Write(b, binary.LittleEndian, uint32(len(s)))
+		b.WriteString(s)
+	}
+}
+
+func parquetInt(v func(r *payloadRecord) int64) func(*payloadRecord, *bytes.Buffer) {
+	return func(r *payloadRecord, b *bytes.Buffer) {
+		binary.Write(b, binary.LittleEndian, v(r))
+	}
+}
+
+var parquetColumns = []parquetColumn{
+	{"type", parquetByteArray, parquetUTF8, parquetString(func(r *payloadRecord) string { return r.payloadType })},
+	{"id", parquetByteArray, parquetUTF8, parquetString(func(r *payloadRecord) string { return r.id })},
+	{"timestamp", parquetInt64, parquetTimestampMicros, parquetInt(func(r *payloadRecord) int64 { return r.timestamp / 1000 })},
+	// Nanoseconds, zero for requests
+	{"latency", parquetInt64, parquetNoConverted, parquetInt(func(r *payloadRecord) int64 { return r.latency })},
+	{"client_addr", parquetByteArray, parquetUTF8, parquetString(func(r *payloadRecord) string { return r.clientAddr })},
+	{"method", parquetByteArray, parquetUTF8, parquetString(func(r *payloadRecord) string { return r.method })},
+	{"url", parquetByteArray, parquetUTF8, parquetString(func(r *payloadRecord) string { return r.url })},
+	{"host", parquetByteArray, parquetUTF8, parquetString(func(r *payloadRecord) string { return r.host })},
+	{"status", parquetInt32, parquetNoConverted, func(r *payloadRecord, b *bytes.Buffer) {
+		binary.Write(b, binary.LittleEndian, r.status)
+	}},
+	{"size", parquetInt64, parquetNoConverted, parquetInt(func(r *payloadRecord) int64 { return r.size })},
+	{"body", parquetByteArray, parquetNoConverted, parquetString(func(r *payloadRecord) string { return string(r.body) })},
+}
+
+// encodeParquet writes rows as Parquet file with single row group, columns are compressed by gzip
+func encodeParquet(buf *bytes.Buffer, columns []parquetColumn, rows []payloadRecord) error {
+	type chunkMeta struct {
+		offset             int64
+		uncompressed, size int64
+	}
+	chunks := make([]chunkMeta, len(columns))
+
+	buf.WriteString("PAR1")
+
+	var values, compressed bytes.Buffer
+	for i, c := range columns {
+		values.Reset()
+		for j := range rows {
+			c.value(&rows[j], &values)
+		}
+
+		compressed.Reset()
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(values.Bytes())
+		if err := gz.Close(); err != nil {
+			return err
+		}
+
+		h := newThriftWriter()
+		h.i32(1, 0) // DATA_PAGE
+		h.i32(2, int32(values.Len()))
+		h.i32(3, int32(compressed.Len()))
+		h.structBegin(5)
+		h.i32(1, int32(len(rows)))
+		h.i32(2, parquetEncodingPlain)
+		h.i32(3, parquetEncodingRLE)
+		h.i32(4, parquetEncodingRLE)
+		h.structEnd()
+		header := h.bytes()
+
+		chunks[i] = chunkMeta{
+			offset:       int64(buf.Len()),
+			uncompressed: int64(len(header) + values.Len()),
+			size:         int64(len(header) + compressed.Len()),
+		}
+		buf.Write(header)
+		buf.Write(compressed.Bytes())
+	}
+
+	var totalSize int64
+	for _, c := range chunks {
+		totalSize += c.uncompressed
+	}
+
+	m := newThriftWriter()
+	m.i32(1, 1)
+	m.listBegin(2, thriftStruct, len(columns)+1)
+	m.listStructBegin()
+	m.binary(4, "schema")
+	m.i32(5, int32(len(columns)))
+	m.structEnd()
+	for _, c := range columns {
+		m.listStructBegin()
+		m.i32(1, c.typ)
+		m.i32(3, 0) // REQUIRED
+		m.binary(4, c.name)
+		if c.converted != parquetNoConverted {
+			m.i32(6, c.converted)
+		}
+		m.structEnd()
+	}
+	m.i64(3, int64(len(rows)))
+	m.listBegin(4, thriftStruct, 1)
+	m.listStructBegin()
+	m.listBegin(1, thriftStruct, len(columns))
+	for i, c := range columns {
+		m.listStructBegin()
+		m.i64(2, chunks[i].offset)
+		m.structBegin(3)
+		m.i32(1, c.typ)
+		m.listBegin(2, thriftI32, 1)
+		m.listI32(parquetEncodingPlain)
+		m.listBegin(3, thriftBinary, 1)
+		m.listBinary(c.name)
+		m.i32(4, parquetCodecGzip)
+		m.i64(5, int64(len(rows)))
+		m.i64(6, chunks[i].uncompressed)
+		m.i64(7, chunks[i].size)
+		m.i64(9, chunks[i].offset)
+		m.structEnd()
+		m.structEnd()
+	}
+	m.i64(2, totalSize)
+	m.i64(3, int64(len(rows)))
+	m.structEnd()
+	m.binary(6, "gor version "+VERSION)
+	footer := m.bytes()
+
+	buf.Write(footer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(footer)))
+	buf.WriteString("PAR1")
+
+	return nil
+}
+
+// thriftWriter encodes structs using thrift compact protocol
+type thriftWriter struct {
+	buf bytes.Buffer
+	// IDs of the last written fields of nested structs
+	last []int
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{last: []int{0}}
+}
+
+func (w *thriftWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutUvarint(b[:], uint64(v<<1^v>>63))])
+}
+
+func (w *thriftWriter) fieldHeader(id int, typ byte) {
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta<<4) | typ)
+	} else {
+		w.buf.WriteByte(typ)
+		w.varint(int64(id))
+	}
+	*last = id
+}
+
+func (w *thriftWriter) i32(id int, v int32) {
+	w.fieldHeader(id, thriftI32)
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) i64(id int, v int64) {
+	w.fieldHeader(id, thriftI64)
+	w.varint(v)
+}
+
+func (w *thriftWriter) binary(id int, v string) {
+	w.fieldHeader(id, thriftBinary)
+	w.listBinary(v)
+}
+
+func (w *thriftWriter) structBegin(id int) {
+	w.fieldHeader(id, thriftStruct)
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) structEnd() {
+	w.buf.WriteByte(0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+func (w *thriftWriter) listBegin(id int, elemType byte, size int) {
+	w.fieldHeader(id, thriftList)
+	if size < 15 {
+		w.buf.WriteByte(byte(size<<4) | elemType)
+	} else {
+		w.buf.WriteByte(0xf0 | elemType)
+		var b [binary.MaxVarintLen64]byte
+		w.buf.Write(b[:binary.PutUvarint(b[:], uint64(size))])
+	}
+}
+
+// listStructBegin starts struct element of list, it is ended by structEnd
+func (w *thriftWriter) listStructBegin() {
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) listI32(v int32) {
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) listBinary(v string) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutUvarint(b[:], uint64(len(v)))])
+	w.buf.WriteString(v)
+}
+
+// bytes ends top level struct and returns encoded data
+func (w *thriftWriter) bytes() []byte {
+	w.buf.WriteByte(0)
+	return w.buf.Bytes()
+}
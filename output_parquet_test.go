@@ -0,0 +1,127 @@
+package goreplay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readThrift decodes struct encoded with thrift compact protocol to map of field IDs to values
+func readThrift(t *testing.T, b *bytes.Reader) map[int]interface{} {
+	fields := make(map[int]interface{})
+	id := 0
+	for {
+		header, _ := b.ReadByte()
+		if header == 0 {
+			return fields
+		}
+		if delta := int(header >> 4); delta != 0 {
+			id += delta
+		} else {
+			v, _ := binary.ReadVarint(b)
+			id = int(v)
+		}
+		fields[id] = readThriftValue(t, b, header&0xf)
+	}
+}
+
+func readThriftValue(t *testing.T, b *bytes.Reader, typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		v, _ := binary.ReadVarint(b)
+		return v
+	case thriftBinary:
+		size, _ := binary.ReadUvarint(b)
+		v := make([]byte, size)
+		b.Read(v)
+		return string(v)
+	case thriftList:
+		header, _ := b.ReadByte()
+		size := uint64(header >> 4)
+		if size == 15 {
+			size, _ = binary.ReadUvarint(b)
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = readThriftValue(t, b, header&0xf)
+		}
+		return list
+	case thriftStruct:
+		return readThrift(t, b)
+	}
+	t.Fatal("Unexpected thrift type", typ)
+	return nil
+}
+
+func TestParquetOutput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-parquet")
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2021, 3, 1, 22, 59, 0, 0, time.UTC).UnixNano()
+
+	output := NewParquetOutput(dir, &ParquetOutputConfig{batchSize: 100, body: true})
+	output.Write(append(payloadHeader(RequestPayload, []byte("a1"), start, -1), "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"...))
+	output.Write(append(payloadHeader(ResponsePayload, []byte("a1"), start+1000, 1000), "HTTP/1.1 404 Not Found\r\n\r\n"...))
+	// Next hour
+	output.Write(append(payloadHeader(RequestPayload, []byte("a2"), start+int64(time.Minute), -1), "POST /b HTTP/1.1\r\n\r\n"...))
+	output.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*"))
+	if len(files) != 2 {
+		t.Fatal("Expected file per hour, got", files)
+	}
+	if rel, _ := filepath.Rel(dir, files[0]); filepath.Dir(rel) != "dt=2021-03-01/hour=22" {
+		t.Error("Wrong partition:", rel)
+	}
+
+	data, _ := ioutil.ReadFile(files[0])
+	if !bytes.HasPrefix(data, []byte("PAR1")) || !bytes.HasSuffix(data, []byte("PAR1")) {
+		t.Fatal("Wrong magic")
+	}
+	size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	meta := readThrift(t, bytes.NewReader(data[len(data)-8-size:len(data)-8]))
+
+	if meta[3] != int64(2) {
+		t.Error("Expected 2 rows, got", meta[3])
+	}
+
+	schema := meta[2].([]interface{})
+	var names []string
+	for _, s := range schema[1:] {
+		names = append(names, s.(map[int]interface{})[4].(string))
+	}
+	columns := meta[4].([]interface{})[0].(map[int]interface{})[1].([]interface{})
+	if len(columns) != len(names) || names[6] != "url" || names[8] != "status" || names[10] != "body" {
+		t.Fatal("Wrong columns", names)
+	}
+
+	// Values of url and status columns
+	readColumn := func(i int) []byte {
+		chunk := columns[i].(map[int]interface{})[3].(map[int]interface{})
+		page := bytes.NewReader(data[chunk[9].(int64):])
+		header := readThrift(t, page)
+		compressed := make([]byte, header[3].(int64))
+		page.Read(compressed)
+		gz, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, _ := ioutil.ReadAll(gz)
+		if int64(len(values)) != header[2].(int64) {
+			t.Error("Wrong uncompressed size")
+		}
+		return values
+	}
+
+	if url := readColumn(6); !bytes.Equal(url, []byte("\x02\x00\x00\x00/a\x00\x00\x00\x00")) {
+		t.Errorf("Wrong url column %q", url)
+	}
+	if status := readColumn(8); !bytes.Equal(status, []byte("\x00\x00\x00\x00\x94\x01\x00\x00")) {
+		t.Errorf("Wrong status column %q", status)
+	}
+}
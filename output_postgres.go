@@ -0,0 +1,226 @@
+package goreplay
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/postgres"
+)
+
+// Connections not used for this time are closed, captured clients do not send Terminate through output
+const postgresIdleTimeout = time.Minute
+
+// PostgresOutputConfig holds configuration options for PostgreSQL output
+type PostgresOutputConfig struct {
+	Workers        int
+	Timeout        time.Duration
+	TrackResponses bool
+}
+
+// PostgresOutput replays captured PostgreSQL commands against another server, e.g. standby or staging cluster.
+// Commands of captured connection are replayed in order by the same worker, using separate connection.
+type PostgresOutput struct {
+	address    string
+	config     *PostgresOutputConfig
+	connConfig postgres.Config
+	queues     []chan []byte
+	responses  chan response
+	quit       chan struct{}
+}
+
+// NewPostgresOutput constructor for PostgresOutput. Accepts address in `user:password@host:port/database` format,
+// password, port and database are optional. If database is not specified, the one captured client connected to is used.
+func NewPostgresOutput(address string, config *PostgresOutputConfig) io.Writer {
+	o := new(PostgresOutput)
+
+	var err error
+	if o.address, o.connConfig, err = parsePostgresAddress(address); err != nil {
+		log.Fatalln("output-postgres error:", err)
+	}
+
+	o.config = config
+	o.responses = make(chan response, 1000)
+	o.quit = make(chan struct{})
+
+	if o.config.Workers <= 0 {
+		o.config.Workers = 10
+	}
+	if o.config.Timeout <= 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+	o.connConfig.Timeout = o.config.Timeout
+
+	for i := 0; i < o.config.Workers; i++ {
+		queue := make(chan []byte, 100)
+		o.queues = append(o.queues, queue)
+		go o.worker(queue)
+	}
+
+	return o
+}
+
+func parsePostgresAddress(address string) (string, postgres.Config, error) {
+	var config postgres.Config
+
+	if i := strings.LastIndex(address, "@"); i != -1 {
+		config.User = address[:i]
+		address = address[i+1:]
+
+		if j := strings.Index(config.User, ":"); j != -1 {
+			config.Password = config.User[j+1:]
+			config.User = config.User[:j]
+		}
+	}
+
+	if i := strings.Index(address, "/"); i != -1 {
+		config.Database = address[i+1:]
+		address = address[:i]
+	}
+
+	if address == "" {
+		return "", config, errors.New("host is not specified")
+	}
+
+	if config.User == "" {
+		return "", config, errors.New("user is not specified")
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "5432")
+	}
+
+	return address, config, nil
+}
+
+type postgresConn struct {
+	*postgres.Conn
+	lastUsed time.Time
+}
+
+func (o *PostgresOutput) worker(queue chan []byte) {
+	conns := make(map[string]*postgresConn)
+	lastExpire := time.Now()
+
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		var data []byte
+		select {
+		case <-o.quit:
+			return
+		case data = <-queue:
+		}
+
+		cmd := new(postgres.Command)
+		if err := cmd.UnmarshalText(payloadBody(data)); err != nil {
+			continue
+		}
+
+		start := time.Now()
+
+		if start.Sub(lastExpire) >= postgresIdleTimeout {
+			lastExpire = start
+			for id, conn := range conns {
+				if start.Sub(conn.lastUsed) >= postgresIdleTimeout {
+					conn.Close()
+					delete(conns, id)
+				}
+			}
+		}
+
+		conn, ok := conns[cmd.Connection]
+		if !ok {
+			// Database can't be changed by connected client, so it is chosen when connecting
+			config := o.connConfig
+			if config.Database == "" {
+				config.Database = cmd.Database
+			}
+
+			c, err := postgres.Dial(o.address, config)
+			if err != nil {
+				log.Println("PostgreSQL output: can't connect to", o.address, err)
+				continue
+			}
+
+			conn = &postgresConn{Conn: c}
+			conns[cmd.Connection] = conn
+		}
+		conn.lastUsed = start
+
+		resp, err := conn.Exec(cmd)
+		if err != nil {
+			log.Println("PostgreSQL output: error replaying command", err)
+			conn.Close()
+			delete(conns, cmd.Connection)
+			continue
+		}
+
+		if !o.config.TrackResponses {
+			continue
+		}
+
+		stop := time.Now()
+		o.responses <- response{resp, payloadMeta(data)[1], start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+	}
+}
+
+func (o *PostgresOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
+
+	// Commands larger than copy buffer are skipped by input
+	if _, _, chunked := payloadChunk(data); chunked {
+		return len(data), nil
+	}
+
+	cmd := new(postgres.Command)
+	if err := cmd.UnmarshalText(payloadBody(data)); err != nil {
+		return len(data), nil
+	}
+
+	// We have to copy, because sending data in multiple threads
+	newBuf := make([]byte, len(data))
+	copy(newBuf, data)
+
+	h := fnv.New32a()
+	h.Write([]byte(cmd.Connection))
+	o.queues[h.Sum32()%uint32(len(o.queues))] <- newBuf
+
+	return len(data), nil
+}
+
+func (o *PostgresOutput) Read(data []byte) (int, error) {
+	var resp response
+	select {
+	case <-o.quit:
+		return 0, io.EOF
+	case resp = <-o.responses:
+	}
+
+	header := payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	copy(data[0:len(header)], header)
+	copy(data[len(header):], resp.payload)
+
+	return len(resp.payload) + len(header), nil
+}
+
+func (o *PostgresOutput) String() string {
+	return fmt.Sprintf("PostgreSQL output %s", o.address)
+}
+
+// Close stops workers, and closes their connections
+func (o *PostgresOutput) Close() error {
+	close(o.quit)
+	return nil
+}
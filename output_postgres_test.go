@@ -0,0 +1,137 @@
+package goreplay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/postgres"
+)
+
+// startPostgresServer accepts clients without password, and answers queries with CommandComplete. Queries are sent
+// to channel together with database of connection.
+func startPostgresServer(t *testing.T, queries chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := postgres.AppendMessage(nil, 'Z', []byte("I"))
+	result := append(postgres.AppendMessage(nil, 'C', []byte("SELECT 1\x00")), ready...)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				header := make([]byte, 4)
+				io.ReadFull(r, header)
+				startup := make([]byte, binary.BigEndian.Uint32(header)-4)
+				io.ReadFull(r, startup)
+
+				params := strings.Split(string(startup[4:]), "\x00")
+				database := ""
+				for i := 0; i+1 < len(params); i += 2 {
+					if params[i] == "database" {
+						database = params[i+1]
+					}
+				}
+
+				conn.Write(append(postgres.AppendMessage(nil, 'R', []byte{0, 0, 0, 0}), ready...))
+
+				for {
+					header := make([]byte, 5)
+					if _, err := io.ReadFull(r, header); err != nil || header[0] == 'X' {
+						return
+					}
+					msg := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+					io.ReadFull(r, msg)
+
+					queries <- database + " " + strings.TrimSuffix(string(msg), "\x00")
+					conn.Write(result)
+				}
+			}(conn)
+		}
+	}()
+
+	return ln
+}
+
+func postgresQuery(connection, database, sql string) []byte {
+	text, _ := (&postgres.Command{Type: postgres.CommandQuery, Connection: connection, Database: database, SQL: sql}).MarshalText()
+	return append(payloadHeader(RequestPayload, uuid(), 1, -1), text...)
+}
+
+func TestPostgresOutput(t *testing.T) {
+	queries := make(chan string, 10)
+	ln := startPostgresServer(t, queries)
+	defer ln.Close()
+
+	output := NewPostgresOutput("app@"+ln.Addr().String(), &PostgresOutputConfig{Workers: 1, TrackResponses: true, Timeout: time.Second})
+	defer output.(*PostgresOutput).Close()
+
+	// Only requests are replayed
+	output.Write(append(payloadHeader(ResponsePayload, uuid(), 1, 1), "Z\x00\x00\x00\x05I"...))
+
+	// Each captured connection is replayed using separate connection to its database
+	output.Write(postgresQuery("10.0.0.1:5000", "shop", "SELECT 1"))
+	output.Write(postgresQuery("10.0.0.2:5000", "billing", "SELECT 2"))
+	output.Write(postgresQuery("10.0.0.1:5000", "shop", "SELECT 3"))
+
+	for _, expected := range []string{"shop SELECT 1", "billing SELECT 2", "shop SELECT 3"} {
+		if q := <-queries; q != expected {
+			t.Errorf("Expected %q, got %q", expected, q)
+		}
+	}
+
+	buf := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		n, _ := output.(*PostgresOutput).Read(buf)
+		if buf[0] != ReplayedResponsePayload || string(payloadBody(buf[:n])) != "C\x00\x00\x00\x0dSELECT 1\x00Z\x00\x00\x00\x05I" {
+			t.Errorf("Wrong replayed response: %q", buf[:n])
+		}
+	}
+}
+
+func TestPostgresOutputDatabase(t *testing.T) {
+	queries := make(chan string, 10)
+	ln := startPostgresServer(t, queries)
+	defer ln.Close()
+
+	output := NewPostgresOutput("app@"+ln.Addr().String()+"/staging", &PostgresOutputConfig{Workers: 1, Timeout: time.Second})
+	defer output.(*PostgresOutput).Close()
+
+	output.Write(postgresQuery("10.0.0.1:5000", "shop", "SELECT 1"))
+	if q := <-queries; q != "staging SELECT 1" {
+		t.Errorf("Database from address should be used: %q", q)
+	}
+}
+
+func TestParsePostgresAddress(t *testing.T) {
+	address, config, err := parsePostgresAddress("app:p@ss:w@rd@db.local/shop")
+	if err != nil || address != "db.local:5432" || config.User != "app" || config.Password != "p@ss:w@rd" || config.Database != "shop" {
+		t.Error("Wrong address", address, config, err)
+	}
+
+	if address, config, _ = parsePostgresAddress("app@[::1]:5433"); address != "[::1]:5433" || config.Database != "" {
+		t.Error("Wrong address", address, config)
+	}
+
+	if _, _, err = parsePostgresAddress("app@/shop"); err == nil {
+		t.Error("Should require host")
+	}
+
+	if _, _, err = parsePostgresAddress("db.local"); err == nil {
+		t.Error("Should require user")
+	}
+}
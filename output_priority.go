@@ -0,0 +1,97 @@
+package goreplay
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// outputPriority tells which outputs lose traffic first when they can't keep up, or memory budget is exceeded.
+// Priority is given after "|" in output address, like limit: `--output-http "analytics.local|best-effort"`.
+type outputPriority int
+
+const (
+	// Normal outputs slow down reading of inputs when they can't keep up
+	priorityNormal outputPriority = iota
+	// Critical outputs never drop payloads, and are not shed by memory budget
+	priorityCritical
+	// Best-effort outputs drop payloads when their queue is full, and are shed first by memory budget
+	priorityBestEffort
+)
+
+var priorityNames = [...]string{
+	priorityNormal:     "normal",
+	priorityCritical:   "critical",
+	priorityBestEffort: "best-effort",
+}
+
+func (p outputPriority) String() string {
+	return priorityNames[p]
+}
+
+// Queue of best-effort output, when --output-dispatch-queue is not set
+const bestEffortQueue = 1000
+
+// droppedPayloads counts payloads dropped by outputs of each priority, because queue was full or output was shed
+var droppedPayloads [len(priorityNames)]uint64
+
+// extractPriorityOption removes priority from plugin options, which can be given after "|" together with limit
+func extractPriorityOption(options string) (string, outputPriority) {
+	priority := priorityNormal
+
+	split := strings.Split(options, "|")
+	rest := split[:1]
+	for _, option := range split[1:] {
+		switch option {
+		case priorityCritical.String():
+			priority = priorityCritical
+		case priorityBestEffort.String():
+			priority = priorityBestEffort
+		case priorityNormal.String():
+		default:
+			rest = append(rest, option)
+		}
+	}
+
+	return strings.Join(rest, "|"), priority
+}
+
+// outputPriority returns priority of output with given index
+func (plugins *InOutPlugins) outputPriority(index int) outputPriority {
+	if index < len(plugins.priorities) {
+		return plugins.priorities[index]
+	}
+	return priorityNormal
+}
+
+// shedOrder returns indexes of outputs in order they are shed by memory budget: best-effort and then normal outputs,
+// given last on command line first. Critical outputs are never shed. If there are no critical outputs, the first
+// output is not shed either, so some output still gets traffic.
+func (plugins *InOutPlugins) shedOrder() (order []int) {
+	keepFirst := true
+	for i := range plugins.Outputs {
+		if plugins.outputPriority(i) == priorityCritical {
+			keepFirst = false
+		}
+	}
+
+	for _, priority := range []outputPriority{priorityBestEffort, priorityNormal} {
+		for i := len(plugins.Outputs) - 1; i >= 0; i-- {
+			if plugins.outputPriority(i) == priority && !(keepFirst && i == 0) {
+				order = append(order, i)
+			}
+		}
+	}
+
+	return
+}
+
+// writePriorityMetrics writes counters of dropped payloads in Prometheus text format
+func writePriorityMetrics(out io.Writer) {
+	fmt.Fprintln(out, "# HELP gor_output_dropped_total Payloads dropped by outputs because they could not keep up, or were shed, by priority.")
+	fmt.Fprintln(out, "# TYPE gor_output_dropped_total counter")
+	for p, name := range priorityNames {
+		fmt.Fprintf(out, "gor_output_dropped_total{priority=%q} %d\n", name, atomic.LoadUint64(&droppedPayloads[p]))
+	}
+}
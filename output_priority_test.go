@@ -0,0 +1,59 @@
+package goreplay
+
+import (
+	"io"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestOutputPriority(t *testing.T) {
+	plugins := NewPlugins()
+	plugins.RegisterPlugin(NewTestInput)
+	plugins.RegisterPlugin(NewFileOutput, "/dev/null|critical", &FileOutputConfig{})
+	plugins.RegisterPlugin(NewDummyOutput)
+	plugins.RegisterPlugin(NewHTTPOutput, "www.example.com|10%|best-effort", &HTTPOutputConfig{})
+
+	if _, ok := plugins.Outputs[2].(*Limiter); !ok {
+		t.Error("Limit should be applied together with priority")
+	}
+
+	priorities := []outputPriority{plugins.outputPriority(0), plugins.outputPriority(1), plugins.outputPriority(2)}
+	if !reflect.DeepEqual(priorities, []outputPriority{priorityCritical, priorityNormal, priorityBestEffort}) {
+		t.Errorf("Wrong priorities %v", priorities)
+	}
+
+	if order := plugins.shedOrder(); !reflect.DeepEqual(order, []int{2, 1}) {
+		t.Errorf("Best-effort output should be shed first, and critical never, got %v", order)
+	}
+
+	// Without critical outputs the first one keeps traffic
+	plugins = &InOutPlugins{Outputs: []io.Writer{nil, nil, nil}}
+	if order := plugins.shedOrder(); !reflect.DeepEqual(order, []int{2, 1}) {
+		t.Errorf("The first output should not be shed, got %v", order)
+	}
+}
+
+func TestOutputDispatcherBestEffort(t *testing.T) {
+	unblock := make(chan struct{})
+	output := NewTestOutput(func(data []byte) {
+		<-unblock
+	})
+
+	d := newOutputDispatcher(output, 10, priorityBestEffort)
+	dropped := atomic.LoadUint64(&droppedPayloads[priorityBestEffort])
+
+	// Payloads which don't fit into queue are dropped instead of blocking
+	for i := 0; i < 100; i++ {
+		if _, err := d.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadUint64(&droppedPayloads[priorityBestEffort]) - dropped; n < 89 {
+		t.Errorf("Expected payloads to be dropped, got %d", n)
+	}
+
+	close(unblock)
+	d.Close()
+}
@@ -0,0 +1,161 @@
+package goreplay
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publish request can have up to 1000 messages and 10MB of data
+const (
+	pubsubMaxBatchSize  = 1000
+	pubsubMaxBatchBytes = 9 << 20
+)
+
+// PubSubOutput publishes payloads to Google Cloud Pub/Sub topic in Gor format, in batches.
+type PubSubOutput struct {
+	sync.Mutex
+	topic  string
+	config *PubSubConfig
+	client *pubsubClient
+
+	batch      []pubsubMessage
+	batchBytes int
+	sessions   payloadSessions
+	batches    chan []pubsubMessage
+	done       chan struct{}
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// NewPubSubOutput constructor for PubSubOutput, accepts topic in `projects/<project>/topics/<topic>` format
+func NewPubSubOutput(topic string, config *PubSubConfig) io.Writer {
+	if !strings.HasPrefix(topic, "projects/") || !strings.Contains(topic, "/topics/") {
+		log.Fatalln("output-pubsub error: topic should be in projects/<project>/topics/<topic> format, got", topic)
+	}
+
+	client, err := newPubSubClient(config)
+	if err != nil {
+		log.Fatalln("output-pubsub error:", err)
+	}
+
+	if config.batchSize <= 0 || config.batchSize > pubsubMaxBatchSize {
+		config.batchSize = pubsubMaxBatchSize
+	}
+
+	o := &PubSubOutput{
+		topic:   topic,
+		config:  config,
+		client:  client,
+		batches: make(chan []pubsubMessage, 10),
+		done:    make(chan struct{}),
+	}
+
+	o.wg.Add(1)
+	go o.publisher()
+
+	if config.flushInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(config.flushInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					o.Lock()
+					o.flush()
+					o.Unlock()
+				case <-o.done:
+					return
+				}
+			}
+		}()
+	}
+
+	return o
+}
+
+func (o *PubSubOutput) Write(data []byte) (n int, err error) {
+	if o.config.redactor != nil {
+		data = o.config.redactor.Redact(data)
+	}
+
+	msg := pubsubMessage{
+		Data: append([]byte(nil), data...),
+		Attributes: map[string]string{
+			"type": filePayloadTypes[data[0]],
+			"id":   string(payloadMeta(data)[1]),
+		},
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return 0, errors.New("Pub/Sub output is closed")
+	}
+
+	if o.config.ordering {
+		msg.OrderingKey = o.sessions.key(data)
+	}
+
+	if o.batchBytes+len(data) > pubsubMaxBatchBytes {
+		o.flush()
+	}
+	o.batch = append(o.batch, msg)
+	o.batchBytes += len(data)
+
+	if len(o.batch) >= o.config.batchSize {
+		o.flush()
+	}
+
+	return len(data), nil
+}
+
+// flush passes batch to publisher. Should be called under lock.
+func (o *PubSubOutput) flush() {
+	if len(o.batch) == 0 {
+		return
+	}
+
+	o.batches <- o.batch
+	o.batch = nil
+	o.batchBytes = 0
+}
+
+func (o *PubSubOutput) publisher() {
+	defer o.wg.Done()
+
+	for batch := range o.batches {
+		request := struct {
+			Messages []pubsubMessage `json:"messages"`
+		}{batch}
+
+		if err := o.client.call(o.topic+":publish", &request, nil); err != nil {
+			log.Println("[PUBSUB-OUTPUT] publish error:", err)
+		}
+	}
+}
+
+func (o *PubSubOutput) String() string {
+	return "Pub/Sub output: " + o.topic
+}
+
+// Close publishes remaining messages and waits for pending publish requests
+func (o *PubSubOutput) Close() error {
+	o.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.done)
+		o.flush()
+		close(o.batches)
+	}
+	o.Unlock()
+
+	o.wg.Wait()
+
+	return nil
+}
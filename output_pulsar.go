@@ -0,0 +1,231 @@
+package goreplay
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Receipts of published messages are awaited for this time, and this many messages can wait for them
+const (
+	pulsarSendTimeout = 5 * time.Second
+	pulsarMaxPending  = 1024
+)
+
+type pulsarProducerMessage struct {
+	Payload []byte `json:"payload"`
+	Key     string `json:"key,omitempty"`
+	Context string `json:"context"`
+}
+
+// PulsarOutput publishes payloads to Apache Pulsar topic in Gor format, using WebSocket API of broker. Message key is
+// session of payload, so payloads of the same captured connection are consumed in order by single consumer of
+// Key_Shared subscription. Limited number of messages can wait for receipt of broker. Connection is re-established
+// after it is lost, payloads written while there is no connection are dropped.
+type PulsarOutput struct {
+	sync.Mutex
+	address *url.URL
+	topic   string
+	config  *PulsarConfig
+
+	conn     *pulsarConn
+	lastDial time.Time
+	sessions payloadSessions
+	// Semaphore of messages waiting for receipt, and their contexts
+	pending   chan struct{}
+	pendingMu sync.Mutex
+	contexts  map[string]bool
+	seq       int
+	done      chan struct{}
+	closed    bool
+}
+
+// NewPulsarOutput constructor for PulsarOutput, accepts address in `ws://host[:port]/[persistent/]tenant/namespace/topic`
+// format
+func NewPulsarOutput(address string, config *PulsarConfig) io.Writer {
+	u, topic, err := parsePulsarAddress(address)
+	if err != nil {
+		log.Fatalln("output-pulsar error:", err)
+	}
+
+	o := &PulsarOutput{
+		address:  u,
+		topic:    topic,
+		config:   config,
+		pending:  make(chan struct{}, pulsarMaxPending),
+		contexts: make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+
+	if o.conn, err = o.connect(); err != nil {
+		log.Fatalln("output-pulsar error:", err)
+	}
+	o.lastDial = time.Now()
+
+	go func() {
+		ticker := time.NewTicker(KafkaOutputFrequency * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				o.Lock()
+				o.conn.Flush()
+				o.Unlock()
+			case <-o.done:
+				return
+			}
+		}
+	}()
+
+	return o
+}
+
+func (o *PulsarOutput) connect() (*pulsarConn, error) {
+	return dialPulsar(o.address, "producer/"+o.topic, nil, o.config.token, o.received)
+}
+
+// received handles receipt of published message
+func (o *PulsarOutput) received(data []byte) {
+	var receipt struct {
+		Result   string `json:"result"`
+		ErrorMsg string `json:"errorMsg"`
+		Context  string `json:"context"`
+	}
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		return
+	}
+	if receipt.Result != "ok" {
+		log.Println("[PULSAR-OUTPUT] send error:", receipt.Result, receipt.ErrorMsg)
+	}
+
+	o.pendingMu.Lock()
+	defer o.pendingMu.Unlock()
+
+	if o.contexts[receipt.Context] {
+		delete(o.contexts, receipt.Context)
+		<-o.pending
+	}
+}
+
+// releasePending releases messages of lost connection, which will not be receipted
+func (o *PulsarOutput) releasePending() {
+	o.pendingMu.Lock()
+	defer o.pendingMu.Unlock()
+
+	for context := range o.contexts {
+		delete(o.contexts, context)
+		<-o.pending
+	}
+}
+
+// connection returns current connection, or dials new one if it is closed, at most once a second. Should be called
+// under lock.
+func (o *PulsarOutput) connection() *pulsarConn {
+	select {
+	case <-o.conn.closed:
+	default:
+		return o.conn
+	}
+
+	if time.Since(o.lastDial) < time.Second {
+		return nil
+	}
+	o.lastDial = time.Now()
+	log.Println("[PULSAR-OUTPUT] connection error:", o.conn.err)
+
+	o.releasePending()
+	conn, err := o.connect()
+	if err != nil {
+		log.Println("[PULSAR-OUTPUT] connection error:", err)
+		return nil
+	}
+	o.conn = conn
+
+	return conn
+}
+
+func (o *PulsarOutput) Write(data []byte) (n int, err error) {
+	if o.config.redactor != nil {
+		data = o.config.redactor.Redact(data)
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return 0, errors.New("Pulsar output is closed")
+	}
+
+	// Sessions are kept while there is no connection, so responses get keys of their requests
+	key := o.sessions.key(data)
+
+	conn := o.connection()
+	if conn == nil {
+		return len(data), nil
+	}
+
+	select {
+	case o.pending <- struct{}{}:
+	default:
+		// Buffered messages are sent, so their receipts can free the room
+		conn.Flush()
+
+		select {
+		case o.pending <- struct{}{}:
+		case <-conn.closed:
+			return len(data), nil
+		case <-time.After(pulsarSendTimeout):
+			log.Println("[PULSAR-OUTPUT] broker does not receipt messages, reconnecting")
+			conn.close(errors.New("receipts timed out"))
+			return len(data), nil
+		}
+	}
+
+	o.seq++
+	context := strconv.Itoa(o.seq)
+	o.pendingMu.Lock()
+	o.contexts[context] = true
+	o.pendingMu.Unlock()
+
+	msg, _ := json.Marshal(pulsarProducerMessage{Payload: data, Key: key, Context: context})
+	conn.send(msg)
+
+	return len(data), nil
+}
+
+func (o *PulsarOutput) String() string {
+	return "Pulsar output: " + o.address.Host + "/" + o.topic
+}
+
+// Close sends buffered messages and waits for their receipts
+func (o *PulsarOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	close(o.done)
+	o.conn.Flush()
+
+	deadline := time.After(pulsarSendTimeout)
+wait:
+	for i := 0; i < pulsarMaxPending; i++ {
+		select {
+		case o.pending <- struct{}{}:
+		case <-o.conn.closed:
+			break wait
+		case <-deadline:
+			break wait
+		}
+	}
+
+	return o.conn.Close()
+}
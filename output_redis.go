@@ -0,0 +1,228 @@
+package goreplay
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/redis"
+)
+
+// Connections not used for this time are closed, captured clients do not send QUIT through output
+const redisIdleTimeout = time.Minute
+
+// RedisOutputConfig holds configuration options for Redis output
+type RedisOutputConfig struct {
+	Workers        int
+	Timeout        time.Duration
+	TrackResponses bool
+}
+
+// RedisOutput replays captured Redis commands against another server, e.g. new cluster during migration.
+// Commands of captured connection are replayed in order by the same worker, using separate connection.
+type RedisOutput struct {
+	address    string
+	config     *RedisOutputConfig
+	connConfig redis.Config
+	// Database commands are replayed to, -1 if database selected by captured client is used
+	db        int
+	queues    []chan []byte
+	responses chan response
+	quit      chan struct{}
+}
+
+// NewRedisOutput constructor for RedisOutput. Accepts address in `user:password@host:port/db` format, credentials,
+// port and database are optional. User can be empty to authenticate as default user. If database is not specified,
+// the one selected by captured client is used.
+func NewRedisOutput(address string, config *RedisOutputConfig) io.Writer {
+	o := new(RedisOutput)
+
+	var err error
+	if o.address, o.connConfig, o.db, err = parseRedisAddress(address); err != nil {
+		log.Fatalln("output-redis error:", err)
+	}
+
+	o.config = config
+	o.responses = make(chan response, 1000)
+	o.quit = make(chan struct{})
+
+	if o.config.Workers <= 0 {
+		o.config.Workers = 10
+	}
+	if o.config.Timeout <= 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+	o.connConfig.Timeout = o.config.Timeout
+
+	for i := 0; i < o.config.Workers; i++ {
+		queue := make(chan []byte, 100)
+		o.queues = append(o.queues, queue)
+		go o.worker(queue)
+	}
+
+	return o
+}
+
+func parseRedisAddress(address string) (string, redis.Config, int, error) {
+	var config redis.Config
+	db := -1
+
+	if i := strings.LastIndex(address, "@"); i != -1 {
+		config.User = address[:i]
+		address = address[i+1:]
+
+		if j := strings.Index(config.User, ":"); j != -1 {
+			config.Password = config.User[j+1:]
+			config.User = config.User[:j]
+		}
+	}
+
+	if i := strings.Index(address, "/"); i != -1 {
+		var err error
+		if db, err = strconv.Atoi(address[i+1:]); err != nil || db < 0 {
+			return "", config, 0, fmt.Errorf("wrong database %q", address[i+1:])
+		}
+		address = address[:i]
+	}
+
+	if address == "" {
+		return "", config, 0, errors.New("host is not specified")
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "6379")
+	}
+
+	return address, config, db, nil
+}
+
+type redisConn struct {
+	*redis.Conn
+	lastUsed time.Time
+}
+
+func (o *RedisOutput) worker(queue chan []byte) {
+	conns := make(map[string]*redisConn)
+	lastExpire := time.Now()
+
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		var data []byte
+		select {
+		case <-o.quit:
+			return
+		case data = <-queue:
+		}
+
+		cmd := new(redis.Command)
+		if err := cmd.UnmarshalText(payloadBody(data)); err != nil {
+			continue
+		}
+
+		start := time.Now()
+
+		if start.Sub(lastExpire) >= redisIdleTimeout {
+			lastExpire = start
+			for id, conn := range conns {
+				if start.Sub(conn.lastUsed) >= redisIdleTimeout {
+					conn.Close()
+					delete(conns, id)
+				}
+			}
+		}
+
+		if o.db != -1 {
+			cmd.DB = o.db
+		}
+
+		conn, ok := conns[cmd.Connection]
+		if !ok {
+			c, err := redis.Dial(o.address, o.connConfig)
+			if err != nil {
+				log.Println("Redis output: can't connect to", o.address, err)
+				continue
+			}
+
+			conn = &redisConn{Conn: c}
+			conns[cmd.Connection] = conn
+		}
+		conn.lastUsed = start
+
+		resp, err := conn.Exec(cmd)
+		if err != nil {
+			log.Println("Redis output: error replaying command", err)
+			conn.Close()
+			delete(conns, cmd.Connection)
+			continue
+		}
+
+		if !o.config.TrackResponses {
+			continue
+		}
+
+		stop := time.Now()
+		o.responses <- response{resp, payloadMeta(data)[1], start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+	}
+}
+
+func (o *RedisOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
+
+	// Commands larger than copy buffer are skipped by input
+	if _, _, chunked := payloadChunk(data); chunked {
+		return len(data), nil
+	}
+
+	cmd := new(redis.Command)
+	if err := cmd.UnmarshalText(payloadBody(data)); err != nil {
+		return len(data), nil
+	}
+
+	// We have to copy, because sending data in multiple threads
+	newBuf := make([]byte, len(data))
+	copy(newBuf, data)
+
+	h := fnv.New32a()
+	h.Write([]byte(cmd.Connection))
+	o.queues[h.Sum32()%uint32(len(o.queues))] <- newBuf
+
+	return len(data), nil
+}
+
+func (o *RedisOutput) Read(data []byte) (int, error) {
+	var resp response
+	select {
+	case <-o.quit:
+		return 0, io.EOF
+	case resp = <-o.responses:
+	}
+
+	header := payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	copy(data[0:len(header)], header)
+	copy(data[len(header):], resp.payload)
+
+	return len(resp.payload) + len(header), nil
+}
+
+func (o *RedisOutput) String() string {
+	return fmt.Sprintf("Redis output %s", o.address)
+}
+
+// Close stops workers, and closes their connections
+func (o *RedisOutput) Close() error {
+	close(o.quit)
+	return nil
+}
@@ -0,0 +1,129 @@
+package goreplay
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/redis"
+)
+
+// startRedisServer accepts clients without password, and answers commands with OK. Commands are sent to channel
+// together with number of connection.
+func startRedisServer(t *testing.T, commands chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for n := 1; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn, n int) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				for {
+					data, err := redis.ReadReply(r)
+					if err != nil {
+						return
+					}
+
+					args, _ := redis.ParseCommand(data)
+					var s []string
+					for _, arg := range args {
+						s = append(s, string(arg))
+					}
+					if s[0] == "QUIT" {
+						return
+					}
+
+					commands <- string('0'+rune(n)) + " " + strings.Join(s, " ")
+					conn.Write([]byte("+OK\r\n"))
+				}
+			}(conn, n)
+		}
+	}()
+
+	return ln
+}
+
+func redisCommand(connection string, db int, args ...string) []byte {
+	cmd := &redis.Command{Connection: connection, DB: db}
+	for _, arg := range args {
+		cmd.Args = append(cmd.Args, []byte(arg))
+	}
+
+	text, _ := cmd.MarshalText()
+	return append(payloadHeader(RequestPayload, uuid(), 1, -1), text...)
+}
+
+func TestRedisOutput(t *testing.T) {
+	commands := make(chan string, 10)
+	ln := startRedisServer(t, commands)
+	defer ln.Close()
+
+	output := NewRedisOutput(ln.Addr().String(), &RedisOutputConfig{Workers: 1, TrackResponses: true, Timeout: time.Second})
+	defer output.(*RedisOutput).Close()
+
+	// Only requests are replayed
+	output.Write(append(payloadHeader(ResponsePayload, uuid(), 1, 1), "+OK\r\n"...))
+
+	// Each captured connection is replayed using separate connection, and selects database of captured one
+	output.Write(redisCommand("10.0.0.1:5000", 0, "SET", "a", "1"))
+	output.Write(redisCommand("10.0.0.2:5000", 2, "GET", "b"))
+	output.Write(redisCommand("10.0.0.1:5000", 0, "DEL", "a"))
+
+	for _, expected := range []string{"1 SET a 1", "2 SELECT 2", "2 GET b", "1 DEL a"} {
+		if c := <-commands; c != expected {
+			t.Errorf("Expected %q, got %q", expected, c)
+		}
+	}
+
+	buf := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		n, _ := output.(*RedisOutput).Read(buf)
+		if buf[0] != ReplayedResponsePayload || string(payloadBody(buf[:n])) != "+OK\r\n" {
+			t.Errorf("Wrong replayed reply: %q", buf[:n])
+		}
+	}
+}
+
+func TestRedisOutputDatabase(t *testing.T) {
+	commands := make(chan string, 10)
+	ln := startRedisServer(t, commands)
+	defer ln.Close()
+
+	output := NewRedisOutput(ln.Addr().String()+"/5", &RedisOutputConfig{Workers: 1, Timeout: time.Second})
+	defer output.(*RedisOutput).Close()
+
+	output.Write(redisCommand("10.0.0.1:5000", 2, "GET", "a"))
+	for _, expected := range []string{"1 SELECT 5", "1 GET a"} {
+		if c := <-commands; c != expected {
+			t.Errorf("Database from address should be used, expected %q, got %q", expected, c)
+		}
+	}
+}
+
+func TestParseRedisAddress(t *testing.T) {
+	address, config, db, err := parseRedisAddress("app:p@ss:w@rd@cache.local/2")
+	if err != nil || address != "cache.local:6379" || config.User != "app" || config.Password != "p@ss:w@rd" || db != 2 {
+		t.Error("Wrong address", address, config, db, err)
+	}
+
+	if address, config, db, _ = parseRedisAddress(":secret@[::1]:6380"); address != "[::1]:6380" || config.User != "" || config.Password != "secret" || db != -1 {
+		t.Error("Wrong address", address, config, db)
+	}
+
+	for _, address := range []string{"app@/2", "cache.local/a"} {
+		if _, _, _, err = parseRedisAddress(address); err == nil {
+			t.Errorf("Should reject %q", address)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package goreplay
 
 import (
 	"crypto/tls"
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -14,23 +15,47 @@ import (
 // Currently used for internal communication between listener and replay server
 // Can be used for transfering binary payloads like protocol buffers
 type TCPOutput struct {
+	network  string
 	address  string
 	limit    int
 	buf      []chan []byte
 	bufStats *GorStat
 	config   *TCPOutputConfig
+
+	// Connections of captured sessions, and sessions of payloads, used if sessions are enabled
+	sessions    map[string]*tcpSession
+	sessionKeys payloadSessions
+	sessionsMu  sync.Mutex
 }
 
 type TCPOutputConfig struct {
 	secure bool
 	sticky bool
+	// Payloads of each captured client connection are sent over own connection, see tcpSession
+	sessions bool
+	// Payloads are sent in text or binary format
+	format string
+	// Payloads are buffered up to batch size, and flushed after flush interval. Each payload is written separately if
+	// batch size is 0.
+	batchSize     int
+	flushInterval time.Duration
 }
 
 // NewTCPOutput constructor for TCPOutput
 // Initialize 10 workers which hold keep-alive connection
 func NewTCPOutput(address string, config *TCPOutputConfig) io.Writer {
+	return newTCPOutput("tcp", address, config)
+}
+
+// NewUnixOutput constructor for TCPOutput sending payloads to unix socket, e.g. of --input-unix or local consumer
+func NewUnixOutput(path string, config *TCPOutputConfig) io.Writer {
+	return newTCPOutput("unix", path, config)
+}
+
+func newTCPOutput(network, address string, config *TCPOutputConfig) io.Writer {
 	o := new(TCPOutput)
 
+	o.network = network
 	o.address = address
 	o.config = config
 
@@ -38,6 +63,8 @@ func NewTCPOutput(address string, config *TCPOutputConfig) io.Writer {
 		o.bufStats = NewGorStat("output_tcp", 5000)
 	}
 
+	o.sessions = make(map[string]*tcpSession)
+
 	if o.config.sticky {
 		// create 10 buffers and send the buffer index to the worker
 		o.buf = make([]chan []byte, 10)
@@ -58,6 +85,28 @@ func NewTCPOutput(address string, config *TCPOutputConfig) io.Writer {
 }
 
 func (o *TCPOutput) worker(bufferIndex int) {
+	conn := o.dial()
+	defer conn.Close()
+
+	w, stop := o.writer(conn)
+	defer stop()
+
+	for {
+		data := <-o.buf[bufferIndex]
+
+		if err := o.send(w, data); err != nil {
+			log.Println("INFO: TCP output connection closed, reconnecting")
+			o.buf[bufferIndex] <- data
+			go o.worker(bufferIndex)
+			break
+		}
+
+		putPayloadBuffer(data)
+	}
+}
+
+// dial connects to aggregator instance, retrying every second until it succeeds
+func (o *TCPOutput) dial() net.Conn {
 	retries := 1
 	conn, err := o.connect(o.address)
 	for {
@@ -72,33 +121,59 @@ func (o *TCPOutput) worker(bufferIndex int) {
 		retries++
 	}
 
-	if retries > 0 {
+	if retries > 1 {
 		log.Println("Connected to aggregator instance after ", retries, " retries")
 	}
 
-	defer conn.Close()
-
-	for {
-		data := <-o.buf[bufferIndex]
-		conn.Write(data)
-		_, err := conn.Write([]byte(payloadSeparator))
+	return conn
+}
 
-		if err != nil {
-			log.Println("INFO: TCP output connection closed, reconnecting")
-			o.buf[bufferIndex] <- data
-			go o.worker(bufferIndex)
-			break
+// writer wraps connection into batch writer if batching is enabled, and starts binary stream. Returned function stops
+// flushing of batches, and sends the last one.
+func (o *TCPOutput) writer(conn net.Conn) (io.Writer, func()) {
+	var w io.Writer = conn
+	stop := func() {}
+	if o.config.batchSize > 0 {
+		batch := newBatchWriter(conn, o.config.batchSize)
+		unregister := registerFlush(o.config.flushInterval, func() { batch.Flush() })
+		stop = func() {
+			unregister()
+			batch.Flush()
 		}
+		w = batch
+	}
+
+	if o.config.format == FileFormatBinary {
+		w.Write(binaryPayloadMagic)
+	}
+
+	return w, stop
+}
+
+// send writes payload in format of output
+func (o *TCPOutput) send(w io.Writer, data []byte) (err error) {
+	if o.config.format == FileFormatBinary {
+		_, err = w.Write(encodeBinaryPayload(data))
+	} else {
+		w.Write(data)
+		_, err = w.Write([]byte(payloadSeparator))
 	}
+
+	return
 }
 
+// getBufferIndex returns queue of sticky worker, payloads of the same session are sent over the same connection
 func (o *TCPOutput) getBufferIndex(data []byte) int {
 	if !o.config.sticky {
 		return 0
 	}
 
+	o.sessionsMu.Lock()
+	key := o.sessionKeys.key(data)
+	o.sessionsMu.Unlock()
+
 	hasher := fnv.New32a()
-	hasher.Write(payloadMeta(data)[1])
+	hasher.Write([]byte(key))
 	return int(hasher.Sum32()) % 10
 }
 
@@ -107,9 +182,12 @@ func (o *TCPOutput) Write(data []byte) (n int, err error) {
 		return len(data), nil
 	}
 
-	// We have to copy, because sending data in multiple threads
-	newBuf := make([]byte, len(data))
-	copy(newBuf, data)
+	// We have to copy, because sending data in multiple threads. Buffer is returned to the pool by worker.
+	newBuf := getPayloadBuffer(data)
+
+	if o.config.sessions && o.sessionWrite(newBuf) {
+		return len(data), nil
+	}
 
 	bufferIndex := o.getBufferIndex(data)
 	o.buf[bufferIndex] <- newBuf
@@ -121,16 +199,45 @@ func (o *TCPOutput) Write(data []byte) (n int, err error) {
 	return len(data), nil
 }
 
+func (o *TCPOutput) queueLen() (n int) {
+	for _, buf := range o.buf {
+		n += len(buf)
+	}
+
+	o.sessionsMu.Lock()
+	for _, s := range o.sessions {
+		n += len(s.payloads)
+	}
+	o.sessionsMu.Unlock()
+
+	return
+}
+
 func (o *TCPOutput) connect(address string) (conn net.Conn, err error) {
 	if o.config.secure {
-		conn, err = tls.Dial("tcp", address, &tls.Config{})
+		conn, err = tls.Dial(o.network, address, &tls.Config{})
 	} else {
-		conn, err = net.Dial("tcp", address)
+		conn, err = net.Dial(o.network, address)
 	}
 
 	return
 }
 
+// healthSamples reports usage of the fullest worker queue
+func (o *TCPOutput) healthSamples() []healthSample {
+	var usage float64
+	for _, buf := range o.buf {
+		if u := float64(len(buf)) / float64(cap(buf)); u > usage {
+			usage = u
+		}
+	}
+
+	return []healthSample{{check: healthQueueSaturation, source: "output_" + o.network + ":" + o.address, usage: usage}}
+}
+
 func (o *TCPOutput) String() string {
+	if o.network == "unix" {
+		return fmt.Sprintf("Unix output %s, limit: %d", o.address, o.limit)
+	}
 	return fmt.Sprintf("TCP output %s, limit: %d", o.address, o.limit)
 }
@@ -0,0 +1,83 @@
+package goreplay
+
+import (
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// tcpSession sends payloads of a single captured client connection over its own connection, in order they were
+// captured, so downstream instances and L4 load balancers see the same connections as the captured server.
+// Connection is opened on the first payload, and closed when session does not get payloads for sessionIdleTimeout.
+type tcpSession struct {
+	payloads chan []byte
+}
+
+// sessionWrite queues payload to connection of its session, session is started if it is not running. Payloads without
+// client address are not queued, they are sent by workers.
+func (o *TCPOutput) sessionWrite(data []byte) bool {
+	info, _ := parsePayloadInfo(data)
+
+	o.sessionsMu.Lock()
+	defer o.sessionsMu.Unlock()
+
+	key := o.sessionKeys.key(data)
+	if key == string(info.id) {
+		return false
+	}
+
+	s, ok := o.sessions[key]
+	if !ok {
+		s = &tcpSession{payloads: make(chan []byte, 100)}
+		o.sessions[key] = s
+		go o.runSession(key, s)
+	}
+
+	// Session does not stop while it has queued payloads
+	s.payloads <- data
+
+	return true
+}
+
+func (o *TCPOutput) runSession(key string, s *tcpSession) {
+	var conn net.Conn
+	var w io.Writer
+	stop := func() {}
+	defer func() {
+		stop()
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case data := <-s.payloads:
+			for {
+				if conn == nil {
+					conn = o.dial()
+					w, stop = o.writer(conn)
+				}
+
+				if err := o.send(w, data); err != nil {
+					log.Println("INFO: TCP output connection of session", key, "closed, reconnecting")
+					stop()
+					conn.Close()
+					conn = nil
+					continue
+				}
+				break
+			}
+			putPayloadBuffer(data)
+		case <-time.After(sessionIdleTimeout):
+			o.sessionsMu.Lock()
+			if len(s.payloads) == 0 {
+				delete(o.sessions, key)
+				o.sessionsMu.Unlock()
+				return
+			}
+			o.sessionsMu.Unlock()
+		}
+	}
+}
@@ -1,11 +1,14 @@
-package main
+package goreplay
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -37,6 +40,107 @@ func TestTCPOutput(t *testing.T) {
 	close(quit)
 }
 
+func TestTCPOutputBatch(t *testing.T) {
+	var count int32
+	listener := startTCP(func(data []byte) {
+		if !bytes.HasSuffix(data, []byte("\r\n\r\n")) {
+			t.Errorf("Wrong payload %q", data)
+		}
+		atomic.AddInt32(&count, 1)
+	})
+
+	output := NewTCPOutput(listener.Addr().String(), &TCPOutputConfig{batchSize: 64 << 10, flushInterval: 10 * time.Millisecond})
+	for i := 0; i < 1000; i++ {
+		output.Write(append(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), "GET / HTTP/1.1\r\n\r\n"...))
+	}
+
+	// Payloads which don't fill the batch are sent by flusher
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&count) < 1000 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&count); n != 1000 {
+		t.Errorf("Expected 1000 payloads, got %d", n)
+	}
+}
+
+func TestTCPOutputSessions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var mu sync.Mutex
+	conns := make(map[string]net.Conn)
+	received := make(map[string][]string)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				scanner.Split(payloadScanner)
+				for scanner.Scan() {
+					addr := payloadClientAddr(scanner.Bytes())
+					mu.Lock()
+					if c, ok := conns[addr]; ok && c != conn {
+						t.Errorf("Payloads of session %s are sent over different connections", addr)
+					}
+					conns[addr] = conn
+					received[addr] = append(received[addr], string(payloadBody(scanner.Bytes())))
+					mu.Unlock()
+				}
+			}()
+		}
+	}()
+
+	output := NewTCPOutput(listener.Addr().String(), &TCPOutputConfig{sessions: true})
+	addrs := []string{"10.0.0.1:5000", "10.0.0.1:5001", "10.0.0.2:5000"}
+	for i := 0; i < 20; i++ {
+		for _, addr := range addrs {
+			header := payloadAddrHeader(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), addr)
+			output.Write(append(header, fmt.Sprintf("GET /%d HTTP/1.1\r\n\r\n", i)...))
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := 0
+		for _, payloads := range received {
+			n += len(payloads)
+		}
+		mu.Unlock()
+		if n == 20*len(addrs) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, addr := range addrs {
+		if len(received[addr]) != 20 {
+			t.Fatalf("Expected 20 payloads of session %s, got %d", addr, len(received[addr]))
+		}
+		for i, body := range received[addr] {
+			if want := fmt.Sprintf("GET /%d HTTP/1.1\r\n\r\n", i); body != want {
+				t.Errorf("Payloads of session %s should keep order, got %q at %d", addr, body, i)
+			}
+		}
+	}
+	if conns[addrs[0]] == conns[addrs[1]] || conns[addrs[0]] == conns[addrs[2]] {
+		t.Error("Each session should have own connection")
+	}
+}
+
 func startTCP(cb func([]byte)) net.Listener {
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 
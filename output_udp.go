@@ -0,0 +1,151 @@
+package goreplay
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// UDPOutputConfig holds configuration options for UDP output
+type UDPOutputConfig struct {
+	Workers        int
+	Timeout        time.Duration
+	TrackResponses bool
+}
+
+// UDPOutput sends payloads of captured requests as datagrams, e.g. to mirror DNS or syslog traffic.
+// Each worker uses its own socket, so replies can be matched with requests.
+type UDPOutput struct {
+	address   string
+	config    *UDPOutputConfig
+	buf       chan []byte
+	responses chan response
+	quit      chan struct{}
+}
+
+// NewUDPOutput constructor for UDPOutput
+func NewUDPOutput(address string, config *UDPOutputConfig) io.Writer {
+	o := new(UDPOutput)
+
+	o.address = address
+	o.config = config
+	o.buf = make(chan []byte, 1000)
+	o.responses = make(chan response, 1000)
+	o.quit = make(chan struct{})
+
+	if o.config.Workers <= 0 {
+		o.config.Workers = 10
+	}
+	if o.config.Timeout <= 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	for i := 0; i < o.config.Workers; i++ {
+		go o.worker()
+	}
+
+	return o
+}
+
+func (o *UDPOutput) worker() {
+	var conn net.Conn
+	var err error
+
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	reply := make([]byte, 64*1024)
+
+	for {
+		var data []byte
+		select {
+		case <-o.quit:
+			return
+		case data = <-o.buf:
+		}
+
+		if conn == nil {
+			if conn, err = net.Dial("udp", o.address); err != nil {
+				log.Println("UDP output: can't connect to", o.address, err)
+				conn = nil
+				continue
+			}
+		}
+
+		start := time.Now()
+		if _, err = conn.Write(payloadBody(data)); err != nil {
+			log.Println("UDP output: write error", err)
+			conn.Close()
+			conn = nil
+			continue
+		}
+
+		if !o.config.TrackResponses {
+			continue
+		}
+
+		conn.SetReadDeadline(start.Add(o.config.Timeout))
+		n, err := conn.Read(reply)
+		if err != nil {
+			// Late reply would be taken for reply to the next request, so socket is replaced
+			conn.Close()
+			conn = nil
+			continue
+		}
+
+		stop := time.Now()
+		resp := make([]byte, n)
+		copy(resp, reply[:n])
+
+		o.responses <- response{resp, payloadMeta(data)[1], start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+	}
+}
+
+func (o *UDPOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
+
+	// Datagrams are small enough to fit into single payload
+	if _, _, chunked := payloadChunk(data); chunked {
+		return len(data), nil
+	}
+
+	// We have to copy, because sending data in multiple threads
+	newBuf := make([]byte, len(data))
+	copy(newBuf, data)
+
+	o.buf <- newBuf
+
+	return len(data), nil
+}
+
+func (o *UDPOutput) Read(data []byte) (int, error) {
+	var resp response
+	select {
+	case <-o.quit:
+		return 0, io.EOF
+	case resp = <-o.responses:
+	}
+
+	header := payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	copy(data[0:len(header)], header)
+	copy(data[len(header):], resp.payload)
+
+	return len(resp.payload) + len(header), nil
+}
+
+func (o *UDPOutput) String() string {
+	return fmt.Sprintf("UDP output %s", o.address)
+}
+
+// Close stops workers
+func (o *UDPOutput) Close() error {
+	close(o.quit)
+	return nil
+}
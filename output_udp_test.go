@@ -0,0 +1,95 @@
+package goreplay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func startUDPEcho(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte("reply:"), buf[:n]...), addr)
+		}
+	}()
+
+	return conn
+}
+
+func TestUDPOutput(t *testing.T) {
+	server := startUDPEcho(t)
+	defer server.Close()
+
+	output := NewUDPOutput(server.LocalAddr().String(), &UDPOutputConfig{TrackResponses: true, Timeout: time.Second})
+	defer output.(*UDPOutput).Close()
+
+	id := uuid()
+	// Only requests are replayed
+	output.Write(append(payloadHeader(ResponsePayload, id, 1, 1), []byte("response")...))
+	output.Write(append(payloadHeader(RequestPayload, id, 1, -1), []byte("query")...))
+
+	buf := make([]byte, 1024)
+	done := make(chan []byte)
+	go func() {
+		n, _ := output.(*UDPOutput).Read(buf)
+		done <- buf[:n]
+	}()
+
+	select {
+	case data := <-done:
+		if data[0] != ReplayedResponsePayload || !bytes.Equal(payloadMeta(data)[1], id) {
+			t.Error("Should return replayed response", string(data))
+		}
+		if body := payloadBody(data); string(body) != "reply:query" {
+			t.Error("Wrong reply", string(body))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Should receive reply")
+	}
+}
+
+func TestUDPOutputTimeout(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	output := NewUDPOutput(server.LocalAddr().String(), &UDPOutputConfig{Workers: 1, TrackResponses: true, Timeout: 10 * time.Millisecond})
+	defer output.(*UDPOutput).Close()
+
+	id := uuid()
+	output.Write(append(payloadHeader(RequestPayload, id, 1, -1), []byte("first")...))
+
+	buf := make([]byte, 1024)
+	n, addr, err := server.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "first" {
+		t.Fatal("Should send datagram", err)
+	}
+
+	// Reply after timeout should not be taken for reply to the next request
+	time.Sleep(50 * time.Millisecond)
+	server.WriteTo([]byte("late"), addr)
+
+	output.Write(append(payloadHeader(RequestPayload, id, 1, -1), []byte("second")...))
+	if n, addr, err = server.ReadFrom(buf); err != nil || string(buf[:n]) != "second" {
+		t.Fatal("Should send datagram", err)
+	}
+	server.WriteTo([]byte("answer"), addr)
+
+	n, _ = output.(*UDPOutput).Read(buf)
+	if body := payloadBody(buf[:n]); string(body) != "answer" {
+		t.Error("Wrong reply", string(body))
+	}
+}
@@ -0,0 +1,165 @@
+package goreplay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Binary payload format is alternative to text format of files and TCP transport. Stream starts with magic, followed
+// by payloads encoded as protobuf messages, each prefixed by its length as varint, like protobuf delimited messages:
+//
+//	message Payload {
+//	  uint32 version = 1;   // binaryPayloadVersion
+//	  uint32 type = 2;      // 1 - request, 2 - response, 3 - replayed response
+//	  bytes id = 3;
+//	  int64 timestamp = 4;
+//	  optional int64 latency = 5;
+//	  repeated bytes fields = 6; // other header fields, e.g. client address `a10.0.0.1:5000` or chunk `c1+`
+//	  bytes data = 7;
+//	}
+//
+// Message is not scanned for separator, so binary bodies can't be confused with it.
+var binaryPayloadMagic = []byte("GOR\x00BIN")
+
+const binaryPayloadVersion = 1
+
+// Payloads larger than this are considered corrupted stream
+const binaryPayloadMaxSize = 1 << 30
+
+const (
+	binaryFieldVersion = 1 + iota
+	binaryFieldType
+	binaryFieldID
+	binaryFieldTimestamp
+	binaryFieldLatency
+	binaryFieldFields
+	binaryFieldData
+)
+
+var errBinaryPayload = errors.New("malformed binary payload")
+
+// isBinaryPayloadStream checks if header of file or connection is binary payload format magic
+func isBinaryPayloadStream(header []byte) bool {
+	return len(header) >= len(binaryPayloadMagic) && string(header[:len(binaryPayloadMagic)]) == string(binaryPayloadMagic)
+}
+
+// encodeBinaryPayload encodes payload as length prefixed message
+func encodeBinaryPayload(payload []byte) []byte {
+	meta := payloadMeta(payload)
+	data := payloadBody(payload)
+
+	msg := make([]byte, 0, len(data)+64)
+	msg = appendVarintField(msg, binaryFieldVersion, binaryPayloadVersion)
+	msg = appendVarintField(msg, binaryFieldType, uint64(payload[0]-'0'))
+	if len(meta) > 1 {
+		msg = appendBytesField(msg, binaryFieldID, meta[1])
+	}
+	if len(meta) > 2 {
+		timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+		msg = appendVarintField(msg, binaryFieldTimestamp, uint64(timestamp))
+	}
+	if len(meta) > 3 {
+		for _, field := range meta[3:] {
+			// Latency is the only numeric field
+			if latency, err := strconv.ParseInt(string(field), 10, 64); err == nil {
+				msg = appendVarintField(msg, binaryFieldLatency, uint64(latency))
+			} else {
+				msg = appendBytesField(msg, binaryFieldFields, field)
+			}
+		}
+	}
+	msg = appendBytesField(msg, binaryFieldData, data)
+
+	return append(appendUvarint(make([]byte, 0, len(msg)+binary.MaxVarintLen64), uint64(len(msg))), msg...)
+}
+
+// decodeBinaryPayload decodes message to payload in text format. Unknown fields are skipped.
+func decodeBinaryPayload(msg []byte) ([]byte, error) {
+	var (
+		payloadType byte
+		id, data    []byte
+		fields      [][]byte
+		timestamp   int64
+		latency     int64 = -1
+		version     uint64
+	)
+
+	err := forEachProtoField(msg, func(field int, value uint64, bytesValue []byte) {
+		switch field {
+		case binaryFieldVersion:
+			version = value
+		case binaryFieldType:
+			payloadType = '0' + byte(value)
+		case binaryFieldID:
+			id = bytesValue
+		case binaryFieldTimestamp:
+			timestamp = int64(value)
+		case binaryFieldLatency:
+			latency = int64(value)
+		case binaryFieldFields:
+			fields = append(fields, bytesValue)
+		case binaryFieldData:
+			data = bytesValue
+		}
+	})
+	if err != nil {
+		return nil, errBinaryPayload
+	}
+
+	if version == 0 || payloadType == 0 {
+		return nil, errBinaryPayload
+	}
+
+	header := payloadHeader(payloadType, id, timestamp, latency)
+	for _, field := range fields {
+		header = append(append(append(header[:len(header)-1], ' '), field...), '\n')
+	}
+
+	return append(header, data...), nil
+}
+
+// readBinaryPayload reads length prefixed message, and returns payload in text format and number of read bytes.
+// io.ErrUnexpectedEOF is returned if stream ends in the middle of message.
+func readBinaryPayload(r *bufio.Reader) ([]byte, int, error) {
+	var read int
+	size, err := binary.ReadUvarint(&countingByteReader{r: r, n: &read})
+	if err == io.EOF && read > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, read, err
+	}
+	if size > binaryPayloadMaxSize {
+		return nil, read, errBinaryPayload
+	}
+
+	msg := make([]byte, size)
+	n, err := io.ReadFull(r, msg)
+	read += n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, read, err
+	}
+
+	payload, err := decodeBinaryPayload(msg)
+
+	return payload, read, err
+}
+
+type countingByteReader struct {
+	r *bufio.Reader
+	n *int
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		*c.n++
+	}
+	return b, err
+}
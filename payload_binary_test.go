@@ -0,0 +1,119 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBinaryPayload(t *testing.T) {
+	// Body contains separator of text format
+	body := "POST / HTTP/1.1\r\nContent-Length: 13\r\n\r\n\x00" + payloadSeparator + "\x01"
+
+	payloads := [][]byte{
+		append(payloadHeader(RequestPayload, []byte("a1"), 1614636000000000000, -1), body...),
+		append(payloadChunkHeader(payloadAddrHeader(payloadHeader(RequestPayload, []byte("a1"), 1, -1), "10.0.0.1:5000"), 1, true), "chunk"...),
+		append(payloadHeader(ResponsePayload, []byte("a1"), 2, 1000), "HTTP/1.1 200 OK\r\n\r\n"...),
+	}
+
+	var stream bytes.Buffer
+	for _, payload := range payloads {
+		stream.Write(encodeBinaryPayload(payload))
+	}
+
+	reader := bufio.NewReader(&stream)
+	for _, expected := range payloads {
+		payload, _, err := readBinaryPayload(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, expected) {
+			t.Errorf("Expected %q, got %q", expected, payload)
+		}
+	}
+	if _, _, err := readBinaryPayload(reader); err != io.EOF {
+		t.Error("Expected end of stream, got", err)
+	}
+
+	// Incomplete message
+	encoded := encodeBinaryPayload(payloads[0])
+	if _, _, err := readBinaryPayload(bufio.NewReader(bytes.NewReader(encoded[:len(encoded)-1]))); err != io.ErrUnexpectedEOF {
+		t.Error("Expected unexpected EOF, got", err)
+	}
+}
+
+func TestFileOutputBinary(t *testing.T) {
+	for _, ext := range []string{".gor", ".gor.gz"} {
+		name := fmt.Sprintf("/tmp/%d%s", rand.Int63(), ext)
+		defer os.Remove(name)
+
+		payload := append(payloadHeader(RequestPayload, []byte("a1"), 1614636000000000000, -1), "POST / HTTP/1.1\r\n\r\n\x00\n"+payloadSeparator...)
+
+		output := NewFileOutput(name, &FileOutputConfig{append: true, flushInterval: time.Minute, format: FileFormatBinary})
+		output.Write(payload)
+		output.Write(payload)
+		output.Close()
+
+		r := NewFileInputReader(name, 0, nil)
+		for i := 0; i < 2; i++ {
+			if r.timestamp != 1614636000000000000 {
+				t.Error(ext, "Wrong timestamp:", r.timestamp)
+			}
+			if data := r.ReadPayload(); !bytes.Equal(data, payload) {
+				t.Errorf("%s Expected %q, got %q", ext, payload, data)
+			}
+		}
+		if atomic.LoadInt32(&r.closed) == 0 {
+			t.Error(ext, "File should be read")
+		}
+
+		// Reading is resumed from offset, after magic
+		if ext == ".gor" {
+			first := NewFileInputReader(name, 0, nil)
+			resumed := NewFileInputReader(name, first.end, nil)
+			if data := resumed.ReadPayload(); !bytes.Equal(data, payload) {
+				t.Errorf("Resumed reader expected %q, got %q", payload, data)
+			}
+		}
+	}
+}
+
+func TestTCPOutputBinary(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	input := NewTCPInput("127.0.0.1:0", &TCPInputConfig{})
+	var received [][]byte
+	var mu sync.Mutex
+	output := NewTestOutput(func(data []byte) {
+		mu.Lock()
+		received = append(received, append([]byte(nil), data...))
+		mu.Unlock()
+		wg.Done()
+	})
+
+	go Start(&InOutPlugins{Inputs: []io.Reader{input}, Outputs: []io.Writer{output}}, quit)
+
+	tcpOutput := NewTCPOutput(input.listener.Addr().String(), &TCPOutputConfig{format: FileFormatBinary})
+	payload := append(payloadHeader(RequestPayload, []byte("a1"), 1, -1), "POST / HTTP/1.1\r\n\r\n"+payloadSeparator...)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		tcpOutput.Write(payload)
+	}
+
+	wg.Wait()
+	close(quit)
+
+	for _, data := range received {
+		if !bytes.Equal(data, payload) {
+			t.Errorf("Expected %q, got %q", payload, data)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package goreplay
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// payloadSpill is FIFO of payloads kept in temporary file, used by output dispatcher when memory budget is exceeded.
+// Payloads are stored with 4 bytes length prefix, and file is truncated once all of them are read.
+type payloadSpill struct {
+	mu      sync.Mutex
+	file    *os.File
+	written int64
+	read    int64
+	pending int
+}
+
+func newPayloadSpill() (*payloadSpill, error) {
+	file, err := ioutil.TempFile("", "gor-spill-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &payloadSpill{file: file}, nil
+}
+
+func (s *payloadSpill) push(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	copy(record[4:], payload)
+
+	if _, err := s.file.WriteAt(record, s.written); err != nil {
+		return err
+	}
+	s.written += int64(len(record))
+	s.pending++
+
+	return nil
+}
+
+// pop returns the oldest payload, or nil if there are no payloads left
+func (s *payloadSpill) pop() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == 0 {
+		return nil, nil
+	}
+
+	var size [4]byte
+	if _, err := s.file.ReadAt(size[:], s.read); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := s.file.ReadAt(payload, s.read+4); err != nil {
+		return nil, err
+	}
+	s.read += int64(4 + len(payload))
+	s.pending--
+
+	if s.pending == 0 {
+		s.read, s.written = 0, 0
+		return payload, s.file.Truncate(0)
+	}
+
+	return payload, nil
+}
+
+func (s *payloadSpill) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pending
+}
+
+// Close removes spill file
+func (s *payloadSpill) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
@@ -0,0 +1,103 @@
+package goreplay
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var errStreamTimeout = errors.New("timed out waiting for the next chunk of message")
+
+// payloadChunker splits message which does not fit into plugin buffer into chunks, see payloadChunkHeader.
+// Message body is read from reader, so it is never copied into single buffer.
+type payloadChunker struct {
+	header    []byte
+	body      io.Reader
+	remaining int
+	index     int
+}
+
+func newPayloadChunker(header []byte, body io.Reader, size int) *payloadChunker {
+	return &payloadChunker{header: header, body: body, remaining: size}
+}
+
+// Read writes next chunk into data. Emitter expects payload to be smaller than its buffer, so one byte is kept free.
+func (c *payloadChunker) Read(data []byte) (int, error) {
+	header := payloadChunkHeader(c.header, c.index, true)
+	size := len(data) - len(header) - 1
+	if size <= 0 {
+		return 0, io.ErrShortBuffer
+	}
+
+	if size >= c.remaining {
+		size = c.remaining
+		header = payloadChunkHeader(c.header, c.index, false)
+	}
+
+	n := copy(data, header)
+	if _, err := io.ReadFull(c.body, data[n:n+size]); err != nil {
+		return 0, err
+	}
+
+	c.remaining -= size
+	c.index++
+
+	return n + size, nil
+}
+
+func (c *payloadChunker) done() bool {
+	return c.remaining <= 0
+}
+
+// payloadStream passes bodies of chunks to the worker which sends the message
+type payloadStream struct {
+	chunks  chan []byte
+	done    chan struct{}
+	timeout time.Duration
+	buf     []byte
+}
+
+func newPayloadStream(timeout time.Duration) *payloadStream {
+	return &payloadStream{
+		chunks:  make(chan []byte, 16),
+		done:    make(chan struct{}),
+		timeout: timeout,
+	}
+}
+
+// Read fails if next chunk is not received in time, e.g. if input was stopped in the middle of message
+func (s *payloadStream) Read(data []byte) (int, error) {
+	for len(s.buf) == 0 {
+		select {
+		case chunk, ok := <-s.chunks:
+			if !ok {
+				return 0, io.EOF
+			}
+			s.buf = chunk
+		case <-time.After(s.timeout):
+			return 0, errStreamTimeout
+		}
+	}
+
+	n := copy(data, s.buf)
+	s.buf = s.buf[n:]
+
+	return n, nil
+}
+
+// write passes chunk to the reader, chunks written after reader is closed are dropped
+func (s *payloadStream) write(chunk []byte, more bool) {
+	select {
+	case s.chunks <- chunk:
+	case <-s.done:
+	}
+
+	if !more {
+		close(s.chunks)
+	}
+}
+
+// close is called by the reader when it doesn't need more chunks
+func (s *payloadStream) close() {
+	close(s.done)
+}
@@ -0,0 +1,75 @@
+package goreplay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestPayloadChunker(t *testing.T) {
+	header := payloadHeader(RequestPayload, []byte("abc"), 1, -1)
+	body := bytes.Repeat([]byte("0123456789"), 100)
+
+	chunker := newPayloadChunker(header, bytes.NewReader(body), len(body))
+	stream := newPayloadStream(time.Second)
+
+	data := make([]byte, 300)
+	var first []byte
+
+	for i := 0; !chunker.done(); i++ {
+		n, err := chunker.Read(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunk := data[:n]
+		index, more, ok := payloadChunk(chunk)
+		if !ok || index != i || more == chunker.done() {
+			t.Fatal("Wrong chunk header:", string(chunk[:bytes.IndexByte(chunk, '\n')]))
+		}
+
+		if meta := payloadMeta(chunk); string(meta[1]) != "abc" || string(meta[2]) != "1" {
+			t.Error("Chunk should keep message header", string(chunk))
+		}
+
+		if index == 0 {
+			first = append(first, payloadBody(chunk)...)
+		} else {
+			stream.write(append([]byte{}, payloadBody(chunk)...), more)
+		}
+	}
+
+	rest, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(append(first, rest...), body) {
+		t.Error("Message should be reassembled from chunks")
+	}
+
+	if _, _, ok := payloadChunk(header); ok {
+		t.Error("Payload without chunk field is not chunked")
+	}
+
+	if _, err := newPayloadChunker(header, bytes.NewReader(body), len(body)).Read(make([]byte, len(header))); err != io.ErrShortBuffer {
+		t.Error("Should not write chunk without body", err)
+	}
+}
+
+func TestPayloadStreamTimeout(t *testing.T) {
+	stream := newPayloadStream(10 * time.Millisecond)
+	stream.write([]byte("a"), true)
+
+	if _, err := ioutil.ReadAll(stream); err != errStreamTimeout {
+		t.Error("Should fail if next chunk is not received in time", err)
+	}
+
+	// Chunks written after reader gave up are dropped
+	stream.close()
+	for i := 0; i < 20; i++ {
+		stream.write([]byte("a"), i < 19)
+	}
+}
@@ -0,0 +1,125 @@
+package goreplay
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var errPipeClosed = errors.New("pipe is closed")
+
+// Pipe connects pipelines running in the same process, without sending payloads between gor instances over TCP.
+// Output of pipe is added to plugins of one Emitter, and input of pipe to plugins of another one, e.g. capture
+// pipeline archives traffic to file and writes it to pipe, while replay pipeline reads it from pipe and replays it
+// with its own limits. Payloads are passed in order, and when pipe is full, writing pipeline waits for reading one.
+type Pipe struct {
+	payloads chan []byte
+	// Closed by output and input, so the other end stops
+	closed      chan struct{}
+	done        chan struct{}
+	closeOutput sync.Once
+	closeInput  sync.Once
+}
+
+// PipeOutput is writing end of Pipe
+type PipeOutput struct {
+	pipe *Pipe
+}
+
+// PipeInput is reading end of Pipe
+type PipeInput struct {
+	pipe *Pipe
+}
+
+// NewPipe constructor for Pipe, size is number of payloads it buffers
+func NewPipe(size int) *Pipe {
+	return &Pipe{
+		payloads: make(chan []byte, size),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Output returns writing end of pipe
+func (p *Pipe) Output() *PipeOutput {
+	return &PipeOutput{pipe: p}
+}
+
+// Input returns reading end of pipe
+func (p *Pipe) Input() *PipeInput {
+	return &PipeInput{pipe: p}
+}
+
+func (o *PipeOutput) Write(data []byte) (int, error) {
+	p := o.pipe
+
+	select {
+	case <-p.closed:
+		return 0, errPipeClosed
+	case <-p.done:
+		// Writing pipeline keeps running after reading one stops
+		return len(data), nil
+	default:
+	}
+
+	// Emitter reuses its buffer, buffer is returned to the pool by input
+	buf := getPayloadBuffer(data)
+	select {
+	case p.payloads <- buf:
+		return len(data), nil
+	case <-p.closed:
+		putPayloadBuffer(buf)
+		return 0, errPipeClosed
+	case <-p.done:
+		putPayloadBuffer(buf)
+		return len(data), nil
+	}
+}
+
+func (o *PipeOutput) String() string {
+	return "Pipe output"
+}
+
+// Close stops writing, input reads payloads left in pipe and then returns io.EOF
+func (o *PipeOutput) Close() error {
+	o.pipe.closeOutput.Do(func() {
+		close(o.pipe.closed)
+	})
+	return nil
+}
+
+func (i *PipeInput) Read(data []byte) (int, error) {
+	p := i.pipe
+
+	var buf []byte
+	select {
+	case buf = <-p.payloads:
+	case <-p.done:
+		return 0, io.EOF
+	case <-p.closed:
+		select {
+		case buf = <-p.payloads:
+		default:
+			return 0, io.EOF
+		}
+	}
+
+	// Like other inputs, size of the whole payload is returned, so emitter skips payloads larger than its buffer
+	copy(data, buf)
+	n := len(buf)
+	putPayloadBuffer(buf)
+
+	return n, nil
+}
+
+func (i *PipeInput) String() string {
+	return "Pipe input"
+}
+
+// Close stops reading, following payloads written to output are dropped
+func (i *PipeInput) Close() error {
+	i.pipe.closeInput.Do(func() {
+		close(i.pipe.done)
+	})
+	return nil
+}
@@ -0,0 +1,66 @@
+package goreplay
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestPipe(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	pipe := NewPipe(10)
+	input := NewTestInput()
+
+	var archived, replayed int
+	capture := NewPlugins()
+	capture.AddPlugin(input, "")
+	capture.AddPlugin(NewTestOutput(func(data []byte) {
+		archived++
+	}), "")
+	capture.AddPlugin(pipe.Output(), "")
+
+	replay := NewPlugins()
+	replay.AddPlugin(pipe.Input(), "")
+	replay.AddPlugin(NewTestOutput(func(data []byte) {
+		replayed++
+		wg.Done()
+	}), "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	captureDone := make(chan error, 1)
+	go func() { captureDone <- NewEmitter(capture, EmitterConfig{}).Start(ctx) }()
+
+	replayCtx, stopReplay := context.WithCancel(context.Background())
+	replayDone := make(chan error, 1)
+	go func() { replayDone <- NewEmitter(replay, EmitterConfig{}).Start(replayCtx) }()
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		input.EmitGET()
+	}
+	wg.Wait()
+
+	if replayed != 100 {
+		t.Errorf("Expected 100 payloads to be replayed, got %d", replayed)
+	}
+
+	// Capture keeps running after replay pipeline is stopped
+	stopReplay()
+	if err := <-replayDone; err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 100; i++ {
+		input.EmitGET()
+	}
+
+	cancel()
+	if err := <-captureDone; err != nil {
+		t.Error("Capture should not fail after replay stopped", err)
+	}
+
+	if _, err := pipe.Input().Read(make([]byte, 100)); err != io.EOF {
+		t.Error("Closed pipe should return EOF", err)
+	}
+}
@@ -1,10 +1,12 @@
-package main
+package goreplay
 
 import (
 	"io"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // InOutPlugins struct for holding references to plugins
@@ -12,8 +14,18 @@ type InOutPlugins struct {
 	Inputs  []io.Reader
 	Outputs []io.Writer
 	All     []interface{}
+	// Limiters wrapping inputs and outputs, in order of registration
+	Limiters []*Limiter
+
+	// Priorities of outputs, in the same order as Outputs
+	priorities []outputPriority
+	// Outputs paused by admin API, in the same order as Outputs
+	paused []int32
 }
 
+// Number of payloads not written to paused outputs
+var pausedPayloads uint64
+
 var pluginMu sync.Mutex
 
 // Plugins holds all the plugin objects
@@ -31,11 +43,19 @@ func extractLimitOptions(options string) (string, string) {
 	return split[0], ""
 }
 
-// Automatically detects type of plugin and initialize it
+// NewPlugins returns empty set of plugins, which can be filled using RegisterPlugin or AddPlugin
+func NewPlugins() *InOutPlugins {
+	return new(InOutPlugins)
+}
+
+// RegisterPlugin automatically detects type of plugin and initialize it
+// First option is plugin address, it may contain limiter, priority and transform options after "|"
 //
 // See this article if curious about relfect stuff below: http://blog.burntsushi.net/type-parametric-functions-golang
-func registerPlugin(constructor interface{}, options ...interface{}) {
+func (plugins *InOutPlugins) RegisterPlugin(constructor interface{}, options ...interface{}) {
 	var path, limit string
+	var transforms []string
+	priority := priorityNormal
 	vc := reflect.ValueOf(constructor)
 
 	// Pre-processing options to make it work with reflect
@@ -45,8 +65,10 @@ func registerPlugin(constructor interface{}, options ...interface{}) {
 	}
 
 	if len(vo) > 0 {
-		// Removing limit options from path
-		path, limit = extractLimitOptions(vo[0].String())
+		// Removing limit, priority and transform options from path
+		path, priority = extractPriorityOption(vo[0].String())
+		path, transforms = extractTransformOptions(path)
+		path, limit = extractLimitOptions(path)
 
 		// Writing value back without limiter "|" options
 		vo[0] = reflect.ValueOf(path)
@@ -54,10 +76,44 @@ func registerPlugin(constructor interface{}, options ...interface{}) {
 
 	// Calling our constructor with list of given options
 	plugin := vc.Call(vo)[0].Interface()
+
+	plugins.AddPlugin(plugin, limit)
+	plugins.setPriority(plugin, priority)
+	plugins.transformNamed(plugin, transforms)
+}
+
+// setPriority sets priority of output added the last
+func (plugins *InOutPlugins) setPriority(plugin interface{}, priority outputPriority) {
+	if _, ok := plugin.(io.Writer); ok {
+		plugins.priorities[len(plugins.priorities)-1] = priority
+	}
+}
+
+// pauseOutput pauses or resumes output with given index. Payloads are not written to paused output, and are dropped.
+func (plugins *InOutPlugins) pauseOutput(index int, paused bool) {
+	var value int32
+	if paused {
+		value = 1
+	}
+	atomic.StoreInt32(&plugins.paused[index], value)
+}
+
+// outputPaused tells if output with given index is paused
+func (plugins *InOutPlugins) outputPaused(index int) bool {
+	return index < len(plugins.paused) && atomic.LoadInt32(&plugins.paused[index]) == 1
+}
+
+// AddPlugin adds already initialized plugin. If limit is not blank, plugin gets wrapped into Limiter
+func (plugins *InOutPlugins) AddPlugin(plugin interface{}, limit string) {
 	pluginWrapper := plugin
 
 	if limit != "" {
-		pluginWrapper = NewLimiter(plugin, limit)
+		limiter := NewLimiter(plugin, limit).(*Limiter)
+		plugins.Limiters = append(plugins.Limiters, limiter)
+		if Settings.stats {
+			limiter.stats = NewGorStat("limiter_"+strconv.Itoa(len(plugins.Limiters)), 5000)
+		}
+		pluginWrapper = limiter
 	} else {
 		pluginWrapper = plugin
 	}
@@ -72,6 +128,8 @@ func registerPlugin(constructor interface{}, options ...interface{}) {
 
 	if isW {
 		plugins.Outputs = append(plugins.Outputs, pluginWrapper.(io.Writer))
+		plugins.priorities = append(plugins.priorities, priorityNormal)
+		plugins.paused = append(plugins.paused, 0)
 	}
 
 	plugins.All = append(plugins.All, plugin)
@@ -83,19 +141,23 @@ func InitPlugins() *InOutPlugins {
 	defer pluginMu.Unlock()
 
 	for _, options := range Settings.inputDummy {
-		registerPlugin(NewDummyInput, options)
+		plugins.RegisterPlugin(NewDummyInput, options)
+	}
+
+	for _, options := range Settings.inputGenerator {
+		plugins.RegisterPlugin(NewGeneratorInput, options)
 	}
 
 	for range Settings.outputDummy {
-		registerPlugin(NewDummyOutput)
+		plugins.RegisterPlugin(NewDummyOutput)
 	}
 
 	if Settings.outputStdout {
-		registerPlugin(NewDummyOutput)
+		plugins.RegisterPlugin(NewDummyOutput)
 	}
 
 	if Settings.outputNull {
-		registerPlugin(NewNullOutput)
+		plugins.RegisterPlugin(NewNullOutput, &Settings.outputNullConfig)
 	}
 
 	engine := EnginePcap
@@ -103,30 +165,92 @@ func InitPlugins() *InOutPlugins {
 		engine = EngineRawSocket
 	} else if Settings.inputRAWEngine == "pcap_file" {
 		engine = EnginePcapFile
+	} else if Settings.inputRAWEngine == "ebpf" {
+		engine = EngineEBPF
+	} else if Settings.inputRAWEngine == "af_packet" {
+		engine = EngineAFPacket
+	} else if Settings.inputRAWEngine == "af_xdp" {
+		engine = EngineXDP
 	}
 
 	for _, options := range Settings.inputRAW {
-		registerPlugin(NewRAWInput, options, engine, Settings.inputRAWTrackResponse, Settings.inputRAWExpire, Settings.inputRAWRealIPHeader, Settings.inputRAWBpfFilter, Settings.inputRAWTimestampType, Settings.inputRAWBufferSize)
+		plugins.RegisterPlugin(NewRAWInput, options, engine, Settings.inputRAWTrackResponse, Settings.inputRAWExpire, Settings.inputRAWRealIPHeader, Settings.inputRAWBpfFilter, Settings.inputRAWTimestampType, Settings.inputRAWBufferSize)
 	}
 
 	for _, options := range Settings.inputTCP {
-		registerPlugin(NewTCPInput, options, &Settings.inputTCPConfig)
+		plugins.RegisterPlugin(NewTCPInput, options, &Settings.inputTCPConfig)
 	}
 
 	for _, options := range Settings.outputTCP {
-		registerPlugin(NewTCPOutput, options, &Settings.outputTCPConfig)
+		plugins.RegisterPlugin(NewTCPOutput, options, &Settings.outputTCPConfig)
+	}
+
+	for _, options := range Settings.inputUnix {
+		plugins.RegisterPlugin(NewUnixInput, options, &TCPInputConfig{})
+	}
+
+	for _, options := range Settings.outputUnix {
+		plugins.RegisterPlugin(NewUnixOutput, options, &Settings.outputUnixConfig)
+	}
+
+	for _, options := range Settings.outputUDP {
+		plugins.RegisterPlugin(NewUDPOutput, options, &Settings.outputUDPConfig)
+	}
+
+	for _, options := range Settings.outputDNS {
+		plugins.RegisterPlugin(NewDNSOutput, options, &Settings.outputDNSConfig)
+	}
+
+	for _, options := range Settings.outputMySQL {
+		plugins.RegisterPlugin(NewMySQLOutput, options, &Settings.outputMySQLConfig)
+	}
+
+	for _, options := range Settings.outputPostgres {
+		plugins.RegisterPlugin(NewPostgresOutput, options, &Settings.outputPostgresConfig)
+	}
+
+	for _, options := range Settings.outputRedis {
+		plugins.RegisterPlugin(NewRedisOutput, options, &Settings.outputRedisConfig)
+	}
+
+	for _, options := range Settings.outputMongo {
+		plugins.RegisterPlugin(NewMongoOutput, options, &Settings.outputMongoConfig)
+	}
+
+	for _, options := range Settings.inputAccessLog {
+		plugins.RegisterPlugin(NewAccessLogInput, options, &Settings.inputAccessLogConfig)
+	}
+
+	for _, options := range Settings.inputEnvoyTap {
+		plugins.RegisterPlugin(NewEnvoyTapInput, options, &Settings.inputEnvoyTapConfig)
+	}
+
+	if Settings.inputStdin {
+		plugins.RegisterPlugin(NewStdinInput)
 	}
 
 	for _, options := range Settings.inputFile {
-		registerPlugin(NewFileInput, options, Settings.inputFileLoop)
+		plugins.RegisterPlugin(NewFileInput, options, &Settings.inputFileConfig)
 	}
 
 	for _, options := range Settings.outputFile {
-		registerPlugin(NewFileOutput, options, &Settings.outputFileConfig)
+		plugins.RegisterPlugin(NewFileOutput, options, &Settings.outputFileConfig)
+	}
+
+	for _, options := range Settings.outputParquet {
+		plugins.RegisterPlugin(NewParquetOutput, options, &Settings.outputParquetConfig)
+	}
+
+	for _, options := range Settings.outputClickHouse {
+		plugins.RegisterPlugin(NewClickHouseOutput, options, &Settings.outputClickHouseConfig)
 	}
 
 	for _, options := range Settings.inputHTTP {
-		registerPlugin(NewHTTPInput, options)
+		plugins.RegisterPlugin(NewHTTPInput, options)
+	}
+
+	for _, options := range Settings.inputHTTPProxy {
+		plugins.RegisterPlugin(NewHTTPProxyInput, options, &Settings.inputHTTPProxyConfig)
 	}
 
 	// If we explicitly set Host header http output should not rewrite it
@@ -139,16 +263,66 @@ func InitPlugins() *InOutPlugins {
 	}
 
 	for _, options := range Settings.outputHTTP {
-		registerPlugin(NewHTTPOutput, options, &Settings.outputHTTPConfig)
+		plugins.RegisterPlugin(NewHTTPOutput, options, &Settings.outputHTTPConfig)
 	}
 
 	if Settings.outputKafkaConfig.host != "" && Settings.outputKafkaConfig.topic != "" {
-		registerPlugin(NewKafkaOutput, "", &Settings.outputKafkaConfig)
+		plugins.RegisterPlugin(NewKafkaOutput, "", &Settings.outputKafkaConfig)
 	}
 
 	if Settings.inputKafkaConfig.host != "" && Settings.inputKafkaConfig.topic != "" {
-		registerPlugin(NewKafkaInput, "", &Settings.inputKafkaConfig)
+		plugins.RegisterPlugin(NewKafkaInput, "", &Settings.inputKafkaConfig)
+	}
+
+	for _, options := range Settings.outputPubSub {
+		plugins.RegisterPlugin(NewPubSubOutput, options, &Settings.outputPubSubConfig)
+	}
+
+	for _, options := range Settings.inputPubSub {
+		plugins.RegisterPlugin(NewPubSubInput, options, &Settings.inputPubSubConfig)
+	}
+
+	for _, options := range Settings.outputKinesis {
+		plugins.RegisterPlugin(NewKinesisOutput, options, &Settings.outputKinesisConfig)
+	}
+
+	for _, options := range Settings.inputKinesis {
+		plugins.RegisterPlugin(NewKinesisInput, options, &Settings.inputKinesisConfig)
+	}
+
+	for _, options := range Settings.outputNATS {
+		plugins.RegisterPlugin(NewNATSOutput, options, &Settings.outputNATSConfig)
+	}
+
+	for _, options := range Settings.inputNATS {
+		plugins.RegisterPlugin(NewNATSInput, options, &Settings.inputNATSConfig)
+	}
+
+	for _, options := range Settings.outputAMQP {
+		plugins.RegisterPlugin(NewAMQPOutput, options, &Settings.outputAMQPConfig)
+	}
+
+	for _, options := range Settings.inputAMQP {
+		plugins.RegisterPlugin(NewAMQPInput, options, &Settings.inputAMQPConfig)
+	}
+
+	for _, options := range Settings.outputMQTT {
+		plugins.RegisterPlugin(NewMQTTOutput, options, &Settings.outputMQTTConfig)
+	}
+
+	for _, options := range Settings.outputPulsar {
+		plugins.RegisterPlugin(NewPulsarOutput, options, &Settings.outputPulsarConfig)
+	}
+
+	for _, options := range Settings.inputPulsar {
+		plugins.RegisterPlugin(NewPulsarInput, options, &Settings.inputPulsarConfig)
+	}
+
+	externalPluginsMu.Lock()
+	for _, p := range externalPlugins {
+		p.register(plugins)
 	}
+	externalPluginsMu.Unlock()
 
 	return plugins
 }
@@ -0,0 +1,162 @@
+package goreplay
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"plugin"
+	"sync"
+)
+
+// PluginFactory creates plugin for given address, which is the value of `--input-<name>` or `--output-<name>` flag
+type PluginFactory func(address string) (interface{}, error)
+
+// ExternalPlugin describes plugin which lives outside of Gor source tree.
+// Plugin named "s3" gets enabled using `--input-s3` and `--output-s3` flags,
+// and its own options are namespaced as `--s3-<option>`.
+type ExternalPlugin struct {
+	Name string
+
+	// At least one constructor should be set. Inputs should implement io.Reader, and outputs io.Writer.
+	NewInput  PluginFactory
+	NewOutput PluginFactory
+
+	// Flags holds plugin options, defined without name prefix
+	Flags *flag.FlagSet
+
+	inputs  MultiOption
+	outputs MultiOption
+}
+
+var externalPluginsMu sync.Mutex
+var externalPlugins []*ExternalPlugin
+
+// Flag sets given to RegisterFlags, which get flags of external plugins registered before or after it
+var externalFlagSets []*flag.FlagSet
+
+// RegisterExternalPlugin makes plugin available from the command line. Its flags are defined in flag sets given to
+// RegisterFlags, never in flag.CommandLine directly. It should be called before flags get parsed, usually from
+// `init()` function of plugin package.
+func RegisterExternalPlugin(p *ExternalPlugin) error {
+	externalPluginsMu.Lock()
+	defer externalPluginsMu.Unlock()
+
+	if p.Name == "" {
+		return errors.New("plugin name can't be blank")
+	}
+
+	if p.NewInput == nil && p.NewOutput == nil {
+		return fmt.Errorf("plugin %q should have input or output constructor", p.Name)
+	}
+
+	for _, e := range externalPlugins {
+		if e.Name == p.Name {
+			return fmt.Errorf("plugin %q already registered", p.Name)
+		}
+	}
+
+	var names []string
+	if p.NewInput != nil {
+		names = append(names, "input-"+p.Name)
+	}
+	if p.NewOutput != nil {
+		names = append(names, "output-"+p.Name)
+	}
+	if p.Flags != nil {
+		p.Flags.VisitAll(func(f *flag.Flag) {
+			names = append(names, p.Name+"-"+f.Name)
+		})
+	}
+
+	// flag package panics on redefinition, so checking it upfront. defaultFlags is among flag sets, so flags of Gor
+	// are checked even if RegisterFlags was not called by embedding program yet.
+	for _, name := range names {
+		for _, fs := range externalFlagSets {
+			if fs.Lookup(name) != nil {
+				return fmt.Errorf("plugin %q: flag --%s already defined", p.Name, name)
+			}
+		}
+	}
+
+	for _, fs := range externalFlagSets {
+		p.defineFlags(fs)
+	}
+
+	externalPlugins = append(externalPlugins, p)
+
+	return nil
+}
+
+// registerExternalFlags defines flags of registered external plugins in flag set given to RegisterFlags, and keeps
+// it, so plugins registered later, e.g. by Go plugin loaded while flags are parsed, get their flags defined there too
+func registerExternalFlags(fs *flag.FlagSet) {
+	externalPluginsMu.Lock()
+	defer externalPluginsMu.Unlock()
+
+	for _, p := range externalPlugins {
+		p.defineFlags(fs)
+	}
+	externalFlagSets = append(externalFlagSets, fs)
+}
+
+// defineFlags defines `--input-<name>`, `--output-<name>` and namespaced plugin flags in given flag set
+func (p *ExternalPlugin) defineFlags(fs *flag.FlagSet) {
+	if p.NewInput != nil {
+		fs.Var(&p.inputs, "input-"+p.Name, fmt.Sprintf("Read traffic using external %q plugin", p.Name))
+	}
+
+	if p.NewOutput != nil {
+		fs.Var(&p.outputs, "output-"+p.Name, fmt.Sprintf("Write traffic using external %q plugin", p.Name))
+	}
+
+	if p.Flags != nil {
+		p.Flags.VisitAll(func(f *flag.Flag) {
+			fs.Var(f.Value, p.Name+"-"+f.Name, f.Usage)
+		})
+	}
+}
+
+// register initializes plugin instances for each of plugin flags
+func (p *ExternalPlugin) register(plugins *InOutPlugins) {
+	for _, options := range p.inputs {
+		plugins.addExternalPlugin(p, p.NewInput, options)
+	}
+
+	for _, options := range p.outputs {
+		plugins.addExternalPlugin(p, p.NewOutput, options)
+	}
+}
+
+func (plugins *InOutPlugins) addExternalPlugin(p *ExternalPlugin, factory PluginFactory, options string) {
+	address, priority := extractPriorityOption(options)
+	address, transforms := extractTransformOptions(address)
+	address, limit := extractLimitOptions(address)
+
+	plugin, err := factory(address)
+	if err != nil {
+		log.Fatalf("Can't initialize %q plugin: %v", p.Name, err)
+	}
+
+	plugins.AddPlugin(plugin, limit)
+	plugins.setPriority(plugin, priority)
+	plugins.transformNamed(plugin, transforms)
+}
+
+// GoPlugins loads Go plugins (.so files) right when the flag is parsed,
+// so flags registered by plugin can be used after it on the command line
+type GoPlugins []string
+
+func (p *GoPlugins) String() string {
+	return fmt.Sprint(*p)
+}
+
+// Set opens Go plugin. Plugin should call RegisterExternalPlugin from its `init()` function
+func (p *GoPlugins) Set(path string) error {
+	if _, err := plugin.Open(path); err != nil {
+		return err
+	}
+
+	*p = append(*p, path)
+	return nil
+}
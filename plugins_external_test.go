@@ -0,0 +1,85 @@
+package goreplay
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestExternalPluginRegistration(t *testing.T) {
+	var prefix string
+
+	flags := flag.NewFlagSet("testext", flag.ContinueOnError)
+	flags.StringVar(&prefix, "prefix", "", "Test option")
+
+	p := &ExternalPlugin{
+		Name: "testext",
+		NewInput: func(address string) (interface{}, error) {
+			return NewTestInput(), nil
+		},
+		NewOutput: func(address string) (interface{}, error) {
+			return NewTestOutput(func(data []byte) {}), nil
+		},
+		Flags: flags,
+	}
+
+	if err := RegisterExternalPlugin(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// Global InitPlugins should not pick up test plugin
+	defer func() {
+		externalPluginsMu.Lock()
+		externalPlugins = externalPlugins[:len(externalPlugins)-1]
+		externalPluginsMu.Unlock()
+	}()
+
+	if err := RegisterExternalPlugin(p); err == nil {
+		t.Error("Should not allow registering plugin twice")
+	}
+
+	if err := RegisterExternalPlugin(&ExternalPlugin{Name: "empty"}); err == nil {
+		t.Error("Should require at least one constructor")
+	}
+
+	// Flags are defined in flag sets given to RegisterFlags only
+	if flag.Lookup("input-testext") != nil {
+		t.Error("Plugin flags should not be defined in flag.CommandLine")
+	}
+	if err := RegisterExternalPlugin(&ExternalPlugin{Name: "raw", NewInput: p.NewInput}); err == nil {
+		t.Error("Should not allow flags colliding with flags of Gor")
+	}
+
+	defaultFlags.Set("input-testext", "first")
+	defaultFlags.Set("output-testext", "second|10%")
+
+	// Flag set given to RegisterFlags later gets flags of plugins registered before
+	flags = flag.NewFlagSet("embedded", flag.ContinueOnError)
+	registerExternalFlags(flags)
+	defer func() {
+		externalPluginsMu.Lock()
+		externalFlagSets = externalFlagSets[:len(externalFlagSets)-1]
+		externalPluginsMu.Unlock()
+	}()
+	if err := flags.Parse([]string{"-testext-prefix", "/api"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if prefix != "/api" {
+		t.Error("Plugin options should be namespaced by plugin name", prefix)
+	}
+
+	plugins := NewPlugins()
+	p.register(plugins)
+
+	if len(plugins.Inputs) != 1 {
+		t.Errorf("Should be 1 input %d", len(plugins.Inputs))
+	}
+
+	if len(plugins.Outputs) != 1 {
+		t.Fatalf("Should be 1 output %d", len(plugins.Outputs))
+	}
+
+	if _, ok := plugins.Outputs[0].(*Limiter); !ok {
+		t.Error("Output should be wrapped in limiter")
+	}
+}
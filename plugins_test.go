@@ -1,4 +1,4 @@
-package main
+package goreplay
 
 import (
 	"testing"
@@ -41,3 +41,25 @@ func TestPluginsRegistration(t *testing.T) {
 	}
 
 }
+
+func TestPluginsRegisterPlugin(t *testing.T) {
+	plugins := NewPlugins()
+	plugins.RegisterPlugin(NewTestInput)
+	plugins.RegisterPlugin(NewHTTPOutput, "www.example.com|10%", &HTTPOutputConfig{})
+
+	if len(plugins.Inputs) != 1 {
+		t.Errorf("Should be 1 input %d", len(plugins.Inputs))
+	}
+
+	if len(plugins.Outputs) != 1 {
+		t.Fatalf("Should be 1 output %d", len(plugins.Outputs))
+	}
+
+	if _, ok := plugins.Outputs[0].(*Limiter); !ok {
+		t.Errorf("HTTPOutput should be wrapped in limiter")
+	}
+
+	if len(plugins.All) != 2 {
+		t.Errorf("Should be 2 plugins %d", len(plugins.All))
+	}
+}
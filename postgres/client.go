@@ -0,0 +1,268 @@
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/buger/goreplay/scram"
+)
+
+// Authentication requests supported by client
+const (
+	authCleartextPassword = 3
+	authMD5Password       = 5
+	authSASL              = 10
+	authSASLContinue      = 11
+)
+
+// Config holds connection options
+type Config struct {
+	User     string
+	Password string
+	Database string
+	Timeout  time.Duration
+}
+
+// Conn is a client connection replaying captured commands
+type Conn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	config Config
+}
+
+// Error is an error returned by server
+type Error struct {
+	Severity string
+	Code     string
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("PostgreSQL %s %s: %s", e.Severity, e.Code, e.Message)
+}
+
+func parseError(msg []byte) error {
+	e := new(Error)
+
+	// Fields are identified by single byte, and terminated by zero byte
+	for len(msg) > 1 {
+		field := msg[0]
+		value, rest, ok := cstring(msg[1:])
+		if !ok {
+			break
+		}
+		msg = rest
+
+		switch field {
+		case 'S':
+			e.Severity = value
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		}
+	}
+
+	return e
+}
+
+// Dial connects to server, and authenticates using password, MD5 or SCRAM-SHA-256. Connections are not encrypted.
+func Dial(address string, config Config) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{conn: conn, r: bufio.NewReader(conn), config: config}
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+
+	if err = c.startup(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Conn) startup() error {
+	msg := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[4:], protocolVersion)
+
+	msg = append(append(msg, "user\x00"...), c.config.User+"\x00"...)
+	if c.config.Database != "" {
+		msg = append(append(msg, "database\x00"...), c.config.Database+"\x00"...)
+	}
+	msg = append(msg, 0)
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)))
+
+	if _, err := c.conn.Write(msg); err != nil {
+		return err
+	}
+
+	var sasl *scram.Client
+
+	for {
+		typ, msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case msgErrorResponse:
+			return parseError(msg)
+		case msgReadyForQuery:
+			return nil
+		case msgAuthentication:
+		default:
+			// Parameter status, backend key data and notices
+			continue
+		}
+
+		if len(msg) < 4 {
+			return ErrMalformed
+		}
+
+		var resp []byte
+
+		switch code := binary.BigEndian.Uint32(msg); code {
+		case authOK:
+			continue
+		case authCleartextPassword:
+			resp = []byte(c.config.Password + "\x00")
+		case authMD5Password:
+			if len(msg) < 8 {
+				return ErrMalformed
+			}
+			resp = []byte(md5Password(c.config.User, c.config.Password, msg[4:8]) + "\x00")
+		case authSASL:
+			if !bytes.Contains(msg[4:], []byte(scram.Mechanism+"\x00")) {
+				return errors.New("PostgreSQL server does not support SCRAM-SHA-256 authentication")
+			}
+
+			// Server takes user name from startup message
+			if sasl, err = scram.NewClient("", c.config.Password); err != nil {
+				return err
+			}
+
+			first := sasl.ClientFirst()
+			resp = append([]byte(scram.Mechanism+"\x00"), 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(resp[len(resp)-4:], uint32(len(first)))
+			resp = append(resp, first...)
+		case authSASLContinue:
+			if sasl == nil {
+				return ErrMalformed
+			}
+			if resp, err = sasl.ClientFinal(msg[4:]); err != nil {
+				return err
+			}
+		case authSASLFinal:
+			if sasl == nil || !sasl.Verify(msg[4:]) {
+				return errors.New("PostgreSQL server signature is not valid")
+			}
+			continue
+		default:
+			return fmt.Errorf("PostgreSQL authentication method %d is not supported", code)
+		}
+
+		if _, err = c.conn.Write(AppendMessage(nil, msgPasswordOrSASL, resp)); err != nil {
+			return err
+		}
+	}
+}
+
+func md5Password(user, password string, salt []byte) string {
+	h := md5.Sum([]byte(password + user))
+	h = md5.Sum(append([]byte(hex.EncodeToString(h[:])), salt...))
+
+	return "md5" + hex.EncodeToString(h[:])
+}
+
+func (c *Conn) readMessage() (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := int(binary.BigEndian.Uint32(header[1:]))
+	if length < 4 {
+		return 0, nil, ErrMalformed
+	}
+
+	msg := make([]byte, length-4)
+	if _, err := io.ReadFull(c.r, msg); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], msg, nil
+}
+
+// readResponse reads messages until server is ready for the next query, and returns them
+func (c *Conn) readResponse() ([]byte, error) {
+	var resp []byte
+
+	for {
+		typ, msg, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		resp = AppendMessage(resp, typ, msg)
+
+		switch typ {
+		case msgReadyForQuery:
+			return resp, nil
+		case msgCopyInResponse:
+			// Captured data sent by COPY FROM STDIN is not replayed
+			if _, err = c.conn.Write(AppendMessage(nil, msgCopyFail, []byte("COPY is not replayed\x00"))); err != nil {
+				return nil, err
+			}
+		case msgCopyBothResponse:
+			return nil, errors.New("PostgreSQL replication protocol is not supported")
+		}
+	}
+}
+
+// Exec replays command, and returns raw server response. Errors returned by server are returned as response.
+// Statements are prepared as unnamed for each execution.
+func (c *Conn) Exec(cmd *Command) ([]byte, error) {
+	if c.config.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	}
+
+	var batch []byte
+
+	if cmd.Type == CommandQuery {
+		batch = AppendMessage(batch, msgQuery, []byte(cmd.SQL+"\x00"))
+	} else {
+		parse := append([]byte("\x00"+cmd.SQL+"\x00"), byte(len(cmd.Types)>>8), byte(len(cmd.Types)))
+		for _, oid := range cmd.Types {
+			parse = append(parse, byte(oid>>24), byte(oid>>16), byte(oid>>8), byte(oid))
+		}
+
+		batch = AppendMessage(batch, msgParse, parse)
+		batch = AppendMessage(batch, msgBind, append([]byte{0, 0}, cmd.Params...))
+		batch = AppendMessage(batch, msgExecute, []byte{0, 0, 0, 0, 0})
+		batch = AppendMessage(batch, msgSync, nil)
+	}
+
+	if _, err := c.conn.Write(batch); err != nil {
+		return nil, err
+	}
+
+	return c.readResponse()
+}
+
+// Close sends Terminate, and closes connection
+func (c *Conn) Close() error {
+	c.conn.Write(AppendMessage(nil, msgTerminate, nil))
+	return c.conn.Close()
+}
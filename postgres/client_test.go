@@ -0,0 +1,121 @@
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer accepts single connection authenticated with MD5 password, and answers requests with canned responses
+func startServer(t *testing.T, requests chan<- []byte) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := messages("ZI")
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		header := make([]byte, 4)
+		io.ReadFull(r, header)
+		startup := make([]byte, binary.BigEndian.Uint32(header)-4)
+		io.ReadFull(r, startup)
+		requests <- startup
+
+		conn.Write(messages(authentication(authMD5Password, "salt")))
+
+		c := &Conn{r: r}
+		if _, msg, _ := c.readMessage(); string(msg) != md5Password("app", "secret", []byte("salt"))+"\x00" {
+			conn.Write(messages("ESFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"))
+			return
+		}
+		conn.Write(messages(authentication(authOK, ""), "Sclient_encoding\x00UTF8\x00", "ZI"))
+
+		for {
+			var batch []byte
+			for {
+				typ, msg, err := c.readMessage()
+				if err != nil || typ == msgTerminate {
+					return
+				}
+				batch = AppendMessage(batch, typ, msg)
+				if typ == msgQuery || typ == msgSync || typ == msgCopyFail {
+					break
+				}
+			}
+			requests <- batch
+
+			switch {
+			case bytes.Contains(batch, []byte("STDIN")):
+				conn.Write(messages("G\x00\x00\x00"))
+			case batch[0] == msgCopyFail:
+				conn.Write(append(messages("ESERROR\x00C57014\x00MCOPY is not replayed\x00\x00"), ready...))
+			default:
+				conn.Write(append(messages("CSELECT 1\x00"), ready...))
+			}
+		}
+	}()
+
+	return ln
+}
+
+func TestClient(t *testing.T) {
+	requests := make(chan []byte, 10)
+	ln := startServer(t, requests)
+	defer ln.Close()
+
+	conn, err := Dial(ln.Addr().String(), Config{User: "app", Password: "secret", Database: "shop", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := <-requests; string(p) != "\x00\x03\x00\x00user\x00app\x00database\x00shop\x00\x00" {
+		t.Errorf("Wrong startup message: %q", p)
+	}
+
+	resp, err := conn.Exec(&Command{Type: CommandQuery, SQL: "SELECT 1"})
+	if err != nil || string(resp) != string(messages("CSELECT 1\x00", "ZI")) {
+		t.Fatalf("Wrong response: %q %v", resp, err)
+	}
+	if p := <-requests; string(p) != string(messages("QSELECT 1\x00")) {
+		t.Errorf("Wrong query: %q", p)
+	}
+
+	params := []byte("\x00\x00\x00\x01\x00\x00\x00\x0242\x00\x00")
+	if _, err = conn.Exec(&Command{Type: CommandExecute, SQL: "SELECT $1", Types: []uint32{23}, Params: params}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := messages("P\x00SELECT $1\x00\x00\x01\x00\x00\x00\x17", "B\x00\x00"+string(params), "E\x00\x00\x00\x00\x00", "S")
+	if p := <-requests; string(p) != string(expected) {
+		t.Errorf("Wrong batch: %q", p)
+	}
+
+	// Data of COPY FROM STDIN is not captured, so it is cancelled
+	if resp, err = conn.Exec(&Command{Type: CommandQuery, SQL: "COPY t FROM STDIN"}); err != nil || !bytes.HasSuffix(resp, []byte("COPY is not replayed\x00\x00Z\x00\x00\x00\x05I")) {
+		t.Errorf("Should cancel COPY: %q %v", resp, err)
+	}
+
+	conn.Close()
+}
+
+func TestClientAuthenticationFailed(t *testing.T) {
+	ln := startServer(t, make(chan []byte, 10))
+	defer ln.Close()
+
+	_, err := Dial(ln.Addr().String(), Config{User: "app", Password: "wrong", Timeout: time.Second})
+	if e, ok := err.(*Error); !ok || e.Code != "28P01" || e.Message != "password authentication failed" {
+		t.Error("Should return server error", err)
+	}
+}
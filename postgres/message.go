@@ -0,0 +1,199 @@
+// Package postgres implements parts of PostgreSQL frontend/backend protocol needed to capture and replay client sessions.
+// See https://www.postgresql.org/docs/current/protocol.html
+package postgres
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Codes of messages sent by client without type byte, at the start of connection
+const (
+	protocolVersion = 196608
+	cancelRequest   = 80877102
+	sslRequest      = 80877103
+	gssencRequest   = 80877104
+)
+
+// Types of messages sent by client
+const (
+	msgBind           = 'B'
+	msgClose          = 'C'
+	msgCopyDone       = 'c'
+	msgCopyFail       = 'f'
+	msgExecute        = 'E'
+	msgFunctionCall   = 'F'
+	msgParse          = 'P'
+	msgPasswordOrSASL = 'p'
+	msgQuery          = 'Q'
+	msgSync           = 'S'
+	msgTerminate      = 'X'
+)
+
+// Types of messages sent by server
+const (
+	msgAuthentication   = 'R'
+	msgCopyInResponse   = 'G'
+	msgCopyBothResponse = 'W'
+	msgErrorResponse    = 'E'
+	msgReadyForQuery    = 'Z'
+)
+
+// Authentication responses which are followed by more messages without waiting for client
+const (
+	authOK        = 0
+	authSASLFinal = 12
+)
+
+// ErrMalformed returned if message does not follow protocol
+var ErrMalformed = errors.New("malformed PostgreSQL message")
+
+// MessageLength returns length of the first typed message in data including type and length, or -1 if it is not complete
+func MessageLength(data []byte) int {
+	if len(data) < 5 {
+		return -1
+	}
+
+	length := int(binary.BigEndian.Uint32(data[1:5]))
+	if length < 4 || len(data) < 1+length {
+		return -1
+	}
+
+	return 1 + length
+}
+
+// isStartup checks if data starts with message sent before protocol version is established: startup message,
+// SSL or GSS encryption request, or cancel request. They have no type byte, and are short, so length starts with zero byte.
+func isStartup(data []byte) bool {
+	return len(data) > 0 && data[0] == 0
+}
+
+func startupLength(data []byte) int {
+	if len(data) < 8 {
+		return -1
+	}
+
+	length := int(binary.BigEndian.Uint32(data))
+	if length < 8 || len(data) < length {
+		return -1
+	}
+
+	return length
+}
+
+func startupCode(data []byte) uint32 {
+	if len(data) < 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(data[4:8])
+}
+
+// RequestLength returns length of messages sent by client before it waits for response, or -1 if they are not complete.
+// Messages of extended query protocol are sent in batches ending with Sync.
+func RequestLength(data []byte) int {
+	if isStartup(data) {
+		return startupLength(data)
+	}
+
+	offset := 0
+	for {
+		n := MessageLength(data[offset:])
+		if n == -1 {
+			return -1
+		}
+
+		typ := data[offset]
+		offset += n
+
+		switch typ {
+		case msgQuery, msgSync, msgTerminate, msgFunctionCall, msgPasswordOrSASL, msgCopyDone, msgCopyFail:
+			return offset
+		}
+	}
+}
+
+// HasResponse returns false for requests which server does not answer
+func HasResponse(req []byte) bool {
+	if isStartup(req) {
+		return startupCode(req) != cancelRequest
+	}
+
+	return lastMessageType(req) != msgTerminate
+}
+
+// ResponseLength returns length of server response to request, or -1 if it is not complete. Server answers queries
+// with ReadyForQuery, and during authentication it waits for client once it requests password or fails.
+func ResponseLength(req []byte, data []byte) int {
+	startup := isStartup(req)
+
+	if startup {
+		switch startupCode(req) {
+		case sslRequest, gssencRequest:
+			// Single byte: S if server accepts encryption, or N
+			if len(data) == 0 {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	auth := startup || lastMessageType(req) == msgPasswordOrSASL
+
+	offset := 0
+	for {
+		n := MessageLength(data[offset:])
+		if n == -1 {
+			return -1
+		}
+
+		typ := data[offset]
+		msg := data[offset+5 : offset+n]
+		offset += n
+
+		switch {
+		case typ == msgReadyForQuery, typ == msgCopyInResponse, typ == msgCopyBothResponse:
+			return offset
+		case auth && typ == msgErrorResponse:
+			return offset
+		case auth && typ == msgAuthentication && len(msg) >= 4:
+			if code := binary.BigEndian.Uint32(msg); code != authOK && code != authSASLFinal {
+				return offset
+			}
+		}
+	}
+}
+
+// lastMessageType returns type of the last message in request
+func lastMessageType(req []byte) byte {
+	var typ byte
+
+	for offset := 0; ; {
+		n := MessageLength(req[offset:])
+		if n == -1 {
+			return typ
+		}
+
+		typ = req[offset]
+		offset += n
+	}
+}
+
+// cstring reads zero terminated string
+func cstring(b []byte) (string, []byte, bool) {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i]), b[i+1:], true
+		}
+	}
+
+	return "", nil, false
+}
+
+// AppendMessage appends typed message
+func AppendMessage(b []byte, typ byte, payload []byte) []byte {
+	b = append(b, typ, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(4+len(payload)))
+
+	return append(b, payload...)
+}
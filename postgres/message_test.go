@@ -0,0 +1,93 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func startupMessage(code uint32, params ...string) []byte {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint32(msg[4:], code)
+	for _, p := range params {
+		msg = append(msg, p+"\x00"...)
+	}
+	if len(params) > 0 {
+		msg = append(msg, 0)
+	}
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)))
+
+	return msg
+}
+
+func messages(msgs ...string) []byte {
+	var b []byte
+	for _, m := range msgs {
+		b = AppendMessage(b, m[0], []byte(m[1:]))
+	}
+	return b
+}
+
+func authentication(code uint32, data string) string {
+	msg := []byte{'R', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], code)
+	return string(msg) + data
+}
+
+func TestRequestLength(t *testing.T) {
+	startup := startupMessage(protocolVersion, "user", "app")
+
+	cases := []struct {
+		name     string
+		data     []byte
+		expected int
+	}{
+		{"startup", append(startup, 'Q'), len(startup)},
+		{"incomplete startup", startup[:10], -1},
+		{"query", messages("QSELECT 1\x00", "X"), 14},
+		{"batch", messages("P\x00SELECT $1\x00\x00\x00", "B\x00\x00\x00\x00\x00\x00\x00\x00", "E\x00\x00\x00\x00\x00", "S", "Q"), 46},
+		{"incomplete batch", messages("P\x00SELECT $1\x00\x00\x00", "B\x00\x00\x00\x00\x00\x00\x00\x00"), -1},
+		{"password", messages("pmd5abc\x00"), 12},
+	}
+
+	for _, c := range cases {
+		if n := RequestLength(c.data); n != c.expected {
+			t.Errorf("%s: expected %d, got %d", c.name, c.expected, n)
+		}
+	}
+
+	if HasResponse(messages("X")) || HasResponse(startupMessage(cancelRequest)) || !HasResponse(messages("QSELECT 1\x00")) {
+		t.Error("Terminate and cancel request have no response")
+	}
+}
+
+func TestResponseLength(t *testing.T) {
+	query := messages("QSELECT 1\x00")
+	result := []string{"T\x00\x01a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x17\x00\x04\xff\xff\xff\xff\x00\x00", "D\x00\x01\x00\x00\x00\x011", "CSELECT 1\x00", "ZI"}
+
+	cases := []struct {
+		name     string
+		req      []byte
+		data     []byte
+		expected int
+	}{
+		{"query", query, messages(result...), -2},
+		{"incomplete query", query, messages(result[:3]...), -1},
+		{"copy", messages("QCOPY t FROM STDIN\x00"), messages("G\x00\x00\x00"), -2},
+		{"ssl", startupMessage(sslRequest), []byte("N"), 1},
+		{"password requested", startupMessage(protocolVersion, "user", "app"), messages(authentication(authMD5Password, "salt")), -2},
+		{"authenticated", messages("pmd5abc\x00"), messages(authentication(authOK, ""), "Sclient_encoding\x00UTF8\x00", "K\x00\x00\x00\x01\x00\x00\x00\x02", "ZI"), -2},
+		{"sasl final", messages("pproof\x00"), messages(authentication(authSASLFinal, "v=sig"), authentication(authOK, "")), -1},
+		{"failed", startupMessage(protocolVersion, "user", "app"), messages("ESFATAL\x00C28P01\x00\x00"), -2},
+	}
+
+	for _, c := range cases {
+		expected := c.expected
+		if expected == -2 {
+			expected = len(c.data)
+		}
+
+		if n := ResponseLength(c.req, c.data); n != expected {
+			t.Errorf("%s: expected %d, got %d", c.name, expected, n)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package postgres
+
+import (
+	"strings"
+)
+
+// Statements which start with these keywords do not modify data, unless they use one of writeKeywords
+var readOnlyKeywords = map[string]bool{
+	"SELECT":  true,
+	"SHOW":    true,
+	"EXPLAIN": true,
+	"WITH":    true,
+	"VALUES":  true,
+	"TABLE":   true,
+}
+
+// SELECT ... INTO creates table, and SELECT ... FOR UPDATE/SHARE locks rows. WITH and EXPLAIN ANALYZE
+// can run data modifying statements.
+var writeKeywords = map[string]bool{
+	"INTO":    true,
+	"INSERT":  true,
+	"UPDATE":  true,
+	"DELETE":  true,
+	"MERGE":   true,
+	"SHARE":   true,
+	"NOWAIT":  true,
+	"LOCKED":  true,
+	"EXECUTE": true,
+}
+
+// IsReadOnly checks if SQL is a single statement which only reads data. Functions with side effects can't be detected,
+// so replay against read-only standby for certainty.
+func IsReadOnly(sql string) bool {
+	first := true
+	end := false
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f':
+			i++
+			continue
+		case strings.HasPrefix(sql[i:], "--"):
+			if n := strings.IndexByte(sql[i:], '\n'); n != -1 {
+				i += n + 1
+			} else {
+				i = len(sql)
+			}
+			continue
+		case strings.HasPrefix(sql[i:], "/*"):
+			n := blockComment(sql[i:])
+			if n == -1 {
+				return false
+			}
+			i += n
+			continue
+		}
+
+		// Only whitespace and comments can follow the last statement
+		if end {
+			return false
+		}
+
+		switch {
+		case c == ';':
+			end = true
+			i++
+		case c == '\'' || c == '"':
+			n := quoted(sql[i:], c, false)
+			if n == -1 {
+				return false
+			}
+			i += n
+		case c == '$' && dollarTag(sql[i:]) != "":
+			tag := dollarTag(sql[i:])
+			n := strings.Index(sql[i+len(tag):], tag)
+			if n == -1 {
+				return false
+			}
+			i += n + 2*len(tag)
+		case isIdentifier(c):
+			n := i
+			for n < len(sql) && (isIdentifier(sql[n]) || sql[n] == '$') {
+				n++
+			}
+
+			word := strings.ToUpper(sql[i:n])
+
+			// Backslash escapes are allowed only in E'...' strings
+			if word == "E" && n < len(sql) && sql[n] == '\'' {
+				m := quoted(sql[n:], '\'', true)
+				if m == -1 {
+					return false
+				}
+				i = n + m
+				continue
+			}
+
+			if first && !readOnlyKeywords[word] || writeKeywords[word] {
+				return false
+			}
+
+			first = false
+			i = n
+		default:
+			if first {
+				return false
+			}
+			i++
+		}
+	}
+
+	return !first
+}
+
+// blockComment returns length of comment, comments can be nested. -1 is returned if it is not terminated.
+func blockComment(s string) int {
+	depth := 0
+
+	for i := 0; i+1 < len(s); i++ {
+		switch {
+		case s[i] == '/' && s[i+1] == '*':
+			depth++
+			i++
+		case s[i] == '*' && s[i+1] == '/':
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+
+	return -1
+}
+
+// quoted returns length of quoted string or identifier, or -1 if it is not terminated
+func quoted(s string, quote byte, escapes bool) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if escapes {
+				i++
+			}
+		case quote:
+			// Quote is escaped by doubling it
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// dollarTag returns opening tag of dollar-quoted string, e.g. $$ or $body$, or empty string
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '$':
+			return s[:i+1]
+		case !isIdentifier(s[i]) || i == 1 && s[i] >= '0' && s[i] <= '9':
+			// $1 is a parameter
+			return ""
+		}
+	}
+
+	return ""
+}
+
+func isIdentifier(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c >= 0x80
+}
@@ -0,0 +1,39 @@
+package postgres
+
+import (
+	"testing"
+)
+
+func TestIsReadOnly(t *testing.T) {
+	cases := []struct {
+		sql      string
+		expected bool
+	}{
+		{"SELECT * FROM users WHERE id = $1", true},
+		{"  select name from \"delete\" where note = 'update; it''s' -- comment", true},
+		{"/* report /* nested */ */ SHOW search_path;", true},
+		{"EXPLAIN SELECT 1", true},
+		{"WITH t AS (SELECT 1) SELECT * FROM t", true},
+		{"VALUES (1), (2)", true},
+		{"SELECT $$;DELETE$$, $body$ ' $body$, E'it\\'s'", true},
+		{"SELECT date'2020-01-01', 'a\\'", true},
+		{"UPDATE users SET name = 'a'", false},
+		{"SELECT * INTO backup FROM users", false},
+		{"SELECT * FROM users FOR UPDATE", false},
+		{"SELECT * FROM users FOR SHARE", false},
+		{"SELECT 1; DELETE FROM users", false},
+		{"WITH t AS (DELETE FROM users RETURNING *) SELECT * FROM t", false},
+		{"EXPLAIN ANALYZE UPDATE users SET name = 'a'", false},
+		{"SELECT $tag$unterminated", false},
+		{"SELECT 1 /* unterminated /* */", false},
+		{"E'SELECT'", false},
+		{"-- only comment", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if IsReadOnly(c.sql) != c.expected {
+			t.Errorf("%q: expected %v", c.sql, c.expected)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of replayed commands
+const (
+	CommandQuery   = "Query"
+	CommandExecute = "Execute"
+)
+
+// ErrUnknownStatement returned if statement or portal was created before capture started
+var ErrUnknownStatement = errors.New("statement was prepared before capture started")
+
+// Command is a client command which can be replayed: simple query, or execution of statement using extended query protocol.
+//
+// It is written as text, similar to HTTP message:
+//
+//	Execute\r\n
+//	Connection: 10.0.0.1:51234\r\n
+//	Database: shop\r\n
+//	Types: 23\r\n
+//	Params: 000100010001000000040000002a0000\r\n
+//	\r\n
+//	SELECT * FROM orders WHERE id = $1
+type Command struct {
+	// CommandQuery or CommandExecute
+	Type string
+	// Client connection, commands of the same connection should be replayed in order using single connection
+	Connection string
+	// Database client connected to
+	Database string
+	// Simple query, or SQL of prepared statement
+	SQL string
+	// Execute: OIDs of parameter types specified by client, zero if type is inferred by server
+	Types []uint32
+	// Execute: parameter format codes, parameter values, and result format codes, as sent in Bind message
+	Params []byte
+}
+
+// MarshalText writes command as text
+func (c *Command) MarshalText() ([]byte, error) {
+	var b bytes.Buffer
+
+	b.WriteString(c.Type + "\r\n")
+	b.WriteString("Connection: " + c.Connection + "\r\n")
+	if c.Database != "" {
+		b.WriteString("Database: " + c.Database + "\r\n")
+	}
+	if c.Type == CommandExecute {
+		if len(c.Types) > 0 {
+			types := make([]string, len(c.Types))
+			for i, oid := range c.Types {
+				types[i] = strconv.FormatUint(uint64(oid), 10)
+			}
+			b.WriteString("Types: " + strings.Join(types, ",") + "\r\n")
+		}
+		b.WriteString("Params: " + hex.EncodeToString(c.Params) + "\r\n")
+	}
+	b.WriteString("\r\n")
+	b.WriteString(c.SQL)
+
+	return b.Bytes(), nil
+}
+
+// UnmarshalText parses command written by MarshalText
+func (c *Command) UnmarshalText(data []byte) error {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end == -1 {
+		return ErrMalformed
+	}
+
+	lines := strings.Split(string(data[:end]), "\r\n")
+	*c = Command{Type: lines[0], SQL: string(data[end+4:])}
+
+	if c.Type != CommandQuery && c.Type != CommandExecute {
+		return ErrMalformed
+	}
+
+	for _, line := range lines[1:] {
+		i := strings.Index(line, ": ")
+		if i == -1 {
+			return ErrMalformed
+		}
+
+		value := line[i+2:]
+		switch line[:i] {
+		case "Connection":
+			c.Connection = value
+		case "Database":
+			c.Database = value
+		case "Types":
+			for _, t := range strings.Split(value, ",") {
+				oid, err := strconv.ParseUint(t, 10, 32)
+				if err != nil {
+					return ErrMalformed
+				}
+				c.Types = append(c.Types, uint32(oid))
+			}
+		case "Params":
+			params, err := hex.DecodeString(value)
+			if err != nil {
+				return ErrMalformed
+			}
+			c.Params = params
+		}
+	}
+
+	// Counts of parameter formats, parameters, and result formats
+	if c.Type == CommandExecute && len(c.Params) < 6 {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+type statement struct {
+	sql   string
+	types []uint32
+}
+
+type portal struct {
+	statement *statement
+	params    []byte
+}
+
+// Session is a state of client connection needed to replay its commands
+type Session struct {
+	database   string
+	statements map[string]*statement
+	portals    map[string]*portal
+	lastSeen   time.Time
+}
+
+// Sessions tracks state of captured client connections. It is not safe for concurrent use.
+type Sessions struct {
+	sessions map[string]*Session
+	// Sessions without commands for this time are forgotten
+	timeout    time.Duration
+	lastExpire time.Time
+}
+
+// NewSessions constructor for Sessions
+func NewSessions(timeout time.Duration) *Sessions {
+	return &Sessions{
+		sessions: make(map[string]*Session),
+		timeout:  timeout,
+	}
+}
+
+// Len returns number of tracked sessions
+func (s *Sessions) Len() int {
+	return len(s.sessions)
+}
+
+func newSession() *Session {
+	return &Session{
+		statements: make(map[string]*statement),
+		portals:    make(map[string]*portal),
+	}
+}
+
+func (s *Sessions) session(conn string, ts time.Time) *Session {
+	session, ok := s.sessions[conn]
+	if !ok {
+		session = newSession()
+		s.sessions[conn] = session
+	}
+	session.lastSeen = ts
+
+	if ts.Sub(s.lastExpire) >= time.Minute {
+		s.lastExpire = ts
+		for id, other := range s.sessions {
+			if ts.Sub(other.lastSeen) >= s.timeout {
+				delete(s.sessions, id)
+			}
+		}
+	}
+
+	return session
+}
+
+// Request updates state of the session with messages sent by client, and returns commands which can be replayed.
+// Batch of extended query protocol can contain multiple executions. Statements and portals not known to session
+// are skipped, and ErrUnknownStatement is returned together with the rest of commands.
+func (s *Sessions) Request(conn string, data []byte, ts time.Time) ([]*Command, error) {
+	session := s.session(conn, ts)
+
+	cmds, err := session.request(data)
+	for _, cmd := range cmds {
+		cmd.Connection = conn
+	}
+
+	// Session ends once client sends Terminate
+	if !isStartup(data) && lastMessageType(data) == msgTerminate {
+		delete(s.sessions, conn)
+	}
+
+	return cmds, err
+}
+
+func (session *Session) request(data []byte) (cmds []*Command, err error) {
+	if isStartup(data) {
+		if startupCode(data) == protocolVersion {
+			session.parseStartup(data[8:])
+		}
+		return nil, nil
+	}
+
+	for len(data) > 0 {
+		n := MessageLength(data)
+		if n == -1 {
+			return cmds, ErrMalformed
+		}
+
+		typ, msg := data[0], data[5:n]
+		data = data[n:]
+
+		switch typ {
+		case msgQuery:
+			sql, _, ok := cstring(msg)
+			if !ok {
+				return cmds, ErrMalformed
+			}
+			cmds = append(cmds, &Command{Type: CommandQuery, Database: session.database, SQL: sql})
+		case msgParse:
+			name, rest, ok := cstring(msg)
+			if !ok {
+				return cmds, ErrMalformed
+			}
+			sql, rest, ok := cstring(rest)
+			if !ok || len(rest) < 2 {
+				return cmds, ErrMalformed
+			}
+
+			count := int(binary.BigEndian.Uint16(rest))
+			if len(rest) < 2+4*count {
+				return cmds, ErrMalformed
+			}
+
+			st := &statement{sql: sql}
+			for i := 0; i < count; i++ {
+				st.types = append(st.types, binary.BigEndian.Uint32(rest[2+4*i:]))
+			}
+			session.statements[name] = st
+		case msgBind:
+			name, rest, ok := cstring(msg)
+			if !ok {
+				return cmds, ErrMalformed
+			}
+			stName, params, ok := cstring(rest)
+			if !ok {
+				return cmds, ErrMalformed
+			}
+
+			st, ok := session.statements[stName]
+			if !ok {
+				delete(session.portals, name)
+				err = ErrUnknownStatement
+				continue
+			}
+			session.portals[name] = &portal{statement: st, params: append([]byte(nil), params...)}
+		case msgExecute:
+			name, _, ok := cstring(msg)
+			if !ok {
+				return cmds, ErrMalformed
+			}
+
+			p, ok := session.portals[name]
+			if !ok {
+				err = ErrUnknownStatement
+				continue
+			}
+
+			cmds = append(cmds, &Command{Type: CommandExecute, Database: session.database, SQL: p.statement.sql, Types: p.statement.types, Params: p.params})
+		case msgClose:
+			if len(msg) < 2 {
+				return cmds, ErrMalformed
+			}
+
+			name, _, _ := cstring(msg[1:])
+			if msg[0] == 'S' {
+				delete(session.statements, name)
+			} else {
+				delete(session.portals, name)
+			}
+		}
+	}
+
+	return cmds, err
+}
+
+// parseStartup reads database from parameters of startup message, it defaults to user name
+func (session *Session) parseStartup(params []byte) {
+	var user string
+
+	for {
+		name, rest, ok := cstring(params)
+		if !ok || name == "" {
+			break
+		}
+		value, rest, ok := cstring(rest)
+		if !ok {
+			break
+		}
+		params = rest
+
+		switch name {
+		case "user":
+			user = value
+		case "database":
+			session.database = value
+		}
+	}
+
+	if session.database == "" {
+		session.database = user
+	}
+}
@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	sessions := NewSessions(time.Hour)
+	now := time.Now()
+	conn := "10.0.0.1:51234"
+
+	if cmds, err := sessions.Request(conn, startupMessage(protocolVersion, "user", "app", "database", "shop"), now); cmds != nil || err != nil {
+		t.Fatal("Startup should not be replayed", cmds, err)
+	}
+
+	cmds, err := sessions.Request(conn, messages("QSELECT 1\x00"), now)
+	if err != nil || len(cmds) != 1 || cmds[0].Type != CommandQuery || cmds[0].Database != "shop" || cmds[0].SQL != "SELECT 1" || cmds[0].Connection != conn {
+		t.Fatal("Wrong query", cmds, err)
+	}
+
+	// Named statement is executed twice in the same batch, with integer parameter in binary format
+	params := "\x00\x01\x00\x01\x00\x01\x00\x00\x00\x04\x00\x00\x00\x2a\x00\x00"
+	batch := messages(
+		"Pfind\x00SELECT * FROM items WHERE id = $1\x00\x00\x01\x00\x00\x00\x17",
+		"B\x00find\x00"+params,
+		"E\x00\x00\x00\x00\x00",
+		"Bp1\x00find\x00"+params,
+		"Ep1\x00\x00\x00\x00\x00",
+		"S",
+	)
+
+	cmds, err = sessions.Request(conn, batch, now)
+	expected := &Command{Type: CommandExecute, Connection: conn, Database: "shop", SQL: "SELECT * FROM items WHERE id = $1", Types: []uint32{23}, Params: []byte(params)}
+	if err != nil || len(cmds) != 2 || !reflect.DeepEqual(cmds[0], expected) || !reflect.DeepEqual(cmds[1], expected) {
+		t.Fatal("Wrong executions", cmds, err)
+	}
+
+	// Statement is closed at the end of batch, but is still used by it
+	batch = messages("B\x00find\x00"+params, "E\x00\x00\x00\x00\x00", "CSfind\x00", "S")
+	if cmds, _ = sessions.Request(conn, batch, now); len(cmds) != 1 {
+		t.Error("Should use statement before it is closed", cmds)
+	}
+
+	if _, err = sessions.Request(conn, messages("B\x00find\x00"+params, "E\x00\x00\x00\x00\x00", "S"), now); err != ErrUnknownStatement {
+		t.Error("Statement should be closed", err)
+	}
+
+	sessions.Request(conn, messages("X"), now)
+	if sessions.Len() != 0 {
+		t.Error("Session should be closed")
+	}
+
+	// Queries of connections established before capture started can be replayed, but not their prepared statements
+	if cmds, _ = sessions.Request("10.0.0.2:4000", messages("QSELECT 2\x00"), now); len(cmds) != 1 || cmds[0].Database != "" {
+		t.Error("Should replay query", cmds)
+	}
+
+	sessions.Request("10.0.0.3:4000", messages("QSELECT 3\x00"), now)
+	if _, err = sessions.Request("10.0.0.2:4000", messages("Bp1\x00find\x00"+params, "Ep1\x00\x00\x00\x00\x00", "S"), now.Add(2*time.Hour)); err != ErrUnknownStatement {
+		t.Error("Statement should be unknown", err)
+	}
+	if sessions.Len() != 1 {
+		t.Error("Idle session should expire", sessions.Len())
+	}
+}
+
+func TestSessionsDefaultDatabase(t *testing.T) {
+	sessions := NewSessions(time.Hour)
+
+	sessions.Request("10.0.0.1:51234", startupMessage(protocolVersion, "user", "app"), time.Now())
+	if cmds, _ := sessions.Request("10.0.0.1:51234", messages("QSELECT 1\x00"), time.Now()); cmds[0].Database != "app" {
+		t.Error("Database should default to user name", cmds[0])
+	}
+}
+
+func TestCommandText(t *testing.T) {
+	cmd := &Command{Type: CommandExecute, Connection: "10.0.0.1:51234", Database: "shop", SQL: "SELECT $1\r\n\r\nFROM t", Types: []uint32{23, 0}, Params: []byte{0, 0, 0, 0, 0, 0}}
+
+	text, _ := cmd.MarshalText()
+	if string(text) != "Execute\r\nConnection: 10.0.0.1:51234\r\nDatabase: shop\r\nTypes: 23,0\r\nParams: 000000000000\r\n\r\nSELECT $1\r\n\r\nFROM t" {
+		t.Errorf("Wrong text: %q", text)
+	}
+
+	decoded := new(Command)
+	if err := decoded.UnmarshalText(text); err != nil || !reflect.DeepEqual(decoded, cmd) {
+		t.Error("Wrong command", decoded, err)
+	}
+
+	for _, text := range []string{"Query\r\nConnection: a", "GET / HTTP/1.1\r\n\r\n", "Execute\r\nTypes: a\r\nParams: 000000000000\r\n\r\nSELECT 1", "Execute\r\nParams: 00\r\n\r\nSELECT 1"} {
+		if err := decoded.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("Should reject %q", text)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package proto
+
+import (
+	"errors"
+)
+
+// ErrMalformedChunked returned if body does not follow chunked transfer coding
+var ErrMalformedChunked = errors.New("malformed chunked body")
+
+type chunkedState uint8
+
+const (
+	chunkSize chunkedState = iota
+	chunkExtension
+	chunkData
+	chunkDataCR
+	chunkDataLF
+	chunkTrailer
+	chunkDone
+)
+
+// ChunkedBody parses body with `Transfer-Encoding: chunked` received in parts, so chunk size lines and
+// trailers can be split between TCP packets or socket reads. See https://tools.ietf.org/html/rfc7230#section-4.1
+//
+//	4\r\n
+//	Wiki\r\n
+//	0\r\n
+//	Trailer-Name: value\r\n
+//	\r\n
+type ChunkedBody struct {
+	state chunkedState
+	// Remaining size of current chunk
+	size   int64
+	digits int
+	// Length of current trailer line
+	line int
+
+	// Set by DecodeChunked to collect chunks data and trailers
+	decode   bool
+	content  []byte
+	trailers []byte
+}
+
+// Parse consumes next part of the body. It returns number of bytes which belong to the body,
+// it is less than len(data) only if body ends inside data, e.g. when followed by pipelined message.
+func (c *ChunkedBody) Parse(data []byte) (n int, err error) {
+	for n < len(data) && c.state != chunkDone {
+		b := data[n]
+
+		switch c.state {
+		case chunkSize:
+			switch {
+			case b >= '0' && b <= '9':
+				c.addDigit(b - '0')
+			case b >= 'a' && b <= 'f':
+				c.addDigit(b - 'a' + 10)
+			case b >= 'A' && b <= 'F':
+				c.addDigit(b - 'A' + 10)
+			case b == ';' || b == ' ' || b == '\t':
+				c.state = chunkExtension
+			case b == '\r':
+			case b == '\n':
+				if !c.endSizeLine() {
+					return n, ErrMalformedChunked
+				}
+			default:
+				return n, ErrMalformedChunked
+			}
+
+			if c.digits > 15 {
+				return n, ErrMalformedChunked
+			}
+		case chunkExtension:
+			if b == '\n' && !c.endSizeLine() {
+				return n, ErrMalformedChunked
+			}
+		case chunkData:
+			size := len(data) - n
+			if int64(size) > c.size {
+				size = int(c.size)
+			}
+
+			if c.decode {
+				c.content = append(c.content, data[n:n+size]...)
+			}
+
+			c.size -= int64(size)
+			if c.size == 0 {
+				c.state = chunkDataCR
+			}
+
+			n += size
+			continue
+		case chunkDataCR:
+			switch b {
+			case '\r':
+				c.state = chunkDataLF
+			case '\n':
+				c.state = chunkSize
+			default:
+				return n, ErrMalformedChunked
+			}
+		case chunkDataLF:
+			if b != '\n' {
+				return n, ErrMalformedChunked
+			}
+			c.state = chunkSize
+		case chunkTrailer:
+			if c.decode {
+				c.trailers = append(c.trailers, b)
+			}
+
+			switch b {
+			case '\r':
+			case '\n':
+				if c.line == 0 {
+					c.state = chunkDone
+				}
+				c.line = 0
+			default:
+				c.line++
+			}
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+func (c *ChunkedBody) addDigit(d byte) {
+	c.size = c.size<<4 | int64(d)
+	c.digits++
+}
+
+// endSizeLine returns false if line does not contain chunk size
+func (c *ChunkedBody) endSizeLine() bool {
+	if c.digits == 0 {
+		return false
+	}
+
+	if c.size == 0 {
+		c.state = chunkTrailer
+	} else {
+		c.state = chunkData
+	}
+	c.digits = 0
+
+	return true
+}
+
+// Done returns true if last chunk and trailers are received
+func (c *ChunkedBody) Done() bool {
+	return c.state == chunkDone
+}
+
+// ChunkedBodyLength returns length of complete chunked body including last chunk and trailers, or -1 if body is not complete
+func ChunkedBodyLength(body []byte) int {
+	var c ChunkedBody
+
+	n, err := c.Parse(body)
+	if err != nil || !c.Done() {
+		return -1
+	}
+
+	return n
+}
+
+// DecodeChunked returns content of complete chunked body, and its trailer fields in header format: `Name: value\r\n`
+func DecodeChunked(body []byte) (content, trailers []byte, err error) {
+	c := ChunkedBody{decode: true}
+
+	if _, err = c.Parse(body); err != nil {
+		return nil, nil, err
+	}
+
+	if !c.Done() {
+		return nil, nil, ErrMalformedChunked
+	}
+
+	// Strip empty line ending trailers
+	trailers = c.trailers[:len(c.trailers)-1]
+	if len(trailers) > 0 && trailers[len(trailers)-1] == '\r' {
+		trailers = trailers[:len(trailers)-1]
+	}
+
+	return c.content, trailers, nil
+}
@@ -276,6 +276,88 @@ func DeleteHeader(payload, name []byte) []byte {
 	return payload
 }
 
+// ReorderHeaders returns payload with headers, which are also in reference payload, in their reference order and name
+// casing, followed by other headers of payload in their order. Used to undo changes of header order made by
+// AddHeader, so request is sent with the same headers layout as it was captured.
+func ReorderHeaders(payload, reference []byte) []byte {
+	start := MIMEHeadersStartPos(payload)
+	end := MIMEHeadersEndPos(payload)
+	refStart := MIMEHeadersStartPos(reference)
+	refEnd := MIMEHeadersEndPos(reference)
+	if start < 2 || end < 4 || end-2 < start || refStart < 2 || refEnd < 4 || refEnd-2 < refStart {
+		return payload
+	}
+
+	lines := headerLines(payload[start : end-2])
+	refLines := headerLines(reference[refStart : refEnd-2])
+
+	reordered := make([]byte, 0, len(payload))
+	reordered = append(reordered, payload[:start]...)
+	used := make([]bool, len(lines))
+
+	for i, ref := range refLines {
+		name := headerLineName(ref)
+
+		// Repeated header is placed with its first occurrence
+		repeated := false
+		for _, prev := range refLines[:i] {
+			if HeadersEqual(headerLineName(prev), name) {
+				repeated = true
+				break
+			}
+		}
+		if repeated {
+			continue
+		}
+
+		for j, line := range lines {
+			if !used[j] && HeadersEqual(headerLineName(line), name) {
+				used[j] = true
+				reordered = append(reordered, name...)
+				reordered = append(reordered, line[len(name):]...)
+			}
+		}
+	}
+
+	for j, line := range lines {
+		if !used[j] {
+			reordered = append(reordered, line...)
+		}
+	}
+
+	return append(reordered, payload[end-2:]...)
+}
+
+// headerLines splits headers section into lines, each with its CRLF, folded lines are kept with their header
+func headerLines(headers []byte) (lines [][]byte) {
+	for len(headers) > 0 {
+		i := bytes.Index(headers, CLRF)
+		for i != -1 && i+2 < len(headers) && (headers[i+2] == ' ' || headers[i+2] == '\t') {
+			next := bytes.Index(headers[i+2:], CLRF)
+			if next == -1 {
+				i = -1
+			} else {
+				i += 2 + next
+			}
+		}
+		if i == -1 {
+			return append(lines, headers)
+		}
+
+		lines = append(lines, headers[:i+2])
+		headers = headers[i+2:]
+	}
+
+	return
+}
+
+func headerLineName(line []byte) []byte {
+	if i := bytes.IndexByte(line, ':'); i != -1 {
+		return line[:i]
+	}
+	return nil
+}
+
 // Body returns request/response body
 func Body(payload []byte) []byte {
 	// 4 -> len(EMPTY_LINE)
@@ -105,6 +105,27 @@ func TestSetHeader(t *testing.T) {
 	}
 }
 
+func TestReorderHeaders(t *testing.T) {
+	captured := []byte("POST /post HTTP/1.1\r\nhost: www.w3.org\r\nx-token: a\r\nAccept: */*\r\nx-token: b\r\ncontent-length: 7\r\n\r\na=1&b=2")
+
+	payload := SetHeader(captured, []byte("Content-Length"), []byte("14"))
+	payload = SetHeader(payload, []byte("X-Request-Id"), []byte("1"))
+	payload = SetHeader(payload, []byte("Host"), []byte("staging.com"))
+	payload = DeleteHeader(payload, []byte("Accept"))
+
+	expected := []byte("POST /post HTTP/1.1\r\nhost: staging.com\r\nx-token: a\r\nx-token: b\r\ncontent-length: 14\r\nX-Request-Id: 1\r\n\r\na=1&b=2")
+	if payload = ReorderHeaders(payload, captured); !bytes.Equal(payload, expected) {
+		t.Errorf("Expected %q, got %q", expected, payload)
+	}
+
+	// Name casing of reference is restored
+	payload = []byte("GET / HTTP/1.1\r\nUser-Agent: Gor\r\n\tfolded\r\nHost: a\r\n\r\n")
+	expected = []byte("GET / HTTP/1.1\r\nhost: a\r\nuser-agent: Gor\r\n\tfolded\r\n\r\n")
+	if payload = ReorderHeaders(payload, []byte("GET / HTTP/1.1\r\nhost: a\r\nuser-agent: Gor\r\n\r\n")); !bytes.Equal(payload, expected) {
+		t.Errorf("Expected %q, got %q", expected, payload)
+	}
+}
+
 func TestDeleteHeader(t *testing.T) {
 	var payload, payloadAfter []byte
 
@@ -324,3 +345,74 @@ func TestSetHostHTTP10(t *testing.T) {
 		t.Error("Should replace host", string(payload))
 	}
 }
+
+func TestChunkedBodyLength(t *testing.T) {
+	testCases := []struct {
+		body   string
+		length int
+	}{
+		{"0\r\n\r\n", 5},
+		{"2\r\nab\r\n0\r\n\r\nGET", 12},
+		{"2;ext=1\r\nab\r\n0\r\nTrailer: 1\r\n\r\n", 30},
+		{"5\r\n0\r\n\r\n\r\n0\r\n\r\n", 15},
+		{"A\r\n0123456789\r\n0\r\n\r\n", 20},
+		{"2\r\nab\r\n", -1},
+		{"2\r\na", -1},
+		{"0\r\nTrailer: 1\r\n", -1},
+		{"zz\r\n", -1},
+		{"\r\n", -1},
+		{"2\r\nabc\r\n0\r\n\r\n", -1},
+	}
+
+	for _, tc := range testCases {
+		if length := ChunkedBodyLength([]byte(tc.body)); length != tc.length {
+			t.Errorf("%q: expected %d, got %d", tc.body, tc.length, length)
+		}
+	}
+}
+
+func TestChunkedBodyParts(t *testing.T) {
+	body := []byte("4;name=value\r\nWiki\r\n5\r\npedia\r\n0\r\nExpires: never\r\n\r\n")
+
+	// Body split at every position, or received byte by byte
+	for split := 1; split < len(body); split++ {
+		var c ChunkedBody
+
+		n1, err1 := c.Parse(body[:split])
+		if c.Done() {
+			t.Fatalf("Split at %d: body should not be complete", split)
+		}
+
+		n2, err2 := c.Parse(append(body[split:], "GET"...))
+		if err1 != nil || err2 != nil || !c.Done() || n1+n2 != len(body) {
+			t.Errorf("Split at %d: wrong result %d %d %v %v", split, n1, n2, err1, err2)
+		}
+	}
+
+	var c ChunkedBody
+	for i := range body {
+		if n, err := c.Parse(body[i : i+1]); n != 1 || err != nil {
+			t.Fatal("Should parse body byte by byte", i, err)
+		}
+	}
+
+	if !c.Done() {
+		t.Error("Body should be complete")
+	}
+}
+
+func TestDecodeChunked(t *testing.T) {
+	content, trailers, err := DecodeChunked([]byte("4\r\nWiki\r\n5;ext\r\npedia\r\n0\r\nExpires: never\r\nX-Sum: 1\r\n\r\n"))
+
+	if err != nil || string(content) != "Wikipedia" || string(trailers) != "Expires: never\r\nX-Sum: 1\r\n" {
+		t.Errorf("Wrong decoded body %q %q %v", content, trailers, err)
+	}
+
+	if content, trailers, err = DecodeChunked([]byte("0\r\n\r\n")); err != nil || len(content) != 0 || len(trailers) != 0 {
+		t.Errorf("Wrong decoded empty body %q %q %v", content, trailers, err)
+	}
+
+	if _, _, err = DecodeChunked([]byte("4\r\nWiki\r\n")); err != ErrMalformedChunked {
+		t.Error("Should fail on incomplete body", err)
+	}
+}
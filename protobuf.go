@@ -0,0 +1,70 @@
+package goreplay
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Messages of protobuf wire format are encoded and decoded by hand, for the few fields gor needs, instead of
+// generating code with protobuf library. See https://protobuf.dev/programming-guides/encoding/.
+var errProtoMessage = errors.New("malformed protobuf message")
+
+func appendUvarint(buf []byte, value uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], value)]...)
+}
+
+func appendVarintField(buf []byte, field int, value uint64) []byte {
+	buf = appendUvarint(buf, uint64(field<<3))
+	return appendUvarint(buf, value)
+}
+
+func appendBytesField(buf []byte, field int, value []byte) []byte {
+	buf = appendUvarint(buf, uint64(field<<3|2))
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// forEachProtoField calls fn for each varint and length delimited field of protobuf message, fixed size fields are
+// skipped
+func forEachProtoField(msg []byte, fn func(field int, value uint64, data []byte)) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errProtoMessage
+		}
+		msg = msg[n:]
+
+		var value uint64
+		var data []byte
+		switch tag & 7 {
+		case 0:
+			if value, n = binary.Uvarint(msg); n <= 0 {
+				return errProtoMessage
+			}
+			msg = msg[n:]
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return errProtoMessage
+			}
+			msg = msg[size:]
+			continue
+		case 2:
+			if value, n = binary.Uvarint(msg); n <= 0 || uint64(len(msg)-n) < value {
+				return errProtoMessage
+			}
+			data = msg[n : n+int(value)]
+			msg = msg[n+int(value):]
+		default:
+			return errProtoMessage
+		}
+
+		fn(int(tag>>3), value, data)
+	}
+
+	return nil
+}
@@ -1,9 +1,10 @@
-package main
+package goreplay
 
 import (
 	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"net/url"
 	"strconv"
 )
 
@@ -77,6 +78,205 @@ func payloadHeader(payloadType byte, uuid []byte, timing int64, latency int64) (
 	return header
 }
 
+// Messages which do not fit into plugin buffer are split into chunks. Each chunk is a payload with header of original
+// message, extended by chunk field: `c`, chunk index and `+` if more chunks follow.
+// Example:
+//
+//	1 f45590522cd1838b4a0d5c5aab80b77929dea3b3 1231 c0+\n
+func payloadChunkHeader(header []byte, index int, more bool) []byte {
+	chunkHeader := make([]byte, 0, len(header)+8)
+	chunkHeader = append(chunkHeader, header[:len(header)-1]...)
+	chunkHeader = append(chunkHeader, ' ', 'c')
+	chunkHeader = strconv.AppendInt(chunkHeader, int64(index), 10)
+	if more {
+		chunkHeader = append(chunkHeader, '+')
+	}
+
+	return append(chunkHeader, '\n')
+}
+
+// payloadLastChunk marks chunk as the last one of message, so chunks following it can be dropped
+func payloadLastChunk(payload []byte) []byte {
+	if end := bytes.IndexByte(payload, '\n'); end > 0 && payload[end-1] == '+' {
+		payload = append(payload[:end-1], payload[end:]...)
+	}
+
+	return payload
+}
+
+// Requests can carry address of the client which sent them, captured from network. It is added as `a` field, and
+// is followed only by chunk field.
+// Example:
+//
+//	1 f45590522cd1838b4a0d5c5aab80b77929dea3b3 1231 a10.0.0.1:51234\n
+func payloadAddrHeader(header []byte, addr string) []byte {
+	addrHeader := make([]byte, 0, len(header)+len(addr)+2)
+	addrHeader = append(addrHeader, header[:len(header)-1]...)
+	addrHeader = append(addrHeader, ' ', 'a')
+	addrHeader = append(addrHeader, addr...)
+
+	return append(addrHeader, '\n')
+}
+
+// payloadClientAddr returns address of the client which sent request, or empty string if it is not known
+func payloadClientAddr(payload []byte) string {
+	info, _ := parsePayloadInfo(payload)
+	return string(info.addr)
+}
+
+// payloadInfo contains fields of payload header. Its slices point into payload, so parsing does not allocate.
+type payloadInfo struct {
+	kind byte
+	id   []byte
+	// Time payload was captured in nanoseconds, 0 if it is not valid
+	timestamp int64
+	// Address of client which sent request, nil if it is not known
+	addr []byte
+	// Index of the chunk, and if more chunks of the message follow. chunked is false if payload contains the whole
+	// message.
+	chunk   int
+	more    bool
+	chunked bool
+}
+
+// parsePayloadInfo parses payload header at once, so plugins handling every payload don't split it for each field.
+// ok is false if header has less than 3 fields.
+func parsePayloadInfo(payload []byte) (info payloadInfo, ok bool) {
+	headerSize := bytes.IndexByte(payload, '\n')
+	if headerSize < 0 {
+		headerSize = 0
+	}
+	header := payload[:headerSize]
+
+	var n int
+	var field []byte
+	for start := 0; start <= len(header); n++ {
+		end := bytes.IndexByte(header[start:], ' ')
+		if end < 0 {
+			end = len(header)
+		} else {
+			end += start
+		}
+		field = header[start:end]
+		start = end + 1
+
+		switch {
+		case n == 0 && len(field) > 0:
+			info.kind = field[0]
+		case n == 1:
+			info.id = field
+		case n == 2:
+			info.timestamp = parseTimestamp(field)
+		case n >= 3 && info.addr == nil && len(field) > 1 && field[0] == 'a':
+			info.addr = field[1:]
+		}
+	}
+
+	// Chunk field is the last one
+	if n >= 4 && len(field) >= 2 && field[0] == 'c' {
+		info.more = field[len(field)-1] == '+'
+		if info.more {
+			field = field[:len(field)-1]
+		}
+
+		info.chunked = len(field) > 1
+		for _, c := range field[1:] {
+			if c < '0' || c > '9' {
+				info.chunk, info.more, info.chunked = 0, false, false
+				break
+			}
+			info.chunk = info.chunk*10 + int(c-'0')
+		}
+	}
+
+	return info, n >= 3
+}
+
+// parseTimestamp parses decimal timestamp without allocating, unlike strconv.ParseInt(string(field)), 0 is returned
+// if it is not valid
+func parseTimestamp(field []byte) (timestamp int64) {
+	if len(field) == 0 || len(field) > 19 {
+		return 0
+	}
+	for _, c := range field {
+		if c < '0' || c > '9' {
+			return 0
+		}
+		timestamp = timestamp*10 + int64(c-'0')
+	}
+	return timestamp
+}
+
+// Responses are assigned to session of their request, this many of the latest requests are remembered
+const maxPayloadSessions = 100000
+
+// payloadSessions assigns payloads to sessions of captured client connections, used as ordering and partition keys by
+// message queue outputs. Requests with client address belong to session of the address, other requests have their own
+// session of request ID. Responses belong to session of their request. Not safe for concurrent use.
+type payloadSessions map[string]string
+
+// key returns session of payload
+func (s *payloadSessions) key(payload []byte) string {
+	id := string(payloadMeta(payload)[1])
+
+	if payload[0] != RequestPayload {
+		if key, ok := (*s)[id]; ok {
+			return key
+		}
+		return id
+	}
+
+	key := payloadClientAddr(payload)
+	if key == "" {
+		return id
+	}
+
+	if *s == nil || len(*s) >= maxPayloadSessions {
+		*s = make(payloadSessions)
+	}
+	(*s)[id] = key
+
+	return key
+}
+
+// Pod metadata can be added to request payload header as `k` field, URL query encoded, with `namespace`, `pod`,
+// `container` and `label.<name>` keys. E.g.: `1 <id> <time> knamespace=default&pod=web-1`.
+func payloadK8sHeader(header []byte, metadata string) []byte {
+	k8sHeader := make([]byte, 0, len(header)+len(metadata)+2)
+	k8sHeader = append(k8sHeader, header[:len(header)-1]...)
+	k8sHeader = append(k8sHeader, ' ', 'k')
+	k8sHeader = append(k8sHeader, metadata...)
+
+	return append(k8sHeader, '\n')
+}
+
+// payloadK8sMetadata returns pod metadata of request payload, or nil if it is not known
+func payloadK8sMetadata(payload []byte) url.Values {
+	meta := payloadMeta(payload)
+	if len(meta) < 4 {
+		return nil
+	}
+
+	for _, field := range meta[3:] {
+		if len(field) > 1 && field[0] == 'k' {
+			metadata, err := url.ParseQuery(string(field[1:]))
+			if err != nil {
+				return nil
+			}
+			return metadata
+		}
+	}
+
+	return nil
+}
+
+// payloadChunk returns index of the chunk, and if more chunks of the message follow.
+// ok is false if payload contains the whole message.
+func payloadChunk(payload []byte) (index int, more, ok bool) {
+	info, _ := parsePayloadInfo(payload)
+	return info.chunk, info.more, info.chunked
+}
+
 func payloadBody(payload []byte) []byte {
 	headerSize := bytes.IndexByte(payload, '\n')
 	return payload[headerSize+1:]
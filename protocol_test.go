@@ -0,0 +1,59 @@
+package goreplay
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPayloadClientAddr(t *testing.T) {
+	header := payloadHeader(RequestPayload, []byte("1"), 1, -1)
+	if addr := payloadClientAddr(append(header, "GET / HTTP/1.1\r\n\r\n"...)); addr != "" {
+		t.Errorf("Expected no address, got %q", addr)
+	}
+
+	header = payloadAddrHeader(header, "[2001:db8::1]:5000")
+	if !bytes.Equal(header, []byte("1 1 1 a[2001:db8::1]:5000\n")) {
+		t.Errorf("Wrong header %q", header)
+	}
+
+	// Chunk field follows address
+	chunk := payloadChunkHeader(header, 0, true)
+	if addr := payloadClientAddr(chunk); addr != "[2001:db8::1]:5000" {
+		t.Errorf("Expected address of client, got %q", addr)
+	}
+
+	if index, more, ok := payloadChunk(chunk); index != 0 || !more || !ok {
+		t.Errorf("Expected the first chunk, got %d %v %v", index, more, ok)
+	}
+}
+
+func TestParsePayloadInfo(t *testing.T) {
+	cases := []struct {
+		payload string
+		info    payloadInfo
+		ok      bool
+	}{
+		{"1 a1 1\nGET / HTTP/1.1\r\n\r\n", payloadInfo{kind: '1', id: []byte("a1"), timestamp: 1}, true},
+		{"1 a1 1600000000000000000\nGET / HTTP/1.1\r\n\r\n", payloadInfo{kind: '1', id: []byte("a1"), timestamp: 1600000000000000000}, true},
+		{"1 a1 x\nGET / HTTP/1.1\r\n\r\n", payloadInfo{kind: '1', id: []byte("a1")}, true},
+		{"2 a1 1 2\nHTTP/1.1 200 OK\r\n\r\n", payloadInfo{kind: '2', id: []byte("a1"), timestamp: 1}, true},
+		{"1 a1 1 a10.0.0.1:5000 c12+\nbody", payloadInfo{kind: '1', id: []byte("a1"), timestamp: 1, addr: []byte("10.0.0.1:5000"), chunk: 12, more: true, chunked: true}, true},
+		{"1 a1 1 c1\nbody", payloadInfo{kind: '1', id: []byte("a1"), timestamp: 1, chunk: 1, chunked: true}, true},
+		{"1 a1 1 cx\nbody", payloadInfo{kind: '1', id: []byte("a1"), timestamp: 1}, true},
+		{"1 a1\nbody", payloadInfo{kind: '1', id: []byte("a1")}, false},
+		{"GET / HTTP/1.1", payloadInfo{}, false},
+	}
+
+	for _, c := range cases {
+		info, ok := parsePayloadInfo([]byte(c.payload))
+		if ok != c.ok || info.kind != c.info.kind || !bytes.Equal(info.id, c.info.id) || info.timestamp != c.info.timestamp || !bytes.Equal(info.addr, c.info.addr) ||
+			info.chunk != c.info.chunk || info.more != c.info.more || info.chunked != c.info.chunked {
+			t.Errorf("%q: expected %+v %v, got %+v %v", c.payload, c.info, c.ok, info, ok)
+		}
+	}
+
+	payload := []byte("1 a1 1 a10.0.0.1:5000 c0+\nGET / HTTP/1.1\r\n\r\n")
+	if allocs := testing.AllocsPerRun(100, func() { parsePayloadInfo(payload) }); allocs != 0 {
+		t.Errorf("Parsing header should not allocate, got %v allocations", allocs)
+	}
+}
@@ -0,0 +1,225 @@
+package goreplay
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PubSubConfig holds configuration of Google Cloud Pub/Sub input and output
+type PubSubConfig struct {
+	// Messages of the same captured session are published with the same ordering key
+	ordering      bool
+	batchSize     int
+	flushInterval time.Duration
+	// Removes credentials from payloads before they are published
+	redactor *headerRedactor
+	// Pub/Sub API URL, set to emulator or test server
+	endpoint string
+}
+
+const (
+	pubsubEndpoint = "https://pubsub.googleapis.com"
+	pubsubAudience = "https://pubsub.googleapis.com/"
+	// Used on GCE, GKE and Cloud Run if service account key is not provided
+	pubsubMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// pubsubClient calls Pub/Sub REST API. Requests are authorized with self-signed JWT of service account key from
+// GOOGLE_APPLICATION_CREDENTIALS, or with token of instance service account from metadata server. Emulator set with
+// PUBSUB_EMULATOR_HOST does not require authorization.
+type pubsubClient struct {
+	endpoint string
+	http     *http.Client
+
+	// Service account key, nil if metadata server is used
+	email string
+	keyID string
+	key   *rsa.PrivateKey
+	auth  bool
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type pubsubMessage struct {
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+func newPubSubClient(config *PubSubConfig) (*pubsubClient, error) {
+	c := &pubsubClient{endpoint: config.endpoint, http: &http.Client{Timeout: time.Minute}}
+
+	if c.endpoint != "" {
+		return c, nil
+	}
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		c.endpoint = "http://" + host
+		return c, nil
+	}
+
+	c.endpoint = pubsubEndpoint
+	c.auth = true
+
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		if err := c.loadKey(path); err != nil {
+			return nil, fmt.Errorf("can't load %s: %v", path, err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *pubsubClient) loadKey(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var credentials struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKeyID string `json:"private_key_id"`
+		PrivateKey   string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return err
+	}
+	if credentials.Type != "service_account" {
+		return fmt.Errorf("expected service account key, got %q", credentials.Type)
+	}
+
+	block, _ := pem.Decode([]byte(credentials.PrivateKey))
+	if block == nil {
+		return errors.New("private key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return errors.New("private key is not RSA key")
+	}
+
+	c.email, c.keyID, c.key = credentials.ClientEmail, credentials.PrivateKeyID, rsaKey
+
+	return nil
+}
+
+// accessToken returns cached token, which is renewed a minute before expiration
+func (c *pubsubClient) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Add(time.Minute).Before(c.expires) {
+		return c.token, nil
+	}
+
+	var err error
+	if c.key != nil {
+		c.token, c.expires, err = c.signedToken(time.Now())
+	} else {
+		c.token, c.expires, err = c.metadataToken()
+	}
+
+	return c.token, err
+}
+
+func (c *pubsubClient) signedToken(now time.Time) (string, time.Time, error) {
+	expires := now.Add(time.Hour)
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": c.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": c.email,
+		"sub": c.email,
+		"aud": pubsubAudience,
+		"iat": now.Unix(),
+		"exp": expires.Unix(),
+	})
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", now, err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), expires, nil
+}
+
+func (c *pubsubClient) metadataToken() (string, time.Time, error) {
+	req, _ := http.NewRequest("GET", pubsubMetadataToken, nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := c.do(req, &token); err != nil {
+		return "", time.Now(), fmt.Errorf("can't get token from metadata server, set GOOGLE_APPLICATION_CREDENTIALS outside of GCP: %v", err)
+	}
+
+	return token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+// call sends request to method of resource, e.g. `projects/p/topics/t:publish`, and decodes response to result
+func (c *pubsubClient) call(method string, request interface{}, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.endpoint+"/v1/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if c.auth {
+		token, err := c.accessToken()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return c.do(req, result)
+}
+
+func (c *pubsubClient) do(req *http.Request, result interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if result == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,156 @@
+package goreplay
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pubsubServer emulates publish, pull and acknowledge methods of Pub/Sub API with single topic and subscription
+type pubsubServer struct {
+	mu       sync.Mutex
+	messages []pubsubMessage
+	acked    int
+}
+
+func (s *pubsubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, ":publish"):
+		var req struct{ Messages []pubsubMessage }
+		json.NewDecoder(r.Body).Decode(&req)
+		s.messages = append(s.messages, req.Messages...)
+		w.Write([]byte(`{}`))
+	case strings.HasSuffix(r.URL.Path, ":pull"):
+		type received struct {
+			AckID   string        `json:"ackId"`
+			Message pubsubMessage `json:"message"`
+		}
+		var resp struct {
+			ReceivedMessages []received `json:"receivedMessages"`
+		}
+		for i, m := range s.messages[s.acked:] {
+			resp.ReceivedMessages = append(resp.ReceivedMessages, received{AckID: string(rune('a' + i)), Message: m})
+		}
+		json.NewEncoder(w).Encode(&resp)
+	case strings.HasSuffix(r.URL.Path, ":acknowledge"):
+		var req struct{ AckIDs []string }
+		json.NewDecoder(r.Body).Decode(&req)
+		s.acked += len(req.AckIDs)
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestPubSubOutputInput(t *testing.T) {
+	backend := new(pubsubServer)
+	server := httptest.NewServer(backend)
+	defer server.Close()
+
+	output := NewPubSubOutput("projects/p/topics/gor", &PubSubConfig{endpoint: server.URL, ordering: true, batchSize: 2})
+
+	payloads := [][]byte{
+		append(payloadAddrHeader(payloadHeader(RequestPayload, []byte("a1"), 1, -1), "10.0.0.1:5000"), "GET / HTTP/1.1\r\n\r\n"...),
+		append(payloadHeader(ResponsePayload, []byte("a1"), 2, 1), "HTTP/1.1 200 OK\r\n\r\n"...),
+		append(payloadHeader(RequestPayload, []byte("a2"), 3, -1), "GET / HTTP/1.1\r\n\r\n"...),
+	}
+	for _, p := range payloads {
+		output.Write(p)
+	}
+	output.(*PubSubOutput).Close()
+
+	if len(backend.messages) != 3 {
+		t.Fatal("Expected 3 messages, got", len(backend.messages))
+	}
+	for i, key := range []string{"10.0.0.1:5000", "10.0.0.1:5000", "a2"} {
+		if m := backend.messages[i]; m.OrderingKey != key {
+			t.Errorf("Message %d expected ordering key %q, got %q", i, key, m.OrderingKey)
+		}
+	}
+	if backend.messages[1].Attributes["type"] != "response" || backend.messages[1].Attributes["id"] != "a1" {
+		t.Error("Wrong attributes", backend.messages[1].Attributes)
+	}
+
+	input := NewPubSubInput("projects/p/subscriptions/gor", &PubSubConfig{endpoint: server.URL})
+	defer input.Close()
+
+	buf := make([]byte, 1000)
+	for _, p := range payloads {
+		n, err := input.Read(buf)
+		if err != nil || string(buf[:n]) != string(p) {
+			t.Errorf("Expected %q, got %q %v", p, buf[:n], err)
+		}
+	}
+
+	// Messages are acknowledged after they are read
+	for i := 0; i < 100; i++ {
+		backend.mu.Lock()
+		acked := backend.acked
+		backend.mu.Unlock()
+		if acked == 3 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Messages should be acknowledged")
+}
+
+func TestPubSubServiceAccountToken(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	credentials, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "gor@p.iam.gserviceaccount.com",
+		"private_key_id": "k1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+
+	f, _ := ioutil.TempFile("", "gor-credentials")
+	defer os.Remove(f.Name())
+	f.Write(credentials)
+	f.Close()
+
+	c := new(pubsubClient)
+	if err := c.loadKey(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	token, expires, err := c.signedToken(time.Unix(1614636000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires.Unix() != 1614636000+3600 {
+		t.Error("Wrong expiration", expires)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatal("Wrong token", token)
+	}
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if !strings.Contains(string(claims), `"aud":"https://pubsub.googleapis.com/"`) || !strings.Contains(string(claims), `"iss":"gor@p.iam.gserviceaccount.com"`) {
+		t.Error("Wrong claims", string(claims))
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature); err != nil {
+		t.Error("Wrong signature", err)
+	}
+}
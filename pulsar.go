@@ -0,0 +1,145 @@
+package goreplay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// PulsarConfig holds configuration of Apache Pulsar input and output
+type PulsarConfig struct {
+	// JWT of token authentication
+	token string
+	// Subscription of input, Key_Shared by default, so payloads of each session are consumed by single consumer in order
+	subscription     string
+	subscriptionType string
+	// Removes credentials from payloads before they are published
+	redactor *headerRedactor
+}
+
+// parsePulsarAddress parses `ws://host[:port]/[persistent/]tenant/namespace/topic` address of broker WebSocket API,
+// `wss://` scheme enables TLS. Port is 8080 by default, and 8443 with TLS. Topic is returned with its domain.
+func parsePulsarAddress(address string) (u *url.URL, topic string, err error) {
+	if !strings.Contains(address, "://") {
+		address = "ws://" + address
+	}
+	if u, err = url.Parse(address); err != nil {
+		return
+	}
+
+	switch u.Scheme {
+	case "ws", "http":
+		u.Scheme = "ws"
+		if u.Port() == "" {
+			u.Host += ":8080"
+		}
+	case "wss", "https":
+		u.Scheme = "wss"
+		if u.Port() == "" {
+			u.Host += ":8443"
+		}
+	default:
+		return nil, "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, "", errors.New("host is not specified")
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if parts[0] != "persistent" && parts[0] != "non-persistent" {
+		parts = append([]string{"persistent"}, parts...)
+	}
+	if len(parts) != 4 || parts[1] == "" || parts[2] == "" || parts[3] == "" {
+		return nil, "", errors.New("topic should be given as [persistent/]tenant/namespace/topic")
+	}
+
+	return u, strings.Join(parts, "/"), nil
+}
+
+// pulsarConn is producer or consumer connection of Pulsar WebSocket API. Received messages are passed to callback
+// from reading goroutine. Connection is not re-established, it is closed on first error and users dial new one.
+type pulsarConn struct {
+	*websocketConn
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error
+}
+
+// dialPulsar connects to WebSocket API endpoint, e.g. `producer/persistent/public/default/gor`
+func dialPulsar(base *url.URL, endpoint string, query url.Values, token string, onMessage func([]byte)) (*pulsarConn, error) {
+	u := *base
+	u.Path = "/ws/v2/" + endpoint
+	u.RawQuery = query.Encode()
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	ws, err := dialWebSocket(&u, header)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &pulsarConn{websocketConn: ws, closed: make(chan struct{})}
+	go func() {
+		for {
+			_, data, err := c.readMessage()
+			if err != nil {
+				c.close(err)
+				return
+			}
+			onMessage(data)
+		}
+	}()
+
+	return c, nil
+}
+
+func (c *pulsarConn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// Close closes connection gracefully
+func (c *pulsarConn) Close() error {
+	c.websocketConn.Close()
+	c.close(errors.New("connection closed"))
+	return nil
+}
+
+// send writes JSON message, messages are buffered until there are enough of them or they are flushed
+func (c *pulsarConn) send(msg []byte) error {
+	select {
+	case <-c.closed:
+		return c.err
+	default:
+	}
+
+	if err := c.writeMessage(wsText, msg, false); err != nil {
+		c.close(err)
+		return err
+	}
+	return nil
+}
+
+// Flush sends buffered messages
+func (c *pulsarConn) Flush() error {
+	select {
+	case <-c.closed:
+		return c.err
+	default:
+	}
+
+	if err := c.websocketConn.Flush(); err != nil {
+		c.close(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package goreplay
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeServerFrame writes unmasked frame, as servers do
+func writeServerFrame(w *bufio.Writer, opcode byte, data []byte) {
+	header := []byte{0x80 | opcode, 0}
+	if len(data) < 126 {
+		header[1] = byte(len(data))
+	} else {
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+	}
+	w.Write(header)
+	w.Write(data)
+	w.Flush()
+}
+
+// pulsarServer emulates WebSocket API of broker, messages sent by producer are delivered to consumer once
+type pulsarServer struct {
+	mu       sync.Mutex
+	messages []pulsarProducerMessage
+	acks     []string
+}
+
+func (s *pulsarServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	conn, buf, _ := w.(http.Hijacker).Hijack()
+	defer conn.Close()
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	buf.Flush()
+
+	// Server reads masked frames the same way
+	ws := &websocketConn{conn: conn, reader: buf.Reader, writer: buf.Writer}
+
+	switch {
+	case r.URL.Path == "/ws/v2/producer/persistent/public/default/gor":
+		for {
+			_, data, err := ws.readMessage()
+			if err != nil {
+				return
+			}
+			var msg pulsarProducerMessage
+			json.Unmarshal(data, &msg)
+
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+
+			receipt, _ := json.Marshal(map[string]string{"result": "ok", "messageId": "id", "context": msg.Context})
+			writeServerFrame(buf.Writer, wsText, receipt)
+		}
+	case r.URL.Path == "/ws/v2/consumer/persistent/public/default/gor/staging" && r.URL.Query().Get("subscriptionType") == "Key_Shared":
+		s.mu.Lock()
+		for i, msg := range s.messages {
+			data, _ := json.Marshal(map[string]interface{}{"messageId": "m" + string(rune('0'+i)), "payload": msg.Payload, "key": msg.Key})
+			writeServerFrame(buf.Writer, wsText, data)
+		}
+		s.mu.Unlock()
+
+		for {
+			_, data, err := ws.readMessage()
+			if err != nil {
+				return
+			}
+			var ack struct {
+				MessageID string `json:"messageId"`
+			}
+			json.Unmarshal(data, &ack)
+
+			s.mu.Lock()
+			s.acks = append(s.acks, ack.MessageID)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func TestPulsarOutputInput(t *testing.T) {
+	backend := new(pulsarServer)
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	address := strings.Replace(server.URL, "http://", "ws://", 1) + "/public/default/gor"
+
+	output := NewPulsarOutput(address, &PulsarConfig{token: "token"}).(*PulsarOutput)
+	payloads := [][]byte{
+		append(payloadAddrHeader(payloadHeader(RequestPayload, []byte("a1"), 1, -1), "10.0.0.1:5000"), "GET / HTTP/1.1\r\n\r\n"...),
+		append(payloadHeader(ResponsePayload, []byte("a1"), 2, 1), "HTTP/1.1 200 OK\r\n\r\n"...),
+		append(payloadHeader(RequestPayload, []byte("a2"), 3, -1), "GET / HTTP/1.1\r\n\r\n"...),
+	}
+	for _, p := range payloads {
+		output.Write(p)
+	}
+	output.Close()
+
+	// Close waits for receipts
+	backend.mu.Lock()
+	if len(backend.messages) != len(payloads) {
+		t.Fatal("Expected all payloads, got", len(backend.messages))
+	}
+	for i, key := range []string{"10.0.0.1:5000", "10.0.0.1:5000", "a2"} {
+		if backend.messages[i].Key != key {
+			t.Errorf("Expected key %s, got %s", key, backend.messages[i].Key)
+		}
+	}
+	backend.mu.Unlock()
+
+	input := NewPulsarInput(address, &PulsarConfig{token: "token", subscription: "staging", subscriptionType: "Key_Shared"})
+	defer input.Close()
+
+	buf := make([]byte, 1000)
+	for _, p := range payloads {
+		n, err := input.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != string(p) {
+			t.Errorf("Expected %q, got %q", p, buf[:n])
+		}
+	}
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		backend.mu.Lock()
+		acks := len(backend.acks)
+		backend.mu.Unlock()
+
+		if acks == len(payloads) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected acknowledgements of all payloads, got", acks)
+		}
+	}
+}
+
+func TestParsePulsarAddress(t *testing.T) {
+	u, topic, err := parsePulsarAddress("wss://pulsar/non-persistent/public/default/gor")
+	if err != nil || u.Host != "pulsar:8443" || topic != "non-persistent/public/default/gor" {
+		t.Error("Wrong address", u, topic, err)
+	}
+
+	if _, _, err := parsePulsarAddress("ws://pulsar/default/gor"); err == nil {
+		t.Error("Tenant should be required")
+	}
+}
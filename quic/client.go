@@ -0,0 +1,1085 @@
+//go:build go1.21
+// +build go1.21
+
+package quic
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// Client connections send datagrams of minimum size every QUIC path supports, so path MTU is not discovered
+const maxDatagramSize = 1200
+
+// Payload of packet leaves room for the longest header without token and for AEAD tag
+const maxPayloadSize = maxDatagramSize - 64
+
+// Size of CRYPTO and STREAM frames data, so they fit into packet together with ACK frame
+const maxFrameData = 1000
+
+const (
+	// Receive window of connection, raised as responses are received. Each response is limited by maxStreamSize.
+	connWindow = maxStreamSize
+	// Receive window of unidirectional streams of server, which carry only settings and QPACK instructions
+	uniStreamWindow = 64 << 10
+	idleTimeout     = 30 * time.Second
+
+	// Loss recovery, RFC 9002 section 6.2
+	initialRTT  = 333 * time.Millisecond
+	granularity = time.Millisecond
+	// Congestion window, RFC 9002 section 7.2
+	initialWindow = 10 * maxDatagramSize
+	minimumWindow = 2 * maxDatagramSize
+)
+
+// H3_NO_ERROR application error code
+const errorNoError = 0x100
+
+// ErrClosed is returned for requests of connection closed by server
+var ErrClosed = errors.New("connection is closed")
+
+// Encryption levels which have packet number space, 0-RTT is not sent
+var levels = []tls.QUICEncryptionLevel{tls.QUICEncryptionLevelInitial, tls.QUICEncryptionLevelHandshake, tls.QUICEncryptionLevelApplication}
+
+// sentPacket is ack-eliciting packet waiting for acknowledgement. Its frames are sent again if it is lost.
+type sentPacket struct {
+	frames [][]byte
+	size   int
+	time   time.Time
+}
+
+// packetSpace is state of packet number space of one encryption level
+type packetSpace struct {
+	dropped bool
+	nextPN  int64
+
+	// Packets received from server, and if they should be acknowledged
+	largest    int64
+	received   ackRanges
+	ackPending bool
+
+	// Frames waiting to be sent, and packets waiting for acknowledgement
+	pending [][]byte
+	sent    map[int64]*sentPacket
+	acked   int64
+}
+
+// transportParameters of server which limit what client sends, RFC 9000 section 18.2
+type transportParameters struct {
+	idleTimeout      time.Duration
+	maxAckDelay      time.Duration
+	ackDelayExponent uint64
+	maxData          uint64
+	maxStreamData    uint64
+	maxUniStream     uint64
+	maxStreamsBidi   uint64
+	maxStreamsUni    uint64
+	// Connection IDs which authenticate Initial and Retry packets of server, RFC 9000 section 7.3
+	originalDCID     []byte
+	initialSourceCID []byte
+	retrySourceCID   []byte
+}
+
+// Conn sends HTTP/1.1 requests to HTTP/3 server one by one, and returns responses translated into HTTP/1.1, like
+// Conn of http2 package does over TCP. It implements QUIC version 1 on top of connected UDP socket, with TLS handshake
+// of crypto/tls. Loss recovery and congestion control follow RFC 9002 in simplified form, which is enough for single
+// stream at a time. Field sections are encoded without QPACK dynamic table, and server is not allowed to use it
+// either. Connection migration, 0-RTT and server push are not used.
+type Conn struct {
+	conn     net.Conn
+	tls      *tls.QUICConn
+	deadline time.Time
+	err      error
+
+	// Connection IDs of client and server, the first connection ID chosen by client, and Retry packet connection ID
+	// and token
+	scid      []byte
+	dcid      []byte
+	odcid     []byte
+	retrySCID []byte
+	token     []byte
+	// Server chose its connection ID, and sent Retry packet
+	serverCID bool
+	retried   bool
+
+	readKeys  [4]*packetKeys
+	writeKeys [4]*packetKeys
+	spaces    [4]packetSpace
+	crypto    [4]streamBuffer
+	cryptoOut [4]uint64
+
+	// Key phase of 1-RTT packets, and keys of previous phase used for reordered packets
+	keyPhase bool
+	prevKeys *packetKeys
+
+	handshakeDone bool
+	confirmed     bool
+	peer          transportParameters
+
+	// Flow control of data sent by client
+	maxData    uint64
+	sentData   uint64
+	maxStreams uint64
+	nextStream uint64
+	// Flow control of data received from server
+	recvLimit   uint64
+	received    uint64
+	uniReceived map[uint64]uint64
+
+	// Request stream, offset of data sent on it, its send window, and response received on it
+	stream      uint64
+	streamSent  uint64
+	streamLimit uint64
+	stopped     bool
+	response    streamBuffer
+	responseEnd uint64
+	streamErr   error
+	qpack       qpackDecoder
+
+	// Loss recovery and congestion control
+	smoothedRTT  time.Duration
+	rttVar       time.Duration
+	hasRTT       bool
+	ptoCount     uint
+	lastSent     time.Time
+	lastReceived time.Time
+	inFlight     int
+	window       int
+
+	buf []byte
+}
+
+// NewConn returns client of HTTP/3 server reached by connected UDP socket. Config should not set NextProtos, "h3" is
+// negotiated. Handshake should be called before requests are sent.
+func NewConn(conn net.Conn, config *tls.Config) *Conn {
+	config = config.Clone()
+	config.MinVersion = tls.VersionTLS13
+	config.NextProtos = []string{"h3"}
+
+	return &Conn{
+		conn:        conn,
+		tls:         tls.QUICClient(&tls.QUICConfig{TLSConfig: config}),
+		recvLimit:   connWindow,
+		uniReceived: make(map[uint64]uint64),
+		window:      initialWindow,
+		buf:         make([]byte, 64<<10),
+	}
+}
+
+// SetDeadline sets time handshake or request fails at, zero time means no deadline
+func (c *Conn) SetDeadline(t time.Time) {
+	c.deadline = t
+}
+
+// Handshake establishes QUIC connection, and opens control stream of HTTP/3
+func (c *Conn) Handshake() error {
+	c.scid = make([]byte, 8)
+	c.dcid = make([]byte, 8)
+	if _, err := rand.Read(c.scid); err != nil {
+		return err
+	}
+	if _, err := rand.Read(c.dcid); err != nil {
+		return err
+	}
+	c.odcid = c.dcid
+	c.writeKeys[tls.QUICEncryptionLevelInitial], c.readKeys[tls.QUICEncryptionLevelInitial] = initialKeys(c.dcid)
+	for _, level := range levels {
+		c.spaces[level].sent = make(map[int64]*sentPacket)
+		c.spaces[level].acked = -1
+	}
+
+	c.tls.SetTransportParameters(c.transportParameters())
+	if err := c.tls.Start(context.Background()); err != nil {
+		return err
+	}
+
+	for c.err = c.events(); c.err == nil && !c.handshakeDone; {
+		c.wait()
+	}
+	if c.err != nil {
+		return c.err
+	}
+
+	if protocol := c.tls.ConnectionState().NegotiatedProtocol; protocol != "h3" {
+		c.err = fmt.Errorf("server negotiated %q protocol instead of h3", protocol)
+		return c.err
+	}
+	if string(c.peer.originalDCID) != string(c.odcid) || string(c.peer.initialSourceCID) != string(c.dcid) ||
+		c.retried != (c.peer.retrySourceCID != nil) || string(c.peer.retrySourceCID) != string(c.retrySCID) {
+		c.err = errors.New("connection IDs are not authenticated by transport parameters")
+		return c.err
+	}
+
+	// Control stream with empty SETTINGS frame, so QPACK dynamic table is not used by server
+	control := append(appendVarint(nil, streamControl), http3Frame(frameSettings, nil)...)
+	c.queue(tls.QUICEncryptionLevelApplication, streamFrame(2, 0, control, false))
+	c.sentData += uint64(len(control))
+
+	c.err = c.flush()
+	return c.err
+}
+
+// transportParameters of client, RFC 9000 section 18.2
+func (c *Conn) transportParameters() []byte {
+	var b []byte
+	param := func(id uint64, value []byte) {
+		b = appendVarint(b, id)
+		b = appendVarint(b, uint64(len(value)))
+		b = append(b, value...)
+	}
+
+	param(0x01, appendVarint(nil, uint64(idleTimeout/time.Millisecond)))
+	param(0x04, appendVarint(nil, connWindow))
+	param(0x05, appendVarint(nil, maxStreamSize))
+	param(0x07, appendVarint(nil, uniStreamWindow))
+	param(0x09, appendVarint(nil, 16))
+	param(0x0f, c.scid)
+
+	return b
+}
+
+// peerParameters reads transport parameters of server
+func (c *Conn) peerParameters(data []byte) error {
+	c.peer = transportParameters{maxAckDelay: 25 * time.Millisecond, ackDelayExponent: 3}
+
+	r := reader{b: data}
+	for len(r.b) > 0 && r.err == nil {
+		id := r.varint()
+		value := r.bytes(r.varint())
+		if r.err != nil {
+			break
+		}
+
+		v, _ := readVarint(value)
+		switch id {
+		case 0x00:
+			c.peer.originalDCID = append([]byte{}, value...)
+		case 0x01:
+			c.peer.idleTimeout = time.Duration(v) * time.Millisecond
+		case 0x04:
+			c.peer.maxData = v
+		case 0x06:
+			c.peer.maxStreamData = v
+		case 0x07:
+			c.peer.maxUniStream = v
+		case 0x08:
+			c.peer.maxStreamsBidi = v
+		case 0x09:
+			c.peer.maxStreamsUni = v
+		case 0x0a:
+			c.peer.ackDelayExponent = v
+		case 0x0b:
+			c.peer.maxAckDelay = time.Duration(v) * time.Millisecond
+		case 0x0f:
+			c.peer.initialSourceCID = append([]byte{}, value...)
+		case 0x10:
+			c.peer.retrySourceCID = append([]byte{}, value...)
+		}
+	}
+	if r.err != nil {
+		return errors.New("malformed transport parameters")
+	}
+
+	if c.peer.maxStreamsUni == 0 || c.peer.maxUniStream < 3 {
+		return errors.New("server does not allow control stream")
+	}
+
+	c.maxData = c.peer.maxData
+	c.maxStreams = c.peer.maxStreamsBidi
+
+	return nil
+}
+
+// events handles events of TLS handshake
+func (c *Conn) events() error {
+	for {
+		e := c.tls.NextEvent()
+
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return nil
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			suite, ok := cipherSuites[e.Suite]
+			if !ok {
+				return fmt.Errorf("unsupported cipher suite 0x%x", e.Suite)
+			}
+			keys, err := newPacketKeys(suite, append([]byte{}, e.Data...))
+			if err != nil {
+				return err
+			}
+
+			if e.Kind == tls.QUICSetReadSecret {
+				c.readKeys[e.Level] = keys
+			} else {
+				c.writeKeys[e.Level] = keys
+			}
+
+			// Initial packets are not sent after Handshake keys are available, RFC 9001 section 4.9.1
+			if e.Kind == tls.QUICSetWriteSecret && e.Level == tls.QUICEncryptionLevelHandshake {
+				c.drop(tls.QUICEncryptionLevelInitial)
+			}
+		case tls.QUICWriteData:
+			for data := e.Data; len(data) > 0; {
+				n := len(data)
+				if n > maxFrameData {
+					n = maxFrameData
+				}
+				c.queue(e.Level, cryptoFrame(c.cryptoOut[e.Level], data[:n]))
+				c.cryptoOut[e.Level] += uint64(n)
+				data = data[n:]
+			}
+		case tls.QUICTransportParameters:
+			if err := c.peerParameters(e.Data); err != nil {
+				return err
+			}
+		case tls.QUICHandshakeDone:
+			c.handshakeDone = true
+		}
+	}
+}
+
+// drop discards packet number space whose keys are not used anymore
+func (c *Conn) drop(level tls.QUICEncryptionLevel) {
+	sp := &c.spaces[level]
+	for _, p := range sp.sent {
+		c.inFlight -= p.size
+	}
+	*sp = packetSpace{dropped: true}
+	c.readKeys[level], c.writeKeys[level] = nil, nil
+}
+
+func (c *Conn) queue(level tls.QUICEncryptionLevel, frame []byte) {
+	c.spaces[level].pending = append(c.spaces[level].pending, frame)
+}
+
+// RoundTrip sends HTTP/1.1 request using new stream, and returns response. Chunked request body is decoded, and its
+// trailer fields are sent as trailer section. Response trailer section is returned as trailer fields of chunked
+// response. Deadline set by SetDeadline limits the time of request.
+func (c *Conn) RoundTrip(request []byte, scheme string) ([]byte, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	fields, trailers, body, err := requestFields(request, scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	data := http3Frame(frameHeaders, encodeFields(fields))
+	if len(body) > 0 {
+		data = append(data, http3Frame(frameData, body)...)
+	}
+	if len(trailers) > 0 {
+		data = append(data, http3Frame(frameHeaders, encodeFields(trailers))...)
+	}
+
+	// Server limits number of streams client can open
+	for c.nextStream/4 >= c.maxStreams {
+		if err := c.wait(); err != nil {
+			return nil, err
+		}
+	}
+
+	c.stream = c.nextStream
+	c.nextStream += 4
+	c.streamSent = 0
+	c.streamLimit = c.peer.maxStreamData
+	c.stopped = false
+	c.response = streamBuffer{}
+	c.responseEnd = 0
+	c.streamErr = nil
+
+	// Server can respond before the whole request is sent, e.g. with error
+	for c.streamSent < uint64(len(data)) && !c.stopped && !c.response.complete() && c.streamErr == nil {
+		var credit uint64
+		if c.maxData > c.sentData {
+			credit = c.maxData - c.sentData
+		}
+
+		n := uint64(len(data)) - c.streamSent
+		for _, limit := range []uint64{maxFrameData, credit, c.streamLimit - c.streamSent} {
+			if limit < n {
+				n = limit
+			}
+		}
+
+		if n == 0 || c.inFlight >= c.window {
+			if err := c.wait(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		fin := c.streamSent+n == uint64(len(data))
+		c.queue(tls.QUICEncryptionLevelApplication, streamFrame(c.stream, c.streamSent, data[c.streamSent:c.streamSent+n], fin))
+		c.streamSent += n
+		c.sentData += n
+		if c.err = c.flush(); c.err != nil {
+			return nil, c.err
+		}
+	}
+
+	if c.streamSent < uint64(len(data)) && c.streamErr == nil {
+		// Rest of request is not needed anymore, RESET_STREAM with H3_NO_ERROR
+		frame := appendVarint([]byte{0x04}, c.stream)
+		frame = appendVarint(frame, errorNoError)
+		c.queue(tls.QUICEncryptionLevelApplication, appendVarint(frame, c.streamSent))
+	}
+
+	for !c.response.complete() && c.streamErr == nil {
+		if err := c.wait(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Response is acknowledged at once, so server can release it
+	if c.err = c.flush(); c.err != nil {
+		return nil, c.err
+	}
+	if c.streamErr != nil {
+		return nil, c.streamErr
+	}
+
+	fields, trailers, body, err = decodeMessage(&c.qpack, c.response.data, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return responseHTTP(fields, trailers, body)
+}
+
+// wait sends pending frames, and handles the next datagram or loss detection timeout
+func (c *Conn) wait() error {
+	if c.err == nil {
+		c.err = c.flush()
+	}
+	if c.err == nil {
+		c.err = c.receive()
+	}
+
+	return c.err
+}
+
+// Alive reports if connection can be used for the next request
+func (c *Conn) Alive() bool {
+	timeout := idleTimeout
+	if c.peer.idleTimeout > 0 && c.peer.idleTimeout < timeout {
+		timeout = c.peer.idleTimeout
+	}
+
+	return c.err == nil && time.Since(c.lastReceived) < timeout
+}
+
+// Close closes connection with H3_NO_ERROR, and closes UDP socket
+func (c *Conn) Close() error {
+	if c.writeKeys[tls.QUICEncryptionLevelApplication] != nil {
+		frame := appendVarint([]byte{0x1d}, errorNoError)
+		frame = append(frame, 0, 0)
+		c.spaces[tls.QUICEncryptionLevelApplication].pending = [][]byte{frame}
+		c.flush()
+	}
+	if c.err == nil {
+		c.err = ErrClosed
+	}
+
+	c.tls.Close()
+	return c.conn.Close()
+}
+
+// flush sends pending frames and acknowledgements, each packet in its own datagram
+func (c *Conn) flush() error {
+	for _, level := range levels {
+		sp := &c.spaces[level]
+		if sp.dropped || c.writeKeys[level] == nil {
+			continue
+		}
+
+		for sp.ackPending || len(sp.pending) > 0 {
+			var payload []byte
+			if sp.ackPending {
+				payload = sp.received.appendAck(payload)
+				sp.ackPending = false
+			}
+
+			var frames [][]byte
+			for len(sp.pending) > 0 && (len(frames) == 0 || len(payload)+len(sp.pending[0]) <= maxPayloadSize) {
+				payload = append(payload, sp.pending[0]...)
+				frames = append(frames, sp.pending[0])
+				sp.pending = sp.pending[1:]
+			}
+
+			pn := sp.nextPN
+			sp.nextPN++
+			packet := c.packet(level, pn, payload)
+			if _, err := c.conn.Write(packet); err != nil {
+				return err
+			}
+
+			if len(frames) > 0 {
+				sp.sent[pn] = &sentPacket{frames: frames, size: len(packet), time: time.Now()}
+				c.inFlight += len(packet)
+				c.lastSent = time.Now()
+			}
+		}
+	}
+
+	return nil
+}
+
+// packet returns protected packet of given level. Initial packets are padded, so datagrams carrying them are not
+// smaller than maxDatagramSize. Packet number is always encoded in 4 bytes.
+func (c *Conn) packet(level tls.QUICEncryptionLevel, pn int64, payload []byte) []byte {
+	var header []byte
+	if level == tls.QUICEncryptionLevelApplication {
+		header = []byte{0x43}
+		if c.keyPhase {
+			header[0] |= 0x04
+		}
+		header = append(header, c.dcid...)
+	} else {
+		typ := byte(0x00)
+		if level == tls.QUICEncryptionLevelHandshake {
+			typ = 0x02
+		}
+		header = []byte{0xc3 | typ<<4, 0, 0, 0, 1, byte(len(c.dcid))}
+		header = append(header, c.dcid...)
+		header = append(header, byte(len(c.scid)))
+		header = append(header, c.scid...)
+		if level == tls.QUICEncryptionLevelInitial {
+			header = appendVarint(header, uint64(len(c.token)))
+			header = append(header, c.token...)
+
+			// Header is followed by 2-byte length and packet number, payload by AEAD tag
+			for len(header)+6+len(payload)+16 < maxDatagramSize {
+				payload = append(payload, 0)
+			}
+		}
+
+		length := 4 + len(payload) + 16
+		header = append(header, 0x40|byte(length>>8), byte(length))
+	}
+
+	pnOffset := len(header)
+	header = append(header, byte(pn>>24), byte(pn>>16), byte(pn>>8), byte(pn))
+
+	return c.writeKeys[level].seal(header, pnOffset, pn, payload)
+}
+
+// receive reads the next datagram, or handles probe timeout if it expires first
+func (c *Conn) receive() error {
+	wait, pto := c.deadline, c.probeTimeout()
+	probe := !pto.IsZero() && (wait.IsZero() || pto.Before(wait))
+	if probe {
+		wait = pto
+	}
+
+	c.conn.SetReadDeadline(wait)
+	n, err := c.conn.Read(c.buf)
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() && probe {
+			c.probe()
+			return nil
+		}
+		return err
+	}
+
+	return c.datagram(c.buf[:n])
+}
+
+// datagram handles coalesced packets of datagram sent by server. Packets which can't be decrypted are dropped.
+func (c *Conn) datagram(data []byte) error {
+	for len(data) > 0 {
+		// Short header packet takes the rest of datagram
+		if data[0]&0x80 == 0 {
+			return c.open(tls.QUICEncryptionLevelApplication, data, 1+len(c.scid), nil)
+		}
+
+		r := reader{b: data[1:]}
+		version := r.uint32()
+		if r.err == nil && version == 0 {
+			return errors.New("server does not support QUIC version 1")
+		}
+		dcid := r.bytes(uint64(r.byte()))
+		scid := r.bytes(uint64(r.byte()))
+		if r.err != nil || version != 1 || string(dcid) != string(c.scid) {
+			return nil
+		}
+
+		typ := (data[0] >> 4) & 0x03
+		if typ == 3 {
+			c.retry(data, scid, r.b)
+			return nil
+		}
+
+		level := tls.QUICEncryptionLevelInitial
+		switch typ {
+		case 0:
+			r.bytes(r.varint())
+		case 2:
+			level = tls.QUICEncryptionLevelHandshake
+		default:
+			return nil
+		}
+
+		length := r.varint()
+		if r.err != nil || uint64(len(r.b)) < length {
+			return nil
+		}
+		pnOffset := len(data) - len(r.b)
+		end := pnOffset + int(length)
+
+		if err := c.open(level, data[:end], pnOffset, scid); err != nil {
+			return err
+		}
+		data = data[end:]
+	}
+
+	return nil
+}
+
+// retry handles Retry packet, so Initial packets are sent again with its token to new connection ID
+func (c *Conn) retry(packet, scid, rest []byte) {
+	if c.retried || c.serverCID || len(rest) < 16 || !validRetry(c.odcid, packet) {
+		return
+	}
+
+	c.retried = true
+	c.token = append([]byte{}, rest[:len(rest)-16]...)
+	c.retrySCID = append([]byte{}, scid...)
+	c.dcid = c.retrySCID
+	c.writeKeys[tls.QUICEncryptionLevelInitial], c.readKeys[tls.QUICEncryptionLevelInitial] = initialKeys(c.dcid)
+
+	c.lose(tls.QUICEncryptionLevelInitial, func(int64) bool { return true })
+}
+
+// open decrypts packet of given level, and handles its frames. The first Initial packet of server sets connection ID
+// chosen by server.
+func (c *Conn) open(level tls.QUICEncryptionLevel, data []byte, pnOffset int, scid []byte) error {
+	sp := &c.spaces[level]
+	keys := c.readKeys[level]
+	if sp.dropped || keys == nil {
+		return nil
+	}
+
+	packet := append([]byte{}, data...)
+	pn, headerLen, err := keys.unprotect(packet, pnOffset, sp.largest)
+	if err != nil {
+		return nil
+	}
+
+	var payload []byte
+	if phase := packet[0]&0x04 != 0; level != tls.QUICEncryptionLevelApplication || phase == c.keyPhase {
+		payload, err = keys.decrypt(packet, headerLen, pn)
+	} else if c.prevKeys != nil && pn < sp.largest {
+		// Packet of previous key phase, which was reordered
+		payload, err = c.prevKeys.decrypt(packet, headerLen, pn)
+	} else {
+		// Server updated keys, and keys of client are updated too, RFC 9001 section 6.2
+		var next *packetKeys
+		if next, err = keys.next(); err == nil {
+			if payload, err = next.decrypt(packet, headerLen, pn); err == nil {
+				c.prevKeys, c.readKeys[level] = keys, next
+				if c.writeKeys[level], err = c.writeKeys[level].next(); err != nil {
+					return err
+				}
+				c.keyPhase = !c.keyPhase
+			}
+		}
+	}
+	if err != nil {
+		return nil
+	}
+
+	if pn > sp.largest {
+		sp.largest = pn
+	}
+	sp.received.add(pn)
+	c.lastReceived = time.Now()
+
+	if level == tls.QUICEncryptionLevelInitial && !c.serverCID {
+		c.dcid = append([]byte{}, scid...)
+		c.serverCID = true
+	}
+
+	elicit, err := c.frames(level, payload)
+	if elicit {
+		c.spaces[level].ackPending = true
+	}
+
+	return err
+}
+
+// frames handles frames of decrypted packet, and reports if packet should be acknowledged
+func (c *Conn) frames(level tls.QUICEncryptionLevel, payload []byte) (elicit bool, err error) {
+	r := reader{b: payload}
+
+	for len(r.b) > 0 && r.err == nil {
+		typ := r.varint()
+		if typ != 0x00 && typ != 0x02 && typ != 0x03 && typ != 0x1c && typ != 0x1d {
+			elicit = true
+		}
+
+		switch {
+		case typ == 0x00, typ == 0x01:
+			// PADDING, PING
+		case typ == 0x02 || typ == 0x03:
+			largest := int64(r.varint())
+			delay := r.varint()
+			count := r.varint()
+			ranges := []ackRange{{largest - int64(r.varint()), largest}}
+			for i := uint64(0); i < count && r.err == nil; i++ {
+				hi := ranges[len(ranges)-1].lo - int64(r.varint()) - 2
+				ranges = append(ranges, ackRange{hi - int64(r.varint()), hi})
+			}
+			if typ == 0x03 {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+			if r.err == nil {
+				c.ack(level, ranges, time.Duration(delay<<c.peer.ackDelayExponent)*time.Microsecond)
+			}
+		case typ == 0x04:
+			// RESET_STREAM
+			id, code := r.varint(), r.varint()
+			r.varint()
+			if id == c.stream && r.err == nil {
+				c.streamErr = fmt.Errorf("stream is reset by server with error 0x%x", code)
+			}
+		case typ == 0x05:
+			// STOP_SENDING, request is reset when its sending is stopped
+			if id := r.varint(); id == c.stream {
+				c.stopped = true
+			}
+			r.varint()
+		case typ == 0x06:
+			offset := r.varint()
+			data := r.bytes(r.varint())
+			if r.err == nil {
+				if err := c.cryptoData(level, offset, data); err != nil {
+					return elicit, err
+				}
+			}
+		case typ == 0x07:
+			// NEW_TOKEN
+			r.bytes(r.varint())
+		case typ >= 0x08 && typ <= 0x0f:
+			id := r.varint()
+			var offset uint64
+			if typ&0x04 != 0 {
+				offset = r.varint()
+			}
+			var data []byte
+			if typ&0x02 != 0 {
+				data = r.bytes(r.varint())
+			} else {
+				data = r.b
+				r.b = nil
+			}
+			if r.err == nil {
+				c.streamData(id, offset, data, typ&0x01 != 0)
+			}
+		case typ == 0x10:
+			if v := r.varint(); v > c.maxData {
+				c.maxData = v
+			}
+		case typ == 0x11:
+			if id, v := r.varint(), r.varint(); id == c.stream && v > c.streamLimit {
+				c.streamLimit = v
+			}
+		case typ == 0x12:
+			if v := r.varint(); v > c.maxStreams {
+				c.maxStreams = v
+			}
+		case typ == 0x13, typ == 0x14, typ == 0x16, typ == 0x17, typ == 0x19:
+			// MAX_STREAMS of unidirectional streams, DATA_BLOCKED, STREAMS_BLOCKED, RETIRE_CONNECTION_ID
+			r.varint()
+		case typ == 0x15:
+			// STREAM_DATA_BLOCKED
+			r.varint()
+			r.varint()
+		case typ == 0x18:
+			// NEW_CONNECTION_ID, connection IDs are not changed
+			r.varint()
+			r.varint()
+			r.bytes(uint64(r.byte()))
+			r.bytes(16)
+		case typ == 0x1a:
+			// PATH_CHALLENGE
+			if data := r.bytes(8); r.err == nil {
+				c.queue(level, append([]byte{0x1b}, data...))
+			}
+		case typ == 0x1b:
+			r.bytes(8)
+		case typ == 0x1c || typ == 0x1d:
+			code := r.varint()
+			if typ == 0x1c {
+				r.varint()
+			}
+			reason := r.bytes(r.varint())
+			return elicit, fmt.Errorf("connection is closed by server with error 0x%x %q", code, reason)
+		case typ == 0x1e:
+			// HANDSHAKE_DONE confirms handshake
+			c.confirmed = true
+			c.drop(tls.QUICEncryptionLevelHandshake)
+		case typ == 0x30:
+			r.b = nil
+		case typ == 0x31:
+			r.bytes(r.varint())
+		default:
+			return elicit, fmt.Errorf("unknown frame type 0x%x", typ)
+		}
+	}
+
+	return elicit, r.err
+}
+
+// cryptoData passes CRYPTO frame data to TLS in order
+func (c *Conn) cryptoData(level tls.QUICEncryptionLevel, offset uint64, data []byte) error {
+	buf := &c.crypto[level]
+	buf.write(offset, data, false, time.Time{})
+	if buf.dropped {
+		return errors.New("TLS handshake is too large")
+	}
+	if len(buf.data) == 0 {
+		return nil
+	}
+
+	data = buf.data
+	buf.consume(len(data))
+	if err := c.tls.HandleData(level, data); err != nil {
+		return err
+	}
+
+	return c.events()
+}
+
+// streamData handles STREAM frame, response is received on request stream and data of unidirectional streams of
+// server is discarded. Receive window of connection is raised when half of it is used.
+func (c *Conn) streamData(id, offset uint64, data []byte, fin bool) {
+	end := offset + uint64(len(data))
+
+	switch {
+	case id&0x03 == 0x03:
+		if end > c.uniReceived[id] {
+			c.received += end - c.uniReceived[id]
+			c.uniReceived[id] = end
+		}
+	case id == c.stream:
+		if end > c.responseEnd {
+			c.received += end - c.responseEnd
+			c.responseEnd = end
+		}
+		c.response.write(offset, data, fin, time.Time{})
+		if c.response.dropped {
+			c.streamErr = errors.New("response is too large")
+		}
+	default:
+		return
+	}
+
+	if c.received+connWindow/2 > c.recvLimit {
+		c.recvLimit = c.received + connWindow
+		c.queue(tls.QUICEncryptionLevelApplication, appendVarint([]byte{0x10}, c.recvLimit))
+	}
+}
+
+// ack handles ACK frame. Newly acknowledged packets update RTT estimate and grow congestion window, and packets sent
+// 3 packets before the largest acknowledged one are lost, RFC 9002 section 6.1.
+func (c *Conn) ack(level tls.QUICEncryptionLevel, ranges []ackRange, delay time.Duration) {
+	sp := &c.spaces[level]
+
+	largest := ranges[0].hi
+	if p := sp.sent[largest]; p != nil {
+		if level != tls.QUICEncryptionLevelApplication || delay > c.peer.maxAckDelay {
+			delay = 0
+		}
+		c.updateRTT(time.Since(p.time), delay)
+	}
+
+	var newly bool
+	for pn, p := range sp.sent {
+		for _, r := range ranges {
+			if pn >= r.lo && pn <= r.hi {
+				delete(sp.sent, pn)
+				c.inFlight -= p.size
+				c.window += p.size
+				newly = true
+				break
+			}
+		}
+	}
+	if !newly {
+		return
+	}
+
+	c.ptoCount = 0
+	if largest > sp.acked {
+		sp.acked = largest
+	}
+
+	if c.lose(level, func(pn int64) bool { return pn+3 <= sp.acked }) {
+		if c.window /= 2; c.window < minimumWindow {
+			c.window = minimumWindow
+		}
+	}
+}
+
+func (c *Conn) updateRTT(sample, delay time.Duration) {
+	if !c.hasRTT {
+		c.smoothedRTT, c.rttVar, c.hasRTT = sample, sample/2, true
+		return
+	}
+
+	if sample-delay >= granularity {
+		sample -= delay
+	}
+	diff := c.smoothedRTT - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	c.rttVar = (3*c.rttVar + diff) / 4
+	c.smoothedRTT = (7*c.smoothedRTT + sample) / 8
+}
+
+// lose queues frames of sent packets matching filter again, in order they were sent
+func (c *Conn) lose(level tls.QUICEncryptionLevel, lost func(pn int64) bool) bool {
+	sp := &c.spaces[level]
+
+	var pns []int64
+	for pn := range sp.sent {
+		if lost(pn) {
+			pns = append(pns, pn)
+		}
+	}
+	sort.Slice(pns, func(i, j int) bool { return pns[i] < pns[j] })
+
+	var frames [][]byte
+	for _, pn := range pns {
+		frames = append(frames, sp.sent[pn].frames...)
+		c.inFlight -= sp.sent[pn].size
+		delete(sp.sent, pn)
+	}
+	sp.pending = append(frames, sp.pending...)
+
+	return len(pns) > 0
+}
+
+// probeTimeout returns time frames are sent again if their packets are not acknowledged. Until handshake is
+// confirmed, timeout is armed even if nothing is in flight, so server is not blocked by anti-amplification limit.
+func (c *Conn) probeTimeout() time.Time {
+	var outstanding bool
+	for _, level := range levels {
+		outstanding = outstanding || len(c.spaces[level].sent) > 0
+	}
+	if !outstanding && c.confirmed || c.lastSent.IsZero() {
+		return time.Time{}
+	}
+
+	rtt, rttVar := initialRTT, initialRTT/2
+	if c.hasRTT {
+		rtt, rttVar = c.smoothedRTT, c.rttVar
+	}
+	if rttVar *= 4; rttVar < granularity {
+		rttVar = granularity
+	}
+	pto := rtt + rttVar
+	if c.handshakeDone {
+		pto += c.peer.maxAckDelay
+	}
+
+	count := c.ptoCount
+	if count > 6 {
+		count = 6
+	}
+
+	return c.lastSent.Add(pto << count)
+}
+
+// probe sends frames of packets in flight again after probe timeout, or PING if there are none
+func (c *Conn) probe() {
+	c.ptoCount++
+
+	var lost bool
+	for _, level := range levels {
+		if c.lose(level, func(int64) bool { return true }) {
+			lost = true
+		}
+	}
+	if lost {
+		return
+	}
+
+	for i := len(levels) - 1; i >= 0; i-- {
+		if level := levels[i]; !c.spaces[level].dropped && c.writeKeys[level] != nil {
+			c.queue(level, []byte{0x01})
+			return
+		}
+	}
+}
+
+// ackRange is range of received packet numbers
+type ackRange struct {
+	lo, hi int64
+}
+
+// ackRanges keeps the latest ranges of received packet numbers, the highest first
+type ackRanges []ackRange
+
+// Older ranges are not acknowledged anymore
+const maxAckRanges = 32
+
+func (r *ackRanges) add(pn int64) {
+	rs := *r
+	for i := range rs {
+		switch {
+		case pn > rs[i].hi+1:
+			rs = append(rs, ackRange{})
+			copy(rs[i+1:], rs[i:])
+			rs[i] = ackRange{pn, pn}
+		case pn == rs[i].hi+1:
+			rs[i].hi = pn
+		case pn >= rs[i].lo:
+		case pn == rs[i].lo-1:
+			rs[i].lo = pn
+			if i+1 < len(rs) && rs[i+1].hi == pn-1 {
+				rs[i].lo = rs[i+1].lo
+				rs = append(rs[:i+1], rs[i+2:]...)
+			}
+		default:
+			continue
+		}
+
+		if len(rs) > maxAckRanges {
+			rs = rs[:maxAckRanges]
+		}
+		*r = rs
+		return
+	}
+
+	if len(rs) < maxAckRanges {
+		*r = append(rs, ackRange{pn, pn})
+	}
+}
+
+// appendAck appends ACK frame acknowledging all ranges
+func (r ackRanges) appendAck(b []byte) []byte {
+	b = append(b, 0x02)
+	b = appendVarint(b, uint64(r[0].hi))
+	b = append(b, 0)
+	b = appendVarint(b, uint64(len(r)-1))
+	b = appendVarint(b, uint64(r[0].hi-r[0].lo))
+
+	for i := 1; i < len(r); i++ {
+		b = appendVarint(b, uint64(r[i-1].lo-r[i].hi-2))
+		b = appendVarint(b, uint64(r[i].hi-r[i].lo))
+	}
+
+	return b
+}
@@ -0,0 +1,44 @@
+//go:build !go1.21
+// +build !go1.21
+
+package quic
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrClosed is returned for requests of connection closed by server
+var ErrClosed = errors.New("connection is closed")
+
+var errNotSupported = errors.New("HTTP/3 client requires QUIC support of crypto/tls, build gor with Go 1.21 or newer")
+
+// Conn is client of HTTP/3 server, which is not supported by Go versions without QUIC API of crypto/tls. Handshake
+// fails, so HTTP/3 requests fall back to TCP.
+type Conn struct {
+	conn net.Conn
+}
+
+func NewConn(conn net.Conn, config *tls.Config) *Conn {
+	return &Conn{conn: conn}
+}
+
+func (c *Conn) SetDeadline(t time.Time) {}
+
+func (c *Conn) Handshake() error {
+	return errNotSupported
+}
+
+func (c *Conn) RoundTrip(request []byte, scheme string) ([]byte, error) {
+	return nil, errNotSupported
+}
+
+func (c *Conn) Alive() bool {
+	return false
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,562 @@
+//go:build go1.21
+// +build go1.21
+
+package quic
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Flow control windows of test server, smaller than requests, so client waits for MAX_DATA and MAX_STREAM_DATA
+const testServerWindow = 32 << 10
+
+// testServer is minimal HTTP/3 server, which responds with request body and trailers. It acknowledges every
+// ack-eliciting packet, and does not send lost packets again.
+type testServer struct {
+	conn   net.PacketConn
+	client net.Addr
+	config *tls.Config
+	tls    *tls.QUICConn
+	err    error
+
+	// Connection IDs of client and server, and the first destination connection ID of client
+	clientCID []byte
+	serverCID []byte
+	odcid     []byte
+
+	readKeys  [4]*packetKeys
+	writeKeys [4]*packetKeys
+	// Read keys of the next key phase, after server updated keys
+	nextKeys  *packetKeys
+	readPhase bool
+	keyPhase  bool
+
+	nextPN    [4]int64
+	received  [4]ackRanges
+	elicited  [4]bool
+	pending   [4][][]byte
+	crypto    [4]streamBuffer
+	cryptoOut [4]uint64
+	streams   map[uint64]*streamBuffer
+	responded map[uint64]bool
+	qpack     qpackDecoder
+
+	// Send Retry packet before handshake, drop datagrams of client for which drop returns true, and update keys
+	// after the first response
+	retry     bool
+	drop      func(n int) bool
+	keyUpdate bool
+	datagrams int
+}
+
+func (s *testServer) serve() {
+	s.streams = make(map[uint64]*streamBuffer)
+	s.responded = make(map[uint64]bool)
+
+	buf := make([]byte, 64<<10)
+	for {
+		// Pending packets are sent on timeout too, if datagram of client which would clock them is lost
+		s.conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		n, addr, err := s.conn.ReadFrom(buf)
+		if e, ok := err.(net.Error); ok && e.Timeout() && s.client != nil {
+			if s.err = s.flush(); s.err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		if s.datagrams++; s.drop != nil && s.drop(s.datagrams) {
+			continue
+		}
+		s.client = addr
+
+		closed, err := s.datagram(buf[:n])
+		if err == nil && !closed {
+			err = s.flush()
+		}
+		if err != nil || closed {
+			s.err = err
+			return
+		}
+	}
+}
+
+func (s *testServer) datagram(data []byte) (bool, error) {
+	for len(data) > 0 {
+		if data[0]&0x80 == 0 {
+			return s.packet(tls.QUICEncryptionLevelApplication, data, 1+len(s.serverCID))
+		}
+
+		r := reader{b: data[1:]}
+		r.uint32()
+		dcid := r.bytes(uint64(r.byte()))
+		scid := r.bytes(uint64(r.byte()))
+
+		level := tls.QUICEncryptionLevelHandshake
+		var token []byte
+		if (data[0]>>4)&0x03 == 0 {
+			level = tls.QUICEncryptionLevelInitial
+			token = r.bytes(r.varint())
+		}
+		length := r.varint()
+		if r.err != nil || uint64(len(r.b)) < length {
+			return false, fmt.Errorf("malformed packet %x", data)
+		}
+		pnOffset := len(data) - len(r.b)
+		end := pnOffset + int(length)
+
+		if s.tls == nil {
+			if s.retry && len(token) == 0 {
+				return false, s.sendRetry(dcid, scid)
+			}
+			if err := s.start(dcid, scid); err != nil {
+				return false, err
+			}
+		}
+
+		if closed, err := s.packet(level, data[:end], pnOffset); closed || err != nil {
+			return closed, err
+		}
+		data = data[end:]
+	}
+
+	return false, nil
+}
+
+func (s *testServer) sendRetry(dcid, scid []byte) error {
+	s.odcid = append([]byte{}, dcid...)
+	s.serverCID = []byte("retrycid")
+
+	packet := []byte{0xf0, 0, 0, 0, 1, byte(len(scid))}
+	packet = append(packet, scid...)
+	packet = append(packet, byte(len(s.serverCID)))
+	packet = append(packet, s.serverCID...)
+	packet = append(packet, "token"...)
+
+	block, _ := aes.NewCipher(retryKey)
+	aead, _ := cipher.NewGCM(block)
+	pseudo := append([]byte{byte(len(dcid))}, dcid...)
+	packet = aead.Seal(packet, retryNonce, nil, append(pseudo, packet...))
+
+	_, err := s.conn.WriteTo(packet, s.client)
+	return err
+}
+
+func (s *testServer) start(dcid, scid []byte) error {
+	s.clientCID = append([]byte{}, scid...)
+	if s.odcid == nil {
+		s.odcid = append([]byte{}, dcid...)
+		s.serverCID = []byte("servercid")
+	}
+	s.readKeys[tls.QUICEncryptionLevelInitial], s.writeKeys[tls.QUICEncryptionLevelInitial] = initialKeys(dcid)
+
+	s.tls = tls.QUICServer(&tls.QUICConfig{TLSConfig: s.config})
+	if err := s.tls.Start(context.Background()); err != nil {
+		return err
+	}
+
+	return s.events()
+}
+
+func (s *testServer) transportParameters() []byte {
+	var b []byte
+	param := func(id uint64, value []byte) {
+		b = appendVarint(b, id)
+		b = appendVarint(b, uint64(len(value)))
+		b = append(b, value...)
+	}
+
+	param(0x00, s.odcid)
+	param(0x01, appendVarint(nil, 30000))
+	param(0x04, appendVarint(nil, testServerWindow))
+	param(0x06, appendVarint(nil, testServerWindow))
+	param(0x07, appendVarint(nil, testServerWindow))
+	param(0x08, appendVarint(nil, 1))
+	param(0x09, appendVarint(nil, 3))
+	param(0x0f, s.serverCID)
+	if s.retry {
+		param(0x10, s.serverCID)
+	}
+
+	return b
+}
+
+func (s *testServer) events() error {
+	for {
+		e := s.tls.NextEvent()
+
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return nil
+		case tls.QUICTransportParametersRequired:
+			s.tls.SetTransportParameters(s.transportParameters())
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			keys, err := newPacketKeys(cipherSuites[e.Suite], append([]byte{}, e.Data...))
+			if err != nil {
+				return err
+			}
+			if e.Kind == tls.QUICSetReadSecret {
+				s.readKeys[e.Level] = keys
+			} else {
+				s.writeKeys[e.Level] = keys
+			}
+		case tls.QUICWriteData:
+			for data := e.Data; len(data) > 0; {
+				n := len(data)
+				if n > maxFrameData {
+					n = maxFrameData
+				}
+				s.pending[e.Level] = append(s.pending[e.Level], cryptoFrame(s.cryptoOut[e.Level], data[:n]))
+				s.cryptoOut[e.Level] += uint64(n)
+				data = data[n:]
+			}
+		case tls.QUICHandshakeDone:
+			s.pending[tls.QUICEncryptionLevelApplication] = append(s.pending[tls.QUICEncryptionLevelApplication], []byte{0x1e})
+		}
+	}
+}
+
+func (s *testServer) packet(level tls.QUICEncryptionLevel, data []byte, pnOffset int) (bool, error) {
+	keys := s.readKeys[level]
+	if keys == nil {
+		return false, nil
+	}
+
+	packet := append([]byte{}, data...)
+	pn, headerLen, err := keys.unprotect(packet, pnOffset, 0)
+	if err != nil {
+		return false, err
+	}
+	if phase := packet[0]&0x04 != 0; level == tls.QUICEncryptionLevelApplication && phase != s.readPhase {
+		s.readKeys[level], keys, s.readPhase = s.nextKeys, s.nextKeys, phase
+	}
+	payload, err := keys.decrypt(packet, headerLen, pn)
+	if err != nil {
+		return false, err
+	}
+	s.received[level].add(pn)
+
+	r := reader{b: payload}
+	for len(r.b) > 0 && r.err == nil {
+		typ := r.varint()
+		if typ != 0x00 && typ != 0x02 {
+			s.elicited[level] = true
+		}
+
+		switch {
+		case typ == 0x00, typ == 0x01:
+		case typ == 0x02:
+			r.varint()
+			r.varint()
+			count := r.varint()
+			r.varint()
+			for i := uint64(0); i < count; i++ {
+				r.varint()
+				r.varint()
+			}
+		case typ == 0x04:
+			r.varint()
+			r.varint()
+			r.varint()
+		case typ == 0x06:
+			offset := r.varint()
+			data := r.bytes(r.varint())
+			if r.err != nil {
+				break
+			}
+
+			buf := &s.crypto[level]
+			buf.write(offset, data, false, time.Time{})
+			if len(buf.data) > 0 {
+				data := buf.data
+				buf.consume(len(data))
+				if err := s.tls.HandleData(level, data); err != nil {
+					return false, err
+				}
+				if err := s.events(); err != nil {
+					return false, err
+				}
+			}
+		case typ >= 0x08 && typ <= 0x0f:
+			id := r.varint()
+			offset := r.varint()
+			data := r.bytes(r.varint())
+			if r.err == nil {
+				if err := s.streamData(id, offset, data, typ&0x01 != 0); err != nil {
+					return false, err
+				}
+			}
+		case typ == 0x10:
+			r.varint()
+		case typ == 0x1d:
+			return true, nil
+		default:
+			return false, fmt.Errorf("unexpected frame type 0x%x", typ)
+		}
+	}
+
+	return false, r.err
+}
+
+// streamData echoes request body and trailers, when request is complete. Flow control windows are raised as
+// request data arrives.
+func (s *testServer) streamData(id, offset uint64, data []byte, fin bool) error {
+	if id&0x02 != 0 {
+		return nil
+	}
+
+	b := s.streams[id]
+	if b == nil {
+		b = new(streamBuffer)
+		s.streams[id] = b
+	}
+	b.write(offset, data, fin, time.Time{})
+
+	var received uint64
+	for _, b := range s.streams {
+		received += b.offset + uint64(len(b.data))
+	}
+	maxData := appendVarint([]byte{0x10}, received+testServerWindow+100)
+	maxStreamData := appendVarint(appendVarint([]byte{0x11}, id), b.offset+uint64(len(b.data))+testServerWindow)
+	s.pending[tls.QUICEncryptionLevelApplication] = append(s.pending[tls.QUICEncryptionLevelApplication], maxData, maxStreamData)
+
+	if !b.complete() || s.responded[id] {
+		return nil
+	}
+	s.responded[id] = true
+
+	fields, trailers, body, err := decodeMessage(&s.qpack, b.data, false)
+	if err != nil {
+		return err
+	}
+
+	resp := http3Frame(frameHeaders, encodeFields([]headerField{{":status", "200"}, {"x-path", fieldValue(fields, ":path")}}))
+	if len(body) > 0 {
+		resp = append(resp, http3Frame(frameData, body)...)
+	}
+	if len(trailers) > 0 {
+		resp = append(resp, http3Frame(frameHeaders, encodeFields(trailers))...)
+	}
+
+	for sent := 0; sent < len(resp); sent += maxFrameData {
+		end := sent + maxFrameData
+		if end > len(resp) {
+			end = len(resp)
+		}
+		frame := streamFrame(id, uint64(sent), resp[sent:end], end == len(resp))
+		s.pending[tls.QUICEncryptionLevelApplication] = append(s.pending[tls.QUICEncryptionLevelApplication], frame)
+	}
+	// Request stream can be opened again
+	s.pending[tls.QUICEncryptionLevelApplication] = append(s.pending[tls.QUICEncryptionLevelApplication], appendVarint([]byte{0x12}, id/4+2))
+
+	if s.keyUpdate && len(s.responded) == 1 {
+		app := tls.QUICEncryptionLevelApplication
+		if s.writeKeys[app], err = s.writeKeys[app].next(); err != nil {
+			return err
+		}
+		if s.nextKeys, err = s.readKeys[app].next(); err != nil {
+			return err
+		}
+		s.keyPhase = true
+	}
+
+	return nil
+}
+
+func (s *testServer) flush() error {
+	for _, level := range levels {
+		keys := s.writeKeys[level]
+		if keys == nil {
+			continue
+		}
+
+		// Response is clocked by acknowledgements, one packet per datagram of client, so socket buffer of client
+		// does not overflow
+		for sent := 0; s.elicited[level] || len(s.pending[level]) > 0 && (sent == 0 || level != tls.QUICEncryptionLevelApplication); sent++ {
+			var payload []byte
+			if s.elicited[level] {
+				payload = s.received[level].appendAck(nil)
+				s.elicited[level] = false
+			}
+			for n := 0; len(s.pending[level]) > 0 && (n == 0 || len(payload)+len(s.pending[level][0]) <= maxPayloadSize); n++ {
+				payload = append(payload, s.pending[level][0]...)
+				s.pending[level] = s.pending[level][1:]
+			}
+
+			var header []byte
+			if level == tls.QUICEncryptionLevelApplication {
+				header = []byte{0x43}
+				if s.keyPhase {
+					header[0] |= 0x04
+				}
+				header = append(header, s.clientCID...)
+			} else {
+				typ := byte(0)
+				if level == tls.QUICEncryptionLevelHandshake {
+					typ = 2
+				}
+				header = []byte{0xc3 | typ<<4, 0, 0, 0, 1, byte(len(s.clientCID))}
+				header = append(header, s.clientCID...)
+				header = append(header, byte(len(s.serverCID)))
+				header = append(header, s.serverCID...)
+				if level == tls.QUICEncryptionLevelInitial {
+					header = append(header, 0)
+				}
+				length := 4 + len(payload) + 16
+				header = append(header, 0x40|byte(length>>8), byte(length))
+			}
+
+			pn := s.nextPN[level]
+			s.nextPN[level]++
+			pnOffset := len(header)
+			header = append(header, byte(pn>>24), byte(pn>>16), byte(pn>>8), byte(pn))
+
+			if _, err := s.conn.WriteTo(keys.seal(header, pnOffset, pn, payload), s.client); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestConn(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}, NextProtos: []string{"h3"}, MinVersion: tls.VersionTLS13}
+
+	// Body exceeds flow control windows of server, and is sent in many packets
+	body := bytes.Repeat([]byte("0123456789"), 10000)
+
+	for _, tc := range []struct {
+		name   string
+		server *testServer
+	}{
+		{"handshake", &testServer{}},
+		{"retry", &testServer{retry: true}},
+		{"loss", &testServer{drop: func(n int) bool { return n%10 == 3 }}},
+		{"key update", &testServer{keyUpdate: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := tc.server
+			s.conn, s.config = l, config
+			done := make(chan struct{})
+			go func() {
+				s.serve()
+				close(done)
+			}()
+
+			conn, err := net.Dial("udp", l.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := NewConn(conn, &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"})
+			c.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := c.Handshake(); err != nil {
+				t.Fatal(err, s.err, c.handshakeDone, c.serverCID, s.datagrams)
+			}
+
+			response, err := c.RoundTrip([]byte("GET /search?q=gor HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive\r\n\r\n"), "https")
+			if resp := string(response); err != nil || resp != "HTTP/1.1 200 OK\r\nx-path: /search?q=gor\r\n\r\n" {
+				t.Errorf("unexpected response %q %v", resp, err)
+			}
+
+			for i := 0; i < 2; i++ {
+				request := "POST /upload HTTP/1.1\r\nHost: example.com\r\nTrailer: X-Request\r\nTransfer-Encoding: chunked\r\n\r\n" +
+					strconv.FormatInt(int64(len(body)), 16) + "\r\n" + string(body) + "\r\n0\r\nX-Request: " + strconv.Itoa(i) + "\r\n\r\n"
+
+				response, err := c.RoundTrip([]byte(request), "https")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				resp := string(response)
+				if !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\nx-path: /upload\r\n") || !strings.Contains(resp, string(body)) ||
+					!strings.HasSuffix(resp, "\r\n0\r\nx-request: "+strconv.Itoa(i)+"\r\n\r\n") {
+					t.Errorf("unexpected response %.200q", resp)
+				}
+			}
+
+			if !c.Alive() {
+				t.Error("connection is not alive")
+			}
+			if tc.server.keyUpdate && !c.keyPhase {
+				t.Error("keys are not updated")
+			}
+
+			c.Close()
+			if _, err := c.RoundTrip([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "https"); err != ErrClosed {
+				t.Error("closed connection is used", err)
+			}
+
+			// Datagram with CONNECTION_CLOSE can be dropped
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+			}
+			l.Close()
+			<-done
+			if s.err != nil {
+				t.Error(s.err)
+			}
+		})
+	}
+}
+
+func TestAckRanges(t *testing.T) {
+	var r ackRanges
+	for _, pn := range []int64{0, 1, 5, 3, 4, 9, 2, 9, 7} {
+		r.add(pn)
+	}
+
+	if fmt.Sprint(r) != "[{9 9} {7 7} {0 5}]" {
+		t.Fatal("wrong ranges", r)
+	}
+
+	// Largest 9, no delay, 2 ranges after the first one of length 0: gap 0 and length 0, gap 0 and length 5
+	if ack := r.appendAck(nil); !bytes.Equal(ack, []byte{0x02, 9, 0, 2, 0, 0, 0, 0, 5}) {
+		t.Errorf("wrong ACK frame %x", ack)
+	}
+}
@@ -0,0 +1,212 @@
+package quic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+)
+
+// Salt of initial secrets of QUIC version 1, RFC 9001 section 5.2
+var initialSalt = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+
+var errDecrypt = errors.New("packet can't be decrypted")
+
+// cipherSuite of TLS 1.3. Only AES-GCM suites are supported, ChaCha20 is not available in standard library.
+type cipherSuite struct {
+	hash   func() hash.Hash
+	keyLen int
+}
+
+var cipherSuites = map[uint16]cipherSuite{
+	0x1301: {sha256.New, 16},    // TLS_AES_128_GCM_SHA256
+	0x1302: {sha512.New384, 32}, // TLS_AES_256_GCM_SHA384
+}
+
+func hkdfExtract(h func() hash.Hash, salt, secret []byte) []byte {
+	mac := hmac.New(h, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel derives secret of given length, with empty context, RFC 8446 section 7.1
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	info := []byte{byte(length >> 8), byte(length), byte(len("tls13 ") + len(label))}
+	info = append(info, "tls13 "...)
+	info = append(info, label...)
+	info = append(info, 0)
+
+	var out, prev []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(h, secret)
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+
+	return out[:length]
+}
+
+// packetKeys protect packets sent in one direction, RFC 9001 section 5
+type packetKeys struct {
+	suite  cipherSuite
+	secret []byte
+	aead   cipher.AEAD
+	iv     []byte
+	hp     cipher.Block
+}
+
+func newPacketKeys(suite cipherSuite, secret []byte) (*packetKeys, error) {
+	k := &packetKeys{suite: suite, secret: secret}
+	k.iv = hkdfExpandLabel(suite.hash, secret, "quic iv", 12)
+
+	block, err := aes.NewCipher(hkdfExpandLabel(suite.hash, secret, "quic key", suite.keyLen))
+	if err != nil {
+		return nil, err
+	}
+	if k.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	if k.hp, err = aes.NewCipher(hkdfExpandLabel(suite.hash, secret, "quic hp", suite.keyLen)); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// initialKeys returns keys of Initial packets sent by client and server, derived from destination connection ID
+// of the first Initial packet of client
+func initialKeys(dcid []byte) (client, server *packetKeys) {
+	suite := cipherSuites[0x1301]
+	secret := hkdfExtract(suite.hash, initialSalt, dcid)
+
+	client, _ = newPacketKeys(suite, hkdfExpandLabel(suite.hash, secret, "client in", 32))
+	server, _ = newPacketKeys(suite, hkdfExpandLabel(suite.hash, secret, "server in", 32))
+
+	return
+}
+
+// next returns keys of the next key phase. Header protection key is not updated.
+func (k *packetKeys) next() (*packetKeys, error) {
+	next, err := newPacketKeys(k.suite, hkdfExpandLabel(k.suite.hash, k.secret, "quic ku", len(k.secret)))
+	if err != nil {
+		return nil, err
+	}
+	next.hp = k.hp
+
+	return next, nil
+}
+
+// unprotect removes header protection of packet in place, and returns its packet number and length of header.
+// Largest packet number received in the same space is used to decode truncated packet number.
+func (k *packetKeys) unprotect(packet []byte, pnOffset int, largest int64) (pn int64, headerLen int, err error) {
+	if len(packet) < pnOffset+4+aes.BlockSize {
+		return 0, 0, errDecrypt
+	}
+
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	if packet[0]&0x80 != 0 {
+		packet[0] ^= mask[0] & 0x0f
+	} else {
+		packet[0] ^= mask[0] & 0x1f
+	}
+
+	pnLen := int(packet[0]&0x03) + 1
+	var truncated int64
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+		truncated = truncated<<8 | int64(packet[pnOffset+i])
+	}
+
+	return decodePacketNumber(largest, truncated, uint(pnLen*8)), pnOffset + pnLen, nil
+}
+
+// decrypt decrypts payload of unprotected packet
+func (k *packetKeys) decrypt(packet []byte, headerLen int, pn int64) ([]byte, error) {
+	payload, err := k.aead.Open(nil, k.nonce(pn), packet[headerLen:], packet[:headerLen])
+	if err != nil {
+		return nil, errDecrypt
+	}
+
+	return payload, nil
+}
+
+// seal encrypts payload and protects header of packet, whose header ends with packet number starting at pnOffset.
+// Payload with packet number should be at least 4 bytes long, so header protection can be sampled.
+func (k *packetKeys) seal(header []byte, pnOffset int, pn int64, payload []byte) []byte {
+	packet := make([]byte, len(header), len(header)+len(payload)+k.aead.Overhead())
+	copy(packet, header)
+	packet = k.aead.Seal(packet, k.nonce(pn), payload, header)
+
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	if packet[0]&0x80 != 0 {
+		packet[0] ^= mask[0] & 0x0f
+	} else {
+		packet[0] ^= mask[0] & 0x1f
+	}
+	for i := 0; i < len(header)-pnOffset; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+
+	return packet
+}
+
+// nonce of packet is IV combined with packet number
+func (k *packetKeys) nonce(pn int64) []byte {
+	nonce := make([]byte, len(k.iv))
+	copy(nonce, k.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * uint(i)))
+	}
+
+	return nonce
+}
+
+// Key and nonce of Retry integrity tag of QUIC version 1, RFC 9001 section 5.8
+var (
+	retryKey   = []byte{0xbe, 0x0c, 0x69, 0x0b, 0x9f, 0x66, 0x57, 0x5a, 0x1d, 0x76, 0x6b, 0x54, 0xe3, 0x68, 0xc8, 0x4e}
+	retryNonce = []byte{0x46, 0x15, 0x99, 0xd3, 0x5d, 0x63, 0x2b, 0xf2, 0x23, 0x98, 0x25, 0xbb}
+)
+
+// validRetry checks integrity tag of Retry packet, which authenticates destination connection ID of the first Initial
+// packet of client
+func validRetry(odcid, packet []byte) bool {
+	if len(packet) < 16 {
+		return false
+	}
+
+	block, _ := aes.NewCipher(retryKey)
+	aead, _ := cipher.NewGCM(block)
+
+	pseudo := append([]byte{byte(len(odcid))}, odcid...)
+	pseudo = append(pseudo, packet[:len(packet)-16]...)
+	_, err := aead.Open(nil, retryNonce, packet[len(packet)-16:], pseudo)
+
+	return err == nil
+}
+
+// decodePacketNumber restores full packet number from its least significant bits, RFC 9000 appendix A.3
+func decodePacketNumber(largest, truncated int64, bits uint) int64 {
+	expected := largest + 1
+	win := int64(1) << bits
+	hwin := win / 2
+	candidate := (expected &^ (win - 1)) | truncated
+
+	if candidate <= expected-hwin && candidate < (1<<62)-win {
+		return candidate + win
+	}
+	if candidate > expected+hwin && candidate >= win {
+		return candidate - win
+	}
+
+	return candidate
+}
@@ -0,0 +1,371 @@
+package quic
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// HTTP/3 frame and stream types, RFC 9114
+const (
+	frameData     = 0x00
+	frameHeaders  = 0x01
+	frameSettings = 0x04
+
+	streamControl = 0x00
+	streamEncoder = 0x02
+
+	settingQPACKMaxTableCapacity = 0x01
+)
+
+// streamData handles STREAM frame, and returns messages completed by it
+func (c *conn) streamData(dir int, id, offset uint64, data []byte, fin bool, t time.Time) ([]*Message, error) {
+	s := c.streams[id]
+	if s == nil {
+		// Streams initiated by server are unidirectional, server push is not decoded
+		if id&0x02 == 0 && id&0x01 != 0 {
+			return nil, nil
+		}
+
+		s = &stream{id: id, uniType: -1}
+		c.streams[id] = s
+	}
+
+	s.data[dir].write(offset, data, fin, t)
+
+	if !s.bidirectional() {
+		return c.uniStream(s, dir)
+	}
+
+	return c.requestStream(s), nil
+}
+
+// uniStream reads control and QPACK encoder streams as their data arrives. Requests blocked by encoder stream are
+// decoded after its instructions.
+func (c *conn) uniStream(s *stream, dir int) ([]*Message, error) {
+	buf := &s.data[dir]
+	if buf.dropped {
+		return nil, nil
+	}
+
+	if s.uniType < 0 {
+		typ, n := readVarint(buf.data)
+		if n == 0 {
+			return nil, nil
+		}
+		s.uniType = int64(typ)
+		buf.consume(n)
+	}
+
+	switch s.uniType {
+	case streamControl:
+		for {
+			r := reader{b: buf.data}
+			typ := r.varint()
+			payload := r.bytes(r.varint())
+			if r.err != nil {
+				break
+			}
+			buf.consume(len(buf.data) - len(r.b))
+
+			if typ == frameSettings {
+				c.settings(dir, payload)
+			}
+		}
+	case streamEncoder:
+		n, err := c.qpack[dir].encoderInstructions(buf.data)
+		buf.consume(n)
+		if err != nil {
+			buf.dropped = true
+			return nil, err
+		}
+
+		var messages []*Message
+		for _, blocked := range c.streams {
+			if blocked.blocked {
+				messages = append(messages, c.requestStream(blocked)...)
+			}
+		}
+		return messages, nil
+	default:
+		// Data of other streams is not needed
+		buf.consume(len(buf.data))
+	}
+
+	return nil, nil
+}
+
+// settings reads SETTINGS frame of endpoint. Its QPACK table capacity limits table of the other endpoint.
+func (c *conn) settings(dir int, payload []byte) {
+	r := reader{b: payload}
+	for len(r.b) > 0 && r.err == nil {
+		id, value := r.varint(), r.varint()
+		if id == settingQPACKMaxTableCapacity && r.err == nil {
+			c.qpack[1-dir].maxCapacity = value
+		}
+	}
+}
+
+// requestStream decodes request and response of stream when they are complete
+func (c *conn) requestStream(s *stream) []*Message {
+	var messages []*Message
+
+	if !s.requestDone && s.data[fromClient].complete() {
+		fields, trailers, body, err := decodeMessage(&c.qpack[fromClient], s.data[fromClient].data, false)
+		s.blocked = err == errBlocked
+		if s.blocked {
+			return nil
+		}
+
+		s.requestDone = true
+		if err == nil {
+			s.request = &Message{Request: true, Stream: s.id, Start: s.data[fromClient].start, End: s.data[fromClient].end}
+			s.request.HTTP, err = requestHTTP(fields, trailers, body)
+		}
+		if err != nil {
+			s.failed = true
+		} else {
+			messages = append(messages, s.request)
+		}
+	}
+
+	if s.requestDone && !s.responseDone && s.data[fromServer].complete() {
+		s.responseDone = true
+		if !s.failed {
+			fields, trailers, body, err := decodeMessage(&c.qpack[fromServer], s.data[fromServer].data, true)
+			if err == nil {
+				resp := &Message{Stream: s.id, Start: s.data[fromServer].start, End: s.data[fromServer].end}
+				resp.Latency = resp.End.Sub(s.request.End)
+				if resp.HTTP, err = responseHTTP(fields, trailers, body); err == nil {
+					messages = append(messages, resp)
+				}
+			}
+		}
+	}
+
+	if s.responseDone || s.requestDone && s.failed {
+		delete(c.streams, s.id)
+	}
+
+	return messages
+}
+
+// decodeMessage reads HTTP/3 frames of request or response stream, and returns fields of its header and trailer
+// sections and its body. Interim responses are skipped.
+func decodeMessage(d *qpackDecoder, data []byte, response bool) (fields, trailers []headerField, body []byte, err error) {
+	var headers bool
+
+	r := reader{b: data}
+	for len(r.b) > 0 {
+		typ := r.varint()
+		payload := r.bytes(r.varint())
+		if r.err != nil {
+			return nil, nil, nil, r.err
+		}
+
+		switch typ {
+		case frameHeaders:
+			f, err := d.decode(payload)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			// HEADERS frame after header section is trailer section, e.g. with grpc-status
+			if headers {
+				trailers = append(trailers, f...)
+				continue
+			}
+			if response && strings.HasPrefix(fieldValue(f, ":status"), "1") {
+				continue
+			}
+			fields = f
+			headers = true
+		case frameData:
+			if !headers {
+				return nil, nil, nil, errors.New("DATA frame before HEADERS")
+			}
+			body = append(body, payload...)
+		}
+	}
+
+	if !headers {
+		return nil, nil, nil, errors.New("message without HEADERS frame")
+	}
+
+	return fields, trailers, body, nil
+}
+
+func http3Frame(typ uint64, payload []byte) []byte {
+	f := appendVarint(nil, typ)
+	f = appendVarint(f, uint64(len(payload)))
+	return append(f, payload...)
+}
+
+func fieldValue(fields []headerField, name string) string {
+	for _, f := range fields {
+		if f.name == name {
+			return f.value
+		}
+	}
+
+	return ""
+}
+
+func requestHTTP(fields, trailers []headerField, body []byte) ([]byte, error) {
+	method, path, authority := fieldValue(fields, ":method"), fieldValue(fields, ":path"), fieldValue(fields, ":authority")
+	if method == "CONNECT" {
+		path = authority
+	}
+	if method == "" || path == "" {
+		return nil, errors.New("request without :method or :path field")
+	}
+
+	return httpMessage(method+" "+path+" HTTP/1.1", authority, fields, trailers, body), nil
+}
+
+func responseHTTP(fields, trailers []headerField, body []byte) ([]byte, error) {
+	status := fieldValue(fields, ":status")
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, errors.New("response without :status field")
+	}
+
+	return httpMessage(strings.TrimSpace("HTTP/1.1 "+status+" "+http.StatusText(code)), "", fields, trailers, body), nil
+}
+
+// httpMessage returns HTTP/1.1 message with given start line. Body is sent with Content-Length, and cookie fields
+// are joined into single header. Message with trailers is chunked, with trailer fields after the last chunk, so
+// they are replayed too.
+func httpMessage(startLine, host string, fields, trailers []headerField, body []byte) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(startLine + "\r\n")
+	if host != "" {
+		buf.WriteString("Host: " + host + "\r\n")
+	}
+
+	var cookies []string
+	for _, f := range fields {
+		if strings.HasPrefix(f.name, ":") {
+			continue
+		}
+
+		switch f.name {
+		case "host", "content-length", "transfer-encoding", "connection":
+			continue
+		case "cookie":
+			cookies = append(cookies, f.value)
+			continue
+		}
+
+		buf.WriteString(f.name + ": " + f.value + "\r\n")
+	}
+
+	if len(cookies) > 0 {
+		buf.WriteString("cookie: " + strings.Join(cookies, "; ") + "\r\n")
+	}
+
+	if len(trailers) > 0 {
+		var names []string
+		for _, f := range trailers {
+			names = append(names, f.name)
+		}
+		buf.WriteString("Trailer: " + strings.Join(names, ", ") + "\r\n")
+		buf.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+
+		if len(body) > 0 {
+			buf.WriteString(strconv.FormatInt(int64(len(body)), 16) + "\r\n")
+			buf.Write(body)
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("0\r\n")
+		for _, f := range trailers {
+			buf.WriteString(f.name + ": " + f.value + "\r\n")
+		}
+		buf.WriteString("\r\n")
+
+		return buf.Bytes()
+	}
+
+	if len(body) > 0 {
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	}
+
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	return buf.Bytes()
+}
+
+// Connection-specific headers of HTTP/1.1, which are not allowed in HTTP/3
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// parseFields parses header lines, `Name: value\r\n`, into fields with lowercase names
+func parseFields(lines []byte) []headerField {
+	var fields []headerField
+
+	for _, line := range bytes.Split(lines, []byte("\n")) {
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+
+		name := strings.ToLower(string(bytes.TrimSpace(line[:i])))
+		fields = append(fields, headerField{name: name, value: string(bytes.TrimSpace(line[i+1:]))})
+	}
+
+	return fields
+}
+
+// requestFields translates HTTP/1.1 request into fields of HTTP/3 header section, body, and fields of trailer section
+// if body is chunked. Host header becomes :authority pseudo-header, and connection-specific headers are removed.
+func requestFields(data []byte, scheme string) (fields, trailers []headerField, body []byte, err error) {
+	if bytes.IndexByte(data, ' ') <= 0 || !bytes.Contains(data, proto.EmptyLine) {
+		return nil, nil, nil, errors.New("malformed HTTP request")
+	}
+
+	method, path := proto.Method(data), proto.Path(data)
+	end := proto.MIMEHeadersEndPos(data)
+	headers := parseFields(data[bytes.IndexByte(data, '\n')+1 : end])
+
+	fields = []headerField{{":method", string(method)}, {":scheme", scheme}, {":authority", fieldValue(headers, "host")}}
+	if string(method) != "CONNECT" {
+		fields = append(fields, headerField{":path", string(path)})
+	}
+
+	// Length of chunked body is known after it is decoded
+	chunked := strings.EqualFold(fieldValue(headers, "transfer-encoding"), "chunked")
+	for _, f := range headers {
+		switch {
+		case f.name == "host" || connectionHeaders[f.name]:
+			continue
+		case f.name == "te" && f.value != "trailers":
+			continue
+		case f.name == "content-length" && chunked:
+			continue
+		}
+		fields = append(fields, f)
+	}
+
+	body = data[end:]
+	if chunked {
+		var lines []byte
+		if body, lines, err = proto.DecodeChunked(body); err != nil {
+			return nil, nil, nil, err
+		}
+		trailers = parseFields(lines)
+	}
+
+	return fields, trailers, body, nil
+}
@@ -0,0 +1,110 @@
+package quic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// trafficSecrets of application data of single TLS 1.3 connection
+type trafficSecrets struct {
+	client []byte
+	server []byte
+}
+
+// KeyLog reads TLS secrets from key log file in NSS format, written by clients and servers when SSLKEYLOGFILE
+// environment variable is set. File is appended while new connections are established, so it is read again when
+// secrets of connection are not found, at most once a second.
+type KeyLog struct {
+	mu       sync.Mutex
+	path     string
+	offset   int64
+	lastRead time.Time
+	secrets  map[string]*trafficSecrets
+}
+
+// NewKeyLog returns key log reading given file
+func NewKeyLog(path string) *KeyLog {
+	return &KeyLog{path: path, secrets: make(map[string]*trafficSecrets)}
+}
+
+// lookup returns secrets of connection with given client random, or nil if they are not logged yet
+func (k *KeyLog) lookup(random []byte) *trafficSecrets {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	id := hex.EncodeToString(random)
+	if s := k.secrets[id]; s != nil && s.client != nil && s.server != nil {
+		return s
+	}
+
+	if time.Since(k.lastRead) < time.Second {
+		return nil
+	}
+	k.lastRead = time.Now()
+	k.read()
+
+	if s := k.secrets[id]; s != nil && s.client != nil && s.server != nil {
+		return s
+	}
+
+	return nil
+}
+
+// read reads lines appended since previous read. Incomplete last line is read next time.
+func (k *KeyLog) read() error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil
+		}
+		k.offset += int64(len(line))
+
+		// LABEL <client random> <secret>
+		fields := bytes.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+
+		var client bool
+		switch string(fields[0]) {
+		case "CLIENT_TRAFFIC_SECRET_0":
+			client = true
+		case "SERVER_TRAFFIC_SECRET_0":
+		default:
+			continue
+		}
+
+		secret := make([]byte, hex.DecodedLen(len(fields[2])))
+		if _, err := hex.Decode(secret, fields[2]); err != nil {
+			continue
+		}
+
+		id := string(bytes.ToLower(fields[1]))
+		s := k.secrets[id]
+		if s == nil {
+			s = &trafficSecrets{}
+			k.secrets[id] = s
+		}
+		if client {
+			s.client = secret
+		} else {
+			s.server = secret
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package quic
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	errTruncated = errors.New("truncated data")
+	// Field section refers to dynamic table entries which are not received yet
+	errBlocked = errors.New("field section is blocked by encoder stream")
+)
+
+type headerField struct {
+	name  string
+	value string
+}
+
+// QPACK static table, RFC 9204 appendix A
+var staticTable = []headerField{
+	{":authority", ""},
+	{":path", "/"},
+	{"age", "0"},
+	{"content-disposition", ""},
+	{"content-length", "0"},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"referer", ""},
+	{"set-cookie", ""},
+	{":method", "CONNECT"},
+	{":method", "DELETE"},
+	{":method", "GET"},
+	{":method", "HEAD"},
+	{":method", "OPTIONS"},
+	{":method", "POST"},
+	{":method", "PUT"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "103"},
+	{":status", "200"},
+	{":status", "304"},
+	{":status", "404"},
+	{":status", "503"},
+	{"accept", "*/*"},
+	{"accept", "application/dns-message"},
+	{"accept-encoding", "gzip, deflate, br"},
+	{"accept-ranges", "bytes"},
+	{"access-control-allow-headers", "cache-control"},
+	{"access-control-allow-headers", "content-type"},
+	{"access-control-allow-origin", "*"},
+	{"cache-control", "max-age=0"},
+	{"cache-control", "max-age=2592000"},
+	{"cache-control", "max-age=604800"},
+	{"cache-control", "no-cache"},
+	{"cache-control", "no-store"},
+	{"cache-control", "public, max-age=31536000"},
+	{"content-encoding", "br"},
+	{"content-encoding", "gzip"},
+	{"content-type", "application/dns-message"},
+	{"content-type", "application/javascript"},
+	{"content-type", "application/json"},
+	{"content-type", "application/x-www-form-urlencoded"},
+	{"content-type", "image/gif"},
+	{"content-type", "image/jpeg"},
+	{"content-type", "image/png"},
+	{"content-type", "text/css"},
+	{"content-type", "text/html; charset=utf-8"},
+	{"content-type", "text/plain"},
+	{"content-type", "text/plain;charset=utf-8"},
+	{"range", "bytes=0-"},
+	{"strict-transport-security", "max-age=31536000"},
+	{"strict-transport-security", "max-age=31536000; includesubdomains"},
+	{"strict-transport-security", "max-age=31536000; includesubdomains; preload"},
+	{"vary", "accept-encoding"},
+	{"vary", "origin"},
+	{"x-content-type-options", "nosniff"},
+	{"x-xss-protection", "1; mode=block"},
+	{":status", "100"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "302"},
+	{":status", "400"},
+	{":status", "403"},
+	{":status", "421"},
+	{":status", "425"},
+	{":status", "500"},
+	{"accept-language", ""},
+	{"access-control-allow-credentials", "FALSE"},
+	{"access-control-allow-credentials", "TRUE"},
+	{"access-control-allow-headers", "*"},
+	{"access-control-allow-methods", "get"},
+	{"access-control-allow-methods", "get, post, options"},
+	{"access-control-allow-methods", "options"},
+	{"access-control-expose-headers", "content-length"},
+	{"access-control-request-headers", "content-type"},
+	{"access-control-request-method", "get"},
+	{"access-control-request-method", "post"},
+	{"alt-svc", "clear"},
+	{"authorization", ""},
+	{"content-security-policy", "script-src 'none'; object-src 'none'; base-uri 'none'"},
+	{"early-data", "1"},
+	{"expect-ct", ""},
+	{"forwarded", ""},
+	{"if-range", ""},
+	{"origin", ""},
+	{"purpose", "prefetch"},
+	{"server", ""},
+	{"timing-allow-origin", "*"},
+	{"upgrade-insecure-requests", "1"},
+	{"user-agent", ""},
+	{"x-forwarded-for", ""},
+	{"x-frame-options", "deny"},
+	{"x-frame-options", "sameorigin"},
+}
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	symbol   int
+}
+
+var huffmanRoot = newHuffmanTree()
+
+func newHuffmanTree() *huffmanNode {
+	root := &huffmanNode{symbol: -1}
+	for symbol, code := range huffmanCodes {
+		n := root
+		for i := int(huffmanCodeLen[symbol]) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{symbol: -1}
+			}
+			n = n.children[bit]
+		}
+		n.symbol = symbol
+	}
+
+	return root
+}
+
+// huffmanDecode decodes Huffman-encoded string. Padding is not validated.
+func huffmanDecode(data []byte) (string, error) {
+	out := make([]byte, 0, len(data)*8/5)
+	n := huffmanRoot
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			if n = n.children[(b>>uint(i))&1]; n == nil {
+				return "", errors.New("invalid Huffman code")
+			}
+			if n.symbol >= 0 {
+				out = append(out, byte(n.symbol))
+				n = huffmanRoot
+			}
+		}
+	}
+
+	return string(out), nil
+}
+
+// readPrefixInt reads integer with N-bit prefix, RFC 7541 section 5.1. Returns integer and number of bytes read.
+func readPrefixInt(b []byte, prefix uint) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errTruncated
+	}
+
+	max := uint64(1)<<prefix - 1
+	v := uint64(b[0]) & max
+	if v < max {
+		return v, 1, nil
+	}
+
+	var m uint
+	for i := 1; i < len(b); i++ {
+		v += uint64(b[i]&0x7f) << m
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+		if m += 7; m > 62 {
+			return 0, 0, errors.New("integer overflow")
+		}
+	}
+
+	return 0, 0, errTruncated
+}
+
+// appendPrefixInt appends integer with N-bit prefix, other bits of the first byte are set to flags
+func appendPrefixInt(b []byte, flags byte, prefix uint, v uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if v < max {
+		return append(b, flags|byte(v))
+	}
+
+	b = append(b, flags|byte(max))
+	for v -= max; v >= 0x80; v >>= 7 {
+		b = append(b, byte(v)|0x80)
+	}
+	return append(b, byte(v))
+}
+
+// appendString appends string literal without Huffman coding
+func appendString(b []byte, flags byte, prefix uint, s string) []byte {
+	return append(appendPrefixInt(b, flags, prefix, uint64(len(s))), s...)
+}
+
+// readString reads string literal with Huffman flag followed by length with N-bit prefix
+func readString(b []byte, prefix uint) (string, int, error) {
+	if len(b) == 0 {
+		return "", 0, errTruncated
+	}
+
+	huffman := b[0]&(1<<prefix) != 0
+	length, n, err := readPrefixInt(b, prefix)
+	if err != nil {
+		return "", 0, err
+	}
+	if uint64(len(b)-n) < length {
+		return "", 0, errTruncated
+	}
+
+	data := b[n : n+int(length)]
+	if !huffman {
+		return string(data), n + int(length), nil
+	}
+
+	s, err := huffmanDecode(data)
+	return s, n + int(length), err
+}
+
+// qpackDecoder decodes field sections of one endpoint, using dynamic table built by instructions of its encoder
+// stream, RFC 9204
+type qpackDecoder struct {
+	// SETTINGS_QPACK_MAX_TABLE_CAPACITY of the peer which decodes field sections
+	maxCapacity uint64
+	capacity    uint64
+	size        uint64
+	// Entries in the table, oldest first, and number of evicted entries, which is absolute index of the first one
+	entries []headerField
+	evicted uint64
+}
+
+func (d *qpackDecoder) inserted() uint64 {
+	return d.evicted + uint64(len(d.entries))
+}
+
+func (d *qpackDecoder) get(index uint64) (headerField, error) {
+	if index < d.evicted || index >= d.inserted() {
+		return headerField{}, fmt.Errorf("dynamic table entry %d is not available", index)
+	}
+
+	return d.entries[index-d.evicted], nil
+}
+
+func (d *qpackDecoder) insert(f headerField) {
+	d.entries = append(d.entries, f)
+	d.size += uint64(len(f.name) + len(f.value) + 32)
+	d.evict()
+}
+
+func (d *qpackDecoder) evict() {
+	for d.size > d.capacity && len(d.entries) > 0 {
+		d.size -= uint64(len(d.entries[0].name) + len(d.entries[0].value) + 32)
+		d.entries = d.entries[1:]
+		d.evicted++
+	}
+}
+
+func staticField(index uint64) (headerField, error) {
+	if index >= uint64(len(staticTable)) {
+		return headerField{}, fmt.Errorf("static table entry %d does not exist", index)
+	}
+
+	return staticTable[index], nil
+}
+
+// encoderInstructions applies instructions of encoder stream, and returns number of bytes read. Incomplete
+// instruction at the end is not read.
+func (d *qpackDecoder) encoderInstructions(b []byte) (int, error) {
+	var read int
+	for read < len(b) {
+		n, err := d.encoderInstruction(b[read:])
+		if err == errTruncated {
+			break
+		}
+		if err != nil {
+			return read, err
+		}
+		read += n
+	}
+
+	return read, nil
+}
+
+func (d *qpackDecoder) encoderInstruction(b []byte) (int, error) {
+	var f headerField
+
+	switch {
+	case b[0]&0x80 != 0:
+		// Insert with name reference
+		index, n, err := readPrefixInt(b, 6)
+		if err != nil {
+			return 0, err
+		}
+
+		var ref headerField
+		if b[0]&0x40 != 0 {
+			ref, err = staticField(index)
+		} else if index < d.inserted() {
+			ref, err = d.get(d.inserted() - 1 - index)
+		} else {
+			err = fmt.Errorf("invalid relative index %d", index)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		value, m, err := readString(b[n:], 7)
+		if err != nil {
+			return 0, err
+		}
+
+		d.insert(headerField{ref.name, value})
+		return n + m, nil
+	case b[0]&0x40 != 0:
+		// Insert with literal name
+		name, n, err := readString(b, 5)
+		if err != nil {
+			return 0, err
+		}
+
+		value, m, err := readString(b[n:], 7)
+		if err != nil {
+			return 0, err
+		}
+
+		d.insert(headerField{name, value})
+		return n + m, nil
+	case b[0]&0x20 != 0:
+		// Set dynamic table capacity
+		capacity, n, err := readPrefixInt(b, 5)
+		if err != nil {
+			return 0, err
+		}
+
+		d.capacity = capacity
+		d.evict()
+		return n, nil
+	default:
+		// Duplicate
+		index, n, err := readPrefixInt(b, 5)
+		if err != nil {
+			return 0, err
+		}
+		if index >= d.inserted() {
+			return 0, fmt.Errorf("invalid relative index %d", index)
+		}
+
+		if f, err = d.get(d.inserted() - 1 - index); err != nil {
+			return 0, err
+		}
+
+		d.insert(f)
+		return n, nil
+	}
+}
+
+// requiredInsertCount decodes Required Insert Count of field section prefix, RFC 9204 section 4.5.1.1
+func (d *qpackDecoder) requiredInsertCount(encoded uint64) (uint64, error) {
+	if encoded == 0 {
+		return 0, nil
+	}
+
+	maxEntries := d.maxCapacity / 32
+	fullRange := 2 * maxEntries
+	if encoded > fullRange {
+		return 0, errors.New("invalid required insert count")
+	}
+
+	maxValue := d.inserted() + maxEntries
+	count := maxValue/fullRange*fullRange + encoded - 1
+	if count > maxValue {
+		if count <= fullRange {
+			return 0, errors.New("invalid required insert count")
+		}
+		count -= fullRange
+	}
+
+	if count == 0 {
+		return 0, errors.New("invalid required insert count")
+	}
+
+	return count, nil
+}
+
+// decode decodes field section. If it refers to entries which are not inserted yet, errBlocked is returned.
+func (d *qpackDecoder) decode(b []byte) ([]headerField, error) {
+	encoded, n, err := readPrefixInt(b, 8)
+	if err != nil {
+		return nil, err
+	}
+	b = b[n:]
+
+	count, err := d.requiredInsertCount(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if count > d.inserted() {
+		return nil, errBlocked
+	}
+
+	if len(b) == 0 {
+		return nil, errTruncated
+	}
+	negative := b[0]&0x80 != 0
+	delta, n, err := readPrefixInt(b, 7)
+	if err != nil {
+		return nil, err
+	}
+	b = b[n:]
+
+	base := count + delta
+	if negative {
+		if delta >= count {
+			return nil, errors.New("invalid base")
+		}
+		base = count - delta - 1
+	}
+
+	// Relative indexes are resolved against base
+	relative := func(index uint64) (headerField, error) {
+		if index >= base {
+			return headerField{}, fmt.Errorf("invalid relative index %d", index)
+		}
+		return d.get(base - 1 - index)
+	}
+
+	var fields []headerField
+	for len(b) > 0 {
+		var f headerField
+		var n int
+
+		switch {
+		case b[0]&0x80 != 0:
+			// Indexed field line
+			var index uint64
+			if index, n, err = readPrefixInt(b, 6); err != nil {
+				return nil, err
+			}
+			if b[0]&0x40 != 0 {
+				f, err = staticField(index)
+			} else {
+				f, err = relative(index)
+			}
+		case b[0]&0x40 != 0:
+			// Literal field line with name reference
+			var index uint64
+			if index, n, err = readPrefixInt(b, 4); err != nil {
+				return nil, err
+			}
+			if b[0]&0x10 != 0 {
+				f, err = staticField(index)
+			} else {
+				f, err = relative(index)
+			}
+			if err == nil {
+				var m int
+				f.value, m, err = readString(b[n:], 7)
+				n += m
+			}
+		case b[0]&0x20 != 0:
+			// Literal field line with literal name
+			if f.name, n, err = readString(b, 3); err != nil {
+				return nil, err
+			}
+			var m int
+			f.value, m, err = readString(b[n:], 7)
+			n += m
+		case b[0]&0x10 != 0:
+			// Indexed field line with post-base index
+			var index uint64
+			if index, n, err = readPrefixInt(b, 4); err != nil {
+				return nil, err
+			}
+			f, err = d.get(base + index)
+		default:
+			// Literal field line with post-base name reference
+			var index uint64
+			if index, n, err = readPrefixInt(b, 3); err != nil {
+				return nil, err
+			}
+			if f, err = d.get(base + index); err == nil {
+				var m int
+				f.value, m, err = readString(b[n:], 7)
+				n += m
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		fields = append(fields, f)
+		b = b[n:]
+	}
+
+	return fields, nil
+}
+
+// encodeFields encodes field section without dynamic table, so it is never blocked, and encoder stream is not needed.
+// Fields of static table are indexed, and other fields reference static names where possible.
+func encodeFields(fields []headerField) []byte {
+	// Required insert count and base are zero
+	b := []byte{0, 0}
+
+	for _, f := range fields {
+		indexed, name := false, -1
+		for i, s := range staticTable {
+			if s.name == f.name && s.value == f.value {
+				b = appendPrefixInt(b, 0xc0, 6, uint64(i))
+				indexed = true
+				break
+			}
+			if s.name == f.name && name < 0 {
+				name = i
+			}
+		}
+
+		if indexed {
+			continue
+		}
+		if name >= 0 {
+			b = appendPrefixInt(b, 0x50, 4, uint64(name))
+		} else {
+			b = appendString(b, 0x20, 3, f.name)
+		}
+		b = appendString(b, 0, 7, f.value)
+	}
+
+	return b
+}
@@ -0,0 +1,472 @@
+package quic
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Directions of packets, indexes of per-direction state
+const (
+	fromClient = 0
+	fromServer = 1
+)
+
+// Packet number spaces which are decrypted, Handshake packets are skipped
+const (
+	spaceInitial = 0
+	spaceAppData = 1
+)
+
+// Message is HTTP/3 request or response, translated into HTTP/1.1 message
+type Message struct {
+	Request bool
+	// ID of request stream
+	Stream uint64
+	// Time of the first and the last packet of message
+	Start time.Time
+	End   time.Time
+	// Response only: time between end of request and end of response
+	Latency time.Duration
+	// HTTP/1.1 message with body and Content-Length header
+	HTTP []byte
+
+	connection string
+	connSeq    uint64
+}
+
+// UUID returns ID of request, shared by its response
+func (m *Message) UUID() []byte {
+	key := []byte(m.connection)
+	key = strconv.AppendUint(key, m.connSeq, 10)
+	key = strconv.AppendUint(key, m.Stream, 10)
+
+	uuid := make([]byte, 40)
+	sha := sha1.Sum(key)
+	hex.Encode(uuid, sha[:20])
+
+	return uuid
+}
+
+// cryptoPrefix collects beginning of TLS handshake carried by CRYPTO frames of Initial packets, enough to read client
+// random of ClientHello and cipher suite of ServerHello
+type cryptoPrefix struct {
+	data   [128]byte
+	filled [128]bool
+}
+
+func (p *cryptoPrefix) write(offset uint64, data []byte) {
+	for i := range data {
+		if offset+uint64(i) >= uint64(len(p.data)) {
+			return
+		}
+		p.data[offset+uint64(i)] = data[i]
+		p.filled[offset+uint64(i)] = true
+	}
+}
+
+// prefix returns contiguous data from the beginning of handshake
+func (p *cryptoPrefix) prefix() []byte {
+	n := 0
+	for n < len(p.filled) && p.filled[n] {
+		n++
+	}
+
+	return p.data[:n]
+}
+
+// conn is state of single QUIC connection
+type conn struct {
+	seq      uint64
+	lastSeen time.Time
+
+	// Destination connection ID of the first Initial packet of client, and keys derived from it
+	initialDCID []byte
+	initialKeys [2]*packetKeys
+	// Connection IDs chosen by client and server, their lengths are used to parse short headers
+	clientCID  []byte
+	serverCID  []byte
+	serverSeen bool
+
+	crypto       [2]cryptoPrefix
+	clientRandom []byte
+	suite        *cipherSuite
+
+	// Keys of 1-RTT packets: current, previous and next key phase
+	appKeys  [2]*packetKeys
+	prevKeys [2]*packetKeys
+	nextKeys [2]*packetKeys
+	keyPhase [2]bool
+
+	largest [2][2]int64
+
+	streams map[uint64]*stream
+	qpack   [2]qpackDecoder
+	closed  bool
+}
+
+// Sessions decrypts QUIC connections using secrets of key log, and decodes HTTP/3 requests and responses sent over
+// them. Only QUIC version 1 with AES-GCM cipher suites is supported, and connections should be captured from their
+// first packet. Requests sent in 0-RTT packets are not decoded.
+type Sessions struct {
+	keys       *KeyLog
+	expire     time.Duration
+	conns      map[string]*conn
+	seq        uint64
+	lastExpire time.Time
+}
+
+// NewSessions returns sessions using given key log. Connections without packets for expire duration are forgotten.
+func NewSessions(keys *KeyLog, expire time.Duration) *Sessions {
+	return &Sessions{keys: keys, expire: expire, conns: make(map[string]*conn)}
+}
+
+// Datagram decodes QUIC packets of datagram sent by client, if incoming is true, or by server, and returns HTTP
+// requests and responses completed by it. Connection identifies client and server, e.g. by their addresses.
+func (s *Sessions) Datagram(connection string, incoming bool, data []byte, t time.Time) ([]*Message, error) {
+	if t.Sub(s.lastExpire) >= s.expire/10 {
+		for id, c := range s.conns {
+			if t.Sub(c.lastSeen) >= s.expire {
+				delete(s.conns, id)
+			}
+		}
+		s.lastExpire = t
+	}
+
+	dir := fromServer
+	if incoming {
+		dir = fromClient
+	}
+
+	c := s.conns[connection]
+	if c == nil || c.closed {
+		// Connection is decoded from the first Initial packet of client
+		if !incoming || len(data) < 5 || data[0]&0xb0 != 0x80 || binary.BigEndian.Uint32(data[1:5]) != 1 {
+			return nil, nil
+		}
+
+		s.seq++
+		c = &conn{seq: s.seq, streams: make(map[uint64]*stream)}
+		s.conns[connection] = c
+	}
+	c.lastSeen = t
+
+	var messages []*Message
+	var err error
+	for len(data) > 0 && err == nil {
+		var n int
+		var msgs []*Message
+
+		// Short header packet takes the rest of datagram
+		if data[0]&0x80 == 0 {
+			msgs, err = c.shortPacket(s.keys, dir, data, t)
+			n = len(data)
+		} else {
+			n, msgs, err = c.longPacket(s.keys, dir, data, t)
+		}
+		messages = append(messages, msgs...)
+		data = data[n:]
+	}
+
+	for _, m := range messages {
+		m.connection = connection
+		m.connSeq = c.seq
+	}
+
+	if c.closed {
+		delete(s.conns, connection)
+	}
+
+	return messages, err
+}
+
+// longPacket decodes long header packet, and returns its length
+func (c *conn) longPacket(keys *KeyLog, dir int, data []byte, t time.Time) (int, []*Message, error) {
+	r := reader{b: data[1:]}
+	version := r.uint32()
+	if version == 0 {
+		// Version negotiation takes the whole datagram
+		return len(data), nil, nil
+	}
+	if version != 1 {
+		return len(data), nil, fmt.Errorf("unsupported QUIC version 0x%x", version)
+	}
+
+	dcid := r.bytes(uint64(r.byte()))
+	scid := r.bytes(uint64(r.byte()))
+	typ := (data[0] >> 4) & 0x03
+
+	if typ == 3 {
+		// Retry, client sends new Initial with keys derived from new connection ID
+		c.initialDCID = nil
+		c.serverSeen = false
+		return len(data), nil, nil
+	}
+	if typ == 0 {
+		r.bytes(r.varint())
+	}
+	length := r.varint()
+	if r.err != nil || uint64(len(r.b)) < length {
+		return len(data), nil, errTruncated
+	}
+
+	pnOffset := len(data) - len(r.b)
+	end := pnOffset + int(length)
+
+	// 0-RTT and Handshake packets are skipped
+	if typ != 0 {
+		return end, nil, nil
+	}
+
+	if dir == fromClient && !c.serverSeen {
+		c.initialDCID = append([]byte{}, dcid...)
+		c.initialKeys[fromClient], c.initialKeys[fromServer] = initialKeys(dcid)
+		c.clientCID = append([]byte{}, scid...)
+	}
+	if dir == fromServer && !c.serverSeen {
+		c.serverSeen = true
+		c.serverCID = append([]byte{}, scid...)
+	}
+
+	if c.initialKeys[dir] == nil {
+		return end, nil, nil
+	}
+
+	payload, err := c.open(c.initialKeys[dir], dir, spaceInitial, data[:end], pnOffset)
+	if err != nil {
+		return end, nil, err
+	}
+
+	msgs, err := c.frames(dir, spaceInitial, payload, t)
+	c.handshake(keys)
+
+	return end, msgs, err
+}
+
+// handshake reads client random and cipher suite from Initial packets, and derives keys of 1-RTT packets when they
+// are logged
+func (c *conn) handshake(keys *KeyLog) {
+	if c.clientRandom == nil {
+		// Handshake type, length, version and random
+		if hello := c.crypto[fromClient].prefix(); len(hello) >= 38 && hello[0] == 0x01 {
+			c.clientRandom = append([]byte{}, hello[6:38]...)
+		}
+	}
+
+	if c.suite == nil {
+		// Random is followed by legacy session ID and cipher suite
+		if hello := c.crypto[fromServer].prefix(); len(hello) >= 39 && hello[0] == 0x02 {
+			if end := 39 + int(hello[38]) + 2; len(hello) >= end {
+				if suite, ok := cipherSuites[binary.BigEndian.Uint16(hello[end-2:end])]; ok {
+					c.suite = &suite
+				}
+			}
+		}
+	}
+
+	if c.appKeys[fromClient] != nil || c.clientRandom == nil || c.suite == nil {
+		return
+	}
+
+	secrets := keys.lookup(c.clientRandom)
+	if secrets == nil {
+		return
+	}
+
+	client, err := newPacketKeys(*c.suite, secrets.client)
+	if err != nil {
+		return
+	}
+	server, err := newPacketKeys(*c.suite, secrets.server)
+	if err != nil {
+		return
+	}
+
+	c.appKeys = [2]*packetKeys{client, server}
+}
+
+// shortPacket decodes 1-RTT packet
+func (c *conn) shortPacket(keys *KeyLog, dir int, data []byte, t time.Time) ([]*Message, error) {
+	if c.appKeys[dir] == nil {
+		c.handshake(keys)
+		if c.appKeys[dir] == nil {
+			return nil, errors.New("secrets of connection are not found in key log")
+		}
+	}
+
+	pnOffset := 1 + len(c.serverCID)
+	if dir == fromServer {
+		pnOffset = 1 + len(c.clientCID)
+	}
+
+	packet := append([]byte{}, data...)
+	pn, headerLen, err := c.appKeys[dir].unprotect(packet, pnOffset, c.largest[dir][spaceAppData])
+	if err != nil {
+		return nil, err
+	}
+
+	var payload []byte
+	if phase := packet[0]&0x04 != 0; phase == c.keyPhase[dir] {
+		payload, err = c.appKeys[dir].decrypt(packet, headerLen, pn)
+	} else {
+		// Packet of previous key phase, which was reordered, or of the next one
+		if c.prevKeys[dir] != nil {
+			payload, err = c.prevKeys[dir].decrypt(packet, headerLen, pn)
+		}
+
+		if payload == nil {
+			if c.nextKeys[dir] == nil {
+				if c.nextKeys[dir], err = c.appKeys[dir].next(); err != nil {
+					return nil, err
+				}
+			}
+
+			if payload, err = c.nextKeys[dir].decrypt(packet, headerLen, pn); err == nil {
+				c.prevKeys[dir], c.appKeys[dir], c.nextKeys[dir] = c.appKeys[dir], c.nextKeys[dir], nil
+				c.keyPhase[dir] = phase
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if pn > c.largest[dir][spaceAppData] {
+		c.largest[dir][spaceAppData] = pn
+	}
+
+	return c.frames(dir, spaceAppData, payload, t)
+}
+
+// open removes protection of long header packet
+func (c *conn) open(keys *packetKeys, dir, space int, data []byte, pnOffset int) ([]byte, error) {
+	packet := append([]byte{}, data...)
+	pn, headerLen, err := keys.unprotect(packet, pnOffset, c.largest[dir][space])
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := keys.decrypt(packet, headerLen, pn)
+	if err != nil {
+		return nil, err
+	}
+
+	if pn > c.largest[dir][space] {
+		c.largest[dir][space] = pn
+	}
+
+	return payload, nil
+}
+
+// frames reads frames of decrypted packet, and returns messages completed by its STREAM frames
+func (c *conn) frames(dir, space int, payload []byte, t time.Time) ([]*Message, error) {
+	var messages []*Message
+	r := reader{b: payload}
+
+	for len(r.b) > 0 && r.err == nil {
+		typ := r.varint()
+
+		switch {
+		case typ == 0x00, typ == 0x01, typ == 0x1e:
+			// PADDING, PING, HANDSHAKE_DONE
+		case typ == 0x02 || typ == 0x03:
+			// ACK
+			r.varint()
+			r.varint()
+			ranges := r.varint()
+			r.varint()
+			for i := uint64(0); i < ranges && r.err == nil; i++ {
+				r.varint()
+				r.varint()
+			}
+			if typ == 0x03 {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+		case typ == 0x04:
+			// RESET_STREAM, response will not be complete
+			id := r.varint()
+			r.varint()
+			r.varint()
+			delete(c.streams, id)
+		case typ == 0x05, typ == 0x11, typ == 0x15:
+			// STOP_SENDING, MAX_STREAM_DATA, STREAM_DATA_BLOCKED
+			r.varint()
+			r.varint()
+		case typ == 0x06:
+			// CRYPTO
+			offset := r.varint()
+			data := r.bytes(r.varint())
+			if space == spaceInitial && r.err == nil {
+				c.crypto[dir].write(offset, data)
+			}
+		case typ == 0x07:
+			// NEW_TOKEN
+			r.bytes(r.varint())
+		case typ >= 0x08 && typ <= 0x0f:
+			// STREAM
+			id := r.varint()
+			var offset uint64
+			if typ&0x04 != 0 {
+				offset = r.varint()
+			}
+			var data []byte
+			if typ&0x02 != 0 {
+				data = r.bytes(r.varint())
+			} else {
+				data = r.b
+				r.b = nil
+			}
+			if r.err == nil && space == spaceAppData {
+				msgs, err := c.streamData(dir, id, offset, data, typ&0x01 != 0, t)
+				if err != nil {
+					return messages, err
+				}
+				messages = append(messages, msgs...)
+			}
+		case typ >= 0x10 && typ <= 0x17:
+			// MAX_DATA, MAX_STREAMS, DATA_BLOCKED, STREAMS_BLOCKED
+			r.varint()
+		case typ == 0x18:
+			// NEW_CONNECTION_ID
+			r.varint()
+			r.varint()
+			r.bytes(uint64(r.byte()))
+			r.bytes(16)
+		case typ == 0x19:
+			// RETIRE_CONNECTION_ID
+			r.varint()
+		case typ == 0x1a || typ == 0x1b:
+			// PATH_CHALLENGE, PATH_RESPONSE
+			r.bytes(8)
+		case typ == 0x1c || typ == 0x1d:
+			// CONNECTION_CLOSE
+			r.varint()
+			if typ == 0x1c {
+				r.varint()
+			}
+			r.bytes(r.varint())
+			if space == spaceAppData {
+				c.closed = true
+			}
+		case typ == 0x30:
+			// DATAGRAM without length
+			r.b = nil
+		case typ == 0x31:
+			r.bytes(r.varint())
+		default:
+			return messages, fmt.Errorf("unknown frame type 0x%x", typ)
+		}
+	}
+
+	if r.err != nil {
+		return messages, r.err
+	}
+
+	return messages, nil
+}
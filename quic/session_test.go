@@ -0,0 +1,265 @@
+package quic
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func initialPacket(k *packetKeys, dcid, scid []byte, pn int64, frames []byte) []byte {
+	for len(frames) < 20 {
+		frames = append(frames, 0)
+	}
+
+	header := []byte{0xc1, 0, 0, 0, 1, byte(len(dcid))}
+	header = append(header, dcid...)
+	header = append(header, byte(len(scid)))
+	header = append(header, scid...)
+	header = append(header, 0)
+	length := 2 + len(frames) + 16
+	header = append(header, 0x40|byte(length>>8), byte(length))
+	header = append(header, byte(pn>>8), byte(pn))
+
+	return k.seal(header, len(header)-2, pn, frames)
+}
+
+func shortPacket(k *packetKeys, dcid []byte, phase bool, pn int64, frames []byte) []byte {
+	header := []byte{0x41}
+	if phase {
+		header[0] |= 0x04
+	}
+	header = append(header, dcid...)
+	header = append(header, byte(pn>>8), byte(pn))
+
+	for len(frames) < 2 {
+		frames = append(frames, 0)
+	}
+
+	return k.seal(header, len(header)-2, pn, frames)
+}
+
+func TestInitialKeys(t *testing.T) {
+	// RFC 9001 appendix A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	client, server := initialKeys(dcid)
+
+	if hex.EncodeToString(client.iv) != "fa044b2f42a3fd3b46fb255c" || hex.EncodeToString(server.iv) != "0ac1493ca1905853b0bba03e" {
+		t.Errorf("Wrong initial IVs: %x %x", client.iv, server.iv)
+	}
+
+	mask := make([]byte, aes.BlockSize)
+	client.hp.Encrypt(mask, make([]byte, aes.BlockSize))
+	expected, _ := aes.NewCipher([]byte{0x9f, 0x50, 0x44, 0x9e, 0x04, 0xa0, 0xe8, 0x10, 0x28, 0x3a, 0x1e, 0x99, 0x33, 0xad, 0xed, 0xd2})
+	expectedMask := make([]byte, aes.BlockSize)
+	expected.Encrypt(expectedMask, make([]byte, aes.BlockSize))
+	if !bytes.Equal(mask, expectedMask) {
+		t.Error("Wrong client header protection key")
+	}
+}
+
+func TestDecodePacketNumber(t *testing.T) {
+	// RFC 9000 appendix A.3
+	if pn := decodePacketNumber(0xa82f30ea, 0x9b32, 16); pn != 0xa82f9b32 {
+		t.Errorf("Wrong packet number %x", pn)
+	}
+}
+
+func TestHuffmanDecode(t *testing.T) {
+	// RFC 7541 appendix C.4.1
+	data, _ := hex.DecodeString("f1e3c2e5f23a6ba0ab90f4ff")
+	if s, err := huffmanDecode(data); err != nil || s != "www.example.com" {
+		t.Errorf("Wrong Huffman decoding: %q %v", s, err)
+	}
+}
+
+func TestValidRetry(t *testing.T) {
+	// RFC 9001 appendix A.4
+	odcid, _ := hex.DecodeString("8394c8f03e515708")
+	packet, _ := hex.DecodeString("ff000000010008f067a5502a4262b5746f6b656e04a265ba2eff4d829058fb3f0f2496ba")
+
+	if !validRetry(odcid, packet) {
+		t.Error("Retry packet should be valid")
+	}
+	if validRetry(odcid[1:], packet) {
+		t.Error("Retry packet for another connection should be invalid")
+	}
+}
+
+func TestEncodeFields(t *testing.T) {
+	fields := []headerField{{":method", "GET"}, {":path", "/search"}, {"user-agent", "gor"}, {"x-custom", ""}, {"x-long", strings.Repeat("v", 200)}}
+
+	var d qpackDecoder
+	decoded, err := d.decode(encodeFields(fields))
+	if err != nil || len(decoded) != len(fields) {
+		t.Fatal("Wrong fields", decoded, err)
+	}
+	for i := range fields {
+		if decoded[i] != fields[i] {
+			t.Error("Wrong field", i, decoded[i])
+		}
+	}
+}
+
+func TestQPACKDecoder(t *testing.T) {
+	d := qpackDecoder{maxCapacity: 4096}
+
+	// Set capacity, insert literal name, insert with static name reference, duplicate
+	instructions := appendPrefixInt(nil, 0x20, 5, 100)
+	instructions = appendString(instructions, 0x40, 5, "x-token")
+	instructions = appendString(instructions, 0, 7, "secret")
+	instructions = appendPrefixInt(instructions, 0xc0, 6, 95)
+	instructions = appendString(instructions, 0, 7, "gor")
+	instructions = append(instructions, 0x00)
+
+	// The last instruction is incomplete
+	n, err := d.encoderInstructions(append(instructions, 0x40|7, 'x'))
+	if err != nil || n != len(instructions) || d.inserted() != 3 {
+		t.Fatal("Wrong instructions", n, err, d.entries)
+	}
+
+	// x-token is evicted by duplicate, table fits two entries
+	if d.evicted != 1 {
+		t.Error("Entry should be evicted", d.entries)
+	}
+
+	// Required insert count 3, base 2
+	section := []byte{4, 0x80}
+	section = append(section, 0xd1)                         // :method GET
+	section = append(section, 0x80)                         // relative 0, absolute 1: user-agent gor
+	section = append(section, 0x10)                         // post-base 0, absolute 2: duplicate of user-agent
+	section = appendPrefixInt(section, 0x50, 4, 1)          // :path with literal value
+	section = appendString(section, 0, 7, "/search")        //
+	section = appendString(section, 0x20, 3, "x-custom")    // literal name
+	section = append(appendString(section, 0, 7, ""), 0x5f) // value and truncated line
+
+	if _, err := d.decode(section); err != errTruncated {
+		t.Error("Truncated field section should fail", err)
+	}
+
+	fields, err := d.decode(section[:len(section)-1])
+	expected := []headerField{{":method", "GET"}, {"user-agent", "gor"}, {"user-agent", "gor"}, {":path", "/search"}, {"x-custom", ""}}
+	if err != nil || len(fields) != len(expected) {
+		t.Fatal("Wrong fields", fields, err)
+	}
+	for i := range fields {
+		if fields[i] != expected[i] {
+			t.Error("Wrong field", i, fields[i])
+		}
+	}
+
+	// Required insert count 4 is not inserted yet
+	if _, err := d.decode([]byte{5, 0, 0xc0 | 17}); err != errBlocked {
+		t.Error("Field section should be blocked", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	random := bytes.Repeat([]byte{0xab}, 32)
+	clientSecret, serverSecret := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+
+	f, _ := ioutil.TempFile("", "gor_keylog")
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\nCLIENT_HANDSHAKE_TRAFFIC_SECRET " + hex.EncodeToString(random) + " 00\n")
+	f.WriteString("CLIENT_TRAFFIC_SECRET_0 " + hex.EncodeToString(random) + " " + hex.EncodeToString(clientSecret) + "\n")
+	f.WriteString("SERVER_TRAFFIC_SECRET_0 " + hex.EncodeToString(random) + " " + hex.EncodeToString(serverSecret) + "\n")
+	f.Close()
+
+	sessions := NewSessions(NewKeyLog(f.Name()), time.Hour)
+	now := time.Now()
+	datagram := func(incoming bool, data []byte) []*Message {
+		now = now.Add(time.Millisecond)
+		messages, err := sessions.Datagram("10.0.0.1:5000-10.0.0.2:443", incoming, data, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return messages
+	}
+
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	clientCID, serverCID := []byte{0xc1, 0xc2, 0xc3, 0xc4}, []byte{5, 6, 7, 8, 9, 10, 11, 12}
+	clientInitial, serverInitial := initialKeys(dcid)
+
+	// ClientHello is split into two frames sent in reverse order
+	hello := append([]byte{0x01, 0, 1, 0, 0x03, 0x03}, random...)
+	hello = append(hello, 0, 0x13, 0x01)
+	datagram(true, initialPacket(clientInitial, dcid, clientCID, 0, cryptoFrame(20, hello[20:])))
+	datagram(true, initialPacket(clientInitial, dcid, clientCID, 1, cryptoFrame(0, hello[:20])))
+
+	serverHello := append([]byte{0x02, 0, 0, 40, 0x03, 0x03}, bytes.Repeat([]byte{0xcd}, 32)...)
+	serverHello = append(serverHello, 0, 0x13, 0x01, 0)
+	// Handshake packet is skipped, coalesced with Initial
+	handshake := []byte{0xe1, 0, 0, 0, 1, 4, 0xc1, 0xc2, 0xc3, 0xc4, 0, 5, 1, 2, 3, 4, 5}
+	datagram(false, append(initialPacket(serverInitial, clientCID, serverCID, 0, cryptoFrame(0, serverHello)), handshake...))
+
+	client, _ := newPacketKeys(cipherSuites[0x1301], clientSecret)
+	server, _ := newPacketKeys(cipherSuites[0x1301], serverSecret)
+
+	// Control streams with settings, and encoder stream of client
+	settings := http3Frame(frameSettings, []byte{0x01, 0x50, 0x00})
+	datagram(false, shortPacket(server, clientCID, false, 0, streamFrame(3, 0, append([]byte{streamControl}, settings...), false)))
+
+	encoder := []byte{streamEncoder}
+	encoder = appendPrefixInt(encoder, 0x20, 5, 4096)
+	encoder = appendString(encoder, 0x40, 5, "x-token")
+	encoder = appendString(encoder, 0, 7, "secret")
+
+	// Request refers to dynamic table entry, which is received after request
+	headers := []byte{2, 0}
+	headers = append(headers, 0xd4, 0xd7)
+	headers = appendString(append(headers, 0x50), 0, 7, "example.com")
+	headers = appendString(append(headers, 0x51), 0, 7, "/api?a=1")
+	headers = append(headers, 0x80)
+	headers = appendString(appendString(headers, 0x20, 3, "cookie"), 0, 7, "a=1")
+	headers = appendString(appendString(headers, 0x20, 3, "cookie"), 0, 7, "b=2")
+	headers = append(headers, 0x5f, 0x50, 0x80|12)
+	ua, _ := hex.DecodeString("f1e3c2e5f23a6ba0ab90f4ff")
+	headers = append(headers, ua...)
+	request := append(http3Frame(frameHeaders, headers), http3Frame(frameData, []byte("ping"))...)
+
+	if m := datagram(true, shortPacket(client, serverCID, false, 0, streamFrame(0, 5, request[5:], true))); len(m) != 0 {
+		t.Fatal("Request is not complete", m)
+	}
+	if m := datagram(true, shortPacket(client, serverCID, false, 1, streamFrame(0, 0, request[:5], false))); len(m) != 0 {
+		t.Fatal("Request is blocked by encoder stream", m)
+	}
+
+	messages := datagram(true, shortPacket(client, serverCID, false, 2, streamFrame(6, 0, encoder, false)))
+	if len(messages) != 1 || !messages[0].Request || messages[0].Stream != 0 {
+		t.Fatal("Expected request", messages)
+	}
+	expected := "POST /api?a=1 HTTP/1.1\r\nHost: example.com\r\nx-token: secret\r\nuser-agent: www.example.com\r\ncookie: a=1; b=2\r\nContent-Length: 4\r\n\r\nping"
+	if string(messages[0].HTTP) != expected {
+		t.Errorf("Wrong request %q", messages[0].HTTP)
+	}
+	requestID := messages[0].UUID()
+
+	// Interim response is skipped, and server updates keys
+	response := http3Frame(frameHeaders, []byte{0, 0, 0xd8})
+	response = append(response, http3Frame(frameHeaders, []byte{0, 0, 0xd9, 0xf5})...)
+	response = append(response, http3Frame(frameData, []byte("pong"))...)
+	// Trailer section
+	response = append(response, http3Frame(frameHeaders, appendString(appendString([]byte{0, 0}, 0x20, 3, "grpc-status"), 0, 7, "0"))...)
+
+	next, _ := server.next()
+	messages = datagram(false, shortPacket(next, clientCID, true, 1, streamFrame(0, 0, response, true)))
+	if len(messages) != 1 || messages[0].Request || messages[0].Latency <= 0 {
+		t.Fatal("Expected response", messages)
+	}
+	if string(messages[0].HTTP) != "HTTP/1.1 200 OK\r\ncontent-type: text/plain\r\nTrailer: grpc-status\r\nTransfer-Encoding: chunked\r\n\r\n4\r\npong\r\n0\r\ngrpc-status: 0\r\n\r\n" {
+		t.Errorf("Wrong response %q", messages[0].HTTP)
+	}
+	if !bytes.Equal(messages[0].UUID(), requestID) {
+		t.Error("Response should have ID of request")
+	}
+
+	// Connection is closed
+	datagram(true, shortPacket(client, serverCID, false, 3, []byte{0x1c, 0, 0, 0}))
+	if len(sessions.conns) != 0 {
+		t.Error("Closed connection should be forgotten")
+	}
+}
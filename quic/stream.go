@@ -0,0 +1,122 @@
+package quic
+
+import (
+	"time"
+)
+
+// Maximum size of data buffered for single stream direction, larger messages are dropped
+const maxStreamSize = 16 << 20
+
+// streamBuffer reassembles data sent in one direction of a stream, or of CRYPTO frames
+type streamBuffer struct {
+	// Contiguous data, starting at offset. Data before offset is already consumed.
+	data   []byte
+	offset uint64
+	// Data received out of order, by its offset
+	pending     map[uint64][]byte
+	pendingSize int
+
+	fin       bool
+	finalSize uint64
+	// Stream exceeded maxStreamSize, and its data is discarded
+	dropped bool
+
+	start time.Time
+	end   time.Time
+}
+
+func (b *streamBuffer) write(offset uint64, data []byte, fin bool, t time.Time) {
+	if b.start.IsZero() {
+		b.start = t
+	}
+	b.end = t
+
+	if fin {
+		b.fin = true
+		b.finalSize = offset + uint64(len(data))
+	}
+
+	if b.dropped {
+		return
+	}
+
+	b.insert(offset, data)
+
+	if len(b.data)+b.pendingSize > maxStreamSize {
+		b.dropped = true
+		b.data = nil
+		b.pending = nil
+		b.pendingSize = 0
+	}
+}
+
+func (b *streamBuffer) insert(offset uint64, data []byte) {
+	end := b.offset + uint64(len(b.data))
+	if offset+uint64(len(data)) <= end {
+		return
+	}
+
+	if offset > end {
+		if b.pending == nil {
+			b.pending = make(map[uint64][]byte)
+		}
+		if len(data) > len(b.pending[offset]) {
+			b.pendingSize += len(data) - len(b.pending[offset])
+			b.pending[offset] = append([]byte{}, data...)
+		}
+		return
+	}
+
+	b.data = append(b.data, data[end-offset:]...)
+
+	// Data received earlier can follow appended data now
+	for progress := true; progress && len(b.pending) > 0; {
+		progress = false
+		for off, chunk := range b.pending {
+			end := b.offset + uint64(len(b.data))
+			if off > end {
+				continue
+			}
+
+			delete(b.pending, off)
+			b.pendingSize -= len(chunk)
+			if off+uint64(len(chunk)) > end {
+				b.data = append(b.data, chunk[end-off:]...)
+			}
+			progress = true
+		}
+	}
+}
+
+// complete reports if all data up to the end of stream is received
+func (b *streamBuffer) complete() bool {
+	return b.fin && !b.dropped && b.offset+uint64(len(b.data)) == b.finalSize
+}
+
+// consume discards n bytes of contiguous data
+func (b *streamBuffer) consume(n int) {
+	b.data = b.data[n:]
+	b.offset += uint64(n)
+}
+
+// stream of HTTP/3 connection. Request streams carry request of client and response of server, unidirectional
+// streams carry data of the endpoint which opened them.
+type stream struct {
+	id   uint64
+	data [2]streamBuffer
+
+	// Type of unidirectional stream, or -1 if it is not read yet
+	uniType int64
+
+	requestDone  bool
+	responseDone bool
+	// Request can't be decoded, response is skipped too
+	failed bool
+	// Request is completed, but waits for instructions of QPACK encoder stream
+	blocked bool
+	request *Message
+}
+
+func (s *stream) bidirectional() bool {
+	return s.id&0x02 == 0
+}
@@ -0,0 +1,100 @@
+package quic
+
+import (
+	"encoding/binary"
+)
+
+// reader of QUIC packets and frames. Reading past the end sets error, and returns zero values.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) byte() byte {
+	if len(r.b) < 1 {
+		r.err = errTruncated
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *reader) bytes(n uint64) []byte {
+	if r.err != nil || uint64(len(r.b)) < n {
+		r.err = errTruncated
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+// varint reads variable-length integer, RFC 9000 section 16
+func (r *reader) varint() uint64 {
+	v, n := readVarint(r.b)
+	if n == 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func readVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+
+	return v, n
+}
+
+// appendVarint appends variable-length integer in the shortest encoding
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, 0x40|byte(v>>8), byte(v))
+	case v < 1<<30:
+		return append(b, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, 0xc0|byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+func cryptoFrame(offset uint64, data []byte) []byte {
+	f := appendVarint([]byte{0x06}, offset)
+	f = appendVarint(f, uint64(len(data)))
+	return append(f, data...)
+}
+
+// streamFrame returns STREAM frame with offset and length fields
+func streamFrame(id, offset uint64, data []byte, fin bool) []byte {
+	typ := byte(0x0e)
+	if fin {
+		typ |= 0x01
+	}
+	f := appendVarint([]byte{typ}, id)
+	f = appendVarint(f, offset)
+	f = appendVarint(f, uint64(len(data)))
+	return append(f, data...)
+}
@@ -0,0 +1,353 @@
+//go:build linux && !386
+// +build linux,!386
+
+package rawSocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	packetRxRing     = 5
+	packetStatistics = 6
+	packetVersion    = 10
+	packetFanout     = 18
+	tpacketV3        = 2
+
+	packetFanoutHash       = 0
+	packetFanoutFlagDefrag = 0x8000
+
+	tpStatusKernel = 0
+	tpStatusUser   = 1
+
+	// Offsets inside `struct tpacket_block_desc` and `struct tpacket3_hdr`
+	blockStatusOffset   = 8
+	blockNumPktsOffset  = 12
+	blockFirstPktOffset = 16
+	pktNextOffset       = 0
+	pktSecOffset        = 4
+	pktNsecOffset       = 8
+	pktSnaplenOffset    = 12
+	pktStatusOffset     = 20
+	pktMacOffset        = 24
+	pktVLANTCIOffset    = 32
+	// `struct sockaddr_ll` follows aligned tpacket3_hdr
+	pktSllOffset = 48
+
+	afPacketDefaultBlockSize = 1 << 20
+	afPacketDefaultBlocks    = 64
+	afPacketFrameSize        = 2048
+	// Block is passed to user space after this timeout even if not full
+	afPacketBlockTimeoutMs = 10
+)
+
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+type tpacketStatsV3 struct {
+	packets    uint32
+	drops      uint32
+	freezeQCnt uint32
+}
+
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+var afPacketFanoutGroup uint32
+
+type afPacketWorker struct {
+	id     int
+	fd     int
+	ring   []byte
+	config EngineConfig
+	iface  string
+
+	packets       uint64
+	kernelPackets uint64
+	kernelDrops   uint64
+	freezeCount   uint64
+}
+
+func setsockopt(fd, level, name int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name), uintptr(val), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getsockopt(fd, level, name int, val unsafe.Pointer, size uintptr) error {
+	socklen := uint32(size)
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name), uintptr(val), uintptr(unsafe.Pointer(&socklen)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func newAFPacketWorker(id int, config EngineConfig, ifindex int, fanoutGroup uint32, progFd int) (w *afPacketWorker, err error) {
+	w = &afPacketWorker{id: id, config: config, iface: interfaceName(ifindex)}
+
+	if w.fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(ethPAll))); err != nil {
+		return nil, fmt.Errorf("can't open packet socket: %v", err)
+	}
+
+	if err = w.setup(ifindex, fanoutGroup, progFd); err != nil {
+		w.close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *afPacketWorker) setup(ifindex int, fanoutGroup uint32, progFd int) (err error) {
+	if progFd >= 0 {
+		if err = syscall.SetsockoptInt(w.fd, syscall.SOL_SOCKET, soAttachBPF, progFd); err != nil {
+			return fmt.Errorf("can't attach eBPF program: %v", err)
+		}
+	}
+
+	if err = syscall.SetsockoptInt(w.fd, solPacket, packetVersion, tpacketV3); err != nil {
+		return fmt.Errorf("TPACKET_V3 is not supported: %v", err)
+	}
+
+	req := tpacketReq3{
+		blockSize:    uint32(w.config.AFPacketBlockSize),
+		blockNr:      uint32(w.config.AFPacketBlocks),
+		frameSize:    afPacketFrameSize,
+		frameNr:      uint32(w.config.AFPacketBlockSize / afPacketFrameSize * w.config.AFPacketBlocks),
+		retireBlkTov: afPacketBlockTimeoutMs,
+	}
+	if err = setsockopt(w.fd, solPacket, packetRxRing, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		return fmt.Errorf("can't setup packet ring: %v", err)
+	}
+
+	if w.ring, err = syscall.Mmap(w.fd, 0, w.config.AFPacketBlockSize*w.config.AFPacketBlocks, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED); err != nil {
+		return fmt.Errorf("can't map packet ring: %v", err)
+	}
+
+	if ifindex > 0 {
+		if err = syscall.Bind(w.fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPAll), Ifindex: ifindex}); err != nil {
+			return fmt.Errorf("can't bind packet socket: %v", err)
+		}
+	}
+
+	// Hash mode keeps packets of the same flow on the same worker, so TCP assembly still sees them in order
+	fanout := fanoutGroup | uint32(packetFanoutHash|packetFanoutFlagDefrag)<<16
+	if err = syscall.SetsockoptInt(w.fd, solPacket, packetFanout, int(int32(fanout))); err != nil {
+		return fmt.Errorf("can't join fanout group: %v", err)
+	}
+
+	return nil
+}
+
+func (w *afPacketWorker) close() {
+	if w.ring != nil {
+		syscall.Munmap(w.ring)
+	}
+	syscall.Close(w.fd)
+}
+
+// packetSocketStats returns number of packets received and dropped by AF_PACKET socket since previous call
+func packetSocketStats(fd int) (packets, drops uint64) {
+	var st tpacketStatsV3
+	if err := getsockopt(fd, solPacket, packetStatistics, unsafe.Pointer(&st), unsafe.Sizeof(st)); err != nil {
+		return 0, 0
+	}
+
+	return uint64(st.packets), uint64(st.drops)
+}
+
+// stats returns cumulative counters. Kernel resets its counters on each read, so they are accumulated here.
+func (w *afPacketWorker) stats() CaptureStats {
+	var st tpacketStatsV3
+	if err := getsockopt(w.fd, solPacket, packetStatistics, unsafe.Pointer(&st), unsafe.Sizeof(st)); err == nil {
+		atomic.AddUint64(&w.kernelPackets, uint64(st.packets))
+		atomic.AddUint64(&w.kernelDrops, uint64(st.drops))
+		atomic.AddUint64(&w.freezeCount, uint64(st.freezeQCnt))
+	}
+
+	// Blocks owned by user space are filled and not processed yet
+	var used int
+	for block := 0; block < w.config.AFPacketBlocks; block++ {
+		if atomic.LoadUint32(w.blockStatus(block))&tpStatusUser != 0 {
+			used++
+		}
+	}
+
+	return CaptureStats{
+		Worker:        w.id,
+		Interface:     w.iface,
+		Packets:       atomic.LoadUint64(&w.packets),
+		KernelPackets: atomic.LoadUint64(&w.kernelPackets),
+		KernelDrops:   atomic.LoadUint64(&w.kernelDrops),
+		RingUsage:     float64(used) / float64(w.config.AFPacketBlocks),
+		FreezeCount:   atomic.LoadUint64(&w.freezeCount),
+	}
+}
+
+func (w *afPacketWorker) u32(offset int) uint32 {
+	return *(*uint32)(unsafe.Pointer(&w.ring[offset]))
+}
+
+func (w *afPacketWorker) u16(offset int) uint16 {
+	return *(*uint16)(unsafe.Pointer(&w.ring[offset]))
+}
+
+func (w *afPacketWorker) blockStatus(block int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&w.ring[block*w.config.AFPacketBlockSize+blockStatusOffset]))
+}
+
+// wait blocks until kernel passes block to user space, or timeout expires
+func (w *afPacketWorker) wait(block int, timeout time.Duration) bool {
+	if atomic.LoadUint32(w.blockStatus(block))&tpStatusUser != 0 {
+		return true
+	}
+
+	pfd := pollFd{fd: int32(w.fd), events: 0x1}
+	ts := syscall.NsecToTimespec(int64(timeout))
+	syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+
+	return atomic.LoadUint32(w.blockStatus(block))&tpStatusUser != 0
+}
+
+// process passes packet located at given ring offset to the listener
+func (w *afPacketWorker) process(t *Listener, pkt int, listenIP net.IP, ifaces, loopbacks map[int]bool) {
+	ifindex := int(int32(w.u32(pkt + pktSllOffset + 4)))
+	pkttype := w.ring[pkt+pktSllOffset+10]
+	protocol := binary.BigEndian.Uint16(w.ring[pkt+pktSllOffset+2:])
+
+	// On loopback each packet is seen twice: when it is sent and when it is received
+	if pkttype == packetOutgoing && loopbacks[ifindex] {
+		return
+	}
+
+	// Socket is bound only if single interface is captured
+	if !captureInterface(ifindex, ifaces, loopbacks) {
+		return
+	}
+
+	tci := noVLAN
+	if w.u32(pkt+pktStatusOffset)&tpStatusVLANValid != 0 {
+		tci = int(w.u32(pkt + pktVLANTCIOffset))
+	}
+
+	mac := pkt + int(w.u16(pkt+pktMacOffset))
+	data, ok := skipVLANTags(protocol, w.ring[mac:mac+int(w.u32(pkt+pktSnaplenOffset))], tci, t.engineConfig.VLANs)
+	if !ok {
+		return
+	}
+
+	srcIP, dstIP, tcp, ok := t.matchIPPacket(data, listenIP)
+	if !ok {
+		return
+	}
+
+	timestamp := time.Unix(int64(w.u32(pkt+pktSecOffset)), int64(w.u32(pkt+pktNsecOffset)))
+
+	// Ring memory is returned to kernel, so packet should have its own copy
+	t.packetsChan <- t.copyPacket(srcIP, dstIP, tcp, timestamp)
+	atomic.AddUint64(&w.packets, 1)
+}
+
+func (w *afPacketWorker) read(t *Listener, loopbacks map[int]bool) {
+	defer w.close()
+
+	listenIP := t.listenIP()
+	ifaces := t.listenInterfaces()
+
+	for block := 0; ; block = (block + 1) % w.config.AFPacketBlocks {
+		for !w.wait(block, time.Second) {
+			select {
+			case <-t.quit:
+				return
+			default:
+			}
+		}
+
+		start := block * w.config.AFPacketBlockSize
+		numPkts := int(w.u32(start + blockNumPktsOffset))
+		pkt := start + int(w.u32(start+blockFirstPktOffset))
+
+		for i := 0; i < numPkts; i++ {
+			w.process(t, pkt, listenIP, ifaces, loopbacks)
+			pkt += int(w.u32(pkt + pktNextOffset))
+		}
+
+		atomic.StoreUint32(w.blockStatus(block), tpStatusKernel)
+	}
+}
+
+// readAFPacket captures traffic using multiple AF_PACKET sockets with TPACKET_V3 memory mapped rings.
+// Sockets are joined into single fanout group, so kernel spreads flows between workers.
+func (t *Listener) readAFPacket() {
+	config := t.engineConfig
+	if config.AFPacketWorkers <= 0 {
+		config.AFPacketWorkers = runtime.NumCPU()
+	}
+	if config.AFPacketBlockSize <= 0 {
+		config.AFPacketBlockSize = afPacketDefaultBlockSize
+	}
+	if config.AFPacketBlocks <= 0 {
+		config.AFPacketBlocks = afPacketDefaultBlocks
+	}
+	if pageSize := os.Getpagesize(); config.AFPacketBlockSize%pageSize != 0 {
+		log.Fatalf("AF_PACKET block size should be multiple of page size (%d)", pageSize)
+	}
+
+	// Filter in kernel if possible, otherwise every packet gets copied to the ring
+	progFd, err := loadEBPFProgram(ebpfCaptureProgram(t.listenPorts(), t.transportProtocol(), t.trackResponse, t.tunnelPort()))
+	if err != nil {
+		log.Println("AF_PACKET engine: packets will be filtered in user space,", err)
+		progFd = -1
+	} else {
+		defer syscall.Close(progFd)
+	}
+
+	ifindex := t.listenInterface()
+	group := (uint32(os.Getpid()) + atomic.AddUint32(&afPacketFanoutGroup, 1)) & 0xffff
+	loopbacks := loopbackInterfaces()
+
+	var wg sync.WaitGroup
+	for i := 0; i < config.AFPacketWorkers; i++ {
+		w, err := newAFPacketWorker(i, config, ifindex, group, progFd)
+		if err != nil {
+			log.Fatal("AF_PACKET engine: ", err)
+		}
+
+		t.mu.Lock()
+		t.workers = append(t.workers, w)
+		t.mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.pinCaptureThread(w.id)
+			w.read(t, loopbacks)
+		}()
+	}
+
+	t.readyCh <- true
+
+	wg.Wait()
+}
@@ -0,0 +1,69 @@
+//go:build linux && !386
+// +build linux,!386
+
+package rawSocket
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAFPacketListenerLoopback(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("AF_PACKET engine requires root")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	config := EngineConfig{AFPacketWorkers: 2, AFPacketBlockSize: os.Getpagesize() * 4, AFPacketBlocks: 4}
+	listener := NewListener("127.0.0.1", port, EngineAFPacket, true, 10*time.Millisecond, "", "", 0, false, false, config)
+	defer listener.Close()
+
+	if !listener.IsReady() {
+		t.Fatal("Listener should be ready")
+	}
+
+	go http.Get("http://" + ln.Addr().String() + "/af_packet")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-listener.Receiver():
+			if msg.IsIncoming && !bytes.HasPrefix(msg.Bytes(), []byte("GET /af_packet")) {
+				t.Error("Wrong request", string(msg.Bytes()))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Should capture request and response")
+		}
+	}
+
+	stats := listener.Stats()
+	if len(stats) != 2 {
+		t.Fatal("Should report stats for each worker", stats)
+	}
+
+	var packets uint64
+	for _, s := range stats {
+		packets += s.Packets
+
+		if s.Interface != "lo" {
+			t.Error("Should report captured interface", s.Interface)
+		}
+		if s.RingUsage < 0 || s.RingUsage > 1 {
+			t.Error("Wrong ring usage", s.RingUsage)
+		}
+	}
+	if packets < 2 {
+		t.Error("Should count captured packets", stats)
+	}
+}
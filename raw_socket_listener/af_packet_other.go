@@ -0,0 +1,14 @@
+//go:build !linux || 386
+// +build !linux 386
+
+package rawSocket
+
+import "log"
+
+func packetSocketStats(fd int) (packets, drops uint64) {
+	return 0, 0
+}
+
+func (t *Listener) readAFPacket() {
+	log.Fatal("AF_PACKET engine is supported only on Linux")
+}
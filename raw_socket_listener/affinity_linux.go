@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package rawSocket
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// cpuSet is `cpu_set_t` of glibc, large enough for 1024 CPUs
+type cpuSet [16]uint64
+
+func (s *cpuSet) set(cpu int) {
+	s[cpu/64] |= 1 << (uint(cpu) % 64)
+}
+
+// setThreadAffinity pins thread with given ID to CPUs, 0 means calling thread
+func setThreadAffinity(tid int, cpus []int) error {
+	var set cpuSet
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= len(set)*64 {
+			return fmt.Errorf("CPU %d is out of range", cpu)
+		}
+		set.set(cpu)
+	}
+
+	return schedSetaffinity(tid, &set)
+}
+
+// threadAffinity returns CPUs calling thread can run on
+func threadAffinity() (set cpuSet, err error) {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(set), uintptr(unsafe.Pointer(&set)))
+	if errno != 0 {
+		return set, errno
+	}
+	return set, nil
+}
+
+func schedSetaffinity(tid int, set *cpuSet) error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid), unsafe.Sizeof(*set), uintptr(unsafe.Pointer(set)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isolateThreads moves all threads of process off given CPUs, to the rest of CPUs allowed for calling thread.
+// Threads created later by Go runtime are cloned from existing ones, so they inherit their affinity.
+func isolateThreads(cpus []int) error {
+	allowed, err := threadAffinity()
+	if err != nil {
+		return err
+	}
+
+	for _, cpu := range cpus {
+		if cpu >= 0 && cpu < len(allowed)*64 {
+			allowed[cpu/64] &^= 1 << (uint(cpu) % 64)
+		}
+	}
+	if allowed == (cpuSet{}) {
+		return fmt.Errorf("no CPUs are left for other threads")
+	}
+
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		// Thread could have exited since directory was read
+		if err := schedSetaffinity(tid, &allowed); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+
+	return nil
+}
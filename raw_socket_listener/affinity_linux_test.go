@@ -0,0 +1,37 @@
+//go:build linux
+// +build linux
+
+package rawSocket
+
+import (
+	"testing"
+)
+
+func TestPinCaptureThread(t *testing.T) {
+	allowed, err := threadAffinity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cpus []int
+	for cpu := 0; cpu < len(allowed)*64; cpu++ {
+		if allowed[cpu/64]&(1<<(uint(cpu)%64)) != 0 {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	l := &Listener{engineConfig: EngineConfig{CaptureCPUs: cpus}}
+	done := make(chan cpuSet)
+	go func() {
+		// Thread is locked, and exits with goroutine
+		l.pinCaptureThread(1)
+		set, _ := threadAffinity()
+		done <- set
+	}()
+
+	var expected cpuSet
+	expected.set(cpus[1%len(cpus)])
+	if set := <-done; set != expected {
+		t.Errorf("Worker should be pinned to CPU %d, got %x", cpus[1%len(cpus)], set[0])
+	}
+}
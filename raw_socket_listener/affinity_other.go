@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package rawSocket
+
+import "errors"
+
+var errAffinityUnsupported = errors.New("CPU affinity is supported only on Linux")
+
+func setThreadAffinity(tid int, cpus []int) error {
+	return errAffinityUnsupported
+}
+
+func isolateThreads(cpus []int) error {
+	return errAffinityUnsupported
+}
@@ -0,0 +1,46 @@
+package rawSocket
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// pcapWorker reports libpcap counters of a single captured device
+type pcapWorker struct {
+	id      int
+	device  string
+	handle  *pcap.Handle
+	packets uint64
+}
+
+func (w *pcapWorker) stats() CaptureStats {
+	st := CaptureStats{
+		Worker:    w.id,
+		Interface: w.device,
+		Packets:   atomic.LoadUint64(&w.packets),
+	}
+
+	// libpcap counters are cumulative
+	if ps, err := w.handle.Stats(); err == nil {
+		st.KernelPackets = uint64(ps.PacketsReceived)
+		st.KernelDrops = uint64(ps.PacketsDropped)
+		st.InterfaceDrops = uint64(ps.PacketsIfDropped)
+	}
+
+	return st
+}
+
+// interfaceName returns name of interface with given index, or empty string if all interfaces are captured
+func interfaceName(ifindex int) string {
+	if ifindex <= 0 {
+		return ""
+	}
+
+	if iface, err := net.InterfaceByIndex(ifindex); err == nil {
+		return iface.Name
+	}
+
+	return ""
+}
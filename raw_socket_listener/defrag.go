@@ -0,0 +1,299 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	ipv4FlagMoreFragments = 0x2000
+	ipv4FragmentOffset    = 0x1fff
+
+	ipMaxDatagramSize = 65535
+
+	// DefaultDefragMemoryLimit is the same as default `ipfrag_high_thresh` of Linux kernel
+	DefaultDefragMemoryLimit = 4 << 20
+	// Same as default `ipfrag_time` of Linux kernel
+	defragTimeout = 30 * time.Second
+)
+
+type fragmentKey struct {
+	version uint8
+	proto   uint8
+	src     [16]byte
+	dst     [16]byte
+	id      uint32
+}
+
+type ipFragment struct {
+	offset int
+	data   []byte
+}
+
+type fragmentedDatagram struct {
+	// Headers of the first fragment, used to build reassembled packet
+	header    []byte
+	fragments []ipFragment
+	// Payload size, known after last fragment is received
+	length   int
+	received int
+	start    time.Time
+}
+
+// ipDefragmenter reassembles fragmented IPv4 and IPv6 packets. Total size of buffered fragments is limited,
+// and incomplete datagrams are dropped after timeout.
+type ipDefragmenter struct {
+	mu sync.Mutex
+
+	datagrams map[fragmentKey]*fragmentedDatagram
+	size      int
+
+	memoryLimit int
+	timeout     time.Duration
+	lastExpire  time.Time
+}
+
+func newIPDefragmenter(memoryLimit int) *ipDefragmenter {
+	if memoryLimit <= 0 {
+		memoryLimit = DefaultDefragMemoryLimit
+	}
+
+	return &ipDefragmenter{
+		datagrams:   make(map[fragmentKey]*fragmentedDatagram),
+		memoryLimit: memoryLimit,
+		timeout:     defragTimeout,
+	}
+}
+
+// parseIPFragment returns datagram key, fragment and headers which should be kept in reassembled packet.
+// ok is false if packet is not a fragment.
+func parseIPFragment(packet []byte) (key fragmentKey, frag ipFragment, header []byte, more, ok bool) {
+	if len(packet) < 20 {
+		return
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		flags := binary.BigEndian.Uint16(packet[6:8])
+		if flags&(ipv4FlagMoreFragments|ipv4FragmentOffset) == 0 {
+			return
+		}
+
+		ihl := int(packet[0]&0x0F) * 4
+		ipLength := int(binary.BigEndian.Uint16(packet[2:4]))
+		if ihl < 20 || ipLength < ihl || len(packet) < ipLength {
+			return
+		}
+
+		key.version, key.proto = 4, packet[9]
+		copy(key.src[:], packet[12:16])
+		copy(key.dst[:], packet[16:20])
+		key.id = uint32(binary.BigEndian.Uint16(packet[4:6]))
+
+		frag = ipFragment{offset: int(flags&ipv4FragmentOffset) * 8, data: packet[ihl:ipLength]}
+
+		return key, frag, packet[:ihl], flags&ipv4FlagMoreFragments != 0, true
+	case 6:
+		if len(packet) < ipv6HeaderSize {
+			return
+		}
+
+		length := ipv6HeaderSize + int(binary.BigEndian.Uint16(packet[4:6]))
+		if len(packet) < length {
+			return
+		}
+		packet = packet[:length]
+
+		// Fragment header follows headers which are processed by every node on the path
+		nextHeaderPos, pos := 6, ipv6HeaderSize
+		for packet[nextHeaderPos] != ipv6Fragment {
+			switch packet[nextHeaderPos] {
+			case ipv6HopByHop, ipv6Routing, ipv6Destination:
+			default:
+				return
+			}
+
+			if len(packet) < pos+8 {
+				return
+			}
+
+			nextHeaderPos, pos = pos, pos+(int(packet[pos+1])+1)*8
+		}
+
+		if len(packet) < pos+ipv6FragmentHeaderSize {
+			return
+		}
+
+		offset := binary.BigEndian.Uint16(packet[pos+2 : pos+4])
+		// Atomic fragment has no other parts
+		if offset&0xfff9 == 0 {
+			return
+		}
+
+		key.version = 6
+		copy(key.src[:], packet[8:24])
+		copy(key.dst[:], packet[24:40])
+		key.id = binary.BigEndian.Uint32(packet[pos+4 : pos+8])
+
+		frag = ipFragment{offset: int(offset & 0xfff8), data: packet[pos+ipv6FragmentHeaderSize:]}
+
+		// Fragment header is removed from reassembled packet
+		header = append([]byte(nil), packet[:pos]...)
+		header[nextHeaderPos] = packet[pos]
+
+		return key, frag, header, offset&0x01 != 0, true
+	}
+
+	return
+}
+
+// defragment returns packet as is if it is not a fragment, or reassembled packet after all its fragments are received.
+// fragmented reports that packet was reassembled, ok is false while datagram is incomplete.
+func (d *ipDefragmenter) defragment(packet []byte) (data []byte, fragmented, ok bool) {
+	if d == nil {
+		return packet, false, true
+	}
+
+	key, frag, header, more, isFragment := parseIPFragment(packet)
+	if !isFragment {
+		return packet, false, true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.lastExpire) >= time.Second {
+		d.expire(now)
+	}
+
+	dg := d.datagrams[key]
+	if dg == nil {
+		dg = &fragmentedDatagram{start: now}
+		d.datagrams[key] = dg
+	}
+
+	// Reassembled IPv4 packet should fit into 64kb, and so should IPv6 payload
+	maxLength := ipMaxDatagramSize - len(header)
+	if key.version == 6 {
+		maxLength += ipv6HeaderSize
+	}
+
+	if !d.addFragment(dg, frag, more, maxLength) {
+		d.drop(key)
+		return nil, false, false
+	}
+
+	if frag.offset == 0 {
+		dg.header = append([]byte(nil), header...)
+	}
+
+	if dg.header == nil || dg.length == 0 || dg.received != dg.length {
+		return nil, false, false
+	}
+
+	d.drop(key)
+
+	return dg.assemble(), true, true
+}
+
+// addFragment copies fragment into datagram. Returns false if datagram should be dropped:
+// fragments overlap, which is not allowed since RFC 5722, or memory limit is exceeded.
+func (d *ipDefragmenter) addFragment(dg *fragmentedDatagram, frag ipFragment, more bool, maxLength int) bool {
+	end := frag.offset + len(frag.data)
+
+	if end > maxLength || (more && len(frag.data)%8 != 0) || (dg.length != 0 && end > dg.length) {
+		return false
+	}
+
+	if !more {
+		if dg.length != 0 && dg.length != end {
+			return false
+		}
+		dg.length = end
+	}
+
+	i := len(dg.fragments)
+	for i > 0 && dg.fragments[i-1].offset > frag.offset {
+		i--
+	}
+
+	// Retransmitted fragment
+	if i > 0 && dg.fragments[i-1].offset == frag.offset && len(dg.fragments[i-1].data) == len(frag.data) {
+		return true
+	}
+
+	if (i > 0 && dg.fragments[i-1].offset+len(dg.fragments[i-1].data) > frag.offset) || (i < len(dg.fragments) && dg.fragments[i].offset < end) {
+		return false
+	}
+
+	if d.size+len(frag.data) > d.memoryLimit {
+		return false
+	}
+
+	// Capture buffers get reused
+	frag.data = append([]byte(nil), frag.data...)
+
+	dg.fragments = append(dg.fragments, ipFragment{})
+	copy(dg.fragments[i+1:], dg.fragments[i:])
+	dg.fragments[i] = frag
+	dg.received += len(frag.data)
+	d.size += len(frag.data)
+
+	return true
+}
+
+func (d *ipDefragmenter) drop(key fragmentKey) {
+	if dg, ok := d.datagrams[key]; ok {
+		d.size -= dg.received
+		delete(d.datagrams, key)
+	}
+}
+
+// expire drops datagrams which were not completed in time
+func (d *ipDefragmenter) expire(now time.Time) {
+	for key, dg := range d.datagrams {
+		if now.Sub(dg.start) >= d.timeout {
+			d.drop(key)
+		}
+	}
+
+	d.lastExpire = now
+}
+
+// assemble builds IP packet from headers of the first fragment and payload of all fragments
+func (dg *fragmentedDatagram) assemble() []byte {
+	packet := make([]byte, 0, len(dg.header)+dg.length)
+	packet = append(packet, dg.header...)
+	for _, frag := range dg.fragments {
+		packet = append(packet, frag.data...)
+	}
+
+	if packet[0]>>4 == 4 {
+		binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+		// Keep only "don't fragment" flag
+		packet[6] &= 0x40
+		packet[7] = 0
+
+		binary.BigEndian.PutUint16(packet[10:12], 0)
+		binary.BigEndian.PutUint16(packet[10:12], ipv4Checksum(packet[:len(dg.header)]))
+	} else {
+		binary.BigEndian.PutUint16(packet[4:6], uint16(len(packet)-ipv6HeaderSize))
+	}
+
+	return packet
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
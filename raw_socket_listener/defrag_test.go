@@ -0,0 +1,183 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// fragmentIPv4 splits IPv4 packet into fragments with given payload size
+func fragmentIPv4(packet []byte, size int) (fragments [][]byte) {
+	header, payload := packet[:20], packet[20:]
+
+	for offset := 0; offset < len(payload); offset += size {
+		end := offset + size
+		flags := uint16(offset/8) | ipv4FlagMoreFragments
+		if end >= len(payload) {
+			end = len(payload)
+			flags &^= ipv4FlagMoreFragments
+		}
+
+		frag := append(append([]byte{}, header...), payload[offset:end]...)
+		binary.BigEndian.PutUint16(frag[2:4], uint16(len(frag)))
+		binary.BigEndian.PutUint16(frag[4:6], 42)
+		binary.BigEndian.PutUint16(frag[6:8], flags)
+		fragments = append(fragments, frag)
+	}
+
+	return
+}
+
+// fragmentIPv6 splits IPv6 packet without extension headers into fragments with given payload size
+func fragmentIPv6(packet []byte, size int) (fragments [][]byte) {
+	payload := packet[ipv6HeaderSize:]
+
+	for offset := 0; offset < len(payload); offset += size {
+		end := offset + size
+		fragmentOffset := uint16(offset) | 1
+		if end >= len(payload) {
+			end = len(payload)
+			fragmentOffset &^= 1
+		}
+
+		fragHeader := []byte{packet[6], 0, byte(fragmentOffset >> 8), byte(fragmentOffset), 0, 0, 0, 42}
+		fragments = append(fragments, buildIPv6Packet(ipv6Fragment, append(fragHeader, payload[offset:end]...)))
+	}
+
+	return
+}
+
+func TestIPDefragment(t *testing.T) {
+	tcp := []byte{0x1f, 0x90, 0x00, 0x50, 0, 0, 0, 1, 0, 0, 0, 2, 0x50, 0x18, 0, 0, 0, 0, 0, 0}
+	segment := append(tcp, bytes.Repeat([]byte("a"), 100)...)
+
+	v4 := buildIPv4Packet(ipProtoTCP, segment)
+	v6 := buildIPv6Packet(ipProtoTCP, segment)
+
+	// Reassembled packet keeps fragment ID, and has checksum updated
+	reassembledV4 := append([]byte{}, v4...)
+	binary.BigEndian.PutUint16(reassembledV4[4:6], 42)
+	binary.BigEndian.PutUint16(reassembledV4[10:12], ipv4Checksum(reassembledV4[:20]))
+
+	cases := []struct {
+		name      string
+		packet    []byte
+		fragments [][]byte
+	}{
+		{"IPv4", reassembledV4, fragmentIPv4(v4, 40)},
+		{"IPv4 reversed", reassembledV4, reverse(fragmentIPv4(v4, 40))},
+		{"IPv4 retransmitted", reassembledV4, append(fragmentIPv4(v4, 40)[:2], fragmentIPv4(v4, 40)...)},
+		{"IPv6", v6, fragmentIPv6(v6, 48)},
+		{"IPv6 reversed", v6, reverse(fragmentIPv6(v6, 48))},
+	}
+
+	for _, c := range cases {
+		d := newIPDefragmenter(0)
+
+		for i, frag := range c.fragments {
+			data, fragmented, ok := d.defragment(frag)
+
+			if i < len(c.fragments)-1 {
+				if ok {
+					t.Errorf("%s: should wait for other fragments", c.name)
+				}
+				continue
+			}
+
+			if !ok || !fragmented {
+				t.Errorf("%s: should reassemble packet", c.name)
+			} else if !bytes.Equal(data, c.packet) {
+				t.Errorf("%s: wrong packet %v", c.name, data)
+			}
+		}
+
+		if len(d.datagrams) != 0 || d.size != 0 {
+			t.Errorf("%s: reassembled datagram should be released", c.name)
+		}
+	}
+
+	d := newIPDefragmenter(0)
+	if data, fragmented, ok := d.defragment(v4); !ok || fragmented || !bytes.Equal(data, v4) {
+		t.Error("Should return not fragmented packet as is")
+	}
+
+	var nilDefragmenter *ipDefragmenter
+	if _, _, ok := nilDefragmenter.defragment(fragmentIPv4(v4, 40)[0]); !ok {
+		t.Error("Listener without defragmenter should pass packets as is")
+	}
+}
+
+func TestIPDefragmentLimits(t *testing.T) {
+	payload := make([]byte, 100)
+	fragments := fragmentIPv4(buildIPv4Packet(ipProtoTCP, payload), 40)
+
+	// Overlapping fragment drops whole datagram
+	d := newIPDefragmenter(0)
+	d.defragment(fragments[0])
+	overlap := append([]byte{}, fragments[1]...)
+	binary.BigEndian.PutUint16(overlap[6:8], 4|ipv4FlagMoreFragments)
+	if _, _, ok := d.defragment(overlap); ok || len(d.datagrams) != 0 || d.size != 0 {
+		t.Error("Should drop datagram with overlapping fragments")
+	}
+
+	// Fragment exceeding maximum datagram size
+	tooLarge := append([]byte{}, fragments[2]...)
+	binary.BigEndian.PutUint16(tooLarge[6:8], 0x1fff)
+	if _, _, ok := d.defragment(tooLarge); ok || len(d.datagrams) != 0 {
+		t.Error("Should drop fragment exceeding maximum datagram size")
+	}
+
+	// Memory limit
+	d = newIPDefragmenter(60)
+	d.defragment(fragments[0])
+	if _, _, ok := d.defragment(fragments[1]); ok || len(d.datagrams) != 0 || d.size != 0 {
+		t.Error("Should drop datagram exceeding memory limit")
+	}
+
+	// Incomplete datagrams expire
+	d = newIPDefragmenter(0)
+	d.timeout = time.Millisecond
+	d.defragment(fragments[0])
+	time.Sleep(2 * time.Millisecond)
+	d.lastExpire = time.Time{}
+
+	d.defragment(fragments[1])
+	d.defragment(fragments[2])
+	if len(d.datagrams) != 1 || d.size != 60 {
+		t.Error("Should expire incomplete datagram", len(d.datagrams), d.size)
+	}
+}
+
+func TestMatchFragmentedPacket(t *testing.T) {
+	tcp := []byte{0x1f, 0x90, 0x00, 0x50, 0, 0, 0, 1, 0, 0, 0, 2, 0x50, 0x18, 0, 0, 0, 0, 0, 0}
+	segment := append(tcp, []byte("GET / HTTP/1.1\r\n\r\n")...)
+	inner := buildIPv4Packet(ipProtoTCP, segment)
+
+	vxlan := []byte{0x30, 0x39, 0x12, 0xb5, 0, 0, 0, 0, 0x08, 0, 0, 0, 0, 0, 1, 0}
+	tunneled := buildIPv4Packet(ipProtoUDP, append(vxlan, buildEthernetFrame(inner)...))
+
+	l := &Listener{port: 80, engineConfig: EngineConfig{Decapsulate: true}, defragmenter: newIPDefragmenter(0)}
+
+	for _, packet := range [][]byte{inner, tunneled} {
+		fragments := fragmentIPv4(packet, 16)
+
+		for i, frag := range fragments {
+			_, _, data, ok := l.matchIPPacket(frag, nil)
+			if i < len(fragments)-1 && ok {
+				t.Error("Should not match incomplete datagram")
+			}
+
+			if i == len(fragments)-1 && (!ok || !bytes.Equal(data, segment)) {
+				t.Error("Should match reassembled packet", data)
+			}
+		}
+	}
+}
+
+func reverse(fragments [][]byte) [][]byte {
+	for i, j := 0, len(fragments)-1; i < j; i, j = i+1, j-1 {
+		fragments[i], fragments[j] = fragments[j], fragments[i]
+	}
+	return fragments
+}
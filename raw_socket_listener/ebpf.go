@@ -0,0 +1,374 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"strconv"
+	"unsafe"
+)
+
+// eBPF instruction classes, sizes, modes and operations used by the capture filter.
+// See linux/bpf_common.h and linux/bpf.h
+const (
+	bpfLD    = 0x00
+	bpfLDX   = 0x01
+	bpfSTX   = 0x03
+	bpfALU   = 0x04
+	bpfALU64 = 0x07
+	bpfJMP   = 0x05
+
+	bpfW  = 0x00
+	bpfH  = 0x08
+	bpfB  = 0x10
+	bpfDW = 0x18
+
+	bpfIMM = 0x00
+	bpfABS = 0x20
+	bpfIND = 0x40
+	bpfMEM = 0x60
+
+	bpfADD = 0x00
+	bpfOR  = 0x40
+	bpfAND = 0x50
+	bpfLSH = 0x60
+	bpfRSH = 0x70
+	bpfMOV = 0xb0
+
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJGT  = 0x20
+	bpfJGE  = 0x30
+	bpfJNE  = 0x50
+	bpfCALL = 0x80
+	bpfEXIT = 0x90
+
+	bpfK = 0x00
+	bpfX = 0x08
+
+	// Source register value marking 64 bit immediate as map file descriptor
+	bpfPseudoMapFd = 1
+)
+
+// eBPF registers
+const (
+	bpfR0 = iota
+	bpfR1
+	bpfR2
+	bpfR3
+	bpfR4
+	bpfR5
+	bpfR6
+	bpfR7
+	bpfR8
+	bpfR9
+	// Read-only frame pointer
+	bpfR10
+)
+
+// Maximum amount of bytes of each packet passed to user space
+const ebpfSnapLen = 256 * 1024
+
+// Maximum number of IPv6 extension headers skipped in kernel
+const ebpfMaxIPv6ExtensionHeaders = 4
+
+// bpfInsn mirrors `struct bpf_insn` from linux/bpf.h
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+var nativeLittleEndian = func() bool {
+	i := uint16(1)
+	return *(*byte)(unsafe.Pointer(&i)) == 1
+}()
+
+func newInsn(code uint8, dst, src uint8, off int16, imm int32) bpfInsn {
+	// dst_reg and src_reg are 4 bit bitfields, so their order depends on byte order
+	regs := src<<4 | dst
+	if !nativeLittleEndian {
+		regs = dst<<4 | src
+	}
+
+	return bpfInsn{code: code, regs: regs, off: off, imm: imm}
+}
+
+// bpfAsm is minimal assembler resolving jumps to named labels
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func (a *bpfAsm) emit(insn bpfInsn) {
+	a.insns = append(a.insns, insn)
+}
+
+func (a *bpfAsm) jump(insn bpfInsn, label string) {
+	if a.jumps == nil {
+		a.jumps = make(map[int]string)
+	}
+	a.jumps[len(a.insns)] = label
+	a.emit(insn)
+}
+
+func (a *bpfAsm) label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.insns)
+}
+
+func (a *bpfAsm) assemble() []bpfInsn {
+	for pos, label := range a.jumps {
+		a.insns[pos].off = int16(a.labels[label] - pos - 1)
+	}
+
+	return a.insns
+}
+
+// Offset of `protocol` field in `struct __sk_buff`
+const skbProtocolOffset = 16
+
+// networkToNative returns 16 bit network byte order value the way it is seen when loaded from memory
+func networkToNative(v uint16) int32 {
+	if nativeLittleEndian {
+		return int32(v>>8 | v<<8)
+	}
+
+	return int32(v)
+}
+
+// emitPortMatch jumps to label if port in R0 is one of given ports
+func (a *bpfAsm) emitPortMatch(ports []portRange, label string) {
+	for _, r := range ports {
+		if r.min == r.max {
+			a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, int32(r.min)), label)
+			continue
+		}
+
+		skip := "range" + strconv.Itoa(len(a.insns))
+		a.jump(newInsn(bpfJMP|bpfJGT|bpfK, bpfR0, 0, 0, int32(r.max)), skip)
+		a.jump(newInsn(bpfJMP|bpfJGE|bpfK, bpfR0, 0, 0, int32(r.min)), label)
+		a.label(skip)
+	}
+}
+
+// emitLoadPacketHalf loads 16 bit network byte order value at offset of R-register packet pointer into R0, in host
+// byte order. R5 is scratch register.
+func (a *bpfAsm) emitLoadPacketHalf(src uint8, off int16) {
+	a.emit(newInsn(bpfLDX|bpfB|bpfMEM, bpfR0, src, off, 0))
+	a.emit(newInsn(bpfALU64|bpfLSH|bpfK, bpfR0, 0, 0, 8))
+	a.emit(newInsn(bpfLDX|bpfB|bpfMEM, bpfR5, src, off+1, 0))
+	a.emit(newInsn(bpfALU64|bpfOR|bpfX, bpfR0, bpfR5, 0, 0))
+}
+
+// emitPacketBoundsCheck jumps to label if packet has less than size bytes after R-register packet pointer
+func (a *bpfAsm) emitPacketBoundsCheck(src uint8, size int32, label string) {
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR4, src, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfADD|bpfK, bpfR4, 0, 0, size))
+	a.jump(newInsn(bpfJMP|bpfJGT|bpfX, bpfR4, bpfR3, 0, 0), label)
+}
+
+// ebpfCaptureProgram builds eBPF socket filter which accepts only TCP or UDP packets, depending on protocol,
+// sent to given ports, or sent from them if responses are tracked. If vxlanPort is not 0, GRE and VXLAN packets are accepted too,
+// so they can be decapsulated in user space. Socket should be AF_PACKET/SOCK_DGRAM,
+// so packet data starts right from IP header, or from inner VLAN tag of QinQ frame.
+func ebpfCaptureProgram(ports []portRange, protocol uint8, trackResponse bool, vxlanPort uint16) []bpfInsn {
+	a := &bpfAsm{}
+	vlanTypes := []uint16{vlanTypeDot1Q, vlanTypeDot1AD, vlanTypeQinQ}
+
+	// LD_ABS and LD_IND instructions expect context in R6
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR6, bpfR1, 0, 0))
+
+	// R9 holds offset of IP header. Kernel strips only outer VLAN tag, so data can start with inner tags.
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfK, bpfR9, 0, 0, 0))
+	a.emit(newInsn(bpfLDX|bpfW|bpfMEM, bpfR0, bpfR6, skbProtocolOffset, 0))
+	for _, vlanType := range vlanTypes {
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, networkToNative(vlanType)), "vlan")
+	}
+
+	// Kernel may report protocol of the innermost packet while inner tag is still in data
+	a.emit(newInsn(bpfLD|bpfIND|bpfB, 0, bpfR9, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfRSH|bpfK, bpfR0, 0, 0, 4))
+	a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, 4), "ip")
+	a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, 6), "ip")
+	a.emit(newInsn(bpfLD|bpfIND|bpfH, 0, bpfR9, 0, 2))
+	a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, ethernetTypeIPv4), "vlan2")
+	a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, ethernetTypeIPv6), "vlan2")
+	a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "drop")
+
+	a.label("vlan")
+	a.emit(newInsn(bpfALU64|bpfADD|bpfK, bpfR9, 0, 0, vlanTagSize))
+	// Ethertype following the tag, LD_IND converts it to host byte order
+	a.emit(newInsn(bpfLD|bpfIND|bpfH, 0, bpfR9, 0, -2))
+	for _, vlanType := range vlanTypes {
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, int32(vlanType)), "vlan2")
+	}
+	a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "ip")
+	a.label("vlan2")
+	a.emit(newInsn(bpfALU64|bpfADD|bpfK, bpfR9, 0, 0, vlanTagSize))
+
+	a.label("ip")
+	a.emit(newInsn(bpfLD|bpfIND|bpfB, 0, bpfR9, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfRSH|bpfK, bpfR0, 0, 0, 4))
+	a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, 6), "ipv6")
+	a.jump(newInsn(bpfJMP|bpfJNE|bpfK, bpfR0, 0, 0, 4), "drop")
+
+	// IPv4: R8 = protocol
+	a.emit(newInsn(bpfLD|bpfIND|bpfB, 0, bpfR9, 0, 9))
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR8, bpfR0, 0, 0))
+	a.emit(newInsn(bpfLD|bpfIND|bpfH, 0, bpfR9, 0, 6))
+	a.emit(newInsn(bpfALU64|bpfAND|bpfK, bpfR0, 0, 0, ipv4FlagMoreFragments|ipv4FragmentOffset))
+	a.jump(newInsn(bpfJMP|bpfJNE|bpfK, bpfR0, 0, 0, 0), "fragment")
+	a.emit(newInsn(bpfLD|bpfIND|bpfB, 0, bpfR9, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfAND|bpfK, bpfR0, 0, 0, 0x0f))
+	a.emit(newInsn(bpfALU64|bpfLSH|bpfK, bpfR0, 0, 0, 2))
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR7, bpfR9, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfADD|bpfX, bpfR7, bpfR0, 0, 0))
+	a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "transport")
+
+	// IPv6: R8 = next header
+	a.label("ipv6")
+	a.emit(newInsn(bpfLD|bpfIND|bpfB, 0, bpfR9, 0, 6))
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR8, bpfR0, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR7, bpfR9, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfADD|bpfK, bpfR7, 0, 0, ipv6HeaderSize))
+
+	// Loops are not allowed, so limited number of extension headers is skipped
+	for i := 0; i < ebpfMaxIPv6ExtensionHeaders; i++ {
+		ext, frag, auth, next := "ext"+strconv.Itoa(i), "frag"+strconv.Itoa(i), "auth"+strconv.Itoa(i), "next"+strconv.Itoa(i)
+
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipv6HopByHop), ext)
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipv6Routing), ext)
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipv6Destination), ext)
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipv6Fragment), frag)
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipv6AuthHeader), auth)
+		a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "transport")
+
+		// Header length is in 8-octet units, not including first 8 octets
+		a.label(ext)
+		a.emit(newInsn(bpfLD|bpfIND|bpfB, 0, bpfR7, 0, 0))
+		a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR8, bpfR0, 0, 0))
+		a.emit(newInsn(bpfLD|bpfIND|bpfB, 0, bpfR7, 0, 1))
+		a.emit(newInsn(bpfALU64|bpfADD|bpfK, bpfR0, 0, 0, 1))
+		a.emit(newInsn(bpfALU64|bpfLSH|bpfK, bpfR0, 0, 0, 3))
+		a.emit(newInsn(bpfALU64|bpfADD|bpfX, bpfR7, bpfR0, 0, 0))
+		a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), next)
+
+		// Atomic fragment is the whole packet
+		a.label(frag)
+		a.emit(newInsn(bpfLD|bpfIND|bpfB, 0, bpfR7, 0, 0))
+		a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR8, bpfR0, 0, 0))
+		a.emit(newInsn(bpfLD|bpfIND|bpfH, 0, bpfR7, 0, 2))
+		a.emit(newInsn(bpfALU64|bpfAND|bpfK, bpfR0, 0, 0, 0xfff9))
+		a.jump(newInsn(bpfJMP|bpfJNE|bpfK, bpfR0, 0, 0, 0), "fragment")
+		a.emit(newInsn(bpfALU64|bpfADD|bpfK, bpfR7, 0, 0, ipv6FragmentHeaderSize))
+		a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), next)
+
+		// Authentication header length is in 4-octet units, minus 2
+		a.label(auth)
+		a.emit(newInsn(bpfLD|bpfIND|bpfB, 0, bpfR7, 0, 0))
+		a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR8, bpfR0, 0, 0))
+		a.emit(newInsn(bpfLD|bpfIND|bpfB, 0, bpfR7, 0, 1))
+		a.emit(newInsn(bpfALU64|bpfADD|bpfK, bpfR0, 0, 0, 2))
+		a.emit(newInsn(bpfALU64|bpfLSH|bpfK, bpfR0, 0, 0, 2))
+		a.emit(newInsn(bpfALU64|bpfADD|bpfX, bpfR7, bpfR0, 0, 0))
+
+		a.label(next)
+	}
+
+	// R7 holds offset of transport header
+	a.label("transport")
+	if vxlanPort != 0 {
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipProtoGRE), "accept")
+		if protocol == ipProtoUDP {
+			// Captured datagrams and VXLAN share protocol, so tunnel port is checked before listening ports
+			a.jump(newInsn(bpfJMP|bpfJNE|bpfK, bpfR8, 0, 0, ipProtoUDP), "drop")
+			a.emit(newInsn(bpfLD|bpfIND|bpfH, 0, bpfR7, 0, 2))
+			a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, int32(vxlanPort)), "accept")
+		} else {
+			a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipProtoUDP), "vxlan")
+		}
+	}
+	a.jump(newInsn(bpfJMP|bpfJNE|bpfK, bpfR8, 0, 0, int32(protocol)), "drop")
+
+	// TCP and UDP headers both start with source and destination ports
+	if trackResponse {
+		a.emit(newInsn(bpfLD|bpfIND|bpfH, 0, bpfR7, 0, 0))
+		a.emitPortMatch(ports, "accept")
+	}
+	a.emit(newInsn(bpfLD|bpfIND|bpfH, 0, bpfR7, 0, 2))
+	a.emitPortMatch(ports, "accept")
+	a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "drop")
+
+	if vxlanPort != 0 && protocol != ipProtoUDP {
+		a.label("vxlan")
+		a.emit(newInsn(bpfLD|bpfIND|bpfH, 0, bpfR7, 0, 2))
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, int32(vxlanPort)), "accept")
+	}
+
+	// Only first fragment has transport header, so fragments are accepted by protocol and checked after reassembly
+	a.label("fragment")
+	a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, int32(protocol)), "accept")
+	if vxlanPort != 0 {
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipProtoGRE), "accept")
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipProtoUDP), "accept")
+	}
+
+	a.label("drop")
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfK, bpfR0, 0, 0, 0))
+	a.emit(newInsn(bpfJMP|bpfEXIT, 0, 0, 0, 0))
+
+	a.label("accept")
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfK, bpfR0, 0, 0, ebpfSnapLen))
+	a.emit(newInsn(bpfJMP|bpfEXIT, 0, 0, 0, 0))
+
+	return a.assemble()
+}
+
+// decodeIPPacket splits raw IP packet into source and destination addresses and TCP segment or UDP datagram,
+// depending on protocol
+func decodeIPPacket(data []byte, protocol uint8) (srcIP, dstIP, tcp []byte, ok bool) {
+	if len(data) < 20 {
+		return
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		ihl := int(data[0]&0x0F) * 4
+		ipLength := int(binary.BigEndian.Uint16(data[2:4]))
+
+		// Truncated or invalid IP info
+		if ihl < 20 || len(data) < ihl || ipLength < ihl || len(data) < ipLength || data[9] != protocol {
+			return
+		}
+
+		srcIP, dstIP, tcp = data[12:16], data[16:20], data[ihl:ipLength]
+	case 6:
+		proto, payload, ok := ipv6Payload(data)
+		if !ok || proto != protocol {
+			return nil, nil, nil, false
+		}
+
+		srcIP, dstIP, tcp = data[8:24], data[24:40], payload
+	default:
+		return
+	}
+
+	if protocol == ipProtoUDP {
+		udp, ok := udpDatagram(tcp)
+		return srcIP, dstIP, udp, ok
+	}
+
+	// Truncated TCP info
+	if len(tcp) <= 13 {
+		return
+	}
+
+	dataOffset := int((tcp[12]&0xF0)>>4) * 4
+	isFIN := tcp[13]&0x01 != 0
+
+	// We need only packets with data inside
+	return srcIP, dstIP, tcp, len(tcp) > dataOffset || isFIN
+}
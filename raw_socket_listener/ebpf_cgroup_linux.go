@@ -0,0 +1,505 @@
+package rawSocket
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	bpfProgAttach            = 8
+	bpfProgDetach            = 9
+	bpfProgTypeCgroupSKB     = 8
+	bpfMapTypePerfEventArray = 4
+	bpfCgroupInetIngress     = 0
+	bpfCgroupInetEgress      = 1
+	bpfFAllowMulti           = 1 << 1
+	bpfFuncPerfEventOutput   = 25
+
+	// Offsets of `len`, `data` and `data_end` fields in `struct __sk_buff`
+	skbLenOffset     = 0
+	skbDataOffset    = 76
+	skbDataEndOffset = 80
+
+	// cgroup_skb program lets packet through
+	cgroupSKBAllow = 1
+
+	// Size of perf record is 16 bit, so larger packets are not passed to user space
+	cgroupSnapLen = 65000
+
+	perfTypeSoftware     = 1
+	perfCountSWBPFOutput = 10
+	perfSampleRaw        = 1 << 10
+	perfFlagFdCloexec    = 1 << 3
+	perfRecordLost       = 2
+	perfRecordSample     = 9
+	// Offsets of `data_head` and `data_tail` in `struct perf_event_mmap_page`
+	perfDataHeadOffset = 1024
+	perfDataTailOffset = 1032
+	// Default size of perf ring of each CPU
+	perfDefaultRingSize = 1 << 20
+)
+
+// bpfProgAttachAttr mirrors BPF_PROG_ATTACH and BPF_PROG_DETACH part of `union bpf_attr`
+type bpfProgAttachAttr struct {
+	targetFd     uint32
+	attachBPFFd  uint32
+	attachType   uint32
+	attachFlags  uint32
+	replaceBPFFd uint32
+}
+
+// perfEventAttr mirrors first version of `struct perf_event_attr` from linux/perf_event.h
+type perfEventAttr struct {
+	typ          uint32
+	size         uint32
+	config       uint64
+	samplePeriod uint64
+	sampleType   uint64
+	readFormat   uint64
+	flags        uint64
+	wakeupEvents uint32
+	bpType       uint32
+	config1      uint64
+}
+
+// cgroupCaptureProgram builds cgroup_skb program passing TCP or UDP packets, depending on protocol, to perf event of
+// current CPU. Ingress program passes packets sent to given ports, and egress program packets sent from them.
+// Packet data of cgroup_skb program starts from IP header. Packets are captured after reassembly and before
+// fragmentation, so there are no fragments. IPv6 packets with extension headers are not captured. Program never
+// drops packets.
+func cgroupCaptureProgram(mapFd int, ports []portRange, protocol uint8, egress bool) []bpfInsn {
+	a := &bpfAsm{}
+
+	// R6 = ctx, R2 = data, R3 = data_end
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR6, bpfR1, 0, 0))
+	a.emit(newInsn(bpfLDX|bpfW|bpfMEM, bpfR2, bpfR6, skbDataOffset, 0))
+	a.emit(newInsn(bpfLDX|bpfW|bpfMEM, bpfR3, bpfR6, skbDataEndOffset, 0))
+
+	a.emitPacketBoundsCheck(bpfR2, 20, "allow")
+	a.emit(newInsn(bpfLDX|bpfB|bpfMEM, bpfR0, bpfR2, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfRSH|bpfK, bpfR0, 0, 0, 4))
+	a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, 6), "ipv6")
+	a.jump(newInsn(bpfJMP|bpfJNE|bpfK, bpfR0, 0, 0, 4), "allow")
+
+	// IPv4: R8 = protocol, R7 = transport header
+	a.emit(newInsn(bpfLDX|bpfB|bpfMEM, bpfR8, bpfR2, 9, 0))
+	a.emit(newInsn(bpfLDX|bpfB|bpfMEM, bpfR0, bpfR2, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfAND|bpfK, bpfR0, 0, 0, 0x0f))
+	a.emit(newInsn(bpfALU64|bpfLSH|bpfK, bpfR0, 0, 0, 2))
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR7, bpfR2, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfADD|bpfX, bpfR7, bpfR0, 0, 0))
+	a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "transport")
+
+	// IPv6: R8 = next header, R7 = transport header
+	a.label("ipv6")
+	a.emitPacketBoundsCheck(bpfR2, ipv6HeaderSize, "allow")
+	a.emit(newInsn(bpfLDX|bpfB|bpfMEM, bpfR8, bpfR2, 6, 0))
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR7, bpfR2, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfADD|bpfK, bpfR7, 0, 0, ipv6HeaderSize))
+
+	// TCP and UDP headers both start with source and destination ports
+	a.label("transport")
+	a.emitPacketBoundsCheck(bpfR7, 4, "allow")
+	a.jump(newInsn(bpfJMP|bpfJNE|bpfK, bpfR8, 0, 0, int32(protocol)), "allow")
+	if egress {
+		a.emitLoadPacketHalf(bpfR7, 0)
+	} else {
+		a.emitLoadPacketHalf(bpfR7, 2)
+	}
+	a.emitPortMatch(ports, "output")
+
+	a.label("allow")
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfK, bpfR0, 0, 0, cgroupSKBAllow))
+	a.emit(newInsn(bpfJMP|bpfEXIT, 0, 0, 0, 0))
+
+	// Sample starts with 32 bit packet length, followed by up to cgroupSnapLen bytes of packet
+	a.label("output")
+	a.emit(newInsn(bpfLDX|bpfW|bpfMEM, bpfR4, bpfR6, skbLenOffset, 0))
+	a.emit(newInsn(bpfSTX|bpfW|bpfMEM, bpfR10, bpfR4, -8, 0))
+	a.jump(newInsn(bpfJMP|bpfJGT|bpfK, bpfR4, 0, 0, cgroupSnapLen), "truncate")
+	a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "flags")
+	a.label("truncate")
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfK, bpfR4, 0, 0, cgroupSnapLen))
+	// R3 = number of packet bytes appended to sample in upper 32 bits | BPF_F_CURRENT_CPU
+	a.label("flags")
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR3, bpfR4, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfLSH|bpfK, bpfR3, 0, 0, 32))
+	// 32 bit move zeroes upper half of register
+	a.emit(newInsn(bpfALU|bpfMOV|bpfK, bpfR0, 0, 0, -1))
+	a.emit(newInsn(bpfALU64|bpfOR|bpfX, bpfR3, bpfR0, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR1, bpfR6, 0, 0))
+	// R2 = map, 64 bit immediate load takes two instructions
+	a.emit(newInsn(bpfLD|bpfDW|bpfIMM, bpfR2, bpfPseudoMapFd, 0, int32(mapFd)))
+	a.emit(newInsn(0, 0, 0, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR4, bpfR10, 0, 0))
+	a.emit(newInsn(bpfALU64|bpfADD|bpfK, bpfR4, 0, 0, -8))
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfK, bpfR5, 0, 0, 4))
+	a.emit(newInsn(bpfJMP|bpfCALL, 0, 0, 0, bpfFuncPerfEventOutput))
+	a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "allow")
+
+	return a.assemble()
+}
+
+// processCgroup returns path of cgroup v2 process with given PID belongs to
+func processCgroup(pid int) (string, error) {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	if err != nil {
+		return "", err
+	}
+
+	var cgroup string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			cgroup = strings.TrimPrefix(line, "0::")
+			break
+		}
+	}
+	if cgroup == "" {
+		return "", fmt.Errorf("process %d is not in cgroup v2 hierarchy", pid)
+	}
+
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(mount, cgroup), nil
+}
+
+// cgroup2Mount returns mount point of cgroup v2 hierarchy
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Mount point is 5th field, and filesystem type follows separator
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for i := 6; i+1 < len(fields); i++ {
+			if fields[i] == "-" && fields[i+1] == "cgroup2" {
+				return fields[4], nil
+			}
+		}
+	}
+
+	return "", errors.New("cgroup v2 is not mounted")
+}
+
+// possibleCPUs returns number of CPUs kernel may use, including offline ones
+func possibleCPUs() int {
+	data, err := ioutil.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return runtime.NumCPU()
+	}
+
+	// Format is like 0-3 or 0,2-7
+	ranges := strings.Split(strings.TrimSpace(string(data)), ",")
+	last := ranges[len(ranges)-1]
+	if i := strings.IndexByte(last, '-'); i >= 0 {
+		last = last[i+1:]
+	}
+	max, err := strconv.Atoi(last)
+	if err != nil {
+		return runtime.NumCPU()
+	}
+
+	return max + 1
+}
+
+// perfRing is ring buffer of perf event, which receives samples of a single CPU
+type perfRing struct {
+	fd  int
+	mem []byte
+	// Part of mem after metadata page, its size is power of 2
+	data []byte
+	// Records which wrap around end of ring are copied here
+	buf []byte
+}
+
+func newPerfRing(cpu, size int) (*perfRing, error) {
+	attr := perfEventAttr{
+		typ:          perfTypeSoftware,
+		config:       perfCountSWBPFOutput,
+		samplePeriod: 1,
+		sampleType:   perfSampleRaw,
+		wakeupEvents: 1,
+	}
+	attr.size = uint32(unsafe.Sizeof(attr))
+
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(&attr)), ^uintptr(0), uintptr(cpu), ^uintptr(0), perfFlagFdCloexec, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	pageSize := os.Getpagesize()
+	pages := 1
+	for pages*pageSize < size {
+		pages *= 2
+	}
+
+	mem, err := syscall.Mmap(int(fd), 0, (pages+1)*pageSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Close(int(fd))
+		return nil, err
+	}
+
+	return &perfRing{fd: int(fd), mem: mem, data: mem[pageSize:]}, nil
+}
+
+// read passes records written by kernel to handler, and releases them. Record passed to handler is valid until
+// handler returns.
+func (r *perfRing) read(handler func(typ uint32, record []byte)) {
+	head := atomic.LoadUint64((*uint64)(unsafe.Pointer(&r.mem[perfDataHeadOffset])))
+	tailPtr := (*uint64)(unsafe.Pointer(&r.mem[perfDataTailOffset]))
+	tail := atomic.LoadUint64(tailPtr)
+	size := uint64(len(r.data))
+
+	for tail < head {
+		// Records are 8 byte aligned, so header never wraps
+		off := tail % size
+		typ := *(*uint32)(unsafe.Pointer(&r.data[off]))
+		length := uint64(*(*uint16)(unsafe.Pointer(&r.data[off+6])))
+		if length < 8 {
+			break
+		}
+
+		var record []byte
+		if off+length <= size {
+			record = r.data[off : off+length]
+		} else {
+			r.buf = append(r.buf[:0], r.data[off:]...)
+			r.buf = append(r.buf, r.data[:off+length-size]...)
+			record = r.buf
+		}
+
+		handler(typ, record[8:])
+		tail += length
+	}
+
+	atomic.StoreUint64(tailPtr, tail)
+}
+
+func (r *perfRing) close() {
+	syscall.Munmap(r.mem)
+	syscall.Close(r.fd)
+}
+
+// cgroupCapture captures traffic of sockets in cgroup, using cgroup_skb programs which pass packets to user space
+// through perf ring of each CPU
+type cgroupCapture struct {
+	cgroupFd int
+	mapFd    int
+	progFds  map[uint32]int
+	rings    []*perfRing
+	epollFd  int
+
+	packets       uint64
+	kernelPackets uint64
+	kernelDrops   uint64
+}
+
+// newCgroupCapture attaches ingress program to cgroup, and egress program if responses are tracked. Programs are
+// attached alongside programs of other applications, like systemd.
+func newCgroupCapture(path string, ports []portRange, protocol uint8, trackResponse bool, ringSize int) (_ *cgroupCapture, err error) {
+	c := &cgroupCapture{cgroupFd: -1, mapFd: -1, epollFd: -1, progFds: make(map[uint32]int)}
+	defer func() {
+		if err != nil {
+			c.close()
+		}
+	}()
+
+	if c.cgroupFd, err = syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0); err != nil {
+		return nil, fmt.Errorf("can't open cgroup %s: %v", path, err)
+	}
+
+	cpus := possibleCPUs()
+	mapAttr := bpfMapCreateAttr{mapType: bpfMapTypePerfEventArray, keySize: 4, valueSize: 4, maxEntries: uint32(cpus)}
+	if c.mapFd, err = bpf(bpfMapCreate, unsafe.Pointer(&mapAttr), unsafe.Sizeof(mapAttr)); err != nil {
+		return nil, fmt.Errorf("can't create perf event map: %v", err)
+	}
+
+	if c.epollFd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return nil, err
+	}
+
+	for cpu := 0; cpu < cpus; cpu++ {
+		ring, err := newPerfRing(cpu, ringSize)
+		// Offline CPUs have no events
+		if err == syscall.ENODEV {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't open perf event: %v", err)
+		}
+		c.rings = append(c.rings, ring)
+
+		key, value := uint32(cpu), uint32(ring.fd)
+		attr := bpfMapUpdateAttr{
+			mapFd: uint32(c.mapFd),
+			key:   uint64(uintptr(unsafe.Pointer(&key))),
+			value: uint64(uintptr(unsafe.Pointer(&value))),
+		}
+		if _, err = bpf(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+			return nil, fmt.Errorf("can't add perf event to map: %v", err)
+		}
+
+		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(len(c.rings) - 1)}
+		if err = syscall.EpollCtl(c.epollFd, syscall.EPOLL_CTL_ADD, ring.fd, &event); err != nil {
+			return nil, err
+		}
+	}
+
+	attachTypes := []uint32{bpfCgroupInetIngress}
+	if trackResponse {
+		attachTypes = append(attachTypes, bpfCgroupInetEgress)
+	}
+	for _, attachType := range attachTypes {
+		progFd, err := loadBPFProgram(bpfProgTypeCgroupSKB, cgroupCaptureProgram(c.mapFd, ports, protocol, attachType == bpfCgroupInetEgress))
+		if err != nil {
+			return nil, err
+		}
+
+		attr := bpfProgAttachAttr{targetFd: uint32(c.cgroupFd), attachBPFFd: uint32(progFd), attachType: attachType, attachFlags: bpfFAllowMulti}
+		if _, err = bpf(bpfProgAttach, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+			syscall.Close(progFd)
+			return nil, fmt.Errorf("can't attach eBPF program to cgroup %s: %v", path, err)
+		}
+		c.progFds[attachType] = progFd
+	}
+
+	return c, nil
+}
+
+// poll waits for samples up to timeout, and passes packets to handler. Packet is valid until handler returns.
+func (c *cgroupCapture) poll(timeout time.Duration, handler func(packet []byte)) error {
+	events := make([]syscall.EpollEvent, len(c.rings))
+	n, err := syscall.EpollWait(c.epollFd, events, int(timeout/time.Millisecond))
+	if err != nil && err != syscall.EINTR {
+		return err
+	}
+
+	for _, event := range events[:n] {
+		c.rings[event.Fd].read(func(typ uint32, record []byte) {
+			switch typ {
+			case perfRecordLost:
+				if len(record) >= 16 {
+					atomic.AddUint64(&c.kernelDrops, *(*uint64)(unsafe.Pointer(&record[8])))
+				}
+			case perfRecordSample:
+				// Raw data size, packet length, and packet padded to 8 bytes
+				if len(record) < 8 {
+					return
+				}
+				atomic.AddUint64(&c.kernelPackets, 1)
+
+				length := int(*(*uint32)(unsafe.Pointer(&record[4])))
+				if length > cgroupSnapLen || 8+length > len(record) {
+					atomic.AddUint64(&c.kernelDrops, 1)
+					return
+				}
+
+				handler(record[8 : 8+length])
+			}
+		})
+	}
+
+	return nil
+}
+
+func (c *cgroupCapture) stats() CaptureStats {
+	return CaptureStats{
+		Packets:       atomic.LoadUint64(&c.packets),
+		KernelPackets: atomic.LoadUint64(&c.kernelPackets),
+		KernelDrops:   atomic.LoadUint64(&c.kernelDrops),
+	}
+}
+
+// close detaches programs from cgroup and releases resources
+func (c *cgroupCapture) close() {
+	for attachType, progFd := range c.progFds {
+		attr := bpfProgAttachAttr{targetFd: uint32(c.cgroupFd), attachBPFFd: uint32(progFd), attachType: attachType}
+		bpf(bpfProgDetach, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		syscall.Close(progFd)
+	}
+	for _, ring := range c.rings {
+		ring.close()
+	}
+	for _, fd := range []int{c.epollFd, c.mapFd, c.cgroupFd} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// readEBPFCgroup captures traffic of sockets in cgroup given by EngineConfig.Cgroup or EngineConfig.PID. Unlike
+// packet sockets, it captures traffic of containers and services regardless of interfaces and network namespaces
+// they use, and doesn't see traffic of other processes on the same ports.
+func (t *Listener) readEBPFCgroup() {
+	path := t.engineConfig.Cgroup
+	if path == "" {
+		var err error
+		if path, err = processCgroup(t.engineConfig.PID); err != nil {
+			log.Fatal("Can't find cgroup of process: ", err)
+		}
+	}
+
+	ringSize := perfDefaultRingSize
+	if t.bufferSize > 0 {
+		ringSize = int(t.bufferSize)
+	}
+
+	capture, err := newCgroupCapture(path, t.listenPorts(), t.transportProtocol(), t.trackResponse, ringSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer capture.close()
+
+	t.mu.Lock()
+	t.workers = append(t.workers, capture)
+	t.mu.Unlock()
+
+	t.readyCh <- true
+
+	t.pinCaptureThread(0)
+
+	listenIP := t.listenIP()
+
+	for {
+		select {
+		case <-t.quit:
+			return
+		default:
+		}
+
+		// Periodically wake up to check if listener was closed
+		err := capture.poll(time.Second, func(packet []byte) {
+			srcIP, dstIP, data, ok := t.matchIPPacket(packet, listenIP)
+			if !ok {
+				return
+			}
+
+			// Ring gets reused, so packet should have its own copy
+			t.packetsChan <- t.copyPacket(srcIP, dstIP, data, time.Now())
+			atomic.AddUint64(&capture.packets, 1)
+		})
+		if err != nil {
+			log.Println("eBPF engine read error: ", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	bpfMapCreate            = 0
+	bpfMapUpdateElem        = 2
+	bpfProgLoad             = 5
+	bpfProgTypeSocketFilter = 1
+
+	soAttachBPF = 50
+
+	solPacket     = 263
+	packetAuxdata = 8
+
+	tpStatusVLANValid = 1 << 4
+
+	ethPAll        = 0x0003
+	packetOutgoing = 4
+)
+
+// bpfProgLoadAttr mirrors BPF_PROG_LOAD part of `union bpf_attr`
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type bpfMapUpdateAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+// bpf(2) is not part of syscall package, so its number depends on architecture
+func sysBPF() (uintptr, error) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return 321, nil
+	case "386":
+		return 357, nil
+	case "arm64", "riscv64":
+		return 280, nil
+	case "arm":
+		return 386, nil
+	case "ppc64", "ppc64le":
+		return 361, nil
+	case "s390x":
+		return 351, nil
+	default:
+		return 0, fmt.Errorf("eBPF engine is not supported on %s", runtime.GOARCH)
+	}
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	nr, err := sysBPF()
+	if err != nil {
+		return -1, err
+	}
+
+	fd, _, errno := syscall.Syscall(nr, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(fd), nil
+}
+
+func loadBPFProgram(progType uint32, insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 64*1024)
+
+	attr := bpfProgLoadAttr{
+		progType: progType,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+
+	fd, err := bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+
+	if err != nil {
+		return -1, fmt.Errorf("can't load eBPF program: %v %s", err, bytes.TrimRight(logBuf, "\x00"))
+	}
+
+	return fd, nil
+}
+
+func loadEBPFProgram(insns []bpfInsn) (int, error) {
+	return loadBPFProgram(bpfProgTypeSocketFilter, insns)
+}
+
+func htons(i uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, i)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+// tpacketAuxdata mirrors `struct tpacket_auxdata` from linux/if_packet.h
+type tpacketAuxdata struct {
+	status   uint32
+	len      uint32
+	snaplen  uint32
+	mac      uint16
+	net      uint16
+	vlanTCI  uint16
+	vlanTPID uint16
+}
+
+// auxdataVLAN returns VLAN tag from PACKET_AUXDATA control message, or noVLAN
+func auxdataVLAN(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return noVLAN
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level == solPacket && m.Header.Type == packetAuxdata && len(m.Data) >= int(unsafe.Sizeof(tpacketAuxdata{})) {
+			aux := (*tpacketAuxdata)(unsafe.Pointer(&m.Data[0]))
+			if aux.status&tpStatusVLANValid != 0 {
+				return int(aux.vlanTCI)
+			}
+		}
+	}
+
+	return noVLAN
+}
+
+// ebpfSocket reports counters of eBPF engine socket, which captures all interfaces
+type ebpfSocket struct {
+	fd int
+
+	packets       uint64
+	kernelPackets uint64
+	kernelDrops   uint64
+}
+
+// stats returns cumulative counters. Kernel resets its counters on each read, so they are accumulated here.
+func (s *ebpfSocket) stats() CaptureStats {
+	packets, drops := packetSocketStats(s.fd)
+
+	return CaptureStats{
+		Packets:       atomic.LoadUint64(&s.packets),
+		KernelPackets: atomic.AddUint64(&s.kernelPackets, packets),
+		KernelDrops:   atomic.AddUint64(&s.kernelDrops, drops),
+	}
+}
+
+// readEBPF captures traffic using AF_PACKET socket with attached eBPF filter.
+// Unlike libpcap engine, filtering happens in kernel before packet gets copied to the socket buffer,
+// and all interfaces including loopback are captured using single socket.
+func (t *Listener) readEBPF() {
+	if t.engineConfig.Cgroup != "" || t.engineConfig.PID != 0 {
+		t.readEBPFCgroup()
+		return
+	}
+
+	progFd, err := loadEBPFProgram(ebpfCaptureProgram(t.listenPorts(), t.transportProtocol(), t.trackResponse, t.tunnelPort()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer syscall.Close(progFd)
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(ethPAll)))
+	if err != nil {
+		log.Fatal("Can't open packet socket: ", err)
+	}
+	defer syscall.Close(fd)
+
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soAttachBPF, progFd); err != nil {
+		log.Fatal("Can't attach eBPF program: ", err)
+	}
+
+	if t.bufferSize > 0 {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, int(t.bufferSize)); err != nil {
+			log.Println("Can't set socket buffer size: ", err)
+		}
+	}
+
+	// Ancillary data contains VLAN tag stripped by NIC or kernel
+	if err = syscall.SetsockoptInt(fd, solPacket, packetAuxdata, 1); err != nil {
+		log.Fatal(err)
+	}
+
+	// Periodically wake up to check if listener was closed
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		log.Fatal(err)
+	}
+
+	loopbacks := loopbackInterfaces()
+	ifaces := t.listenInterfaces()
+	listenIP := t.listenIP()
+
+	socket := &ebpfSocket{fd: fd}
+	t.mu.Lock()
+	t.workers = append(t.workers, socket)
+	t.mu.Unlock()
+
+	t.readyCh <- true
+
+	t.pinCaptureThread(0)
+
+	buf := make([]byte, ebpfSnapLen)
+	oob := make([]byte, syscall.CmsgSpace(int(unsafe.Sizeof(tpacketAuxdata{}))))
+
+	for {
+		select {
+		case <-t.quit:
+			return
+		default:
+		}
+
+		n, oobn, _, from, err := syscall.Recvmsg(fd, buf, oob, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			log.Println("eBPF engine read error: ", err)
+			return
+		}
+
+		sll, ok := from.(*syscall.SockaddrLinklayer)
+		if !ok {
+			continue
+		}
+
+		// On loopback each packet is seen twice: when it is sent and when it is received
+		if sll.Pkttype == packetOutgoing && loopbacks[sll.Ifindex] {
+			continue
+		}
+
+		if !captureInterface(sll.Ifindex, ifaces, loopbacks) {
+			continue
+		}
+
+		packet, ok := skipVLANTags(htons(sll.Protocol), buf[:n], auxdataVLAN(oob[:oobn]), t.engineConfig.VLANs)
+		if !ok {
+			continue
+		}
+
+		srcIP, dstIP, data, ok := t.matchIPPacket(packet, listenIP)
+		if !ok {
+			continue
+		}
+
+		// Buffer gets reused, so packet should have its own copy
+		t.packetsChan <- t.copyPacket(srcIP, dstIP, data, time.Now())
+		atomic.AddUint64(&socket.packets, 1)
+	}
+}
@@ -0,0 +1,219 @@
+package rawSocket
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEBPFProgramLoad(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Loading eBPF programs requires root")
+	}
+
+	for _, track := range []bool{false, true} {
+		for _, vxlanPort := range []uint16{0, DefaultVXLANPort} {
+			for _, protocol := range []uint8{ipProtoTCP, ipProtoUDP} {
+				fd, err := loadEBPFProgram(ebpfCaptureProgram([]portRange{{80, 80}, {8000, 8100}}, protocol, track, vxlanPort))
+				if err != nil {
+					t.Skip(err)
+				}
+				syscall.Close(fd)
+			}
+		}
+	}
+}
+
+func TestEBPFListenerLoopback(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("eBPF engine requires root")
+	}
+
+	fd, err := loadEBPFProgram(ebpfCaptureProgram([]portRange{{80, 80}}, ipProtoTCP, false, 0))
+	if err != nil {
+		t.Skip(err)
+	}
+	syscall.Close(fd)
+
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		t.Run(addr, func(t *testing.T) {
+			ln, err := net.Listen("tcp", net.JoinHostPort(addr, "0"))
+			if err != nil {
+				t.Skip(err)
+			}
+			defer ln.Close()
+
+			go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			_, port, _ := net.SplitHostPort(ln.Addr().String())
+			listener := NewListener(addr, port, EngineEBPF, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
+			defer listener.Close()
+
+			if !listener.IsReady() {
+				t.Fatal("Listener should be ready")
+			}
+
+			go http.Get("http://" + ln.Addr().String() + "/ebpf")
+
+			for i := 0; i < 2; i++ {
+				select {
+				case msg := <-listener.Receiver():
+					if msg.IsIncoming && !bytes.HasPrefix(msg.Bytes(), []byte("GET /ebpf")) {
+						t.Error("Wrong request", string(msg.Bytes()))
+					}
+					if !msg.IP().Equal(net.ParseIP(addr)) {
+						t.Error("Wrong source address", msg.IP())
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("Should capture request and response")
+				}
+			}
+
+			if stats := listener.Stats(); len(stats) != 1 || stats[0].Packets < 2 {
+				t.Error("Should count captured packets", stats)
+			}
+		})
+	}
+}
+
+func TestEBPFCgroupProgramLoad(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Loading eBPF programs requires root")
+	}
+
+	capture, err := newCgroupCapture("/nonexistent", []portRange{{80, 80}}, ipProtoTCP, true, 0)
+	if err == nil {
+		capture.close()
+		t.Fatal("Should fail to open missing cgroup")
+	}
+
+	mount, err := cgroup2Mount()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	for _, track := range []bool{false, true} {
+		for _, protocol := range []uint8{ipProtoTCP, ipProtoUDP} {
+			capture, err := newCgroupCapture(mount, []portRange{{80, 80}, {8000, 8100}}, protocol, track, 0)
+			if err != nil {
+				t.Skip(err)
+			}
+			if len(capture.progFds) != 1 && !track || len(capture.progFds) != 2 && track {
+				t.Error("Should attach egress program only if responses are tracked", capture.progFds)
+			}
+			capture.close()
+		}
+	}
+}
+
+func TestEBPFCgroupListener(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("eBPF engine requires root")
+	}
+
+	path, err := processCgroup(os.Getpid())
+	if err != nil {
+		t.Skip(err)
+	}
+	capture, err := newCgroupCapture(path, []portRange{{80, 80}}, ipProtoTCP, true, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	capture.close()
+
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		t.Run(addr, func(t *testing.T) {
+			ln, err := net.Listen("tcp", net.JoinHostPort(addr, "0"))
+			if err != nil {
+				t.Skip(err)
+			}
+			defer ln.Close()
+
+			go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			_, port, _ := net.SplitHostPort(ln.Addr().String())
+			listener := NewListener(addr, port, EngineEBPF, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{PID: os.Getpid()})
+			defer listener.Close()
+
+			if !listener.IsReady() {
+				t.Fatal("Listener should be ready")
+			}
+
+			go http.Get("http://" + ln.Addr().String() + "/cgroup")
+
+			var requests, responses int
+			for i := 0; i < 2; i++ {
+				select {
+				case msg := <-listener.Receiver():
+					if msg.IsIncoming {
+						requests++
+						if !bytes.HasPrefix(msg.Bytes(), []byte("GET /cgroup")) {
+							t.Error("Wrong request", string(msg.Bytes()))
+						}
+					} else {
+						responses++
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("Should capture request and response")
+				}
+			}
+			if requests != 1 || responses != 1 {
+				t.Error("Should capture each message once", requests, responses)
+			}
+
+			if stats := listener.Stats(); len(stats) != 1 || stats[0].Packets < 2 || stats[0].KernelDrops != 0 {
+				t.Error("Should count captured packets", stats)
+			}
+		})
+	}
+}
+
+func TestEBPFCgroupScope(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("eBPF engine requires root")
+	}
+
+	mount, err := cgroup2Mount()
+	if err != nil {
+		t.Skip(err)
+	}
+	// Test process is not in new cgroup, so its traffic should not be captured
+	path, err := ioutil.TempDir(mount, "gor-test")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.Remove(path)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	listener := NewListener("127.0.0.1", port, EngineEBPF, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{Cgroup: path})
+	defer listener.Close()
+
+	if !listener.IsReady() {
+		t.Fatal("Listener should be ready")
+	}
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case msg := <-listener.Receiver():
+		t.Error("Should not capture traffic of other cgroups", string(msg.Bytes()))
+	case <-time.After(200 * time.Millisecond):
+	}
+}
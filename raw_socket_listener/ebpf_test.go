@@ -0,0 +1,65 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEBPFCaptureProgram(t *testing.T) {
+	ports := []portRange{{80, 80}, {8000, 8100}, {9000, 9000}}
+
+	for _, track := range []bool{false, true} {
+		for _, protocol := range []uint8{ipProtoTCP, ipProtoUDP} {
+			prog := ebpfCaptureProgram(ports, protocol, track, DefaultVXLANPort)
+
+			for i, insn := range prog {
+				if insn.code&0x07 == bpfJMP && insn.code&0xf0 != bpfEXIT {
+					if target := i + 1 + int(insn.off); target <= i || target >= len(prog) {
+						t.Errorf("Jump %d points outside of program: %d", i, target)
+					}
+				}
+			}
+
+			if last := prog[len(prog)-1]; last.code != bpfJMP|bpfEXIT {
+				t.Error("Program should end with exit", track, protocol)
+			}
+		}
+	}
+}
+
+func TestDecodeIPPacket(t *testing.T) {
+	tcp := []byte{0x1f, 0x90, 0x00, 0x50, 0, 0, 0, 1, 0, 0, 0, 2, 0x50, 0x18, 0, 0, 0, 0, 0, 0}
+	payload := []byte("GET / HTTP/1.1\r\n\r\n")
+
+	ip := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	total := len(ip) + len(tcp) + len(payload)
+	ip[2], ip[3] = byte(total>>8), byte(total)
+
+	packet := append(append(append([]byte{}, ip...), tcp...), payload...)
+	// Ethernet padding should be ignored
+	packet = append(packet, 0, 0, 0)
+
+	srcIP, dstIP, data, ok := decodeIPPacket(packet, ipProtoTCP)
+	if !ok {
+		t.Fatal("Should decode packet")
+	}
+
+	if !bytes.Equal(srcIP, []byte{10, 0, 0, 1}) || !bytes.Equal(dstIP, []byte{10, 0, 0, 2}) {
+		t.Error("Wrong addresses", srcIP, dstIP)
+	}
+
+	if !bytes.HasSuffix(data, payload) || len(data) != len(tcp)+len(payload) {
+		t.Error("Wrong TCP segment", data)
+	}
+
+	// Packet without payload
+	packet = append(append([]byte{}, ip...), tcp...)
+	packet[2], packet[3] = 0, byte(len(packet))
+	if _, _, _, ok := decodeIPPacket(packet, ipProtoTCP); ok {
+		t.Error("Should skip packets without data")
+	}
+
+	if _, _, _, ok := decodeIPPacket(packet[:30], ipProtoTCP); ok {
+		t.Error("Should skip truncated packets")
+	}
+}
@@ -0,0 +1,117 @@
+package rawSocket
+
+// EngineConfig holds additional capture options, mostly specific to capture engines. Zero values mean defaults.
+type EngineConfig struct {
+	// Extract traffic from VXLAN, GRE and ERSPAN tunnels, used by cloud traffic mirroring and switch SPAN ports
+	Decapsulate bool
+	// UDP port of VXLAN tunnel, defaults to 4789
+	VXLANPort int
+	// Capture only frames tagged with one of VLAN IDs
+	VLANs []int
+	// Maximum size of single TCP message buffered by the assembler, larger messages are dropped. Zero means no limit.
+	StreamMemoryLimit int
+	// Maximum size of IP fragments buffered for reassembly, defaults to 4mb
+	DefragMemoryLimit int
+
+	// Capture UDP datagrams instead of TCP segments. Each datagram is a separate message.
+	UDP bool
+	// UDP mode: optional hook deciding if request datagram with given payload should be captured.
+	// Responses to skipped requests are skipped too.
+	DatagramFilter func(payload []byte) bool
+	// UDP mode: datagrams sent by server are passed without associating them with requests, for protocols which
+	// track their sessions, like QUIC
+	UnpairedDatagrams bool
+	// TCP mode: how messages are delimited, HTTP by default
+	Framing Framing
+	// TCP mode: each segment with data is passed as separate message as it is captured, without associating it with
+	// request, for protocols multiplexing requests over connection, like HTTP/2. Segments are reordered by consumer
+	// using their Seq.
+	RawSegments bool
+
+	// AF_PACKET engine: number of sockets joined into single fanout group, defaults to number of CPUs
+	AFPacketWorkers int
+	// AF_PACKET engine: size of single TPACKET_V3 ring block, should be multiple of page size
+	AFPacketBlockSize int
+	// AF_PACKET engine: number of ring blocks per worker
+	AFPacketBlocks int
+
+	// CPUs capture workers are pinned to, in turn, each worker on its own OS thread. Linux only, empty means
+	// workers run on any CPU.
+	CaptureCPUs []int
+	// Move other threads of process, like output workers, off CaptureCPUs, so they don't delay capture
+	IsolateCaptureCPUs bool
+
+	// AF_XDP engine: NIC RX queues to attach sockets to, defaults to queue 0
+	XDPQueues []int
+	// AF_XDP engine: size of packet buffer (UMEM) registered for each queue
+	XDPUmemSize int
+
+	// eBPF engine: capture only traffic of sockets in cgroup v2 with given path, like /sys/fs/cgroup/system.slice/nginx.service.
+	// Requests are captured when they are received by servers in cgroup, and responses when they are sent.
+	Cgroup string
+	// eBPF engine: capture only traffic of cgroup the process with given PID belongs to
+	PID int
+}
+
+// Framing of TCP messages
+type Framing uint8
+
+// Supported framings
+const (
+	FramingHTTP Framing = iota
+	// Messages start with 2-byte length, like DNS over TCP (RFC 1035, section 4.2.2)
+	FramingLengthPrefixed
+	// MySQL packets: 3-byte little endian length and sequence number. Each request is a separate command,
+	// and length of response depends on the command.
+	FramingMySQL
+	// PostgreSQL messages: type and 4-byte big endian length. Request is a batch of messages ending with Sync
+	// or simple query, and response ends with ReadyForQuery.
+	FramingPostgres
+	// Redis commands and replies in RESP. Each command, including inline one, is answered by single reply.
+	FramingRedis
+	// MongoDB messages: 4-byte little endian length followed by the rest of header. Each request is answered by
+	// single message, unless it has moreToCome flag.
+	FramingMongo
+	// FastCGI records: request ends with empty stdin record, and response ends with end request record
+	FramingFastCGI
+)
+
+// CaptureStats contains packet counters of a single capture worker
+type CaptureStats struct {
+	Worker int
+	// Captured interface, empty if worker captures all interfaces
+	Interface string
+	// Packets passed to TCP assembler
+	Packets uint64
+	// Packets seen by kernel after filtering
+	KernelPackets uint64
+	// Packets dropped by kernel because ring or socket buffer was full
+	KernelDrops uint64
+	// Packets dropped by network interface or its driver
+	InterfaceDrops uint64
+	// Share of ring occupied by packets waiting to be read, from 0 to 1
+	RingUsage float64
+	// Number of times ring was frozen due to lack of free blocks
+	FreezeCount uint64
+}
+
+// AssemblerStats contains counters of TCP assembler, shared by all capture workers of listener
+type AssemblerStats struct {
+	// Packets waiting for assembler, and capacity of their queue. Capture blocks when queue is full.
+	QueuedPackets   int
+	PacketsCapacity int
+	// Messages waiting to be read, and capacity of their queue
+	QueuedMessages   int
+	MessagesCapacity int
+	// Messages dropped because they exceeded StreamMemoryLimit
+	Oversized uint64
+	// Requests dispatched without response, because it was not captured before message expiration, and responses
+	// dropped because their request was not captured
+	Unanswered uint64
+	Orphans    uint64
+}
+
+// captureWorker is implemented by engines which can report their packet counters
+type captureWorker interface {
+	stats() CaptureStats
+}
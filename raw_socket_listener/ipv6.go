@@ -0,0 +1,71 @@
+package rawSocket
+
+import "encoding/binary"
+
+const (
+	ipv6HeaderSize = 40
+
+	// IPv6 extension headers which can precede TCP header
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6AuthHeader  = 51
+	ipv6NoNext      = 59
+	ipv6Destination = 60
+
+	ipv6FragmentHeaderSize = 8
+)
+
+func isIPv6ExtensionHeader(nextHeader uint8) bool {
+	switch nextHeader {
+	case ipv6HopByHop, ipv6Routing, ipv6Fragment, ipv6AuthHeader, ipv6Destination:
+		return true
+	}
+
+	return false
+}
+
+// ipv6Payload skips IPv6 header and extension headers, and returns upper layer protocol and its data.
+// Non-first fragments are skipped, since they have no upper layer header.
+func ipv6Payload(packet []byte) (proto uint8, payload []byte, ok bool) {
+	if len(packet) < ipv6HeaderSize {
+		return
+	}
+
+	// Zero length is used by jumbograms
+	if length := int(binary.BigEndian.Uint16(packet[4:6])); length > 0 {
+		if len(packet) < ipv6HeaderSize+length {
+			return
+		}
+		packet = packet[:ipv6HeaderSize+length]
+	}
+
+	proto, payload = packet[6], packet[ipv6HeaderSize:]
+
+	for isIPv6ExtensionHeader(proto) {
+		if len(payload) < 8 {
+			return 0, nil, false
+		}
+
+		var size int
+		switch proto {
+		case ipv6Fragment:
+			if binary.BigEndian.Uint16(payload[2:4])&0xfff8 != 0 {
+				return 0, nil, false
+			}
+			size = ipv6FragmentHeaderSize
+		case ipv6AuthHeader:
+			size = (int(payload[1]) + 2) * 4
+		default:
+			size = (int(payload[1]) + 1) * 8
+		}
+
+		if len(payload) < size {
+			return 0, nil, false
+		}
+
+		proto, payload = payload[0], payload[size:]
+	}
+
+	return proto, payload, proto != ipv6NoNext
+}
@@ -0,0 +1,73 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func buildIPv6Packet(nextHeader uint8, payload []byte) []byte {
+	ip := make([]byte, ipv6HeaderSize)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], uint16(len(payload)))
+	ip[6] = nextHeader
+	ip[7] = 64
+	ip[23], ip[39] = 1, 2
+	return append(ip, payload...)
+}
+
+func TestIPv6Payload(t *testing.T) {
+	tcp := []byte{0x1f, 0x90, 0x00, 0x50, 0, 0, 0, 1, 0, 0, 0, 2, 0x50, 0x18, 0, 0, 0, 0, 0, 0}
+	segment := append(tcp, []byte("GET / HTTP/1.1\r\n\r\n")...)
+
+	ext := func(next uint8, size int) []byte {
+		h := make([]byte, size)
+		h[0], h[1] = next, byte(size/8-1)
+		return h
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	fragment := []byte{ipProtoTCP, 0, 0, 0x01, 0, 0, 0, 1}
+	auth := make([]byte, 24)
+	auth[0], auth[1] = ipv6Destination, 4
+
+	cases := []struct {
+		name   string
+		packet []byte
+		ok     bool
+	}{
+		{"no extension headers", buildIPv6Packet(ipProtoTCP, segment), true},
+		{"hop-by-hop", buildIPv6Packet(ipv6HopByHop, join(ext(ipProtoTCP, 8), segment)), true},
+		{"destination options and routing", buildIPv6Packet(ipv6Destination, join(ext(ipv6Routing, 16), ext(ipProtoTCP, 24), segment)), true},
+		{"first fragment", buildIPv6Packet(ipv6Fragment, join(fragment, segment)), true},
+		{"authentication header", buildIPv6Packet(ipv6AuthHeader, join(auth, ext(ipProtoTCP, 8), segment)), true},
+		{"non-first fragment", buildIPv6Packet(ipv6Fragment, join([]byte{ipProtoTCP, 0, 0x05, 0xa8, 0, 0, 0, 1}, segment)), false},
+		{"no next header", buildIPv6Packet(ipv6HopByHop, join(ext(ipv6NoNext, 8), segment)), false},
+		{"truncated extension header", buildIPv6Packet(ipv6HopByHop, ext(ipProtoTCP, 16))[:ipv6HeaderSize+8], false},
+		{"truncated packet", buildIPv6Packet(ipProtoTCP, segment)[:ipv6HeaderSize+10], false},
+	}
+
+	for _, c := range cases {
+		proto, payload, ok := ipv6Payload(c.packet)
+		if ok != c.ok {
+			t.Errorf("%s: expected %v, got %v", c.name, c.ok, ok)
+			continue
+		}
+
+		if ok && (proto != ipProtoTCP || !bytes.Equal(payload, segment)) {
+			t.Errorf("%s: wrong payload %d %v", c.name, proto, payload)
+		}
+	}
+
+	srcIP, dstIP, data, ok := decodeIPPacket(cases[2].packet, ipProtoTCP)
+	if !ok || srcIP[15] != 1 || dstIP[15] != 2 || !bytes.Equal(data, segment) {
+		t.Error("Should decode IPv6 packet with extension headers")
+	}
+
+	l := &Listener{port: 80}
+	if _, _, _, ok := l.matchIPPacket(cases[1].packet, nil); !ok {
+		t.Error("Should match port of IPv6 packet with extension headers")
+	}
+}
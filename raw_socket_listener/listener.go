@@ -24,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buger/goreplay/proto"
@@ -37,12 +38,21 @@ var _ = fmt.Println
 
 type packet struct {
 	srcIP     []byte
+	dstIP     []byte
 	data      []byte
 	timestamp time.Time
+	// Pooled buffer holding addresses and data, nil if they are not pooled
+	buf *packetBuffer
 }
 
 // Listener handle traffic capture
 type Listener struct {
+	// Messages dropped because they exceeded StreamMemoryLimit, requests expired without response, and responses
+	// without request. Kept first to be 64-bit aligned for atomic access.
+	oversized  uint64
+	unanswered uint64
+	orphans    uint64
+
 	mu sync.Mutex
 	// buffer of TCPMessages waiting to be send
 	// ID -> TCPMessage
@@ -60,27 +70,41 @@ type Listener struct {
 	// Ack -> ID
 	respWithoutReq map[uint32]tcpID
 
+	// Requests of each TCP stream waiting for response, in order they were sent. Server answers pipelined requests
+	// in the same order, so response belongs to the oldest of them.
+	tcpRequests map[flowID][]*TCPMessage
+
+	// UDP requests waiting for response, in order they were received
+	udpRequests map[flowID][]*TCPMessage
+	udpSeq      uint32
+
 	// Messages ready to be send to client
 	packetsChan chan *packet
 
 	// Messages ready to be send to client
 	messagesChan chan *TCPMessage
 
-	addr string // IP to listen
-	port uint16 // Port to listen
+	addr  string      // IP, interface name or comma separated list of them to listen
+	port  uint16      // Port to listen, first port if listening on multiple ports
+	ports []portRange // Ports to listen, empty if listening on single port
 
 	trackResponse bool
 	messageExpire time.Duration
 
 	bpfFilter       string
+	packetFilter    packetMatcher
 	timestampType   string
 	overrideSnapLen bool
 	immediateMode   bool
 
 	bufferSize int64
 
+	engineConfig EngineConfig
+	defragmenter *ipDefragmenter
+
 	conn        net.PacketConn
 	pcapHandles []*pcap.Handle
+	workers     []captureWorker
 
 	quit    chan bool
 	readyCh chan bool
@@ -97,10 +121,13 @@ const (
 	EngineRawSocket = 1 << iota
 	EnginePcap
 	EnginePcapFile
+	EngineEBPF
+	EngineAFPacket
+	EngineXDP
 )
 
 // NewListener creates and initializes new Listener object
-func NewListener(addr string, port string, engine int, trackResponse bool, expire time.Duration, bpfFilter string, timestampType string, bufferSize int64, overrideSnapLen bool, immediateMode bool) (l *Listener) {
+func NewListener(addr string, port string, engine int, trackResponse bool, expire time.Duration, bpfFilter string, timestampType string, bufferSize int64, overrideSnapLen bool, immediateMode bool, engineConfig EngineConfig) (l *Listener) {
 	l = &Listener{}
 
 	l.packetsChan = make(chan *packet, 10000)
@@ -113,16 +140,35 @@ func NewListener(addr string, port string, engine int, trackResponse bool, expir
 	l.seqWithData = make(map[uint32]uint32)
 	l.respAliases = make(map[uint32]*TCPMessage)
 	l.respWithoutReq = make(map[uint32]tcpID)
+	l.tcpRequests = make(map[flowID][]*TCPMessage)
+	l.udpRequests = make(map[flowID][]*TCPMessage)
 	l.trackResponse = trackResponse
 	l.bpfFilter = bpfFilter
 	l.timestampType = timestampType
 	l.immediateMode = immediateMode
 	l.bufferSize = bufferSize
 	l.overrideSnapLen = overrideSnapLen
+	l.engineConfig = engineConfig
+	l.defragmenter = newIPDefragmenter(engineConfig.DefragMemoryLimit)
+
+	// Engines running own kernel filter apply custom expression in user space
+	if bpfFilter != "" && engine&(EngineEBPF|EngineAFPacket|EngineXDP) != 0 {
+		filter, err := pcap.NewBPF(linkTypeRawIP, 65536, bpfFilter)
+		if err != nil {
+			log.Fatal("BPF filter error:", err)
+		}
+		l.packetFilter = filter
+	}
 
 	l.addr = addr
-	_port, _ := strconv.Atoi(port)
-	l.port = uint16(_port)
+	ports, err := parsePorts(port)
+	if err != nil {
+		log.Fatal("Can't parse listening port: ", err)
+	}
+	l.port = ports[0].min
+	if len(ports) > 1 || ports[0].min != ports[0].max {
+		l.ports = ports
+	}
 
 	if expire.Nanoseconds() == 0 {
 		expire = 2000 * time.Millisecond
@@ -130,6 +176,15 @@ func NewListener(addr string, port string, engine int, trackResponse bool, expir
 
 	l.messageExpire = expire
 
+	if engineConfig.IsolateCaptureCPUs && len(engineConfig.CaptureCPUs) > 0 {
+		// Listeners share CPUs given by the same option, so threads are moved before the first one starts capture
+		isolateOnce.Do(func() {
+			if err := isolateThreads(engineConfig.CaptureCPUs); err != nil {
+				log.Println("Can't isolate capture CPUs:", err)
+			}
+		})
+	}
+
 	go l.listen()
 
 	// Special case for testing
@@ -139,6 +194,12 @@ func NewListener(addr string, port string, engine int, trackResponse bool, expir
 			go l.readPcap()
 		case EnginePcapFile:
 			go l.readPcapFile()
+		case EngineEBPF:
+			go l.readEBPF()
+		case EngineAFPacket:
+			go l.readAFPacket()
+		case EngineXDP:
+			go l.readXDP()
 		default:
 			log.Fatal("Unknown traffic interception engine:", engine)
 		}
@@ -147,6 +208,23 @@ func NewListener(addr string, port string, engine int, trackResponse bool, expir
 	return
 }
 
+var isolateOnce sync.Once
+
+// pinCaptureThread locks goroutine of capture worker to its OS thread, and pins thread to one of CaptureCPUs. Thread
+// is not reused by other goroutines, since it exits together with locked goroutine.
+func (t *Listener) pinCaptureThread(worker int) {
+	cpus := t.engineConfig.CaptureCPUs
+	if len(cpus) == 0 {
+		return
+	}
+
+	runtime.LockOSThread()
+	cpu := cpus[worker%len(cpus)]
+	if err := setThreadAffinity(0, []int{cpu}); err != nil {
+		log.Printf("Can't pin capture worker %d to CPU %d: %v\n", worker, cpu, err)
+	}
+}
+
 func (t *Listener) listen() {
 	gcTicker := time.Tick(t.messageExpire / 2)
 
@@ -158,23 +236,147 @@ func (t *Listener) listen() {
 			}
 			return
 		case packet := <-t.packetsChan:
+			if t.engineConfig.UDP {
+				t.processUDPPacket(packet)
+				continue
+			}
+
 			tcpPacket := ParseTCPPacket(packet.srcIP, packet.data, packet.timestamp)
+			tcpPacket.DstAddr = packet.dstIP
+			tcpPacket.buf = packet.buf
 			t.processTCPPacket(tcpPacket)
 		case <-gcTicker:
 			now := time.Now()
+			t.expireUDPRequests(now)
 
-			// Dispatch requests before responses
+			var expired []*TCPMessage
 			for _, message := range t.messages {
-				if now.Sub(message.End) >= t.messageExpire {
-					t.dispatchMessage(message)
+				for ; message != nil; message = message.next {
+					if now.Sub(message.End) >= t.messageExpire {
+						expired = append(expired, message)
+					}
 				}
 			}
+
+			for _, message := range expired {
+				t.dispatchMessage(message)
+			}
+		}
+	}
+}
+
+// Pipelined messages of the same TCP stream have the same ID, so they are linked into list starting from the map entry
+func (t *Listener) unlinkMessage(message *TCPMessage) {
+	id := message.ID()
+	head, ok := t.messages[id]
+	if !ok {
+		return
+	}
+
+	if head == message {
+		if message.next != nil {
+			t.messages[id] = message.next
+		} else {
+			delete(t.messages, id)
+		}
+	} else {
+		for m := head; m.next != nil; m = m.next {
+			if m.next == message {
+				m.next = message.next
+				break
+			}
+		}
+	}
+
+	message.next = nil
+}
+
+// isPending checks that message is not dispatched yet
+func (t *Listener) isPending(message *TCPMessage) bool {
+	for m := t.messages[message.ID()]; m != nil; m = m.next {
+		if m == message {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findResponse returns response with given ID, which is not associated with other request
+func (t *Listener) findResponse(id tcpID, req *TCPMessage) (*TCPMessage, bool) {
+	for m := t.messages[id]; m != nil; m = m.next {
+		if m.AssocMessage == nil || m.AssocMessage == req {
+			return m, true
+		}
+	}
+
+	return nil, false
+}
+
+// firstUnanswered returns the earliest pipelined request without response. Server answers pipelined requests in order,
+// but its responses can acknowledge all of them at once.
+func (t *Listener) firstUnanswered(req *TCPMessage) *TCPMessage {
+	for m := t.messages[req.ID()]; m != nil && m != req; m = m.next {
+		if m.AssocMessage == nil {
+			return m
 		}
 	}
+
+	return req
+}
+
+// deleteRespAlias removes request alias used by the response. Responses to pipelined requests can have the same Ack,
+// so alias is kept if it points to another request without response.
+func (t *Listener) deleteRespAlias(resp *TCPMessage) {
+	if req, ok := t.respAliases[resp.Ack]; ok && resp.AssocMessage != nil && req != resp.AssocMessage && req.AssocMessage == nil {
+		return
+	}
+
+	delete(t.respAliases, resp.Ack)
+}
+
+// queueRequest remembers new request waiting for response in stream of its first packet
+func (t *Listener) queueRequest(req *TCPMessage, packet *TCPPacket) {
+	id := packetStream(packet, true)
+	t.tcpRequests[id] = append(t.tcpRequests[id], req)
+}
+
+// unqueueRequest forgets request which got response, or is dispatched
+func (t *Listener) unqueueRequest(req *TCPMessage) {
+	id := req.stream()
+	requests := t.tcpRequests[id]
+	for i, m := range requests {
+		if m == req {
+			requests = append(requests[:i:i], requests[i+1:]...)
+			break
+		}
+	}
+
+	if len(requests) == 0 {
+		delete(t.tcpRequests, id)
+	} else {
+		t.tcpRequests[id] = requests
+	}
+}
+
+// streamRequest returns the oldest request of response stream without response, which server received before
+// sending the response. Unlike Ack aliases, it does not require response to acknowledge the whole request, and is
+// not confused by other streams with the same sequence numbers.
+func (t *Listener) streamRequest(resp *TCPPacket) *TCPMessage {
+	for _, req := range t.tcpRequests[packetStream(resp, false)] {
+		if req.AssocMessage == nil && seqLess(req.Seq, resp.Ack) {
+			return req
+		}
+	}
+
+	return nil
 }
 
 func (t *Listener) deleteMessage(message *TCPMessage) {
-	delete(t.messages, message.ID())
+	t.unlinkMessage(message)
+	if message.IsIncoming {
+		t.unqueueRequest(message)
+	}
 	delete(t.ackAliases, message.Ack)
 	if message.DataAck != 0 {
 		delete(t.ackAliases, message.DataAck)
@@ -188,16 +390,29 @@ func (t *Listener) deleteMessage(message *TCPMessage) {
 
 func (t *Listener) dispatchMessage(message *TCPMessage) {
 	// If already dispatched
-	if _, ok := t.messages[message.ID()]; !ok {
+	if !t.isPending(message) {
 		return
 	}
 
+	// Pipelined data could be added before message became complete
+	rest := message.splitPipelined()
+	defer func() {
+		for _, p := range rest {
+			t.processTCPPacket(p)
+		}
+	}()
+
 	t.deleteMessage(message)
 
 	if !message.complete {
 		if !message.IsIncoming {
-			delete(t.respAliases, message.Ack)
+			t.deleteRespAlias(message)
 			delete(t.respWithoutReq, message.Ack)
+
+			// Responses are not complete until request is found
+			if message.AssocMessage == nil {
+				atomic.AddUint64(&t.orphans, 1)
+			}
 		}
 
 		return
@@ -208,7 +423,7 @@ func (t *Listener) dispatchMessage(message *TCPMessage) {
 		// log.Println("Looking for Response: ", t.respWithoutReq, message.ResponseAck)
 		if t.trackResponse {
 			if respID, ok := t.respWithoutReq[message.ResponseAck]; ok {
-				if resp, rok := t.messages[respID]; rok {
+				if resp, rok := t.findResponse(respID, message); rok && resp.stream() == message.stream() {
 					// if resp.AssocMessage == nil {
 					// log.Println("FOUND RESPONSE")
 					resp.setAssocMessage(message)
@@ -221,9 +436,13 @@ func (t *Listener) dispatchMessage(message *TCPMessage) {
 				}
 			}
 
-			if resp, ok := t.messages[message.ResponseID]; ok {
+			if resp, ok := t.findResponse(message.ResponseID, message); ok {
 				resp.setAssocMessage(message)
 			}
+
+			if message.AssocMessage == nil && message.expectsResponse() {
+				atomic.AddUint64(&t.unanswered, 1)
+			}
 		}
 	} else {
 		if message.AssocMessage == nil {
@@ -233,12 +452,12 @@ func (t *Listener) dispatchMessage(message *TCPMessage) {
 			}
 		}
 
-		delete(t.respAliases, message.Ack)
+		t.deleteRespAlias(message)
 		delete(t.respWithoutReq, message.Ack)
 
 		// Do not track responses which have no associated requests
 		if message.AssocMessage == nil {
-			// log.Println("Can't dispatch resp", message.Seq, message.Ack, string(message.Bytes()))
+			atomic.AddUint64(&t.orphans, 1)
 			return
 		}
 	}
@@ -307,10 +526,16 @@ func findPcapDevices(addr string) (interfaces []pcap.Interface, err error) {
 			continue
 		}
 
+		// Devices without addresses, e.g. host side of container veth pair, can be matched only by name
+		var ips []net.IP
 		for _, address := range device.Addresses {
-			if device.Name == addr || address.IP.String() == addr {
+			ips = append(ips, address.IP)
+		}
+
+		for _, a := range strings.Split(addr, ",") {
+			if matchAddress(a, device.Name, ips) {
 				interfaces = append(interfaces, device)
-				return interfaces, nil
+				break
 			}
 		}
 	}
@@ -336,8 +561,10 @@ func (t *Listener) readPcap() {
 	var wg sync.WaitGroup
 	wg.Add(len(devices))
 
-	for _, d := range devices {
-		go func(device pcap.Interface) {
+	for i, d := range devices {
+		go func(id int, device pcap.Interface) {
+			t.pinCaptureThread(id)
+
 			inactive, err := pcap.NewInactiveHandle(device.Name)
 			if err != nil {
 				log.Println("Pcap Error while opening device", device.Name, err)
@@ -406,25 +633,51 @@ func (t *Listener) readPcap() {
 				}
 			}
 
-			if bpfSupported {
+			if t.bpfFilter != "" {
+				if err := handle.SetBPFFilter(t.bpfFilter); err != nil {
+					log.Println("BPF filter error:", err, "Device:", device.Name, t.bpfFilter)
+					t.mu.Unlock()
+					wg.Done()
+					return
+				}
+			} else if bpfSupported {
 				var bpf string
 
 				if t.trackResponse {
-					bpf = "(tcp dst port " + strconv.Itoa(int(t.port)) + " and (" + bpfDstHost + ")) or (" + "tcp src port " + strconv.Itoa(int(t.port)) + " and (" + bpfSrcHost + "))"
+					bpf = "(" + t.pcapPortFilter("dst") + " and (" + bpfDstHost + ")) or (" + t.pcapPortFilter("src") + " and (" + bpfSrcHost + "))"
 				} else {
-					bpf = "tcp dst port " + strconv.Itoa(int(t.port)) + " and (" + bpfDstHost + ")"
+					bpf = t.pcapPortFilter("dst") + " and (" + bpfDstHost + ")"
+				}
+
+				// `tcp port` matches IPv6 packets only if TCP header directly follows IPv6 header,
+				// so packets with extension headers are checked in user space
+				bpf = "(" + bpf + ") or (ip6 and (ip6[6] == 0 or ip6[6] == 43 or ip6[6] == 44 or ip6[6] == 51 or ip6[6] == 60))"
+
+				// Tunneled packets are checked after decapsulation
+				fragmentProtos := "ip proto " + strconv.Itoa(int(t.transportProtocol()))
+				if vxlanPort := t.tunnelPort(); vxlanPort != 0 {
+					bpf = "(" + bpf + ") or (udp dst port " + strconv.Itoa(int(vxlanPort)) + ") or (ip proto 47) or (ip6 proto 47)"
+					fragmentProtos = "(" + fragmentProtos + " or ip proto 17 or ip proto 47)"
 				}
 
-				if t.bpfFilter != "" {
-					bpf = t.bpfFilter
+				// Only first fragment has ports, so fragments are checked after reassembly
+				bpf = "(" + bpf + ") or (ip[6:2] & 0x3fff != 0 and " + fragmentProtos + ")"
+
+				// Frames from trunk and SPAN ports can have VLAN and QinQ tags. Since `vlan` keyword shifts offsets
+				// for the rest of expression, expressions for inner tags should be nested.
+				if handle.LinkType() == layers.LinkTypeEthernet {
+					bpf = "(" + bpf + ") or (vlan and ((" + bpf + ") or (vlan and (" + bpf + "))))"
 				}
 
 				if err := handle.SetBPFFilter(bpf); err != nil {
 					log.Println("BPF filter error:", err, "Device:", device.Name, bpf)
+					t.mu.Unlock()
 					wg.Done()
 					return
 				}
 			}
+			worker := &pcapWorker{id: id, device: device.Name, handle: handle}
+			t.workers = append(t.workers, worker)
 			t.mu.Unlock()
 
 			var decoder gopacket.Decoder
@@ -436,16 +689,15 @@ func (t *Listener) readPcap() {
 				decoder = handle.LinkType()
 			}
 
-			source := gopacket.NewPacketSource(handle, decoder)
-			source.Lazy = true
-			source.NoCopy = true
-
 			wg.Done()
 
 			var data, srcIP, dstIP []byte
+			var tunneled bool
+			vxlanPort := t.tunnelPort()
 
 			for {
-				packet, err := source.NextPacket()
+				// Packet data is valid until the next read, so it is copied into pooled buffer
+				packetData, ci, err := handle.ZeroCopyReadPacketData()
 
 				if err == io.EOF {
 					break
@@ -471,12 +723,47 @@ func (t *Listener) readPcap() {
 				case layers.LinkTypeLinuxSLL:
 					of = 16
 				default:
-					log.Println("Unknown packet layer", decoder, packet)
+					log.Println("Unknown packet layer", decoder)
 					break
 				}
 
-				data = packet.Data()[of:]
+				var ok, fragmented bool
+				if decoder == layers.LinkTypeEthernet {
+					if data, ok = ethernetPayload(packetData, t.engineConfig.VLANs); !ok {
+						continue
+					}
+				} else if len(packetData) >= of {
+					data = packetData[of:]
+				} else {
+					continue
+				}
+
+				// Datagrams are complete messages, so generic path is enough for them
+				if t.engineConfig.UDP {
+					if srcIP, dstIP, data, ok = t.matchIPPacket(data, nil); ok {
+						t.packetsChan <- t.copyPacket(srcIP, dstIP, data, ci.Timestamp)
+						atomic.AddUint64(&worker.packets, 1)
+					}
+					continue
+				}
+
+				if data, fragmented, ok = t.defragmenter.defragment(data); !ok {
+					continue
+				}
 
+				if vxlanPort != 0 {
+					var inner []byte
+					if inner, tunneled = decapsulate(data, vxlanPort); tunneled {
+						if data, _, ok = t.defragmenter.defragment(inner); !ok {
+							continue
+						}
+					} else if proto, _, ok := ipPayload(data); !ok || proto != ipProtoTCP {
+						// Malformed tunnel packet passed by BPF filter
+						continue
+					}
+				}
+
+				extensionHeaders := false
 				version := uint8(data[0]) >> 4
 				ipLength := int(binary.BigEndian.Uint16(data[2:4]))
 
@@ -510,15 +797,17 @@ func (t *Listener) readPcap() {
 
 					data = data[ihl*4:]
 				} else {
-					// Truncated IP info
-					if len(data) < 40 {
+					proto, payload, ok := ipv6Payload(data)
+					if !ok || proto != ipProtoTCP {
 						continue
 					}
 
+					extensionHeaders = data[6] != ipProtoTCP
+
 					srcIP = data[8:24]
 					dstIP = data[24:40]
 
-					data = data[40:]
+					data = payload
 				}
 
 				// Truncated TCP info
@@ -532,17 +821,19 @@ func (t *Listener) readPcap() {
 				// We need only packets with data inside
 				// Check that the buffer is larger than the size of the TCP header
 				if len(data) > int(dataOffset*4) || isFIN {
-					if !bpfSupported {
+					// BPF filter can't check ports of tunneled, fragmented packets and packets with IPv6 extension headers.
+					// Custom filter can select packets of other ports.
+					if !bpfSupported || tunneled || fragmented || extensionHeaders || t.bpfFilter != "" {
 						destPort := binary.BigEndian.Uint16(data[2:4])
 						srcPort := binary.BigEndian.Uint16(data[0:2])
 
 						var addrCheck []byte
 
-						if destPort == t.port {
+						if t.isListenPort(destPort) {
 							addrCheck = dstIP
 						}
 
-						if t.trackResponse && srcPort == t.port {
+						if t.trackResponse && t.isListenPort(srcPort) {
 							addrCheck = srcIP
 						}
 
@@ -550,7 +841,8 @@ func (t *Listener) readPcap() {
 							continue
 						}
 
-						addrMatched := false
+						// Inner addresses of mirrored traffic belong to remote hosts
+						addrMatched := tunneled
 
 						if loopback {
 							for _, dc := range devices {
@@ -579,10 +871,11 @@ func (t *Listener) readPcap() {
 						}
 					}
 
-					t.packetsChan <- t.buildPacket(srcIP, data, packet.Metadata().Timestamp)
+					t.packetsChan <- t.copyPacket(srcIP, dstIP, data, ci.Timestamp)
+					atomic.AddUint64(&worker.packets, 1)
 				}
 			}
-		}(d)
+		}(i, d)
 	}
 
 	wg.Wait()
@@ -612,13 +905,35 @@ func (t *Listener) readPcapFile() {
 				continue
 			}
 
-			var addr, data []byte
+			// Fragments are decoded without transport layer, so they should be reassembled first
+			if ip := packet.NetworkLayer(); ip != nil {
+				ipData, fragmented, ok := t.defragmenter.defragment(append(ip.LayerContents(), ip.LayerPayload()...))
+				if !ok {
+					continue
+				}
+
+				if fragmented {
+					packet = gopacket.NewPacket(ipData, ip.LayerType(), gopacket.Default)
+				}
+			}
+
+			var addr, dstAddr, data []byte
 
-			if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+			if t.engineConfig.UDP {
+				if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
+					udp, _ := udpLayer.(*layers.UDP)
+					if !t.isListenPort(uint16(udp.DstPort)) && !(t.trackResponse && t.isListenPort(uint16(udp.SrcPort))) {
+						continue
+					}
+					data = append(udp.LayerContents(), udp.LayerPayload()...)
+				} else {
+					continue
+				}
+			} else if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
 				tcp, _ := tcpLayer.(*layers.TCP)
 				data = append(tcp.LayerContents(), tcp.LayerPayload()...)
 
-				if uint16(tcp.DstPort) == t.port {
+				if t.isListenPort(uint16(tcp.DstPort)) {
 					copy(data[0:2], []byte{byte(tcp.SrcPort >> 8), byte(tcp.SrcPort)})
 					copy(data[2:4], []byte{byte(tcp.DstPort >> 8), byte(tcp.DstPort)})
 				} else {
@@ -631,15 +946,20 @@ func (t *Listener) readPcapFile() {
 
 			if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
 				ip, _ := ipLayer.(*layers.IPv4)
-				addr = ip.SrcIP
+				addr, dstAddr = ip.SrcIP, ip.DstIP
 			} else if ipLayer = packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
 				ip, _ := ipLayer.(*layers.IPv6)
-				addr = ip.SrcIP
+				addr, dstAddr = ip.SrcIP, ip.DstIP
 			} else {
 				// log.Println("Can't find IP layer", packet)
 				continue
 			}
 
+			if t.engineConfig.UDP {
+				t.packetsChan <- t.buildPacket(addr, dstAddr, data, packet.Metadata().Timestamp)
+				continue
+			}
+
 			dataOffset := (data[12] & 0xF0) >> 4
 			isFIN := data[13]&0x01 != 0
 
@@ -649,13 +969,18 @@ func (t *Listener) readPcapFile() {
 				continue
 			}
 
-			t.packetsChan <- t.buildPacket(addr, data, packet.Metadata().Timestamp)
+			t.packetsChan <- t.buildPacket(addr, dstAddr, data, packet.Metadata().Timestamp)
 		}
 	}
 }
 
 func (t *Listener) readRAWSocket() {
-	conn, e := net.ListenPacket("ip:tcp", t.addr)
+	network := "ip:tcp"
+	if ip := net.ParseIP(t.addr); ip != nil && ip.To4() == nil && !listenAllInterfaces(t.addr) {
+		network = "ip6:tcp"
+	}
+
+	conn, e := net.ListenPacket(network, t.addr)
 	t.conn = conn
 
 	if e != nil {
@@ -682,15 +1007,16 @@ func (t *Listener) readRAWSocket() {
 
 		if n > 0 {
 			if t.isValidPacket(buf[:n]) {
-				t.packetsChan <- t.buildPacket([]byte(addr.(*net.IPAddr).IP), buf[:n], time.Now())
+				t.packetsChan <- t.copyPacket(addr.(*net.IPAddr).IP, nil, buf[:n], time.Now())
 			}
 		}
 	}
 }
 
-func (t *Listener) buildPacket(packetSrcIP []byte, packetData []byte, timestamp time.Time) *packet {
+func (t *Listener) buildPacket(packetSrcIP []byte, packetDstIP []byte, packetData []byte, timestamp time.Time) *packet {
 	return &packet{
 		srcIP:     packetSrcIP,
+		dstIP:     packetDstIP,
 		data:      packetData,
 		timestamp: timestamp,
 	}
@@ -703,7 +1029,7 @@ func (t *Listener) isValidPacket(buf []byte) bool {
 	srcPort := binary.BigEndian.Uint16(buf[0:2])
 
 	// Because RAW_SOCKET can't be bound to port, we have to control it by ourself
-	if destPort == t.port || (t.trackResponse && srcPort == t.port) {
+	if t.isListenPort(destPort) || (t.trackResponse && t.isListenPort(srcPort)) {
 		// Get the 'data offset' (size of the TCP header in 32-bit words)
 		dataOffset := (buf[12] & 0xF0) >> 4
 
@@ -721,6 +1047,20 @@ func (t *Listener) isValidPacket(buf []byte) bool {
 // Trying to add packet to existing message or creating new message
 //
 // For TCP message unique id is Acknowledgment number (see tcp_packet.go)
+// dispatchSegment passes segment with data as complete message, see EngineConfig.RawSegments
+func (t *Listener) dispatchSegment(packet *TCPPacket, isIncoming bool) {
+	if len(packet.Data) == 0 {
+		return
+	}
+
+	message := NewTCPMessage(packet.Seq, packet.Ack, isIncoming, packet.timestamp)
+	message.packets = []*TCPPacket{packet}
+	message.End = packet.timestamp
+	message.complete = true
+
+	t.messagesChan <- message
+}
+
 func (t *Listener) processTCPPacket(packet *TCPPacket) {
 	// Don't exit on panic
 	defer func() {
@@ -732,7 +1072,12 @@ func (t *Listener) processTCPPacket(packet *TCPPacket) {
 	var responseRequest *TCPMessage
 	var message *TCPMessage
 
-	isIncoming := packet.DestPort == t.port
+	isIncoming := t.isListenPort(packet.DestPort)
+
+	if t.engineConfig.RawSegments {
+		t.dispatchSegment(packet, isIncoming)
+		return
+	}
 
 	if !isIncoming {
 		responseRequest, _ = t.respAliases[packet.Ack]
@@ -783,14 +1128,48 @@ func (t *Listener) processTCPPacket(packet *TCPPacket) {
 
 	message, ok := t.messages[packet.ID]
 
+	// Pipelined messages have the same ID, so data following complete message belongs to the next one
+	var prev *TCPMessage
+	for ok && message.complete && !seqLess(packet.Seq, message.nextSeq()) {
+		if message.next == nil {
+			if len(packet.Data) > 0 {
+				prev, ok = message, false
+			}
+			break
+		}
+		message = message.next
+	}
+
 	if !ok {
 		message = NewTCPMessage(packet.Seq, packet.Ack, isIncoming, packet.timestamp)
-		t.messages[packet.ID] = message
+		message.framing = t.engineConfig.Framing
+		message.responseTracked = t.trackResponse
+		if prev != nil {
+			prev.next = message
+		} else {
+			t.messages[packet.ID] = message
+		}
+
+		if isIncoming {
+			if t.trackResponse {
+				t.queueRequest(message, packet)
+			}
+		} else {
+			// Ack alias of another stream can have the same sequence numbers
+			if responseRequest != nil && responseRequest.stream() != packetStream(packet, false) {
+				responseRequest = nil
+			}
+
+			if responseRequest != nil {
+				responseRequest = t.firstUnanswered(responseRequest)
+			} else {
+				responseRequest = t.streamRequest(packet)
+			}
 
-		if !isIncoming {
 			if responseRequest != nil {
 				message.setAssocMessage(responseRequest)
 				responseRequest.setAssocMessage(message)
+				t.unqueueRequest(responseRequest)
 			} else {
 				t.respWithoutReq[packet.Ack] = packet.ID
 			}
@@ -838,6 +1217,21 @@ func (t *Listener) processTCPPacket(packet *TCPPacket) {
 		message.DataSeq = seq
 	}
 
+	if limit := t.engineConfig.StreamMemoryLimit; limit > 0 && message.bufferedSize > limit {
+		atomic.AddUint64(&t.oversized, 1)
+		message.complete = false
+		t.dispatchMessage(message)
+		return
+	}
+
+	// Single segment can contain end of one pipelined request and beginning of the next one
+	rest := message.splitPipelined()
+	defer func() {
+		for _, p := range rest {
+			t.processTCPPacket(p)
+		}
+	}()
+
 	if isIncoming {
 		// If message have multiple packets, delete previous alias
 		if len(message.packets) > 1 {
@@ -852,10 +1246,10 @@ func (t *Listener) processTCPPacket(packet *TCPPacket) {
 	if message.complete {
 		// log.Println("COMPLETE!", isIncoming, message)
 		if isIncoming {
-			if t.trackResponse {
+			if t.trackResponse && message.expectsResponse() {
 				// log.Println("Found response!", message.ResponseID, t.messages)
 
-				if resp, ok := t.messages[message.ResponseID]; ok {
+				if resp, ok := t.findResponse(message.ResponseID, message); ok {
 					if resp.complete {
 						t.dispatchMessage(resp)
 					}
@@ -870,7 +1264,7 @@ func (t *Listener) processTCPPacket(packet *TCPPacket) {
 				return
 			}
 
-			if req, ok := t.messages[message.AssocMessage.ID()]; ok {
+			if req := message.AssocMessage; t.isPending(req) {
 				if req.complete {
 					t.dispatchMessage(req)
 					t.dispatchMessage(message)
@@ -889,6 +1283,39 @@ func (t *Listener) IsReady() bool {
 	}
 }
 
+// Stats returns packet counters of capture workers: libpcap devices, eBPF socket, AF_PACKET sockets or AF_XDP queues.
+// Raw socket engine and pcap files do not report them.
+func (t *Listener) Stats() (stats []CaptureStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Handles and sockets are released once listener is closed
+	select {
+	case <-t.quit:
+		return nil
+	default:
+	}
+
+	for _, w := range t.workers {
+		stats = append(stats, w.stats())
+	}
+
+	return
+}
+
+// AssemblerStats returns queue lengths and dropped messages of TCP assembler
+func (t *Listener) AssemblerStats() AssemblerStats {
+	return AssemblerStats{
+		QueuedPackets:    len(t.packetsChan),
+		PacketsCapacity:  cap(t.packetsChan),
+		QueuedMessages:   len(t.messagesChan),
+		MessagesCapacity: cap(t.messagesChan),
+		Oversized:        atomic.LoadUint64(&t.oversized),
+		Unanswered:       atomic.LoadUint64(&t.unanswered),
+		Orphans:          atomic.LoadUint64(&t.orphans),
+	}
+}
+
 // Receiver TCP messages from the listener channel
 func (t *Listener) Receiver() chan *TCPMessage {
 	return t.messagesChan
@@ -896,7 +1323,10 @@ func (t *Listener) Receiver() chan *TCPMessage {
 
 // Close tcp listener
 func (t *Listener) Close() {
+	t.mu.Lock()
 	close(t.quit)
+	t.mu.Unlock()
+
 	if t.conn != nil {
 		t.conn.Close()
 	}
@@ -7,12 +7,15 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/buger/goreplay/fastcgi"
+	"github.com/buger/goreplay/mongo"
 )
 
 func TestRawListenerInput(t *testing.T) {
 	var req, resp *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"), time.Now())
@@ -77,7 +80,7 @@ func responsePacket(prev *TCPPacket, payload []byte) *TCPPacket {
 }
 
 func TestHEADRequestNoBody(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	reqPacket := firstPacket([]byte("HEAD / HTTP/1.1\r\nContent-Length: 0\r\n\r\n"))
@@ -111,7 +114,7 @@ func TestHEADRequestNoBody(t *testing.T) {
 }
 
 func TestSingleAck100Continue(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	reqPacket1 := firstPacket([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"))
@@ -130,7 +133,7 @@ func TestSingleAck100Continue(t *testing.T) {
 }
 
 func Test100ContinueWithoutWaiting(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	req1 := firstPacket([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"))
@@ -146,7 +149,7 @@ func Test100ContinueWithoutWaiting(t *testing.T) {
 
 // Client first sends data without waiting 100-continue, but once response received, generate packets based on Ack payload
 func Test100ContinueMixed(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	req1 := firstPacket([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 12\r\n\r\n"))
@@ -164,7 +167,7 @@ func Test100ContinueMixed(t *testing.T) {
 }
 
 func TestDoubleAck100Continue(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	reqPacket1 := firstPacket([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"))
@@ -187,7 +190,7 @@ func TestDoubleAck100Continue(t *testing.T) {
 func TestRawListenerInputResponseByClose(t *testing.T) {
 	var req, resp *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"), time.Now())
@@ -227,7 +230,7 @@ func TestRawListenerInputResponseByClose(t *testing.T) {
 func TestRawListenerInputWithoutResponse(t *testing.T) {
 	var req *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, false, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, false, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"), time.Now())
@@ -249,7 +252,7 @@ func TestRawListenerInputWithoutResponse(t *testing.T) {
 func TestRawListenerResponse(t *testing.T) {
 	var req, resp *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	reqPacket := firstPacket([]byte("GET / HTTP/1.1\r\n\r\n"))
@@ -297,7 +300,7 @@ func get100ContinuePackets() (req []*TCPPacket, resp []*TCPPacket) {
 }
 
 func TestShort100Continue(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	req, resp := get100ContinuePackets()
@@ -309,7 +312,7 @@ func TestShort100Continue(t *testing.T) {
 
 // Response comes before Request
 func Test100ContinueWrongOrder(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	req, resp := get100ContinuePackets()
@@ -462,7 +465,7 @@ func permutation(n int, list []*TCPPacket) []*TCPPacket {
 
 // Response comes before Request
 func TestRawListenerChunkedWrongOrder(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	reqPacket1 := firstPacket([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nExpect: 100-continue\r\n\r\n"))
@@ -532,7 +535,7 @@ func getMessage() []*TCPPacket {
 
 // Response comes before Request
 func TestRawListenerBench(t *testing.T) {
-	l := NewListener("", "0", EnginePcap, true, 200*time.Millisecond, "", "", 0, false, false)
+	l := NewListener("", "0", EnginePcap, true, 200*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer l.Close()
 
 	// Should re-construct message from all possible combinations
@@ -583,7 +586,7 @@ func TestRawListenerBench(t *testing.T) {
 
 func TestResponseZeroContentLength(t *testing.T) {
 	var req, resp *TCPMessage
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
 	defer listener.Close()
 
 	reqPacket := firstPacket([]byte("POST /api/setup/install HTTP/1.1\r\nHost: localhost:22936\r\nUser-Agent: curl/7.57.0\r\nAccept: */*\r\nContent-Length: 0\r\nContent-Type: application/x-www-form-urlencoded\r\n\r\n"))
@@ -621,3 +624,466 @@ func TestResponseZeroContentLength(t *testing.T) {
 		t.Error("Resp and Req UUID should be equal")
 	}
 }
+
+func TestChunkedBodyBoundaries(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, false, 50*time.Millisecond, "", "", 0, false, false, EngineConfig{})
+	defer listener.Close()
+
+	// Chunk data looks like last chunk, and last chunk with trailers is split between packets
+	packet := firstPacket([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n"))
+	packets := []*TCPPacket{packet}
+	for _, data := range []string{"5\r\n0\r\n\r\n\r\n", "0\r", "\nX-Sum: 1\r\n", "\r\n"} {
+		packet = nextPacket(packet, []byte(data))
+		packets = append(packets, packet)
+	}
+
+	var expected []byte
+	for i, p := range packets {
+		expected = append(expected, p.Data...)
+		listener.packetsChan <- p.dump()
+
+		select {
+		case msg := <-listener.messagesChan:
+			if i != len(packets)-1 {
+				t.Fatalf("Should not emit incomplete message after packet %d: %q", i, msg.Bytes())
+			}
+
+			if !bytes.Equal(msg.Bytes(), expected) {
+				t.Errorf("Wrong message %q", msg.Bytes())
+			}
+		case <-time.After(5 * time.Millisecond):
+			if i == len(packets)-1 {
+				t.Error("Should emit message after trailers received")
+			}
+		}
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
+	defer listener.Close()
+
+	reqPacket := firstPacket([]byte("GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\n"))
+	respPacket := responsePacket(reqPacket, []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na"))
+	respPacket2 := nextPacket(respPacket, []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb"))
+
+	listener.packetsChan <- reqPacket.dump()
+	listener.packetsChan <- respPacket.dump()
+	listener.packetsChan <- respPacket2.dump()
+
+	var messages []*TCPMessage
+	for i := 0; i < 4; i++ {
+		select {
+		case msg := <-listener.messagesChan:
+			messages = append(messages, msg)
+		case <-time.After(20 * time.Millisecond):
+			t.Fatalf("Should return 4 messages, got %d", len(messages))
+		}
+	}
+
+	expected := []string{
+		"GET /a HTTP/1.1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na",
+		"GET /b HTTP/1.1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb",
+	}
+	for i, msg := range messages {
+		if string(msg.Bytes()) != expected[i] {
+			t.Errorf("Wrong message %d: %q", i, msg.Bytes())
+		}
+	}
+
+	if !bytes.Equal(messages[0].UUID(), messages[1].UUID()) || !bytes.Equal(messages[2].UUID(), messages[3].UUID()) {
+		t.Error("Responses should have UUID of their requests")
+	}
+
+	if bytes.Equal(messages[0].UUID(), messages[2].UUID()) {
+		t.Error("Pipelined requests should have different UUIDs")
+	}
+}
+
+func TestStreamMemoryLimit(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{StreamMemoryLimit: 100})
+	defer listener.Close()
+
+	packets := []*TCPPacket{firstPacket([]byte("POST / HTTP/1.1\r\nContent-Length: 200\r\n\r\n"))}
+	for i := 0; i < 4; i++ {
+		packets = append(packets, nextPacket(packets[len(packets)-1], bytes.Repeat([]byte("a"), 50)))
+	}
+
+	for _, p := range packets {
+		listener.packetsChan <- p.dump()
+	}
+
+	select {
+	case msg := <-listener.messagesChan:
+		t.Errorf("Message exceeding memory limit should be dropped: %q", msg.Bytes())
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	if len(listener.messages) != 0 {
+		t.Error("Dropped message should not stay in buffer")
+	}
+}
+
+func TestLengthPrefixedMessages(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{Framing: FramingLengthPrefixed})
+	defer listener.Close()
+
+	// Length is split from the first query, and the second query is pipelined
+	reqPacket := firstPacket([]byte{0, 5})
+	reqPacket2 := nextPacket(reqPacket, []byte("query\x00\x03two"))
+	respPacket := responsePacket(reqPacket2, []byte("\x00\x06answer\x00\x05reply"))
+
+	listener.packetsChan <- reqPacket.dump()
+	listener.packetsChan <- reqPacket2.dump()
+	listener.packetsChan <- respPacket.dump()
+
+	var messages []*TCPMessage
+	for i := 0; i < 4; i++ {
+		select {
+		case msg := <-listener.messagesChan:
+			messages = append(messages, msg)
+		case <-time.After(20 * time.Millisecond):
+			t.Fatalf("Should return 4 messages, got %d", len(messages))
+		}
+	}
+
+	expected := []string{"\x00\x05query", "\x00\x06answer", "\x00\x03two", "\x00\x05reply"}
+	for i, msg := range messages {
+		if string(msg.Bytes()) != expected[i] {
+			t.Errorf("Wrong message %d: %q", i, msg.Bytes())
+		}
+	}
+
+	if string(messages[0].Payload()) != "query" {
+		t.Errorf("Payload should not contain length: %q", messages[0].Payload())
+	}
+
+	if !bytes.Equal(messages[0].UUID(), messages[1].UUID()) || !bytes.Equal(messages[2].UUID(), messages[3].UUID()) {
+		t.Error("Responses should have UUID of their requests")
+	}
+}
+
+func TestRawSegments(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, false, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{RawSegments: true})
+	defer listener.Close()
+
+	// Segments are passed as they are captured, even if they are out of order or retransmitted
+	reqPacket := firstPacket([]byte("frame1"))
+	reqPacket2 := nextPacket(reqPacket, []byte("frame2"))
+	respPacket := responsePacket(reqPacket2, []byte("frame3"))
+
+	listener.packetsChan <- reqPacket2.dump()
+	listener.packetsChan <- respPacket.dump()
+	listener.packetsChan <- reqPacket.dump()
+	listener.packetsChan <- reqPacket.dump()
+
+	expected := []struct {
+		data     string
+		seq      uint32
+		incoming bool
+	}{{"frame2", reqPacket2.Seq, true}, {"frame3", respPacket.Seq, false}, {"frame1", reqPacket.Seq, true}, {"frame1", reqPacket.Seq, true}}
+	for i, e := range expected {
+		select {
+		case msg := <-listener.messagesChan:
+			if string(msg.Bytes()) != e.data || msg.Seq != e.seq || msg.IsIncoming != e.incoming {
+				t.Errorf("Wrong segment %d: %q %d %v", i, msg.Bytes(), msg.Seq, msg.IsIncoming)
+			}
+		case <-time.After(20 * time.Millisecond):
+			t.Fatalf("Should return %d segments, got %d", len(expected), i)
+		}
+	}
+}
+
+func TestPrefixedLength(t *testing.T) {
+	cases := []struct {
+		data   string
+		length int
+	}{
+		{"", -1},
+		{"\x00", -1},
+		{"\x00\x03ab", -1},
+		{"\x00\x03abc", 5},
+		{"\x00\x01abc", 3},
+	}
+
+	for _, c := range cases {
+		if l := prefixedLength([]byte(c.data)); l != c.length {
+			t.Errorf("%q: expected %d, got %d", c.data, c.length, l)
+		}
+	}
+}
+
+func TestMySQLMessages(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{Framing: FramingMySQL})
+	defer listener.Close()
+
+	// COM_STMT_CLOSE has no response, and is sent together with the next command
+	reqPacket := firstPacket([]byte("\x05\x00\x00\x00\x19\x01\x00\x00\x00\x09\x00\x00\x00\x03SELECT 1"))
+	// Result set is split between segments, which end at packet boundaries: column count, column definition,
+	// EOF, row and EOF
+	respPacket := responsePacket(reqPacket, []byte("\x01\x00\x00\x01\x01"))
+	respPacket2 := nextPacket(respPacket, []byte("\x04\x00\x00\x02\x03def"))
+	respPacket3 := nextPacket(respPacket2, []byte("\x05\x00\x00\x03\xfe\x00\x00\x02\x00\x02\x00\x00\x04\x011\x05\x00\x00\x05\xfe\x00\x00\x02\x00"))
+
+	for _, p := range []*TCPPacket{reqPacket, respPacket, respPacket2, respPacket3} {
+		listener.packetsChan <- p.dump()
+	}
+
+	var messages []*TCPMessage
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-listener.messagesChan:
+			messages = append(messages, msg)
+		case <-time.After(50 * time.Millisecond):
+			t.Fatalf("Should return 3 messages, got %d", len(messages))
+		}
+	}
+
+	// Command without response is returned immediately
+	closeStmt, query, resp := messages[0], messages[1], messages[2]
+	if string(query.Bytes()) != "\x09\x00\x00\x00\x03SELECT 1" || string(closeStmt.Bytes()) != "\x05\x00\x00\x00\x19\x01\x00\x00\x00" {
+		t.Fatalf("Should split commands: %q %q", query.Bytes(), closeStmt.Bytes())
+	}
+
+	expected := string(respPacket.Data) + string(respPacket2.Data) + string(respPacket3.Data)
+	if resp.IsIncoming || resp.AssocMessage != query || string(resp.Bytes()) != expected {
+		t.Errorf("Should return whole result set: %q", resp.Bytes())
+	}
+
+	if addr := resp.ClientAddr(); !addr.IP.Equal(query.IP()) || addr.Port != int(reqPacket.SrcPort) {
+		t.Error("Wrong client address", addr)
+	}
+}
+
+func TestPostgresMessages(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{Framing: FramingPostgres})
+	defer listener.Close()
+
+	// Extended query batch ends with Sync, and is followed by simple query in the same segment
+	batch := "P\x00\x00\x00\x10\x00SELECT 1\x00\x00\x00B\x00\x00\x00\x0c\x00\x00\x00\x00\x00\x00\x00\x00E\x00\x00\x00\x09\x00\x00\x00\x00\x00S\x00\x00\x00\x04"
+	query := "Q\x00\x00\x00\x0dSELECT 2\x00"
+	reqPacket := firstPacket([]byte(batch + query))
+	// Response to batch is split between segments
+	respPacket := responsePacket(reqPacket, []byte("1\x00\x00\x00\x042\x00\x00\x00\x04D\x00\x00\x00\x0b\x00\x01\x00\x00\x00\x011"))
+	respPacket2 := nextPacket(respPacket, []byte("C\x00\x00\x00\x0dSELECT 1\x00Z\x00\x00\x00\x05I"))
+	respPacket3 := nextPacket(respPacket2, []byte("C\x00\x00\x00\x0dSELECT 2\x00Z\x00\x00\x00\x05I"))
+
+	for _, p := range []*TCPPacket{reqPacket, respPacket, respPacket2, respPacket3} {
+		listener.packetsChan <- p.dump()
+	}
+
+	var messages []*TCPMessage
+	for i := 0; i < 4; i++ {
+		select {
+		case msg := <-listener.messagesChan:
+			messages = append(messages, msg)
+		case <-time.After(50 * time.Millisecond):
+			t.Fatalf("Should return 4 messages, got %d", len(messages))
+		}
+	}
+
+	expected := []string{
+		batch,
+		string(respPacket.Data) + string(respPacket2.Data),
+		query,
+		string(respPacket3.Data),
+	}
+	for i, msg := range messages {
+		if string(msg.Bytes()) != expected[i] {
+			t.Errorf("Wrong message %d: %q", i, msg.Bytes())
+		}
+	}
+
+	if messages[1].AssocMessage != messages[0] || messages[3].AssocMessage != messages[2] {
+		t.Error("Responses should be associated with their requests")
+	}
+}
+
+func TestRedisMessages(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{Framing: FramingRedis})
+	defer listener.Close()
+
+	// Inline command is pipelined with command in RESP, and bulk string reply contains CRLF
+	reqPacket := firstPacket([]byte("PING\r\n*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"))
+	respPacket := responsePacket(reqPacket, []byte("+PONG\r\n$7\r\nva\r\n"))
+	respPacket2 := nextPacket(respPacket, []byte("lue\r\n"))
+
+	for _, p := range []*TCPPacket{reqPacket, respPacket, respPacket2} {
+		listener.packetsChan <- p.dump()
+	}
+
+	var messages []*TCPMessage
+	for i := 0; i < 4; i++ {
+		select {
+		case msg := <-listener.messagesChan:
+			messages = append(messages, msg)
+		case <-time.After(50 * time.Millisecond):
+			t.Fatalf("Should return 4 messages, got %d", len(messages))
+		}
+	}
+
+	expected := []string{"PING\r\n", "+PONG\r\n", "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", "$7\r\nva\r\nlue\r\n"}
+	for i, msg := range messages {
+		if string(msg.Bytes()) != expected[i] {
+			t.Errorf("Wrong message %d: %q", i, msg.Bytes())
+		}
+	}
+
+	if messages[1].AssocMessage != messages[0] || messages[3].AssocMessage != messages[2] {
+		t.Error("Replies should be associated with their commands")
+	}
+}
+
+func TestMongoMessages(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{Framing: FramingMongo})
+	defer listener.Close()
+
+	// Body section with empty document, preceded by flag bits
+	body := func(flags byte) []byte {
+		return []byte{flags, 0, 0, 0, 0, 5, 0, 0, 0, 0}
+	}
+
+	// Unacknowledged write is not answered, and is pipelined with the next command
+	unacknowledged := mongo.AppendMessage(nil, 1, 0, mongo.OpMsg, body(2))
+	req := mongo.AppendMessage(nil, 2, 0, mongo.OpMsg, body(0))
+	resp := mongo.AppendMessage(nil, 3, 2, mongo.OpMsg, body(0))
+
+	reqPacket := firstPacket(append(append([]byte{}, unacknowledged...), req...))
+	respPacket := responsePacket(reqPacket, resp[:10])
+	respPacket2 := nextPacket(respPacket, resp[10:])
+
+	for _, p := range []*TCPPacket{reqPacket, respPacket, respPacket2} {
+		listener.packetsChan <- p.dump()
+	}
+
+	var messages []*TCPMessage
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-listener.messagesChan:
+			messages = append(messages, msg)
+		case <-time.After(50 * time.Millisecond):
+			t.Fatalf("Should return 3 messages, got %d", len(messages))
+		}
+	}
+
+	for i, expected := range [][]byte{unacknowledged, req, resp} {
+		if !bytes.Equal(messages[i].Bytes(), expected) {
+			t.Errorf("Wrong message %d: %q", i, messages[i].Bytes())
+		}
+	}
+
+	if messages[2].AssocMessage != messages[1] {
+		t.Error("Reply should be associated with its command")
+	}
+}
+
+func TestFastCGIMessages(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{Framing: FramingFastCGI})
+	defer listener.Close()
+
+	req := fastcgi.AppendRecord(nil, fastcgi.TypeBeginRequest, 1, []byte{0, 1, 1, 0, 0, 0, 0, 0})
+	req = fastcgi.AppendRecord(req, fastcgi.TypeParams, 1, fastcgi.AppendParams(nil, fastcgi.Param{Name: "REQUEST_METHOD", Value: "GET"}))
+	req = fastcgi.AppendRecord(req, fastcgi.TypeParams, 1, nil)
+	req = fastcgi.AppendRecord(req, fastcgi.TypeStdin, 1, nil)
+
+	resp := fastcgi.AppendRecord(nil, fastcgi.TypeStdout, 1, []byte("Status: 200\r\n\r\nok"))
+	resp = fastcgi.AppendRecord(resp, fastcgi.TypeStdout, 1, nil)
+	resp = fastcgi.AppendRecord(resp, fastcgi.TypeEndRequest, 1, make([]byte, 8))
+
+	// Keep-alive connection is reused for the next request, response is split between packets
+	reqPacket := firstPacket(req[:20])
+	reqPacket2 := nextPacket(reqPacket, req[20:])
+	respPacket := responsePacket(reqPacket2, resp[:30])
+	respPacket2 := nextPacket(respPacket, resp[30:])
+	reqPacket3 := nextPacket(reqPacket2, req)
+	reqPacket3.Ack = respPacket2.Seq + uint32(len(respPacket2.Data))
+
+	for _, p := range []*TCPPacket{reqPacket, reqPacket2, respPacket, respPacket2, reqPacket3} {
+		listener.packetsChan <- p.dump()
+	}
+
+	var messages []*TCPMessage
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-listener.messagesChan:
+			messages = append(messages, msg)
+		case <-time.After(50 * time.Millisecond):
+			t.Fatalf("Should return 3 messages, got %d", len(messages))
+		}
+	}
+
+	for i, expected := range [][]byte{req, resp, req} {
+		if !bytes.Equal(messages[i].Bytes(), expected) {
+			t.Errorf("Wrong message %d: %q", i, messages[i].Bytes())
+		}
+	}
+
+	if messages[1].AssocMessage != messages[0] {
+		t.Error("Response should be associated with its request")
+	}
+}
+
+func TestResponsePairingByStream(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{})
+	defer listener.Close()
+
+	// Connections of different clients can have the same sequence numbers
+	reqA := firstPacket([]byte("GET /a HTTP/1.1\r\n\r\n"))
+	respA := responsePacket(reqA, []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na"))
+	reqB := firstPacket([]byte("GET /b HTTP/1.1\r\n\r\n"))
+	respB := responsePacket(reqB, []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb"))
+	reqB.SrcPort, respB.DestPort = 2, 2
+
+	// Server responds to request body it does not want before receiving all of it
+	reqC := firstPacket([]byte("POST /c HTTP/1.1\r\nContent-Length: 4\r\n\r\n"))
+	reqC2 := nextPacket(reqC, []byte("body"))
+	respC := responsePacket(reqC, []byte("HTTP/1.1 413 Payload Too Large\r\nContent-Length: 1\r\n\r\nc"))
+	reqC.SrcPort, reqC2.SrcPort, respC.DestPort = 3, 3, 3
+
+	for _, p := range []*TCPPacket{reqB, reqA, respB, respA, reqC, reqC2, respC} {
+		listener.packetsChan <- p.dump()
+	}
+
+	responses := make(map[string]string)
+	for len(responses) < 3 {
+		select {
+		case msg := <-listener.messagesChan:
+			if !msg.IsIncoming {
+				responses[string(msg.Bytes()[len(msg.Bytes())-1:])] = string(msg.AssocMessage.Bytes()[:7])
+			}
+		case <-time.After(50 * time.Millisecond):
+			t.Fatalf("Should return 3 responses, got %d", len(responses))
+		}
+	}
+
+	for resp, req := range map[string]string{"a": "GET /a ", "b": "GET /b ", "c": "POST /c"} {
+		if responses[resp] != req {
+			t.Errorf("Response %s should be associated with %q, got %q", resp, req, responses[resp])
+		}
+	}
+
+	// Requests without response are dispatched after expiration, and responses without request are dropped
+	reqD := firstPacket([]byte("GET /d HTTP/1.1\r\n\r\n"))
+	reqD.SrcPort = 4
+	respE := buildPacket(false, 100, 100, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"), time.Now())
+	respE.DestPort = 5
+
+	listener.packetsChan <- reqD.dump()
+	listener.packetsChan <- respE.dump()
+
+	select {
+	case msg := <-listener.messagesChan:
+		if msg.AssocMessage != nil || !bytes.HasPrefix(msg.Bytes(), []byte("GET /d")) {
+			t.Errorf("Expected unanswered request, got %q", msg.Bytes())
+		}
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("Unanswered request should be dispatched")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if stats := listener.AssemblerStats(); stats.Unanswered != 1 || stats.Orphans != 1 {
+		t.Errorf("Expected 1 unanswered request and 1 orphan response, got %+v", stats)
+	}
+}
@@ -0,0 +1,235 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DLT_RAW, packets start with IPv4 or IPv6 header
+const linkTypeRawIP = layers.LinkType(12)
+
+// packetMatcher is implemented by compiled pcap filter
+type packetMatcher interface {
+	Matches(ci gopacket.CaptureInfo, data []byte) bool
+}
+
+// portRange is inclusive range of TCP ports, single port has equal bounds
+type portRange struct {
+	min, max uint16
+}
+
+// parsePorts parses comma separated list of ports and port ranges, e.g. `80,8000-8100`
+func parsePorts(spec string) (ports []portRange, err error) {
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+
+		min, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.ParseUint(bounds[1], 10, 16); err != nil || max < min {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+
+		ports = append(ports, portRange{uint16(min), uint16(max)})
+	}
+
+	return
+}
+
+// listenPorts returns ranges of listening ports
+func (t *Listener) listenPorts() []portRange {
+	if len(t.ports) == 0 {
+		return []portRange{{t.port, t.port}}
+	}
+
+	return t.ports
+}
+
+// isListenPort checks if port is one of listening ports
+func (t *Listener) isListenPort(port uint16) bool {
+	if len(t.ports) == 0 {
+		return port == t.port
+	}
+
+	for _, r := range t.ports {
+		if port >= r.min && port <= r.max {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pcapPortFilter returns pcap expression matching listening ports, direction is `src` or `dst`
+func (t *Listener) pcapPortFilter(direction string) string {
+	var exprs []string
+	for _, r := range t.listenPorts() {
+		if r.min == r.max {
+			exprs = append(exprs, t.transportName()+" "+direction+" port "+strconv.Itoa(int(r.min)))
+		} else {
+			exprs = append(exprs, t.transportName()+" "+direction+" portrange "+strconv.Itoa(int(r.min))+"-"+strconv.Itoa(int(r.max)))
+		}
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+
+	return "(" + strings.Join(exprs, " or ") + ")"
+}
+
+// matchAddress checks if address from listening addresses list matches interface name, name pattern or interface address
+func matchAddress(addr string, name string, addrs []net.IP) bool {
+	if name == addr {
+		return true
+	}
+
+	if matched, _ := filepath.Match(addr, name); matched {
+		return true
+	}
+
+	for _, ip := range addrs {
+		if ip.String() == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listenIP returns IP address traffic should be sent to, or nil if listening on all addresses or on list of interfaces
+func (t *Listener) listenIP() net.IP {
+	if listenAllInterfaces(t.addr) || strings.Contains(t.addr, ",") {
+		return nil
+	}
+
+	return net.ParseIP(t.addr)
+}
+
+// listenInterfaces returns indexes of interfaces matching listening addresses, or nil if all interfaces should be captured.
+// Same as libpcap engine, interfaces can be specified by name, name pattern like `eth*` or address.
+func (t *Listener) listenInterfaces() map[int]bool {
+	if listenAllInterfaces(t.addr) {
+		return nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	indexes := make(map[int]bool)
+	for _, iface := range ifaces {
+		var ips []net.IP
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+
+		for _, addr := range strings.Split(t.addr, ",") {
+			if matchAddress(addr, iface.Name, ips) {
+				indexes[iface.Index] = true
+			}
+		}
+	}
+
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	return indexes
+}
+
+// captureInterface checks if packets received on interface should be captured.
+// Same as libpcap engine, loopback interfaces are always captured.
+func captureInterface(ifindex int, ifaces, loopbacks map[int]bool) bool {
+	return ifaces == nil || ifaces[ifindex] || loopbacks[ifindex]
+}
+
+// listenInterface returns index of the only interface matching listening addresses, or 0 if multiple or all
+// interfaces should be captured.
+func (t *Listener) listenInterface() int {
+	ifaces := t.listenInterfaces()
+	if len(ifaces) != 1 {
+		return 0
+	}
+
+	for index := range ifaces {
+		return index
+	}
+
+	return 0
+}
+
+func loopbackInterfaces() map[int]bool {
+	loopbacks := make(map[int]bool)
+
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				loopbacks[iface.Index] = true
+			}
+		}
+	}
+
+	return loopbacks
+}
+
+// matchIPPacket checks that raw IP packet belongs to the listener, and returns its addresses and TCP segment or UDP datagram.
+// Engines filtering packets in kernel still need it, because packets received before filter was attached are not filtered.
+func (t *Listener) matchIPPacket(packet []byte, listenIP net.IP) (srcIP, dstIP, tcp []byte, ok bool) {
+	if packet, _, ok = t.defragmenter.defragment(packet); !ok {
+		return nil, nil, nil, false
+	}
+
+	if t.packetFilter != nil && !t.packetFilter.Matches(gopacket.CaptureInfo{CaptureLength: len(packet), Length: len(packet)}, packet) {
+		return nil, nil, nil, false
+	}
+
+	// Inner addresses of mirrored traffic belong to remote hosts
+	if vxlanPort := t.tunnelPort(); vxlanPort != 0 {
+		if inner, tunneled := decapsulate(packet, vxlanPort); tunneled {
+			if packet, _, ok = t.defragmenter.defragment(inner); !ok {
+				return nil, nil, nil, false
+			}
+			listenIP = nil
+		}
+	}
+
+	srcIP, dstIP, tcp, ok = decodeIPPacket(packet, t.transportProtocol())
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	destPort := binary.BigEndian.Uint16(tcp[2:4])
+	srcPort := binary.BigEndian.Uint16(tcp[0:2])
+
+	var addrCheck []byte
+	if t.isListenPort(destPort) {
+		addrCheck = dstIP
+	} else if t.trackResponse && t.isListenPort(srcPort) {
+		addrCheck = srcIP
+	} else {
+		return nil, nil, nil, false
+	}
+
+	if listenIP != nil && !listenIP.Equal(net.IP(addrCheck)) {
+		return nil, nil, nil, false
+	}
+
+	return srcIP, dstIP, tcp, true
+}
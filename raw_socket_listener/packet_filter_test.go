@@ -0,0 +1,89 @@
+package rawSocket
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+// srcHostFilter matches IPv4 packets by source address, like `src host` pcap expression
+type srcHostFilter [4]byte
+
+func (f srcHostFilter) Matches(ci gopacket.CaptureInfo, data []byte) bool {
+	return ci.CaptureLength == len(data) && [4]byte{data[12], data[13], data[14], data[15]} == f
+}
+
+func TestMatchIPPacketCustomFilter(t *testing.T) {
+	tcp := []byte{0x1f, 0x90, 0x00, 0x50, 0, 0, 0, 1, 0, 0, 0, 2, 0x50, 0x18, 0, 0, 0, 0, 0, 0}
+	packet := buildIPv4Packet(ipProtoTCP, append(tcp, []byte("GET / HTTP/1.1\r\n\r\n")...))
+
+	l := &Listener{port: 80}
+	if _, _, _, ok := l.matchIPPacket(packet, nil); !ok {
+		t.Fatal("Should match packet without custom filter")
+	}
+
+	l.packetFilter = srcHostFilter{packet[12], packet[13], packet[14], packet[15]}
+	if _, _, _, ok := l.matchIPPacket(packet, nil); !ok {
+		t.Error("Should match packet selected by custom filter")
+	}
+
+	l.packetFilter = srcHostFilter{10, 0, 0, 5}
+	if _, _, _, ok := l.matchIPPacket(packet, nil); ok {
+		t.Error("Should drop packet rejected by custom filter")
+	}
+
+	// Custom filter does not change listening port
+	l.port = 8080
+	l.packetFilter = srcHostFilter{packet[12], packet[13], packet[14], packet[15]}
+	if _, _, _, ok := l.matchIPPacket(packet, nil); ok {
+		t.Error("Should drop packet of other port")
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("80,8000-8100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ports) != 2 || ports[0] != (portRange{80, 80}) || ports[1] != (portRange{8000, 8100}) {
+		t.Error("Wrong ports", ports)
+	}
+
+	for _, spec := range []string{"", "http", "80,", "8100-8000", "80-", "70000"} {
+		if _, err := parsePorts(spec); err == nil {
+			t.Error("Should fail on", spec)
+		}
+	}
+}
+
+func TestListenPorts(t *testing.T) {
+	l := &Listener{port: 80}
+	if !l.isListenPort(80) || l.isListenPort(81) {
+		t.Error("Should match single port")
+	}
+	if f := l.pcapPortFilter("dst"); f != "tcp dst port 80" {
+		t.Error("Wrong filter", f)
+	}
+
+	l = &Listener{port: 80, ports: []portRange{{80, 80}, {8000, 8100}}}
+	for port, match := range map[uint16]bool{80: true, 81: false, 7999: false, 8000: true, 8050: true, 8100: true, 8101: false} {
+		if l.isListenPort(port) != match {
+			t.Error("Wrong port match", port)
+		}
+	}
+	if f := l.pcapPortFilter("src"); f != "(tcp src port 80 or tcp src portrange 8000-8100)" {
+		t.Error("Wrong filter", f)
+	}
+}
+
+func TestMatchAddress(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.1")}
+
+	for addr, match := range map[string]bool{"eth0": true, "eth*": true, "10.0.0.1": true, "eth1": false, "en*": false, "10.0.0.2": false} {
+		if matchAddress(addr, "eth0", ips) != match {
+			t.Error("Wrong address match", addr)
+		}
+	}
+}
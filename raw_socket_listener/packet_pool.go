@@ -0,0 +1,70 @@
+package rawSocket
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Buffers larger than this are not returned to the pool, so rare large packets, like reassembled datagrams, do not
+// keep memory allocated
+const maxPooledPacket = 64 << 10
+
+// packetBuffer holds copy of captured packet: its addresses and TCP segment or UDP datagram. Capture engines reuse
+// their rings and buffers, so each packet is copied, and at high packet rates allocating these copies makes GC pauses
+// long enough for kernel to drop packets.
+type packetBuffer struct {
+	data []byte
+	// Packets referring to the buffer, e.g. parts of segment split between pipelined messages
+	refs int32
+}
+
+var packetBuffers = sync.Pool{
+	New: func() interface{} {
+		return &packetBuffer{data: make([]byte, 0, 2048)}
+	},
+}
+
+// copyPacket returns packet with copy of addresses and data in buffer taken from the pool. Buffer is returned to the
+// pool when message containing the packet is released, see TCPMessage.Release.
+func (t *Listener) copyPacket(srcIP, dstIP, data []byte, timestamp time.Time) *packet {
+	b := packetBuffers.Get().(*packetBuffer)
+	b.refs = 1
+
+	buf := append(b.data[:0], srcIP...)
+	buf = append(buf, dstIP...)
+	buf = append(buf, data...)
+	b.data = buf
+
+	p := &packet{buf: b, timestamp: timestamp}
+
+	// Full slice expressions keep appends to one part from overwriting the next one
+	n := len(srcIP)
+	p.srcIP = buf[:n:n]
+	if dstIP != nil {
+		p.dstIP = buf[n : n+len(dstIP) : n+len(dstIP)]
+		n += len(dstIP)
+	}
+	p.data = buf[n:len(buf):len(buf)]
+
+	return p
+}
+
+// ref adds packet referring to the buffer
+func (b *packetBuffer) ref() {
+	if b != nil {
+		atomic.AddInt32(&b.refs, 1)
+	}
+}
+
+// release removes packet referring to the buffer, and returns buffer to the pool when it is not referred anymore
+func (b *packetBuffer) release() {
+	if b == nil || atomic.AddInt32(&b.refs, -1) != 0 {
+		return
+	}
+
+	if cap(b.data) <= maxPooledPacket {
+		b.data = b.data[:0]
+		packetBuffers.Put(b)
+	}
+}
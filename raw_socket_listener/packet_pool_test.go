@@ -0,0 +1,107 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCopyPacket(t *testing.T) {
+	l := &Listener{}
+	data := []byte("segment")
+
+	p := l.copyPacket([]byte{127, 0, 0, 1}, []byte{127, 0, 0, 2}, data, time.Now())
+	data[0] = 'S'
+
+	if !bytes.Equal(p.srcIP, []byte{127, 0, 0, 1}) || !bytes.Equal(p.dstIP, []byte{127, 0, 0, 2}) || string(p.data) != "segment" {
+		t.Errorf("unexpected packet %v %v %q", p.srcIP, p.dstIP, p.data)
+	}
+
+	// Appends to one part keep the next one
+	_ = append(p.srcIP, 0)
+	if p.dstIP[0] != 127 {
+		t.Error("destination address is overwritten")
+	}
+
+	p = l.copyPacket([]byte{127, 0, 0, 1}, nil, data, time.Now())
+	if p.dstIP != nil || string(p.data) != "Segment" {
+		t.Errorf("unexpected packet %v %q", p.dstIP, p.data)
+	}
+}
+
+func pooledMessage(isIncoming bool, seq uint32) (*TCPMessage, *packetBuffer) {
+	l := &Listener{}
+	p := l.copyPacket([]byte{127, 0, 0, 1}, nil, []byte("data"), time.Now())
+
+	packet := buildPacket(isIncoming, 1, seq, p.data, p.timestamp)
+	packet.buf = p.buf
+
+	msg := NewTCPMessage(seq, 1, isIncoming, p.timestamp)
+	msg.packets = []*TCPPacket{packet}
+	msg.responseTracked = true
+
+	return msg, p.buf
+}
+
+func TestTCPMessageRelease(t *testing.T) {
+	// Request is released with its response, read after or before it
+	for _, requestFirst := range []bool{true, false} {
+		req, reqBuf := pooledMessage(true, 1)
+		resp, respBuf := pooledMessage(false, 2)
+		resp.AssocMessage = req
+
+		if requestFirst {
+			req.Release()
+		} else {
+			resp.Release()
+		}
+		if reqBuf.refs != 1 || respBuf.refs != 1 {
+			t.Error(requestFirst, "buffers are released before both messages are read")
+		}
+
+		if requestFirst {
+			resp.Release()
+		} else {
+			req.Release()
+		}
+		if reqBuf.refs != 0 || respBuf.refs != 0 {
+			t.Error(requestFirst, "buffers are not released")
+		}
+	}
+
+	// Request is released at once if responses are not tracked
+	req, reqBuf := pooledMessage(true, 1)
+	req.responseTracked = false
+	req.Release()
+	if reqBuf.refs != 0 {
+		t.Error("request buffer is not released")
+	}
+}
+
+func TestSplitPipelinedRefs(t *testing.T) {
+	l := &Listener{}
+	p := l.copyPacket([]byte{127, 0, 0, 1}, nil, []byte("GET /1 HTTP/1.1\r\n\r\nGET /2 HTTP/1.1\r\n\r\n"), time.Now())
+
+	packet := buildPacket(true, 1, 1, p.data, p.timestamp)
+	packet.buf = p.buf
+
+	msg := NewTCPMessage(1, 1, true, p.timestamp)
+	msg.AddPacket(packet)
+
+	rest := msg.splitPipelined()
+	if len(rest) != 1 || string(rest[0].Data) != "GET /2 HTTP/1.1\r\n\r\n" {
+		t.Fatal("pipelined request is not split", rest)
+	}
+	if p.buf.refs != 2 {
+		t.Error("split packet does not refer to buffer", p.buf.refs)
+	}
+
+	tail := NewTCPMessage(rest[0].Seq, 1, true, p.timestamp)
+	tail.packets = rest
+
+	msg.Release()
+	tail.Release()
+	if p.buf.refs != 0 {
+		t.Error("buffer is not released", p.buf.refs)
+	}
+}
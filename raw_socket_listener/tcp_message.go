@@ -5,13 +5,19 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
+	"io"
 	"log"
 	"net"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/buger/goreplay/fastcgi"
+	"github.com/buger/goreplay/mongo"
+	"github.com/buger/goreplay/mysql"
+	"github.com/buger/goreplay/postgres"
 	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/redis"
 )
 
 var _ = log.Println
@@ -36,9 +42,23 @@ type TCPMessage struct {
 	IsIncoming   bool
 
 	packets []*TCPPacket
+	// Size of packets data, used to enforce memory limit
+	bufferedSize int
+
+	// Pipelined message of the same TCP stream, which has the same ID
+	next *TCPMessage
 
 	delChan chan *TCPMessage
 
+	// Non-HTTP messages are delimited by protocol specific framing
+	framing Framing
+	// Listener tracks responses, which refer to their requests
+	responseTracked bool
+
+	// Consumer state: message is read, and response read before its request, see Release
+	read         bool
+	readResponse *TCPMessage
+
 	/* HTTP specific variables */
 	methodType    httpMethodType
 	bodyType      httpBodyType
@@ -47,6 +67,10 @@ type TCPMessage struct {
 	headerPacket  int
 	contentLength int
 	complete      bool
+
+	// Chunked body is parsed as packets arrive, chunkedOffset is size of body already passed to the parser
+	chunked       proto.ChunkedBody
+	chunkedOffset int
 }
 
 // NewTCPMessage pointer created from a sequence and acknowledgment numbers, whether the message is incoming and a timestamp
@@ -66,8 +90,13 @@ func (t *TCPMessage) packetsData() (d [][]byte) {
 	return
 }
 
-// Bytes return message content
+// Bytes return message content. Content of single packet is returned without copying, and should not be modified.
 func (t *TCPMessage) Bytes() (output []byte) {
+	if len(t.packets) == 1 {
+		data := t.packets[0].Data
+		return data[:len(data):len(data)]
+	}
+
 	for _, p := range t.packets {
 		output = append(output, p.Data...)
 	}
@@ -75,6 +104,65 @@ func (t *TCPMessage) Bytes() (output []byte) {
 	return output
 }
 
+// CopyBytes copies message content into dst, like copy(dst, t.Bytes()) without assembling packets into new buffer
+func (t *TCPMessage) CopyBytes(dst []byte) (n int) {
+	for _, p := range t.packets {
+		n += copy(dst[n:], p.Data)
+	}
+
+	return n
+}
+
+// Payload returns message content without 2-byte length prefix, if messages are length-prefixed
+func (t *TCPMessage) Payload() []byte {
+	data := t.Bytes()
+	if t.framing == FramingLengthPrefixed && len(data) >= 2 {
+		return data[2:]
+	}
+
+	return data
+}
+
+// Release is called by consumer once message is read, and returns buffers of its packets to the pool. Response
+// refers to its request, so buffers of both are returned when both are read. Requests without response are not
+// returned, as response can be associated with them later, and their buffers are collected by GC instead. Message,
+// and data returned by its methods, should not be used after Release.
+func (t *TCPMessage) Release() {
+	switch {
+	case t.IsIncoming && !t.responseTracked:
+		t.releasePackets()
+	case t.IsIncoming:
+		if t.readResponse != nil {
+			t.releasePackets()
+			t.readResponse.releasePackets()
+		}
+		t.read = true
+	case t.AssocMessage == nil:
+		t.releasePackets()
+	case t.AssocMessage.read:
+		t.AssocMessage.releasePackets()
+		t.releasePackets()
+	default:
+		t.AssocMessage.readResponse = t
+	}
+}
+
+func (t *TCPMessage) releasePackets() {
+	for _, p := range t.packets {
+		p.buf.release()
+	}
+}
+
+// Reader returns message content without copying packets into single buffer
+func (t *TCPMessage) Reader() io.Reader {
+	readers := make([]io.Reader, len(t.packets))
+	for i, p := range t.packets {
+		readers[i] = bytes.NewReader(p.Data)
+	}
+
+	return io.MultiReader(readers...)
+}
+
 // BodySize returns total body size
 func (t *TCPMessage) BodySize() (size int) {
 	if len(t.packets) == 0 || t.headerPacket == -1 {
@@ -104,32 +192,12 @@ func (t *TCPMessage) Size() (size int) {
 }
 
 // AddPacket to the message and ensure packet uniqueness
-// TCP allows that packet can be re-send multiple times
+// TCP allows that packet can be re-send multiple times, and retransmitted data can be split into segments differently
 func (t *TCPMessage) AddPacket(packet *TCPPacket) {
-	packetFound := false
-
-	for _, pkt := range t.packets {
-		if packet.Seq == pkt.Seq {
-			packetFound = true
-			break
-		}
-	}
+	if t.insertPacket(packet) {
+		// Packets not always captured in same Seq order, so message Seq should indicate starting seq
+		t.Seq = t.packets[0].Seq
 
-	if !packetFound {
-		// Packets not always captured in same Seq order, and sometimes we need to prepend
-		if len(t.packets) == 0 || packet.Seq > t.packets[len(t.packets)-1].Seq {
-			t.packets = append(t.packets, packet)
-		} else if packet.Seq < t.packets[0].Seq {
-			t.packets = append([]*TCPPacket{packet}, t.packets...)
-			t.Seq = packet.Seq // Message Seq should indicated starting seq
-		} else { // insert somewhere in the middle...
-			for i, p := range t.packets {
-				if packet.Seq < p.Seq {
-					t.packets = append(t.packets[:i], append([]*TCPPacket{packet}, t.packets[i:]...)...)
-					break
-				}
-			}
-		}
 		if packet.OrigAck != 0 {
 			t.DataAck = packet.OrigAck
 		}
@@ -144,6 +212,12 @@ func (t *TCPMessage) AddPacket(packet *TCPPacket) {
 	}
 
 	t.checkSeqIntegrity()
+
+	if t.framing != FramingHTTP {
+		t.checkIfComplete()
+		return
+	}
+
 	t.updateHeadersPacket()
 	t.updateMethodType()
 	t.updateBodyType()
@@ -151,6 +225,71 @@ func (t *TCPMessage) AddPacket(packet *TCPPacket) {
 	t.check100Continue()
 }
 
+// insertPacket puts packet in Seq order. Data which message already has is cut from the packet,
+// and packets fully covered by the new one are replaced. Returns false if packet has no new data.
+func (t *TCPMessage) insertPacket(packet *TCPPacket) bool {
+	i := len(t.packets)
+	for i > 0 && seqLess(packet.Seq, t.packets[i-1].Seq) {
+		i--
+	}
+
+	// FIN packets carry no data, so they are only ordered by Seq
+	if len(packet.Data) == 0 {
+		if i > 0 && t.packets[i-1].Seq == packet.Seq {
+			return false
+		}
+	} else if i > 0 && len(t.packets[i-1].Data) > 0 {
+		prev := t.packets[i-1]
+
+		if prev.Seq == packet.Seq || seqLess(packet.Seq, prev.nextSeq) {
+			if !seqLess(prev.nextSeq, packet.nextSeq) {
+				return false
+			}
+
+			if prev.Seq == packet.Seq {
+				i--
+				t.removePacket(i)
+			} else {
+				packet.Data = packet.Data[prev.nextSeq-packet.Seq:]
+				packet.Seq = prev.nextSeq
+			}
+		}
+	}
+
+	for i < len(t.packets) && seqLess(t.packets[i].Seq, packet.nextSeq) && len(t.packets[i].Data) > 0 {
+		next := t.packets[i]
+
+		if seqLess(packet.nextSeq, next.nextSeq) {
+			if next.Seq == packet.Seq {
+				return false
+			}
+
+			packet.Data = packet.Data[:next.Seq-packet.Seq]
+			packet.nextSeq = next.Seq
+			break
+		}
+
+		t.removePacket(i)
+	}
+
+	t.packets = append(t.packets, nil)
+	copy(t.packets[i+1:], t.packets[i:])
+	t.packets[i] = packet
+	t.bufferedSize += len(packet.Data)
+
+	return true
+}
+
+func (t *TCPMessage) removePacket(i int) {
+	t.bufferedSize -= len(t.packets[i].Data)
+	t.packets = append(t.packets[:i], t.packets[i+1:]...)
+}
+
+// nextSeq returns Seq following the last packet of the message
+func (t *TCPMessage) nextSeq() uint32 {
+	return t.packets[len(t.packets)-1].nextSeq
+}
+
 // Check if there is missing packet
 func (t *TCPMessage) checkSeqIntegrity() {
 	if len(t.packets) == 1 {
@@ -200,9 +339,6 @@ func (t *TCPMessage) checkSeqIntegrity() {
 var bEmptyLine = []byte("\r\n\r\n")
 var bBR = []byte("\r\n")
 
-// last-chunk always is 0\r\n\r\n\. More info https://tools.ietf.org/html/rfc2616#section-3.6.1
-var bChunkEnd = []byte("0\r\n\r\n")
-
 func (t *TCPMessage) updateHeadersPacket() {
 	if len(t.packets) == 1 {
 		t.headerPacket = -1
@@ -236,6 +372,11 @@ func (t *TCPMessage) updateHeadersPacket() {
 
 // checkIfComplete returns true if all of the packets that compse the message arrived.
 func (t *TCPMessage) checkIfComplete() {
+	if t.framing != FramingHTTP {
+		t.complete = !t.seqMissing && (t.IsIncoming || t.AssocMessage != nil) && t.framedLength(t.Bytes()) != -1
+		return
+	}
+
 	if t.seqMissing || t.headerPacket == -1 {
 		// log.Println("Seq missing", t.seqMissing, t.packets)
 		return
@@ -258,14 +399,12 @@ func (t *TCPMessage) checkIfComplete() {
 	case httpBodyEmpty:
 		t.complete = true
 	case httpBodyContentLength:
-		if t.contentLength == 0 || t.contentLength == t.BodySize() {
+		// Body can be followed by pipelined message
+		if t.contentLength == 0 || t.BodySize() >= t.contentLength {
 			t.complete = true
 		}
 	case httpBodyChunked:
-		lastPacket := t.packets[len(t.packets)-1]
-		if bytes.LastIndex(lastPacket.Data, bChunkEnd) != -1 {
-			t.complete = true
-		}
+		t.complete = t.parseChunkedBody()
 	default:
 		if len(t.packets) == 0 {
 			return
@@ -450,6 +589,212 @@ func (t *TCPMessage) check100Continue() {
 	t.expectType = httpExpectEmpty
 }
 
+// parseChunkedBody passes body received since previous check to chunked parser, and returns true if last chunk
+// and trailers are received. Malformed body is treated as one ending with connection close.
+func (t *TCPMessage) parseChunkedBody() bool {
+	if t.chunked.Done() {
+		return true
+	}
+
+	offset := 0
+
+	for i, p := range t.packets[t.headerPacket:] {
+		data := p.Data
+		if i == 0 {
+			data = proto.Body(data)
+		}
+
+		skip := t.chunkedOffset - offset
+		offset += len(data)
+		if skip >= len(data) {
+			continue
+		}
+
+		n, err := t.chunked.Parse(data[skip:])
+		t.chunkedOffset += n
+
+		if err != nil {
+			t.bodyType = httpBodyConnectionClose
+			return false
+		}
+
+		if t.chunked.Done() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// httpLength returns length of the first HTTP message in data, or -1 if it is not known
+func (t *TCPMessage) httpLength(data []byte) int {
+	headersEnd := bytes.Index(data, bEmptyLine)
+	if headersEnd == -1 {
+		return -1
+	}
+	headersEnd += len(bEmptyLine)
+
+	switch t.bodyType {
+	case httpBodyEmpty:
+		return headersEnd
+	case httpBodyContentLength:
+		return headersEnd + t.contentLength
+	case httpBodyChunked:
+		if length := proto.ChunkedBodyLength(data[headersEnd:]); length != -1 {
+			return headersEnd + length
+		}
+	}
+
+	return -1
+}
+
+// prefixedLength returns length of the first length-prefixed message in data, including 2-byte prefix, or -1 if it is not complete
+func prefixedLength(data []byte) int {
+	if len(data) < 2 {
+		return -1
+	}
+
+	length := 2 + int(binary.BigEndian.Uint16(data))
+	if length > len(data) {
+		return -1
+	}
+
+	return length
+}
+
+// expectsResponse returns false for requests which server does not answer
+func (t *TCPMessage) expectsResponse() bool {
+	if t.framing == FramingMySQL && mysql.Sequence(t.packets[0].Data) == 0 {
+		if p := mysql.Payload(t.Bytes()); len(p) > 0 {
+			return mysql.HasResponse(p[0])
+		}
+	}
+
+	if t.framing == FramingPostgres {
+		return postgres.HasResponse(t.Bytes())
+	}
+
+	if t.framing == FramingMongo {
+		return mongo.HasResponse(t.Bytes())
+	}
+
+	if t.framing == FramingFastCGI {
+		return fastcgi.HasResponse(t.Bytes())
+	}
+
+	return true
+}
+
+// framedLength returns length of the first message in data, or -1 if it is not complete
+func (t *TCPMessage) framedLength(data []byte) int {
+	switch t.framing {
+	case FramingLengthPrefixed:
+		return prefixedLength(data)
+	case FramingMySQL:
+		if t.IsIncoming {
+			return mysql.PacketLength(data)
+		}
+
+		if t.AssocMessage == nil || len(data) == 0 {
+			return -1
+		}
+
+		// Response to command ends according to its type, e.g. result set consists of multiple packets.
+		// Authentication packets exchanged before commands are sent one by one.
+		req := t.AssocMessage.Bytes()
+		if mysql.Sequence(req) == 0 {
+			if p := mysql.Payload(req); len(p) > 0 {
+				return mysql.ResponseLength(p[0], data)
+			}
+		}
+
+		return mysql.PacketLength(data)
+	case FramingPostgres:
+		if t.IsIncoming {
+			return postgres.RequestLength(data)
+		}
+
+		if t.AssocMessage == nil || len(data) == 0 {
+			return -1
+		}
+
+		return postgres.ResponseLength(t.AssocMessage.Bytes(), data)
+	case FramingRedis:
+		if t.IsIncoming {
+			return redis.RequestLength(data)
+		}
+
+		return redis.Length(data)
+	case FramingMongo:
+		return mongo.MessageLength(data)
+	case FramingFastCGI:
+		if t.IsIncoming {
+			return fastcgi.RequestLength(data)
+		}
+
+		return fastcgi.ResponseLength(data)
+	}
+
+	return -1
+}
+
+// splitPipelined cuts data following complete HTTP message, which happens when client pipelines requests
+// over keep-alive connection, and returns packets belonging to the following messages.
+func (t *TCPMessage) splitPipelined() (rest []*TCPPacket) {
+	if !t.complete || t.expectType == httpExpect100Continue {
+		return nil
+	}
+
+	data := t.Bytes()
+
+	var length int
+	if t.framing != FramingHTTP {
+		length = t.framedLength(data)
+	} else {
+		// Informational response is followed by final response, and both are treated as single message
+		if !t.IsIncoming && len(data) > 9 && data[9] == '1' {
+			return nil
+		}
+
+		length = t.httpLength(data)
+	}
+
+	if length == -1 || length >= len(data) {
+		return nil
+	}
+
+	for i, p := range t.packets {
+		if length >= len(p.Data) {
+			length -= len(p.Data)
+			continue
+		}
+
+		if length > 0 {
+			tail := *p
+			tail.buf.ref()
+			tail.Seq = p.Seq + uint32(length)
+			tail.Data = p.Data[length:]
+
+			p.Data = p.Data[:length]
+			p.nextSeq = tail.Seq
+			p.IsFIN = false
+
+			rest = append(rest, &tail)
+			i++
+		}
+
+		rest = append(rest, t.packets[i:]...)
+		t.packets = t.packets[:i]
+		break
+	}
+
+	for _, p := range rest {
+		t.bufferedSize -= len(p.Data)
+	}
+
+	return rest
+}
+
 func (t *TCPMessage) setAssocMessage(m *TCPMessage) {
 	t.AssocMessage = m
 	t.checkIfComplete()
@@ -467,8 +812,12 @@ func (t *TCPMessage) UpdateResponseAck() uint32 {
 	if t.ResponseAck != respAck {
 		t.ResponseAck = lastPacket.Seq + uint32(len(lastPacket.Data))
 
-		// We swappwed src and dst port
-		copy(t.ResponseID[:16], lastPacket.Addr)
+		// Response is sent from server address, and we swappwed src and dst port
+		if lastPacket.DstAddr != nil {
+			copy(t.ResponseID[:16], lastPacket.DstAddr)
+		} else {
+			copy(t.ResponseID[:16], lastPacket.Addr)
+		}
 		copy(t.ResponseID[16:], lastPacket.Raw[2:4]) // Src port
 		copy(t.ResponseID[18:], lastPacket.Raw[0:2]) // Dest port
 		binary.BigEndian.PutUint32(t.ResponseID[20:24], t.ResponseAck)
@@ -484,10 +833,13 @@ func (t *TCPMessage) UUID() []byte {
 		// log.Println("UUID:", t.Ack, t.Start.UnixNano())
 		key = strconv.AppendInt(key, t.Start.UnixNano(), 10)
 		key = strconv.AppendUint(key, uint64(t.Ack), 10)
+		// Pipelined requests can have same Ack and timestamp
+		key = strconv.AppendUint(key, uint64(t.Seq), 10)
 	} else {
 		// log.Println("RequestMessage:", t.AssocMessage.Ack, t.AssocMessage.Start.UnixNano())
 		key = strconv.AppendInt(key, t.AssocMessage.Start.UnixNano(), 10)
 		key = strconv.AppendUint(key, uint64(t.AssocMessage.Ack), 10)
+		key = strconv.AppendUint(key, uint64(t.AssocMessage.Seq), 10)
 	}
 
 	uuid := make([]byte, 40)
@@ -497,6 +849,11 @@ func (t *TCPMessage) UUID() []byte {
 	return uuid
 }
 
+// stream returns flow of TCP connection the message belongs to
+func (t *TCPMessage) stream() flowID {
+	return packetStream(t.packets[0], t.IsIncoming)
+}
+
 func (t *TCPMessage) ID() tcpID {
 	return t.packets[0].ID
 }
@@ -505,6 +862,38 @@ func (t *TCPMessage) IP() net.IP {
 	return net.IP(t.packets[0].Addr)
 }
 
+// ClientAddr returns address of client which sent request, or received response
+func (t *TCPMessage) ClientAddr() *net.TCPAddr {
+	if !t.IsIncoming {
+		if t.AssocMessage != nil {
+			return t.AssocMessage.ClientAddr()
+		}
+
+		// Datagrams are not always associated with requests
+		if p := t.packets[0]; p.DstAddr != nil {
+			return &net.TCPAddr{IP: net.IP(p.DstAddr), Port: int(p.DestPort)}
+		}
+
+		return nil
+	}
+
+	return &net.TCPAddr{IP: t.IP(), Port: int(t.packets[0].SrcPort)}
+}
+
+// ServerAddr returns address of server which received request, or sent response. Nil is returned if it is not known.
+func (t *TCPMessage) ServerAddr() *net.TCPAddr {
+	p := t.packets[0]
+	if !t.IsIncoming {
+		return &net.TCPAddr{IP: t.IP(), Port: int(p.SrcPort)}
+	}
+
+	if p.DstAddr == nil {
+		return nil
+	}
+
+	return &net.TCPAddr{IP: net.IP(p.DstAddr), Port: int(p.DestPort)}
+}
+
 func (t *TCPMessage) String() string {
 	return strings.Join([]string{
 		"Len packets: " + strconv.Itoa(len(t.packets)),
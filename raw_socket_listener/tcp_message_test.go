@@ -70,7 +70,7 @@ func TestTCPMessagePacketsOrder(t *testing.T) {
 
 func TestTCPMessageSize(t *testing.T) {
 	msg := buildMessage(buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\na"), time.Now()))
-	msg.AddPacket(buildPacket(true, 1, 2, []byte("b"), time.Now()))
+	msg.AddPacket(buildPacket(true, 1, 40, []byte("b"), time.Now()))
 
 	if msg.BodySize() != 2 {
 		t.Error("Should count only body", msg.BodySize())
@@ -256,3 +256,86 @@ func TestTcpMessageStart(t *testing.T) {
 		t.Error("Message timestamp should be equal to the lowest related packet timestamp", start, msg.Start)
 	}
 }
+
+func TestTCPMessageRetransmission(t *testing.T) {
+	p1 := buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\n"), time.Now())
+	p2 := nextPacket(p1, []byte("Content-Length: 2\r\n\r\n"))
+	p3 := nextPacket(p2, []byte("ab"))
+	expected := []byte("POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\nab")
+
+	// Retransmitted data is coalesced into single segment
+	msg := buildMessage(p1)
+	msg.AddPacket(buildPacket(true, 1, 1, append(append([]byte{}, p1.Data...), p2.Data...), time.Now()))
+	msg.AddPacket(p3)
+	if !bytes.Equal(msg.Bytes(), expected) || !msg.complete {
+		t.Errorf("Should replace segments covered by retransmission: %q", msg.Bytes())
+	}
+
+	// Retransmission overlaps both neighbours
+	msg = buildMessage(buildPacket(true, 1, 1, p1.Data, time.Now()))
+	msg.AddPacket(buildPacket(true, 1, p3.Seq, p3.Data, time.Now()))
+	msg.AddPacket(buildPacket(true, 1, p2.Seq-5, expected[p2.Seq-6:p3.Seq], time.Now()))
+	if !bytes.Equal(msg.Bytes(), expected) || msg.seqMissing {
+		t.Errorf("Should trim overlapping data: %q", msg.Bytes())
+	}
+
+	// Retransmission of already received data
+	msg.AddPacket(buildPacket(true, 1, p2.Seq+3, expected[p2.Seq+2:p3.Seq+1], time.Now()))
+	if !bytes.Equal(msg.Bytes(), expected) || msg.bufferedSize != len(expected) {
+		t.Errorf("Should ignore data message already has: %q", msg.Bytes())
+	}
+}
+
+func TestTCPMessageSeqWraparound(t *testing.T) {
+	seq := uint32(1<<32 - 10)
+	p1 := buildPacket(true, 1, seq, []byte("GET / HTTP/1.1\r\n"), time.Now())
+	p2 := nextPacket(p1, []byte("\r\n"))
+
+	msg := buildMessage(p2)
+	msg.AddPacket(p1)
+
+	if !bytes.Equal(msg.Bytes(), []byte("GET / HTTP/1.1\r\n\r\n")) || msg.Seq != seq {
+		t.Errorf("Should order packets across sequence wraparound: %q", msg.Bytes())
+	}
+}
+
+func TestTCPMessageSplitPipelined(t *testing.T) {
+	testCases := []struct {
+		direction bool
+		payloads  []string
+		first     string
+		rest      string
+	}{
+		{true, []string{"GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\n"}, "GET /a HTTP/1.1\r\n\r\n", "GET /b HTTP/1.1\r\n\r\n"},
+		{true, []string{"POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\na", "bGET / HTTP/1.1\r\n", "\r\n"}, "POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\nab", "GET / HTTP/1.1\r\n\r\n"},
+		{true, []string{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n0\r\n\r\n\r\n0\r\n\r\nGET / HTTP/1.1\r\n\r\n"}, "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n0\r\n\r\n\r\n0\r\n\r\n", "GET / HTTP/1.1\r\n\r\n"},
+		{false, []string{"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\naHTTP/1.1 200 OK\r\n\r\n"}, "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na", "HTTP/1.1 200 OK\r\n\r\n"},
+		// Informational response is not split from final one
+		{false, []string{"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\n\r\n"}, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\n\r\n", ""},
+	}
+
+	for _, tc := range testCases {
+		p := buildPacket(tc.direction, 1, 1, []byte(tc.payloads[0]), time.Now())
+		msg := NewTCPMessage(p.Seq, p.Ack, tc.direction, p.timestamp)
+		msg.AssocMessage = &TCPMessage{}
+		msg.AddPacket(p)
+
+		for _, payload := range tc.payloads[1:] {
+			p = nextPacket(p, []byte(payload))
+			msg.AddPacket(p)
+		}
+
+		var rest []byte
+		for _, p := range msg.splitPipelined() {
+			rest = append(rest, p.Data...)
+		}
+
+		if string(msg.Bytes()) != tc.first || string(rest) != tc.rest {
+			t.Errorf("Wrong split %q: %q %q", tc.payloads, msg.Bytes(), rest)
+		}
+
+		if msg.bufferedSize != len(tc.first) {
+			t.Errorf("Wrong buffered size %d of %q", msg.bufferedSize, tc.first)
+		}
+	}
+}
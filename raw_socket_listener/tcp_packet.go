@@ -39,8 +39,34 @@ type TCPPacket struct {
 	Raw       []byte
 	Data      []byte
 	Addr      []byte
+	DstAddr   []byte
 	timestamp time.Time
 	ID        tcpID
+
+	// Sequence number following packet data. Unlike Seq + len(Data), it does not change when data is modified.
+	nextSeq uint32
+	// Pooled buffer holding packet, see TCPMessage.Release
+	buf *packetBuffer
+}
+
+// seqLess compares sequence numbers, taking into account their wraparound
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// packetStream returns flow of TCP connection the packet belongs to. Destination address is unknown for packets of
+// some engines, which capture traffic of single host, so it is assumed to be the same as source one.
+func packetStream(p *TCPPacket, isIncoming bool) flowID {
+	dst := p.DstAddr
+	if dst == nil {
+		dst = p.Addr
+	}
+
+	if isIncoming {
+		return newFlowID(p.Addr, dst, p.SrcPort, p.DestPort)
+	}
+
+	return newFlowID(dst, p.Addr, p.DestPort, p.SrcPort)
 }
 
 // ParseTCPPacket takes address and tcp payload and returns parsed TCPPacket
@@ -80,6 +106,8 @@ func (t *TCPPacket) ParseBasic() {
 	if len(t.Raw) >= int(t.DataOffset*4) {
 		t.Data = t.Raw[t.DataOffset*4:]
 	}
+
+	t.nextSeq = t.Seq + uint32(len(t.Data))
 }
 
 func (t *TCPPacket) dump() *packet {
@@ -0,0 +1,136 @@
+package rawSocket
+
+import "encoding/binary"
+
+const (
+	ethernetHeaderSize = 14
+	ethernetTypeOffset = 12
+	ethernetTypeIPv4   = 0x0800
+	ethernetTypeIPv6   = 0x86DD
+
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+	ipProtoGRE = 47
+
+	// DefaultVXLANPort is IANA assigned VXLAN port, used by AWS VPC Traffic Mirroring
+	DefaultVXLANPort = 4789
+
+	greFlagChecksum = 0x80
+	greFlagKey      = 0x20
+	greFlagSequence = 0x10
+
+	greProtoTEB       = 0x6558 // Transparent Ethernet Bridging
+	greProtoERSPANII  = 0x88BE // ERSPAN type I and II
+	greProtoERSPANIII = 0x22EB
+)
+
+// ipPayload returns transport protocol and payload of IP packet
+func ipPayload(packet []byte) (proto uint8, payload []byte, ok bool) {
+	if len(packet) < 20 {
+		return
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0F) * 4
+		ipLength := int(binary.BigEndian.Uint16(packet[2:4]))
+
+		if ihl < 20 || ipLength < ihl || len(packet) < ipLength {
+			return
+		}
+
+		return packet[9], packet[ihl:ipLength], true
+	case 6:
+		return ipv6Payload(packet)
+	}
+
+	return
+}
+
+// tunnelPort returns VXLAN port if decapsulation is enabled, or 0 otherwise
+func (t *Listener) tunnelPort() uint16 {
+	if !t.engineConfig.Decapsulate {
+		return 0
+	}
+
+	if t.engineConfig.VXLANPort > 0 {
+		return uint16(t.engineConfig.VXLANPort)
+	}
+
+	return DefaultVXLANPort
+}
+
+// decapsulate extracts inner IP packet from VXLAN, GRE or ERSPAN tunnel.
+// Returns false if packet is not tunneled.
+func decapsulate(packet []byte, vxlanPort uint16) ([]byte, bool) {
+	proto, payload, ok := ipPayload(packet)
+	if !ok {
+		return nil, false
+	}
+
+	switch proto {
+	case ipProtoUDP:
+		// UDP header + VXLAN header, which should have "valid VNI" flag
+		if len(payload) < 16 || binary.BigEndian.Uint16(payload[2:4]) != vxlanPort || payload[8]&0x08 == 0 {
+			return nil, false
+		}
+
+		return ethernetPayload(payload[16:], nil)
+	case ipProtoGRE:
+		if len(payload) < 4 || payload[1]&0x07 != 0 {
+			return nil, false
+		}
+
+		flags := payload[0]
+		offset := 4
+		if flags&greFlagChecksum != 0 {
+			offset += 4
+		}
+		if flags&greFlagKey != 0 {
+			offset += 4
+		}
+		if flags&greFlagSequence != 0 {
+			offset += 4
+		}
+
+		if len(payload) < offset {
+			return nil, false
+		}
+
+		inner := payload[offset:]
+
+		switch binary.BigEndian.Uint16(payload[2:4]) {
+		case ethernetTypeIPv4, ethernetTypeIPv6:
+			return inner, true
+		case greProtoTEB:
+			return ethernetPayload(inner, nil)
+		case greProtoERSPANII:
+			// ERSPAN type I has no own header, and is sent without GRE sequence number
+			if flags&greFlagSequence == 0 {
+				return ethernetPayload(inner, nil)
+			}
+
+			if len(inner) < 8 {
+				return nil, false
+			}
+
+			return ethernetPayload(inner[8:], nil)
+		case greProtoERSPANIII:
+			if len(inner) < 12 {
+				return nil, false
+			}
+
+			// Optional platform specific sub-header
+			if inner[11]&0x01 != 0 {
+				if len(inner) < 20 {
+					return nil, false
+				}
+				return ethernetPayload(inner[20:], nil)
+			}
+
+			return ethernetPayload(inner[12:], nil)
+		}
+	}
+
+	return nil, false
+}
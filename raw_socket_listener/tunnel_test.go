@@ -0,0 +1,67 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func buildIPv4Packet(proto uint8, payload []byte) []byte {
+	ip := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, proto, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)+len(payload)))
+	return append(ip, payload...)
+}
+
+func buildEthernetFrame(packet []byte) []byte {
+	frame := make([]byte, ethernetHeaderSize)
+	binary.BigEndian.PutUint16(frame[ethernetTypeOffset:], ethernetTypeIPv4)
+	return append(frame, packet...)
+}
+
+func TestDecapsulate(t *testing.T) {
+	tcp := []byte{0x1f, 0x90, 0x00, 0x50, 0, 0, 0, 1, 0, 0, 0, 2, 0x50, 0x18, 0, 0, 0, 0, 0, 0}
+	inner := buildIPv4Packet(ipProtoTCP, append(tcp, []byte("GET / HTTP/1.1\r\n\r\n")...))
+
+	vxlan := []byte{0x30, 0x39, 0x12, 0xb5, 0, 0, 0, 0, 0x08, 0, 0, 0, 0, 0, 1, 0}
+	gre := func(flags uint8, proto uint16, extra ...byte) []byte {
+		h := []byte{flags, 0, byte(proto >> 8), byte(proto)}
+		return append(h, extra...)
+	}
+
+	cases := []struct {
+		name   string
+		packet []byte
+	}{
+		{"VXLAN", buildIPv4Packet(ipProtoUDP, append(vxlan, buildEthernetFrame(inner)...))},
+		{"GRE", buildIPv4Packet(ipProtoGRE, append(gre(0, ethernetTypeIPv4), inner...))},
+		{"GRE with key", buildIPv4Packet(ipProtoGRE, append(gre(greFlagKey, ethernetTypeIPv4, 0, 0, 0, 1), inner...))},
+		{"GRE TEB", buildIPv4Packet(ipProtoGRE, append(gre(0, greProtoTEB), buildEthernetFrame(inner)...))},
+		{"ERSPAN I", buildIPv4Packet(ipProtoGRE, append(gre(0, greProtoERSPANII), buildEthernetFrame(inner)...))},
+		{"ERSPAN II", buildIPv4Packet(ipProtoGRE, append(gre(greFlagSequence, greProtoERSPANII, 0, 0, 0, 1, 0x10, 0, 0, 1, 0, 0, 0, 0), buildEthernetFrame(inner)...))},
+		{"ERSPAN III", buildIPv4Packet(ipProtoGRE, append(gre(greFlagSequence, greProtoERSPANIII, 0, 0, 0, 1, 0x20, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0), buildEthernetFrame(inner)...))},
+	}
+
+	for _, c := range cases {
+		if data, ok := decapsulate(c.packet, DefaultVXLANPort); !ok || !bytes.Equal(data, inner) {
+			t.Errorf("%s: should extract inner packet %v", c.name, data)
+		}
+	}
+
+	if _, ok := decapsulate(inner, DefaultVXLANPort); ok {
+		t.Error("Should not decapsulate plain TCP packet")
+	}
+
+	if _, ok := decapsulate(cases[0].packet, 8472); ok {
+		t.Error("Should respect VXLAN port")
+	}
+
+	l := &Listener{port: 80, engineConfig: EngineConfig{Decapsulate: true}}
+	if _, _, data, ok := l.matchIPPacket(cases[0].packet, []byte{192, 168, 0, 1}); !ok || !bytes.Equal(data, inner[20:]) {
+		t.Error("Should match tunneled packet regardless of listen address")
+	}
+
+	l.engineConfig.Decapsulate = false
+	if _, _, _, ok := l.matchIPPacket(cases[0].packet, nil); ok {
+		t.Error("Should not match tunneled packet if decapsulation is disabled")
+	}
+}
@@ -0,0 +1,131 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Size of UDP header
+const udpHeaderSize = 8
+
+// flowID identifies packets exchanged by the same client and server: client IP, server IP, client port, server port
+type flowID [36]byte
+
+func newFlowID(clientIP, serverIP []byte, clientPort, serverPort uint16) (id flowID) {
+	copy(id[:16], net.IP(clientIP).To16())
+	copy(id[16:32], net.IP(serverIP).To16())
+	binary.BigEndian.PutUint16(id[32:34], clientPort)
+	binary.BigEndian.PutUint16(id[34:36], serverPort)
+
+	return
+}
+
+// udpDatagram checks UDP header and strips padding after datagram. Datagrams without payload are skipped.
+func udpDatagram(data []byte) ([]byte, bool) {
+	if len(data) < udpHeaderSize {
+		return nil, false
+	}
+
+	length := int(binary.BigEndian.Uint16(data[4:6]))
+	if length <= udpHeaderSize || length > len(data) {
+		return nil, false
+	}
+
+	return data[:length], true
+}
+
+// transportProtocol returns IP protocol number of captured traffic
+func (t *Listener) transportProtocol() uint8 {
+	if t.engineConfig.UDP {
+		return ipProtoUDP
+	}
+
+	return ipProtoTCP
+}
+
+// transportName returns name of captured protocol used in pcap expressions
+func (t *Listener) transportName() string {
+	if t.engineConfig.UDP {
+		return "udp"
+	}
+
+	return "tcp"
+}
+
+// processUDPPacket turns datagram into complete message. Unlike TCP, each datagram is a separate message,
+// and response is associated with the oldest unanswered request of the same flow.
+func (t *Listener) processUDPPacket(p *packet) {
+	datagram, ok := udpDatagram(p.data)
+	if !ok {
+		return
+	}
+
+	srcPort := binary.BigEndian.Uint16(datagram[0:2])
+	destPort := binary.BigEndian.Uint16(datagram[2:4])
+	isIncoming := t.isListenPort(destPort)
+
+	if isIncoming && t.engineConfig.DatagramFilter != nil && !t.engineConfig.DatagramFilter(datagram[udpHeaderSize:]) {
+		return
+	}
+
+	udpPacket := &TCPPacket{
+		SrcPort:   srcPort,
+		DestPort:  destPort,
+		Raw:       datagram,
+		Data:      datagram[udpHeaderSize:],
+		Addr:      p.srcIP,
+		DstAddr:   p.dstIP,
+		timestamp: p.timestamp,
+		buf:       p.buf,
+	}
+	copy(udpPacket.ID[:16], p.srcIP)
+	copy(udpPacket.ID[16:20], datagram[0:4])
+
+	message := NewTCPMessage(0, 0, isIncoming, p.timestamp)
+	message.packets = []*TCPPacket{udpPacket}
+	message.responseTracked = t.trackResponse
+	message.End = p.timestamp
+	message.complete = true
+
+	if isIncoming {
+		// Sequence makes UUID unique when datagrams are captured at the same time
+		t.udpSeq++
+		message.Seq = t.udpSeq
+
+		if t.trackResponse {
+			id := newFlowID(p.srcIP, p.dstIP, srcPort, destPort)
+			t.udpRequests[id] = append(t.udpRequests[id], message)
+		}
+	} else if !t.engineConfig.UnpairedDatagrams {
+		id := newFlowID(p.dstIP, p.srcIP, destPort, srcPort)
+		requests := t.udpRequests[id]
+		if len(requests) == 0 {
+			return
+		}
+
+		message.AssocMessage = requests[0]
+		if len(requests) == 1 {
+			delete(t.udpRequests, id)
+		} else {
+			t.udpRequests[id] = requests[1:]
+		}
+	}
+
+	t.messagesChan <- message
+}
+
+// expireUDPRequests forgets requests which were not answered in time
+func (t *Listener) expireUDPRequests(now time.Time) {
+	for id, requests := range t.udpRequests {
+		for len(requests) > 0 && now.Sub(requests[0].End) >= t.messageExpire {
+			requests = requests[1:]
+		}
+
+		if len(requests) == 0 {
+			delete(t.udpRequests, id)
+		} else {
+			t.udpRequests[id] = requests
+		}
+	}
+}
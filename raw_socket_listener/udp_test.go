@@ -0,0 +1,126 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func buildUDPDatagram(srcPort, dstPort uint16, payload []byte) []byte {
+	udp := make([]byte, udpHeaderSize)
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpHeaderSize+len(payload)))
+	return append(udp, payload...)
+}
+
+func TestDecodeUDPPacket(t *testing.T) {
+	datagram := buildUDPDatagram(5353, 53, []byte("query"))
+	packet := buildIPv4Packet(ipProtoUDP, datagram)
+
+	if _, _, data, ok := decodeIPPacket(packet, ipProtoUDP); !ok || !bytes.Equal(data, datagram) {
+		t.Error("Should decode datagram", data)
+	}
+
+	if _, _, _, ok := decodeIPPacket(packet, ipProtoTCP); ok {
+		t.Error("Should skip UDP packet when capturing TCP")
+	}
+
+	empty := buildIPv4Packet(ipProtoUDP, buildUDPDatagram(5353, 53, nil))
+	if _, _, _, ok := decodeIPPacket(empty, ipProtoUDP); ok {
+		t.Error("Should skip datagrams without payload")
+	}
+
+	l := &Listener{port: 53, engineConfig: EngineConfig{UDP: true}}
+	if _, _, _, ok := l.matchIPPacket(packet, nil); !ok {
+		t.Error("Should match datagram sent to listening port")
+	}
+}
+
+func TestUDPListenerRequestResponse(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{UDP: true})
+	defer listener.Close()
+
+	client, server := []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}
+	now := time.Now()
+
+	// Response without request is skipped
+	listener.packetsChan <- listener.buildPacket(server, client, buildUDPDatagram(0, 5000, []byte("orphan")), now)
+	listener.packetsChan <- listener.buildPacket(client, server, buildUDPDatagram(5000, 0, []byte("first")), now)
+	listener.packetsChan <- listener.buildPacket(client, server, buildUDPDatagram(5000, 0, []byte("second")), now)
+	listener.packetsChan <- listener.buildPacket(server, client, buildUDPDatagram(0, 5000, []byte("answer")), now.Add(time.Millisecond))
+
+	var messages []*TCPMessage
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			messages = append(messages, m)
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should return datagrams immediately")
+		}
+	}
+
+	first, second, resp := messages[0], messages[1], messages[2]
+	if !first.IsIncoming || string(first.Bytes()) != "first" || string(second.Bytes()) != "second" {
+		t.Fatal("Should return requests", string(first.Bytes()), string(second.Bytes()))
+	}
+
+	if bytes.Equal(first.UUID(), second.UUID()) {
+		t.Error("Datagrams captured at the same time should have different UUIDs")
+	}
+
+	if resp.IsIncoming || string(resp.Bytes()) != "answer" {
+		t.Fatal("Should return response", string(resp.Bytes()))
+	}
+
+	if resp.AssocMessage != first || !bytes.Equal(resp.UUID(), first.UUID()) {
+		t.Error("Response should belong to the oldest request of the flow")
+	}
+
+	if !resp.IP().Equal(server) {
+		t.Error("Wrong response address", resp.IP())
+	}
+}
+
+func TestUDPListenerDatagramFilter(t *testing.T) {
+	filter := func(payload []byte) bool {
+		return !bytes.HasPrefix(payload, []byte("skip"))
+	}
+
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false, EngineConfig{UDP: true, DatagramFilter: filter})
+	defer listener.Close()
+
+	client, server := []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}
+
+	listener.packetsChan <- listener.buildPacket(client, server, buildUDPDatagram(5000, 0, []byte("skip me")), time.Now())
+	listener.packetsChan <- listener.buildPacket(server, client, buildUDPDatagram(0, 5000, []byte("skipped answer")), time.Now())
+	listener.packetsChan <- listener.buildPacket(client, server, buildUDPDatagram(5001, 0, []byte("keep me")), time.Now())
+
+	select {
+	case m := <-listener.messagesChan:
+		if string(m.Bytes()) != "keep me" {
+			t.Error("Should skip filtered request and its response", string(m.Bytes()))
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Should return request")
+	}
+}
+
+func TestUDPListenerExpire(t *testing.T) {
+	l := &Listener{messageExpire: time.Second, udpRequests: make(map[flowID][]*TCPMessage)}
+	now := time.Now()
+
+	id := newFlowID([]byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}, 5000, 53)
+	l.udpRequests[id] = []*TCPMessage{{End: now.Add(-2 * time.Second)}, {End: now}}
+
+	l.expireUDPRequests(now)
+	if len(l.udpRequests[id]) != 1 {
+		t.Error("Should forget only expired requests", l.udpRequests[id])
+	}
+
+	l.expireUDPRequests(now.Add(time.Second))
+	if _, ok := l.udpRequests[id]; ok {
+		t.Error("Should delete flows without requests")
+	}
+}
@@ -0,0 +1,87 @@
+package rawSocket
+
+import "encoding/binary"
+
+const (
+	vlanTypeDot1Q  = 0x8100
+	vlanTypeDot1AD = 0x88A8 // QinQ outer tag
+	vlanTypeQinQ   = 0x9100 // Pre-standard QinQ outer tag
+
+	vlanTagSize = 4
+
+	// noVLAN is passed as TCI when frame has no tag stripped by NIC or kernel
+	noVLAN = -1
+)
+
+func isVLANType(etherType uint16) bool {
+	switch etherType {
+	case vlanTypeDot1Q, vlanTypeDot1AD, vlanTypeQinQ:
+		return true
+	}
+
+	return false
+}
+
+// innerVLANTag checks if data starts with VLAN tag followed by IP packet, rather than with IP header
+func innerVLANTag(data []byte) bool {
+	if len(data) < vlanTagSize {
+		return false
+	}
+
+	if version := data[0] >> 4; version == 4 || version == 6 {
+		return false
+	}
+
+	etherType := binary.BigEndian.Uint16(data[2:4])
+	return etherType == ethernetTypeIPv4 || etherType == ethernetTypeIPv6
+}
+
+func vlanMatches(tci int, vlans []int) bool {
+	for _, id := range vlans {
+		if tci&0x0FFF == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// skipVLANTags skips 802.1Q and 802.1ad (QinQ) tags at the beginning of data, which follows given ethertype,
+// and returns IP packet. If vlans filter is not empty, any of the tags, including tag stripped by NIC or kernel
+// and passed as tci, should match it.
+func skipVLANTags(etherType uint16, data []byte, tci int, vlans []int) ([]byte, bool) {
+	matched := len(vlans) == 0 || (tci != noVLAN && vlanMatches(tci, vlans))
+
+	// When outer tag is stripped, kernel may report ethertype of the innermost packet while inner tag is still in data
+	if tci != noVLAN && !isVLANType(etherType) && innerVLANTag(data) {
+		etherType = vlanTypeDot1Q
+	}
+
+	for isVLANType(etherType) {
+		if len(data) < vlanTagSize {
+			return nil, false
+		}
+
+		if !matched {
+			matched = vlanMatches(int(binary.BigEndian.Uint16(data[0:2])), vlans)
+		}
+
+		etherType = binary.BigEndian.Uint16(data[2:4])
+		data = data[vlanTagSize:]
+	}
+
+	if !matched || (etherType != ethernetTypeIPv4 && etherType != ethernetTypeIPv6) {
+		return nil, false
+	}
+
+	return data, true
+}
+
+// ethernetPayload strips ethernet header and VLAN tags from the frame
+func ethernetPayload(frame []byte, vlans []int) ([]byte, bool) {
+	if len(frame) < ethernetHeaderSize {
+		return nil, false
+	}
+
+	return skipVLANTags(binary.BigEndian.Uint16(frame[ethernetTypeOffset:]), frame[ethernetHeaderSize:], noVLAN, vlans)
+}
@@ -0,0 +1,85 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func buildVLANFrame(packet []byte, tags ...[2]uint16) []byte {
+	frame := make([]byte, ethernetTypeOffset)
+	for _, tag := range tags {
+		frame = append(frame, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(frame[len(frame)-4:], tag[0])
+		binary.BigEndian.PutUint16(frame[len(frame)-2:], tag[1])
+	}
+	frame = append(frame, 0x08, 0x00)
+	return append(frame, packet...)
+}
+
+func TestEthernetPayload(t *testing.T) {
+	frame := make([]byte, 34)
+	frame[12], frame[13] = 0x08, 0x00
+	frame[14] = 0x45
+
+	if data, ok := ethernetPayload(frame, nil); !ok || data[0] != 0x45 {
+		t.Error("Should strip ethernet header")
+	}
+
+	frame[12], frame[13] = 0x08, 0x06
+	if _, ok := ethernetPayload(frame, nil); ok {
+		t.Error("Should skip ARP")
+	}
+
+	if _, ok := ethernetPayload(frame[:10], nil); ok {
+		t.Error("Should skip truncated frames")
+	}
+}
+
+func TestVLANTags(t *testing.T) {
+	packet := buildIPv4Packet(ipProtoTCP, make([]byte, 20))
+
+	cases := []struct {
+		name  string
+		frame []byte
+		vlans []int
+		ok    bool
+	}{
+		{"untagged", buildEthernetFrame(packet), nil, true},
+		{"untagged with filter", buildEthernetFrame(packet), []int{100}, false},
+		{"802.1Q", buildVLANFrame(packet, [2]uint16{vlanTypeDot1Q, 100}), nil, true},
+		{"802.1Q matching filter", buildVLANFrame(packet, [2]uint16{vlanTypeDot1Q, 0x2000 | 100}), []int{200, 100}, true},
+		{"802.1Q not matching filter", buildVLANFrame(packet, [2]uint16{vlanTypeDot1Q, 101}), []int{100}, false},
+		{"QinQ", buildVLANFrame(packet, [2]uint16{vlanTypeDot1AD, 10}, [2]uint16{vlanTypeDot1Q, 100}), nil, true},
+		{"QinQ matching inner tag", buildVLANFrame(packet, [2]uint16{vlanTypeDot1AD, 10}, [2]uint16{vlanTypeDot1Q, 100}), []int{100}, true},
+		{"QinQ matching outer tag", buildVLANFrame(packet, [2]uint16{vlanTypeQinQ, 10}, [2]uint16{vlanTypeDot1Q, 100}), []int{10}, true},
+		{"truncated tag", buildVLANFrame(nil, [2]uint16{vlanTypeDot1Q, 100})[:16], nil, false},
+	}
+
+	for _, c := range cases {
+		data, ok := ethernetPayload(c.frame, c.vlans)
+		if ok != c.ok {
+			t.Errorf("%s: expected %v, got %v", c.name, c.ok, ok)
+		}
+		if ok && !bytes.Equal(data, packet) {
+			t.Errorf("%s: should return IP packet %v", c.name, data)
+		}
+	}
+
+	// Tag stripped by NIC is passed separately, and ethertype already points to IP
+	if _, ok := skipVLANTags(ethernetTypeIPv4, packet, 100, []int{100}); !ok {
+		t.Error("Should match stripped tag")
+	}
+
+	if _, ok := skipVLANTags(ethernetTypeIPv4, packet, 101, []int{100}); ok {
+		t.Error("Should not match stripped tag")
+	}
+
+	if data, ok := skipVLANTags(ethernetTypeIPv4, append([]byte{0, 100, 0x08, 0x00}, packet...), 10, []int{100}); !ok || !bytes.Equal(data, packet) {
+		t.Error("Should detect inner tag when kernel reports innermost ethertype")
+	}
+
+	if data, ok := skipVLANTags(vlanTypeDot1Q, append([]byte{0, 100, 0x08, 0x00}, packet...), 10, []int{100}); !ok || !bytes.Equal(data, packet) {
+		t.Error("Should match inner tag when outer tag is stripped")
+	}
+}
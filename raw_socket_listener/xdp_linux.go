@@ -0,0 +1,538 @@
+//go:build linux && !386
+// +build linux,!386
+
+package rawSocket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	afXDP  = 44
+	solXDP = 283
+
+	xdpMmapOffsets         = 1
+	xdpRxRing              = 2
+	xdpUmemReg             = 4
+	xdpUmemFillRing        = 5
+	xdpUmemCompletionRing  = 6
+	xdpStatisticsOpt       = 7
+	xdpPgoffRxRing         = 0
+	xdpUmemPgoffFillRing   = 0x100000000
+	xdpUmemPgoffCompletion = 0x180000000
+
+	xdpCopy     = 1 << 1
+	xdpZeroCopy = 1 << 2
+
+	bpfLinkCreate      = 28
+	bpfMapTypeXSKMap   = 17
+	bpfProgTypeXDP     = 6
+	bpfAttachTypeXDP   = 37
+	bpfFuncRedirectMap = 51
+	xdpFlagsSkbMode    = 1 << 1
+	xdpFlagsDrvMode    = 1 << 2
+	xdpActionPass      = 2
+	xdpMdRxQueueIndex  = 16
+	xdpDefaultUmemSize = 16 << 20
+	xdpFrameSize       = 4096
+	xdpDescSize        = 16
+)
+
+type xdpUmemRegAttr struct {
+	addr      uint64
+	len       uint64
+	chunkSize uint32
+	headroom  uint32
+}
+
+type xdpRingOffset struct {
+	producer uint64
+	consumer uint64
+	desc     uint64
+	flags    uint64
+}
+
+type xdpMmapOffsetsAttr struct {
+	rx xdpRingOffset
+	tx xdpRingOffset
+	fr xdpRingOffset
+	cr xdpRingOffset
+}
+
+type sockaddrXDP struct {
+	family       uint16
+	flags        uint16
+	ifindex      uint32
+	queueID      uint32
+	sharedUmemFd uint32
+}
+
+type bpfLinkCreateAttr struct {
+	progFd        uint32
+	targetIfindex uint32
+	attachType    uint32
+	flags         uint32
+}
+
+type xdpStatistics struct {
+	rxDropped            uint64
+	rxInvalidDescs       uint64
+	txInvalidDescs       uint64
+	rxRingFull           uint64
+	rxFillRingEmptyDescs uint64
+	txRingEmptyDescs     uint64
+}
+
+// xdpRing is single producer/single consumer ring shared with kernel
+type xdpRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	desc     int
+	mask     uint32
+}
+
+func mapXDPRing(fd int, offset int64, off xdpRingOffset, size, descSize int) (*xdpRing, error) {
+	mem, err := syscall.Mmap(fd, offset, int(off.desc)+size*descSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		return nil, err
+	}
+
+	return &xdpRing{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Pointer(&mem[off.producer])),
+		consumer: (*uint32)(unsafe.Pointer(&mem[off.consumer])),
+		desc:     int(off.desc),
+		mask:     uint32(size - 1),
+	}, nil
+}
+
+func (r *xdpRing) addr(i uint32) *uint64 {
+	return (*uint64)(unsafe.Pointer(&r.mem[r.desc+int(i&r.mask)*8]))
+}
+
+func (r *xdpRing) rxDesc(i uint32) (addr uint64, length uint32) {
+	p := r.desc + int(i&r.mask)*xdpDescSize
+	return *(*uint64)(unsafe.Pointer(&r.mem[p])), *(*uint32)(unsafe.Pointer(&r.mem[p+8]))
+}
+
+// Offsets of `data` and `data_end` fields in `struct xdp_md`
+const (
+	xdpMdData    = 0
+	xdpMdDataEnd = 4
+)
+
+// Offsets of IP header after Ethernet header without VLAN tags, and with up to 2 tags
+var xdpIPOffsets = []int32{ethernetHeaderSize, ethernetHeaderSize + vlanTagSize, ethernetHeaderSize + 2*vlanTagSize}
+
+// xdpRedirectProgram builds XDP program passing packets from each RX queue to AF_XDP socket bound to it. Only
+// packets matched like by socket filter of eBPF engine, TCP or UDP depending on protocol sent to given ports, or from
+// them if responses are tracked, and VXLAN and GRE packets if vxlanPort is not 0, are redirected. Other packets, and
+// packets of queues without socket, are passed to kernel network stack as usual, so host keeps its own traffic, like
+// SSH. IP fragments of captured protocol are redirected, as only the first of them has ports. IPv6 packets with
+// extension headers are passed to kernel.
+func xdpRedirectProgram(mapFd int, ports []portRange, protocol uint8, trackResponse bool, vxlanPort uint16) []bpfInsn {
+	a := &bpfAsm{}
+	vlanTypes := []uint16{vlanTypeDot1Q, vlanTypeDot1AD, vlanTypeQinQ}
+
+	// R6 = ctx, R2 = data, R3 = data_end
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR6, bpfR1, 0, 0))
+	a.emit(newInsn(bpfLDX|bpfW|bpfMEM, bpfR2, bpfR6, xdpMdData, 0))
+	a.emit(newInsn(bpfLDX|bpfW|bpfMEM, bpfR3, bpfR6, xdpMdDataEnd, 0))
+
+	// Packet pointers can't be offset by values loaded from packet before bounds check, so each number of VLAN
+	// tags has its own code with constant offsets
+	for i, l3 := range xdpIPOffsets {
+		suffix := strconv.Itoa(int(l3))
+		a.label("eth" + suffix)
+		a.emitPacketBoundsCheck(bpfR2, l3, "pass")
+		a.emitLoadPacketHalf(bpfR2, int16(l3-2))
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, ethernetTypeIPv4), "ipv4"+suffix)
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, ethernetTypeIPv6), "ipv6"+suffix)
+		if i+1 < len(xdpIPOffsets) {
+			for _, vlanType := range vlanTypes {
+				a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, int32(vlanType)), "eth"+strconv.Itoa(int(xdpIPOffsets[i+1])))
+			}
+		}
+		a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "pass")
+
+		// IPv4: R8 = protocol, R7 = transport header
+		a.label("ipv4" + suffix)
+		a.emitPacketBoundsCheck(bpfR2, l3+20, "pass")
+		a.emit(newInsn(bpfLDX|bpfB|bpfMEM, bpfR8, bpfR2, int16(l3+9), 0))
+		a.emitLoadPacketHalf(bpfR2, int16(l3+6))
+		a.emit(newInsn(bpfALU64|bpfAND|bpfK, bpfR0, 0, 0, ipv4FlagMoreFragments|ipv4FragmentOffset))
+		a.jump(newInsn(bpfJMP|bpfJNE|bpfK, bpfR0, 0, 0, 0), "fragment")
+		a.emit(newInsn(bpfLDX|bpfB|bpfMEM, bpfR0, bpfR2, int16(l3), 0))
+		a.emit(newInsn(bpfALU64|bpfAND|bpfK, bpfR0, 0, 0, 0x0f))
+		a.emit(newInsn(bpfALU64|bpfLSH|bpfK, bpfR0, 0, 0, 2))
+		a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR7, bpfR2, 0, 0))
+		a.emit(newInsn(bpfALU64|bpfADD|bpfK, bpfR7, 0, 0, l3))
+		a.emit(newInsn(bpfALU64|bpfADD|bpfX, bpfR7, bpfR0, 0, 0))
+		a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "transport")
+
+		// IPv6: R8 = next header, R7 = transport header
+		a.label("ipv6" + suffix)
+		a.emitPacketBoundsCheck(bpfR2, l3+ipv6HeaderSize, "pass")
+		a.emit(newInsn(bpfLDX|bpfB|bpfMEM, bpfR8, bpfR2, int16(l3+6), 0))
+		a.emit(newInsn(bpfALU64|bpfMOV|bpfX, bpfR7, bpfR2, 0, 0))
+		a.emit(newInsn(bpfALU64|bpfADD|bpfK, bpfR7, 0, 0, l3+ipv6HeaderSize))
+		a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "transport")
+	}
+
+	// TCP and UDP headers both start with source and destination ports
+	a.label("transport")
+	a.emitPacketBoundsCheck(bpfR7, 4, "pass")
+	if vxlanPort != 0 {
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipProtoGRE), "redirect")
+		a.jump(newInsn(bpfJMP|bpfJNE|bpfK, bpfR8, 0, 0, ipProtoUDP), "ports")
+		a.emitLoadPacketHalf(bpfR7, 2)
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR0, 0, 0, int32(vxlanPort)), "redirect")
+		a.label("ports")
+	}
+	a.jump(newInsn(bpfJMP|bpfJNE|bpfK, bpfR8, 0, 0, int32(protocol)), "pass")
+	if trackResponse {
+		a.emitLoadPacketHalf(bpfR7, 0)
+		a.emitPortMatch(ports, "redirect")
+	}
+	a.emitLoadPacketHalf(bpfR7, 2)
+	a.emitPortMatch(ports, "redirect")
+	a.jump(newInsn(bpfJMP|bpfJA, 0, 0, 0, 0), "pass")
+
+	a.label("fragment")
+	a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, int32(protocol)), "redirect")
+	if vxlanPort != 0 {
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipProtoGRE), "redirect")
+		a.jump(newInsn(bpfJMP|bpfJEQ|bpfK, bpfR8, 0, 0, ipProtoUDP), "redirect")
+	}
+
+	a.label("pass")
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfK, bpfR0, 0, 0, xdpActionPass))
+	a.emit(newInsn(bpfJMP|bpfEXIT, 0, 0, 0, 0))
+
+	a.label("redirect")
+	// R2 = ctx->rx_queue_index
+	a.emit(newInsn(bpfLDX|bpfW|bpfMEM, bpfR2, bpfR6, xdpMdRxQueueIndex, 0))
+	// R1 = map, 64 bit immediate load takes two instructions
+	a.emit(newInsn(bpfLD|bpfDW|bpfIMM, bpfR1, bpfPseudoMapFd, 0, int32(mapFd)))
+	a.emit(newInsn(0, 0, 0, 0, 0))
+	// R3 = action used if queue has no socket
+	a.emit(newInsn(bpfALU64|bpfMOV|bpfK, bpfR3, 0, 0, xdpActionPass))
+	a.emit(newInsn(bpfJMP|bpfCALL, 0, 0, 0, bpfFuncRedirectMap))
+	a.emit(newInsn(bpfJMP|bpfEXIT, 0, 0, 0, 0))
+
+	return a.assemble()
+}
+
+type xdpSocket struct {
+	fd      int
+	queue   int
+	iface   string
+	umem    []byte
+	fill    *xdpRing
+	rx      *xdpRing
+	packets uint64
+}
+
+func newXDPSocket(ifindex, queue, umemSize int) (s *xdpSocket, err error) {
+	s = &xdpSocket{queue: queue, iface: interfaceName(ifindex)}
+
+	if s.fd, err = syscall.Socket(afXDP, syscall.SOCK_RAW, 0); err != nil {
+		return nil, fmt.Errorf("can't open AF_XDP socket: %v", err)
+	}
+
+	if err = s.setup(ifindex, umemSize); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *xdpSocket) setup(ifindex, umemSize int) (err error) {
+	frames := umemSize / xdpFrameSize
+	// Ring sizes should be power of 2
+	ringSize := 1
+	for ringSize*2 <= frames {
+		ringSize *= 2
+	}
+	if ringSize < 64 {
+		return errors.New("UMEM size is too small")
+	}
+
+	if s.umem, err = syscall.Mmap(-1, 0, frames*xdpFrameSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS); err != nil {
+		return fmt.Errorf("can't allocate UMEM: %v", err)
+	}
+
+	reg := xdpUmemRegAttr{
+		addr:      uint64(uintptr(unsafe.Pointer(&s.umem[0]))),
+		len:       uint64(len(s.umem)),
+		chunkSize: xdpFrameSize,
+	}
+	if err = setsockopt(s.fd, solXDP, xdpUmemReg, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return fmt.Errorf("can't register UMEM: %v", err)
+	}
+
+	for _, opt := range []int{xdpUmemFillRing, xdpUmemCompletionRing, xdpRxRing} {
+		if err = syscall.SetsockoptInt(s.fd, solXDP, opt, ringSize); err != nil {
+			return fmt.Errorf("can't setup XDP ring: %v", err)
+		}
+	}
+
+	var off xdpMmapOffsetsAttr
+	if err = getsockopt(s.fd, solXDP, xdpMmapOffsets, unsafe.Pointer(&off), unsafe.Sizeof(off)); err != nil {
+		return fmt.Errorf("can't get XDP ring offsets: %v", err)
+	}
+
+	if s.fill, err = mapXDPRing(s.fd, xdpUmemPgoffFillRing, off.fr, ringSize, 8); err != nil {
+		return fmt.Errorf("can't map fill ring: %v", err)
+	}
+
+	if s.rx, err = mapXDPRing(s.fd, xdpPgoffRxRing, off.rx, ringSize, xdpDescSize); err != nil {
+		return fmt.Errorf("can't map RX ring: %v", err)
+	}
+
+	// Give all frames to the kernel
+	for i := 0; i < ringSize; i++ {
+		*s.fill.addr(uint32(i)) = uint64(i * xdpFrameSize)
+	}
+	atomic.StoreUint32(s.fill.producer, uint32(ringSize))
+
+	// Zero-copy requires driver support, so trying it first
+	for _, mode := range []uint16{xdpZeroCopy, xdpCopy} {
+		sa := sockaddrXDP{family: afXDP, flags: mode, ifindex: uint32(ifindex), queueID: uint32(s.queue)}
+		_, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(s.fd), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+		if errno == 0 {
+			if mode == xdpCopy {
+				log.Println("AF_XDP: zero-copy is not supported by driver, using copy mode for queue", s.queue)
+			}
+			return nil
+		}
+		err = errno
+	}
+
+	return fmt.Errorf("can't bind AF_XDP socket to queue %d: %v", s.queue, err)
+}
+
+func (s *xdpSocket) close() {
+	for _, r := range []*xdpRing{s.fill, s.rx} {
+		if r != nil {
+			syscall.Munmap(r.mem)
+		}
+	}
+	syscall.Close(s.fd)
+	if s.umem != nil {
+		syscall.Munmap(s.umem)
+	}
+}
+
+func (s *xdpSocket) read(t *Listener, listenIP net.IP) {
+	defer s.close()
+
+	for {
+		cons := atomic.LoadUint32(s.rx.consumer)
+		prod := atomic.LoadUint32(s.rx.producer)
+
+		if cons == prod {
+			pfd := pollFd{fd: int32(s.fd), events: 0x1}
+			ts := syscall.NsecToTimespec(int64(time.Second))
+			syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+
+			select {
+			case <-t.quit:
+				return
+			default:
+			}
+			continue
+		}
+
+		fillProd := atomic.LoadUint32(s.fill.producer)
+
+		for i := cons; i != prod; i++ {
+			addr, length := s.rx.rxDesc(i)
+
+			if data, ok := ethernetPayload(s.umem[addr:addr+uint64(length)], t.engineConfig.VLANs); ok {
+				if srcIP, dstIP, tcp, ok := t.matchIPPacket(data, listenIP); ok {
+					// Frame is returned to kernel, so packet should have its own copy
+					t.packetsChan <- t.copyPacket(srcIP, dstIP, tcp, time.Now())
+					atomic.AddUint64(&s.packets, 1)
+				}
+			}
+
+			// Same frame goes back to the fill ring, which has room for every frame
+			*s.fill.addr(fillProd) = addr &^ (xdpFrameSize - 1)
+			fillProd++
+		}
+
+		atomic.StoreUint32(s.rx.consumer, prod)
+		atomic.StoreUint32(s.fill.producer, fillProd)
+	}
+}
+
+func (s *xdpSocket) stats() CaptureStats {
+	var st xdpStatistics
+	getsockopt(s.fd, solXDP, xdpStatisticsOpt, unsafe.Pointer(&st), unsafe.Sizeof(st))
+
+	pending := atomic.LoadUint32(s.rx.producer) - atomic.LoadUint32(s.rx.consumer)
+
+	return CaptureStats{
+		Worker:      s.queue,
+		Interface:   s.iface,
+		Packets:     atomic.LoadUint64(&s.packets),
+		KernelDrops: st.rxDropped + st.rxRingFull,
+		RingUsage:   float64(pending) / float64(s.rx.mask+1),
+		FreezeCount: st.rxFillRingEmptyDescs,
+	}
+}
+
+func registerXDPSocket(mapFd int, s *xdpSocket) error {
+	key, value := uint32(s.queue), uint32(s.fd)
+	attr := bpfMapUpdateAttr{
+		mapFd: uint32(mapFd),
+		key:   uint64(uintptr(unsafe.Pointer(&key))),
+		value: uint64(uintptr(unsafe.Pointer(&value))),
+	}
+	_, err := bpf(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// startXDP binds AF_XDP socket to each of the queues, and attaches XDP program redirecting their packets.
+// Returned file descriptors keep program attached and should be closed once capture is finished.
+func (t *Listener) startXDP(ifindex int, queues []int, umemSize int) (sockets []*xdpSocket, fds []int, err error) {
+	defer func() {
+		if err != nil {
+			for _, s := range sockets {
+				s.close()
+			}
+			for _, fd := range fds {
+				syscall.Close(fd)
+			}
+		}
+	}()
+
+	maxQueue := 0
+	for _, q := range queues {
+		if q > maxQueue {
+			maxQueue = q
+		}
+	}
+
+	mapAttr := bpfMapCreateAttr{mapType: bpfMapTypeXSKMap, keySize: 4, valueSize: 4, maxEntries: uint32(maxQueue + 1)}
+	mapFd, err := bpf(bpfMapCreate, unsafe.Pointer(&mapAttr), unsafe.Sizeof(mapAttr))
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't create XSKMAP: %v", err)
+	}
+	fds = append(fds, mapFd)
+
+	progFd, err := loadBPFProgram(bpfProgTypeXDP, xdpRedirectProgram(mapFd, t.listenPorts(), t.transportProtocol(), t.trackResponse, t.tunnelPort()))
+	if err != nil {
+		return
+	}
+	fds = append(fds, progFd)
+
+	for _, q := range queues {
+		var s *xdpSocket
+		if s, err = newXDPSocket(ifindex, q, umemSize); err != nil {
+			return
+		}
+		sockets = append(sockets, s)
+
+		if err = registerXDPSocket(mapFd, s); err != nil {
+			err = fmt.Errorf("can't register AF_XDP socket: %v", err)
+			return
+		}
+	}
+
+	// Native mode requires driver support, generic mode works everywhere.
+	// Program is detached automatically once link gets closed, even if process crashes.
+	var linkFd int
+	for _, mode := range []uint32{xdpFlagsDrvMode, xdpFlagsSkbMode} {
+		linkAttr := bpfLinkCreateAttr{progFd: uint32(progFd), targetIfindex: uint32(ifindex), attachType: bpfAttachTypeXDP, flags: mode}
+		if linkFd, err = bpf(bpfLinkCreate, unsafe.Pointer(&linkAttr), unsafe.Sizeof(linkAttr)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("can't attach XDP program: %v", err)
+		return
+	}
+	fds = append(fds, linkFd)
+
+	return
+}
+
+// readXDP captures traffic using AF_XDP sockets. XDP program redirects packets of listening ports from selected NIC
+// queues straight into memory shared with user space, bypassing kernel network stack. It means redirected packets
+// do not reach local applications, so it should be used on interfaces receiving mirrored traffic. Other packets
+// are passed to kernel.
+// Each of listened interfaces gets its own program and sockets. If AF_XDP is not supported, falls back to libpcap.
+func (t *Listener) readXDP() {
+	config := t.engineConfig
+	if len(config.XDPQueues) == 0 {
+		config.XDPQueues = []int{0}
+	}
+	if config.XDPUmemSize <= 0 {
+		config.XDPUmemSize = xdpDefaultUmemSize
+	}
+
+	ifaces := t.listenInterfaces()
+	if ifaces == nil {
+		log.Println("AF_XDP engine requires interfaces to be specified, falling back to libpcap")
+		t.readPcap()
+		return
+	}
+
+	var sockets []*xdpSocket
+	var fds []int
+	for ifindex := range ifaces {
+		s, f, err := t.startXDP(ifindex, config.XDPQueues, config.XDPUmemSize)
+		if err != nil {
+			for _, s := range sockets {
+				s.close()
+			}
+			for _, fd := range fds {
+				syscall.Close(fd)
+			}
+
+			log.Println("AF_XDP engine is not supported, falling back to libpcap:", err)
+			t.readPcap()
+			return
+		}
+		sockets = append(sockets, s...)
+		fds = append(fds, f...)
+	}
+	defer func() {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+	}()
+
+	listenIP := t.listenIP()
+
+	var wg sync.WaitGroup
+	for i, s := range sockets {
+		t.mu.Lock()
+		t.workers = append(t.workers, s)
+		t.mu.Unlock()
+
+		wg.Add(1)
+		go func(id int, s *xdpSocket) {
+			defer wg.Done()
+			t.pinCaptureThread(id)
+			s.read(t, listenIP)
+		}(i, s)
+	}
+
+	t.readyCh <- true
+
+	wg.Wait()
+}
@@ -0,0 +1,148 @@
+//go:build linux && !386
+// +build linux,!386
+
+package rawSocket
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+const (
+	bpfProgTestRun    = 10
+	bpfMapTypeDevMap  = 14
+	xdpActionRedirect = 4
+)
+
+type bpfTestRunAttr struct {
+	progFd      uint32
+	retval      uint32
+	dataSizeIn  uint32
+	dataSizeOut uint32
+	dataIn      uint64
+	dataOut     uint64
+	repeat      uint32
+	duration    uint32
+}
+
+func TestXDPRedirectProgramLoad(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Loading XDP programs requires root")
+	}
+
+	attr := bpfMapCreateAttr{mapType: bpfMapTypeXSKMap, keySize: 4, valueSize: 4, maxEntries: 4}
+	mapFd, err := bpf(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		t.Skip("XSKMAP is not supported", err)
+	}
+	defer syscall.Close(mapFd)
+
+	for _, track := range []bool{false, true} {
+		for _, vxlanPort := range []uint16{0, DefaultVXLANPort} {
+			for _, protocol := range []uint8{ipProtoTCP, ipProtoUDP} {
+				progFd, err := loadBPFProgram(bpfProgTypeXDP, xdpRedirectProgram(mapFd, []portRange{{80, 80}, {8000, 8100}}, protocol, track, vxlanPort))
+				if err != nil {
+					t.Fatal(err)
+				}
+				syscall.Close(progFd)
+			}
+		}
+	}
+}
+
+// xdpTestFrame builds Ethernet frame with given VLAN tags, and IPv4 or IPv6 packet with TCP or UDP ports
+func xdpTestFrame(vlans int, ipv6 bool, protocol uint8, src, dst uint16) []byte {
+	frame := make([]byte, 12)
+	for i := 0; i < vlans; i++ {
+		frame = append(frame, 0x81, 0x00, 0, 1)
+	}
+
+	var ip []byte
+	if ipv6 {
+		frame = append(frame, 0x86, 0xdd)
+		ip = make([]byte, ipv6HeaderSize)
+		ip[0], ip[6] = 0x60, protocol
+	} else {
+		frame = append(frame, 0x08, 0x00)
+		ip = make([]byte, 20)
+		ip[0], ip[9] = 0x45, protocol
+	}
+
+	ports := make([]byte, 20)
+	binary.BigEndian.PutUint16(ports[0:], src)
+	binary.BigEndian.PutUint16(ports[2:], dst)
+
+	return append(append(frame, ip...), ports...)
+}
+
+func TestXDPRedirectProgramFilter(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Running XDP programs requires root")
+	}
+
+	// Device map redirects like XSKMAP with socket, which can't be bound in test
+	attr := bpfMapCreateAttr{mapType: bpfMapTypeDevMap, keySize: 4, valueSize: 4, maxEntries: 1}
+	mapFd, err := bpf(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		t.Skip("DEVMAP is not supported", err)
+	}
+	defer syscall.Close(mapFd)
+
+	key, ifindex := uint32(0), uint32(1)
+	update := bpfMapUpdateAttr{mapFd: uint32(mapFd), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&ifindex)))}
+	if _, err := bpf(bpfMapUpdateElem, unsafe.Pointer(&update), unsafe.Sizeof(update)); err != nil {
+		t.Skip("Can't update DEVMAP", err)
+	}
+
+	progFd, err := loadBPFProgram(bpfProgTypeXDP, xdpRedirectProgram(mapFd, []portRange{{80, 80}, {8000, 8100}}, ipProtoTCP, true, DefaultVXLANPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(progFd)
+
+	run := func(frame []byte) uint32 {
+		out := make([]byte, len(frame)+256)
+		attr := bpfTestRunAttr{
+			progFd:      uint32(progFd),
+			dataSizeIn:  uint32(len(frame)),
+			dataSizeOut: uint32(len(out)),
+			dataIn:      uint64(uintptr(unsafe.Pointer(&frame[0]))),
+			dataOut:     uint64(uintptr(unsafe.Pointer(&out[0]))),
+			repeat:      1,
+		}
+		if _, err := bpf(bpfProgTestRun, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+			t.Skip("Can't run XDP program", err)
+		}
+		return attr.retval
+	}
+
+	cases := []struct {
+		name     string
+		frame    []byte
+		redirect bool
+	}{
+		{"request", xdpTestFrame(0, false, ipProtoTCP, 50000, 80), true},
+		{"response", xdpTestFrame(0, false, ipProtoTCP, 8050, 50000), true},
+		{"port range", xdpTestFrame(0, false, ipProtoTCP, 50000, 8100), true},
+		{"ipv6", xdpTestFrame(0, true, ipProtoTCP, 50000, 80), true},
+		{"vlan", xdpTestFrame(1, false, ipProtoTCP, 50000, 80), true},
+		{"qinq", xdpTestFrame(2, true, ipProtoTCP, 50000, 8000), true},
+		{"vxlan", xdpTestFrame(0, false, ipProtoUDP, 50000, DefaultVXLANPort), true},
+		{"gre", xdpTestFrame(0, false, ipProtoGRE, 0, 0), true},
+		{"ssh", xdpTestFrame(0, false, ipProtoTCP, 50000, 22), false},
+		{"ssh over vlan", xdpTestFrame(1, true, ipProtoTCP, 22, 50000), false},
+		{"udp", xdpTestFrame(0, false, ipProtoUDP, 50000, 80), false},
+		{"arp", append(make([]byte, 12), 0x08, 0x06, 0, 1, 8, 0, 6, 4, 0, 1), false},
+		{"truncated", xdpTestFrame(0, false, ipProtoTCP, 50000, 80)[:36], false},
+	}
+
+	for _, c := range cases {
+		retval := run(c.frame)
+		if c.redirect && retval != xdpActionRedirect || !c.redirect && retval != xdpActionPass {
+			t.Errorf("%s: expected redirect %v, got action %d", c.name, c.redirect, retval)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux || 386
+// +build !linux 386
+
+package rawSocket
+
+import "log"
+
+func (t *Listener) readXDP() {
+	log.Println("AF_XDP engine is supported only on Linux, falling back to libpcap")
+	t.readPcap()
+}
@@ -0,0 +1,134 @@
+package goreplay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Headers carrying credentials, they are always redacted
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// headerRedactor removes credentials from HTTP payloads before they are persisted by file or Kafka outputs. Headers
+// are stripped, or their values are replaced with SHA-256 hash, so requests of the same user can still be correlated.
+type headerRedactor struct {
+	headers [][]byte
+	hash    bool
+}
+
+// newHeaderRedactor returns redactor for `strip` or `hash` mode, extra headers are redacted together with defaults
+func newHeaderRedactor(mode string, extra []string) (*headerRedactor, error) {
+	r := new(headerRedactor)
+
+	switch mode {
+	case "strip":
+	case "hash":
+		r.hash = true
+	default:
+		return nil, fmt.Errorf("expected strip or hash, got %q", mode)
+	}
+
+	for _, name := range append(defaultRedactedHeaders, extra...) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		r.headers = append(r.headers, []byte(name))
+	}
+
+	return r, nil
+}
+
+// Transform redacts payload, so redactor can be used as Transformer of any output
+func (r *headerRedactor) Transform(payload []byte) []byte {
+	return r.Redact(payload)
+}
+
+// Redact returns payload without sensitive headers. Payload is returned as is if it is not HTTP, or it is a chunk
+// which continues message, since headers are in the first chunk.
+func (r *headerRedactor) Redact(payload []byte) []byte {
+	if len(payload) == 0 || !isOriginPayload(payload) {
+		return payload
+	}
+
+	if index, _, ok := payloadChunk(payload); ok && index > 0 {
+		return payload
+	}
+
+	headerSize := bytes.IndexByte(payload, '\n') + 1
+	body := payload[headerSize:]
+	if !proto.IsHTTPPayload(body) && !bytes.HasPrefix(body, []byte("HTTP/")) {
+		return payload
+	}
+
+	// Headers of large message can be split between chunks, then the whole first chunk is checked
+	end := bytes.Index(body, proto.EmptyLine)
+	if end == -1 {
+		end = len(body)
+	} else {
+		end += len(proto.CLRF)
+	}
+
+	start := bytes.Index(body[:end], proto.CLRF)
+	if start == -1 {
+		return payload
+	}
+	start += len(proto.CLRF)
+
+	var out []byte
+	last := 0
+	for pos := start; pos < end; {
+		lineEnd := bytes.Index(body[pos:end], proto.CLRF)
+		if lineEnd == -1 {
+			lineEnd = end
+		} else {
+			lineEnd += pos + len(proto.CLRF)
+		}
+
+		line := body[pos:lineEnd]
+		if colon := bytes.IndexByte(line, ':'); colon > 0 && r.sensitive(line[:colon]) {
+			if out == nil {
+				out = make([]byte, 0, len(payload))
+				out = append(out, payload[:headerSize]...)
+			}
+			out = append(out, body[last:pos]...)
+
+			if r.hash {
+				out = append(out, line[:colon]...)
+				out = append(out, ": "...)
+				out = append(out, hashHeaderValue(line[colon+1:])...)
+				if bytes.HasSuffix(line, proto.CLRF) {
+					out = append(out, proto.CLRF...)
+				}
+			}
+			last = lineEnd
+		}
+
+		pos = lineEnd
+	}
+
+	if out == nil {
+		return payload
+	}
+
+	return append(out, body[last:]...)
+}
+
+func (r *headerRedactor) sensitive(name []byte) bool {
+	for _, h := range r.headers {
+		if bytes.EqualFold(h, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hashHeaderValue(value []byte) string {
+	sum := sha256.Sum256(bytes.TrimSpace(value))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,65 @@
+package goreplay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+func TestHeaderRedactor(t *testing.T) {
+	strip, _ := newHeaderRedactor("strip", []string{"X-Api-Key"})
+	hash, _ := newHeaderRedactor("hash", nil)
+
+	sum := sha256.Sum256([]byte("Bearer token"))
+	hashed := "sha256:" + hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		redactor *headerRedactor
+		payload  string
+		expected string
+	}{
+		{strip, "1 a 1\nGET / HTTP/1.1\r\nHost: a\r\nAuthorization: Bearer token\r\n\r\n", "1 a 1\nGET / HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{strip, "1 a 1\nGET / HTTP/1.1\r\nCookie: a=1\r\nHost: a\r\ncookie: b=2\r\nx-api-key: 1\r\n\r\nbody", "1 a 1\nGET / HTTP/1.1\r\nHost: a\r\n\r\nbody"},
+		{strip, "2 a 1 2\nHTTP/1.1 200 OK\r\nSet-Cookie: a=1\r\nContent-Length: 0\r\n\r\n", "2 a 1 2\nHTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+		{strip, "1 a 1\nGET / HTTP/1.1\r\nCookies-Enabled: 1\r\n\r\n", "1 a 1\nGET / HTTP/1.1\r\nCookies-Enabled: 1\r\n\r\n"},
+		{strip, "1 a 1 c1\nCookie: a=1\r\n\r\n", "1 a 1 c1\nCookie: a=1\r\n\r\n"},
+		{strip, "3 a 1 2\nGET / HTTP/1.1\r\nCookie: a=1\r\n\r\n", "3 a 1 2\nGET / HTTP/1.1\r\nCookie: a=1\r\n\r\n"},
+		{hash, "1 a 1\nGET / HTTP/1.1\r\nAuthorization:  Bearer token \r\nX-Api-Key: 1\r\n\r\n", "1 a 1\nGET / HTTP/1.1\r\nAuthorization: " + hashed + "\r\nX-Api-Key: 1\r\n\r\n"},
+	}
+
+	for i, tc := range tests {
+		if got := string(tc.redactor.Redact([]byte(tc.payload))); got != tc.expected {
+			t.Errorf("%d: expected %q, got %q", i, tc.expected, got)
+		}
+	}
+
+	if _, err := newHeaderRedactor("mask", nil); err == nil {
+		t.Error("Unknown mode should not be accepted")
+	}
+}
+
+func TestOutputKafkaRedact(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, config)
+	producer.ExpectInputAndSucceed()
+
+	redactor, _ := newHeaderRedactor("strip", nil)
+	output := NewKafkaOutput("", &KafkaConfig{
+		producer: producer,
+		topic:    "test",
+		redactor: redactor,
+	})
+
+	output.Write([]byte("1 2 3\nGET / HTTP/1.1\r\nCookie: a=1\r\nHeader: 1\r\n\r\n"))
+
+	resp := <-producer.Successes()
+	data, _ := resp.Value.Encode()
+
+	if string(data) != "1 2 3\nGET / HTTP/1.1\r\nHeader: 1\r\n\r\n" {
+		t.Error("Cookie should be removed: ", string(data))
+	}
+}
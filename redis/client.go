@@ -0,0 +1,102 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds connection options
+type Config struct {
+	// User of ACL, password is checked for default user if it is empty
+	User     string
+	Password string
+	Timeout  time.Duration
+}
+
+// Conn is a client connection replaying captured commands
+type Conn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	config Config
+	db     int
+}
+
+// Error is an error returned by server
+type Error struct {
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "Redis error: " + e.Message
+}
+
+// Dial connects to server, and authenticates if password is set
+func Dial(address string, config Config) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{conn: conn, r: bufio.NewReader(conn), config: config}
+
+	if config.Password != "" {
+		args := [][]byte{[]byte("AUTH"), []byte(config.Password)}
+		if config.User != "" {
+			args = [][]byte{[]byte("AUTH"), []byte(config.User), []byte(config.Password)}
+		}
+
+		if err = c.call(args); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *Conn) command(args [][]byte) ([]byte, error) {
+	if c.config.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	}
+
+	if _, err := c.conn.Write(AppendCommand(nil, args)); err != nil {
+		return nil, err
+	}
+
+	return ReadReply(c.r)
+}
+
+// call sends command, and returns error reply as error
+func (c *Conn) call(args [][]byte) error {
+	reply, err := c.command(args)
+	if err != nil {
+		return err
+	}
+
+	if reply[0] == '-' {
+		return &Error{Message: strings.TrimSuffix(string(reply[1:]), "\r\n")}
+	}
+
+	return nil
+}
+
+// Exec replays command, and returns raw server reply. Errors returned by server are returned as reply.
+func (c *Conn) Exec(cmd *Command) ([]byte, error) {
+	if cmd.DB != c.db {
+		if err := c.call([][]byte{[]byte("SELECT"), []byte(strconv.Itoa(cmd.DB))}); err != nil {
+			return nil, err
+		}
+		c.db = cmd.DB
+	}
+
+	return c.command(cmd.Args)
+}
+
+// Close sends QUIT, and closes connection
+func (c *Conn) Close() error {
+	c.conn.Write(AppendCommand(nil, [][]byte{[]byte("QUIT")}))
+	return c.conn.Close()
+}
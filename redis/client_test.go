@@ -0,0 +1,90 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer accepts single connection, checks password, and answers commands with their names
+func startServer(t *testing.T, commands chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		for {
+			data, err := ReadReply(r)
+			if err != nil {
+				return
+			}
+
+			args, _ := ParseCommand(data)
+			var s []string
+			for _, arg := range args {
+				s = append(s, string(arg))
+			}
+			commands <- strings.Join(s, " ")
+
+			switch {
+			case s[0] == "AUTH" && s[len(s)-1] != "secret":
+				conn.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+			case s[0] == "QUIT":
+				return
+			default:
+				conn.Write([]byte("+" + s[0] + "\r\n"))
+			}
+		}
+	}()
+
+	return ln
+}
+
+func TestClient(t *testing.T) {
+	commands := make(chan string, 10)
+	ln := startServer(t, commands)
+	defer ln.Close()
+
+	conn, err := Dial(ln.Addr().String(), Config{User: "app", Password: "secret", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := <-commands; c != "AUTH app secret" {
+		t.Errorf("Wrong authentication: %q", c)
+	}
+
+	reply, err := conn.Exec(&Command{DB: 2, Args: [][]byte{[]byte("GET"), []byte("key")}})
+	if err != nil || string(reply) != "+GET\r\n" {
+		t.Fatalf("Wrong reply: %q %v", reply, err)
+	}
+
+	conn.Exec(&Command{DB: 2, Args: [][]byte{[]byte("GET"), []byte("key")}})
+	conn.Close()
+
+	for _, expected := range []string{"SELECT 2", "GET key", "GET key", "QUIT"} {
+		if c := <-commands; c != expected {
+			t.Errorf("Expected %q, got %q", expected, c)
+		}
+	}
+}
+
+func TestClientAuthenticationFailed(t *testing.T) {
+	ln := startServer(t, make(chan string, 10))
+	defer ln.Close()
+
+	_, err := Dial(ln.Addr().String(), Config{Password: "wrong", Timeout: time.Second})
+	if e, ok := err.(*Error); !ok || e.Message != "WRONGPASS invalid username-password pair" {
+		t.Error("Should return server error", err)
+	}
+}
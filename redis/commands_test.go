@@ -0,0 +1,15 @@
+package redis
+
+import (
+	"testing"
+)
+
+func TestInCategory(t *testing.T) {
+	if !InCategory("set", "@write") || InCategory("GET", "@write") || !InCategory("GET", "@READ") || InCategory("EVAL", "@read") {
+		t.Error("Wrong command categories")
+	}
+
+	if !IsCategory("@write") || IsCategory("@dangerous") {
+		t.Error("Wrong known categories")
+	}
+}
@@ -0,0 +1,219 @@
+// Package redis implements parts of RESP, Redis serialization protocol, needed to capture and replay client commands.
+// See https://redis.io/docs/reference/protocol-spec/
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// ErrMalformed returned if data can't be parsed
+var ErrMalformed = errors.New("malformed RESP data")
+
+var crlf = []byte("\r\n")
+
+// lineEnd returns offset following CRLF of the line starting at offset, or -1 if line is not complete
+func lineEnd(data []byte, offset int) int {
+	i := bytes.Index(data[offset:], crlf)
+	if i == -1 {
+		return -1
+	}
+
+	return offset + i + 2
+}
+
+// Length returns length of the first RESP value in data, or -1 if it is not complete. Types of both RESP2 and RESP3 are supported.
+func Length(data []byte) int {
+	offset, pending := 0, 1
+
+	for pending > 0 {
+		if offset >= len(data) {
+			return -1
+		}
+
+		end := lineEnd(data, offset)
+		if end == -1 {
+			return -1
+		}
+
+		switch typ := data[offset]; typ {
+		case '+', '-', ':', '_', ',', '#', '(':
+		case '$', '!', '=':
+			n, err := strconv.Atoi(string(data[offset+1 : end-2]))
+			if err != nil {
+				return -1
+			}
+			// Null bulk string has length -1
+			if n >= 0 {
+				end += n + 2
+			}
+		case '*', '~', '>', '%', '|':
+			n, err := strconv.Atoi(string(data[offset+1 : end-2]))
+			if err != nil {
+				return -1
+			}
+			if n > 0 {
+				if typ == '%' || typ == '|' {
+					n *= 2
+				}
+				pending += n
+			}
+			// Attributes precede the value they describe
+			if typ == '|' {
+				pending++
+			}
+		default:
+			return -1
+		}
+
+		if end > len(data) {
+			return -1
+		}
+
+		offset = end
+		pending--
+	}
+
+	return offset
+}
+
+// RequestLength returns length of the first command in data, or -1 if it is not complete.
+// Commands are sent as arrays of bulk strings, or as inline commands separated by spaces.
+func RequestLength(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+
+	if data[0] == '*' {
+		return Length(data)
+	}
+
+	if i := bytes.IndexByte(data, '\n'); i != -1 {
+		return i + 1
+	}
+
+	return -1
+}
+
+// ParseCommand returns arguments of the command, starting with its name. Arguments refer to data.
+func ParseCommand(data []byte) ([][]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrMalformed
+	}
+
+	if data[0] != '*' {
+		if i := bytes.IndexByte(data, '\n'); i != -1 {
+			data = data[:i]
+		}
+
+		args := bytes.Fields(data)
+		if len(args) == 0 {
+			return nil, ErrMalformed
+		}
+
+		return args, nil
+	}
+
+	end := lineEnd(data, 0)
+	if end == -1 {
+		return nil, ErrMalformed
+	}
+
+	count, err := strconv.Atoi(string(data[1 : end-2]))
+	if err != nil || count <= 0 {
+		return nil, ErrMalformed
+	}
+
+	args := make([][]byte, 0, count)
+	offset := end
+	for i := 0; i < count; i++ {
+		if offset >= len(data) || data[offset] != '$' {
+			return nil, ErrMalformed
+		}
+
+		end = lineEnd(data, offset)
+		if end == -1 {
+			return nil, ErrMalformed
+		}
+
+		n, err := strconv.Atoi(string(data[offset+1 : end-2]))
+		if err != nil || n < 0 || end+n+2 > len(data) {
+			return nil, ErrMalformed
+		}
+
+		args = append(args, data[end:end+n])
+		offset = end + n + 2
+	}
+
+	return args, nil
+}
+
+// AppendCommand appends command with given arguments as array of bulk strings
+func AppendCommand(b []byte, args [][]byte) []byte {
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, crlf...)
+
+	for _, arg := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(arg)), 10)
+		b = append(b, crlf...)
+		b = append(b, arg...)
+		b = append(b, crlf...)
+	}
+
+	return b
+}
+
+// ReadReply reads single RESP value sent by server
+func ReadReply(r *bufio.Reader) ([]byte, error) {
+	var data []byte
+
+	for pending := 1; pending > 0; pending-- {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 3 || line[len(line)-2] != '\r' {
+			return nil, ErrMalformed
+		}
+		data = append(data, line...)
+
+		switch typ := line[0]; typ {
+		case '+', '-', ':', '_', ',', '#', '(':
+		case '$', '!', '=':
+			n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+			if err != nil {
+				return nil, ErrMalformed
+			}
+			if n >= 0 {
+				value := make([]byte, n+2)
+				if _, err = io.ReadFull(r, value); err != nil {
+					return nil, err
+				}
+				data = append(data, value...)
+			}
+		case '*', '~', '>', '%', '|':
+			n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+			if err != nil {
+				return nil, ErrMalformed
+			}
+			if n > 0 {
+				if typ == '%' || typ == '|' {
+					n *= 2
+				}
+				pending += n
+			}
+			if typ == '|' {
+				pending++
+			}
+		default:
+			return nil, ErrMalformed
+		}
+	}
+
+	return data, nil
+}
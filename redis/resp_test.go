@@ -0,0 +1,89 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLength(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		expected int
+	}{
+		{"simple string", "+OK\r\n+OK\r\n", 5},
+		{"error", "-ERR unknown command\r\n", -2},
+		{"bulk string", "$5\r\nhello\r\n", -2},
+		{"bulk string with CRLF", "$7\r\nhe\r\nllo\r\n:1\r\n", 13},
+		{"null", "$-1\r\n*-1\r\n", 5},
+		{"incomplete bulk string", "$5\r\nhel", -1},
+		{"nested array", "*2\r\n*1\r\n:1\r\n$1\r\na\r\n", -2},
+		{"incomplete array", "*2\r\n:1\r\n", -1},
+		{"empty array", "*0\r\n:1\r\n", 4},
+		{"map", "%1\r\n+key\r\n$5\r\nvalue\r\n", -2},
+		{"attribute", "|1\r\n+ttl\r\n:3600\r\n$5\r\nvalue\r\n", -2},
+		{"unknown type", "hello\r\n", -1},
+		{"incomplete line", "+OK", -1},
+	}
+
+	for _, c := range cases {
+		expected := c.expected
+		if expected == -2 {
+			expected = len(c.data)
+		}
+
+		if n := Length([]byte(c.data)); n != expected {
+			t.Errorf("%s: expected %d, got %d", c.name, expected, n)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	data := []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$7\r\nva\r\nlue\r\n")
+	if n := RequestLength(data); n != len(data) {
+		t.Error("Wrong command length", n)
+	}
+
+	args, err := ParseCommand(data)
+	if err != nil || !reflect.DeepEqual(args, [][]byte{[]byte("SET"), []byte("key"), []byte("va\r\nlue")}) {
+		t.Errorf("Wrong arguments: %q %v", args, err)
+	}
+
+	if !bytes.Equal(AppendCommand(nil, args), data) {
+		t.Error("Should encode arguments")
+	}
+
+	// Inline commands are sent by telnet and redis-cli
+	inline := []byte("get  key\r\nPING\r\n")
+	if n := RequestLength(inline); n != 10 {
+		t.Error("Wrong inline command length", n)
+	}
+
+	if args, err = ParseCommand(inline); err != nil || !reflect.DeepEqual(args, [][]byte{[]byte("get"), []byte("key")}) {
+		t.Errorf("Wrong arguments: %q %v", args, err)
+	}
+
+	for _, data := range []string{"", "*0\r\n", "*2\r\n$3\r\nGET\r\n", "*1\r\n:1\r\n", "*1\r\n$5\r\nGET\r\n", "\r\n"} {
+		if _, err = ParseCommand([]byte(data)); err == nil {
+			t.Errorf("Should reject %q", data)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	replies := "*2\r\n$1\r\na\r\n$-1\r\n" + "%1\r\n+key\r\n~1\r\n,1.5\r\n" + "-ERR wrong\r\n"
+	r := bufio.NewReader(strings.NewReader(replies + "$10\r\nab"))
+
+	for _, expected := range []string{"*2\r\n$1\r\na\r\n$-1\r\n", "%1\r\n+key\r\n~1\r\n,1.5\r\n", "-ERR wrong\r\n"} {
+		if reply, err := ReadReply(r); err != nil || string(reply) != expected {
+			t.Errorf("Expected %q, got %q %v", expected, reply, err)
+		}
+	}
+
+	if _, err := ReadReply(r); err == nil {
+		t.Error("Should return error for incomplete reply")
+	}
+}
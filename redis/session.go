@@ -0,0 +1,186 @@
+package redis
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commands changing state of connection, they are not replayed. Output connections authenticate and select database
+// themselves, and subscriptions and monitoring change protocol so that commands are not answered one by one.
+var sessionCommands = commandSet(`AUTH CLIENT HELLO MONITOR PSUBSCRIBE PUNSUBSCRIBE QUIT RESET SELECT SSUBSCRIBE
+	SUBSCRIBE SUNSUBSCRIBE UNSUBSCRIBE`)
+
+// Command is a client command which can be replayed.
+//
+// It is written as text, similar to HTTP message, followed by command in RESP:
+//
+//	SET\r\n
+//	Connection: 10.0.0.1:51234\r\n
+//	DB: 2\r\n
+//	\r\n
+//	*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n
+type Command struct {
+	// Client connection, commands of the same connection should be replayed in order using single connection
+	Connection string
+	// Database selected by client
+	DB int
+	// Name of command and its arguments
+	Args [][]byte
+}
+
+// Name returns name of the command in upper case
+func (c *Command) Name() string {
+	return strings.ToUpper(string(c.Args[0]))
+}
+
+// MarshalText writes command as text
+func (c *Command) MarshalText() ([]byte, error) {
+	var b bytes.Buffer
+
+	b.WriteString(c.Name() + "\r\n")
+	b.WriteString("Connection: " + c.Connection + "\r\n")
+	b.WriteString("DB: " + strconv.Itoa(c.DB) + "\r\n")
+	b.WriteString("\r\n")
+	b.Write(AppendCommand(nil, c.Args))
+
+	return b.Bytes(), nil
+}
+
+// UnmarshalText parses command written by MarshalText
+func (c *Command) UnmarshalText(data []byte) error {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end == -1 {
+		return ErrMalformed
+	}
+
+	args, err := ParseCommand(data[end+4:])
+	if err != nil || data[end+4] != '*' {
+		return ErrMalformed
+	}
+	*c = Command{Args: args}
+
+	lines := strings.Split(string(data[:end]), "\r\n")
+	for _, line := range lines[1:] {
+		i := strings.Index(line, ": ")
+		if i == -1 {
+			return ErrMalformed
+		}
+
+		value := line[i+2:]
+		switch line[:i] {
+		case "Connection":
+			c.Connection = value
+		case "DB":
+			if c.DB, err = strconv.Atoi(value); err != nil || c.DB < 0 {
+				return ErrMalformed
+			}
+		}
+	}
+
+	return nil
+}
+
+// Session is a state of client connection needed to replay its commands
+type Session struct {
+	db       int
+	lastSeen time.Time
+}
+
+// Sessions tracks state of captured client connections. It is not safe for concurrent use.
+type Sessions struct {
+	sessions map[string]*Session
+	// Sessions without commands for this time are forgotten
+	timeout    time.Duration
+	lastExpire time.Time
+}
+
+// NewSessions constructor for Sessions
+func NewSessions(timeout time.Duration) *Sessions {
+	return &Sessions{
+		sessions: make(map[string]*Session),
+		timeout:  timeout,
+	}
+}
+
+// Len returns number of tracked sessions
+func (s *Sessions) Len() int {
+	return len(s.sessions)
+}
+
+func (s *Sessions) session(conn string, ts time.Time) *Session {
+	session, ok := s.sessions[conn]
+	if !ok {
+		session = &Session{}
+		s.sessions[conn] = session
+	}
+	session.lastSeen = ts
+
+	if ts.Sub(s.lastExpire) >= time.Minute {
+		s.lastExpire = ts
+		for id, other := range s.sessions {
+			if ts.Sub(other.lastSeen) >= s.timeout {
+				delete(s.sessions, id)
+			}
+		}
+	}
+
+	return session
+}
+
+// Request updates state of the session with command sent by client, and returns command which can be replayed.
+// Commands changing state of connection are not replayed, and nil is returned. Connections established before capture
+// started are expected to use database 0, until they select another one.
+func (s *Sessions) Request(conn string, data []byte, ts time.Time) (*Command, error) {
+	session := s.session(conn, ts)
+
+	cmd, err := session.request(data, true)
+	if cmd != nil {
+		cmd.Connection = conn
+	}
+
+	if args, _ := ParseCommand(data); len(args) > 0 && strings.EqualFold(string(args[0]), "QUIT") {
+		delete(s.sessions, conn)
+	}
+
+	return cmd, err
+}
+
+// Command returns command sent by client without updating state of the session, e.g. to decide if response should be replayed
+func (s *Sessions) Command(conn string, data []byte) *Command {
+	session, ok := s.sessions[conn]
+	if !ok {
+		return nil
+	}
+
+	cmd, _ := session.request(data, false)
+	if cmd != nil {
+		cmd.Connection = conn
+	}
+
+	return cmd
+}
+
+func (session *Session) request(data []byte, update bool) (*Command, error) {
+	args, err := ParseCommand(data)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := &Command{DB: session.db, Args: args}
+	switch name := cmd.Name(); {
+	case name == "SELECT" && len(args) == 2:
+		if db, err := strconv.Atoi(string(args[1])); err == nil && db >= 0 && update {
+			session.db = db
+		}
+		return nil, nil
+	case name == "RESET" && update:
+		session.db = 0
+		return nil, nil
+	case sessionCommands[name]:
+		return nil, nil
+	}
+
+	return cmd, nil
+}
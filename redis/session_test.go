@@ -0,0 +1,71 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	sessions := NewSessions(time.Hour)
+	now := time.Now()
+	conn := "10.0.0.1:51234"
+
+	// Connection state is not replayed
+	for _, data := range []string{"*2\r\n$4\r\nAUTH\r\n$6\r\nsecret\r\n", "SELECT 2\r\n", "*1\r\n$9\r\nSUBSCRIBE\r\n"} {
+		if cmd, err := sessions.Request(conn, []byte(data), now); cmd != nil || err != nil {
+			t.Errorf("%q should not be replayed: %v %v", data, cmd, err)
+		}
+	}
+
+	cmd, err := sessions.Request(conn, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"), now)
+	if err != nil || cmd == nil || cmd.Name() != "GET" || cmd.DB != 2 || cmd.Connection != conn {
+		t.Fatal("Wrong command", cmd, err)
+	}
+
+	if cmd = sessions.Command(conn, []byte("select 3\r\n")); cmd != nil {
+		t.Error("Should not replay SELECT", cmd)
+	}
+	if cmd = sessions.Command(conn, []byte("get a\r\n")); cmd == nil || cmd.DB != 2 {
+		t.Error("Peeking SELECT should not change database", cmd)
+	}
+
+	sessions.Request(conn, []byte("RESET\r\n"), now)
+	if cmd, _ = sessions.Request(conn, []byte("get a\r\n"), now); cmd.DB != 0 {
+		t.Error("RESET should select database 0", cmd)
+	}
+
+	sessions.Request(conn, []byte("QUIT\r\n"), now)
+	if sessions.Len() != 0 {
+		t.Error("Session should be closed")
+	}
+
+	if _, err = sessions.Request(conn, []byte("*2\r\n$3\r\nGET\r\n"), now); err != ErrMalformed {
+		t.Error("Should reject malformed command", err)
+	}
+
+	sessions.Request("10.0.0.2:4000", []byte("PING\r\n"), now.Add(2*time.Hour))
+	if sessions.Len() != 1 {
+		t.Error("Idle session should expire", sessions.Len())
+	}
+}
+
+func TestCommandText(t *testing.T) {
+	cmd := &Command{Connection: "10.0.0.1:51234", DB: 2, Args: [][]byte{[]byte("set"), []byte("key"), []byte("\r\n\r\n")}}
+
+	text, _ := cmd.MarshalText()
+	if string(text) != "SET\r\nConnection: 10.0.0.1:51234\r\nDB: 2\r\n\r\n*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$4\r\n\r\n\r\n\r\n" {
+		t.Errorf("Wrong text: %q", text)
+	}
+
+	decoded := new(Command)
+	if err := decoded.UnmarshalText(text); err != nil || !reflect.DeepEqual(decoded, cmd) {
+		t.Error("Wrong command", decoded, err)
+	}
+
+	for _, text := range []string{"GET\r\nConnection: a", "GET / HTTP/1.1\r\n\r\n", "GET\r\nDB: a\r\n\r\n*1\r\n$3\r\nGET\r\n", "GET\r\n\r\n*1\r\n$3\r\nGET"} {
+		if err := decoded.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("Should reject %q", text)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package goreplay
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Hash of empty payload, sent in X-Amz-Content-Sha256 header required by S3
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Object is object of bucket listed by ListObjectsV2
+type s3Object struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+}
+
+// s3Client reads objects of S3 bucket, using awsClient for credentials and signing
+type s3Client struct {
+	*awsClient
+	bucket string
+	// URL of bucket, virtual-hosted style on AWS, path style with custom endpoint
+	url string
+}
+
+func newS3Client(bucket, region, endpoint string) (*s3Client, error) {
+	client, err := newAWSClient("s3", "", region, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &s3Client{awsClient: client, bucket: bucket, url: endpoint + "/" + bucket}
+	if endpoint == "" {
+		c.url = "https://" + bucket + ".s3." + region + ".amazonaws.com"
+	}
+
+	return c, nil
+}
+
+// get sends signed GET request of object with given key, or of bucket if key is empty. Body of object is streamed,
+// without timeout.
+func (c *s3Client) get(key string, query url.Values) (*http.Response, error) {
+	u := c.url
+	if key != "" {
+		segments := strings.Split(key, "/")
+		for i, s := range segments {
+			segments[i] = url.PathEscape(s)
+		}
+		u += "/" + strings.Join(segments, "/")
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+
+	credentials, err := c.getCredentials()
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, nil, credentials, time.Now())
+
+	resp, err := c.stream.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3ResponseError(resp)
+	}
+
+	return resp, nil
+}
+
+// list lists all objects with given key prefix, in order of their keys
+func (c *s3Client) list(prefix string) ([]s3Object, error) {
+	var objects []s3Object
+
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := c.get("", query)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents              []s3Object
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// open reads object with given key
+func (c *s3Client) open(key string) (io.ReadCloser, error) {
+	resp, err := c.get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// s3ResponseError returns error of S3 response, which is XML unlike errors of JSON APIs
+func s3ResponseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var result struct {
+		Code    string
+		Message string
+	}
+	e := &awsError{status: resp.Status}
+	if xml.Unmarshal(body, &result) == nil && result.Code != "" {
+		e.Type, e.Message = result.Code, result.Message
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	return e
+}
@@ -0,0 +1,193 @@
+package goreplay
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// replayWindow is a daily time window, in minutes since midnight. Window ending before it starts continues next day.
+type replayWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// parseReplayWindow parses window in `[days ]HH:MM-HH:MM` format, e.g. `22:00-06:00` or `Mon-Fri 20:00-23:30`.
+// Days are a list of weekdays or their ranges separated by commas, e.g. `Sat,Sun` or `Mon-Wed,Fri`.
+func parseReplayWindow(s string) (w replayWindow, err error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("expected [days ]HH:MM-HH:MM, got %q", s)
+	}
+
+	if len(fields) == 1 {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	} else if err = w.parseDays(fields[0]); err != nil {
+		return
+	}
+
+	times := strings.Split(fields[len(fields)-1], "-")
+	if len(times) != 2 {
+		return w, fmt.Errorf("expected HH:MM-HH:MM, got %q", fields[len(fields)-1])
+	}
+
+	if w.start, err = parseClock(times[0]); err != nil {
+		return
+	}
+	if w.end, err = parseClock(times[1]); err != nil {
+		return
+	}
+
+	if w.start == w.end || w.start == 24*60 {
+		return w, fmt.Errorf("empty window %q", s)
+	}
+
+	return w, nil
+}
+
+func (w *replayWindow) parseDays(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.Split(strings.ToLower(part), "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("unknown days %q", part)
+		}
+
+		first, ok := weekdays[bounds[0]]
+		last, ok2 := weekdays[bounds[len(bounds)-1]]
+		if !ok || !ok2 {
+			return fmt.Errorf("unknown days %q", part)
+		}
+
+		// Range can wrap around the end of week, e.g. Fri-Mon
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseClock returns minutes since midnight of HH:MM time, 24:00 is allowed as end of day
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("expected HH:MM, got %q", s)
+	}
+
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("wrong hour %q", s)
+	}
+
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("wrong minute %q", s)
+	}
+
+	return h*60 + m, nil
+}
+
+func (w replayWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+
+	// Part after midnight belongs to window started previous day
+	return w.days[day] && minute >= w.start || w.days[(day+6)%7] && minute < w.end
+}
+
+// replaySchedule decides if traffic is forwarded, it is active during any of its windows
+type replaySchedule struct {
+	windows []replayWindow
+
+	mu     sync.Mutex
+	active bool
+	// Set after the first check, so only changes are logged
+	checked bool
+}
+
+func newReplaySchedule(windows []string) (*replaySchedule, error) {
+	s := new(replaySchedule)
+
+	for _, spec := range windows {
+		w, err := parseReplayWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, w)
+	}
+
+	return s, nil
+}
+
+// Active checks if t is in any window, and logs when schedule starts or stops forwarding traffic
+func (s *replaySchedule) Active(t time.Time) bool {
+	active := false
+	for _, w := range s.windows {
+		if w.contains(t) {
+			active = true
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.checked || active != s.active {
+		if active {
+			log.Println("[SCHEDULE] Replay window is open, forwarding traffic")
+		} else {
+			log.Println("[SCHEDULE] Replay window is closed, dropping traffic")
+		}
+		s.active = active
+		s.checked = true
+	}
+
+	return active
+}
+
+// captureSchedule decides if traffic is forwarded by time it was captured, given by timestamps of payloads, so only
+// part of multi-day recording can be replayed
+type captureSchedule []replayWindow
+
+func newCaptureSchedule(windows []string) (captureSchedule, error) {
+	var s captureSchedule
+
+	for _, spec := range windows {
+		w, err := parseReplayWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, w)
+	}
+
+	return s, nil
+}
+
+// Contains checks if t is in any window
+func (s captureSchedule) Contains(t time.Time) bool {
+	for _, w := range s {
+		if w.contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
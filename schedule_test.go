@@ -0,0 +1,96 @@
+package goreplay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReplayWindow(t *testing.T) {
+	for _, spec := range []string{"", "22:00", "22:00-25:00", "10:00-10:00", "Mon-Funday 10:00-11:00", "Mon 10:00-11:00 UTC", "24:00-01:00", "10:60-11:00"} {
+		if _, err := parseReplayWindow(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+
+	w, err := parseReplayWindow("Fri-Mon,Wed 22:30-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [7]bool{true, true, false, true, false, true, true}
+	if w.days != expected || w.start != 22*60+30 || w.end != 24*60 {
+		t.Errorf("Wrong window %+v", w)
+	}
+}
+
+func TestReplayWindowContains(t *testing.T) {
+	// 2021-03-01 is Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, 3, day, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		spec     string
+		t        time.Time
+		contains bool
+	}{
+		{"09:00-17:00", at(1, 9, 0), true},
+		{"09:00-17:00", at(1, 16, 59), true},
+		{"09:00-17:00", at(1, 17, 0), false},
+		{"22:00-06:00", at(1, 23, 0), true},
+		{"22:00-06:00", at(2, 5, 59), true},
+		{"22:00-06:00", at(2, 12, 0), false},
+		{"Mon-Fri 09:00-17:00", at(6, 10, 0), false},
+		{"Mon-Fri 09:00-17:00", at(5, 10, 0), true},
+		// Window started on Friday continues on Saturday morning, but Sunday's one does not start
+		{"Mon-Fri 22:00-06:00", at(6, 3, 0), true},
+		{"Mon-Fri 22:00-06:00", at(7, 23, 0), false},
+		{"Mon-Fri 22:00-06:00", at(1, 3, 0), false},
+	}
+
+	for _, tt := range tests {
+		w, err := parseReplayWindow(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if w.contains(tt.t) != tt.contains {
+			t.Errorf("%q contains %v: expected %v", tt.spec, tt.t, tt.contains)
+		}
+	}
+}
+
+func TestReplaySchedule(t *testing.T) {
+	s, err := newReplaySchedule([]string{"09:00-10:00", "Sat,Sun 12:00-13:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Active(time.Date(2021, 3, 1, 9, 30, 0, 0, time.Local)) || !s.Active(time.Date(2021, 3, 6, 12, 30, 0, 0, time.Local)) {
+		t.Error("Schedule should be active during any of its windows")
+	}
+
+	if s.Active(time.Date(2021, 3, 1, 12, 30, 0, 0, time.Local)) {
+		t.Error("Schedule should not be active outside of windows")
+	}
+}
+
+func TestCaptureSchedule(t *testing.T) {
+	if _, err := newCaptureSchedule([]string{"09:00"}); err == nil {
+		t.Error("Wrong window should not be accepted")
+	}
+
+	s, err := newCaptureSchedule([]string{"Mon-Fri 09:00-18:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2021-03-01 is Monday
+	if !s.Contains(time.Date(2021, 3, 1, 9, 30, 0, 0, time.Local)) {
+		t.Error("Schedule should contain business hours")
+	}
+
+	if s.Contains(time.Date(2021, 3, 1, 20, 0, 0, 0, time.Local)) || s.Contains(time.Date(2021, 3, 6, 10, 0, 0, 0, time.Local)) {
+		t.Error("Schedule should not contain time outside of windows")
+	}
+}
@@ -0,0 +1,119 @@
+// Package scram implements client side of SCRAM-SHA-256 authentication, see RFC 5802 and RFC 7677.
+// Passwords are used as is, without SASLprep normalization.
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Mechanism is a SASL name of the mechanism
+const Mechanism = "SCRAM-SHA-256"
+
+// ErrMalformed returned if server message can't be parsed, or its nonce does not extend client nonce
+var ErrMalformed = errors.New("malformed SCRAM message")
+
+// Client holds state of authentication exchange
+type Client struct {
+	user        string
+	password    string
+	nonce       string
+	authMessage string
+	serverKey   []byte
+}
+
+// NewClient constructor for Client. User can be empty if server takes it from elsewhere, like PostgreSQL does.
+func NewClient(user, password string) (*Client, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &Client{user: user, password: password, nonce: base64.StdEncoding.EncodeToString(nonce)}, nil
+}
+
+// clientFirstBare returns the first message without GS2 header
+func (s *Client) clientFirstBare() string {
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s.user)
+	return "n=" + user + ",r=" + s.nonce
+}
+
+// ClientFirst returns the first message sent by client
+func (s *Client) ClientFirst() []byte {
+	return []byte("n,," + s.clientFirstBare())
+}
+
+// ClientFinal returns client proof in response to the first server message
+func (s *Client) ClientFinal(serverFirst []byte) ([]byte, error) {
+	var nonce, salt string
+	iterations := 0
+
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, ErrMalformed
+		}
+
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, s.nonce) || iterations <= 0 {
+		return nil, ErrMalformed
+	}
+
+	salted := pbkdf2SHA256([]byte(s.password), saltBytes, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	s.serverKey = hmacSHA256(salted, []byte("Server Key"))
+
+	// Channel binding is not used: base64 of "n,,"
+	final := "c=biws,r=" + nonce
+	s.authMessage = s.clientFirstBare() + "," + string(serverFirst) + "," + final
+
+	proof := hmacSHA256(storedKey[:], []byte(s.authMessage))
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	return []byte(final + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Verify checks server signature sent in the final server message
+func (s *Client) Verify(serverFinal []byte) bool {
+	signature := base64.StdEncoding.EncodeToString(hmacSHA256(s.serverKey, []byte(s.authMessage)))
+
+	return string(serverFinal) == "v="+signature
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA256 derives key of SHA-256 size, see RFC 2898
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	u := hmacSHA256(password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	key := append([]byte{}, u...)
+
+	for i := 1; i < iterations; i++ {
+		u = hmacSHA256(password, u)
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
@@ -0,0 +1,34 @@
+package scram
+
+import (
+	"testing"
+)
+
+// Test vector from RFC 7677
+func TestClient(t *testing.T) {
+	s := &Client{user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+
+	if string(s.ClientFirst()) != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("Wrong first message: %s", s.ClientFirst())
+	}
+
+	final, err := s.ClientFinal([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil || string(final) != "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Errorf("Wrong final message: %s %v", final, err)
+	}
+
+	if !s.Verify([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")) || s.Verify([]byte("v=invalid")) {
+		t.Error("Wrong server signature check")
+	}
+
+	if _, err = s.ClientFinal([]byte("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err == nil {
+		t.Error("Should reject server nonce not extending client nonce")
+	}
+}
+
+func TestUserName(t *testing.T) {
+	s := &Client{user: "a=b,c", nonce: "abc"}
+	if string(s.ClientFirst()) != "n,,n=a=3Db=2Cc,r=abc" {
+		t.Errorf("User name should be escaped: %s", s.ClientFirst())
+	}
+}
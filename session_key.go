@@ -0,0 +1,55 @@
+package goreplay
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Keys of sessions given by --output-http-session-key and --input-raw-session-key, besides header:<name> and
+// cookie:<name>
+const (
+	sessionKeyClientAddr = "client-addr"
+	sessionKeyClientIP   = "client-ip"
+)
+
+// validSessionKey tells if key is client-addr, client-ip, header:<name> or cookie:<name>. Empty key means
+// client-addr.
+func validSessionKey(key string) bool {
+	switch {
+	case key == "", key == sessionKeyClientAddr, key == sessionKeyClientIP:
+		return true
+	case strings.HasPrefix(key, "header:") || strings.HasPrefix(key, "cookie:"):
+		return !strings.HasSuffix(key, ":")
+	}
+
+	return false
+}
+
+// requestSessionKey returns session of HTTP request sent by client with given address, by value of header or cookie
+// for header:<name> and cookie:<name> keys. Empty string is returned if request has no session key.
+func requestSessionKey(key, addr string, request []byte) string {
+	switch {
+	case key == "" || key == sessionKeyClientAddr:
+		return addr
+	case key == sessionKeyClientIP:
+		ip, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return ""
+		}
+		return ip
+	case strings.HasPrefix(key, "header:"):
+		return string(proto.Header(request, []byte(strings.TrimPrefix(key, "header:"))))
+	case strings.HasPrefix(key, "cookie:"):
+		header := http.Header{"Cookie": {string(proto.Header(request, []byte("Cookie")))}}
+		cookie, err := (&http.Request{Header: header}).Cookie(strings.TrimPrefix(key, "cookie:"))
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+
+	return ""
+}
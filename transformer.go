@@ -0,0 +1,192 @@
+package goreplay
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Transformer changes payloads before they are written by output, e.g. to redact, rewrite or drop them. Transform
+// gets the whole payload with its header, and returns changed payload, or empty one to drop it. Payload is a copy
+// owned by the output, so it can be changed in place, but it should not be kept after Transform returns.
+type Transformer interface {
+	Transform(payload []byte) []byte
+}
+
+// TransformerFunc allows to use ordinary function as Transformer
+type TransformerFunc func(payload []byte) []byte
+
+// Transform calls f(payload)
+func (f TransformerFunc) Transform(payload []byte) []byte {
+	return f(payload)
+}
+
+var transformersMu sync.Mutex
+
+// Transformers which can be given by name in output options, each output gets own transformer from factory
+var transformerFactories = map[string]func() (Transformer, error){
+	"redact-strip": func() (Transformer, error) {
+		return newHeaderRedactor("strip", Settings.outputRedactHeaders)
+	},
+	"redact-hash": func() (Transformer, error) {
+		return newHeaderRedactor("hash", Settings.outputRedactHeaders)
+	},
+	"prettify-http": func() (Transformer, error) {
+		return TransformerFunc(prettifyTransform), nil
+	},
+}
+
+// RegisterTransformer makes transformer available by name in output options, after "|" like limit:
+// `--output-http "staging.com|transform=my-transform"`. Factory is called for each output using it.
+func RegisterTransformer(name string, factory func() (Transformer, error)) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+
+	transformerFactories[name] = factory
+}
+
+// newTransformer creates transformer registered with given name
+func newTransformer(name string) (Transformer, error) {
+	transformersMu.Lock()
+	factory, ok := transformerFactories[name]
+	transformersMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown transformer %q, available: %s", name, strings.Join(transformerNames(), ", "))
+	}
+	return factory()
+}
+
+func transformerNames() (names []string) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+
+	for name := range transformerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// extractTransformOptions removes transformers from plugin options, transformers can be given several times and are
+// applied in the same order
+func extractTransformOptions(options string) (string, []string) {
+	var names []string
+
+	split := strings.Split(options, "|")
+	rest := split[:1]
+	for _, option := range split[1:] {
+		if strings.HasPrefix(option, "transform=") {
+			names = append(names, strings.TrimPrefix(option, "transform="))
+		} else {
+			rest = append(rest, option)
+		}
+	}
+
+	return strings.Join(rest, "|"), names
+}
+
+// prettifyTransform is --prettify-http for single output, chunked payloads are passed as is
+func prettifyTransform(payload []byte) []byte {
+	if info, ok := parsePayloadInfo(payload); ok && info.chunked {
+		return payload
+	}
+	return prettifyHTTP(payload)
+}
+
+// transformOutput applies transformers to payloads before they are written to output
+type transformOutput struct {
+	out          io.Writer
+	transformers []Transformer
+}
+
+// transformReadOutput is transformOutput of output which returns responses
+type transformReadOutput struct {
+	*transformOutput
+	io.Reader
+}
+
+func (o *transformOutput) Write(data []byte) (int, error) {
+	// Emitter writes the same buffer to all outputs, so transformers get a copy
+	buf := getPayloadBuffer(data)
+	defer putPayloadBuffer(buf)
+
+	payload := buf
+	for _, t := range o.transformers {
+		if payload = t.Transform(payload); len(payload) == 0 {
+			return len(data), nil
+		}
+	}
+
+	if _, err := o.out.Write(payload); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (o *transformOutput) String() string {
+	return fmt.Sprint(o.out)
+}
+
+// Transform adds transformers applied to payloads of given output, after transformers added before. Output is
+// plugin added by AddPlugin or RegisterPlugin, transformers are applied before limit of output is checked, so
+// dropped payloads do not count towards it.
+func (plugins *InOutPlugins) Transform(output io.Writer, transformers ...Transformer) {
+	for i, out := range plugins.Outputs {
+		if unwrapOutput(out) != output {
+			continue
+		}
+
+		switch o := out.(type) {
+		case *transformOutput:
+			o.transformers = append(o.transformers, transformers...)
+		case transformReadOutput:
+			o.transformers = append(o.transformers, transformers...)
+		default:
+			t := &transformOutput{out: out, transformers: transformers}
+			if r, ok := out.(io.Reader); ok {
+				plugins.Outputs[i] = transformReadOutput{t, r}
+			} else {
+				plugins.Outputs[i] = t
+			}
+		}
+		return
+	}
+
+	log.Printf("[TRANSFORM] Output %v is not added to plugins, transformers are not applied\n", output)
+}
+
+// transformNamed adds transformers given by name in options of output added the last
+func (plugins *InOutPlugins) transformNamed(plugin interface{}, names []string) {
+	out, ok := plugin.(io.Writer)
+	if !ok || len(names) == 0 {
+		return
+	}
+
+	var transformers []Transformer
+	for _, name := range names {
+		t, err := newTransformer(name)
+		if err != nil {
+			log.Fatalf("transform error: %v\n", err)
+		}
+		transformers = append(transformers, t)
+	}
+	plugins.Transform(out, transformers...)
+}
+
+// unwrapOutput returns plugin wrapped by transformers and limiter
+func unwrapOutput(out io.Writer) interface{} {
+	switch o := out.(type) {
+	case *transformOutput:
+		return unwrapOutput(o.out)
+	case transformReadOutput:
+		return unwrapOutput(o.out)
+	case *Limiter:
+		return o.plugin
+	default:
+		return out
+	}
+}
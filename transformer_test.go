@@ -0,0 +1,80 @@
+package goreplay
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestTransformer(t *testing.T) {
+	var received [][]byte
+	var mu sync.Mutex
+	output := NewTestOutput(func(data []byte) {
+		mu.Lock()
+		received = append(received, append([]byte(nil), data...))
+		mu.Unlock()
+	})
+	other := NewTestOutput(func(data []byte) {
+		if !bytes.Contains(data, []byte("secret")) {
+			t.Error("Other outputs should get original payloads", string(data))
+		}
+	})
+
+	plugins := NewPlugins()
+	plugins.AddPlugin(output, "")
+	plugins.AddPlugin(other, "")
+
+	// Payloads of health checks are dropped, and the rest is redacted in place
+	plugins.Transform(output, TransformerFunc(func(payload []byte) []byte {
+		if bytes.Contains(payload, []byte("/health")) {
+			return nil
+		}
+		return payload
+	}))
+	plugins.Transform(output, TransformerFunc(func(payload []byte) []byte {
+		return bytes.Replace(payload, []byte("secret"), []byte("xxxxxx"), -1)
+	}))
+
+	payloads := []string{
+		"1 1 1\nGET /health HTTP/1.1\r\nAuthorization: secret\r\n\r\n",
+		"1 2 1\nGET / HTTP/1.1\r\nAuthorization: secret\r\n\r\n",
+	}
+	for _, p := range payloads {
+		for _, out := range plugins.Outputs {
+			if _, err := out.Write([]byte(p)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if len(received) != 1 {
+		t.Fatal("Dropped payload should not be written", len(received))
+	}
+	if !bytes.Contains(received[0], []byte("xxxxxx")) || bytes.Contains(received[0], []byte("secret")) {
+		t.Error("Transformers should be applied in order", string(received[0]))
+	}
+}
+
+func TestTransformerOptions(t *testing.T) {
+	RegisterTransformer("test-upper", func() (Transformer, error) {
+		return TransformerFunc(bytes.ToUpper), nil
+	})
+
+	plugins := NewPlugins()
+	plugins.RegisterPlugin(NewHTTPOutput, "www.example.com|transform=redact-hash|10%|transform=test-upper", &HTTPOutputConfig{})
+
+	// HTTP output returns responses, so they are still read from it
+	o, ok := plugins.Outputs[0].(transformReadOutput)
+	if !ok {
+		t.Fatalf("Output should be transformed, got %T", plugins.Outputs[0])
+	}
+	if len(o.transformers) != 2 {
+		t.Error("Both transformers should be applied", len(o.transformers))
+	}
+	if _, ok := o.out.(*Limiter); !ok {
+		t.Error("Transformers should be applied before limiter")
+	}
+	if _, ok := unwrapOutput(o).(*HTTPOutput); !ok {
+		t.Error("Output should be unwrapped to plugin")
+	}
+}
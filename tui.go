@@ -0,0 +1,287 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Terminal UI settings
+const (
+	tuiRefreshInterval = time.Second
+	tuiRecentRequests  = 15
+	tuiLogLines        = 5
+	// Requests are kept for inspect view up to this size
+	tuiRequestSize = 4096
+)
+
+// queuedOutput is implemented by outputs which queue payloads before sending them, queue depth is shown by terminal UI
+type queuedOutput interface {
+	queueLen() int
+}
+
+// terminal is terminal UI started by --tui, nil otherwise
+var terminal *terminalUI
+
+type tuiCounter struct {
+	name   string
+	count  int
+	bytes  int
+	last   int
+	output bool
+	plugin interface{}
+}
+
+type tuiRequest struct {
+	time    time.Time
+	payload []byte
+}
+
+// terminalUI shows live throughput of plugins, queue depths of outputs, response status codes and recent requests,
+// refreshed every second. Commands are read from input by lines: `p` pauses refreshing, number of recent request
+// shows it in inspect view, and empty line resumes refreshing.
+type terminalUI struct {
+	mu       sync.Mutex
+	counters []*tuiCounter
+	byPlugin map[interface{}]*tuiCounter
+	statuses map[byte]map[string]int
+	recent   []tuiRequest
+	logs     []string
+	paused   bool
+	// Index of recent request shown in inspect view, or -1
+	inspect int
+	// Screen is not rendered again while paused, until next command
+	frozen bool
+}
+
+func newTerminalUI(plugins *InOutPlugins) *terminalUI {
+	t := &terminalUI{
+		byPlugin: make(map[interface{}]*tuiCounter),
+		statuses: make(map[byte]map[string]int),
+		inspect:  -1,
+	}
+
+	for _, in := range plugins.Inputs {
+		t.counter(in, false)
+	}
+	for _, out := range plugins.Outputs {
+		t.counter(out, true)
+	}
+
+	return t
+}
+
+// counter returns counter of plugin, unknown plugins like middleware are added on first payload
+func (t *terminalUI) counter(plugin interface{}, output bool) *tuiCounter {
+	c, ok := t.byPlugin[plugin]
+	if !ok {
+		c = &tuiCounter{name: fmt.Sprint(plugin), output: output, plugin: plugin}
+		t.byPlugin[plugin] = c
+		t.counters = append(t.counters, c)
+	}
+
+	return c
+}
+
+// read records payload read from input
+func (t *terminalUI) read(src io.Reader, payload []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.counter(src, false)
+	c.count++
+	c.bytes += len(payload)
+
+	switch payload[0] {
+	case RequestPayload:
+		// Requests listed on paused screen can be inspected by their numbers
+		if chunkIndex, _, _ := payloadChunk(payload); chunkIndex > 0 || t.paused {
+			return
+		}
+
+		size := len(payload)
+		if size > tuiRequestSize {
+			size = tuiRequestSize
+		}
+		req := tuiRequest{time: time.Now(), payload: append([]byte(nil), payload[:size]...)}
+
+		t.recent = append(t.recent, req)
+		if len(t.recent) > tuiRecentRequests {
+			t.recent = t.recent[1:]
+		}
+	case ResponsePayload, ReplayedResponsePayload:
+		status := proto.Status(payloadBody(payload))
+		if len(status) == 0 {
+			return
+		}
+		if t.statuses[payload[0]] == nil {
+			t.statuses[payload[0]] = make(map[string]int)
+		}
+		t.statuses[payload[0]][string(status)]++
+	}
+}
+
+// write records payload written to output
+func (t *terminalUI) write(dst io.Writer, payload []byte) {
+	t.mu.Lock()
+	c := t.counter(dst, true)
+	c.count++
+	c.bytes += len(payload)
+	t.mu.Unlock()
+}
+
+// Write keeps last lines of log, since log printed to terminal would be overwritten
+func (t *terminalUI) Write(data []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		t.logs = append(t.logs, line)
+	}
+	if len(t.logs) > tuiLogLines {
+		t.logs = t.logs[len(t.logs)-tuiLogLines:]
+	}
+
+	return len(data), nil
+}
+
+// command handles line read from terminal
+func (t *terminalUI) command(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.frozen = false
+
+	line = strings.TrimSpace(line)
+	if line == "p" {
+		t.paused = true
+		return
+	}
+	if n, err := strconv.Atoi(line); err == nil && n >= 1 && n <= len(t.recent) {
+		t.paused = true
+		t.inspect = len(t.recent) - n
+		return
+	}
+
+	t.paused = false
+	t.inspect = -1
+}
+
+// run refreshes screen until input is closed
+func (t *terminalUI) run(w io.Writer, r io.Reader) {
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line := <-lines:
+			t.command(line)
+		case <-ticker.C:
+		case <-closeCh:
+			return
+		}
+
+		var buf bytes.Buffer
+		if t.render(&buf, tuiRefreshInterval) {
+			w.Write(buf.Bytes())
+		}
+	}
+}
+
+// render writes screen to w, and returns false if refreshing is paused and screen was already rendered
+func (t *terminalUI) render(w io.Writer, interval time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.frozen {
+		return false
+	}
+
+	// Clear screen and move cursor to top left corner
+	fmt.Fprint(w, "\033[H\033[2J")
+
+	if t.inspect >= 0 {
+		req := t.recent[t.inspect]
+		fmt.Fprintf(w, "Request received at %s\n\n", req.time.Format("15:04:05.000"))
+		w.Write(payloadBody(req.payload))
+		fmt.Fprint(w, "\n\nPress Enter to resume\n")
+		t.frozen = true
+		return true
+	}
+
+	fmt.Fprintf(w, "%-50s %12s %12s %12s %8s\n", "PLUGIN", "PAYLOADS", "PER SECOND", "BYTES", "QUEUE")
+	for _, c := range t.counters {
+		kind := "in "
+		if c.output {
+			kind = "out"
+		}
+		queue := "-"
+		if q, ok := c.plugin.(queuedOutput); ok {
+			queue = strconv.Itoa(q.queueLen())
+		}
+
+		rate := float64(c.count-c.last) / interval.Seconds()
+		if !t.paused {
+			c.last = c.count
+		}
+		fmt.Fprintf(w, "%s %-46.46s %12d %12.1f %12d %8s\n", kind, c.name, c.count, rate, c.bytes, queue)
+	}
+
+	for _, kind := range []byte{ResponsePayload, ReplayedResponsePayload} {
+		statuses := t.statuses[kind]
+		if len(statuses) == 0 {
+			continue
+		}
+
+		codes := make([]string, 0, len(statuses))
+		for code := range statuses {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+
+		title := "Original responses:"
+		if kind == ReplayedResponsePayload {
+			title = "Replayed responses:"
+		}
+		fmt.Fprint(w, "\n"+title)
+		for _, code := range codes {
+			fmt.Fprintf(w, " %s=%d", code, statuses[code])
+		}
+		fmt.Fprint(w, "\n")
+	}
+
+	fmt.Fprint(w, "\nRecent requests:\n")
+	for k := len(t.recent) - 1; k >= 0; k-- {
+		body := payloadBody(t.recent[k].payload)
+		fmt.Fprintf(w, "%3d %s %s %s\n", len(t.recent)-k, t.recent[k].time.Format("15:04:05.000"), proto.Method(body), proto.Path(body))
+	}
+
+	if len(t.logs) > 0 {
+		fmt.Fprint(w, "\n"+strings.Join(t.logs, "\n")+"\n")
+	}
+
+	if t.paused {
+		fmt.Fprint(w, "\nPaused, press Enter to resume\n")
+		t.frozen = true
+	} else {
+		fmt.Fprint(w, "\nEnter p to pause, or number of request to inspect it\n")
+	}
+
+	return true
+}
@@ -0,0 +1,55 @@
+package goreplay
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTerminalUI(t *testing.T) {
+	input := NewTestInput()
+	output := NewTestOutput(func(data []byte) {})
+	ui := newTerminalUI(&InOutPlugins{Inputs: []io.Reader{input}, Outputs: []io.Writer{output}})
+
+	req := append(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), []byte("GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n")...)
+	resp := append(payloadHeader(ResponsePayload, uuid(), time.Now().UnixNano(), 1), []byte("HTTP/1.1 404 Not Found\r\n\r\n")...)
+
+	ui.read(input, req)
+	ui.read(input, resp)
+	ui.write(output, req)
+
+	var screen bytes.Buffer
+	ui.render(&screen, time.Second)
+	for _, expected := range []string{"in  " + input.String(), "out " + output.String(), "Original responses: 404=1", "  1 ", "GET /first"} {
+		if !strings.Contains(screen.String(), expected) {
+			t.Errorf("Screen should contain %q:\n%s", expected, screen.String())
+		}
+	}
+
+	// Requests are not listed while paused, so their numbers don't change
+	ui.command("p")
+	ui.read(input, append(payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), []byte("GET /second HTTP/1.1\r\n\r\n")...))
+	screen.Reset()
+	if !ui.render(&screen, time.Second) || strings.Contains(screen.String(), "/second") {
+		t.Error("Paused screen should be rendered without new requests:\n", screen.String())
+	}
+	if ui.render(&screen, time.Second) {
+		t.Error("Paused screen should not be refreshed")
+	}
+
+	ui.command("1")
+	screen.Reset()
+	ui.render(&screen, time.Second)
+	if !strings.Contains(screen.String(), "Host: example.com") {
+		t.Error("Inspect view should show request:\n", screen.String())
+	}
+
+	ui.command("")
+	screen.Reset()
+	ui.render(&screen, time.Second)
+	if !strings.Contains(screen.String(), "Enter p to pause") {
+		t.Error("Refreshing should be resumed:\n", screen.String())
+	}
+}
@@ -0,0 +1,184 @@
+package goreplay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Requests captured during --verify are not tracked beyond this number, so memory stays bounded
+const maxVerifiedRequests = 1000000
+
+// deliveryVerifier checks that mirroring is not silently lossy. It tracks requests read from inputs during --verify,
+// and --output-http sends them with probe header set to request ID. Target echoing probe header back in response
+// confirms it accepted request. Requests dropped by filters and by memory budget are reported separately, so share of
+// requests which passed filters confirmed by target is delivery ratio.
+type deliveryVerifier struct {
+	header []byte
+
+	mu       sync.Mutex
+	stopped  bool
+	reported bool
+	// Requests waiting for response with probe header, true if request was not written to output shed by memory
+	// budget
+	pending  map[string]bool
+	captured int
+	filtered int
+	// Requests sampled by memory budget, or not answered after they were not written to shed output
+	budget   int
+	accepted int
+	// Responses without probe header, e.g. target or proxy in front of it doesn't echo it
+	unechoed int
+	failed   int
+	// Requests captured when maxVerifiedRequests were tracked
+	untracked int
+}
+
+// mirrorVerifier is verifier of --verify, nil if delivery is not verified
+var mirrorVerifier *deliveryVerifier
+
+func newDeliveryVerifier(header string) *deliveryVerifier {
+	return &deliveryVerifier{header: []byte(header), pending: make(map[string]bool)}
+}
+
+// capture tracks request read from input
+func (v *deliveryVerifier) capture(id []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.stopped {
+		return
+	}
+	if len(v.pending) >= maxVerifiedRequests {
+		v.untracked++
+		return
+	}
+	if _, ok := v.pending[string(id)]; !ok {
+		v.pending[string(id)] = false
+		v.captured++
+	}
+}
+
+// filter stops tracking request dropped by filters on purpose
+func (v *deliveryVerifier) filter(id []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.pending[string(id)]; ok {
+		delete(v.pending, string(id))
+		v.filtered++
+	}
+}
+
+// shed marks request dropped by memory budget. Sampled request is not written to any output, while request not written
+// to shed output can still be accepted by other outputs.
+func (v *deliveryVerifier) shed(id []byte, sampled bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.pending[string(id)]; !ok {
+		return
+	}
+	if sampled {
+		delete(v.pending, string(id))
+		v.budget++
+		return
+	}
+	v.pending[string(id)] = true
+}
+
+// probe tells if request is tracked, and should be sent with probe header
+func (v *deliveryVerifier) probe(id []byte) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	_, ok := v.pending[string(id)]
+	return ok
+}
+
+// response counts result of sending probed request. Request sent to several outputs is counted once, by its first
+// response echoing probe header.
+func (v *deliveryVerifier) response(id, resp []byte, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.pending[string(id)]; !ok {
+		return
+	}
+
+	switch {
+	case err != nil:
+		v.failed++
+	case bytes.Equal(proto.Header(resp, v.header), id):
+		v.accepted++
+	default:
+		v.unechoed++
+	}
+	delete(v.pending, string(id))
+}
+
+// stop stops tracking new requests
+func (v *deliveryVerifier) stop() {
+	v.mu.Lock()
+	v.stopped = true
+	v.mu.Unlock()
+}
+
+// wait waits until all tracked requests get response, or grace period passes
+func (v *deliveryVerifier) wait(grace time.Duration) {
+	for deadline := time.Now().Add(grace); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		v.mu.Lock()
+		pending := len(v.pending)
+		v.mu.Unlock()
+
+		if pending == 0 {
+			return
+		}
+	}
+}
+
+// report writes counters and delivery ratio, once. Requests which didn't get response were lost on the way, e.g.
+// dropped by full output queue or by output limit.
+func (v *deliveryVerifier) report(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.reported {
+		return
+	}
+	v.reported = true
+
+	budget, lost := v.budget, 0
+	for _, shed := range v.pending {
+		if shed {
+			budget++
+		} else {
+			lost++
+		}
+	}
+
+	ratio := 0.0
+	if expected := v.captured - v.filtered; expected > 0 {
+		ratio = float64(v.accepted) / float64(expected) * 100
+	}
+
+	fmt.Fprintf(w, "[VERIFY] Captured requests: %d\n", v.captured)
+	fmt.Fprintf(w, "[VERIFY] Filtered: %d\n", v.filtered)
+	fmt.Fprintf(w, "[VERIFY] Dropped by memory budget: %d\n", budget)
+	fmt.Fprintf(w, "[VERIFY] Accepted by target: %d\n", v.accepted)
+	fmt.Fprintf(w, "[VERIFY] Responses without %s header: %d\n", v.header, v.unechoed)
+	fmt.Fprintf(w, "[VERIFY] Failed: %d\n", v.failed)
+	fmt.Fprintf(w, "[VERIFY] Lost: %d\n", lost)
+	if v.untracked > 0 {
+		fmt.Fprintf(w, "[VERIFY] Not tracked: %d\n", v.untracked)
+	}
+	fmt.Fprintf(w, "[VERIFY] Delivery ratio: %.2f%%\n", ratio)
+
+	if v.accepted == 0 && v.unechoed > 0 {
+		fmt.Fprintf(w, "[VERIFY] Target doesn't echo %s header back, configure it or proxy in front of it to copy header to response\n", v.header)
+	}
+}
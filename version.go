@@ -1,4 +1,4 @@
-package main
+package goreplay
 
 // VERSION the current version of goreplay
 const VERSION = "1.0.0"
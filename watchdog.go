@@ -0,0 +1,213 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Health checks of watchdog
+const (
+	healthKernelDrops       = "kernel_drops"
+	healthAssemblerOverflow = "assembler_overflow"
+	healthQueueSaturation   = "queue_saturation"
+)
+
+var healthChecks = map[string]string{
+	healthKernelDrops:       "packets dropped by kernel or network interface, consider increasing --input-raw-buffer-size or using af_packet engine",
+	healthAssemblerOverflow: "TCP assembler can't keep up with captured packets, or messages exceed --input-raw-stream-memory-limit",
+	healthQueueSaturation:   "output queue is full, output can't keep up with captured traffic",
+}
+
+const (
+	// Interval of checking health of plugins
+	watchdogInterval = 5 * time.Second
+	// Share of queue capacity considered saturated
+	watchdogQueueThreshold = 0.9
+)
+
+// healthSample is state of single check of plugin
+type healthSample struct {
+	check  string
+	source string
+	// Counter of lost packets or messages, it increases while traffic is lost
+	lost uint64
+	// Share of queue capacity used, from 0 to 1
+	usage float64
+}
+
+// healthReporter is implemented by plugins which can detect lost traffic
+type healthReporter interface {
+	healthSamples() []healthSample
+}
+
+type healthState struct {
+	lost  uint64
+	usage float64
+	// Time problem was first seen at, zero if check is healthy, and lost counter at that time
+	badSince  time.Time
+	lostSince uint64
+	alarmed   bool
+}
+
+// healthEvent is logged, and sent to webhook as JSON
+type healthEvent struct {
+	// `alarm` or `recovered`
+	State   string    `json:"state"`
+	Check   string    `json:"check"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// watchdog checks health of plugins, and raises alarm when traffic is lost during sustain period: kernel drops
+// packets, TCP assembler is overflown, or output queue is saturated. Alarms are logged, exposed by admin API metrics,
+// and optionally sent to webhook, so capture loss is not silent.
+type watchdog struct {
+	plugins *InOutPlugins
+	sustain time.Duration
+	webhook string
+	client  *http.Client
+
+	mu     sync.Mutex
+	states map[[2]string]*healthState
+}
+
+var captureWatchdog *watchdog
+
+func newWatchdog(plugins *InOutPlugins, sustain time.Duration, webhook string) *watchdog {
+	return &watchdog{
+		plugins: plugins,
+		sustain: sustain,
+		webhook: webhook,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		states:  make(map[[2]string]*healthState),
+	}
+}
+
+func (w *watchdog) run() {
+	interval := watchdogInterval
+	if w.sustain < interval {
+		interval = w.sustain
+	}
+
+	for now := range time.Tick(interval) {
+		w.check(now)
+	}
+}
+
+// check samples health of all plugins. Check is unhealthy if lost counter increased since previous sample, or queue
+// is saturated.
+func (w *watchdog) check(now time.Time) {
+	var events []healthEvent
+
+	w.mu.Lock()
+	for _, p := range w.plugins.All {
+		r, ok := p.(healthReporter)
+		if !ok {
+			continue
+		}
+
+		for _, sample := range r.healthSamples() {
+			key := [2]string{sample.check, sample.source}
+			st := w.states[key]
+			if st == nil {
+				// Counters before the first sample are not known to be lost during sustain period
+				w.states[key] = &healthState{lost: sample.lost, usage: sample.usage}
+				continue
+			}
+
+			if sample.lost > st.lost || sample.usage >= watchdogQueueThreshold {
+				if st.badSince.IsZero() {
+					st.badSince = now
+					st.lostSince = st.lost
+				}
+
+				if !st.alarmed && now.Sub(st.badSince) >= w.sustain {
+					st.alarmed = true
+					message := fmt.Sprintf("%s: %d lost, %.0f%% of queue used during %v", healthChecks[sample.check], sample.lost-st.lostSince, sample.usage*100, now.Sub(st.badSince))
+					events = append(events, healthEvent{"alarm", sample.check, sample.source, message, now})
+				}
+			} else {
+				if st.alarmed {
+					message := fmt.Sprintf("%d lost in total during %v", st.lost-st.lostSince, now.Sub(st.badSince))
+					events = append(events, healthEvent{"recovered", sample.check, sample.source, message, now})
+				}
+				st.badSince = time.Time{}
+				st.alarmed = false
+			}
+
+			st.lost, st.usage = sample.lost, sample.usage
+		}
+	}
+	w.mu.Unlock()
+
+	for _, e := range events {
+		if e.State == "alarm" {
+			log.Printf("[WATCHDOG] ALARM %s %s: %s\n", e.Check, e.Source, e.Message)
+		} else {
+			log.Printf("[WATCHDOG] Recovered %s %s: %s\n", e.Check, e.Source, e.Message)
+		}
+
+		if w.webhook != "" {
+			go w.notify(e)
+		}
+
+		notify("watchdog_"+e.State, e.Message, map[string]interface{}{"check": e.Check, "source": e.Source})
+	}
+}
+
+func (w *watchdog) notify(e healthEvent) {
+	body, _ := json.Marshal(e)
+
+	resp, err := w.client.Post(w.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("[WATCHDOG] Webhook error:", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Println("[WATCHDOG] Webhook responded with status", resp.Status)
+	}
+}
+
+// writeMetrics writes state of checks in Prometheus text format
+func (w *watchdog) writeMetrics(out io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.states) == 0 {
+		return
+	}
+
+	keys := make([][2]string, 0, len(w.states))
+	for key := range w.states {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+
+	fmt.Fprintln(out, "# HELP gor_watchdog_alarm Whether traffic is lost during sustain period, by check and source.")
+	fmt.Fprintln(out, "# TYPE gor_watchdog_alarm gauge")
+	for _, key := range keys {
+		alarm := 0
+		if w.states[key].alarmed {
+			alarm = 1
+		}
+		fmt.Fprintf(out, "gor_watchdog_alarm{check=%q,source=%q} %d\n", key[0], key[1], alarm)
+	}
+
+	fmt.Fprintln(out, "# HELP gor_watchdog_lost_total Packets or messages lost, by check and source.")
+	fmt.Fprintln(out, "# TYPE gor_watchdog_lost_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(out, "gor_watchdog_lost_total{check=%q,source=%q} %d\n", key[0], key[1], w.states[key].lost)
+	}
+}
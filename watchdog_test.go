@@ -0,0 +1,86 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testHealthReporter struct {
+	TestOutput
+	samples []healthSample
+}
+
+func (r *testHealthReporter) healthSamples() []healthSample {
+	return r.samples
+}
+
+func TestWatchdog(t *testing.T) {
+	events := make(chan healthEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e healthEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer webhook.Close()
+
+	reporter := &testHealthReporter{samples: []healthSample{
+		{check: healthKernelDrops, source: "input_raw::80"},
+		{check: healthQueueSaturation, source: "output_http:staging.com"},
+	}}
+	plugins := NewPlugins()
+	plugins.AddPlugin(reporter, "")
+
+	w := newWatchdog(plugins, 10*time.Second, webhook.URL)
+	now := time.Now()
+	w.check(now)
+
+	// Drops in every check during sustain period raise alarm, single saturated sample does not
+	for i := 1; i <= 3; i++ {
+		reporter.samples[0].lost += 100
+		reporter.samples[1].usage = float64(i%2) * 0.95
+		w.check(now.Add(time.Duration(i) * 5 * time.Second))
+	}
+
+	select {
+	case e := <-events:
+		if e.State != "alarm" || e.Check != healthKernelDrops || e.Source != "input_raw::80" || !strings.Contains(e.Message, "300 lost") {
+			t.Errorf("Expected alarm of kernel drops, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected alarm to be sent to webhook")
+	}
+
+	var buf bytes.Buffer
+	w.writeMetrics(&buf)
+	for _, line := range []string{
+		`gor_watchdog_alarm{check="kernel_drops",source="input_raw::80"} 1`,
+		`gor_watchdog_alarm{check="queue_saturation",source="output_http:staging.com"} 0`,
+		`gor_watchdog_lost_total{check="kernel_drops",source="input_raw::80"} 300`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+
+	w.check(now.Add(20 * time.Second))
+
+	select {
+	case e := <-events:
+		if e.State != "recovered" || e.Check != healthKernelDrops {
+			t.Errorf("Expected recovery of kernel drops, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected recovery to be sent to webhook")
+	}
+
+	select {
+	case e := <-events:
+		t.Errorf("Unexpected event %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
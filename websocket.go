@@ -0,0 +1,241 @@
+package goreplay
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+	wsMaxMessage   = 64 << 20
+)
+
+// websocketConn is client connection of WebSocket protocol. Messages are read by single goroutine, and written
+// concurrently.
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex
+	writer *bufio.Writer
+}
+
+// dialWebSocket opens WebSocket connection to `ws://` or `wss://` URL, with additional headers of handshake request
+func dialWebSocket(u *url.URL, header http.Header) (*websocketConn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if u.Scheme == "wss" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = net.DialTimeout("tcp", host, 5*time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	c := &websocketConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(c.reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake failed: %s %s", resp.Status, body)
+	}
+
+	accept := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		conn.Close()
+		return nil, errors.New("WebSocket handshake failed: wrong Sec-WebSocket-Accept")
+	}
+	conn.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+// writeFrame writes single frame, masked as required from clients. Should be called under lock.
+func (c *websocketConn) writeFrame(opcode byte, data []byte) {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+	switch {
+	case len(data) < 126:
+		header[1] = 0x80 | byte(len(data))
+	case len(data) <= 0xffff:
+		header[1] = 0x80 | 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+	default:
+		header[1] = 0x80 | 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(len(data)))
+	}
+
+	var mask [4]byte
+	rand.Read(mask[:])
+	c.writer.Write(header)
+	c.writer.Write(mask[:])
+
+	masked := make([]byte, len(data))
+	for i, b := range data {
+		masked[i] = b ^ mask[i%4]
+	}
+	c.writer.Write(masked)
+}
+
+// writeMessage writes message in single frame, messages are buffered until there are enough of them or flush is
+// requested
+func (c *websocketConn) writeMessage(opcode byte, data []byte, flush bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeFrame(opcode, data)
+	if !flush && c.writer.Buffered() < 32<<10 {
+		return nil
+	}
+	return c.writer.Flush()
+}
+
+// Flush sends buffered messages
+func (c *websocketConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writer.Flush()
+}
+
+// readMessage reads data message, joining its fragments. Pings are answered, and io.EOF is returned when server
+// closes connection.
+func (c *websocketConn) readMessage() (opcode byte, data []byte, err error) {
+	for {
+		var header [2]byte
+		if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+			return
+		}
+		fin, op := header[0]&0x80 != 0, header[0]&0x0f
+
+		size := uint64(header[1] & 0x7f)
+		switch size {
+		case 126:
+			var ext [2]byte
+			if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+				return
+			}
+			size = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+				return
+			}
+			size = binary.BigEndian.Uint64(ext[:])
+		}
+		if size+uint64(len(data)) > wsMaxMessage {
+			return 0, nil, errors.New("WebSocket message is too large")
+		}
+
+		var mask [4]byte
+		masked := header[1]&0x80 != 0
+		if masked {
+			if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+				return
+			}
+		}
+
+		payload := make([]byte, size)
+		if _, err = io.ReadFull(c.reader, payload); err != nil {
+			return
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch op {
+		case wsPing:
+			c.writeMessage(wsPong, payload, true)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeMessage(wsClose, payload, true)
+			return 0, nil, io.EOF
+		case wsContinuation:
+		default:
+			opcode = op
+		}
+
+		data = append(data, payload...)
+		if fin {
+			return opcode, data, nil
+		}
+	}
+}
+
+// Close closes connection
+func (c *websocketConn) Close() error {
+	c.mu.Lock()
+	c.writeFrame(wsClose, []byte{0x03, 0xe8})
+	c.writer.Flush()
+	c.mu.Unlock()
+
+	return c.conn.Close()
+}